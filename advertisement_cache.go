@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+)
+
+// AdvertisementCacheKey is the key of an encoded advertisement.
+type AdvertisementCacheKey struct {
+	// Repository identifies the repository.
+	Repository string
+	// Profile identifies everything else that changes the encoded bytes,
+	// such as the service, the protocol version, and the capabilities
+	// advertised.
+	Profile string
+}
+
+// AdvertisementCache caches encoded ref advertisements. It's safe for
+// concurrent use.
+//
+// Every entry has a validator, an opaque string that changes when the refs
+// change (e.g. a ref database version). An entry is served only if the
+// validator matches the current one. Concurrent misses of the same key
+// generate the advertisement only once.
+type AdvertisementCache struct {
+	m            sync.Mutex
+	entries      map[AdvertisementCacheKey]*advertisementCacheEntry
+	pending      map[AdvertisementCacheKey]*advertisementCacheCall
+	onInvalidate []func(AdvertisementCacheKey)
+}
+
+type advertisementCacheEntry struct {
+	validator string
+	data      []byte
+}
+
+type advertisementCacheCall struct {
+	validator string
+	done      chan struct{}
+	data      []byte
+	err       error
+}
+
+// NewAdvertisementCache returns a new AdvertisementCache.
+func NewAdvertisementCache() *AdvertisementCache {
+	return &AdvertisementCache{
+		entries: map[AdvertisementCacheKey]*advertisementCacheEntry{},
+		pending: map[AdvertisementCacheKey]*advertisementCacheCall{},
+	}
+}
+
+// OnInvalidate registers a callback called with the key of every entry
+// removed by Invalidate, InvalidateRepository, or a validator mismatch.
+func (c *AdvertisementCache) OnInvalidate(f func(AdvertisementCacheKey)) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.onInvalidate = append(c.onInvalidate, f)
+}
+
+// Get returns the cached advertisement if the entry exists and its validator
+// matches. The returned bytes must not be modified.
+func (c *AdvertisementCache) Get(key AdvertisementCacheKey, validator string) ([]byte, bool) {
+	c.m.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.m.Unlock()
+		return nil, false
+	}
+	if e.validator != validator {
+		delete(c.entries, key)
+		callbacks := c.onInvalidate
+		c.m.Unlock()
+		for _, f := range callbacks {
+			f(key)
+		}
+		return nil, false
+	}
+	c.m.Unlock()
+	return e.data, true
+}
+
+// Put stores an encoded advertisement.
+func (c *AdvertisementCache) Put(key AdvertisementCacheKey, validator string, data []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.entries[key] = &advertisementCacheEntry{validator: validator, data: data}
+}
+
+// Invalidate removes the entry of the key.
+func (c *AdvertisementCache) Invalidate(key AdvertisementCacheKey) {
+	c.invalidate(func(k AdvertisementCacheKey) bool { return k == key })
+}
+
+// InvalidateRepository removes all entries of the repository.
+func (c *AdvertisementCache) InvalidateRepository(repository string) {
+	c.invalidate(func(k AdvertisementCacheKey) bool { return k.Repository == repository })
+}
+
+func (c *AdvertisementCache) invalidate(match func(AdvertisementCacheKey) bool) {
+	c.m.Lock()
+	var removed []AdvertisementCacheKey
+	for k := range c.entries {
+		if match(k) {
+			delete(c.entries, k)
+			removed = append(removed, k)
+		}
+	}
+	callbacks := c.onInvalidate
+	c.m.Unlock()
+	for _, k := range removed {
+		for _, f := range callbacks {
+			f(k)
+		}
+	}
+}
+
+// GetOrGenerate returns the cached advertisement, or generates one with gen
+// and caches it. gen writes the encoded packets to the writer. If gen fails,
+// nothing is cached.
+func (c *AdvertisementCache) GetOrGenerate(key AdvertisementCacheKey, validator string, gen func(io.Writer) error) ([]byte, error) {
+	if data, ok := c.Get(key, validator); ok {
+		return data, nil
+	}
+	c.m.Lock()
+	if call, ok := c.pending[key]; ok && call.validator == validator {
+		c.m.Unlock()
+		<-call.done
+		return call.data, call.err
+	}
+	call := &advertisementCacheCall{validator: validator, done: make(chan struct{})}
+	c.pending[key] = call
+	c.m.Unlock()
+
+	// If gen panics, the waiters get errGeneratePanicked and the panic goes
+	// on in this goroutine.
+	call.err = errGeneratePanicked
+	defer func() {
+		c.m.Lock()
+		if c.pending[key] == call {
+			delete(c.pending, key)
+		}
+		if call.err == nil {
+			c.entries[key] = &advertisementCacheEntry{validator: validator, data: call.data}
+		}
+		c.m.Unlock()
+		close(call.done)
+	}()
+
+	var buf bytes.Buffer
+	call.err = gen(&buf)
+	if call.err == nil {
+		call.data = buf.Bytes()
+	}
+	return call.data, call.err
+}
+
+var errGeneratePanicked = errors.New("gitprotocolio: the advertisement generator panicked")
+
+// ServeTo writes the cached advertisement to w, generating it with gen if
+// needed. See GetOrGenerate.
+func (c *AdvertisementCache) ServeTo(w io.Writer, key AdvertisementCacheKey, validator string, gen func(io.Writer) error) error {
+	data, err := c.GetOrGenerate(key, validator, gen)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdvertisementCache(t *testing.T) {
+	c := NewAdvertisementCache()
+	var invalidated []AdvertisementCacheKey
+	c.OnInvalidate(func(k AdvertisementCacheKey) { invalidated = append(invalidated, k) })
+	a := AdvertisementCacheKey{Repository: "a", Profile: "v0"}
+	a2 := AdvertisementCacheKey{Repository: "a", Profile: "v2"}
+	b := AdvertisementCacheKey{Repository: "b", Profile: "v0"}
+
+	c.Put(a, "1", []byte("a"))
+	c.Put(a2, "1", []byte("a2"))
+	c.Put(b, "1", []byte("b"))
+	if data, ok := c.Get(a, "1"); !ok || string(data) != "a" {
+		t.Errorf("got %q, %v", data, ok)
+	}
+	if _, ok := c.Get(a, "2"); ok {
+		t.Error("got an entry of a stale validator")
+	}
+	if _, ok := c.Get(a, "1"); ok {
+		t.Error("the stale entry is not removed")
+	}
+	c.InvalidateRepository("a")
+	c.Invalidate(b)
+	if want := []AdvertisementCacheKey{a, a2, b}; !reflect.DeepEqual(invalidated, want) {
+		t.Errorf("invalidated %v, want %v", invalidated, want)
+	}
+}
+
+func TestAdvertisementCacheGetOrGenerate(t *testing.T) {
+	c := NewAdvertisementCache()
+	key := AdvertisementCacheKey{Repository: "a"}
+	calls := 0
+	gen := func(w io.Writer) error {
+		calls++
+		_, err := io.WriteString(w, "refs")
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		data, err := c.GetOrGenerate(key, "1", gen)
+		if err != nil || string(data) != "refs" {
+			t.Errorf("got %q, %v", data, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("gen is called %d times", calls)
+	}
+
+	errGen := errors.New("failed")
+	if _, err := c.GetOrGenerate(key, "2", func(io.Writer) error { return errGen }); err != errGen {
+		t.Errorf("got %v, want %v", err, errGen)
+	}
+	if _, ok := c.Get(key, "2"); ok {
+		t.Error("a failed generation is cached")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic is not propagated")
+			}
+		}()
+		c.GetOrGenerate(key, "3", func(io.Writer) error { panic("gen") })
+	}()
+	// The key is not left pending.
+	if data, err := c.GetOrGenerate(key, "3", gen); err != nil || string(data) != "refs" {
+		t.Errorf("after a panic: got %q, %v", data, err)
+	}
+}
+
+func TestAdvertisementCacheGetOrGeneratePanicWaiter(t *testing.T) {
+	c := NewAdvertisementCache()
+	key := AdvertisementCacheKey{Repository: "a"}
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.GetOrGenerate(key, "1", func(io.Writer) error {
+			close(started)
+			<-release
+			panic("gen")
+		})
+	}()
+	<-started
+	done := make(chan struct{})
+	go func() {
+		// It gets the error of the panic if it waits for the first call,
+		// or generates the advertisement itself.
+		c.GetOrGenerate(key, "1", func(io.Writer) error { return nil })
+		close(done)
+	}()
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("the waiter is blocked after a panic")
+	}
+}
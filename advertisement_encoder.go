@@ -0,0 +1,249 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"sort"
+)
+
+// defaultAdvertisementFlushInterval is the number of refs between flushes by
+// default.
+const defaultAdvertisementFlushInterval = 1000
+
+// AdvertisedRef is a ref in a ref advertisement or an ls-refs response.
+type AdvertisedRef struct {
+	Name     string
+	ObjectID string
+	// Peeled is the object ID the annotated tag points to, "" otherwise.
+	Peeled string
+	// SymrefTarget is the target of a symbolic ref, "" otherwise. It's sent
+	// only by ls-refs with the "symrefs" argument.
+	SymrefTarget string
+}
+
+// RefIterator calls yield for each ref. It stops and returns the error when
+// yield returns an error.
+type RefIterator func(yield func(*AdvertisedRef) error) error
+
+// RefSlice returns a RefIterator over the refs.
+func RefSlice(refs []*AdvertisedRef) RefIterator {
+	return func(yield func(*AdvertisedRef) error) error {
+		for _, r := range refs {
+			if err := yield(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// SortAdvertisedRefs sorts the refs in the order git advertises them: HEAD
+// first, then bytewise by the ref name. A peeled tag is sent right after its
+// tag as a part of the AdvertisedRef.
+func SortAdvertisedRefs(refs []*AdvertisedRef) {
+	sort.SliceStable(refs, func(i, j int) bool {
+		if (refs[i].Name == "HEAD") != (refs[j].Name == "HEAD") {
+			return refs[i].Name == "HEAD"
+		}
+		return refs[i].Name < refs[j].Name
+	})
+}
+
+// AdvertisementEncoder writes ref advertisements and ls-refs responses,
+// streaming the refs as the iterator produces them. It flushes the writer
+// every FlushInterval refs if the writer has a Flush method, such as
+// *bufio.Writer and http.ResponseWriter, so the client starts receiving the
+// refs before all of them are produced.
+type AdvertisementEncoder struct {
+	w io.Writer
+	// FlushInterval is the number of refs between flushes. If it's zero,
+	// 1000 is used. If it's negative, the writer is flushed only at the end.
+	FlushInterval int
+	// SortRefs sorts the refs with SortAdvertisedRefs. Otherwise, the refs
+	// are sent in the order of the iterator. Sorting needs all the refs in
+	// memory, so the first ref is sent after the iterator finishes.
+	SortRefs bool
+	// Visibility hides refs as Git's hideRefs configuration does.
+	// EncodeInfoRefs uses the rules of its service, or only the Transfer
+	// rules without a service, and EncodeLsRefs the rules of
+	// git-upload-pack. A "symref=" capability or a symref target that names
+	// a hidden ref is dropped. If nil, every ref is advertised.
+	Visibility *RefVisibility
+
+	count int
+}
+
+// NewAdvertisementEncoder returns a new AdvertisementEncoder that writes to w.
+func NewAdvertisementEncoder(w io.Writer) *AdvertisementEncoder {
+	return &AdvertisementEncoder{w: w}
+}
+
+func (e *AdvertisementEncoder) write(c Packet) error {
+	_, err := e.w.Write(c.EncodeToPktLine())
+	return err
+}
+
+func (e *AdvertisementEncoder) flush() error {
+	switch f := e.w.(type) {
+	case interface{ Flush() error }:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
+// iterate calls yield for each ref, sorted if SortRefs is true.
+func (e *AdvertisementEncoder) iterate(refs RefIterator, yield func(*AdvertisedRef) error) error {
+	if !e.SortRefs {
+		return refs(yield)
+	}
+	var all []*AdvertisedRef
+	if err := refs(func(r *AdvertisedRef) error {
+		all = append(all, r)
+		return nil
+	}); err != nil {
+		return err
+	}
+	SortAdvertisedRefs(all)
+	return RefSlice(all)(yield)
+}
+
+// visible returns the filter of the refs visible for the service, or nil if
+// every ref is visible.
+func (e *AdvertisementEncoder) visible(service string) RefFilter {
+	if e.Visibility == nil {
+		return nil
+	}
+	return keepRefs(func(ref string) bool {
+		return !e.Visibility.IsHidden(service, ref)
+	})
+}
+
+// filterRefs returns the refs that the filter keeps. The symref targets that
+// it hides are cleared.
+func filterRefs(refs RefIterator, f RefFilter) RefIterator {
+	if f == nil {
+		return refs
+	}
+	return func(yield func(*AdvertisedRef) error) error {
+		return refs(func(r *AdvertisedRef) error {
+			if _, ok := f(r.Name); !ok {
+				return nil
+			}
+			if r.SymrefTarget != "" && f.symrefTarget(r.SymrefTarget) == "" {
+				rr := *r
+				rr.SymrefTarget = ""
+				r = &rr
+			}
+			return yield(r)
+		})
+	}
+}
+
+// wroteRef counts a ref and flushes the writer at the interval.
+func (e *AdvertisementEncoder) wroteRef() error {
+	e.count++
+	interval := e.FlushInterval
+	if interval == 0 {
+		interval = defaultAdvertisementFlushInterval
+	}
+	if interval > 0 && e.count%interval == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+// EncodeInfoRefs writes a protocol v0/v1 ref advertisement. If service is not
+// empty, the smart HTTP "# service=" header is written first. The capabilities
+// are attached to the first ref, or to a "capabilities^{}" line if there is no
+// ref.
+func (e *AdvertisementEncoder) EncodeInfoRefs(service string, caps []string, refs RefIterator) error {
+	if service != "" {
+		if err := e.write(&InfoRefsResponseChunk{ServiceHeader: service}); err != nil {
+			return err
+		}
+		if err := e.write(&InfoRefsResponseChunk{ServiceHeaderFlush: true}); err != nil {
+			return err
+		}
+	}
+	visible := e.visible(service)
+	if visible != nil {
+		caps = visible.symrefCapabilities(caps)
+	}
+	if caps == nil {
+		caps = []string{}
+	}
+	first := true
+	err := e.iterate(filterRefs(refs, visible), func(r *AdvertisedRef) error {
+		c := &InfoRefsResponseChunk{ObjectID: r.ObjectID, Ref: r.Name}
+		if first {
+			c.Capabilities = caps
+			first = false
+		}
+		if err := e.write(c); err != nil {
+			return err
+		}
+		if r.Peeled != "" {
+			if err := e.write(&InfoRefsResponseChunk{ObjectID: r.Peeled, Ref: r.Name + "^{}"}); err != nil {
+				return err
+			}
+		}
+		return e.wroteRef()
+	})
+	if err != nil {
+		return err
+	}
+	if first {
+		c := &InfoRefsResponseChunk{
+			Capabilities: caps,
+			ObjectID:     ObjectFormatFromCapabilities(caps).ZeroObjectID(),
+			Ref:          "capabilities^{}",
+		}
+		if err := e.write(c); err != nil {
+			return err
+		}
+	}
+	if err := e.write(&InfoRefsResponseChunk{EndOfRequest: true}); err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// EncodeLsRefs writes a protocol v2 ls-refs response. peel and symrefs are the
+// ls-refs arguments of the same names.
+func (e *AdvertisementEncoder) EncodeLsRefs(refs RefIterator, peel, symrefs bool) error {
+	err := e.iterate(filterRefs(refs, e.visible("git-upload-pack")), func(r *AdvertisedRef) error {
+		c := &LsRefsResponseChunk{ObjectID: r.ObjectID, Ref: r.Name}
+		if symrefs {
+			c.SymrefTarget = r.SymrefTarget
+		}
+		if peel {
+			c.Peeled = r.Peeled
+		}
+		if err := e.write(c); err != nil {
+			return err
+		}
+		return e.wroteRef()
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.write(&ProtocolV2ResponseChunk{EndResponse: true}); err != nil {
+		return err
+	}
+	return e.flush()
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testAdvertisedRefs() []*AdvertisedRef {
+	return []*AdvertisedRef{
+		{Name: "HEAD", ObjectID: oidA, SymrefTarget: "refs/heads/main"},
+		{Name: "refs/heads/main", ObjectID: oidA},
+		{Name: "refs/tags/v1", ObjectID: oidB, Peeled: oidA},
+	}
+}
+
+func TestAdvertisementEncoderInfoRefs(t *testing.T) {
+	var b bytes.Buffer
+	e := NewAdvertisementEncoder(&b)
+	if err := e.EncodeInfoRefs("git-upload-pack", []string{"ofs-delta", "symref=HEAD:refs/heads/main"}, RefSlice(testAdvertisedRefs())); err != nil {
+		t.Fatal(err)
+	}
+	want := pktLines(
+		"# service=git-upload-pack\n",
+		"0000",
+		oidA+" HEAD\x00ofs-delta symref=HEAD:refs/heads/main\n",
+		oidA+" refs/heads/main\n",
+		oidB+" refs/tags/v1\n",
+		oidA+" refs/tags/v1^{}\n",
+		"0000",
+	)
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	// The output is parsed back.
+	r := NewInfoRefsResponse(&b)
+	var refs []string
+	for r.Scan() {
+		if c := r.Chunk(); c.Ref != "" {
+			refs = append(refs, c.Ref)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"HEAD", "refs/heads/main", "refs/tags/v1", "refs/tags/v1^{}"}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("got %q, want %q", refs, want)
+	}
+}
+
+func TestAdvertisementEncoderNoRefs(t *testing.T) {
+	for _, tc := range []struct {
+		caps []string
+		want string
+	}{
+		{nil, pktLines(strings.Repeat("0", 40)+" capabilities^{}\x00\n", "0000")},
+		{[]string{"object-format=sha256"}, pktLines(strings.Repeat("0", 64)+" capabilities^{}\x00object-format=sha256\n", "0000")},
+	} {
+		var b bytes.Buffer
+		if err := NewAdvertisementEncoder(&b).EncodeInfoRefs("", tc.caps, RefSlice(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.caps, b.String(), tc.want)
+		}
+	}
+}
+
+func TestAdvertisementEncoderLsRefs(t *testing.T) {
+	for _, tc := range []struct {
+		peel, symrefs bool
+		want          string
+	}{
+		{false, false, pktLines(oidA+" HEAD\n", oidA+" refs/heads/main\n", oidB+" refs/tags/v1\n", "0000")},
+		{true, true, pktLines(oidA+" HEAD symref-target:refs/heads/main\n", oidA+" refs/heads/main\n", oidB+" refs/tags/v1 peeled:"+oidA+"\n", "0000")},
+	} {
+		var b bytes.Buffer
+		if err := NewAdvertisementEncoder(&b).EncodeLsRefs(RefSlice(testAdvertisedRefs()), tc.peel, tc.symrefs); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tc.want {
+			t.Errorf("peel %v, symrefs %v: got %q, want %q", tc.peel, tc.symrefs, b.String(), tc.want)
+		}
+	}
+}
+
+func TestAdvertisementEncoderVisibility(t *testing.T) {
+	refs := append(testAdvertisedRefs(), &AdvertisedRef{Name: "refs/hidden/x", ObjectID: oidB})
+	v := &RefVisibility{Transfer: []string{"refs/hidden"}, UploadPack: []string{"refs/heads"}}
+
+	var b bytes.Buffer
+	e := NewAdvertisementEncoder(&b)
+	e.Visibility = v
+	if err := e.EncodeInfoRefs("git-upload-pack", []string{"ofs-delta", "symref=HEAD:refs/heads/main"}, RefSlice(refs)); err != nil {
+		t.Fatal(err)
+	}
+	want := pktLines(
+		"# service=git-upload-pack\n",
+		"0000",
+		oidA+" HEAD\x00ofs-delta\n",
+		oidB+" refs/tags/v1\n",
+		oidA+" refs/tags/v1^{}\n",
+		"0000",
+	)
+	if b.String() != want {
+		t.Errorf("upload-pack: got %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	if err := e.EncodeInfoRefs("git-receive-pack", nil, RefSlice(refs)); err != nil {
+		t.Fatal(err)
+	}
+	want = pktLines(
+		"# service=git-receive-pack\n",
+		"0000",
+		oidA+" HEAD\x00\n",
+		oidA+" refs/heads/main\n",
+		oidB+" refs/tags/v1\n",
+		oidA+" refs/tags/v1^{}\n",
+		"0000",
+	)
+	if b.String() != want {
+		t.Errorf("receive-pack: got %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	if err := e.EncodeLsRefs(RefSlice(refs), false, true); err != nil {
+		t.Fatal(err)
+	}
+	want = pktLines(oidA+" HEAD\n", oidB+" refs/tags/v1\n", "0000")
+	if b.String() != want {
+		t.Errorf("ls-refs: got %q, want %q", b.String(), want)
+	}
+	// The caller's refs are left untouched.
+	if refs[0].SymrefTarget != "refs/heads/main" {
+		t.Errorf("got symref target %q, want refs/heads/main", refs[0].SymrefTarget)
+	}
+}
+
+func TestAdvertisementEncoderFlushInterval(t *testing.T) {
+	refs := func(yield func(*AdvertisedRef) error) error {
+		for i := 0; i < 5; i++ {
+			if err := yield(&AdvertisedRef{Name: "refs/heads/b", ObjectID: oidA}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	refLen := len(pktLines(oidA + " refs/heads/b\n"))
+	for _, tc := range []struct {
+		interval int
+		want     []int
+	}{
+		{2, []int{2 * refLen, 4 * refLen, 5*refLen + 4}},
+		{0, []int{5*refLen + 4}},
+		{-1, []int{5*refLen + 4}},
+	} {
+		w := &flushRecorder{}
+		e := NewAdvertisementEncoder(w)
+		e.FlushInterval = tc.interval
+		if err := e.EncodeLsRefs(refs, false, false); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(w.flushes, tc.want) {
+			t.Errorf("interval %d: got %v, want %v", tc.interval, w.flushes, tc.want)
+		}
+	}
+}
+
+func TestAdvertisementEncoderErrors(t *testing.T) {
+	errRefs := errors.New("ref backend")
+	refs := func(yield func(*AdvertisedRef) error) error {
+		if err := yield(&AdvertisedRef{Name: "refs/heads/main", ObjectID: oidA}); err != nil {
+			return err
+		}
+		return errRefs
+	}
+	var b bytes.Buffer
+	if err := NewAdvertisementEncoder(&b).EncodeInfoRefs("", nil, refs); err != errRefs {
+		t.Errorf("got %v, want %v", err, errRefs)
+	}
+	if strings.HasSuffix(b.String(), FlushPkt) {
+		t.Errorf("got %q, want no flush after an error", b.String())
+	}
+	if err := NewAdvertisementEncoder(failingWriter{}).EncodeLsRefs(RefSlice(testAdvertisedRefs()), false, false); err == nil {
+		t.Error("got no error from the writer")
+	}
+}
+
+func TestAdvertisementEncoderSortRefs(t *testing.T) {
+	refs := []*AdvertisedRef{
+		{Name: "refs/tags/v1", ObjectID: oidB, Peeled: oidA},
+		{Name: "refs/heads/main", ObjectID: oidA},
+		{Name: "HEAD", ObjectID: oidA},
+		{Name: "refs/heads/Main", ObjectID: oidB},
+	}
+	var b bytes.Buffer
+	e := NewAdvertisementEncoder(&b)
+	e.SortRefs = true
+	if err := e.EncodeInfoRefs("", []string{"ofs-delta"}, RefSlice(refs)); err != nil {
+		t.Fatal(err)
+	}
+	want := pktLines(
+		oidA+" HEAD\x00ofs-delta\n",
+		oidB+" refs/heads/Main\n",
+		oidA+" refs/heads/main\n",
+		oidB+" refs/tags/v1\n",
+		oidA+" refs/tags/v1^{}\n",
+		"0000",
+	)
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	// The input is not reordered.
+	if refs[0].Name != "refs/tags/v1" {
+		t.Errorf("got %s first", refs[0].Name)
+	}
+
+	// An error of the iterator is returned before anything is sent.
+	errRefs := errors.New("ref backend")
+	b.Reset()
+	err := e.EncodeLsRefs(func(yield func(*AdvertisedRef) error) error {
+		yield(refs[0])
+		return errRefs
+	}, false, false)
+	if err != errRefs || b.Len() != 0 {
+		t.Errorf("got %v, %q, want %v and no output", err, b.String(), errRefs)
+	}
+}
+
+func TestSortAdvertisedRefs(t *testing.T) {
+	refs := []*AdvertisedRef{{Name: "refs/b"}, {Name: "HEAD"}, {Name: "refs/a"}, {Name: "HEAD"}}
+	SortAdvertisedRefs(refs)
+	var got []string
+	for _, r := range refs {
+		got = append(got, r.Name)
+	}
+	if want := []string{"HEAD", "HEAD", "refs/a", "refs/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit results.
+const (
+	// AuditResultOK means the exchange succeeded.
+	AuditResultOK = "ok"
+	// AuditResultRejected means the exchange completed, but the push was
+	// rejected in part or as a whole.
+	AuditResultRejected = "rejected"
+	// AuditResultError means the exchange failed.
+	AuditResultError = "error"
+)
+
+// AuditRefUpdate is a ref update command of a push and its result.
+type AuditRefUpdate struct {
+	RefName     string
+	OldObjectID string
+	NewObjectID string
+	// Status is "ok" or "ng", empty if the server didn't report it.
+	Status string
+	// Reason is the reason of "ng".
+	Reason string
+}
+
+// AuditRecord is the record of a completed exchange.
+type AuditRecord struct {
+	Service         string
+	ProtocolVersion int
+	// Command is the protocol v2 command, such as "fetch".
+	Command      string
+	Agent        string
+	Capabilities []string
+
+	Wants    int
+	Haves    int
+	Shallows int
+	Done     bool
+
+	RefUpdates   []*AuditRefUpdate
+	UnpackStatus string
+	// PushCert is the verification result of the push certificate, nil if
+	// the push is not signed.
+	PushCert *PushCertVerification
+
+	Result string
+	Error  string
+
+	Start    time.Time
+	Duration time.Duration
+	// Phases is the duration of each phase recorded in the SessionStats.
+	Phases map[string]time.Duration
+
+	BytesIn  int64
+	BytesOut int64
+}
+
+// ExchangeAuditor builds an AuditRecord from the chunks of an exchange and
+// passes it to a callback when the exchange ends. It's safe for concurrent
+// use, so the request and the response can be observed from different
+// goroutines.
+type ExchangeAuditor struct {
+	m     sync.Mutex
+	rec   AuditRecord
+	refs  map[string]*AuditRefUpdate
+	stats *SessionStats
+	emit  func(*AuditRecord)
+	done  bool
+}
+
+// NewExchangeAuditor returns a new ExchangeAuditor for the service (e.g.
+// "git-upload-pack"). If stats is not nil, the byte counts and the phase
+// durations are taken from it. emit is called once by Finish.
+func NewExchangeAuditor(service string, protocolVersion int, stats *SessionStats, emit func(*AuditRecord)) *ExchangeAuditor {
+	return &ExchangeAuditor{
+		rec: AuditRecord{
+			Service:         service,
+			ProtocolVersion: protocolVersion,
+			Start:           time.Now(),
+		},
+		refs:  map[string]*AuditRefUpdate{},
+		stats: stats,
+		emit:  emit,
+	}
+}
+
+func (a *ExchangeAuditor) addCapabilities(caps []string) {
+	for _, c := range caps {
+		a.rec.Capabilities = append(a.rec.Capabilities, c)
+		if strings.HasPrefix(c, "agent=") {
+			a.rec.Agent = strings.TrimPrefix(c, "agent=")
+		}
+	}
+}
+
+// ObserveUploadPackRequest records a chunk of a protocol v0/v1 upload-pack
+// request.
+func (a *ExchangeAuditor) ObserveUploadPackRequest(c *ProtocolV1UploadPackRequestChunk) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.addCapabilities(c.Capabilities)
+	switch {
+	case c.WantObjectID != "":
+		a.rec.Wants++
+	case c.ShallowObjectID != "":
+		a.rec.Shallows++
+	case c.HaveObjectID != "":
+		a.rec.Haves++
+	case c.NoMoreNegotiation:
+		a.rec.Done = true
+	}
+}
+
+// ObserveProtocolV2Request records a chunk of a protocol v2 request.
+func (a *ExchangeAuditor) ObserveProtocolV2Request(c *ProtocolV2RequestChunk) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	switch {
+	case c.Command != "":
+		a.rec.Command = c.Command
+	case c.Capability != "":
+		a.addCapabilities([]string{c.Capability})
+	case len(c.Argument) != 0:
+		arg := strings.TrimSuffix(string(c.Argument), "\n")
+		switch {
+		case strings.HasPrefix(arg, "want ") || strings.HasPrefix(arg, "want-ref "):
+			a.rec.Wants++
+		case strings.HasPrefix(arg, "have "):
+			a.rec.Haves++
+		case strings.HasPrefix(arg, "shallow "):
+			a.rec.Shallows++
+		case arg == "done":
+			a.rec.Done = true
+		}
+	}
+}
+
+// ObserveReceivePackRequest records a chunk of a receive-pack request.
+func (a *ExchangeAuditor) ObserveReceivePackRequest(c *ProtocolV1ReceivePackRequestChunk) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.addCapabilities(c.Capabilities)
+	if c.RefName == "" {
+		return
+	}
+	u := &AuditRefUpdate{
+		RefName:     c.RefName,
+		OldObjectID: c.OldObjectID,
+		NewObjectID: c.NewObjectID,
+	}
+	a.rec.RefUpdates = append(a.rec.RefUpdates, u)
+	a.refs[c.RefName] = u
+}
+
+// ObservePushCertVerification records the verification result of the push
+// certificate.
+func (a *ExchangeAuditor) ObservePushCertVerification(v *PushCertVerification) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.rec.PushCert = v
+}
+
+// ObserveReceivePackResponse records a chunk of a receive-pack response.
+func (a *ExchangeAuditor) ObserveReceivePackResponse(c *ProtocolV1ReceivePackResponseChunk) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if c.UnpackStatus != "" {
+		a.rec.UnpackStatus = c.UnpackStatus
+	}
+	if c.RefUpdateStatus == "" {
+		return
+	}
+	u, ok := a.refs[c.RefName]
+	if !ok {
+		u = &AuditRefUpdate{RefName: c.RefName}
+		a.rec.RefUpdates = append(a.rec.RefUpdates, u)
+		a.refs[c.RefName] = u
+	}
+	u.Status = c.RefUpdateStatus
+	u.Reason = c.RefUpdateFailMessage
+}
+
+// Finish completes the record with the error of the exchange, if any, and
+// passes it to the callback. Calls after the first are ignored.
+func (a *ExchangeAuditor) Finish(err error) {
+	a.m.Lock()
+	if a.done {
+		a.m.Unlock()
+		return
+	}
+	a.done = true
+	rec := a.rec
+	a.m.Unlock()
+
+	rec.Duration = time.Since(rec.Start)
+	rec.Result = AuditResultOK
+	if rec.UnpackStatus != "" && rec.UnpackStatus != "ok" {
+		rec.Result = AuditResultRejected
+	}
+	for _, u := range rec.RefUpdates {
+		if u.Status == "ng" {
+			rec.Result = AuditResultRejected
+		}
+	}
+	if err != nil {
+		rec.Result = AuditResultError
+		rec.Error = err.Error()
+	}
+	if a.stats != nil {
+		rec.BytesIn = a.stats.Direction(ClientToServer).Bytes
+		rec.BytesOut = a.stats.Direction(ServerToClient).Bytes
+		rec.Phases = a.stats.Phases()
+	}
+	a.emit(&rec)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestExchangeAuditorUploadPack(t *testing.T) {
+	stats := NewSessionStats()
+	stats.StartPhase("negotiation")
+	stats.AddPacket(ClientToServer, BytesPacket("want x\n"))
+	var recs []*AuditRecord
+	a := NewExchangeAuditor("git-upload-pack", 0, stats, func(r *AuditRecord) { recs = append(recs, r) })
+	for _, c := range []*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: "w1", Capabilities: []string{"ofs-delta", "agent=git/2.40"}},
+		{WantObjectID: "w2"},
+		{ShallowObjectID: "s1"},
+		{EndOneRound: true},
+		{HaveObjectID: "h1"},
+		{NoMoreNegotiation: true},
+	} {
+		a.ObserveUploadPackRequest(c)
+	}
+	a.Finish(nil)
+	a.Finish(errors.New("ignored"))
+	if len(recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(recs))
+	}
+	r := recs[0]
+	if r.Service != "git-upload-pack" || r.Agent != "git/2.40" || r.Wants != 2 || r.Haves != 1 || r.Shallows != 1 || !r.Done || r.Result != AuditResultOK {
+		t.Errorf("got %+v", r)
+	}
+	if r.BytesIn != 11 || r.BytesOut != 0 {
+		t.Errorf("got %d bytes in and %d bytes out, want 11 and 0", r.BytesIn, r.BytesOut)
+	}
+	if _, ok := r.Phases["negotiation"]; !ok {
+		t.Errorf("got phases %v, want negotiation", r.Phases)
+	}
+}
+
+func TestExchangeAuditorProtocolV2(t *testing.T) {
+	var rec *AuditRecord
+	a := NewExchangeAuditor("git-upload-pack", 2, nil, func(r *AuditRecord) { rec = r })
+	for _, c := range []*ProtocolV2RequestChunk{
+		{Command: "fetch"},
+		{Capability: "agent=git/2.40"},
+		{EndCapability: true},
+		{Argument: []byte("want w1\n")},
+		{Argument: []byte("want-ref refs/heads/main\n")},
+		{Argument: []byte("have h1\n")},
+		{Argument: []byte("shallow s1\n")},
+		{Argument: []byte("done\n")},
+		{EndArgument: true},
+	} {
+		a.ObserveProtocolV2Request(c)
+	}
+	a.Finish(errors.New("broken pipe"))
+	if rec.Command != "fetch" || rec.Agent != "git/2.40" || rec.Wants != 2 || rec.Haves != 1 || rec.Shallows != 1 || !rec.Done {
+		t.Errorf("got %+v", rec)
+	}
+	if rec.Result != AuditResultError || rec.Error != "broken pipe" {
+		t.Errorf("got result %q and error %q", rec.Result, rec.Error)
+	}
+}
+
+func TestExchangeAuditorReceivePack(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		unpack string
+		status string
+		want   string
+	}{
+		{"ok", "ok", "ok", AuditResultOK},
+		{"ref rejected", "ok", "ng", AuditResultRejected},
+		{"unpack failed", "index-pack abnormal exit", "ng", AuditResultRejected},
+	} {
+		var rec *AuditRecord
+		a := NewExchangeAuditor("git-receive-pack", 0, nil, func(r *AuditRecord) { rec = r })
+		a.ObserveReceivePackRequest(&ProtocolV1ReceivePackRequestChunk{OldObjectID: "o1", NewObjectID: "n1", RefName: "refs/heads/main", Capabilities: []string{"report-status"}})
+		a.ObserveReceivePackRequest(&ProtocolV1ReceivePackRequestChunk{EndOfCommands: true})
+		a.ObservePushCertVerification(&PushCertVerification{})
+		a.ObserveReceivePackResponse(&ProtocolV1ReceivePackResponseChunk{UnpackStatus: tc.unpack})
+		a.ObserveReceivePackResponse(&ProtocolV1ReceivePackResponseChunk{RefUpdateStatus: tc.status, RefName: "refs/heads/main", RefUpdateFailMessage: "no"})
+		a.ObserveReceivePackResponse(&ProtocolV1ReceivePackResponseChunk{RefUpdateStatus: "ok", RefName: "refs/heads/unknown"})
+		a.Finish(nil)
+		if rec.Result != tc.want || rec.UnpackStatus != tc.unpack || rec.PushCert == nil {
+			t.Errorf("%s: got %+v", tc.name, rec)
+		}
+		want := []*AuditRefUpdate{
+			{RefName: "refs/heads/main", OldObjectID: "o1", NewObjectID: "n1", Status: tc.status, Reason: "no"},
+			{RefName: "refs/heads/unknown", Status: "ok"},
+		}
+		if !reflect.DeepEqual(rec.RefUpdates, want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, rec.RefUpdates, want)
+		}
+	}
+}
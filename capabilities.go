@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+)
+
+// Capabilities is a capability list, such as the Capabilities of the first ref
+// of an advertisement or the first want line. A capability can have a value
+// after "=", and some, such as symref, can appear more than once, so the
+// order and the duplicates are kept.
+type Capabilities []string
+
+// ParseCapabilities parses a space-separated capability list.
+func ParseCapabilities(s string) Capabilities {
+	return Capabilities(strings.Fields(s))
+}
+
+// String returns the space-separated capability list.
+func (c Capabilities) String() string {
+	return strings.Join(c, " ")
+}
+
+// Has returns true if the capability is in the list, with or without a value.
+func (c Capabilities) Has(name string) bool {
+	_, ok := c.Value(name)
+	return ok
+}
+
+// Value returns the value of the first capability of the name. The value is ""
+// if the capability has no value.
+func (c Capabilities) Value(name string) (string, bool) {
+	for _, s := range c {
+		if s == name {
+			return "", true
+		}
+		if strings.HasPrefix(s, name+"=") {
+			return strings.TrimPrefix(s, name+"="), true
+		}
+	}
+	return "", false
+}
+
+// Values returns the values of all the capabilities of the name.
+func (c Capabilities) Values(name string) []string {
+	var ret []string
+	for _, s := range c {
+		if s == name {
+			ret = append(ret, "")
+		} else if strings.HasPrefix(s, name+"=") {
+			ret = append(ret, strings.TrimPrefix(s, name+"="))
+		}
+	}
+	return ret
+}
+
+// SymRefs returns the symbolic refs. See SymrefsFromCapabilities.
+func (c Capabilities) SymRefs() map[string]string {
+	return SymrefsFromCapabilities(c)
+}
+
+// Agent returns the value of the agent capability. See AgentFromCapabilities.
+func (c Capabilities) Agent() string {
+	return AgentFromCapabilities(c)
+}
+
+// ObjectFormat returns the object format. See ObjectFormatFromCapabilities.
+func (c Capabilities) ObjectFormat() ObjectFormat {
+	return ObjectFormatFromCapabilities(c)
+}
+
+// AckMode returns the acknowledgement mode. See AckModeFromCapabilities.
+func (c Capabilities) AckMode() AckMode {
+	return AckModeFromCapabilities(c)
+}
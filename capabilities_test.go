@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	c := ParseCapabilities("  multi_ack_detailed symref=HEAD:refs/heads/main symref=refs/remotes/origin/HEAD:refs/remotes/origin/main agent=git/2.40 object-format=sha256 ofs-delta  filter=")
+	if got, want := c.String(), "multi_ack_detailed symref=HEAD:refs/heads/main symref=refs/remotes/origin/HEAD:refs/remotes/origin/main agent=git/2.40 object-format=sha256 ofs-delta filter="; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, tc := range []struct {
+		name      string
+		wantValue string
+		wantOK    bool
+	}{
+		{"ofs-delta", "", true},
+		{"agent", "git/2.40", true},
+		{"symref", "HEAD:refs/heads/main", true},
+		{"filter", "", true},
+		{"multi_ack", "", false},
+		{"ofs", "", false},
+		{"thin-pack", "", false},
+	} {
+		v, ok := c.Value(tc.name)
+		if v != tc.wantValue || ok != tc.wantOK || c.Has(tc.name) != tc.wantOK {
+			t.Errorf("%s: got %q, %v, want %q, %v", tc.name, v, ok, tc.wantValue, tc.wantOK)
+		}
+	}
+	if got, want := c.Values("symref"), []string{"HEAD:refs/heads/main", "refs/remotes/origin/HEAD:refs/remotes/origin/main"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := c.Values("thin-pack"); got != nil {
+		t.Errorf("got %q, want nil", got)
+	}
+	if got, want := c.SymRefs(), map[string]string{"HEAD": "refs/heads/main", "refs/remotes/origin/HEAD": "refs/remotes/origin/main"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if c.Agent() != "git/2.40" || c.ObjectFormat() != ObjectFormatSHA256 || c.AckMode() != AckModeMultiAckDetailed {
+		t.Errorf("got %q, %q, %v", c.Agent(), c.ObjectFormat(), c.AckMode())
+	}
+}
+
+func TestCapabilitiesEmpty(t *testing.T) {
+	c := ParseCapabilities("")
+	if len(c) != 0 || c.String() != "" {
+		t.Errorf("got %q", c)
+	}
+	if c.Has("agent") || c.Agent() != "" || c.ObjectFormat() != ObjectFormatSHA1 || c.AckMode() != AckModeSingle || len(c.SymRefs()) != 0 {
+		t.Errorf("unexpected values of an empty list")
+	}
+	// A malformed symref is ignored.
+	if got := ParseCapabilities("symref=HEAD").SymRefs(); len(got) != 0 {
+		t.Errorf("got %v, want none", got)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package capture implements a binary capture format of Git protocol
+// sessions.
+//
+// A capture file starts with the 8-byte magic "GITCAP\x00\x01". It's followed
+// by records. Each record is:
+//
+//	direction  1 byte (1: client to server, 2: server to client)
+//	timestamp  8 bytes, big-endian nanoseconds from UNIX epoch
+//	length     uvarint
+//	data       length bytes
+//
+// The data is the raw bytes as they appeared on the wire, so the capture is
+// lossless including the pack files. A record written by Writer.Tee is
+// whatever a Write call had, and one by Writer.Trace is a whole chunk of a
+// parser or an encoder. Data larger than 64MiB is split into several records.
+//
+// To reproduce a session, use Replay to feed the data of a direction to a
+// parser, such as gitprotocolio.NewProtocolV1UploadPackRequest.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+var magic = []byte("GITCAP\x00\x01")
+
+// maxRecordSize is the upper bound of a record accepted by Reader. Writer
+// splits larger data.
+const maxRecordSize = 64 << 20
+
+// ErrBadMagic is returned when the input is not a capture file.
+var ErrBadMagic = errors.New("capture: not a capture file")
+
+// Record is a piece of data observed in a session.
+type Record struct {
+	Direction gitprotocolio.Direction
+	Time      time.Time
+	Data      []byte
+}
+
+// Writer writes a capture file. It's safe for concurrent use, so both
+// directions can be recorded from different goroutines.
+type Writer struct {
+	m   sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a new Writer that writes to w. It writes the file header
+// immediately.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := w.Write(magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteRecord writes a record. If the data is larger than Reader accepts, it's
+// split into several records with the same time.
+func (w *Writer) WriteRecord(r *Record) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	data := r.Data
+	for {
+		sz := len(data)
+		if sz > maxRecordSize {
+			sz = maxRecordSize
+		}
+		hdr := make([]byte, 1+8+binary.MaxVarintLen64)
+		hdr[0] = byte(r.Direction)
+		binary.BigEndian.PutUint64(hdr[1:9], uint64(r.Time.UnixNano()))
+		n := binary.PutUvarint(hdr[9:], uint64(sz))
+		if _, w.err = w.w.Write(hdr[:9+n]); w.err != nil {
+			return w.err
+		}
+		if _, w.err = w.w.Write(data[:sz]); w.err != nil {
+			return w.err
+		}
+		data = data[sz:]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// Tee returns a writer that writes to dst and records the written bytes in the
+// given direction.
+func (w *Writer) Tee(d gitprotocolio.Direction, dst io.Writer) io.Writer {
+	return &teeWriter{c: w, d: d, w: dst}
+}
+
+// TeeReader returns a reader that reads from src and records the read bytes in
+// the given direction.
+func (w *Writer) TeeReader(d gitprotocolio.Direction, src io.Reader) io.Reader {
+	return &teeReader{c: w, d: d, r: src}
+}
+
+// Trace records the raw bytes of a chunk. It's a gitprotocolio.TraceFunc, so
+// that the packets read by a parser or written by an encoder are recorded with
+// their timestamps:
+//
+//	resp.SetTrace(w.Trace)
+//
+// An error is returned by the next WriteRecord.
+func (w *Writer) Trace(d gitprotocolio.Direction, raw []byte, _ gitprotocolio.Packet) {
+	if len(raw) == 0 {
+		return
+	}
+	w.WriteRecord(&Record{Direction: d, Time: time.Now(), Data: raw})
+}
+
+type teeWriter struct {
+	c *Writer
+	d gitprotocolio.Direction
+	w io.Writer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		if cerr := t.c.WriteRecord(&Record{Direction: t.d, Time: time.Now(), Data: p[:n]}); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+type teeReader struct {
+	c *Writer
+	d gitprotocolio.Direction
+	r io.Reader
+}
+
+func (t *teeReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if cerr := t.c.WriteRecord(&Record{Direction: t.d, Time: time.Now(), Data: p[:n]}); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+// Reader reads a capture file.
+type Reader struct {
+	r    *bufio.Reader
+	err  error
+	curr *Record
+}
+
+// NewReader returns a new Reader that reads from r. It reads and checks the
+// file header immediately.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrBadMagic
+		}
+		return nil, err
+	}
+	if !bytes.Equal(hdr, magic) {
+		return nil, ErrBadMagic
+	}
+	return &Reader{r: br}, nil
+}
+
+// Err returns the first non-EOF error that was encountered by the Reader.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Record returns the most recent record generated by a call to Scan.
+func (r *Reader) Record() *Record {
+	return r.curr
+}
+
+// Scan advances the reader to the next record. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After Scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *Reader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	hdr := make([]byte, 9)
+	if _, err := io.ReadFull(r.r, hdr); err != nil {
+		if err != io.EOF {
+			r.err = unexpectedEOF(err)
+		}
+		return false
+	}
+	d := gitprotocolio.Direction(hdr[0])
+	if d != gitprotocolio.ClientToServer && d != gitprotocolio.ServerToClient {
+		r.err = errors.New("capture: unknown direction")
+		return false
+	}
+	sz, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		r.err = unexpectedEOF(err)
+		return false
+	}
+	if sz > maxRecordSize {
+		r.err = errors.New("capture: record too large")
+		return false
+	}
+	data := make([]byte, sz)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		r.err = unexpectedEOF(err)
+		return false
+	}
+	r.curr = &Record{
+		Direction: d,
+		Time:      time.Unix(0, int64(binary.BigEndian.Uint64(hdr[1:]))),
+		Data:      data,
+	}
+	return true
+}
+
+// Streams reads all the records from r and returns the concatenated data of
+// each direction.
+func Streams(r *Reader) (clientToServer, serverToClient []byte, err error) {
+	var c, s bytes.Buffer
+	for r.Scan() {
+		rec := r.Record()
+		if rec.Direction == gitprotocolio.ClientToServer {
+			c.Write(rec.Data)
+		} else {
+			s.Write(rec.Data)
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.Bytes(), s.Bytes(), nil
+}
+
+// Replay returns a reader of the data of the records in the direction d, in
+// order. The records of the other direction are skipped. Unlike Streams, the
+// records are read as the returned reader is read, so a large capture can be
+// replayed to a parser without loading it. To replay both directions, open the
+// capture twice.
+func Replay(r *Reader, d gitprotocolio.Direction) io.Reader {
+	return &replayReader{r: r, d: d}
+}
+
+type replayReader struct {
+	r   *Reader
+	d   gitprotocolio.Direction
+	buf []byte
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		if !rr.r.Scan() {
+			if err := rr.r.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		if rec := rr.r.Record(); rec.Direction == rr.d {
+			rr.buf = rec.Data
+		}
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
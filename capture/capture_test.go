@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package capture
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 123)
+	if err := w.WriteRecord(&Record{Direction: gitprotocolio.ClientToServer, Time: now, Data: []byte("0000")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Tee(gitprotocolio.ServerToClient, io.Discard).Write([]byte("0008NAK\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(w.TeeReader(gitprotocolio.ClientToServer, bytes.NewReader([]byte("0009done\n")))); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Scan() || !r.Record().Time.Equal(now) {
+		t.Fatalf("unexpected first record: %+v, %v", r.Record(), r.Err())
+	}
+	c2s, s2c, err := Streams(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(c2s) != "0009done\n" || string(s2c) != "0008NAK\n" {
+		t.Errorf("got %q and %q", c2s, s2c)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf)
+	w.Tee(gitprotocolio.ClientToServer, io.Discard).Write([]byte("0000"))
+	w.Tee(gitprotocolio.ServerToClient, io.Discard).Write([]byte("0008NAK\n"))
+	w.Tee(gitprotocolio.ClientToServer, io.Discard).Write([]byte("0009done\n"))
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := io.ReadAll(Replay(r, gitprotocolio.ClientToServer))
+	if err != nil || string(bs) != "00000009done\n" {
+		t.Errorf("got %q, %v", bs, err)
+	}
+}
+
+func TestLargeRecord(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), maxRecordSize+10)
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf)
+	if _, err := w.Tee(gitprotocolio.ServerToClient, io.Discard).Write(data); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	var got []byte
+	for r.Scan() {
+		sizes = append(sizes, len(r.Record().Data))
+		got = append(got, r.Record().Data...)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[0] != maxRecordSize || !bytes.Equal(got, data) {
+		t.Errorf("unexpected records: %v", sizes)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	if _, err := NewReader(bytes.NewReader([]byte("GIT"))); err != ErrBadMagic {
+		t.Errorf("short header: got %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("NOTACAPTURE"))); err != ErrBadMagic {
+		t.Errorf("bad magic: got %v", err)
+	}
+	record := func(d byte, size byte, data string) []byte {
+		return append(append(append([]byte(nil), magic...), d, 0, 0, 0, 0, 0, 0, 0, 0, size), data...)
+	}
+	for name, input := range map[string][]byte{
+		"unknown direction": record(9, 1, "x"),
+		"truncated data":    record(1, 5, "x"),
+		"truncated header":  append(append([]byte(nil), magic...), 1, 0),
+		"too large":         append(record(1, 0x80, ""), 0x80, 0x80, 0x80, 0x01),
+	} {
+		r, err := NewReader(bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Scan() {
+		}
+		if r.Err() == nil {
+			t.Errorf("%s: want an error", name)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ChunkEncoder writes chunks as pkt-lines.
+type ChunkEncoder struct {
+	w io.Writer
+	// Deterministic makes the output byte-identical for the same logical
+	// input regardless of the order the capabilities are given in: the
+	// capability lists are sorted, the capability lines of a protocol v2
+	// advertisement or request are sorted by key, and the values of a v2
+	// capability such as "fetch=shallow filter" are sorted. The other chunks
+	// are written as is.
+	Deterministic bool
+
+	// pending is the capability lines held until the end of the block in
+	// the deterministic mode.
+	pending []Packet
+}
+
+// NewChunkEncoder returns a new ChunkEncoder that writes to w.
+func NewChunkEncoder(w io.Writer) *ChunkEncoder {
+	return &ChunkEncoder{w: w}
+}
+
+// Encode writes the chunk. In the deterministic mode, protocol v2 capability
+// lines are held until the end of the block.
+func (e *ChunkEncoder) Encode(c Packet) error {
+	if !e.Deterministic {
+		_, err := e.w.Write(c.EncodeToPktLine())
+		return err
+	}
+	switch c := c.(type) {
+	case *InfoRefsResponseChunk:
+		if len(c.Capabilities) == 1 && c.ObjectID == "" {
+			e.pending = append(e.pending, &InfoRefsResponseChunk{Capabilities: []string{canonicalV2Capability(c.Capabilities[0])}})
+			return nil
+		}
+		if len(c.Capabilities) > 1 {
+			cp := *c
+			cp.Capabilities = SortCapabilities(c.Capabilities)
+			return e.write(&cp)
+		}
+	case *ProtocolV2RequestChunk:
+		if c.Capability != "" {
+			e.pending = append(e.pending, &ProtocolV2RequestChunk{Capability: canonicalV2Capability(c.Capability)})
+			return nil
+		}
+	case *ProtocolV1UploadPackRequestChunk:
+		if len(c.Capabilities) != 0 {
+			cp := *c
+			cp.Capabilities = SortCapabilities(c.Capabilities)
+			return e.write(&cp)
+		}
+	case *ProtocolV1ReceivePackRequestChunk:
+		if len(c.Capabilities) != 0 {
+			cp := *c
+			cp.Capabilities = SortCapabilities(c.Capabilities)
+			return e.write(&cp)
+		}
+	}
+	return e.write(c)
+}
+
+func (e *ChunkEncoder) write(c Packet) error {
+	if err := e.Flush(); err != nil {
+		return err
+	}
+	_, err := e.w.Write(c.EncodeToPktLine())
+	return err
+}
+
+// Flush writes the held capability lines. Encode calls it at the end of the
+// block, so it's needed only when the stream ends without it.
+func (e *ChunkEncoder) Flush() error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	sort.SliceStable(e.pending, func(i, j int) bool {
+		return pendingCapability(e.pending[i]) < pendingCapability(e.pending[j])
+	})
+	for _, c := range e.pending {
+		if _, err := e.w.Write(c.EncodeToPktLine()); err != nil {
+			return err
+		}
+	}
+	e.pending = nil
+	return nil
+}
+
+func pendingCapability(c Packet) string {
+	switch c := c.(type) {
+	case *InfoRefsResponseChunk:
+		return c.Capabilities[0]
+	case *ProtocolV2RequestChunk:
+		return c.Capability
+	}
+	return ""
+}
+
+// SortCapabilities returns a sorted copy of the capabilities.
+func SortCapabilities(caps []string) []string {
+	ret := append([]string(nil), caps...)
+	sort.Strings(ret)
+	return ret
+}
+
+// canonicalV2Capability sorts the space-separated values of a protocol v2
+// capability line.
+func canonicalV2Capability(line string) string {
+	i := strings.IndexByte(line, '=')
+	if i < 0 {
+		return line
+	}
+	values := strings.Split(line[i+1:], " ")
+	sort.Strings(values)
+	return line[:i+1] + strings.Join(values, " ")
+}
+
+// chunkWriter is the common part of the streaming encoders, such as
+// ProtocolV1UploadPackResponseEncoder. It writes the encoded chunks and
+// remembers the kind of the last one for the errors.
+type chunkWriter struct {
+	w    io.Writer
+	err  error
+	last string
+
+	trace    TraceFunc
+	traceDir Direction
+}
+
+func (w *chunkWriter) write(kind string, c Packet, bs []byte) error {
+	if _, err := w.w.Write(bs); err != nil {
+		w.err = err
+		return err
+	}
+	w.last = kind
+	if w.trace != nil {
+		w.trace(w.traceDir, bs, c)
+	}
+	return nil
+}
+
+// orderError returns the error for a chunk that cannot follow the last one.
+func (w *chunkWriter) orderError(kind string) error {
+	switch {
+	case kind == "":
+		return SyntaxError("invalid chunk")
+	case w.last == "":
+		return SyntaxError(fmt.Sprintf("cannot start with %s", kind))
+	}
+	return SyntaxError(fmt.Sprintf("cannot write %s after %s", kind, w.last))
+}
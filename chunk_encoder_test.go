@@ -0,0 +1,136 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func encodeChunks(t *testing.T, deterministic bool, chunks ...Packet) string {
+	var b bytes.Buffer
+	e := NewChunkEncoder(&b)
+	e.Deterministic = deterministic
+	for _, c := range chunks {
+		if err := e.Encode(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestChunkEncoderV2Advertisement(t *testing.T) {
+	a := []Packet{
+		&InfoRefsResponseChunk{ProtocolVersion: 2},
+		&InfoRefsResponseChunk{Capabilities: []string{"ls-refs"}},
+		&InfoRefsResponseChunk{Capabilities: []string{"fetch=shallow filter"}},
+		&InfoRefsResponseChunk{Capabilities: []string{"agent=git/2.40"}},
+		&InfoRefsResponseChunk{EndOfRequest: true},
+	}
+	b := []Packet{a[0], a[3], &InfoRefsResponseChunk{Capabilities: []string{"fetch=filter shallow"}}, a[1], a[4]}
+	want := pktLines("version 2\n", "agent=git/2.40\n", "fetch=filter shallow\n", "ls-refs\n", "0000")
+	for _, chunks := range [][]Packet{a, b} {
+		if got := encodeChunks(t, true, chunks...); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// Not deterministic, the chunks are written as is.
+	if got, want := encodeChunks(t, false, b...), pktLines("version 2\n", "agent=git/2.40\n", "fetch=filter shallow\n", "ls-refs\n", "0000"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := encodeChunks(t, false, a...), pktLines("version 2\n", "ls-refs\n", "fetch=shallow filter\n", "agent=git/2.40\n", "0000"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChunkEncoderV2Request(t *testing.T) {
+	got := encodeChunks(t, true,
+		&ProtocolV2RequestChunk{Command: "fetch"},
+		&ProtocolV2RequestChunk{Capability: "object-format=sha1"},
+		&ProtocolV2RequestChunk{Capability: "agent=git/2.40"},
+		&ProtocolV2RequestChunk{EndCapability: true},
+		&ProtocolV2RequestChunk{Argument: []byte("want " + oidB + "\n")},
+		&ProtocolV2RequestChunk{Argument: []byte("want " + oidA + "\n")},
+		&ProtocolV2RequestChunk{EndRequest: true},
+	)
+	// The arguments are not reordered.
+	want := pktLines("command=fetch\n", "agent=git/2.40\n", "object-format=sha1\n") + DelimPkt + pktLines("want "+oidB+"\n", "want "+oidA+"\n", "0000")
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChunkEncoderV1Capabilities(t *testing.T) {
+	got := encodeChunks(t, true,
+		&ProtocolV1UploadPackRequestChunk{WantObjectID: oidA, Capabilities: []string{"thin-pack", "ofs-delta"}},
+		&ProtocolV1UploadPackRequestChunk{WantObjectID: oidB},
+	)
+	if want := pktLines("want "+oidA+" ofs-delta thin-pack\n", "want "+oidB+"\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got = encodeChunks(t, true,
+		&ProtocolV1ReceivePackRequestChunk{OldObjectID: oidA, NewObjectID: oidB, RefName: "refs/heads/main", Capabilities: []string{"report-status", "atomic"}},
+	)
+	if want := pktLines(oidA + " " + oidB + " refs/heads/main\x00atomic report-status\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestChunkEncoderFlush(t *testing.T) {
+	var b bytes.Buffer
+	e := NewChunkEncoder(&b)
+	e.Deterministic = true
+	e.Encode(&ProtocolV2RequestChunk{Capability: "b"})
+	e.Encode(&ProtocolV2RequestChunk{Capability: "a"})
+	if b.Len() != 0 {
+		t.Errorf("got %q before Flush", b.String())
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := pktLines("a\n", "b\n"); b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	e = NewChunkEncoder(failingWriter{})
+	e.Deterministic = true
+	if err := e.Encode(&ProtocolV2RequestChunk{Capability: "a"}); err != nil {
+		t.Errorf("got %v for a held line", err)
+	}
+	if err := e.Encode(&ProtocolV2RequestChunk{EndRequest: true}); err == nil {
+		t.Error("got no error")
+	}
+}
+
+func TestSortCapabilities(t *testing.T) {
+	caps := []string{"thin-pack", "agent=git/2.40", "ofs-delta"}
+	got := SortCapabilities(caps)
+	if want := []string{"agent=git/2.40", "ofs-delta", "thin-pack"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if caps[0] != "thin-pack" {
+		t.Errorf("the input was modified: %q", caps)
+	}
+	if got := canonicalV2Capability("fetch=shallow filter"); got != "fetch=filter shallow" {
+		t.Errorf("got %q", got)
+	}
+	if got := canonicalV2Capability("ls-refs"); got != "ls-refs" {
+		t.Errorf("got %q", got)
+	}
+}
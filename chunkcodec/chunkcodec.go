@@ -0,0 +1,466 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package chunkcodec implements a versioned binary encoding of parsed chunk
+// streams, so that one process can parse the traffic and another can analyze
+// or re-encode it later.
+//
+// Unlike pkt-lines, the encoding keeps the chunk types and the field values as
+// parsed. A stream starts with the 8-byte magic "GITCHNK" followed by the
+// format version (currently 1). It's followed by records. Each record is:
+//
+//	length     uvarint, the size of the rest of the record
+//	direction  1 byte (0: unknown, 1: client to server, 2: server to client)
+//	type       string, the Go type name of the chunk such as
+//	           "ProtocolV2RequestChunk"
+//	fields     uvarint count, followed by the fields
+//
+// Each field is:
+//
+//	name       string, the Go field name ("" for a packet that is not a struct)
+//	kind       1 byte
+//	value      uvarint length, followed by the value
+//
+// The type and the names are a uvarint length followed by the bytes. A value of
+// a string or a byte slice is the bytes as is, a string slice is the strings
+// each prefixed by a uvarint length, an integer is a varint or a uvarint, and a
+// bool is a byte. Only the non-zero fields are written.
+//
+// Compatibility: within a format version, fields and chunk types are only
+// added. A Reader skips fields it doesn't know, and returns a record with a nil
+// Chunk for a chunk type it doesn't know, so that a stream written by a newer
+// version of this package can be read by an older one. A Reader rejects a
+// stream of a newer format version.
+package chunkcodec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/google/gitprotocolio"
+)
+
+// Version is the format version written by Writer.
+const Version = 1
+
+var magic = []byte("GITCHNK")
+
+// maxRecordSize is the upper bound of a record accepted by Reader.
+const maxRecordSize = 64 << 20
+
+// Field kinds.
+const (
+	kindString      = 1
+	kindBool        = 2
+	kindBytes       = 3
+	kindStringSlice = 4
+	kindInt         = 5
+	kindUint        = 6
+)
+
+var (
+	// ErrBadMagic is returned when the input is not a chunk stream.
+	ErrBadMagic = errors.New("chunkcodec: not a chunk stream")
+	// ErrUnsupportedVersion is returned when the stream is of a newer format
+	// version.
+	ErrUnsupportedVersion = errors.New("chunkcodec: unsupported format version")
+)
+
+var knownTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, c := range []gitprotocolio.Packet{
+		gitprotocolio.FlushPacket{},
+		gitprotocolio.DelimPacket{},
+		gitprotocolio.ResponseEndPacket{},
+		gitprotocolio.BytesPacket(nil),
+		gitprotocolio.ErrorPacket(""),
+		gitprotocolio.PackFileIndicatorPacket{},
+		gitprotocolio.PackFilePacket(nil),
+		gitprotocolio.SideBandMainPacket(nil),
+		gitprotocolio.SideBandReportPacket(nil),
+		gitprotocolio.SideBandErrorPacket(nil),
+		&gitprotocolio.InfoRefsResponseChunk{},
+		&gitprotocolio.UploadArchiveRequestChunk{},
+		&gitprotocolio.UploadArchiveResponseChunk{},
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{},
+		&gitprotocolio.ProtocolV1ReceivePackResponseChunk{},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{},
+		&gitprotocolio.ProtocolV1UploadPackResponseChunk{},
+		&gitprotocolio.ProtocolV2RequestChunk{},
+		&gitprotocolio.ProtocolV2ResponseChunk{},
+	} {
+		knownTypes[typeName(reflect.TypeOf(c))] = reflect.TypeOf(c)
+	}
+}
+
+func typeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// Record is an encoded chunk.
+type Record struct {
+	Direction gitprotocolio.Direction
+	// Type is the Go type name of the chunk.
+	Type string
+	// Chunk is the decoded chunk. It's nil if the type is unknown to this
+	// version of the package.
+	Chunk gitprotocolio.Packet
+}
+
+// Writer writes a chunk stream. It's safe for concurrent use.
+type Writer struct {
+	m   sync.Mutex
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a new Writer that writes to w. It writes the stream header
+// immediately.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := w.Write(append(append([]byte(nil), magic...), Version)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteChunk writes a chunk, such as *ProtocolV2RequestChunk or BytesPacket.
+func (w *Writer) WriteChunk(d gitprotocolio.Direction, c gitprotocolio.Packet) error {
+	var body bytes.Buffer
+	body.WriteByte(byte(d))
+	v := reflect.ValueOf(c)
+	putString(&body, typeName(v.Type()))
+	if err := putFields(&body, v); err != nil {
+		return err
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	var hdr [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(body.Len()))
+	if _, w.err = w.w.Write(hdr[:n]); w.err != nil {
+		return w.err
+	}
+	_, w.err = w.w.Write(body.Bytes())
+	return w.err
+}
+
+func putFields(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		var val bytes.Buffer
+		kind, err := putValue(&val, v)
+		if err != nil {
+			return err
+		}
+		putUvarint(buf, 1)
+		putField(buf, "", kind, val.Bytes())
+		return nil
+	}
+	type field struct {
+		name string
+		kind byte
+		val  []byte
+	}
+	var fields []field
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" || v.Field(i).IsZero() {
+			continue
+		}
+		var val bytes.Buffer
+		kind, err := putValue(&val, v.Field(i))
+		if err != nil {
+			return fmt.Errorf("chunkcodec: field %s: %v", f.Name, err)
+		}
+		fields = append(fields, field{f.Name, kind, val.Bytes()})
+	}
+	putUvarint(buf, uint64(len(fields)))
+	for _, f := range fields {
+		putField(buf, f.name, f.kind, f.val)
+	}
+	return nil
+}
+
+func putField(buf *bytes.Buffer, name string, kind byte, val []byte) {
+	putString(buf, name)
+	buf.WriteByte(kind)
+	putUvarint(buf, uint64(len(val)))
+	buf.Write(val)
+}
+
+func putValue(buf *bytes.Buffer, v reflect.Value) (byte, error) {
+	switch v.Kind() {
+	case reflect.String:
+		buf.WriteString(v.String())
+		return kindString, nil
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		return kindBool, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var b [binary.MaxVarintLen64]byte
+		buf.Write(b[:binary.PutVarint(b[:], v.Int())])
+		return kindInt, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		putUvarint(buf, v.Uint())
+		return kindUint, nil
+	case reflect.Slice:
+		switch v.Type().Elem().Kind() {
+		case reflect.Uint8:
+			buf.Write(v.Bytes())
+			return kindBytes, nil
+		case reflect.String:
+			for i := 0; i < v.Len(); i++ {
+				putString(buf, v.Index(i).String())
+			}
+			return kindStringSlice, nil
+		}
+	case reflect.Struct:
+		if v.NumField() == 0 {
+			return kindBool, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported type %s", v.Type())
+}
+
+func putUvarint(buf *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// Reader reads a chunk stream.
+type Reader struct {
+	r       *bufio.Reader
+	version byte
+	err     error
+	curr    *Record
+}
+
+// NewReader returns a new Reader that reads from r. It reads and checks the
+// stream header immediately.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	hdr := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrBadMagic
+		}
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:len(magic)], magic) {
+		return nil, ErrBadMagic
+	}
+	if hdr[len(magic)] == 0 || hdr[len(magic)] > Version {
+		return nil, ErrUnsupportedVersion
+	}
+	return &Reader{r: br, version: hdr[len(magic)]}, nil
+}
+
+// Err returns the first non-EOF error that was encountered by the Reader.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Record returns the most recent record generated by a call to Scan.
+func (r *Reader) Record() *Record {
+	return r.curr
+}
+
+// Scan advances the reader to the next record. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After Scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *Reader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	sz, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err != io.EOF {
+			r.err = unexpectedEOF(err)
+		}
+		return false
+	}
+	if sz > maxRecordSize {
+		r.err = errors.New("chunkcodec: record too large")
+		return false
+	}
+	body := make([]byte, sz)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		r.err = unexpectedEOF(err)
+		return false
+	}
+	rec, err := decodeRecord(body)
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.curr = rec
+	return true
+}
+
+var errCorrupted = errors.New("chunkcodec: corrupted record")
+
+func decodeRecord(body []byte) (*Record, error) {
+	d := &decoder{buf: body}
+	if len(d.buf) == 0 {
+		return nil, errCorrupted
+	}
+	rec := &Record{Direction: gitprotocolio.Direction(d.buf[0])}
+	d.buf = d.buf[1:]
+	rec.Type = string(d.bytes())
+	n := d.uvarint()
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	t, known := knownTypes[rec.Type]
+	var v reflect.Value
+	if known {
+		if t.Kind() == reflect.Ptr {
+			v = reflect.New(t.Elem())
+		} else {
+			v = reflect.New(t)
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		name := string(d.bytes())
+		if len(d.buf) == 0 {
+			return nil, errCorrupted
+		}
+		kind := d.buf[0]
+		d.buf = d.buf[1:]
+		val := d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if !known {
+			continue
+		}
+		f := v.Elem()
+		if name != "" {
+			if f.Kind() != reflect.Struct {
+				continue
+			}
+			f = f.FieldByName(name)
+			if !f.IsValid() || !f.CanSet() {
+				// A field added by a newer version.
+				continue
+			}
+		}
+		if err := setValue(f, kind, val); err != nil {
+			return nil, err
+		}
+	}
+	if known {
+		if t.Kind() == reflect.Ptr {
+			rec.Chunk = v.Interface().(gitprotocolio.Packet)
+		} else {
+			rec.Chunk = v.Elem().Interface().(gitprotocolio.Packet)
+		}
+	}
+	return rec, nil
+}
+
+func setValue(f reflect.Value, kind byte, val []byte) error {
+	d := &decoder{buf: val}
+	switch {
+	case kind == kindString && f.Kind() == reflect.String:
+		f.SetString(string(val))
+	case kind == kindBool && f.Kind() == reflect.Bool:
+		f.SetBool(len(val) == 1 && val[0] == 1)
+	case kind == kindBool && f.Kind() == reflect.Struct:
+	case kind == kindInt && f.Kind() >= reflect.Int && f.Kind() <= reflect.Int64:
+		x, n := binary.Varint(val)
+		if n <= 0 {
+			return errCorrupted
+		}
+		f.SetInt(x)
+	case kind == kindUint && f.Kind() >= reflect.Uint && f.Kind() <= reflect.Uint64:
+		f.SetUint(d.uvarint())
+	case kind == kindBytes && f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint8:
+		f.SetBytes(append([]byte(nil), val...))
+	case kind == kindStringSlice && f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+		var ss []string
+		for len(d.buf) != 0 && d.err == nil {
+			ss = append(ss, string(d.bytes()))
+		}
+		f.Set(reflect.ValueOf(ss).Convert(f.Type()))
+	default:
+		// A kind unknown to this version. Skip it.
+	}
+	return d.err
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = errCorrupted
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < n {
+		d.err = errCorrupted
+		return nil
+	}
+	ret := d.buf[:n]
+	d.buf = d.buf[n:]
+	return ret
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunkcodec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestRoundTrip(t *testing.T) {
+	records := []*Record{
+		{gitprotocolio.ClientToServer, "ProtocolV1UploadPackRequestChunk", &gitprotocolio.ProtocolV1UploadPackRequestChunk{
+			WantObjectID: "1111", Capabilities: []string{"ofs-delta", "agent=git/2"},
+		}},
+		{gitprotocolio.ClientToServer, "ProtocolV1UploadPackRequestChunk", &gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenDepth: -1}},
+		{gitprotocolio.ClientToServer, "ProtocolV1UploadPackRequestChunk", &gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenSince: 1 << 40}},
+		{gitprotocolio.ClientToServer, "ProtocolV2RequestChunk", &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("\x00\xff")}},
+		{gitprotocolio.ServerToClient, "ProtocolV2ResponseChunk", &gitprotocolio.ProtocolV2ResponseChunk{EndResponse: true}},
+		{gitprotocolio.ServerToClient, "FlushPacket", gitprotocolio.FlushPacket{}},
+		{gitprotocolio.ServerToClient, "ResponseEndPacket", gitprotocolio.ResponseEndPacket{}},
+		{gitprotocolio.ServerToClient, "BytesPacket", gitprotocolio.BytesPacket("abc\n")},
+		{gitprotocolio.ServerToClient, "ErrorPacket", gitprotocolio.ErrorPacket("oops")},
+		{gitprotocolio.ServerToClient, "SideBandMainPacket", gitprotocolio.SideBandMainPacket("PACK")},
+		{0, "InfoRefsResponseChunk", &gitprotocolio.InfoRefsResponseChunk{ProtocolVersion: 2}},
+	}
+	var b bytes.Buffer
+	w, err := NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := w.WriteChunk(rec.Direction, rec.Chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*Record
+	for r.Scan() {
+		got = append(got, r.Record())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(records) {
+		t.Fatalf("got %d records, want %d", len(got), len(records))
+	}
+	for i := range records {
+		if !reflect.DeepEqual(got[i], records[i]) {
+			t.Errorf("record %d: got %#v, want %#v", i, got[i], records[i])
+		}
+	}
+}
+
+// rawRecord encodes a record with the fields as given.
+func rawRecord(typ string, fields ...[]byte) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(gitprotocolio.ServerToClient))
+	putString(&body, typ)
+	putUvarint(&body, uint64(len(fields)))
+	for _, f := range fields {
+		body.Write(f)
+	}
+	var rec bytes.Buffer
+	putUvarint(&rec, uint64(body.Len()))
+	rec.Write(body.Bytes())
+	return rec.Bytes()
+}
+
+func rawField(name string, kind byte, val string) []byte {
+	var b bytes.Buffer
+	putField(&b, name, kind, []byte(val))
+	return b.Bytes()
+}
+
+func TestReaderCompatibility(t *testing.T) {
+	in := append([]byte("GITCHNK\x01"), rawRecord("FutureChunk", rawField("Foo", kindString, "bar"))...)
+	in = append(in, rawRecord("ProtocolV2ResponseChunk",
+		rawField("NewField", kindString, "x"),
+		rawField("Response", 99, "future kind"),
+		rawField("Delimiter", kindBool, "\x01"),
+	)...)
+	r, err := NewReader(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []*Record
+	for r.Scan() {
+		got = append(got, r.Record())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []*Record{
+		{gitprotocolio.ServerToClient, "FutureChunk", nil},
+		{gitprotocolio.ServerToClient, "ProtocolV2ResponseChunk", &gitprotocolio.ProtocolV2ResponseChunk{Delimiter: true}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+		want error
+	}{
+		{"empty", "", ErrBadMagic},
+		{"bad magic", "GITCHUNK", ErrBadMagic},
+		{"version 0", "GITCHNK\x00", ErrUnsupportedVersion},
+		{"newer version", "GITCHNK\x02", ErrUnsupportedVersion},
+	} {
+		if _, err := NewReader(bytes.NewReader([]byte(tc.in))); err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	var tooLarge [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tooLarge[:], maxRecordSize+1)
+	valid := rawRecord("FlushPacket")
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"truncated", valid[:len(valid)-1]},
+		{"truncated length", []byte{0x80}},
+		{"too large", tooLarge[:n]},
+		{"empty record", []byte{0}},
+		{"bad field count", []byte{2, 1, 0}},
+		{"truncated field", rawRecord("BytesPacket", rawField("", kindBytes, "abc")[:4])},
+		{"bad int", rawRecord("ProtocolV1UploadPackRequestChunk", rawField("DeepenDepth", kindInt, "\x80"))},
+	} {
+		r, err := NewReader(bytes.NewReader(append([]byte("GITCHNK\x01"), tc.in...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for r.Scan() {
+		}
+		if r.Err() == nil || r.Err() == io.EOF {
+			t.Errorf("%s: got %v, want an error", tc.name, r.Err())
+		}
+	}
+}
+
+func TestWriterError(t *testing.T) {
+	w, err := NewWriter(&bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunk(gitprotocolio.ServerToClient, unsupportedPacket{Values: []int{1}}); err == nil {
+		t.Error("got no error for an unsupported field type")
+	}
+}
+
+type unsupportedPacket struct {
+	Values []int
+}
+
+func (unsupportedPacket) EncodeToPktLine() []byte { return nil }
@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client implements git fetch and push on top of the chunk parsers:
+// the ref discovery, the negotiation, and the pack streaming.
+//
+// The client speaks the stateless-RPC style of smart HTTP, where the ref
+// discovery and every request are separate round trips.
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gitprotocolio"
+)
+
+// SyntaxError is an error returned when the parser cannot parse the input.
+type SyntaxError string
+
+func (s SyntaxError) Error() string { return string(s) }
+
+// Transport sends the ref discovery and the requests of a service
+// ("git-upload-pack" or "git-receive-pack") to a remote repository.
+// httpclient.Client is a Transport of the smart HTTP protocol.
+type Transport interface {
+	// Discover returns the ref advertisement of the service. If version is
+	// 2, it requests protocol v2.
+	Discover(ctx context.Context, service string, version int) (io.ReadCloser, error)
+	// Request sends a request of the service and returns the response.
+	// version is the protocol version of the request. The body is streamed,
+	// so it can carry a large pack.
+	Request(ctx context.Context, service string, version int, body io.Reader) (io.ReadCloser, error)
+}
+
+// discover reads the ref advertisement of the service, requesting protocol v2
+// unless disabled.
+func discover(ctx context.Context, t Transport, service string, disableV2 bool) (*gitprotocolio.ProtocolDiscovery, error) {
+	open := func(ctx context.Context, version int) (io.ReadCloser, error) {
+		return t.Discover(ctx, service, version)
+	}
+	if disableV2 {
+		rc, err := open(ctx, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return gitprotocolio.ReadProtocolDiscovery(rc)
+	}
+	d, rc, err := gitprotocolio.DiscoverWithFallback(ctx, open)
+	if err != nil {
+		return nil, err
+	}
+	rc.Close()
+	return d, nil
+}
+
+// phaseError returns the PhaseDeadlineError if a phase of the session ran out
+// of time, which makes err, usually context.Canceled, less informative.
+func phaseError(ctx context.Context, err error) error {
+	var pde *gitprotocolio.PhaseDeadlineError
+	if errors.As(context.Cause(ctx), &pde) {
+		return pde
+	}
+	return err
+}
+
+// phaseReadCloser is a pack stream read in the pack transfer phase. Close
+// stops the deadlines.
+type phaseReadCloser struct {
+	io.ReadCloser
+	ctx       context.Context
+	deadlines *gitprotocolio.PhaseDeadlines
+}
+
+func (r *phaseReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = phaseError(r.ctx, err)
+	}
+	return n, err
+}
+
+func (r *phaseReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.deadlines.Stop()
+	return err
+}
+
+// writeV1Chunks encodes the chunks into a request body.
+func writeV1Chunks(buf *bytes.Buffer, chunks []*gitprotocolio.ProtocolV1UploadPackRequestChunk) {
+	for _, c := range chunks {
+		buf.Write(c.EncodeToPktLine())
+	}
+}
+
+// readCloser is a reader with the closer of its source.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// packReader reads the main stream of the sideband packets of a pack, and
+// writes the progress messages.
+type packReader struct {
+	next     func() ([]byte, error)
+	progress io.Writer
+	closer   io.Closer
+	buf      []byte
+	err      error
+}
+
+func (r *packReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.fill()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *packReader) fill() error {
+	bs, err := r.next()
+	if err != nil {
+		return err
+	}
+	if sp, ok := gitprotocolio.ParseSideBandPacket(gitprotocolio.BytesPacket(bs)).(gitprotocolio.SideBandMainPacket); ok {
+		// The parsers reuse the buffer.
+		r.buf = append(r.buf[:0], sp...)
+		return nil
+	}
+	return sideBandMessage(bs, r.progress)
+}
+
+// sideBandMessage writes a progress packet to progress, or returns an error
+// packet as an error.
+func sideBandMessage(bs []byte, progress io.Writer) error {
+	switch sp := gitprotocolio.ParseSideBandPacket(gitprotocolio.BytesPacket(bs)).(type) {
+	case gitprotocolio.SideBandReportPacket:
+		if progress != nil {
+			_, err := progress.Write(sp)
+			return err
+		}
+		return nil
+	case gitprotocolio.SideBandErrorPacket:
+		return &gitprotocolio.RemoteError{Message: strings.TrimSuffix(string(sp), "\n")}
+	}
+	return SyntaxError(fmt.Sprintf("not a sideband packet: %q", bs))
+}
+
+func (r *packReader) Close() error {
+	return r.closer.Close()
+}
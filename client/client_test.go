@@ -0,0 +1,124 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	oidA = "1111111111111111111111111111111111111111"
+	oidB = "2222222222222222222222222222222222222222"
+)
+
+// fakeTransport serves a v0 advertisement and passes the requests to request.
+type fakeTransport struct {
+	caps    []string
+	refs    []*gitprotocolio.AdvertisedRef
+	request func(ctx context.Context, service string, body []byte) (io.ReadCloser, error)
+}
+
+func (t *fakeTransport) Discover(ctx context.Context, service string, version int) (io.ReadCloser, error) {
+	var b bytes.Buffer
+	if err := gitprotocolio.NewAdvertisementEncoder(&b).EncodeInfoRefs("", t.caps, gitprotocolio.RefSlice(t.refs)); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&b), nil
+}
+
+func (t *fakeTransport) Request(ctx context.Context, service string, version int, body io.Reader) (io.ReadCloser, error) {
+	bs, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return t.request(ctx, service, bs)
+}
+
+// stalledReader returns the data and then blocks until the context is done.
+type stalledReader struct {
+	ctx  context.Context
+	data []byte
+}
+
+func (r *stalledReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		<-r.ctx.Done()
+		return 0, r.ctx.Err()
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *stalledReader) Close() error { return nil }
+
+func stall(ctx context.Context, service string, body []byte) (io.ReadCloser, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestFetchPhaseTimeouts(t *testing.T) {
+	tr := &fakeTransport{
+		caps: []string{"side-band-64k", "ofs-delta"},
+		refs: []*gitprotocolio.AdvertisedRef{{Name: "refs/heads/main", ObjectID: oidA}},
+	}
+
+	tr.request = stall
+	_, err := Fetch(context.Background(), tr, &FetchOptions{DisableProtocolV2: true, PhaseTimeouts: gitprotocolio.PhaseTimeouts{Negotiation: 20 * time.Millisecond}})
+	var pde *gitprotocolio.PhaseDeadlineError
+	if !errors.As(err, &pde) || pde.Phase != gitprotocolio.PhaseNegotiation {
+		t.Errorf("negotiation: got %v, want a negotiation PhaseDeadlineError", err)
+	}
+
+	// The pack transfer phase lasts after Fetch returns.
+	tr.request = func(ctx context.Context, service string, body []byte) (io.ReadCloser, error) {
+		var b bytes.Buffer
+		b.Write(gitprotocolio.BytesPacket("NAK\n").EncodeToPktLine())
+		b.Write(gitprotocolio.BytesPacket("\x01PACK").EncodeToPktLine())
+		return &stalledReader{ctx: ctx, data: b.Bytes()}, nil
+	}
+	result, err := Fetch(context.Background(), tr, &FetchOptions{DisableProtocolV2: true, PhaseTimeouts: gitprotocolio.PhaseTimeouts{Negotiation: time.Minute, PackTransfer: 20 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Pack.Close()
+	bs, err := io.ReadAll(result.Pack)
+	if string(bs) != "PACK" || !errors.As(err, &pde) || pde.Phase != gitprotocolio.PhasePackTransfer {
+		t.Errorf("pack: got %q, %v, want PACK and a pack PhaseDeadlineError", bs, err)
+	}
+}
+
+func TestPushPhaseTimeouts(t *testing.T) {
+	tr := &fakeTransport{
+		caps:    []string{"report-status"},
+		refs:    []*gitprotocolio.AdvertisedRef{{Name: "refs/heads/main", ObjectID: oidA}},
+		request: stall,
+	}
+	_, err := Push(context.Background(), tr, &PushOptions{
+		Updates:       []*gitprotocolio.RefUpdate{{RefName: "refs/heads/main", OldObjectID: oidA, NewObjectID: oidB}},
+		PhaseTimeouts: gitprotocolio.PhaseTimeouts{PackTransfer: 20 * time.Millisecond},
+	})
+	var pde *gitprotocolio.PhaseDeadlineError
+	if !errors.As(err, &pde) || pde.Phase != gitprotocolio.PhasePackTransfer {
+		t.Errorf("got %v, want a pack PhaseDeadlineError", err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/google/gitprotocolio"
+)
+
+// DialDaemon connects to a git:// server and sends the request line. addr is
+// "host" or "host:port". If req.Host is empty, addr is sent as the host
+// parameter. The server's response, such as the ref advertisement, follows on
+// the returned connection.
+//
+// Unlike the smart HTTP protocol, the connection is stateful: the whole
+// negotiation happens on it.
+func DialDaemon(ctx context.Context, addr string, req *gitprotocolio.DaemonRequest) (net.Conn, error) {
+	hostport := addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		hostport = net.JoinHostPort(addr, strconv.Itoa(gitprotocolio.DaemonPort))
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+	r := *req
+	if r.Host == "" {
+		r.Host = addr
+	}
+	if _, err := conn.Write(r.EncodeToPktLine()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DaemonOpener returns a gitprotocolio.DiscoveryOpener that connects to a
+// git:// server with DialDaemon, for gitprotocolio.DiscoverWithFallback. A
+// protocol v2 request adds the "version=2" extra parameter.
+func DaemonOpener(addr, service, path string) gitprotocolio.DiscoveryOpener {
+	return func(ctx context.Context, version int) (io.ReadCloser, error) {
+		req := &gitprotocolio.DaemonRequest{Service: service, Path: path}
+		if version != 0 {
+			req.ExtraParameters = []string{"version=" + strconv.Itoa(version)}
+		}
+		return DialDaemon(ctx, addr, req)
+	}
+}
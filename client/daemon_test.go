@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestDaemonOpener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	reqs := make(chan *gitprotocolio.DaemonRequest, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			req, err := gitprotocolio.ReadDaemonRequest(conn)
+			if err != nil {
+				t.Error(err)
+			}
+			reqs <- req
+			conn.Write([]byte("advertisement"))
+			conn.Close()
+		}
+	}()
+
+	addr := l.Addr().String()
+	for _, tc := range []struct {
+		version int
+		want    *gitprotocolio.DaemonRequest
+	}{
+		{0, &gitprotocolio.DaemonRequest{Service: "git-upload-pack", Path: "/repo", Host: addr}},
+		{2, &gitprotocolio.DaemonRequest{Service: "git-upload-pack", Path: "/repo", Host: addr, ExtraParameters: []string{"version=2"}}},
+	} {
+		rc, err := DaemonOpener(addr, "git-upload-pack", "/repo")(context.Background(), tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(rc)
+		rc.Close()
+		if got := <-reqs; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("version %d: got %+v, want %+v", tc.version, got, tc.want)
+		}
+		if err != nil || string(bs) != "advertisement" {
+			t.Errorf("version %d: got %q, %v", tc.version, bs, err)
+		}
+	}
+
+	// The host parameter can differ from the address.
+	conn, err := DialDaemon(context.Background(), addr, &gitprotocolio.DaemonRequest{Service: "git-receive-pack", Path: "/repo", Host: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := <-reqs; got.Host != "example.com" || got.Service != "git-receive-pack" {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,525 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+const uploadPackService = "git-upload-pack"
+
+// FetchOptions is the options of Fetch.
+type FetchOptions struct {
+	// Refs is the names of the refs to fetch, such as "refs/heads/main". If
+	// empty, all the advertised refs are fetched.
+	Refs []string
+	// Haves returns the local commits to offer, one per call, and "" at the
+	// end. gitprotocolio.HaveWalker's Next fits. If nil, nothing is offered,
+	// as in a clone.
+	Haves func() (string, error)
+	// Shallows is the shallow commits of the local repository.
+	Shallows []string
+	// Depth limits the history to the depth from the wants. Zero means the
+	// full history.
+	Depth int
+	// DeepenRelative makes Depth relative to the current shallow commits,
+	// instead of the wants, as git fetch --deepen does.
+	DeepenRelative bool
+	// DeepenSince limits the history to the commits after the time.
+	DeepenSince time.Time
+	// DeepenNot excludes the history of the refs, such as "refs/heads/main".
+	DeepenNot []string
+	// Filter is the object filter of a partial clone, such as "blob:none".
+	Filter *gitprotocolio.FilterSpec
+	// PackfileURIProtocols is the URI schemes, such as "https", of the packs
+	// the client can download besides the fetched pack. If the server
+	// supports packfile-uris, it can offload objects to such packs, which
+	// are returned in FetchResult.PackfileURIs. Only protocol v2 supports
+	// it.
+	PackfileURIProtocols []string
+	// UseRefInWant makes the client ask for Refs by name with want-ref
+	// lines, instead of listing the refs with ls-refs first, if the server
+	// supports ref-in-want. FetchResult.Refs are the object IDs the server
+	// resolved. Only protocol v2 supports it.
+	UseRefInWant bool
+	// DisableProtocolV2 makes the client speak protocol v0. Otherwise, it
+	// requests protocol v2 and falls back to v0 if the server doesn't speak
+	// it.
+	DisableProtocolV2 bool
+	// Progress receives the progress messages of the server. If nil, they
+	// are discarded. Use gitprotocolio.ProgressParser to get them as
+	// structured events.
+	Progress io.Writer
+	// PhaseTimeouts limits the time of the ref discovery, the negotiation
+	// and the pack transfer. The pack transfer lasts until
+	// FetchResult.Pack is closed. When a phase runs out of time, the fetch
+	// or the reads of the pack fail with a gitprotocolio.PhaseDeadlineError.
+	PhaseTimeouts gitprotocolio.PhaseTimeouts
+}
+
+// FetchResult is the result of Fetch.
+type FetchResult struct {
+	// ProtocolVersion is the protocol version the server chose.
+	ProtocolVersion uint64
+	// Refs maps the names of the fetched refs to their object IDs.
+	Refs map[string]string
+	// Shallows and Unshallows are the shallow commits to add to and remove
+	// from the local repository.
+	Shallows   []string
+	Unshallows []string
+	// Pack is the pack data, without the sideband framing. It's nil if
+	// there's nothing to fetch. The caller must close it.
+	Pack io.ReadCloser
+	// PackfileURIs are the packs the server offloaded objects to. The
+	// caller must download them too, and check them with the hashes.
+	PackfileURIs []*PackfileURI
+}
+
+// PackfileURI is a pack to download, a line of the packfile-uris section.
+type PackfileURI struct {
+	// Hash is the hash of the pack, the checksum at the end of it.
+	Hash string
+	URI  string
+}
+
+// Fetch discovers the refs, negotiates the common commits, and returns the
+// pack stream of the refs.
+func Fetch(ctx context.Context, t Transport, opts *FetchOptions) (*FetchResult, error) {
+	pd, ctx := gitprotocolio.NewPhaseDeadlines(ctx, opts.PhaseTimeouts, nil)
+	pd.Start(gitprotocolio.PhaseDiscovery)
+	result, err := fetch(ctx, t, pd, opts)
+	if err != nil {
+		err = phaseError(ctx, err)
+		pd.Stop()
+		return nil, err
+	}
+	if result.Pack == nil {
+		pd.Stop()
+		return result, nil
+	}
+	result.Pack = &phaseReadCloser{ReadCloser: result.Pack, ctx: ctx, deadlines: pd}
+	return result, nil
+}
+
+func fetch(ctx context.Context, t Transport, pd *gitprotocolio.PhaseDeadlines, opts *FetchOptions) (*FetchResult, error) {
+	d, err := discover(ctx, t, uploadPackService, opts.DisableProtocolV2)
+	if err != nil {
+		return nil, err
+	}
+	if d.ProtocolVersion == 2 {
+		return fetchV2(ctx, t, pd, d, opts)
+	}
+	return fetchV0(ctx, t, pd, d, opts)
+}
+
+// selectRefs returns the refs of the names, or all the refs if names is empty.
+func selectRefs(refs map[string]string, names []string) (map[string]string, error) {
+	if len(names) == 0 {
+		return refs, nil
+	}
+	ret := map[string]string{}
+	for _, name := range names {
+		oid, ok := refs[name]
+		if !ok {
+			return nil, fmt.Errorf("couldn't find remote ref %s", name)
+		}
+		ret[name] = oid
+	}
+	return ret, nil
+}
+
+// wantObjectIDs returns the sorted unique object IDs of the refs.
+func wantObjectIDs(refs map[string]string) []string {
+	m := map[string]bool{}
+	for _, oid := range refs {
+		m[oid] = true
+	}
+	var ret []string
+	for oid := range m {
+		ret = append(ret, oid)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// isShallowFetch returns true if the fetch needs the shallow capability.
+func isShallowFetch(opts *FetchOptions) bool {
+	return opts.Depth != 0 || len(opts.Shallows) != 0 || !opts.DeepenSince.IsZero() || len(opts.DeepenNot) != 0
+}
+
+// nextHaves adds the local commits to the negotiator until a round is full,
+// and returns the chunks to send. final is true if the negotiation should end
+// with done.
+func nextHaves(n *gitprotocolio.FetchNegotiator, haves func() (string, error)) (chunks []*gitprotocolio.ProtocolV1UploadPackRequestChunk, final bool, err error) {
+	for {
+		if n.Stop() || haves == nil {
+			return chunks, true, nil
+		}
+		oid, err := haves()
+		if err != nil {
+			return nil, false, err
+		}
+		if oid == "" {
+			return chunks, true, nil
+		}
+		cs := n.Have(oid)
+		chunks = append(chunks, cs...)
+		if len(cs) != 0 && cs[len(cs)-1].EndOneRound {
+			return chunks, false, nil
+		}
+	}
+}
+
+// v0Capabilities returns the capabilities of the request that the server
+// supports.
+func v0Capabilities(serverCaps gitprotocolio.Capabilities, opts *FetchOptions) ([]string, error) {
+	// Every round is a separate request as in the stateless-RPC mode, so
+	// no-done can be used: the server sends the pack as soon as it's ready.
+	var caps []string
+	for _, c := range []string{"multi_ack_detailed", "no-done", "side-band-64k", "ofs-delta"} {
+		if serverCaps.Has(c) {
+			caps = append(caps, c)
+		}
+	}
+	if !serverCaps.Has("side-band-64k") {
+		return nil, SyntaxError("the server doesn't support side-band-64k")
+	}
+	if isShallowFetch(opts) {
+		if !serverCaps.Has("shallow") {
+			return nil, SyntaxError("the server doesn't support shallow")
+		}
+		caps = append(caps, "shallow")
+	}
+	for _, c := range []struct {
+		name string
+		used bool
+	}{
+		{"deepen-since", !opts.DeepenSince.IsZero()},
+		{"deepen-not", len(opts.DeepenNot) != 0},
+		{"deepen-relative", opts.DeepenRelative},
+	} {
+		if !c.used {
+			continue
+		}
+		if !serverCaps.Has(c.name) {
+			return nil, SyntaxError("the server doesn't support " + c.name)
+		}
+		caps = append(caps, c.name)
+	}
+	if opts.Filter != nil {
+		if !serverCaps.Has("filter") {
+			return nil, SyntaxError("the server doesn't support filter")
+		}
+		caps = append(caps, "filter")
+	}
+	if f := serverCaps.ObjectFormat(); f != gitprotocolio.ObjectFormatSHA1 {
+		caps = append(caps, "object-format="+string(f))
+	}
+	return caps, nil
+}
+
+func fetchV0(ctx context.Context, t Transport, pd *gitprotocolio.PhaseDeadlines, d *gitprotocolio.ProtocolDiscovery, opts *FetchOptions) (*FetchResult, error) {
+	advertised := map[string]string{}
+	for _, c := range d.Refs {
+		if !c.IsPeeled() && c.RefName() != "" {
+			advertised[c.Ref] = c.ObjectID
+		}
+	}
+	refs, err := selectRefs(advertised, opts.Refs)
+	if err != nil {
+		return nil, err
+	}
+	result := &FetchResult{ProtocolVersion: d.ProtocolVersion, Refs: refs}
+	wants := wantObjectIDs(refs)
+	if len(wants) == 0 {
+		return result, nil
+	}
+	caps, err := v0Capabilities(d.Capabilities, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pd.Start(gitprotocolio.PhaseNegotiation)
+	n := gitprotocolio.NewFetchNegotiator(caps, true)
+	var prefix bytes.Buffer
+	for i, w := range wants {
+		c := &gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: w}
+		if i == 0 {
+			c.Capabilities = caps
+		}
+		prefix.Write(c.EncodeToPktLine())
+	}
+	writeV1Chunks(&prefix, gitprotocolio.ShallowRequestChunks(opts.Shallows))
+	if opts.Depth != 0 {
+		prefix.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenDepth: opts.Depth}).EncodeToPktLine())
+	}
+	if !opts.DeepenSince.IsZero() {
+		prefix.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenSince: uint64(opts.DeepenSince.Unix())}).EncodeToPktLine())
+	}
+	for _, ref := range opts.DeepenNot {
+		prefix.Write((&gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenNotRef: ref}).EncodeToPktLine())
+	}
+	if opts.Filter != nil {
+		prefix.Write(opts.Filter.ProtocolV1Chunk().EncodeToPktLine())
+	}
+	prefix.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+
+	for {
+		haves, final, err := nextHaves(n, opts.Haves)
+		if err != nil {
+			return nil, err
+		}
+		var body bytes.Buffer
+		body.Write(prefix.Bytes())
+		writeV1Chunks(&body, n.CommonHaves())
+		writeV1Chunks(&body, haves)
+		if final {
+			writeV1Chunks(&body, n.Finish())
+		}
+		rc, err := t.Request(ctx, uploadPackService, 0, &body)
+		if err != nil {
+			return nil, err
+		}
+		resp := gitprotocolio.NewProtocolV1UploadPackResponse(rc)
+		resp.SetStatelessRPC(true)
+		resp.SetObjectFormat(gitprotocolio.ObjectFormatFromCapabilities(d.Capabilities))
+		// With no-done, the pack follows "ACK <oid> ready" in the response
+		// of a round without done.
+		var shallows, unshallows []string
+		inPack := false
+		for !inPack && resp.Scan() {
+			c := resp.Chunk()
+			switch {
+			case c.ShallowObjectID != "":
+				shallows = append(shallows, c.ShallowObjectID)
+			case c.UnshallowObjectID != "":
+				unshallows = append(unshallows, c.UnshallowObjectID)
+			case len(c.PackStream) != 0 || len(c.PackFile) != 0:
+				inPack = true
+				pd.Start(gitprotocolio.PhasePackTransfer)
+			default:
+				n.Observe(c)
+			}
+		}
+		if err := resp.Err(); err != nil {
+			rc.Close()
+			return nil, err
+		}
+		if !inPack {
+			rc.Close()
+			if !final {
+				continue
+			}
+			return nil, SyntaxError("no pack in the response")
+		}
+		result.Shallows, result.Unshallows = shallows, unshallows
+		result.Pack = &readCloser{resp.PackReader(opts.Progress), rc}
+		return result, nil
+	}
+}
+
+// v2Request encodes a protocol v2 request.
+func v2Request(command string, caps []string, args []string) []byte {
+	var buf bytes.Buffer
+	buf.Write((&gitprotocolio.ProtocolV2RequestChunk{Command: command}).EncodeToPktLine())
+	for _, c := range caps {
+		buf.Write((&gitprotocolio.ProtocolV2RequestChunk{Capability: c}).EncodeToPktLine())
+	}
+	buf.Write((&gitprotocolio.ProtocolV2RequestChunk{EndCapability: true}).EncodeToPktLine())
+	for _, arg := range args {
+		buf.Write((&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(arg + "\n")}).EncodeToPktLine())
+	}
+	buf.Write((&gitprotocolio.ProtocolV2RequestChunk{EndArgument: true}).EncodeToPktLine())
+	return buf.Bytes()
+}
+
+// v2Features returns the features of a protocol v2 command, such as "shallow"
+// and "filter" of "fetch=shallow filter".
+func v2Features(serverCaps gitprotocolio.Capabilities, command string) gitprotocolio.Capabilities {
+	v, _ := serverCaps.Value(command)
+	return gitprotocolio.ParseCapabilities(v)
+}
+
+func lsRefs(ctx context.Context, t Transport, caps []string, prefixes []string) (map[string]string, error) {
+	req := &gitprotocolio.LsRefsRequest{RefPrefixes: prefixes}
+	rc, err := t.Request(ctx, uploadPackService, 2, bytes.NewReader(v2Request("ls-refs", caps, req.Arguments())))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	refs := map[string]string{}
+	resp := gitprotocolio.NewLsRefsResponse(rc)
+	for resp.Scan() {
+		if c := resp.Chunk(); c.ObjectID != "" {
+			refs[c.Ref] = c.ObjectID
+		}
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func fetchV2(ctx context.Context, t Transport, pd *gitprotocolio.PhaseDeadlines, d *gitprotocolio.ProtocolDiscovery, opts *FetchOptions) (*FetchResult, error) {
+	serverCaps := gitprotocolio.Capabilities(d.Capabilities)
+	var caps []string
+	if f := serverCaps.ObjectFormat(); f != gitprotocolio.ObjectFormatSHA1 {
+		caps = append(caps, "object-format="+string(f))
+	}
+	features := v2Features(serverCaps, "fetch")
+	result := &FetchResult{ProtocolVersion: 2}
+	req := &gitprotocolio.FetchRequest{OfsDelta: true}
+	if opts.UseRefInWant && len(opts.Refs) != 0 && features.Has("ref-in-want") {
+		// The server resolves the refs and returns them in the wanted-refs
+		// section.
+		req.WantRefs = opts.Refs
+		result.Refs = map[string]string{}
+	} else {
+		advertised, err := lsRefs(ctx, t, caps, opts.Refs)
+		if err != nil {
+			return nil, err
+		}
+		refs, err := selectRefs(advertised, opts.Refs)
+		if err != nil {
+			return nil, err
+		}
+		result.Refs = refs
+		req.Wants = wantObjectIDs(refs)
+		if len(req.Wants) == 0 {
+			return result, nil
+		}
+	}
+
+	if isShallowFetch(opts) && !features.Has("shallow") {
+		return nil, SyntaxError("the server doesn't support shallow")
+	}
+	req.Shallows = opts.Shallows
+	req.Deepen = opts.Depth
+	req.DeepenRelative = opts.DeepenRelative
+	if !opts.DeepenSince.IsZero() {
+		req.DeepenSince = uint64(opts.DeepenSince.Unix())
+	}
+	req.DeepenNot = opts.DeepenNot
+	if opts.Filter != nil {
+		if !features.Has("filter") {
+			return nil, SyntaxError("the server doesn't support filter")
+		}
+		req.Filter = opts.Filter
+	}
+	// Git's upload-pack sends packfile-uris only with sideband-all.
+	req.SideBandAll = features.Has("sideband-all")
+	if features.Has("packfile-uris") {
+		req.PackfileURIs = opts.PackfileURIProtocols
+	}
+
+	pd.Start(gitprotocolio.PhaseNegotiation)
+	n := gitprotocolio.NewFetchNegotiator([]string{"multi_ack_detailed"}, true)
+	for {
+		haves, final, err := nextHaves(n, opts.Haves)
+		if err != nil {
+			return nil, err
+		}
+		req.Haves = nil
+		for _, c := range append(n.CommonHaves(), haves...) {
+			if c.HaveObjectID != "" {
+				req.Haves = append(req.Haves, c.HaveObjectID)
+			}
+		}
+		req.Done = final
+		args := req.Arguments()
+		rc, err := t.Request(ctx, uploadPackService, 2, bytes.NewReader(v2Request("fetch", caps, args)))
+		if err != nil {
+			return nil, err
+		}
+		resp := gitprotocolio.NewProtocolV2FetchResponse(rc)
+		resp.SetObjectFormat(serverCaps.ObjectFormat())
+		resp.SetSideBandAll(req.SideBandAll)
+		var first []byte
+		for first == nil && resp.Scan() {
+			c := resp.Chunk()
+			switch {
+			case c.Nak:
+				n.Observe(&gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true})
+			case c.AckObjectID != "":
+				n.Observe(&gitprotocolio.ProtocolV1UploadPackResponseChunk{AckObjectID: c.AckObjectID, AckDetail: "common"})
+			case c.Ready:
+				// The pack follows in the same response.
+				final = true
+			case c.WantedRefName != "":
+				result.Refs[c.WantedRefName] = c.WantedRefObjectID
+			case c.ShallowObjectID != "":
+				result.Shallows = append(result.Shallows, c.ShallowObjectID)
+			case c.UnshallowObjectID != "":
+				result.Unshallows = append(result.Unshallows, c.UnshallowObjectID)
+			case c.PackfileURIHash != "":
+				result.PackfileURIs = append(result.PackfileURIs, &PackfileURI{Hash: c.PackfileURIHash, URI: c.PackfileURI})
+			case len(c.PackStream) != 0:
+				first = append([]byte(nil), c.PackStream...)
+				pd.Start(gitprotocolio.PhasePackTransfer)
+			case len(c.SideBandMessage) != 0:
+				err = sideBandMessage(c.SideBandMessage, opts.Progress)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = resp.Err()
+		}
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		if first == nil {
+			rc.Close()
+			if final {
+				return nil, SyntaxError("no pack in the response")
+			}
+			continue
+		}
+		result.Pack = &packReader{
+			next: func() ([]byte, error) {
+				if first != nil {
+					bs := first
+					first = nil
+					return bs, nil
+				}
+				for resp.Scan() {
+					c := resp.Chunk()
+					if len(c.PackStream) != 0 {
+						return c.PackStream, nil
+					}
+					if c.EndResponse {
+						return nil, io.EOF
+					}
+				}
+				if err := resp.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.ErrUnexpectedEOF
+			},
+			progress: opts.Progress,
+			closer:   rc,
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/gittest"
+)
+
+var testPack = []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00fake")
+
+func newTestServer() *gittest.Server {
+	s := gittest.NewServer()
+	s.SetRef("refs/heads/master", oidA)
+	s.SetTag("refs/tags/v1", oidB, oidA)
+	s.SetPack(oidA, testPack)
+	return s
+}
+
+// haves returns the Haves of n commits unknown to the server.
+func haves(n int) func() (string, error) {
+	i := 0
+	return func() (string, error) {
+		if i == n {
+			return "", nil
+		}
+		i++
+		return fmt.Sprintf("%040x", 0xf000+i), nil
+	}
+}
+
+func TestFetch(t *testing.T) {
+	for _, disableV2 := range []bool{true, false} {
+		for _, tc := range []struct {
+			name string
+			opts FetchOptions
+			refs map[string]string
+		}{
+			{"all", FetchOptions{}, map[string]string{"HEAD": oidA, "refs/heads/master": oidA, "refs/tags/v1": oidB}},
+			{"one ref", FetchOptions{Refs: []string{"refs/heads/master"}}, map[string]string{"refs/heads/master": oidA}},
+			// The server NAKs every round until the client runs out of
+			// haves and sends done.
+			{"haves", FetchOptions{Refs: []string{"refs/heads/master"}, Haves: haves(100)}, map[string]string{"refs/heads/master": oidA}},
+		} {
+			name := fmt.Sprintf("%s, v2 disabled %v", tc.name, disableV2)
+			opts := tc.opts
+			opts.DisableProtocolV2 = disableV2
+			result, err := Fetch(context.Background(), newTestServer(), &opts)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			want := uint64(2)
+			if disableV2 {
+				want = 0
+			}
+			if result.ProtocolVersion != want {
+				t.Errorf("%s: got version %d, want %d", name, result.ProtocolVersion, want)
+			}
+			if !reflect.DeepEqual(result.Refs, tc.refs) {
+				t.Errorf("%s: got refs %v, want %v", name, result.Refs, tc.refs)
+			}
+			pack, err := io.ReadAll(result.Pack)
+			result.Pack.Close()
+			if err != nil || !bytes.Equal(pack, testPack) {
+				t.Errorf("%s: got pack %q, %v", name, pack, err)
+			}
+		}
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	for _, disableV2 := range []bool{true, false} {
+		for _, tc := range []struct {
+			name string
+			opts FetchOptions
+			want string
+		}{
+			{"unknown ref", FetchOptions{Refs: []string{"refs/heads/missing"}}, "couldn't find remote ref refs/heads/missing"},
+			// gittest doesn't support shallow or filter.
+			{"shallow", FetchOptions{Depth: 1}, "the server doesn't support shallow"},
+			{"filter", FetchOptions{Filter: &gitprotocolio.FilterSpec{Type: gitprotocolio.FilterTypeBlobNone}}, "the server doesn't support filter"},
+		} {
+			opts := tc.opts
+			opts.DisableProtocolV2 = disableV2
+			if _, err := Fetch(context.Background(), newTestServer(), &opts); err == nil || err.Error() != tc.want {
+				t.Errorf("%s, v2 disabled %v: got %v, want %s", tc.name, disableV2, err, tc.want)
+			}
+		}
+	}
+
+	// Nothing to fetch from an empty repository.
+	result, err := Fetch(context.Background(), gittest.NewServer(), &FetchOptions{})
+	if err != nil || result.Pack != nil || len(result.Refs) != 0 {
+		t.Errorf("empty: got %+v, %v", result, err)
+	}
+}
+
+func TestFetchShallow(t *testing.T) {
+	var req []byte
+	tr := &fakeTransport{
+		caps: []string{"side-band-64k", "shallow"},
+		refs: []*gitprotocolio.AdvertisedRef{{Name: "refs/heads/main", ObjectID: oidA}},
+		request: func(ctx context.Context, service string, body []byte) (io.ReadCloser, error) {
+			req = body
+			var b bytes.Buffer
+			b.Write(gitprotocolio.BytesPacket("shallow " + oidA + "\n").EncodeToPktLine())
+			b.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+			b.Write(gitprotocolio.BytesPacket("NAK\n").EncodeToPktLine())
+			b.Write(gitprotocolio.BytesPacket("\x02Counting objects\n").EncodeToPktLine())
+			b.Write(gitprotocolio.BytesPacket("\x01PACK").EncodeToPktLine())
+			b.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+			return io.NopCloser(&b), nil
+		},
+	}
+	var progress bytes.Buffer
+	result, err := Fetch(context.Background(), tr, &FetchOptions{DisableProtocolV2: true, Depth: 1, Progress: &progress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack, err := io.ReadAll(result.Pack)
+	result.Pack.Close()
+	if err != nil || string(pack) != "PACK" {
+		t.Errorf("got pack %q, %v", pack, err)
+	}
+	if want := []string{oidA}; !reflect.DeepEqual(result.Shallows, want) {
+		t.Errorf("got shallows %q, want %q", result.Shallows, want)
+	}
+	if progress.String() != "Counting objects\n" {
+		t.Errorf("got progress %q", progress.String())
+	}
+	if !strings.Contains(string(req), "want "+oidA+" side-band-64k shallow\n") || !strings.Contains(string(req), "deepen 1\n") {
+		t.Errorf("got request %q", req)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/google/gitprotocolio"
+)
+
+const receivePackService = "git-receive-pack"
+
+// PushOptions is the options of Push.
+type PushOptions struct {
+	// Updates is the ref update commands. Status is ignored. A zero
+	// OldObjectID creates the ref and a zero NewObjectID deletes it.
+	Updates []*gitprotocolio.RefUpdate
+	// Pack is the pack with the objects the server needs. It's streamed to
+	// the server as is. It can be nil if all the updates are deletions.
+	Pack io.Reader
+	// PushOptions is the push options, such as "ci.skip".
+	PushOptions []string
+	// Atomic makes the server update either all the refs or none of them.
+	Atomic bool
+	// SignPushCert makes the push a signed push. It signs the payload of
+	// the push certificate, such as with gpg --detach-sign --armor, and
+	// returns the armored signature. The server must support push-cert.
+	SignPushCert func(payload []byte) ([]byte, error)
+	// Pusher is the identity of the signer with a timestamp, such as
+	// "A U Thor <author@example.com> 1700000000 +0000", for a signed push.
+	Pusher string
+	// Pushee is the URL of the repository in the push certificate. It's
+	// optional.
+	Pushee string
+	// Progress receives the progress messages of the server. If nil, they
+	// are discarded.
+	Progress io.Writer
+	// PhaseTimeouts limits the time of the ref discovery and of the pack
+	// transfer, which lasts from sending the commands to reading the
+	// report. When a phase runs out of time, the push fails with a
+	// gitprotocolio.PhaseDeadlineError. Negotiation is unused.
+	PhaseTimeouts gitprotocolio.PhaseTimeouts
+}
+
+// PushResult is the result of Push.
+type PushResult struct {
+	// Unpack is the result of unpacking the pack.
+	Unpack *gitprotocolio.UnpackStatus
+	// Updates is the ref update commands with the Status reported by the
+	// server. Status is nil if the server didn't report one.
+	Updates []*gitprotocolio.RefUpdate
+}
+
+// pushCapabilities returns the capabilities of the request that the server
+// supports.
+func pushCapabilities(serverCaps gitprotocolio.Capabilities, opts *PushOptions) ([]string, error) {
+	var caps []string
+	switch {
+	case serverCaps.Has("report-status-v2"):
+		caps = append(caps, "report-status-v2")
+	case serverCaps.Has("report-status"):
+		caps = append(caps, "report-status")
+	default:
+		return nil, SyntaxError("the server doesn't support report-status")
+	}
+	for _, c := range []string{"side-band-64k", "ofs-delta"} {
+		if serverCaps.Has(c) {
+			caps = append(caps, c)
+		}
+	}
+	if opts.Progress == nil && serverCaps.Has("quiet") {
+		caps = append(caps, "quiet")
+	}
+	if opts.Atomic {
+		if !serverCaps.Has("atomic") {
+			return nil, SyntaxError("the server doesn't support atomic")
+		}
+		caps = append(caps, "atomic")
+	}
+	if len(opts.PushOptions) != 0 {
+		if !serverCaps.Has("push-options") {
+			return nil, SyntaxError("the server doesn't support push-options")
+		}
+		caps = append(caps, "push-options")
+	}
+	for _, u := range opts.Updates {
+		if u.Kind() == "delete" {
+			if !serverCaps.Has("delete-refs") {
+				return nil, SyntaxError("the server doesn't support delete-refs")
+			}
+			caps = append(caps, "delete-refs")
+			break
+		}
+	}
+	if f := serverCaps.ObjectFormat(); f != gitprotocolio.ObjectFormatSHA1 {
+		caps = append(caps, "object-format="+string(f))
+	}
+	return caps, nil
+}
+
+// signPushCert returns the push certificate of the updates signed with the
+// nonce the server advertised.
+func signPushCert(serverCaps gitprotocolio.Capabilities, opts *PushOptions) (*gitprotocolio.PushCertificate, error) {
+	nonce, ok := serverCaps.Value("push-cert")
+	if !ok {
+		return nil, SyntaxError("the server doesn't support push-cert")
+	}
+	if opts.Pusher == "" {
+		return nil, SyntaxError("no pusher for the push certificate")
+	}
+	cert := &gitprotocolio.PushCertificate{
+		Pusher:      opts.Pusher,
+		Pushee:      opts.Pushee,
+		Nonce:       nonce,
+		PushOptions: opts.PushOptions,
+	}
+	for _, u := range opts.Updates {
+		cert.Commands = append(cert.Commands, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			OldObjectID: u.OldObjectID,
+			NewObjectID: u.NewObjectID,
+			RefName:     u.RefName,
+			InPushCert:  true,
+		})
+	}
+	cert.Payload = cert.EncodePayload()
+	sig, err := opts.SignPushCert(cert.Payload)
+	if err != nil {
+		return nil, err
+	}
+	cert.Signature = sig
+	return cert, nil
+}
+
+// Push sends the ref update commands and the pack, and returns the results
+// reported by the server. A rejected update or a failed unpack is reported in
+// the result, not as an error.
+func Push(ctx context.Context, t Transport, opts *PushOptions) (*PushResult, error) {
+	if len(opts.Updates) == 0 {
+		return nil, SyntaxError("no ref update commands")
+	}
+	pd, ctx := gitprotocolio.NewPhaseDeadlines(ctx, opts.PhaseTimeouts, nil)
+	defer pd.Stop()
+	pd.Start(gitprotocolio.PhaseDiscovery)
+	result, err := push(ctx, t, pd, opts)
+	if err != nil {
+		return nil, phaseError(ctx, err)
+	}
+	return result, nil
+}
+
+func push(ctx context.Context, t Transport, pd *gitprotocolio.PhaseDeadlines, opts *PushOptions) (*PushResult, error) {
+	// Protocol v2 doesn't have push yet.
+	d, err := discover(ctx, t, receivePackService, true)
+	if err != nil {
+		return nil, err
+	}
+	serverCaps := gitprotocolio.Capabilities(d.Capabilities)
+	caps, err := pushCapabilities(serverCaps, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmds bytes.Buffer
+	if opts.SignPushCert != nil {
+		cert, err := signPushCert(serverCaps, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range cert.Chunks(caps) {
+			cmds.Write(c.EncodeToPktLine())
+		}
+	} else {
+		for i, u := range opts.Updates {
+			c := &gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+				OldObjectID: u.OldObjectID,
+				NewObjectID: u.NewObjectID,
+				RefName:     u.RefName,
+			}
+			if i == 0 {
+				c.Capabilities = caps
+			}
+			cmds.Write(c.EncodeToPktLine())
+		}
+	}
+	cmds.Write((&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true}).EncodeToPktLine())
+	if len(opts.PushOptions) != 0 {
+		chunks, err := gitprotocolio.PushOptionsChunks(opts.PushOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range chunks {
+			cmds.Write(c.EncodeToPktLine())
+		}
+	}
+	var body io.Reader = &cmds
+	if opts.Pack != nil {
+		body = io.MultiReader(&cmds, opts.Pack)
+	}
+
+	pd.Start(gitprotocolio.PhasePackTransfer)
+	rc, err := t.Request(ctx, receivePackService, 0, body)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var resp *gitprotocolio.ProtocolV1ReceivePackResponse
+	if serverCaps.Has("side-band-64k") {
+		resp = gitprotocolio.NewProtocolV1ReceivePackResponseFromSideBand(rc, opts.Progress)
+	} else {
+		resp = gitprotocolio.NewProtocolV1ReceivePackResponse(rc)
+	}
+	var chunks []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	for resp.Scan() {
+		c := *resp.Chunk()
+		chunks = append(chunks, &c)
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].Unpack() == nil {
+		return nil, SyntaxError("no unpack status in the response")
+	}
+	sts, err := gitprotocolio.ParseRefStatuses(chunks)
+	if err != nil {
+		return nil, err
+	}
+	byRef := map[string]*gitprotocolio.RefStatus{}
+	for _, st := range sts {
+		byRef[st.RefName] = st
+	}
+
+	result := &PushResult{Unpack: chunks[0].Unpack()}
+	for _, u := range opts.Updates {
+		result.Updates = append(result.Updates, &gitprotocolio.RefUpdate{
+			RefName:     u.RefName,
+			OldObjectID: u.OldObjectID,
+			NewObjectID: u.NewObjectID,
+			Status:      byRef[u.RefName],
+		})
+	}
+	return result, nil
+}
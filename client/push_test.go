@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+var zeroOID = gitprotocolio.HashAlgoSHA1.ZeroObjectID()
+
+func TestPush(t *testing.T) {
+	s := newTestServer()
+	s.SetRef("refs/heads/old", oidA)
+	result, err := Push(context.Background(), s, &PushOptions{
+		Updates: []*gitprotocolio.RefUpdate{
+			{RefName: "refs/heads/master", OldObjectID: oidA, NewObjectID: oidB},
+			{RefName: "refs/heads/new", OldObjectID: zeroOID, NewObjectID: oidB},
+			{RefName: "refs/heads/old", OldObjectID: oidA, NewObjectID: zeroOID},
+			// The server has another value.
+			{RefName: "refs/tags/v1", OldObjectID: oidA, NewObjectID: oidB},
+		},
+		Pack:        bytes.NewReader(testPack),
+		PushOptions: []string{"ci.skip"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Unpack.Ok {
+		t.Errorf("got unpack %+v", result.Unpack)
+	}
+	var got []string
+	for _, u := range result.Updates {
+		if u.Status == nil {
+			t.Fatalf("%s: no status", u.RefName)
+		}
+		got = append(got, u.RefName+" "+u.Status.Reason)
+	}
+	want := []string{"refs/heads/master ", "refs/heads/new ", "refs/heads/old ", "refs/tags/v1 failed to update ref"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := map[string]string{"refs/heads/master": oidB, "refs/heads/new": oidB, "refs/tags/v1": oidB}; !reflect.DeepEqual(s.Refs(), want) {
+		t.Errorf("got refs %v, want %v", s.Refs(), want)
+	}
+	pushes := s.Pushes()
+	if len(pushes) != 1 || !bytes.Equal(pushes[0].Pack, testPack) || !reflect.DeepEqual(pushes[0].Options, []string{"ci.skip"}) {
+		t.Errorf("got pushes %+v", pushes)
+	}
+}
+
+func TestPushAtomic(t *testing.T) {
+	s := newTestServer()
+	result, err := Push(context.Background(), s, &PushOptions{
+		Updates: []*gitprotocolio.RefUpdate{
+			{RefName: "refs/heads/master", OldObjectID: oidA, NewObjectID: oidB},
+			{RefName: "refs/heads/stale", OldObjectID: oidA, NewObjectID: oidB},
+		},
+		Atomic: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range result.Updates {
+		if u.Status == nil || u.Status.Ok {
+			t.Errorf("%s: got status %+v, want a failure", u.RefName, u.Status)
+		}
+	}
+	if got := s.Refs()["refs/heads/master"]; got != oidA {
+		t.Errorf("got master %s, want %s", got, oidA)
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	update := []*gitprotocolio.RefUpdate{{RefName: "refs/heads/master", OldObjectID: oidA, NewObjectID: oidB}}
+	for _, tc := range []struct {
+		name string
+		opts *PushOptions
+		want string
+	}{
+		{"no updates", &PushOptions{}, "no ref update commands"},
+		{"push-cert", &PushOptions{Updates: update, SignPushCert: func([]byte) ([]byte, error) { return nil, nil }}, "the server doesn't support push-cert"},
+	} {
+		if _, err := Push(context.Background(), newTestServer(), tc.opts); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.name, err, tc.want)
+		}
+	}
+
+	// A server without report-status.
+	tr := &fakeTransport{refs: []*gitprotocolio.AdvertisedRef{{Name: "refs/heads/master", ObjectID: oidA}}}
+	if _, err := Push(context.Background(), tr, &PushOptions{Updates: update}); err == nil || err.Error() != "the server doesn't support report-status" {
+		t.Errorf("got %v", err)
+	}
+}
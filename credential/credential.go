@@ -0,0 +1,232 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package credential implements the Git credential helper protocol.
+//
+// A credential is a list of key=value lines terminated by a blank line or the
+// end of the input. See gitcredentials(7) and git-credential(1).
+package credential
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// SyntaxError is an error returned when the parser cannot parse the input.
+type SyntaxError string
+
+func (s SyntaxError) Error() string { return string(s) }
+
+// Action is an action of a credential helper.
+type Action string
+
+const (
+	// ActionGet asks for a matching credential.
+	ActionGet Action = "get"
+	// ActionStore asks to store the credential.
+	ActionStore Action = "store"
+	// ActionErase asks to remove the matching credentials.
+	ActionErase Action = "erase"
+)
+
+// Credential is a credential exchanged with a credential helper.
+type Credential struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+	Password string
+	// WWWAuth are the WWW-Authenticate header values the server sent.
+	WWWAuth []string
+	// Quit is true if the helper asks Git not to consult other helpers.
+	Quit bool
+	// Extra are the attributes that this package doesn't know, in the
+	// order they appeared.
+	Extra [][2]string
+}
+
+// FromURL returns a Credential that matches u.
+func FromURL(u *url.URL) *Credential {
+	c := &Credential{
+		Protocol: u.Scheme,
+		Host:     u.Host,
+		Path:     strings.TrimPrefix(u.Path, "/"),
+	}
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+	}
+	return c
+}
+
+// Read reads a credential from r. It reads until a blank line or the end of
+// the input.
+func Read(r io.Reader) (*Credential, error) {
+	c := &Credential{}
+	if err := c.read(r); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Credential) read(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			break
+		}
+		ss := strings.SplitN(line, "=", 2)
+		if len(ss) != 2 {
+			return SyntaxError("cannot split into key and value: " + line)
+		}
+		if err := c.set(ss[0], ss[1]); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func (c *Credential) set(key, value string) error {
+	switch key {
+	case "protocol":
+		c.Protocol = value
+	case "host":
+		c.Host = value
+	case "path":
+		c.Path = value
+	case "username":
+		c.Username = value
+	case "password":
+		c.Password = value
+	case "wwwauth[]":
+		if value == "" {
+			// An empty value resets the list.
+			c.WWWAuth = nil
+		} else {
+			c.WWWAuth = append(c.WWWAuth, value)
+		}
+	case "quit":
+		c.Quit = value == "1" || value == "true"
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil {
+			return SyntaxError("cannot parse url: " + value)
+		}
+		fu := FromURL(u)
+		c.Protocol, c.Host, c.Path = fu.Protocol, fu.Host, fu.Path
+		if fu.Username != "" {
+			c.Username = fu.Username
+		}
+		if fu.Password != "" {
+			c.Password = fu.Password
+		}
+	default:
+		c.Extra = append(c.Extra, [2]string{key, value})
+	}
+	return nil
+}
+
+// WriteTo writes the credential to w. It doesn't write the terminating blank
+// line.
+func (c *Credential) WriteTo(w io.Writer) (int64, error) {
+	var b bytes.Buffer
+	attrs := [][2]string{
+		{"protocol", c.Protocol},
+		{"host", c.Host},
+		{"path", c.Path},
+		{"username", c.Username},
+		{"password", c.Password},
+	}
+	for _, v := range c.WWWAuth {
+		attrs = append(attrs, [2]string{"wwwauth[]", v})
+	}
+	if c.Quit {
+		attrs = append(attrs, [2]string{"quit", "1"})
+	}
+	attrs = append(attrs, c.Extra...)
+	for _, kv := range attrs {
+		if kv[1] == "" {
+			continue
+		}
+		if strings.ContainsAny(kv[1], "\n\x00") || strings.ContainsAny(kv[0], "=\n\x00") {
+			return 0, SyntaxError(fmt.Sprintf("invalid attribute %q", kv[0]))
+		}
+		fmt.Fprintf(&b, "%s=%s\n", kv[0], kv[1])
+	}
+	return b.WriteTo(w)
+}
+
+// Helper is a credential helper as specified in credential.helper. It is the
+// name of a helper ("store" runs git credential-store), an absolute path, or a
+// shell snippet prefixed with "!". It can have arguments.
+type Helper string
+
+// Get asks the helper for a credential matching c. The returned credential
+// has the attributes of c overwritten by the helper's response.
+func (h Helper) Get(ctx context.Context, c *Credential) (*Credential, error) {
+	out, err := h.run(ctx, ActionGet, c)
+	if err != nil {
+		return nil, err
+	}
+	ret := *c
+	ret.WWWAuth = append([]string(nil), c.WWWAuth...)
+	ret.Extra = append([][2]string(nil), c.Extra...)
+	if err := ret.read(bytes.NewReader(out)); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// Store asks the helper to store the credential.
+func (h Helper) Store(ctx context.Context, c *Credential) error {
+	_, err := h.run(ctx, ActionStore, c)
+	return err
+}
+
+// Erase asks the helper to remove the credentials matching c.
+func (h Helper) Erase(ctx context.Context, c *Credential) error {
+	_, err := h.run(ctx, ActionErase, c)
+	return err
+}
+
+func (h Helper) run(ctx context.Context, action Action, c *Credential) ([]byte, error) {
+	var in bytes.Buffer
+	if _, err := c.WriteTo(&in); err != nil {
+		return nil, err
+	}
+	in.WriteString("\n")
+
+	script := string(h)
+	switch {
+	case strings.HasPrefix(script, "!"):
+		script = script[1:]
+	case !filepath.IsAbs(script):
+		script = "git credential-" + script
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", script+` "$@"`, script, string(action))
+	cmd.Stdin = &in
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q failed: %v", string(h), err)
+	}
+	return out, nil
+}
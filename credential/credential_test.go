@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package credential
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	in := "protocol=https\nhost=example.com\nwwwauth[]=Basic\nwwwauth[]=\nwwwauth[]=Bearer\nquit=true\ncapability[]=authtype\n\nusername=ignored\n"
+	c, err := Read(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Credential{
+		Protocol: "https",
+		Host:     "example.com",
+		WWWAuth:  []string{"Bearer"},
+		Quit:     true,
+		Extra:    [][2]string{{"capability[]", "authtype"}},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+}
+
+func TestReadURL(t *testing.T) {
+	c, err := Read(strings.NewReader("username=a\nurl=https://b:c@example.com/repo.git\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Credential{Protocol: "https", Host: "example.com", Path: "repo.git", Username: "b", Password: "c"}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+	u, _ := url.Parse("https://example.com/repo.git")
+	if got := FromURL(u); got.Username != "" || got.Path != "repo.git" {
+		t.Errorf("got %+v", got)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for _, in := range []string{
+		"host\n",
+		"url=%zz\n",
+	} {
+		if _, err := Read(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: got no error", in)
+		}
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	c := &Credential{
+		Protocol: "https",
+		Host:     "example.com",
+		Password: "p",
+		WWWAuth:  []string{"Basic"},
+		Quit:     true,
+		Extra:    [][2]string{{"state[]", "x"}},
+	}
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "protocol=https\nhost=example.com\npassword=p\nwwwauth[]=Basic\nquit=1\nstate[]=x\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	got, err := Read(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("got %+v, want %+v", got, c)
+	}
+}
+
+func TestWriteToErrors(t *testing.T) {
+	for _, c := range []*Credential{
+		{Host: "example.com\nusername=evil"},
+		{Password: "a\x00b"},
+		{Extra: [][2]string{{"a=b", "c"}}},
+	} {
+		if _, err := c.WriteTo(&bytes.Buffer{}); err == nil {
+			t.Errorf("%+v: got no error", c)
+		}
+	}
+}
+
+func TestHelper(t *testing.T) {
+	ctx := context.Background()
+	c := &Credential{Protocol: "https", Host: "example.com"}
+	h := Helper(`!f() { test "$1" = get && cat >/dev/null && printf 'username=u\npassword=p\n'; }; f`)
+	got, err := h.Get(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Credential{Protocol: "https", Host: "example.com", Username: "u", Password: "p"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if c.Username != "" {
+		t.Errorf("Get modified the input: %+v", c)
+	}
+	if err := Helper("!exit 1").Store(ctx, c); err == nil {
+		t.Error("got no error from a failing helper")
+	}
+	if _, err := Helper("!echo bad").Get(ctx, c); err == nil {
+		t.Error("got no error from a malformed response")
+	}
+}
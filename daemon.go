@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DaemonPort is the default TCP port of the git:// protocol.
+const DaemonPort = 9418
+
+// DaemonRequest is the request line that a client sends first over the git://
+// protocol, such as
+// "git-upload-pack /project.git\0host=example.com\0\0version=2\0".
+type DaemonRequest struct {
+	// Service is "git-upload-pack", "git-receive-pack", or
+	// "git-upload-archive".
+	Service string
+	Path    string
+	// Host is the host-parameter, which can have a ":port" suffix. It's
+	// optional.
+	Host string
+	// ExtraParameters are the extra parameters, such as "version=2".
+	ExtraParameters []string
+}
+
+// EncodeToPktLine serializes the request.
+func (r *DaemonRequest) EncodeToPktLine() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\x00", r.Service, r.Path)
+	if r.Host != "" {
+		fmt.Fprintf(&b, "host=%s\x00", r.Host)
+	}
+	if len(r.ExtraParameters) != 0 {
+		b.WriteByte(0)
+		for _, p := range r.ExtraParameters {
+			b.WriteString(p)
+			b.WriteByte(0)
+		}
+	}
+	return BytesPacket(b.Bytes()).EncodeToPktLine()
+}
+
+// ProtocolVersion returns the protocol version requested by the "version"
+// extra parameter, or 0 if none.
+func (r *DaemonRequest) ProtocolVersion() int {
+	for _, p := range r.ExtraParameters {
+		if v, ok := strings.CutPrefix(p, "version="); ok {
+			if n, err := strconv.Atoi(v); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// ParseDaemonRequest parses the content of a request line packet.
+func ParseDaemonRequest(bs []byte) (*DaemonRequest, error) {
+	s := string(bs)
+	cmd, rest, ok := strings.Cut(s, "\x00")
+	if !ok {
+		return nil, SyntaxError(fmt.Sprintf("no NUL after the path: %q", s))
+	}
+	// Old clients end the command with a newline.
+	service, path, ok := strings.Cut(strings.TrimSuffix(cmd, "\n"), " ")
+	if !ok || service == "" || path == "" {
+		return nil, SyntaxError(fmt.Sprintf("cannot parse the request command: %q", cmd))
+	}
+	r := &DaemonRequest{Service: service, Path: path}
+	if h, ok := strings.CutPrefix(rest, "host="); ok {
+		r.Host, rest, ok = strings.Cut(h, "\x00")
+		if !ok {
+			return nil, SyntaxError(fmt.Sprintf("no NUL after the host parameter: %q", s))
+		}
+	}
+	if rest == "" {
+		return r, nil
+	}
+	params, ok := strings.CutPrefix(rest, "\x00")
+	if !ok {
+		return nil, SyntaxError(fmt.Sprintf("unexpected data after the host parameter: %q", s))
+	}
+	for params != "" {
+		var p string
+		p, params, ok = strings.Cut(params, "\x00")
+		if !ok {
+			return nil, SyntaxError(fmt.Sprintf("no NUL after an extra parameter: %q", s))
+		}
+		if p != "" {
+			r.ExtraParameters = append(r.ExtraParameters, p)
+		}
+	}
+	return r, nil
+}
+
+// ReadDaemonRequest reads the request line packet from a git:// connection.
+// It doesn't read ahead of the packet, so the rest of the connection can be
+// handed to a service.
+func ReadDaemonRequest(rd io.Reader) (*DaemonRequest, error) {
+	hdr := make([]byte, PacketLengthHeaderSize)
+	if _, err := io.ReadFull(rd, hdr); err != nil {
+		return nil, err
+	}
+	sz, err := strconv.ParseUint(string(hdr), 16, 16)
+	if err != nil {
+		return nil, SyntaxError(fmt.Sprintf("cannot parse the packet length: %q", hdr))
+	}
+	if sz <= PacketLengthHeaderSize || sz > MaxPacketSize {
+		return nil, SyntaxError(fmt.Sprintf("invalid request line length: %d", sz))
+	}
+	bs := make([]byte, sz-PacketLengthHeaderSize)
+	if _, err := io.ReadFull(rd, bs); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return ParseDaemonRequest(bs)
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDaemonRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		in      string
+		want    *DaemonRequest
+		version int
+	}{
+		{"full", "git-upload-pack /project.git\x00host=example.com:9418\x00\x00version=2\x00", &DaemonRequest{Service: "git-upload-pack", Path: "/project.git", Host: "example.com:9418", ExtraParameters: []string{"version=2"}}, 2},
+		{"no host", "git-receive-pack /project.git\x00\x00version=1\x00", &DaemonRequest{Service: "git-receive-pack", Path: "/project.git", ExtraParameters: []string{"version=1"}}, 1},
+		{"no extra parameters", "git-upload-archive /project.git\x00host=example.com\x00", &DaemonRequest{Service: "git-upload-archive", Path: "/project.git", Host: "example.com"}, 0},
+		{"only the command", "git-upload-pack /project.git\x00", &DaemonRequest{Service: "git-upload-pack", Path: "/project.git"}, 0},
+	} {
+		got, err := ParseDaemonRequest([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+		if got.ProtocolVersion() != tc.version {
+			t.Errorf("%s: got version %d, want %d", tc.name, got.ProtocolVersion(), tc.version)
+		}
+		if got := string(tc.want.EncodeToPktLine()); got != pktLines(tc.in) {
+			t.Errorf("%s: encoded to %q, want %q", tc.name, got, pktLines(tc.in))
+		}
+	}
+
+	// Old clients end the command with a newline.
+	if got, err := ParseDaemonRequest([]byte("git-upload-pack /project.git\n\x00")); err != nil || got.Path != "/project.git" {
+		t.Errorf("newline: got %+v, %v", got, err)
+	}
+
+	for _, in := range []string{
+		"git-upload-pack /project.git",
+		"git-upload-pack\x00",
+		"git-upload-pack /project.git\x00host=example.com",
+		"git-upload-pack /project.git\x00junk",
+		"git-upload-pack /project.git\x00\x00version=2",
+	} {
+		if _, err := ParseDaemonRequest([]byte(in)); err == nil {
+			t.Errorf("%q: got no error", in)
+		}
+	}
+}
+
+func TestReadDaemonRequest(t *testing.T) {
+	req := &DaemonRequest{Service: "git-upload-pack", Path: "/project.git", Host: "example.com", ExtraParameters: []string{"version=2"}}
+	// The request line is read without reading ahead.
+	r := strings.NewReader(string(req.EncodeToPktLine()) + "rest")
+	got, err := ReadDaemonRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("got %+v, want %+v", got, req)
+	}
+	if r.Len() != len("rest") {
+		t.Errorf("got %d bytes left, want 4", r.Len())
+	}
+
+	for _, in := range []string{"", "00", "zzzz", "0000", "0004", "0020git-upload-pack"} {
+		if _, err := ReadDaemonRequest(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: got no error", in)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types.
+const (
+	// EventTypeChunk is an event of a parsed chunk or packet.
+	EventTypeChunk = "chunk"
+	// EventTypeState is an event of a state transition, such as the start
+	// of a phase.
+	EventTypeState = "state"
+	// EventTypeError is an event of an error.
+	EventTypeError = "error"
+)
+
+// Event is an event of a protocol session.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Type      string    `json:"type"`
+	// ChunkType is the Go type name of the chunk, such as
+	// "ProtocolV2RequestChunk".
+	ChunkType string `json:"chunk_type,omitempty"`
+	// Chunk is the non-zero fields of the chunk. Byte slices are strings
+	// if they are valid UTF-8, and base64 otherwise.
+	Chunk map[string]interface{} `json:"chunk,omitempty"`
+	State string                 `json:"state,omitempty"`
+	Error string                 `json:"error,omitempty"`
+}
+
+// EventSink writes the events of a session as newline-delimited JSON. It's
+// safe for concurrent use, so both directions can share a sink.
+type EventSink struct {
+	m       sync.Mutex
+	enc     *json.Encoder
+	session string
+	// Now returns the timestamp of an event. It's time.Now by default.
+	Now func() time.Time
+}
+
+// NewEventSink returns a new EventSink that writes to w. session is attached
+// to every event to tell sessions apart in a shared log.
+func NewEventSink(w io.Writer, session string) *EventSink {
+	return &EventSink{enc: json.NewEncoder(w), session: session, Now: time.Now}
+}
+
+func (s *EventSink) write(e *Event) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	e.Time = s.Now()
+	e.Session = s.session
+	return s.enc.Encode(e)
+}
+
+// Chunk writes an event of a chunk or a packet, such as
+// *ProtocolV1UploadPackRequestChunk or BytesPacket.
+func (s *EventSink) Chunk(d Direction, c Packet) error {
+	t := reflect.TypeOf(c)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return s.write(&Event{
+		Direction: d.String(),
+		Type:      EventTypeChunk,
+		ChunkType: t.Name(),
+		Chunk:     chunkFields(c),
+	})
+}
+
+// State writes an event of a state transition.
+func (s *EventSink) State(d Direction, state string) error {
+	return s.write(&Event{
+		Direction: d.String(),
+		Type:      EventTypeState,
+		State:     state,
+	})
+}
+
+// Error writes an event of an error.
+func (s *EventSink) Error(d Direction, err error) error {
+	return s.write(&Event{
+		Direction: d.String(),
+		Type:      EventTypeError,
+		Error:     err.Error(),
+	})
+}
+
+// chunkFields returns the non-zero fields of a chunk struct. For a packet that
+// is not a struct, the value is in "Packet".
+func chunkFields(c Packet) map[string]interface{} {
+	v := reflect.ValueOf(c)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return map[string]interface{}{"Packet": jsonValue(v)}
+	}
+	ret := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" || v.Field(i).IsZero() {
+			continue
+		}
+		ret[f.Name] = jsonValue(v.Field(i))
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+func jsonValue(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		bs := v.Bytes()
+		if utf8.Valid(bs) {
+			return string(bs)
+		}
+		return bs
+	}
+	return v.Interface()
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventSink(t *testing.T) {
+	var b bytes.Buffer
+	s := NewEventSink(&b, "s1")
+	s.Now = func() time.Time { return time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC) }
+	for _, err := range []error{
+		s.Chunk(ClientToServer, &ProtocolV2RequestChunk{Command: "fetch"}),
+		s.Chunk(ServerToClient, &ProtocolV2ResponseChunk{Response: []byte("\xff\x00")}),
+		s.Chunk(ServerToClient, BytesPacket("ok\n")),
+		s.Chunk(ServerToClient, FlushPacket{}),
+		s.State(ServerToClient, "packfile"),
+		s.Error(ClientToServer, errors.New("early EOF")),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		`{"time":"2018-01-02T03:04:05Z","session":"s1","direction":"` + ClientToServer.String() + `","type":"chunk","chunk_type":"ProtocolV2RequestChunk","chunk":{"Command":"fetch"}}`,
+		`{"time":"2018-01-02T03:04:05Z","session":"s1","direction":"` + ServerToClient.String() + `","type":"chunk","chunk_type":"ProtocolV2ResponseChunk","chunk":{"Response":"/wA="}}`,
+		`{"time":"2018-01-02T03:04:05Z","session":"s1","direction":"` + ServerToClient.String() + `","type":"chunk","chunk_type":"BytesPacket","chunk":{"Packet":"ok\n"}}`,
+		`{"time":"2018-01-02T03:04:05Z","session":"s1","direction":"` + ServerToClient.String() + `","type":"chunk","chunk_type":"FlushPacket"}`,
+		`{"time":"2018-01-02T03:04:05Z","session":"s1","direction":"` + ServerToClient.String() + `","type":"state","state":"packfile"}`,
+		`{"time":"2018-01-02T03:04:05Z","session":"s1","direction":"` + ClientToServer.String() + `","type":"error","error":"early EOF"}`,
+	}
+	got := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d:\n%s", len(got), len(want), b.String())
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+// maxHavesInVain is the number of haves git-fetch-pack sends without a new
+// common commit before it gives up, after the server found one.
+const maxHavesInVain = 256
+
+// FetchNegotiator drives the client side of a protocol v0/v1 fetch
+// negotiation in the same way as git-fetch-pack. It's the counterpart of
+// UploadPackNegotiator.
+//
+// Send the chunks of Wants first. Then feed the local commits to Have, for
+// example from a HaveWalker, and send the returned chunks. When a round ends,
+// read the server's ACK and NAK lines and pass them to Observe. Stop adding
+// haves when Stop returns true or there are no more commits, and send the
+// chunks of Finish.
+type FetchNegotiator struct {
+	// AckMode is the negotiated acknowledgement mode.
+	AckMode AckMode
+	// NoDone is true if both sides support no-done. The client can omit done
+	// after the server says it's ready.
+	NoDone bool
+	// StatelessRPC is true for smart HTTP. Every round is a separate request,
+	// so the common commits are sent again at the start of every request.
+	StatelessRPC bool
+
+	batcher    *HaveBatcher
+	common     []string
+	isCommon   map[string]bool
+	ready      bool
+	gotAck     bool
+	gotCommon  bool
+	inVain     int
+	roundsDone int
+}
+
+// NewFetchNegotiator returns a new FetchNegotiator for the capabilities sent on
+// the first want line.
+func NewFetchNegotiator(caps []string, statelessRPC bool) *FetchNegotiator {
+	n := &FetchNegotiator{
+		AckMode:      AckModeFromCapabilities(caps),
+		StatelessRPC: statelessRPC,
+		batcher:      NewHaveBatcher(statelessRPC),
+		isCommon:     map[string]bool{},
+	}
+	for _, c := range caps {
+		if c == "no-done" {
+			n.NoDone = true
+		}
+	}
+	return n
+}
+
+// Wants returns the want lines with the capabilities on the first one, and
+// the flush that ends them.
+func (n *FetchNegotiator) Wants(wants, caps []string) []*ProtocolV1UploadPackRequestChunk {
+	var ret []*ProtocolV1UploadPackRequestChunk
+	for i, w := range wants {
+		c := &ProtocolV1UploadPackRequestChunk{WantObjectID: w}
+		if i == 0 {
+			c.Capabilities = caps
+		}
+		ret = append(ret, c)
+	}
+	return append(ret, &ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+}
+
+// Have records a local commit to offer and returns the chunks to send: the have
+// line, and a flush if the round ends. Commits already known to be common are
+// skipped.
+func (n *FetchNegotiator) Have(objectID string) []*ProtocolV1UploadPackRequestChunk {
+	if n.isCommon[objectID] {
+		return nil
+	}
+	if n.gotCommon {
+		n.inVain++
+	}
+	return n.batcher.Add(objectID)
+}
+
+// CommonHaves returns the have lines of the common commits found so far. In
+// the stateless-RPC mode, a new request starts with them since the server
+// doesn't keep the state.
+func (n *FetchNegotiator) CommonHaves() []*ProtocolV1UploadPackRequestChunk {
+	var ret []*ProtocolV1UploadPackRequestChunk
+	for _, oid := range n.common {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{HaveObjectID: oid})
+	}
+	return ret
+}
+
+// PendingRounds returns the number of rounds sent that the server hasn't
+// answered yet. git-fetch-pack keeps one round in flight over a stateful
+// connection, and reads the response to the previous round after sending a
+// flush.
+func (n *FetchNegotiator) PendingRounds() int {
+	if n.AckMode == AckModeSingle && n.gotAck {
+		// The server stops responding after the first ACK.
+		return 0
+	}
+	return n.batcher.Rounds() - n.roundsDone
+}
+
+// Observe processes an ACK or NAK line of the server. Other chunks are ignored.
+func (n *FetchNegotiator) Observe(c *ProtocolV1UploadPackResponseChunk) {
+	switch {
+	case c.Nak:
+		n.roundsDone++
+	case c.AckObjectID != "":
+		// Every ACK, with "common", "continue", "ready", or no detail,
+		// names a common commit.
+		n.gotAck = true
+		if c.AckDetail == "ready" {
+			n.ready = true
+		}
+		n.markCommon(c.AckObjectID)
+	}
+}
+
+func (n *FetchNegotiator) markCommon(oid string) {
+	n.gotCommon = true
+	n.inVain = 0
+	if !n.isCommon[oid] {
+		n.isCommon[oid] = true
+		n.common = append(n.common, oid)
+	}
+}
+
+// Ready returns true if the server said it's ready to send the pack.
+func (n *FetchNegotiator) Ready() bool {
+	return n.ready
+}
+
+// CommonObjectIDs returns the common commits found so far.
+func (n *FetchNegotiator) CommonObjectIDs() []string {
+	return n.common
+}
+
+// Stop returns true if the client should stop sending haves: the server is
+// ready, the server acknowledged a common commit in the single mode, or too
+// many haves were sent without a new common commit.
+func (n *FetchNegotiator) Stop() bool {
+	switch {
+	case n.ready:
+		return true
+	case n.AckMode == AckModeSingle && n.gotAck:
+		return true
+	case n.inVain > maxHavesInVain:
+		return true
+	}
+	return false
+}
+
+// Finish returns the chunks that end the negotiation. It's done, unless
+// no-done is negotiated and the server is ready. Then the server sends the
+// pack after the flush of the round, so only the pending haves are flushed.
+func (n *FetchNegotiator) Finish() []*ProtocolV1UploadPackRequestChunk {
+	if n.NoDone && n.ready {
+		if c := n.batcher.Flush(); c != nil {
+			return []*ProtocolV1UploadPackRequestChunk{c}
+		}
+		return nil
+	}
+	return []*ProtocolV1UploadPackRequestChunk{{NoMoreNegotiation: true}}
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetchNegotiatorWants(t *testing.T) {
+	n := NewFetchNegotiator([]string{"multi_ack_detailed", "no-done"}, false)
+	if n.AckMode != AckModeMultiAckDetailed || !n.NoDone || n.StatelessRPC {
+		t.Errorf("got %+v", n)
+	}
+	got := n.Wants([]string{oidA, oidB}, []string{"ofs-delta"})
+	want := []*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: oidA, Capabilities: []string{"ofs-delta"}},
+		{WantObjectID: oidB},
+		{EndOneRound: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestFetchNegotiatorRounds(t *testing.T) {
+	n := NewFetchNegotiator([]string{"multi_ack_detailed"}, false)
+	for i := 0; i < 16; i++ {
+		cs := n.Have(fmt.Sprintf("h%02d", i))
+		if ended := len(cs) == 2 && cs[1].EndOneRound; ended != (i == 15) {
+			t.Errorf("have %d: got %+v", i, cs)
+		}
+	}
+	if n.PendingRounds() != 1 {
+		t.Errorf("got %d pending rounds, want 1", n.PendingRounds())
+	}
+	n.Observe(&ProtocolV1UploadPackResponseChunk{AckObjectID: "h03", AckDetail: "common"})
+	n.Observe(&ProtocolV1UploadPackResponseChunk{AckObjectID: "h03", AckDetail: "common"})
+	n.Observe(&ProtocolV1UploadPackResponseChunk{Nak: true})
+	if n.PendingRounds() != 0 || n.Stop() || n.Ready() {
+		t.Errorf("got %d pending rounds, stop %v, ready %v", n.PendingRounds(), n.Stop(), n.Ready())
+	}
+	if got, want := n.CommonObjectIDs(), []string{"h03"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := n.CommonHaves(), []*ProtocolV1UploadPackRequestChunk{{HaveObjectID: "h03"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	// A common commit is not offered again.
+	if cs := n.Have("h03"); cs != nil {
+		t.Errorf("got %+v, want nothing", cs)
+	}
+	n.Observe(&ProtocolV1UploadPackResponseChunk{AckObjectID: "h03", AckDetail: "ready"})
+	if !n.Ready() || !n.Stop() {
+		t.Errorf("ready %v, stop %v", n.Ready(), n.Stop())
+	}
+	if got, want := n.Finish(), []*ProtocolV1UploadPackRequestChunk{{NoMoreNegotiation: true}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestFetchNegotiatorSingleAck(t *testing.T) {
+	n := NewFetchNegotiator(nil, false)
+	for i := 0; i < 40; i++ {
+		n.Have(fmt.Sprintf("h%02d", i))
+	}
+	n.Observe(&ProtocolV1UploadPackResponseChunk{AckObjectID: "h05"})
+	// The server doesn't answer the pending rounds after the first ACK.
+	if !n.Stop() || n.PendingRounds() != 0 || n.Ready() {
+		t.Errorf("stop %v, pending rounds %d, ready %v", n.Stop(), n.PendingRounds(), n.Ready())
+	}
+}
+
+func TestFetchNegotiatorInVain(t *testing.T) {
+	n := NewFetchNegotiator([]string{"multi_ack_detailed"}, true)
+	// No limit before the first common commit.
+	for i := 0; i < 1000; i++ {
+		n.Have(fmt.Sprintf("a%d", i))
+	}
+	if n.Stop() {
+		t.Error("stopped before a common commit")
+	}
+	n.Observe(&ProtocolV1UploadPackResponseChunk{AckObjectID: "a0", AckDetail: "common"})
+	for i := 0; i < maxHavesInVain; i++ {
+		n.Have(fmt.Sprintf("b%d", i))
+	}
+	if n.Stop() {
+		t.Errorf("stopped after %d haves in vain", maxHavesInVain)
+	}
+	n.Have("c")
+	if !n.Stop() {
+		t.Errorf("not stopped after %d haves in vain", maxHavesInVain+1)
+	}
+}
+
+func TestFetchNegotiatorWithUploadPackNegotiator(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		caps []string
+		want []string
+	}{
+		// The first two rounds, of 16 and 16 more haves, have no common
+		// commit. The client stops at the ready after h40 and sends done.
+		{"done", []string{"multi_ack_detailed"}, []string{"NAK", "NAK", "ACK h40 common", "ACK h41 ready", "ACK h40"}},
+		// With no-done, the client ends the round instead.
+		{"no-done", []string{"multi_ack_detailed", "no-done"}, []string{"NAK", "NAK", "ACK h40 common", "ACK h41 ready", "NAK", "ACK h40"}},
+	} {
+		client := NewFetchNegotiator(tc.caps, false)
+		server := &UploadPackNegotiator{
+			AckMode:    AckModeFromCapabilities(tc.caps),
+			NoDone:     client.NoDone,
+			HasObject:  func(oid string) bool { return oid == "h40" },
+			OKToGiveUp: func(commons []string) bool { return len(commons) != 0 },
+		}
+		var got []string
+		send := func(cs []*ProtocolV1UploadPackRequestChunk) {
+			for _, c := range cs {
+				resp, err := server.Feed(c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range resp {
+					client.Observe(r)
+					if r.Nak {
+						got = append(got, "NAK")
+					} else {
+						got = append(got, strings.TrimSpace("ACK "+r.AckObjectID+" "+r.AckDetail))
+					}
+				}
+			}
+		}
+		for i := 0; i < 100 && !client.Stop(); i++ {
+			send(client.Have(fmt.Sprintf("h%02d", i)))
+		}
+		send(client.Finish())
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if !server.Done() || !server.SendPack() || server.Finish() != nil {
+			t.Errorf("%s: done %v, send pack %v, finish %v", tc.name, server.Done(), server.SendPack(), server.Finish())
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ErrPackTruncated is returned by PackVerifier when the pack stream ended
+// before the trailing checksum.
+var ErrPackTruncated = errors.New("gitprotocolio: pack stream truncated")
+
+// PackChecksumError is returned by PackVerifier when the trailing checksum
+// doesn't match the pack data.
+type PackChecksumError struct {
+	Want string
+	Got  string
+}
+
+func (e *PackChecksumError) Error() string {
+	return fmt.Sprintf("pack checksum mismatch: trailer %s, computed %s", e.Want, e.Got)
+}
+
+// PackVerifier is a writer that verifies the trailing checksum of a pack
+// stream written to it. Write the pack data (e.g. the PackStream of the
+// response chunks), and call Verify at the end.
+type PackVerifier struct {
+	h       hash.Hash
+	tail    []byte
+	written int64
+}
+
+// NewPackVerifier returns a new PackVerifier. sha256Format selects the SHA-256
+// object format.
+func NewPackVerifier(sha256Format bool) *PackVerifier {
+	if sha256Format {
+		return NewPackVerifierWithHashAlgo(HashAlgoSHA256)
+	}
+	return NewPackVerifierWithHashAlgo(HashAlgoSHA1)
+}
+
+// NewPackVerifierWithHashAlgo returns a new PackVerifier for the hash
+// algorithm.
+func NewPackVerifierWithHashAlgo(a *HashAlgo) *PackVerifier {
+	return &PackVerifier{h: a.New()}
+}
+
+// Write adds the pack data. It holds back the last bytes as the candidate
+// checksum.
+func (v *PackVerifier) Write(p []byte) (int, error) {
+	v.written += int64(len(p))
+	v.tail = append(v.tail, p...)
+	if n := len(v.tail) - v.h.Size(); n > 0 {
+		v.h.Write(v.tail[:n])
+		v.tail = append(v.tail[:0], v.tail[n:]...)
+	}
+	return len(p), nil
+}
+
+// Verify checks the checksum. It returns ErrPackTruncated if the stream is
+// too short to be a pack, and *PackChecksumError if the checksum doesn't
+// match, which also happens when the stream is cut in the middle.
+func (v *PackVerifier) Verify() error {
+	if v.written < int64(12+v.h.Size()) {
+		return ErrPackTruncated
+	}
+	got := v.h.Sum(nil)
+	if !bytes.Equal(got, v.tail) {
+		return &PackChecksumError{Want: hex.EncodeToString(v.tail), Got: hex.EncodeToString(got)}
+	}
+	return nil
+}
+
+// IsRetryableFetchError returns true if the fetch failed because the response
+// was cut or corrupted in transit, so that retrying can succeed.
+func IsRetryableFetchError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pce *PackChecksumError
+	if errors.Is(err, ErrPackTruncated) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &pce) {
+		return true
+	}
+	var se SyntaxError
+	if errors.As(err, &se) && se == SyntaxError("early EOF") {
+		return true
+	}
+	return false
+}
+
+// FetchResumeState is the knowledge gained by a fetch that failed during the
+// pack transfer. A retry uses it to skip the negotiation: the common commits
+// found are sent as haves with done, and the shallow boundary received is sent
+// as shallow lines.
+type FetchResumeState struct {
+	common     map[string]bool
+	shallows   map[string]bool
+	unshallows map[string]bool
+}
+
+// NewFetchResumeState returns an empty FetchResumeState.
+func NewFetchResumeState() *FetchResumeState {
+	return &FetchResumeState{
+		common:     map[string]bool{},
+		shallows:   map[string]bool{},
+		unshallows: map[string]bool{},
+	}
+}
+
+// ObserveUploadPackResponse records the ACKs and the shallow updates of a
+// protocol v0/v1 response.
+func (s *FetchResumeState) ObserveUploadPackResponse(c *ProtocolV1UploadPackResponseChunk) {
+	switch {
+	case c.AckObjectID != "":
+		s.common[c.AckObjectID] = true
+	case c.ShallowObjectID != "":
+		s.shallows[c.ShallowObjectID] = true
+		delete(s.unshallows, c.ShallowObjectID)
+	case c.UnshallowObjectID != "":
+		s.unshallows[c.UnshallowObjectID] = true
+		delete(s.shallows, c.UnshallowObjectID)
+	}
+}
+
+// ObserveProtocolV2Response records the acknowledgments and the shallow-info
+// lines of a protocol v2 fetch response.
+func (s *FetchResumeState) ObserveProtocolV2Response(c *ProtocolV2ResponseChunk) {
+	line := strings.TrimSuffix(string(c.Response), "\n")
+	switch {
+	case strings.HasPrefix(line, "ACK "):
+		s.common[strings.TrimPrefix(line, "ACK ")] = true
+	case strings.HasPrefix(line, "shallow "):
+		oid := strings.TrimPrefix(line, "shallow ")
+		s.shallows[oid] = true
+		delete(s.unshallows, oid)
+	case strings.HasPrefix(line, "unshallow "):
+		oid := strings.TrimPrefix(line, "unshallow ")
+		s.unshallows[oid] = true
+		delete(s.shallows, oid)
+	}
+}
+
+// CommonObjectIDs returns the sorted common commits found.
+func (s *FetchResumeState) CommonObjectIDs() []string {
+	return sortedKeys(s.common)
+}
+
+// ShallowObjectIDs returns the sorted shallow commits received.
+func (s *FetchResumeState) ShallowObjectIDs() []string {
+	return sortedKeys(s.shallows)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// RetryUploadPackRequest returns a protocol v0/v1 request that fetches the
+// wants again with the common commits as haves and done, so the server sends
+// the pack without another negotiation. localShallows are the shallow commits
+// the client had before the failed fetch. If withShallowState is true, the
+// shallow boundary received in the failed fetch is sent too.
+func (s *FetchResumeState) RetryUploadPackRequest(wants, capabilities, localShallows []string, withShallowState bool) []*ProtocolV1UploadPackRequestChunk {
+	var ret []*ProtocolV1UploadPackRequestChunk
+	for i, w := range wants {
+		c := &ProtocolV1UploadPackRequestChunk{WantObjectID: w}
+		if i == 0 {
+			c.Capabilities = capabilities
+		}
+		ret = append(ret, c)
+	}
+	for _, sh := range s.retryShallows(localShallows, withShallowState) {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{ShallowObjectID: sh})
+	}
+	ret = append(ret, &ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+	for _, h := range s.CommonObjectIDs() {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{HaveObjectID: h})
+	}
+	return append(ret, &ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true})
+}
+
+// RetryProtocolV2FetchArguments returns the arguments of a protocol v2 fetch
+// with the same semantics as RetryUploadPackRequest. otherArgs (e.g.
+// "ofs-delta") come first.
+func (s *FetchResumeState) RetryProtocolV2FetchArguments(wants, otherArgs, localShallows []string, withShallowState bool) []string {
+	ret := append([]string(nil), otherArgs...)
+	for _, w := range wants {
+		ret = append(ret, "want "+w)
+	}
+	for _, sh := range s.retryShallows(localShallows, withShallowState) {
+		ret = append(ret, "shallow "+sh)
+	}
+	for _, h := range s.CommonObjectIDs() {
+		ret = append(ret, "have "+h)
+	}
+	return append(ret, "done")
+}
+
+func (s *FetchResumeState) retryShallows(localShallows []string, withShallowState bool) []string {
+	m := shallowSet(localShallows)
+	if withShallowState {
+		for sh := range s.shallows {
+			m[sh] = true
+		}
+		for sh := range s.unshallows {
+			delete(m, sh)
+		}
+	}
+	return sortedKeys(m)
+}
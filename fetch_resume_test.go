@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestPackVerifier(t *testing.T) {
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x01object data")
+	sum := sha1.Sum(pack)
+	pack = append(pack, sum[:]...)
+
+	v := NewPackVerifier(false)
+	// Write byte by byte so that the trailer candidate moves.
+	for i := range pack {
+		v.Write(pack[i : i+1])
+	}
+	if err := v.Verify(); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	v = NewPackVerifier(false)
+	v.Write(pack[:20])
+	if err := v.Verify(); err != ErrPackTruncated {
+		t.Errorf("short pack: got %v, want %v", err, ErrPackTruncated)
+	}
+	v = NewPackVerifier(false)
+	v.Write(pack[:len(pack)-1])
+	var pce *PackChecksumError
+	if err := v.Verify(); !errors.As(err, &pce) {
+		t.Errorf("cut pack: got %v, want a PackChecksumError", err)
+	}
+	v = NewPackVerifier(true)
+	v.Write(pack)
+	if err := v.Verify(); err != ErrPackTruncated {
+		t.Errorf("SHA-256: got %v, want %v", err, ErrPackTruncated)
+	}
+}
+
+func TestIsRetryableFetchError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{ErrPackTruncated, true},
+		{fmt.Errorf("fetch: %w", io.ErrUnexpectedEOF), true},
+		{&PackChecksumError{}, true},
+		{SyntaxError("early EOF"), true},
+		{SyntaxError("unexpected packet"), false},
+		{ErrorPacket("not our ref"), false},
+	} {
+		if got := IsRetryableFetchError(tc.err); got != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestFetchResumeState(t *testing.T) {
+	s := NewFetchResumeState()
+	for _, c := range []*ProtocolV1UploadPackResponseChunk{
+		{ShallowObjectID: "s1"},
+		{ShallowObjectID: "s2"},
+		{UnshallowObjectID: "u1"},
+		{EndOfShallows: true},
+		{AckObjectID: "c2", AckDetail: "common"},
+		{AckObjectID: "c1", AckDetail: "common"},
+		{Nak: true},
+	} {
+		s.ObserveUploadPackResponse(c)
+	}
+	if got, want := s.CommonObjectIDs(), []string{"c1", "c2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got common %q, want %q", got, want)
+	}
+	if got, want := s.ShallowObjectIDs(), []string{"s1", "s2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got shallows %q, want %q", got, want)
+	}
+
+	got := s.RetryUploadPackRequest([]string{"w1", "w2"}, []string{"ofs-delta"}, []string{"u1", "l1"}, true)
+	want := []*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: "w1", Capabilities: []string{"ofs-delta"}},
+		{WantObjectID: "w2"},
+		{ShallowObjectID: "l1"},
+		{ShallowObjectID: "s1"},
+		{ShallowObjectID: "s2"},
+		{EndOneRound: true},
+		{HaveObjectID: "c1"},
+		{HaveObjectID: "c2"},
+		{NoMoreNegotiation: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	args := s.RetryProtocolV2FetchArguments([]string{"w1"}, []string{"ofs-delta"}, []string{"u1"}, false)
+	if want := []string{"ofs-delta", "want w1", "shallow u1", "have c1", "have c2", "done"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("got %q, want %q", args, want)
+	}
+}
+
+func TestFetchResumeStateProtocolV2(t *testing.T) {
+	s := NewFetchResumeState()
+	for _, line := range []string{"acknowledgments\n", "ACK c1\n", "ready\n", "shallow s1\n", "unshallow s1\n", "shallow s2\n"} {
+		s.ObserveProtocolV2Response(&ProtocolV2ResponseChunk{Response: []byte(line)})
+	}
+	if got := s.CommonObjectIDs(); !reflect.DeepEqual(got, []string{"c1"}) {
+		t.Errorf("got common %q", got)
+	}
+	if got := s.ShallowObjectIDs(); !reflect.DeepEqual(got, []string{"s2"}) {
+		t.Errorf("got shallows %q", got)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The filter types, the same as the names of uploadpackfilter.<filter>.allow
+// of Git.
+const (
+	FilterTypeBlobNone   = "blob:none"
+	FilterTypeBlobLimit  = "blob:limit"
+	FilterTypeTree       = "tree"
+	FilterTypeSparseOID  = "sparse:oid"
+	FilterTypeObjectType = "object:type"
+	FilterTypeCombine    = "combine"
+)
+
+// filterSpecReserved is the characters that a sub-filter of a combined filter
+// must percent-encode, besides the whitespaces, "%", and "+".
+const filterSpecReserved = "~`!@#$^&*()[]{}\\;'\",<>?"
+
+// FilterSpec is an object filter of a partial clone, the argument of a
+// "filter" line such as "blob:limit=1m" or "combine:blob:none+tree:3".
+type FilterSpec struct {
+	// Type is one of the FilterType constants.
+	Type string
+	// BlobLimit is the size limit in bytes of blob:limit.
+	BlobLimit uint64
+	// TreeDepth is the depth of tree.
+	TreeDepth uint64
+	// SparseOID is the blob with the sparse-checkout patterns of sparse:oid,
+	// such as "main:.sparse", resolved by the server.
+	SparseOID string
+	// ObjectType is the type of object:type, such as "blob".
+	ObjectType string
+	// Filters are the sub-filters of combine.
+	Filters []*FilterSpec
+}
+
+// ParseFilterSpec parses and validates a filter spec in the same way as Git's
+// parse_list_objects_filter. A size can have a "k", "m", or "g" suffix.
+func ParseFilterSpec(spec string) (*FilterSpec, error) {
+	switch {
+	case spec == "blob:none":
+		return &FilterSpec{Type: FilterTypeBlobNone}, nil
+	case strings.HasPrefix(spec, "blob:limit="):
+		n, err := parseFilterSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return nil, SyntaxError(fmt.Sprintf("invalid filter-spec '%s'", spec))
+		}
+		return &FilterSpec{Type: FilterTypeBlobLimit, BlobLimit: n}, nil
+	case strings.HasPrefix(spec, "tree:"):
+		n, err := parseFilterSize(strings.TrimPrefix(spec, "tree:"))
+		if err != nil {
+			return nil, SyntaxError("expected 'tree:<depth>'")
+		}
+		return &FilterSpec{Type: FilterTypeTree, TreeDepth: n}, nil
+	case strings.HasPrefix(spec, "sparse:oid="):
+		oid := strings.TrimPrefix(spec, "sparse:oid=")
+		if oid == "" {
+			return nil, SyntaxError(fmt.Sprintf("invalid filter-spec '%s'", spec))
+		}
+		return &FilterSpec{Type: FilterTypeSparseOID, SparseOID: oid}, nil
+	case strings.HasPrefix(spec, "sparse:path="):
+		return nil, SyntaxError("sparse:path filters support has been dropped")
+	case strings.HasPrefix(spec, "object:type="):
+		typ := strings.TrimPrefix(spec, "object:type=")
+		switch typ {
+		case "blob", "tree", "commit", "tag":
+		default:
+			return nil, SyntaxError(fmt.Sprintf("'%s' for 'object:type=<type>' is not a valid object type", typ))
+		}
+		return &FilterSpec{Type: FilterTypeObjectType, ObjectType: typ}, nil
+	case strings.HasPrefix(spec, "combine:"):
+		return parseCombineFilterSpec(strings.TrimPrefix(spec, "combine:"))
+	}
+	return nil, SyntaxError(fmt.Sprintf("invalid filter-spec '%s'", spec))
+}
+
+func parseCombineFilterSpec(s string) (*FilterSpec, error) {
+	if s == "" {
+		return nil, SyntaxError("expected something after combine:")
+	}
+	f := &FilterSpec{Type: FilterTypeCombine}
+	for _, sub := range strings.Split(s, "+") {
+		for _, c := range sub {
+			if c <= ' ' || strings.ContainsRune(filterSpecReserved, c) {
+				return nil, SyntaxError(fmt.Sprintf("must escape char in sub-filter-spec: '%c'", c))
+			}
+		}
+		decoded, err := percentDecode(sub)
+		if err != nil {
+			return nil, err
+		}
+		sf, err := ParseFilterSpec(decoded)
+		if err != nil {
+			return nil, err
+		}
+		f.Filters = append(f.Filters, sf)
+	}
+	return f, nil
+}
+
+// parseFilterSize parses an unsigned number with an optional unit suffix, as
+// Git's git_parse_ulong.
+func parseFilterSize(s string) (uint64, error) {
+	var unit uint64 = 1
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			unit = 1 << 10
+		case 'm', 'M':
+			unit = 1 << 20
+		case 'g', 'G':
+			unit = 1 << 30
+		}
+		if unit != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n > (1<<64-1)/unit {
+		return 0, strconv.ErrRange
+	}
+	return n * unit, nil
+}
+
+func percentDecode(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", SyntaxError(fmt.Sprintf("invalid percent-encoding: %q", s))
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", SyntaxError(fmt.Sprintf("invalid percent-encoding: %q", s))
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// String returns the filter spec. As Git sends it, a size is in bytes without
+// a suffix, and the sub-filters of combine are percent-encoded.
+func (f *FilterSpec) String() string {
+	switch f.Type {
+	case FilterTypeBlobNone:
+		return "blob:none"
+	case FilterTypeBlobLimit:
+		return fmt.Sprintf("blob:limit=%d", f.BlobLimit)
+	case FilterTypeTree:
+		return fmt.Sprintf("tree:%d", f.TreeDepth)
+	case FilterTypeSparseOID:
+		return "sparse:oid=" + f.SparseOID
+	case FilterTypeObjectType:
+		return "object:type=" + f.ObjectType
+	case FilterTypeCombine:
+		var subs []string
+		for _, sf := range f.Filters {
+			subs = append(subs, percentEncodeFilterSpec(sf.String()))
+		}
+		return "combine:" + strings.Join(subs, "+")
+	}
+	return f.Type
+}
+
+func percentEncodeFilterSpec(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == '%' || c == '+' || c >= 0x7f || strings.IndexByte(filterSpecReserved, c) >= 0 {
+			fmt.Fprintf(&b, "%%%02x", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ProtocolV1Chunk returns the filter line of a protocol v0/v1 upload-pack
+// request.
+func (f *FilterSpec) ProtocolV1Chunk() *ProtocolV1UploadPackRequestChunk {
+	return &ProtocolV1UploadPackRequestChunk{FilterSpec: f.String()}
+}
+
+// ProtocolV2Argument returns the filter argument of a protocol v2 fetch
+// request.
+func (f *FilterSpec) ProtocolV2Argument() *ProtocolV2RequestChunk {
+	return &ProtocolV2RequestChunk{Argument: []byte("filter " + f.String() + "\n")}
+}
+
+// Filter parses the FilterSpec of a filter chunk.
+func (c *ProtocolV1UploadPackRequestChunk) Filter() (*FilterSpec, error) {
+	return ParseFilterSpec(c.FilterSpec)
+}
+
+// Filter parses the filter argument of a protocol v2 fetch request. It returns
+// nil and no error if the chunk is not a filter argument.
+func (c *ProtocolV2RequestChunk) Filter() (*FilterSpec, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSuffix(string(c.Argument), "\n"), "filter ")
+	if !ok {
+		return nil, nil
+	}
+	return ParseFilterSpec(spec)
+}
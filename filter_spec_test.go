@@ -0,0 +1,146 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		want    *FilterSpec
+		wantStr string
+	}{
+		{"blob:none", &FilterSpec{Type: FilterTypeBlobNone}, "blob:none"},
+		{"blob:limit=100", &FilterSpec{Type: FilterTypeBlobLimit, BlobLimit: 100}, "blob:limit=100"},
+		{"blob:limit=1k", &FilterSpec{Type: FilterTypeBlobLimit, BlobLimit: 1 << 10}, "blob:limit=1024"},
+		{"blob:limit=2M", &FilterSpec{Type: FilterTypeBlobLimit, BlobLimit: 2 << 20}, "blob:limit=2097152"},
+		{"blob:limit=1g", &FilterSpec{Type: FilterTypeBlobLimit, BlobLimit: 1 << 30}, "blob:limit=1073741824"},
+		{"tree:0", &FilterSpec{Type: FilterTypeTree}, "tree:0"},
+		{"tree:3", &FilterSpec{Type: FilterTypeTree, TreeDepth: 3}, "tree:3"},
+		{"sparse:oid=main:.sparse", &FilterSpec{Type: FilterTypeSparseOID, SparseOID: "main:.sparse"}, "sparse:oid=main:.sparse"},
+		{"object:type=commit", &FilterSpec{Type: FilterTypeObjectType, ObjectType: "commit"}, "object:type=commit"},
+		{
+			"combine:blob:none+tree:1",
+			&FilterSpec{Type: FilterTypeCombine, Filters: []*FilterSpec{{Type: FilterTypeBlobNone}, {Type: FilterTypeTree, TreeDepth: 1}}},
+			"combine:blob:none+tree:1",
+		},
+		{
+			// The sub-filters are percent-decoded, and encoded again.
+			"combine:sparse:oid=a%2bb+combine:blob:none%2btree:2",
+			&FilterSpec{Type: FilterTypeCombine, Filters: []*FilterSpec{
+				{Type: FilterTypeSparseOID, SparseOID: "a+b"},
+				{Type: FilterTypeCombine, Filters: []*FilterSpec{{Type: FilterTypeBlobNone}, {Type: FilterTypeTree, TreeDepth: 2}}},
+			}},
+			"combine:sparse:oid=a%2bb+combine:blob:none%2btree:2",
+		},
+	} {
+		got, err := ParseFilterSpec(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.spec, got, tc.want)
+		}
+		if got.String() != tc.wantStr {
+			t.Errorf("%s: got %q, want %q", tc.spec, got.String(), tc.wantStr)
+		}
+		// The encoded spec is parsed to the same filter.
+		if again, err := ParseFilterSpec(got.String()); err != nil || !reflect.DeepEqual(again, got) {
+			t.Errorf("%s: got %+v, %v after the round trip", tc.spec, again, err)
+		}
+	}
+}
+
+func TestParseFilterSpecErrors(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want string
+	}{
+		{"", "invalid filter-spec ''"},
+		{"blob:nothing", "invalid filter-spec 'blob:nothing'"},
+		{"blob:limit=", "invalid filter-spec 'blob:limit='"},
+		{"blob:limit=1t", "invalid filter-spec 'blob:limit=1t'"},
+		{"blob:limit=-1", "invalid filter-spec 'blob:limit=-1'"},
+		{"blob:limit=99999999999999999999", "invalid filter-spec 'blob:limit=99999999999999999999'"},
+		{"blob:limit=17179869184g", "invalid filter-spec 'blob:limit=17179869184g'"},
+		{"tree:", "expected 'tree:<depth>'"},
+		{"tree:x", "expected 'tree:<depth>'"},
+		{"sparse:oid=", "invalid filter-spec 'sparse:oid='"},
+		{"sparse:path=/x", "sparse:path filters support has been dropped"},
+		{"object:type=blobs", "'blobs' for 'object:type=<type>' is not a valid object type"},
+		{"combine:", "expected something after combine:"},
+		{"combine:blob:none+", "invalid filter-spec ''"},
+		{"combine:blob:none+tree:x", "expected 'tree:<depth>'"},
+		{"combine:sparse:oid=a b", "must escape char in sub-filter-spec: ' '"},
+		{"combine:sparse:oid=a~b", "must escape char in sub-filter-spec: '~'"},
+		{"combine:sparse:oid=a%2", `invalid percent-encoding: "sparse:oid=a%2"`},
+		{"combine:sparse:oid=a%zz", `invalid percent-encoding: "sparse:oid=a%zz"`},
+	} {
+		got, err := ParseFilterSpec(tc.spec)
+		if err == nil {
+			t.Errorf("%q: got %+v, want an error", tc.spec, got)
+			continue
+		}
+		if _, ok := err.(SyntaxError); !ok || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: got %#v, want %q", tc.spec, err, tc.want)
+		}
+	}
+}
+
+func TestFilterSpecChunks(t *testing.T) {
+	f := &FilterSpec{Type: FilterTypeBlobLimit, BlobLimit: 1024}
+	if got, want := string(f.ProtocolV1Chunk().EncodeToPktLine()), pktLines("filter blob:limit=1024\n"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, err := f.ProtocolV1Chunk().Filter(); err != nil || !reflect.DeepEqual(got, f) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	arg := f.ProtocolV2Argument()
+	if got, want := string(arg.Argument), "filter blob:limit=1024\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, err := arg.Filter(); err != nil || !reflect.DeepEqual(got, f) {
+		t.Errorf("got %+v, %v", got, err)
+	}
+	if got, err := (&ProtocolV2RequestChunk{Argument: []byte("thin-pack\n")}).Filter(); got != nil || err != nil {
+		t.Errorf("got %+v, %v for a non-filter argument", got, err)
+	}
+	if _, err := (&ProtocolV2RequestChunk{Argument: []byte("filter blob:some\n")}).Filter(); err == nil {
+		t.Error("got no error for an invalid filter argument")
+	}
+}
+
+func TestProtocolV1UploadPackRequestFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter  string
+		wantErr bool
+	}{
+		{"blob:none", false},
+		{"combine:blob:none+tree:0", false},
+		{"blob:some", true},
+	} {
+		r := NewProtocolV1UploadPackRequest(strings.NewReader(pktLines("want "+oidA+" filter\n", "filter "+tc.filter+"\n", "0000", "done\n")))
+		for r.Scan() {
+		}
+		if (r.Err() != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %v", tc.filter, r.Err(), tc.wantErr)
+		}
+	}
+}
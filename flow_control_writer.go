@@ -0,0 +1,199 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrFlowControlTimeout is returned by FlowControlWriter when the reader
+// doesn't consume the outstanding bytes within the timeout.
+var ErrFlowControlTimeout = errors.New("gitprotocolio: timed out waiting for the reader")
+
+// FlowControlWriter is a WriteFlushCloser that writes to the underlying writer
+// in the background, keeping at most a window of bytes outstanding. A Write
+// that would exceed the window blocks until the underlying writer catches up,
+// or fails with ErrFlowControlTimeout after the timeout.
+//
+// This bounds the memory a server uses for a stalled client while streaming a
+// large pack. Write, Flush, and Close must not be called concurrently.
+type FlowControlWriter struct {
+	w       io.Writer
+	window  int
+	timeout time.Duration
+
+	m           sync.Mutex
+	pending     [][]byte
+	outstanding int
+	closed      bool
+	err         error
+
+	wake    chan struct{}
+	drained chan struct{}
+	done    chan struct{}
+}
+
+// NewFlowControlWriter returns a new FlowControlWriter writing to w with at
+// most window bytes outstanding. If timeout is zero, Write and Flush block
+// until the reader catches up.
+func NewFlowControlWriter(w io.Writer, window int, timeout time.Duration) *FlowControlWriter {
+	if window <= 0 {
+		window = MaxPacketSize
+	}
+	fw := &FlowControlWriter{
+		w:       w,
+		window:  window,
+		timeout: timeout,
+		wake:    make(chan struct{}, 1),
+		drained: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go fw.run()
+	return fw
+}
+
+func (w *FlowControlWriter) run() {
+	defer close(w.done)
+	for {
+		w.m.Lock()
+		for len(w.pending) == 0 && !w.closed {
+			w.m.Unlock()
+			<-w.wake
+			w.m.Lock()
+		}
+		if len(w.pending) == 0 {
+			w.m.Unlock()
+			return
+		}
+		p := w.pending[0]
+		w.pending = w.pending[1:]
+		failed := w.err != nil
+		w.m.Unlock()
+
+		var err error
+		if !failed {
+			_, err = w.w.Write(p)
+		}
+
+		w.m.Lock()
+		w.outstanding -= len(p)
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+		w.m.Unlock()
+		notify(w.drained)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until cond returns true or the timeout expires. cond is called
+// with the lock held.
+func (w *FlowControlWriter) wait(cond func() bool) error {
+	var timer <-chan time.Time
+	if w.timeout > 0 {
+		t := time.NewTimer(w.timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		w.m.Lock()
+		ok, err := cond(), w.err
+		w.m.Unlock()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-w.drained:
+		case <-timer:
+			return ErrFlowControlTimeout
+		}
+	}
+}
+
+// Write queues p. It blocks while the window is full.
+func (w *FlowControlWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) != 0 {
+		sz := len(p)
+		if sz > w.window {
+			sz = w.window
+		}
+		err := w.wait(func() bool {
+			return w.outstanding+sz <= w.window
+		})
+		if err != nil {
+			return n, err
+		}
+		w.m.Lock()
+		w.pending = append(w.pending, append([]byte(nil), p[:sz]...))
+		w.outstanding += sz
+		w.m.Unlock()
+		notify(w.wake)
+		n += sz
+		p = p[sz:]
+	}
+	return n, nil
+}
+
+// Outstanding returns the number of bytes not yet written to the underlying
+// writer.
+func (w *FlowControlWriter) Outstanding() int {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.outstanding
+}
+
+// Flush waits until all the bytes are written to the underlying writer, and
+// then flushes it if it has a Flush method.
+func (w *FlowControlWriter) Flush() error {
+	if err := w.wait(func() bool { return w.outstanding == 0 }); err != nil {
+		return err
+	}
+	if f, ok := w.w.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close flushes and stops the background writer. It doesn't close the
+// underlying writer.
+func (w *FlowControlWriter) Close() error {
+	err := w.Flush()
+	w.m.Lock()
+	w.closed = true
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	w.m.Unlock()
+	notify(w.wake)
+	if err == ErrFlowControlTimeout {
+		// The background writer is stuck in the underlying writer.
+		return err
+	}
+	<-w.done
+	return err
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer that is safe for concurrent use.
+type lockedBuffer struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
+
+// blockingWriter blocks every Write until unblock is closed.
+type blockingWriter struct {
+	unblock chan struct{}
+	buf     lockedBuffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return w.buf.Write(p)
+}
+
+func TestFlowControlWriter(t *testing.T) {
+	var buf lockedBuffer
+	w := NewFlowControlWriter(&buf, 4, time.Minute)
+	in := strings.Repeat("0123456789", 10)
+	if n, err := io.WriteString(w, in); err != nil || n != len(in) {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Outstanding() != 0 {
+		t.Errorf("got %d outstanding bytes after Flush", w.Outstanding())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != in {
+		t.Errorf("got %q, want %q", got, in)
+	}
+}
+
+func TestFlowControlWriterTimeout(t *testing.T) {
+	bw := &blockingWriter{unblock: make(chan struct{})}
+	defer close(bw.unblock)
+	w := NewFlowControlWriter(bw, 4, 50*time.Millisecond)
+	if _, err := w.Write([]byte("0123")); err != nil {
+		t.Fatalf("the first window: %v", err)
+	}
+	if n, err := w.Write([]byte("4567")); err != ErrFlowControlTimeout || n != 0 {
+		t.Errorf("got %d, %v, want %v", n, err, ErrFlowControlTimeout)
+	}
+	if w.Outstanding() != 4 {
+		t.Errorf("got %d outstanding bytes, want 4", w.Outstanding())
+	}
+	if err := w.Close(); err != ErrFlowControlTimeout {
+		t.Errorf("Close: got %v, want %v", err, ErrFlowControlTimeout)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestFlowControlWriterError(t *testing.T) {
+	w := NewFlowControlWriter(failingWriter{}, 4, time.Minute)
+	w.Write([]byte("0123"))
+	if err := w.Flush(); err == nil || err.Error() != "broken pipe" {
+		t.Errorf("Flush: got %v, want the write error", err)
+	}
+	if _, err := w.Write([]byte("4567")); err == nil {
+		t.Error("Write: got no error after a failed write")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close: got no error after a failed write")
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gittest provides an in-memory Git server for tests. It speaks enough
+// of upload-pack (protocol v0, v1, and v2) and receive-pack (protocol v0 and
+// v1) for a client to discover the refs, fetch, and push without a git binary.
+//
+// The server has no objects. A fetch gets a canned pack registered with
+// SetPack as is, and a push updates the refs without looking into the pack.
+// The negotiation never finds a common commit, so a fetch always gets the
+// whole pack.
+//
+// Serve it over HTTP with httptest, at any repository path:
+//
+//	s := gittest.NewServer()
+//	s.SetRef("refs/heads/master", oid)
+//	s.SetPack(oid, pack)
+//	ts := httptest.NewServer(s)
+//	// git clone ts.URL + "/repo.git"
+//
+// Or use it as a client.Transport, which reads and writes the requests and the
+// responses in memory.
+package gittest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	uploadPackService  = "git-upload-pack"
+	receivePackService = "git-receive-pack"
+)
+
+var (
+	uploadPackCapabilities  = []string{"side-band", "side-band-64k", "ofs-delta", "no-progress", "agent=gittest", "object-format=sha1"}
+	receivePackCapabilities = []string{"report-status", "report-status-v2", "delete-refs", "side-band-64k", "atomic", "push-options", "ofs-delta", "agent=gittest", "object-format=sha1"}
+	v2Capabilities          = []string{"agent=gittest", "ls-refs", "fetch", "object-format=sha1"}
+)
+
+var zeroObjectID = gitprotocolio.HashAlgoSHA1.ZeroObjectID()
+
+// Push is a push the server received.
+type Push struct {
+	// Updates are the ref update commands with their results.
+	Updates []*gitprotocolio.RefUpdate
+	Options []string
+	// Pack is the pack data as the client sent it, nil if it sent none.
+	Pack []byte
+}
+
+// Server is an in-memory Git server. It's safe for concurrent use.
+type Server struct {
+	m       sync.Mutex
+	refs    map[string]*gitprotocolio.AdvertisedRef
+	symrefs map[string]string
+	packs   map[string][]byte
+	pushes  []*Push
+}
+
+// NewServer returns a new Server without refs. HEAD points to
+// "refs/heads/master", as git init does by default.
+func NewServer() *Server {
+	return &Server{
+		refs:    map[string]*gitprotocolio.AdvertisedRef{},
+		symrefs: map[string]string{"HEAD": "refs/heads/master"},
+		packs:   map[string][]byte{},
+	}
+}
+
+// SetRef creates or updates a ref.
+func (s *Server) SetRef(name, oid string) {
+	s.SetTag(name, oid, "")
+}
+
+// SetTag creates or updates a ref to an annotated tag. peeled is the object
+// the tag points to.
+func (s *Server) SetTag(name, oid, peeled string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.refs[name] = &gitprotocolio.AdvertisedRef{Name: name, ObjectID: oid, Peeled: peeled}
+}
+
+// DeleteRef deletes a ref.
+func (s *Server) DeleteRef(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.refs, name)
+}
+
+// SetSymref makes a symbolic ref, such as "HEAD", point to the target ref. A
+// symbolic ref is advertised only if the target exists.
+func (s *Server) SetSymref(name, target string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.symrefs[name] = target
+}
+
+// Refs returns the refs, mapping the names to the object IDs. The symbolic
+// refs are not included.
+func (s *Server) Refs() map[string]string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ret := map[string]string{}
+	for name, r := range s.refs {
+		ret[name] = r.ObjectID
+	}
+	return ret
+}
+
+// SetPack registers the pack sent for a fetch that wants oid. For a fetch with
+// multiple wants, the pack of the first want that has one is sent, so it
+// should have the objects of all of them. A push registers its pack for the
+// new object IDs of the updated refs.
+func (s *Server) SetPack(oid string, pack []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.packs[oid] = pack
+}
+
+// Pushes returns the pushes received so far.
+func (s *Server) Pushes() []*Push {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]*Push(nil), s.pushes...)
+}
+
+// advertisedRefs returns the symbolic refs with existing targets and the refs.
+func (s *Server) advertisedRefs() []*gitprotocolio.AdvertisedRef {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var ret []*gitprotocolio.AdvertisedRef
+	for name, target := range s.symrefs {
+		if r, ok := s.refs[target]; ok {
+			ret = append(ret, &gitprotocolio.AdvertisedRef{Name: name, ObjectID: r.ObjectID, Peeled: r.Peeled, SymrefTarget: target})
+		}
+	}
+	for _, r := range s.refs {
+		ret = append(ret, r)
+	}
+	gitprotocolio.SortAdvertisedRefs(ret)
+	return ret
+}
+
+// Discover returns the ref advertisement of the service ("git-upload-pack" or
+// "git-receive-pack") as a smart HTTP server does. If version is 2, it's the
+// protocol v2 capability advertisement for upload-pack. With Request, the
+// server is a client.Transport.
+func (s *Server) Discover(ctx context.Context, service string, version int) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if err := s.advertise(&buf, service, version); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// Request handles a stateless request of the service and returns the
+// response. An error for the client, such as a want of an unknown object, is
+// an ERR packet in the response.
+func (s *Server) Request(ctx context.Context, service string, version int, body io.Reader) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	if err := s.serve(&buf, service, version, body); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// ServeHTTP serves the smart HTTP protocol at any path that ends with
+// "/info/refs", "/git-upload-pack", or "/git-receive-pack".
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version := 0
+	for _, p := range strings.Split(r.Header.Get("Git-Protocol"), ":") {
+		switch p {
+		case "version=2":
+			version = 2
+		case "version=1":
+			if version == 0 {
+				version = 1
+			}
+		}
+	}
+	var buf bytes.Buffer
+	switch service := path.Base(r.URL.Path); service {
+	case "refs":
+		service = r.URL.Query().Get("service")
+		if !strings.HasSuffix(r.URL.Path, "/info/refs") {
+			http.NotFound(w, r)
+			return
+		}
+		if err := s.advertise(&buf, service, version); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	case uploadPackService, receivePackService:
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body io.Reader = r.Body
+		if enc := r.Header.Get("Content-Encoding"); enc == "gzip" || enc == "x-gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "cannot ungzip", http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		if err := s.serve(&buf, service, version, body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", service))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) advertise(w io.Writer, service string, version int) error {
+	var caps []string
+	switch service {
+	case uploadPackService:
+		if version == 2 {
+			// Like git-http-backend, no service header for protocol v2.
+			_, err := w.Write((&gitprotocolio.ProtocolV2CapabilityAdvertisement{Capabilities: v2Capabilities}).EncodeToPktLine())
+			return err
+		}
+		caps = uploadPackCapabilities
+	case receivePackService:
+		caps = receivePackCapabilities
+	default:
+		return fmt.Errorf("gittest: unknown service %q", service)
+	}
+	refs := s.advertisedRefs()
+	if service == uploadPackService {
+		caps = append([]string(nil), caps...)
+		for _, r := range refs {
+			if r.SymrefTarget != "" {
+				caps = append(caps, fmt.Sprintf("symref=%s:%s", r.Name, r.SymrefTarget))
+			}
+		}
+	} else {
+		// receive-pack doesn't advertise the symbolic refs.
+		var rs []*gitprotocolio.AdvertisedRef
+		for _, r := range refs {
+			if r.SymrefTarget == "" {
+				rs = append(rs, r)
+			}
+		}
+		refs = rs
+	}
+
+	chunks := []*gitprotocolio.InfoRefsResponseChunk{{ServiceHeader: service}, {ServiceHeaderFlush: true}}
+	if version == 1 {
+		chunks = append(chunks, &gitprotocolio.InfoRefsResponseChunk{ProtocolVersion: 1})
+	}
+	for _, c := range chunks {
+		if _, err := w.Write(c.EncodeToPktLine()); err != nil {
+			return err
+		}
+	}
+	return gitprotocolio.NewAdvertisementEncoder(w).EncodeInfoRefs("", caps, gitprotocolio.RefSlice(refs))
+}
+
+func (s *Server) serve(w io.Writer, service string, version int, body io.Reader) error {
+	var err error
+	switch {
+	case service == uploadPackService && version == 2:
+		err = s.serveProtocolV2(w, body)
+	case service == uploadPackService:
+		err = s.uploadPack(w, body)
+	case service == receivePackService:
+		err = s.receivePack(w, body)
+	default:
+		return fmt.Errorf("gittest: unknown service %q", service)
+	}
+	var ep gitprotocolio.ErrorPacket
+	if errors.As(err, &ep) {
+		_, err = w.Write(ep.EncodeToPktLine())
+	}
+	return err
+}
+
+// pack returns the pack for the wants.
+func (s *Server) pack(wants []string) ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, want := range wants {
+		if _, ok := s.packs[want]; !ok && !s.isTip(want) {
+			return nil, gitprotocolio.ErrorPacket("upload-pack: not our ref " + want)
+		}
+	}
+	for _, want := range wants {
+		if p, ok := s.packs[want]; ok {
+			return p, nil
+		}
+	}
+	return nil, gitprotocolio.ErrorPacket("gittest: no pack for " + wants[0])
+}
+
+func (s *Server) isTip(oid string) bool {
+	for _, r := range s.refs {
+		if r.ObjectID == oid || r.Peeled == oid {
+			return true
+		}
+	}
+	return false
+}
+
+// writePack writes the pack with the sideband if the client asked it.
+func writePack(w io.Writer, caps gitprotocolio.Capabilities, pack []byte) error {
+	size := gitprotocolio.MaxSideBandPayloadSize
+	switch {
+	case caps.Has("side-band-64k"):
+	case caps.Has("side-band"):
+		size = 999
+	default:
+		_, err := w.Write(pack)
+		return err
+	}
+	if err := gitprotocolio.NewSideBandMuxer(w, size).WritePack(pack); err != nil {
+		return err
+	}
+	_, err := w.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+	return err
+}
+
+// uploadPack handles a protocol v0 or v1 request. Without "done", the response
+// is a NAK for the haves.
+func (s *Server) uploadPack(w io.Writer, body io.Reader) error {
+	var caps gitprotocolio.Capabilities
+	var wants []string
+	done := false
+	sc := gitprotocolio.NewProtocolV1UploadPackRequest(body)
+	for sc.Scan() {
+		c := sc.Chunk()
+		if caps == nil && len(c.Capabilities) != 0 {
+			caps = c.Capabilities
+		}
+		switch {
+		case c.WantObjectID != "":
+			wants = append(wants, c.WantObjectID)
+		case c.NoMoreNegotiation:
+			done = true
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(wants) == 0 {
+		return nil
+	}
+	pack, err := s.pack(wants)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write((&gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true}).EncodeToPktLine()); err != nil {
+		return err
+	}
+	if !done {
+		return nil
+	}
+	return writePack(w, caps, pack)
+}
+
+// serveProtocolV2 handles the commands of a protocol v2 request.
+func (s *Server) serveProtocolV2(w io.Writer, body io.Reader) error {
+	var command string
+	var args []string
+	sc := gitprotocolio.NewProtocolV2Request(body)
+	for sc.Scan() {
+		c := sc.Chunk()
+		switch {
+		case c.Command != "":
+			command, args = c.Command, nil
+		case len(c.Argument) != 0:
+			args = append(args, string(c.Argument))
+		case c.EndArgument:
+			if err := s.serveCommand(w, command, args); err != nil {
+				return err
+			}
+		}
+	}
+	return sc.Err()
+}
+
+func (s *Server) serveCommand(w io.Writer, command string, args []string) error {
+	switch command {
+	case "ls-refs":
+		req, err := gitprotocolio.ParseLsRefsArguments(args)
+		if err != nil {
+			return err
+		}
+		m := gitprotocolio.NewRefPrefixMatcher(req.RefPrefixes)
+		var refs []*gitprotocolio.AdvertisedRef
+		for _, r := range s.advertisedRefs() {
+			if m.Match(r.Name) {
+				refs = append(refs, r)
+			}
+		}
+		return gitprotocolio.NewAdvertisementEncoder(w).EncodeLsRefs(gitprotocolio.RefSlice(refs), req.Peel, req.Symrefs)
+	case "fetch":
+		req, err := gitprotocolio.ParseFetchArguments(args)
+		if err != nil {
+			return err
+		}
+		if len(req.Wants) == 0 {
+			return gitprotocolio.ErrorPacket("fetch: no want")
+		}
+		pack, err := s.pack(req.Wants)
+		if err != nil {
+			return err
+		}
+		var chunks []*gitprotocolio.ProtocolV2FetchResponseChunk
+		if !req.Done {
+			// There's no common commit, but there's nothing to
+			// negotiate either.
+			chunks = append(chunks,
+				&gitprotocolio.ProtocolV2FetchResponseChunk{SectionHeader: "acknowledgments"},
+				&gitprotocolio.ProtocolV2FetchResponseChunk{Nak: true},
+				&gitprotocolio.ProtocolV2FetchResponseChunk{Ready: true},
+				&gitprotocolio.ProtocolV2FetchResponseChunk{EndOfSection: true},
+			)
+		}
+		chunks = append(chunks, &gitprotocolio.ProtocolV2FetchResponseChunk{SectionHeader: "packfile"})
+		for _, c := range chunks {
+			if _, err := w.Write(c.EncodeToPktLine()); err != nil {
+				return err
+			}
+		}
+		return writePack(w, gitprotocolio.Capabilities{"side-band-64k"}, pack)
+	}
+	return gitprotocolio.ErrorPacket(fmt.Sprintf("invalid command '%s'", command))
+}
+
+// receivePack handles a push. The ref updates are checked against the current
+// values, and applied all or nothing for an atomic push.
+func (s *Server) receivePack(w io.Writer, body io.Reader) error {
+	var caps gitprotocolio.Capabilities
+	var cmds []gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	var pack bytes.Buffer
+	push := &Push{}
+	summary := gitprotocolio.NewRefUpdateSummary()
+	sc := gitprotocolio.NewProtocolV1ReceivePackRequest(body)
+	for sc.Scan() {
+		c := sc.Chunk()
+		if caps == nil && len(c.Capabilities) != 0 {
+			caps = c.Capabilities
+		}
+		switch {
+		case c.RefName != "":
+			cmds = append(cmds, *c)
+			summary.AddCommand(c)
+		case c.PushOption != "":
+			push.Options = append(push.Options, c.PushOption)
+		case len(c.PackStream) != 0:
+			pack.Write(c.PackStream)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	summary.Atomic = caps.Has("atomic")
+
+	s.m.Lock()
+	for _, c := range cmds {
+		var err error
+		cur := zeroObjectID
+		if r, ok := s.refs[c.RefName]; ok {
+			cur = r.ObjectID
+		}
+		if c.OldObjectID != cur {
+			err = errors.New("failed to update ref")
+		}
+		summary.SetResult(c.RefName, err)
+	}
+	push.Updates = summary.Updates()
+	if pack.Len() != 0 {
+		push.Pack = pack.Bytes()
+	}
+	for _, u := range push.Updates {
+		if !u.Status.Ok {
+			continue
+		}
+		if u.NewObjectID == zeroObjectID {
+			delete(s.refs, u.RefName)
+			continue
+		}
+		s.refs[u.RefName] = &gitprotocolio.AdvertisedRef{Name: u.RefName, ObjectID: u.NewObjectID}
+		if push.Pack != nil {
+			s.packs[u.NewObjectID] = push.Pack
+		}
+	}
+	s.pushes = append(s.pushes, push)
+	s.m.Unlock()
+
+	if !caps.Has("report-status") && !caps.Has("report-status-v2") {
+		return nil
+	}
+	var out io.Writer = w
+	if caps.Has("side-band-64k") {
+		out = gitprotocolio.NewSideBandMuxer(w, gitprotocolio.MaxSideBandPayloadSize)
+	}
+	for _, c := range summary.ReportStatus(caps.Has("report-status-v2")) {
+		if _, err := out.Write(c.EncodeToPktLine()); err != nil {
+			return err
+		}
+	}
+	if caps.Has("side-band-64k") {
+		_, err := w.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gittest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/testutil"
+)
+
+const (
+	oidA = "1111111111111111111111111111111111111111"
+	oidB = "2222222222222222222222222222222222222222"
+)
+
+func newTestServer(pack []byte) *Server {
+	s := NewServer()
+	s.SetRef("refs/heads/master", oidA)
+	s.SetTag("refs/tags/v1", oidB, oidA)
+	s.SetPack(oidA, pack)
+	return s
+}
+
+// readPack reads a v0 upload-pack response and returns the pack data. Every
+// packet must be within the limit of Git.
+func readPack(t *testing.T, rd io.Reader) []byte {
+	t.Helper()
+	var pack []byte
+	sc := gitprotocolio.NewPacketScanner(rd)
+	for sc.Scan() {
+		p, ok := sc.Packet().(gitprotocolio.BytesPacket)
+		if !ok || string(p) == "NAK\n" {
+			continue
+		}
+		if sp, ok := gitprotocolio.ParseSideBandPacket(p).(gitprotocolio.SideBandMainPacket); ok {
+			pack = append(pack, sp...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return pack
+}
+
+func TestServerDiscover(t *testing.T) {
+	s := newTestServer(nil)
+	refs := []string{"HEAD", "refs/heads/master", "refs/tags/v1", "refs/tags/v1^{}"}
+	for _, tc := range []struct {
+		service     string
+		version     int
+		wantVersion uint64
+		wantRefs    []string
+		wantCap     string
+	}{
+		{uploadPackService, 0, 0, refs, "symref=HEAD:refs/heads/master"},
+		{uploadPackService, 1, 1, refs, "symref=HEAD:refs/heads/master"},
+		{uploadPackService, 2, 2, nil, "ls-refs"},
+		// receive-pack doesn't advertise HEAD.
+		{receivePackService, 0, 0, refs[1:], "report-status"},
+	} {
+		rc, err := s.Discover(context.Background(), tc.service, tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := gitprotocolio.ReadProtocolDiscovery(rc)
+		if err != nil {
+			t.Fatalf("%s v%d: %v", tc.service, tc.version, err)
+		}
+		var got []string
+		for _, c := range d.Refs {
+			got = append(got, c.Ref)
+		}
+		if d.ProtocolVersion != tc.wantVersion || !reflect.DeepEqual(got, tc.wantRefs) || !gitprotocolio.Capabilities(d.Capabilities).Has(tc.wantCap) {
+			t.Errorf("%s v%d: got version %d, refs %q, capabilities %q", tc.service, tc.version, d.ProtocolVersion, got, d.Capabilities)
+		}
+	}
+	if _, err := s.Discover(context.Background(), "git-upload-archive", 0); err == nil {
+		t.Error("got no error for an unknown service")
+	}
+}
+
+func TestServerUploadPack(t *testing.T) {
+	// The pack is larger than a packet.
+	pack := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(pack)
+	s := newTestServer(pack)
+
+	req := func(caps []string, done bool) io.Reader {
+		chunks := []*gitprotocolio.ProtocolV1UploadPackRequestChunk{{WantObjectID: oidA, Capabilities: caps}, {EndOneRound: true}}
+		if done {
+			chunks = append(chunks, &gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true})
+		}
+		return bytes.NewReader(testutil.Encode(chunks))
+	}
+	for _, caps := range [][]string{{"side-band-64k"}, {"side-band"}} {
+		rc, err := s.Request(context.Background(), uploadPackService, 0, req(caps, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readPack(t, rc); !bytes.Equal(got, pack) {
+			t.Errorf("%q: got %d bytes, want %d", caps, len(got), len(pack))
+		}
+	}
+
+	// Without done, the response is only a NAK.
+	rc, err := s.Request(context.Background(), uploadPackService, 0, req([]string{"side-band-64k"}, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := io.ReadAll(rc); string(bs) != "0008NAK\n" {
+		t.Errorf("got %q, want a NAK", bs)
+	}
+
+	unknown := testutil.Encode([]*gitprotocolio.ProtocolV1UploadPackRequestChunk{{WantObjectID: oidB}, {EndOneRound: true}, {NoMoreNegotiation: true}})
+	s = NewServer()
+	rc, err = s.Request(context.Background(), uploadPackService, 0, bytes.NewReader(unknown))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := io.ReadAll(rc); !strings.Contains(string(bs), "ERR upload-pack: not our ref "+oidB) {
+		t.Errorf("got %q, want an ERR packet", bs)
+	}
+}
+
+func TestServerProtocolV2(t *testing.T) {
+	s := newTestServer([]byte("PACKdata"))
+	v2 := func(command string, args ...string) io.Reader {
+		chunks := []*gitprotocolio.ProtocolV2RequestChunk{{Command: command}, {EndCapability: true}}
+		for _, a := range args {
+			chunks = append(chunks, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte(a + "\n")})
+		}
+		chunks = append(chunks, &gitprotocolio.ProtocolV2RequestChunk{EndArgument: true})
+		return bytes.NewReader(testutil.Encode(chunks))
+	}
+
+	rc, err := s.Request(context.Background(), uploadPackService, 2, v2("ls-refs", "symrefs", "ref-prefix refs/heads/", "ref-prefix HEAD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	lr := gitprotocolio.NewLsRefsResponse(rc)
+	for lr.Scan() {
+		if c := lr.Chunk(); c.Ref != "" {
+			refs = append(refs, c.Ref+" "+c.SymrefTarget)
+		}
+	}
+	if err := lr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"HEAD refs/heads/master", "refs/heads/master "}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("got %q, want %q", refs, want)
+	}
+
+	rc, err = s.Request(context.Background(), uploadPackService, 2, v2("fetch", "want "+oidA, "done"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pack []byte
+	fr := gitprotocolio.NewProtocolV2FetchResponse(rc)
+	for fr.Scan() {
+		if sp, ok := gitprotocolio.ParseSideBandPacket(gitprotocolio.BytesPacket(fr.Chunk().PackStream)).(gitprotocolio.SideBandMainPacket); ok {
+			pack = append(pack, sp...)
+		}
+	}
+	if err := fr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if string(pack) != "PACKdata" {
+		t.Errorf("got pack %q", pack)
+	}
+}
+
+func TestServerReceivePack(t *testing.T) {
+	s := newTestServer(nil)
+	zero := strings.Repeat("0", 40)
+	body := testutil.Encode([]*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+		{OldObjectID: zero, NewObjectID: oidB, RefName: "refs/heads/new", Capabilities: []string{"report-status", "push-options"}},
+		{OldObjectID: oidB, NewObjectID: zero, RefName: "refs/heads/master"},
+		{EndOfCommands: true},
+		{PushOption: "ci.skip"},
+		{EndOfPushOptions: true},
+	})
+	body = append(body, "PACKdata"...)
+	rc, err := s.Request(context.Background(), receivePackService, 0, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := io.ReadAll(rc)
+	if !strings.Contains(string(bs), "unpack ok\n") || !strings.Contains(string(bs), "ok refs/heads/new\n") || !strings.Contains(string(bs), "ng refs/heads/master failed to update ref\n") {
+		t.Errorf("got report-status %q", bs)
+	}
+	if want := map[string]string{"refs/heads/master": oidA, "refs/heads/new": oidB, "refs/tags/v1": oidB}; !reflect.DeepEqual(s.Refs(), want) {
+		t.Errorf("got refs %v, want %v", s.Refs(), want)
+	}
+	pushes := s.Pushes()
+	if len(pushes) != 1 || string(pushes[0].Pack) != "PACKdata" || !reflect.DeepEqual(pushes[0].Options, []string{"ci.skip"}) {
+		t.Errorf("got pushes %+v", pushes)
+	}
+
+	// The pushed pack is fetched for the new ref.
+	req := testutil.Encode([]*gitprotocolio.ProtocolV1UploadPackRequestChunk{{WantObjectID: oidB}, {EndOneRound: true}, {NoMoreNegotiation: true}})
+	rc, err = s.Request(context.Background(), uploadPackService, 0, bytes.NewReader(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := io.ReadAll(rc); !strings.HasSuffix(string(bs), "PACKdata") {
+		t.Errorf("got %q, want the pushed pack", bs)
+	}
+}
+
+func TestServerHTTP(t *testing.T) {
+	ts := httptest.NewServer(newTestServer([]byte("PACKdata")))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := gitprotocolio.ReadProtocolDiscovery(resp.Body)
+	resp.Body.Close()
+	if err != nil || d.ProtocolVersion != 2 || resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		t.Errorf("got %+v, %v, content type %q", d, err, resp.Header.Get("Content-Type"))
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(testutil.Encode([]*gitprotocolio.ProtocolV1UploadPackRequestChunk{{WantObjectID: oidA, Capabilities: []string{"side-band-64k"}}, {EndOneRound: true}, {NoMoreNegotiation: true}}))
+	zw.Close()
+	req, _ = http.NewRequest("POST", ts.URL+"/repo.git/git-upload-pack", &body)
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := readPack(t, resp.Body)
+	resp.Body.Close()
+	if string(pack) != "PACKdata" || resp.Header.Get("Content-Type") != "application/x-git-upload-pack-result" {
+		t.Errorf("got pack %q, content type %q", pack, resp.Header.Get("Content-Type"))
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/repo.git/git-upload-pack", http.StatusMethodNotAllowed},
+		{"GET", "/repo.git/HEAD", http.StatusNotFound},
+		{"GET", "/repo.git/info/refs?service=git-upload-archive", http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(tc.method, ts.URL+tc.path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s: got status %d, want %d", tc.method, tc.path, resp.StatusCode, tc.want)
+		}
+	}
+}
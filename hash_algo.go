@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+)
+
+// HashAlgo is a hash algorithm of object IDs and pack checksums.
+type HashAlgo struct {
+	// Name is the name in the "object-format" capability.
+	Name ObjectFormat
+	// HexSize is the length of a hexadecimal object ID.
+	HexSize int
+	// New returns a new hasher.
+	New func() hash.Hash
+}
+
+// ZeroObjectID returns the all-zero object ID.
+func (a *HashAlgo) ZeroObjectID() string {
+	return strings.Repeat("0", a.HexSize)
+}
+
+// ValidObjectID returns true if s is a lowercase hexadecimal object ID of the
+// algorithm.
+func (a *HashAlgo) ValidObjectID(s string) bool {
+	if len(s) != a.HexSize {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// The built-in hash algorithms.
+var (
+	HashAlgoSHA1   = &HashAlgo{Name: ObjectFormatSHA1, HexSize: 40, New: sha1.New}
+	HashAlgoSHA256 = &HashAlgo{Name: ObjectFormatSHA256, HexSize: 64, New: sha256.New}
+)
+
+var (
+	hashAlgosMu sync.RWMutex
+	hashAlgos   = map[ObjectFormat]*HashAlgo{
+		ObjectFormatSHA1:   HashAlgoSHA1,
+		ObjectFormatSHA256: HashAlgoSHA256,
+	}
+)
+
+// RegisterHashAlgo registers a hash algorithm, so that the object format of its
+// name is accepted by the parsers and the helpers. Registering a name again
+// replaces the algorithm, e.g. with a test double.
+func RegisterHashAlgo(a *HashAlgo) {
+	hashAlgosMu.Lock()
+	defer hashAlgosMu.Unlock()
+	hashAlgos[a.Name] = a
+}
+
+// LookupHashAlgo returns the hash algorithm of the object format, or nil if
+// it's not registered.
+func LookupHashAlgo(f ObjectFormat) *HashAlgo {
+	hashAlgosMu.RLock()
+	defer hashAlgosMu.RUnlock()
+	return hashAlgos[f]
+}
+
+// HashAlgoByHexSize returns the registered hash algorithm of which object IDs
+// have the length, or nil if there is none or more than one.
+func HashAlgoByHexSize(n int) *HashAlgo {
+	hashAlgosMu.RLock()
+	defer hashAlgosMu.RUnlock()
+	var ret *HashAlgo
+	for _, a := range hashAlgos {
+		if a.HexSize == n {
+			if ret != nil {
+				return nil
+			}
+			ret = a
+		}
+	}
+	return ret
+}
+
+// NegotiateObjectFormat returns the hash algorithm of the object format
+// advertised in the server capabilities. It returns an error if the algorithm
+// is not registered.
+func NegotiateObjectFormat(serverCaps []string) (*HashAlgo, error) {
+	f := ObjectFormatFromCapabilities(serverCaps)
+	a := LookupHashAlgo(f)
+	if a == nil {
+		return nil, fmt.Errorf("unsupported object format: %s", f)
+	}
+	return a, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"crypto/md5"
+	"strings"
+	"testing"
+)
+
+// registerTestHashAlgo registers a until the end of the test.
+func registerTestHashAlgo(t *testing.T, a *HashAlgo) {
+	RegisterHashAlgo(a)
+	t.Cleanup(func() {
+		hashAlgosMu.Lock()
+		defer hashAlgosMu.Unlock()
+		delete(hashAlgos, a.Name)
+	})
+}
+
+func TestHashAlgoBuiltins(t *testing.T) {
+	for _, a := range []*HashAlgo{HashAlgoSHA1, HashAlgoSHA256} {
+		if got := LookupHashAlgo(a.Name); got != a {
+			t.Errorf("LookupHashAlgo(%s): got %v", a.Name, got)
+		}
+		if got := HashAlgoByHexSize(a.HexSize); got != a {
+			t.Errorf("HashAlgoByHexSize(%d): got %v", a.HexSize, got)
+		}
+		if got := a.New().Size() * 2; got != a.HexSize {
+			t.Errorf("%s: hasher size %d, want %d", a.Name, got, a.HexSize)
+		}
+		if !a.ValidObjectID(a.ZeroObjectID()) {
+			t.Errorf("%s: zero object ID is not valid", a.Name)
+		}
+		for _, s := range []string{"", a.ZeroObjectID()[1:], strings.Repeat("A", a.HexSize), strings.Repeat("g", a.HexSize)} {
+			if a.ValidObjectID(s) {
+				t.Errorf("%s: %q is valid", a.Name, s)
+			}
+		}
+	}
+	if got := LookupHashAlgo("md5"); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+	if got := HashAlgoByHexSize(32); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
+
+func TestRegisterHashAlgo(t *testing.T) {
+	md5Algo := &HashAlgo{Name: "md5", HexSize: 32, New: md5.New}
+	registerTestHashAlgo(t, md5Algo)
+	if got := LookupHashAlgo("md5"); got != md5Algo {
+		t.Errorf("got %v, want %v", got, md5Algo)
+	}
+	if got := ObjectFormat("md5").HexSize(); got != 32 {
+		t.Errorf("got %d, want 32", got)
+	}
+	if got := HashAlgoByHexSize(32); got != md5Algo {
+		t.Errorf("got %v, want %v", got, md5Algo)
+	}
+
+	// Two algorithms of the same size are ambiguous.
+	registerTestHashAlgo(t, &HashAlgo{Name: "md5-other", HexSize: 32, New: md5.New})
+	if got := HashAlgoByHexSize(32); got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
+
+func TestNegotiateObjectFormat(t *testing.T) {
+	for _, tc := range []struct {
+		caps    []string
+		want    *HashAlgo
+		wantErr bool
+	}{
+		{nil, HashAlgoSHA1, false},
+		{[]string{"object-format=sha256"}, HashAlgoSHA256, false},
+		{[]string{"object-format=md5"}, nil, true},
+	} {
+		got, err := NegotiateObjectFormat(tc.caps)
+		if got != tc.want || (err != nil) != tc.wantErr {
+			t.Errorf("%q: got %v, %v, want %v", tc.caps, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+// The windows of git-fetch-pack: INITIAL_FLUSH, PIPESAFE_FLUSH and
+// LARGE_FLUSH.
+const (
+	haveBatchInitialWindow  = 16
+	haveBatchPipeSafeWindow = 32
+	haveBatchLargeWindow    = 16384
+)
+
+// HaveBatcher splits have lines into negotiation rounds in the same way as
+// git-fetch-pack.
+//
+// The first round ends after 16 haves and the window doubles up to 32. Over a
+// stateful connection, every following round adds another 32 haves so that
+// the client does not fill up the pipe before reading the server's ACKs. In
+// the stateless-RPC mode (smart HTTP), every round is a separate request, so
+// the window doubles up to 16384 haves and grows by 10% after that.
+type HaveBatcher struct {
+	statelessRPC bool
+	count        int
+	lastFlush    int
+	flushAt      int
+	rounds       int
+}
+
+// NewHaveBatcher returns a new HaveBatcher.
+func NewHaveBatcher(statelessRPC bool) *HaveBatcher {
+	return &HaveBatcher{
+		statelessRPC: statelessRPC,
+		flushAt:      haveBatchInitialWindow,
+	}
+}
+
+// Add records a have line and returns the chunks to send. The returned chunks
+// are the have line, followed by a flush that ends the round if the window is
+// full.
+func (b *HaveBatcher) Add(objectID string) []*ProtocolV1UploadPackRequestChunk {
+	b.count++
+	chunks := []*ProtocolV1UploadPackRequestChunk{
+		{HaveObjectID: objectID},
+	}
+	if b.count >= b.flushAt {
+		chunks = append(chunks, b.endRound())
+	}
+	return chunks
+}
+
+// Flush returns the chunk that ends the current round if there are haves sent
+// after the last flush. Otherwise, it returns nil.
+func (b *HaveBatcher) Flush() *ProtocolV1UploadPackRequestChunk {
+	if b.Pending() == 0 {
+		return nil
+	}
+	return b.endRound()
+}
+
+// Pending returns the number of haves sent after the last flush.
+func (b *HaveBatcher) Pending() int {
+	return b.count - b.lastFlush
+}
+
+// Count returns the number of haves added in total.
+func (b *HaveBatcher) Count() int {
+	return b.count
+}
+
+// Rounds returns the number of rounds ended by a flush.
+func (b *HaveBatcher) Rounds() int {
+	return b.rounds
+}
+
+// Window returns the number of haves the current round ends at, counted from
+// the first have.
+func (b *HaveBatcher) Window() int {
+	return b.flushAt
+}
+
+func (b *HaveBatcher) endRound() *ProtocolV1UploadPackRequestChunk {
+	b.rounds++
+	b.lastFlush = b.count
+	b.flushAt = nextHaveBatchFlush(b.statelessRPC, b.count)
+	return &ProtocolV1UploadPackRequestChunk{EndOneRound: true}
+}
+
+func nextHaveBatchFlush(statelessRPC bool, count int) int {
+	if statelessRPC {
+		if count < haveBatchLargeWindow {
+			return count << 1
+		}
+		return count * 11 / 10
+	}
+	if count < haveBatchPipeSafeWindow {
+		return count << 1
+	}
+	return count + haveBatchPipeSafeWindow
+}
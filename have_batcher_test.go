@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHaveBatcher(t *testing.T) {
+	for _, tc := range []struct {
+		statelessRPC bool
+		n            int
+		want         []int
+	}{
+		// git-fetch-pack flushes at 16 and 32, then every 32 haves.
+		{false, 200, []int{16, 32, 64, 96, 128, 160, 192}},
+		// Over stateless RPC, the window doubles.
+		{true, 600, []int{16, 32, 64, 128, 256, 512}},
+	} {
+		b := NewHaveBatcher(tc.statelessRPC)
+		var flushes []int
+		for i := 1; i <= tc.n; i++ {
+			chunks := b.Add("1111")
+			if chunks[0].HaveObjectID != "1111" {
+				t.Fatalf("unexpected chunk: %+v", chunks[0])
+			}
+			if len(chunks) == 2 && chunks[1].EndOneRound {
+				flushes = append(flushes, i)
+			}
+		}
+		if !reflect.DeepEqual(flushes, tc.want) {
+			t.Errorf("stateless %v: flushes at %v, want %v", tc.statelessRPC, flushes, tc.want)
+		}
+		if b.Count() != tc.n || b.Rounds() != len(tc.want) || b.Pending() != tc.n-tc.want[len(tc.want)-1] {
+			t.Errorf("stateless %v: count %d, rounds %d, pending %d", tc.statelessRPC, b.Count(), b.Rounds(), b.Pending())
+		}
+		if c := b.Flush(); c == nil || !c.EndOneRound || b.Pending() != 0 {
+			t.Errorf("stateless %v: unexpected flush %+v", tc.statelessRPC, c)
+		}
+		if c := b.Flush(); c != nil {
+			t.Errorf("stateless %v: flush without pending haves", tc.statelessRPC)
+		}
+	}
+
+	if got := nextHaveBatchFlush(true, 20000); got != 22000 {
+		t.Errorf("got %d, want the window to grow by 10%% above 16384", got)
+	}
+}
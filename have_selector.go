@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+// NegotiationTip is a local ref that can be offered as a have.
+type NegotiationTip struct {
+	RefName  string
+	ObjectID string
+}
+
+// TipSelector chooses the local tips to offer as haves for the wants, and the
+// order to offer them in. Tips that are not returned are not offered, and
+// neither are their ancestors unless they are reachable from a returned tip.
+type TipSelector func(wants []string, tips []*NegotiationTip) []*NegotiationTip
+
+// DefaultTipSelector offers all the tips in the given order.
+func DefaultTipSelector(wants []string, tips []*NegotiationTip) []*NegotiationTip {
+	return tips
+}
+
+// HaveWalker produces the have lines of a fetch by walking the local history
+// from the tips chosen by a TipSelector. By default, the tips are walked
+// breadth-first together, which is far from optimal for a large repository
+// with many unrelated refs. A TipSelector can put the refs related to the
+// wants first, or leave out the unrelated ones.
+//
+// Feed the returned haves to a HaveBatcher, and call MarkCommon for the
+// commits the server acknowledges so that their ancestors are not offered.
+type HaveWalker struct {
+	parents func(objectID string) ([]string, error)
+	queue   []string
+	seen    map[string]bool
+	common  map[string]bool
+}
+
+// NewHaveWalker returns a new HaveWalker. parents returns the parent commits of
+// a local commit. If selector is nil, DefaultTipSelector is used.
+func NewHaveWalker(wants []string, tips []*NegotiationTip, selector TipSelector, parents func(objectID string) ([]string, error)) *HaveWalker {
+	if selector == nil {
+		selector = DefaultTipSelector
+	}
+	w := &HaveWalker{
+		parents: parents,
+		seen:    map[string]bool{},
+		common:  map[string]bool{},
+	}
+	for _, t := range selector(wants, tips) {
+		w.enqueue(t.ObjectID)
+	}
+	return w
+}
+
+func (w *HaveWalker) enqueue(oid string) {
+	if w.seen[oid] {
+		return
+	}
+	w.seen[oid] = true
+	w.queue = append(w.queue, oid)
+}
+
+// MarkCommon records a commit acknowledged by the server. The commit and its
+// ancestors that are not queued yet are not offered. The ancestors already
+// reached through another path can still be offered.
+func (w *HaveWalker) MarkCommon(objectID string) {
+	w.common[objectID] = true
+}
+
+// Next returns the next have, or "" if there is no more commit to offer.
+func (w *HaveWalker) Next() (string, error) {
+	for len(w.queue) > 0 {
+		oid := w.queue[0]
+		w.queue = w.queue[1:]
+		if w.common[oid] {
+			continue
+		}
+		ps, err := w.parents(oid)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range ps {
+			w.enqueue(p)
+		}
+		return oid, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testHistory is main c1 <- c2 <- c3 and topic d1 <- d2, d1 merging c1.
+var testHistory = map[string][]string{
+	"c3": {"c2"},
+	"c2": {"c1"},
+	"c1": nil,
+	"d2": {"d1"},
+	"d1": {"c1"},
+}
+
+var testTips = []*NegotiationTip{
+	{RefName: "refs/heads/main", ObjectID: "c3"},
+	{RefName: "refs/heads/topic", ObjectID: "d2"},
+}
+
+func testParents(oid string) ([]string, error) {
+	ps, ok := testHistory[oid]
+	if !ok {
+		return nil, errors.New("missing object " + oid)
+	}
+	return ps, nil
+}
+
+func walkHaves(t *testing.T, w *HaveWalker) []string {
+	var ret []string
+	for {
+		oid, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if oid == "" {
+			return ret
+		}
+		ret = append(ret, oid)
+	}
+}
+
+func TestHaveWalker(t *testing.T) {
+	mainOnly := func(wants []string, tips []*NegotiationTip) []*NegotiationTip {
+		return tips[:1]
+	}
+	reversed := func(wants []string, tips []*NegotiationTip) []*NegotiationTip {
+		return []*NegotiationTip{tips[1], tips[0]}
+	}
+	for _, tc := range []struct {
+		name     string
+		selector TipSelector
+		want     []string
+	}{
+		{"default", nil, []string{"c3", "d2", "c2", "d1", "c1"}},
+		{"selected", mainOnly, []string{"c3", "c2", "c1"}},
+		{"reordered", reversed, []string{"d2", "c3", "d1", "c2", "c1"}},
+	} {
+		w := NewHaveWalker([]string{"x"}, testTips, tc.selector, testParents)
+		if got := walkHaves(t, w); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHaveWalkerMarkCommon(t *testing.T) {
+	w := NewHaveWalker(nil, testTips[:1], nil, testParents)
+	if oid, _ := w.Next(); oid != "c3" {
+		t.Fatalf("got %q, want c3", oid)
+	}
+	// c2 is queued already, but not walked yet, so neither it nor c1 is
+	// offered.
+	w.MarkCommon("c2")
+	if got := walkHaves(t, w); len(got) != 0 {
+		t.Errorf("got %q, want nothing", got)
+	}
+}
+
+func TestHaveWalkerError(t *testing.T) {
+	w := NewHaveWalker(nil, []*NegotiationTip{{RefName: "refs/heads/broken", ObjectID: "e1"}}, nil, testParents)
+	if oid, err := w.Next(); err == nil {
+		t.Errorf("got %q, want an error", oid)
+	}
+}
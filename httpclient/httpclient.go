@@ -0,0 +1,175 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpclient implements the client side of the smart HTTP protocol.
+//
+// The ref discovery is a GET request to /info/refs?service=<service>, and
+// every request is a POST request to /<service>. The server doesn't keep any
+// state between them (the stateless-RPC mode), so a fetch negotiation sends
+// the wants and the common haves again in every round. The response bodies
+// are the pkt-line streams that the parsers of gitprotocolio read.
+package httpclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// gzipThreshold is the request size above which git-remote-curl compresses an
+// upload-pack request.
+const gzipThreshold = 1024
+
+// StatusError is an error returned when the server responds with a non-200
+// status.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+}
+
+// ContentTypeError is an error returned when the response has an unexpected
+// content type. A dumb HTTP server responds to the ref discovery with a plain
+// text file, for example.
+type ContentTypeError struct {
+	URL         string
+	ContentType string
+	Want        string
+}
+
+func (e *ContentTypeError) Error() string {
+	return fmt.Sprintf("%s: content type %q, want %q", e.URL, e.ContentType, e.Want)
+}
+
+// Client is a smart HTTP client of a repository. Its Discover and Request
+// methods fit client.Transport.
+type Client struct {
+	// HTTPClient is the HTTP client. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// URL is the URL of the repository, such as
+	// "https://example.com/repo.git".
+	URL string
+	// UserAgent is the User-Agent header. If empty, the header of the
+	// HTTPClient is used.
+	UserAgent string
+	// DisableGzip makes the client send the upload-pack requests
+	// uncompressed.
+	DisableGzip bool
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) url(path string) string {
+	return strings.TrimSuffix(c.URL, "/") + path
+}
+
+func (c *Client) do(req *http.Request, version int, contentType string) (io.ReadCloser, error) {
+	if version == 2 {
+		req.Header.Set("Git-Protocol", "version=2")
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != contentType {
+		resp.Body.Close()
+		return nil, &ContentTypeError{
+			URL:         req.URL.String(),
+			ContentType: resp.Header.Get("Content-Type"),
+			Want:        contentType,
+		}
+	}
+	return resp.Body, nil
+}
+
+// Discover sends the ref discovery request of the service ("git-upload-pack"
+// or "git-receive-pack") and returns the advertisement. If version is 2, it
+// requests protocol v2. The server can still answer with v0.
+func (c *Client) Discover(ctx context.Context, service string, version int) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url("/info/refs?service="+service), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "*/*")
+	// Proxies must not serve a stale advertisement.
+	req.Header.Set("Cache-Control", "no-cache")
+	return c.do(req, version, fmt.Sprintf("application/x-%s-advertisement", service))
+}
+
+// Request sends a request of the service and returns the response. version is
+// the protocol version of the request.
+//
+// An upload-pack request is small, so it's buffered and, if it's larger than
+// 1KiB, compressed with gzip as git-remote-curl does. Other requests, such as
+// a push with a pack, are streamed as is.
+func (c *Client) Request(ctx context.Context, service string, version int, body io.Reader) (io.ReadCloser, error) {
+	var encoding string
+	if service == "git-upload-pack" {
+		bs, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		if !c.DisableGzip && len(bs) > gzipThreshold {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(bs); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			bs = buf.Bytes()
+			encoding = "gzip"
+		}
+		// A bytes.Reader sets the Content-Length.
+		body = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url("/"+service), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", fmt.Sprintf("application/x-%s-request", service))
+	req.Header.Set("Accept", fmt.Sprintf("application/x-%s-result", service))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return c.do(req, version, fmt.Sprintf("application/x-%s-result", service))
+}
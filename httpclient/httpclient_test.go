@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// request is a request received by the test server.
+type request struct {
+	method, url string
+	header      http.Header
+	body        string
+}
+
+// newServer returns a server that records the requests and responds with the
+// content type and the body.
+func newServer(t *testing.T, status int, contentType, body string) (*httptest.Server, *[]*request) {
+	var reqs []*request
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rd io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rd = zr
+		}
+		bs, err := io.ReadAll(rd)
+		if err != nil {
+			t.Error(err)
+		}
+		reqs = append(reqs, &request{r.Method, r.URL.String(), r.Header, string(bs)})
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(s.Close)
+	return s, &reqs
+}
+
+func TestClientDiscover(t *testing.T) {
+	s, reqs := newServer(t, http.StatusOK, "application/x-git-upload-pack-advertisement", "advertisement")
+	c := &Client{URL: s.URL + "/repo.git/", UserAgent: "git/2.40"}
+	for _, version := range []int{0, 2} {
+		rc, err := c.Discover(context.Background(), "git-upload-pack", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(bs) != "advertisement" {
+			t.Errorf("version %d: got %q, %v", version, bs, err)
+		}
+	}
+	for i, want := range []string{"", "version=2"} {
+		r := (*reqs)[i]
+		if r.method != "GET" || r.url != "/repo.git/info/refs?service=git-upload-pack" {
+			t.Errorf("got %s %s", r.method, r.url)
+		}
+		if got := r.header.Get("Git-Protocol"); got != want {
+			t.Errorf("got Git-Protocol %q, want %q", got, want)
+		}
+		if r.header.Get("Cache-Control") != "no-cache" || r.header.Get("User-Agent") != "git/2.40" {
+			t.Errorf("got headers %v", r.header)
+		}
+	}
+}
+
+func TestClientDiscoverErrors(t *testing.T) {
+	s, _ := newServer(t, http.StatusNotFound, "text/plain", "not found")
+	_, err := (&Client{URL: s.URL}).Discover(context.Background(), "git-upload-pack", 0)
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound || se.Method != "GET" {
+		t.Errorf("got %v, want a StatusError", err)
+	}
+
+	// A dumb HTTP server serves info/refs as a plain text file.
+	s, _ = newServer(t, http.StatusOK, "text/plain", "refs")
+	_, err = (&Client{URL: s.URL}).Discover(context.Background(), "git-upload-pack", 0)
+	var ce *ContentTypeError
+	if !errors.As(err, &ce) || ce.ContentType != "text/plain" || ce.Want != "application/x-git-upload-pack-advertisement" {
+		t.Errorf("got %v, want a ContentTypeError", err)
+	}
+}
+
+func TestClientRequest(t *testing.T) {
+	small := "0032want 1111111111111111111111111111111111111111\n"
+	large := strings.Repeat(small, 100)
+	for _, tc := range []struct {
+		name        string
+		service     string
+		disableGzip bool
+		body        string
+		wantGzip    bool
+	}{
+		{"small", "git-upload-pack", false, small, false},
+		{"large", "git-upload-pack", false, large, true},
+		{"gzip disabled", "git-upload-pack", true, large, false},
+		// A push is streamed as is.
+		{"receive-pack", "git-receive-pack", false, large, false},
+	} {
+		s, reqs := newServer(t, http.StatusOK, "application/x-"+tc.service+"-result", "result")
+		c := &Client{URL: s.URL, DisableGzip: tc.disableGzip}
+		rc, err := c.Request(context.Background(), tc.service, 2, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		bs, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil || string(bs) != "result" {
+			t.Errorf("%s: got %q, %v", tc.name, bs, err)
+		}
+		r := (*reqs)[0]
+		if r.method != "POST" || r.url != "/"+tc.service || r.body != tc.body {
+			t.Errorf("%s: got %s %s with %d bytes", tc.name, r.method, r.url, len(r.body))
+		}
+		if got := r.header.Get("Content-Encoding") == "gzip"; got != tc.wantGzip {
+			t.Errorf("%s: got gzip %v, want %v", tc.name, got, tc.wantGzip)
+		}
+		for k, want := range map[string]string{
+			"Content-Type": "application/x-" + tc.service + "-request",
+			"Accept":       "application/x-" + tc.service + "-result",
+			"Git-Protocol": "version=2",
+		} {
+			if got := r.header.Get(k); got != want {
+				t.Errorf("%s: got %s %q, want %q", tc.name, k, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpduplex implements a full-duplex mode of the smart HTTP protocol
+// for HTTP/2.
+//
+// In the usual stateless mode, the client sends the whole request body, and
+// then the server responds. Over HTTP/2, the request and the response bodies
+// can be streamed at the same time, so the server can send the
+// acknowledgments of a protocol v2 fetch while the client is still sending
+// haves. Both sides must flush at the packet boundaries, or the packets are
+// stuck in the HTTP/2 frames.
+package httpduplex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/google/gitprotocolio"
+)
+
+// ServerWriter prepares the response of a smart HTTP handler for the
+// full-duplex mode and returns a writer that flushes the response at the
+// packet boundaries. The handler can read r.Body while writing to it.
+//
+// The response headers must be set before calling this. For HTTP/1, it fails
+// if the server doesn't support the full-duplex mode.
+func ServerWriter(w http.ResponseWriter, r *http.Request) (*gitprotocolio.PacketFlushWriter, error) {
+	rc := http.NewResponseController(w)
+	if r.ProtoMajor < 2 {
+		if err := rc.EnableFullDuplex(); err != nil {
+			return nil, err
+		}
+	}
+	return gitprotocolio.NewPacketFlushWriter(w, rc.Flush), nil
+}
+
+// Stream is the client side of a full-duplex request. Write sends the request
+// body and Read reads the response body.
+type Stream struct {
+	pw     *io.PipeWriter
+	done   chan struct{}
+	resp   *http.Response
+	err    error
+	closed sync.Once
+}
+
+// Dial starts a POST request for the service ("git-upload-pack" or
+// "git-receive-pack") to the URL with the protocol v2 headers. The request body
+// is streamed from the Stream's Write. The client should use HTTP/2 to get a
+// response before the request body ends.
+func Dial(ctx context.Context, client *http.Client, url, service string) (*Stream, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = -1
+	req.Header.Add("Content-Type", fmt.Sprintf("application/x-%s-request", service))
+	req.Header.Add("Accept", fmt.Sprintf("application/x-%s-result", service))
+	req.Header.Add("Git-Protocol", "version=2")
+
+	s := &Stream{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		resp, err := client.Do(req)
+		if err != nil {
+			s.err = err
+			pr.CloseWithError(err)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			s.err = errors.New(resp.Status)
+			pr.CloseWithError(s.err)
+			return
+		}
+		s.resp = resp
+	}()
+	return s, nil
+}
+
+// Write sends p as a part of the request body. Each Write is handed to the
+// HTTP transport before it returns, so write whole sections at once.
+func (s *Stream) Write(p []byte) (int, error) {
+	return s.pw.Write(p)
+}
+
+// CloseWrite ends the request body.
+func (s *Stream) CloseWrite() error {
+	return s.pw.Close()
+}
+
+// Response waits for the response headers and returns the response.
+func (s *Stream) Response() (*http.Response, error) {
+	<-s.done
+	return s.resp, s.err
+}
+
+// Read reads the response body. It blocks until the response headers arrive.
+func (s *Stream) Read(p []byte) (int, error) {
+	resp, err := s.Response()
+	if err != nil {
+		return 0, err
+	}
+	return resp.Body.Read(p)
+}
+
+// Close ends the request body and closes the response body.
+func (s *Stream) Close() error {
+	var err error
+	s.closed.Do(func() {
+		s.pw.Close()
+		if resp, _ := s.Response(); resp != nil {
+			err = resp.Body.Close()
+		}
+	})
+	return err
+}
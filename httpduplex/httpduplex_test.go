@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpduplex
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+// newEchoServer returns an HTTP/2 server that echoes every request packet as
+// soon as it's read.
+func newEchoServer(t *testing.T) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo/git-upload-pack" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Git-Protocol") != "version=2" || r.Header.Get("Content-Type") != "application/x-git-upload-pack-request" {
+			http.Error(w, "bad headers", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		fw, err := ServerWriter(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sc := gitprotocolio.NewPacketScanner(r.Body)
+		for sc.Scan() {
+			if _, err := fw.Write(sc.Packet().EncodeToPktLine()); err != nil {
+				return
+			}
+		}
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestStream(t *testing.T) {
+	s := newEchoServer(t)
+	st, err := Dial(context.Background(), s.Client(), s.URL+"/repo/git-upload-pack", "git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+
+	// The echo of each section arrives before the request body ends. The
+	// server flushes only at the flush packets.
+	for _, section := range []string{
+		"0012command=fetch\n0001000ethin-pack\n0000",
+		"000bhave 1\n0000",
+	} {
+		if _, err := io.WriteString(st, section); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(section))
+		if _, err := io.ReadFull(st, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != section {
+			t.Errorf("got %q, want %q", got, section)
+		}
+	}
+	if err := st.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if rest, err := io.ReadAll(st); err != nil || len(rest) != 0 {
+		t.Errorf("got %q, %v after the request ended", rest, err)
+	}
+	resp, err := st.Response()
+	if err != nil || resp.ProtoMajor != 2 {
+		t.Errorf("got %v, %v, want an HTTP/2 response", resp, err)
+	}
+}
+
+func TestStreamErrorStatus(t *testing.T) {
+	s := newEchoServer(t)
+	st, err := Dial(context.Background(), s.Client(), s.URL+"/missing/git-upload-pack", "git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.CloseWrite()
+	if _, err := st.Read(make([]byte, 1)); err == nil {
+		t.Error("got no error for 404")
+	}
+}
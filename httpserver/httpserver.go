@@ -0,0 +1,344 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpserver implements the server side of the smart HTTP protocol.
+//
+// The handlers parse the requests and pass the chunks to a backend, which
+// implements the repository side: the refs, the negotiation and the pack
+// generation, and the ref updates. They speak protocol v0. A protocol v2
+// client falls back to v0 since the advertisement doesn't start with
+// "version 2".
+//
+// A server usually routes the paths like this:
+//
+//	mux.Handle("/repo.git/info/refs", &httpserver.InfoRefsHandler{Backend: b})
+//	mux.Handle("/repo.git/git-upload-pack", &httpserver.UploadPackHandler{Backend: b})
+//	mux.Handle("/repo.git/git-receive-pack", &httpserver.ReceivePackHandler{Backend: b})
+package httpserver
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/google/gitprotocolio"
+)
+
+const (
+	uploadPackService  = "git-upload-pack"
+	receivePackService = "git-receive-pack"
+)
+
+// RefsBackend provides the ref advertisements.
+type RefsBackend interface {
+	// AdvertiseRefs returns the capabilities and the refs to advertise for
+	// the service ("git-upload-pack" or "git-receive-pack").
+	AdvertiseRefs(ctx context.Context, service string) ([]string, gitprotocolio.RefIterator, error)
+}
+
+// UploadPackBackend serves the upload-pack requests.
+type UploadPackBackend interface {
+	// UploadPack handles a request and calls send for each response chunk.
+	// In the stateless-RPC mode, a request has the wants and the haves of
+	// one round, and the common haves of the previous rounds.
+	//
+	// The response chunks are written as is. If the client requested
+	// side-band-64k, the PackStream chunks must be sideband packets.
+	UploadPack(ctx context.Context, req []*gitprotocolio.ProtocolV1UploadPackRequestChunk, send func(*gitprotocolio.ProtocolV1UploadPackResponseChunk) error) error
+}
+
+// ReceivePackBackend serves the receive-pack requests.
+type ReceivePackBackend interface {
+	// ReceivePack applies the commands of a request with the pack, and
+	// returns the report-status response chunks. req has the chunks up to
+	// the pack. pack is empty if the client sent no pack, as in a push that
+	// only deletes refs.
+	//
+	// gitprotocolio.RefUpdateSummary can render the response.
+	ReceivePack(ctx context.Context, req []*gitprotocolio.ProtocolV1ReceivePackRequestChunk, pack io.Reader) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error)
+}
+
+// InfoRefsHandler serves the ref discovery, GET /info/refs?service=<service>.
+type InfoRefsHandler struct {
+	Backend RefsBackend
+	// PhaseTimeouts limits the time of the advertisement with Discovery.
+	// The context of the backend is canceled with a
+	// gitprotocolio.PhaseDeadlineError when it runs out.
+	PhaseTimeouts gitprotocolio.PhaseTimeouts
+	// ErrorLog logs the backend errors. If nil, the log package's standard
+	// logger is used.
+	ErrorLog *log.Logger
+}
+
+func (h *InfoRefsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service := r.URL.Query().Get("service")
+	if service != uploadPackService && service != receivePackService {
+		// The dumb HTTP protocol isn't supported.
+		http.Error(w, "unsupported service", http.StatusForbidden)
+		return
+	}
+	pd, ctx := gitprotocolio.NewPhaseDeadlines(r.Context(), h.PhaseTimeouts, nil)
+	defer pd.Stop()
+	pd.Start(gitprotocolio.PhaseDiscovery)
+	caps, refs, err := h.Backend.AdvertiseRefs(ctx, service)
+	if err != nil {
+		serveError(w, h.ErrorLog, err)
+		return
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := gitprotocolio.NewAdvertisementEncoder(w).EncodeInfoRefs(service, caps, refs); err != nil {
+		// The response has started. The client sees a truncated
+		// advertisement.
+		logf(h.ErrorLog, "cannot write the advertisement: %v", err)
+	}
+}
+
+// UploadPackHandler serves the upload-pack requests, POST /git-upload-pack.
+type UploadPackHandler struct {
+	Backend UploadPackBackend
+	// Policy rejects the requests that exceed the limits. If nil, the
+	// requests aren't limited.
+	Policy *gitprotocolio.UploadPackPolicy
+	// PhaseTimeouts limits the time of the negotiation, from reading the
+	// request to sending the first pack data, and of the pack transfer.
+	// The request is read and the backend runs with a context canceled with
+	// a gitprotocolio.PhaseDeadlineError when a phase runs out.
+	PhaseTimeouts gitprotocolio.PhaseTimeouts
+	// ErrorLog logs the backend errors. If nil, the log package's standard
+	// logger is used.
+	ErrorLog *log.Logger
+}
+
+func (h *UploadPackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := requestBody(w, r, uploadPackService)
+	if !ok {
+		return
+	}
+	defer body.Close()
+	pd, ctx := gitprotocolio.NewPhaseDeadlines(r.Context(), h.PhaseTimeouts, nil)
+	defer pd.Stop()
+	pd.Start(gitprotocolio.PhaseNegotiation)
+
+	var req []*gitprotocolio.ProtocolV1UploadPackRequestChunk
+	sc := gitprotocolio.NewProtocolV1UploadPackRequest(body)
+	if h.Policy != nil {
+		sc.SetPolicy(h.Policy)
+	}
+	for sc.ScanContext(ctx) {
+		req = append(req, copyUploadPackRequestChunk(sc.Chunk()))
+	}
+	if err := sc.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", uploadPackService))
+	w.Header().Set("Cache-Control", "no-cache")
+	inPack := false
+	send := func(c *gitprotocolio.ProtocolV1UploadPackResponseChunk) error {
+		if !inPack && (len(c.PackStream) != 0 || len(c.PackFile) != 0) {
+			inPack = true
+			pd.Start(gitprotocolio.PhasePackTransfer)
+		}
+		_, err := w.Write(c.EncodeToPktLine())
+		return err
+	}
+	if err := h.Backend.UploadPack(ctx, req, send); err != nil {
+		writeErrorPacket(w, h.ErrorLog, err)
+	}
+}
+
+// ReceivePackHandler serves the receive-pack requests, POST /git-receive-pack.
+type ReceivePackHandler struct {
+	Backend ReceivePackBackend
+	// PhaseTimeouts limits the time of a request with PackTransfer, since
+	// the commands and the pack are one stream. The request is read and the
+	// backend runs with a context canceled with a
+	// gitprotocolio.PhaseDeadlineError when it runs out.
+	PhaseTimeouts gitprotocolio.PhaseTimeouts
+	// ErrorLog logs the backend errors. If nil, the log package's standard
+	// logger is used.
+	ErrorLog *log.Logger
+}
+
+func (h *ReceivePackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := requestBody(w, r, receivePackService)
+	if !ok {
+		return
+	}
+	defer body.Close()
+	pd, ctx := gitprotocolio.NewPhaseDeadlines(r.Context(), h.PhaseTimeouts, nil)
+	defer pd.Stop()
+	pd.Start(gitprotocolio.PhasePackTransfer)
+
+	var req []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	var caps gitprotocolio.Capabilities
+	sc := gitprotocolio.NewProtocolV1ReceivePackRequest(body)
+	pack := &packReader{ctx: ctx, sc: sc}
+	for sc.ScanContext(ctx) {
+		c := sc.Chunk()
+		if len(c.PackStream) != 0 {
+			pack.buf = c.PackStream
+			break
+		}
+		if caps == nil && len(c.Capabilities) != 0 {
+			caps = c.Capabilities
+		}
+		req = append(req, copyReceivePackRequestChunk(c))
+	}
+	if err := sc.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp, err := h.Backend.ReceivePack(ctx, req, pack)
+	if err != nil {
+		serveError(w, h.ErrorLog, err)
+		return
+	}
+	// The client doesn't read the response until it sends the whole pack.
+	if _, err := io.Copy(io.Discard, pack); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-%s-result", receivePackService))
+	w.Header().Set("Cache-Control", "no-cache")
+	if !caps.Has("report-status") && !caps.Has("report-status-v2") {
+		return
+	}
+	var out io.Writer = w
+	if caps.Has("side-band-64k") {
+		out = gitprotocolio.NewSideBandMuxer(w, gitprotocolio.MaxSideBandPayloadSize)
+	}
+	for _, c := range resp {
+		if _, err := out.Write(c.EncodeToPktLine()); err != nil {
+			logf(h.ErrorLog, "cannot write the report-status: %v", err)
+			return
+		}
+	}
+	if caps.Has("side-band-64k") {
+		// The sideband stream ends with a flush.
+		w.Write(gitprotocolio.FlushPacket{}.EncodeToPktLine())
+	}
+}
+
+// copyUploadPackRequestChunk returns a copy of the chunk that doesn't share
+// memory with the scanner, which reuses it for the next chunk.
+func copyUploadPackRequestChunk(c *gitprotocolio.ProtocolV1UploadPackRequestChunk) *gitprotocolio.ProtocolV1UploadPackRequestChunk {
+	cc := *c
+	cc.Capabilities = append([]string(nil), c.Capabilities...)
+	return &cc
+}
+
+// copyReceivePackRequestChunk returns a copy of the chunk that doesn't share
+// memory with the scanner, which reuses it for the next chunk.
+func copyReceivePackRequestChunk(c *gitprotocolio.ProtocolV1ReceivePackRequestChunk) *gitprotocolio.ProtocolV1ReceivePackRequestChunk {
+	cc := *c
+	cc.Capabilities = append([]string(nil), c.Capabilities...)
+	cc.GPGSignaturePart = append([]byte(nil), c.GPGSignaturePart...)
+	cc.PackStream = append([]byte(nil), c.PackStream...)
+	return &cc
+}
+
+// requestBody checks the method and the content type of a request, and returns
+// the decompressed body. If the request is invalid, it writes the error and
+// returns false.
+func requestBody(w http.ResponseWriter, r *http.Request, service string) (io.ReadCloser, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != fmt.Sprintf("application/x-%s-request", service) {
+		http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+		return r.Body, true
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "cannot ungzip", http.StatusBadRequest)
+			return nil, false
+		}
+		return zr, true
+	}
+	http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+	return nil, false
+}
+
+// packReader reads the pack data of a receive-pack request.
+type packReader struct {
+	ctx context.Context
+	sc  *gitprotocolio.ProtocolV1ReceivePackRequest
+	buf []byte
+}
+
+func (r *packReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if !r.sc.ScanContext(r.ctx) {
+			if err := r.sc.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		r.buf = r.sc.Chunk().PackStream
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// serveError responds with the error before the response starts. An
+// ErrorPacket, including a RemoteError of an upstream, is sent to the client.
+// Other errors are logged and hidden.
+func serveError(w http.ResponseWriter, l *log.Logger, err error) {
+	var ep gitprotocolio.ErrorPacket
+	if errors.As(err, &ep) {
+		http.Error(w, string(ep), http.StatusForbidden)
+		return
+	}
+	logf(l, "backend error: %v", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// writeErrorPacket writes the error as an error packet after the response
+// starts.
+func writeErrorPacket(w io.Writer, l *log.Logger, err error) {
+	var ep gitprotocolio.ErrorPacket
+	if !errors.As(err, &ep) {
+		logf(l, "backend error: %v", err)
+		ep = gitprotocolio.ErrorPacket("internal error")
+	}
+	w.Write(ep.EncodeToPktLine())
+}
+
+func logf(l *log.Logger, format string, args ...interface{}) {
+	if l == nil {
+		log.Printf(format, args...)
+		return
+	}
+	l.Printf(format, args...)
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/testutil"
+)
+
+const (
+	oidA = "1111111111111111111111111111111111111111"
+	oidB = "2222222222222222222222222222222222222222"
+)
+
+type fakeBackend struct {
+	uploadPackReq  []*gitprotocolio.ProtocolV1UploadPackRequestChunk
+	receivePackReq []*gitprotocolio.ProtocolV1ReceivePackRequestChunk
+	pack           []byte
+}
+
+func (b *fakeBackend) UploadPack(ctx context.Context, req []*gitprotocolio.ProtocolV1UploadPackRequestChunk, send func(*gitprotocolio.ProtocolV1UploadPackResponseChunk) error) error {
+	b.uploadPackReq = req
+	return send(&gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true})
+}
+
+func (b *fakeBackend) ReceivePack(ctx context.Context, req []*gitprotocolio.ProtocolV1ReceivePackRequestChunk, pack io.Reader) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error) {
+	b.receivePackReq = req
+	var err error
+	b.pack, err = io.ReadAll(pack)
+	summary := &gitprotocolio.RefUpdateSummary{}
+	return summary.ReportStatus(false), err
+}
+
+// post sends the body one byte at a time, so that the scanner refills its
+// buffer between the chunks.
+func post(h http.Handler, service string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/"+service, iotest.OneByteReader(bytes.NewReader(body)))
+	r.Header.Set("Content-Type", "application/x-"+service+"-request")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestUploadPackHandler(t *testing.T) {
+	req := []*gitprotocolio.ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: oidA, Capabilities: []string{"side-band-64k", "ofs-delta"}},
+		{WantObjectID: oidB},
+		{EndOneRound: true},
+		{HaveObjectID: oidB},
+		{NoMoreNegotiation: true},
+	}
+	b := &fakeBackend{}
+	w := post(&UploadPackHandler{Backend: b}, uploadPackService, testutil.Encode(req))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if !reflect.DeepEqual(b.uploadPackReq, req) {
+		t.Errorf("got request %+v, want %+v", b.uploadPackReq, req)
+	}
+	if got, want := w.Body.String(), "0008NAK\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReceivePackHandler(t *testing.T) {
+	cert := &gitprotocolio.PushCertificate{
+		Pusher: "A U Thor <author@example.com> 1500000000 +0000",
+		Nonce:  "1500000000-abc",
+		Commands: []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			{OldObjectID: oidA, NewObjectID: oidB, RefName: "refs/heads/main"},
+		},
+	}
+	// The signature is larger than the scanner's initial buffer.
+	cert.Signature = []byte("-----BEGIN PGP SIGNATURE-----\n")
+	for i := 0; i < 100; i++ {
+		cert.Signature = fmt.Appendf(cert.Signature, "%063d\n", i)
+	}
+	cert.Signature = append(cert.Signature, "-----END PGP SIGNATURE-----\n"...)
+	req := append(cert.Chunks([]string{"report-status", "side-band-64k"}), &gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true})
+	body := append(testutil.Encode(req), "PACKdata"...)
+	b := &fakeBackend{}
+	w := post(&ReceivePackHandler{Backend: b}, receivePackService, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if !reflect.DeepEqual(b.receivePackReq, req) {
+		t.Errorf("got request %+v, want %+v", b.receivePackReq, req)
+	}
+	if string(b.pack) != "PACKdata" {
+		t.Errorf("got pack %q", b.pack)
+	}
+	got, err := io.ReadAll(gitprotocolio.NewSideBandReader(w.Body, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "000eunpack ok\n0000"; string(got) != want {
+		t.Errorf("got report-status %q, want %q", got, want)
+	}
+}
+
+func TestUploadPackHandlerPhaseTimeouts(t *testing.T) {
+	// The client stalls in the middle of the request.
+	stalled, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(testutil.Encode([]*gitprotocolio.ProtocolV1UploadPackRequestChunk{{WantObjectID: oidA}}))
+	r := httptest.NewRequest("POST", "/"+uploadPackService, stalled)
+	r.Header.Set("Content-Type", "application/x-"+uploadPackService+"-request")
+	w := httptest.NewRecorder()
+	h := &UploadPackHandler{Backend: &fakeBackend{}, PhaseTimeouts: gitprotocolio.PhaseTimeouts{Negotiation: 20 * time.Millisecond}}
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "negotiation phase exceeded its deadline") {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+}
@@ -16,8 +16,10 @@ package gitprotocolio
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"iter"
 	"strconv"
 	"strings"
 )
@@ -34,6 +36,26 @@ const (
 	infoRefsResponseStateEnd
 )
 
+func (s infoRefsResponseState) String() string {
+	switch s {
+	case infoRefsResponseStateScanServiceHeader:
+		return "ScanServiceHeader"
+	case infoRefsResponseStateScanServiceHeaderFlush:
+		return "ScanServiceHeaderFlush"
+	case infoRefsResponseStateScanOptionalProtocolVersion:
+		return "ScanOptionalProtocolVersion"
+	case infoRefsResponseStateScanCapabilities:
+		return "ScanCapabilities"
+	case infoRefsResponseStateScanRefs:
+		return "ScanRefs"
+	case infoRefsResponseStateScanProtocolV2Capabilities:
+		return "ScanProtocolV2Capabilities"
+	case infoRefsResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
 // InfoRefsResponseChunk is a chunk of an /info/refs response.
 type InfoRefsResponseChunk struct {
 	ServiceHeader      string
@@ -56,8 +78,8 @@ func (c *InfoRefsResponseChunk) EncodeToPktLine() []byte {
 	if c.ProtocolVersion != 0 {
 		return BytesPacket([]byte(fmt.Sprintf("version %d\n", c.ProtocolVersion))).EncodeToPktLine()
 	}
-	if len(c.Capabilities) > 0 && c.ObjectID != "" && c.Ref != "" {
-		// V1 packet.
+	if c.Capabilities != nil && c.ObjectID != "" && c.Ref != "" {
+		// V1 packet. The first ref has the NUL even without capabilities.
 		return BytesPacket([]byte(fmt.Sprintf("%s %s\000%s\n", c.ObjectID, c.Ref, strings.Join(c.Capabilities, " ")))).EncodeToPktLine()
 	}
 	if len(c.Capabilities) == 1 {
@@ -73,6 +95,136 @@ func (c *InfoRefsResponseChunk) EncodeToPktLine() []byte {
 	panic("impossible chunk")
 }
 
+// IsPeeled returns true if the chunk is the peeled line of an annotated tag,
+// "<oid> <ref>^{}", where ObjectID is the object the tag points to.
+func (c *InfoRefsResponseChunk) IsPeeled() bool {
+	return c.Ref != "capabilities^{}" && strings.HasSuffix(c.Ref, "^{}")
+}
+
+// RefName returns the ref name without the peeled suffix "^{}", or "" for the
+// "capabilities^{}" line of an empty repository.
+func (c *InfoRefsResponseChunk) RefName() string {
+	if c.Ref == "capabilities^{}" {
+		return ""
+	}
+	return strings.TrimSuffix(c.Ref, "^{}")
+}
+
+// SymrefsFromCapabilities returns the symbolic refs in the "symref=HEAD:<ref>"
+// capabilities, mapping the symbolic ref names to their targets.
+func SymrefsFromCapabilities(caps []string) map[string]string {
+	ret := map[string]string{}
+	for _, c := range caps {
+		if !strings.HasPrefix(c, "symref=") {
+			continue
+		}
+		ss := strings.SplitN(strings.TrimPrefix(c, "symref="), ":", 2)
+		if len(ss) == 2 {
+			ret[ss[0]] = ss[1]
+		}
+	}
+	return ret
+}
+
+// AgentFromCapabilities returns the value of the "agent" capability, or "" if
+// there's none.
+func AgentFromCapabilities(caps []string) string {
+	for _, c := range caps {
+		if strings.HasPrefix(c, "agent=") {
+			return strings.TrimPrefix(c, "agent=")
+		}
+	}
+	return ""
+}
+
+// kind returns the name of the chunk type for the errors, or "" for an
+// impossible chunk.
+func (c *InfoRefsResponseChunk) kind() string {
+	switch {
+	case c.ServiceHeader != "":
+		return "the service header"
+	case c.ServiceHeaderFlush:
+		return "the flush after the service header"
+	case c.ProtocolVersion != 0:
+		return "the version"
+	case c.Capabilities != nil && c.ObjectID != "" && c.Ref != "":
+		return "a ref with capabilities"
+	case len(c.Capabilities) == 1:
+		return "a capability"
+	case c.ObjectID != "" && c.Ref != "":
+		return "a ref"
+	case c.EndOfRequest:
+		return "the end of the advertisement"
+	}
+	return ""
+}
+
+// InfoRefsResponseEncoder writes a ref or capability advertisement chunk by
+// chunk, in the order InfoRefsResponse reads.
+type InfoRefsResponseEncoder struct {
+	w     chunkWriter
+	state infoRefsResponseState
+}
+
+// NewInfoRefsResponseEncoder returns a new InfoRefsResponseEncoder that writes
+// to w.
+func NewInfoRefsResponseEncoder(w io.Writer) *InfoRefsResponseEncoder {
+	return &InfoRefsResponseEncoder{w: chunkWriter{w: w}}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ServerToClient
+// as the direction. See TraceFunc.
+func (e *InfoRefsResponseEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ServerToClient, f)
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one. The first ref of protocol v0/v1 has
+// the capabilities, and a protocol v2 advertisement has a capability per chunk
+// and no ref.
+func (e *InfoRefsResponseEncoder) WriteChunk(c *InfoRefsResponseChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	var ok bool
+	var next infoRefsResponseState
+	kind := c.kind()
+	switch kind {
+	case "the service header":
+		ok = e.state == infoRefsResponseStateScanServiceHeader
+		next = infoRefsResponseStateScanServiceHeaderFlush
+	case "the flush after the service header":
+		ok = e.state == infoRefsResponseStateScanServiceHeaderFlush
+		next = infoRefsResponseStateScanOptionalProtocolVersion
+	case "the version":
+		ok = e.state == infoRefsResponseStateScanServiceHeader || e.state == infoRefsResponseStateScanOptionalProtocolVersion
+		next = infoRefsResponseStateScanCapabilities
+		if c.ProtocolVersion == 2 {
+			next = infoRefsResponseStateScanProtocolV2Capabilities
+		}
+	case "a ref with capabilities":
+		ok = e.state == infoRefsResponseStateScanServiceHeader || e.state == infoRefsResponseStateScanOptionalProtocolVersion || e.state == infoRefsResponseStateScanCapabilities
+		next = infoRefsResponseStateScanRefs
+	case "a capability":
+		ok = e.state == infoRefsResponseStateScanProtocolV2Capabilities
+		next = infoRefsResponseStateScanProtocolV2Capabilities
+	case "a ref":
+		ok = e.state == infoRefsResponseStateScanRefs
+		next = infoRefsResponseStateScanRefs
+	case "the end of the advertisement":
+		ok = e.state != infoRefsResponseStateScanServiceHeaderFlush && e.state != infoRefsResponseStateEnd
+		next = infoRefsResponseStateEnd
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	if err := e.w.write(kind, c, c.EncodeToPktLine()); err != nil {
+		return err
+	}
+	e.state = next
+	return nil
+}
+
 // InfoRefsResponse provides an interface for reading an /info/refs response.
 // The usage is same as bufio.Scanner.
 type InfoRefsResponse struct {
@@ -80,6 +232,7 @@ type InfoRefsResponse struct {
 	state   infoRefsResponseState
 	err     error
 	curr    *InfoRefsResponseChunk
+	format  ObjectFormat
 }
 
 // NewInfoRefsResponse returns a new InfoRefsResponse to read from rd.
@@ -98,11 +251,51 @@ func (r *InfoRefsResponse) Chunk() *InfoRefsResponseChunk {
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *InfoRefsResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *InfoRefsResponse) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *InfoRefsResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *InfoRefsResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *InfoRefsResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
 // Scan advances the scanner to the next chunk. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After Scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *InfoRefsResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "InfoRefsResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *InfoRefsResponse) scan() bool {
 	if r.err != nil || r.state == infoRefsResponseStateEnd {
 		return false
 	}
@@ -116,17 +309,13 @@ transition:
 	switch r.state {
 	case infoRefsResponseStateScanServiceHeader:
 		bp, ok := pkt.(BytesPacket)
-		if !ok {
-			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
-			return false
-		}
-		if bytes.HasPrefix(bp, []byte("version ")) {
+		if !ok || !bytes.HasPrefix(bp, []byte("# service=")) {
+			// The service header exists only in the smart HTTP
+			// protocol. Native transports (git://, ssh) start with
+			// the protocol version or the refs.
 			r.state = infoRefsResponseStateScanOptionalProtocolVersion
 			goto transition
 		}
-		if !bytes.HasPrefix(bp, []byte("# service=")) {
-			r.err = SyntaxError(fmt.Sprintf("expect the service header, but got: %v", pkt))
-		}
 		r.state = infoRefsResponseStateScanServiceHeaderFlush
 		r.curr = &InfoRefsResponseChunk{
 			ServiceHeader: strings.TrimPrefix(strings.TrimSuffix(string(bp), "\n"), "# service="),
@@ -157,7 +346,9 @@ transition:
 		if ver == 2 {
 			r.state = infoRefsResponseStateScanProtocolV2Capabilities
 		} else {
-			r.state = infoRefsResponseStateScanRefs
+			// Protocol v1 is v0 with the version line. The first ref
+			// has the capabilities.
+			r.state = infoRefsResponseStateScanCapabilities
 		}
 		r.curr = &InfoRefsResponseChunk{
 			ProtocolVersion: ver,
@@ -187,6 +378,10 @@ transition:
 				r.err = SyntaxError("cannot split into two: " + string(zss[0]))
 				return false
 			}
+			if err := r.format.check(ss[0]); err != nil {
+				r.err = err
+				return false
+			}
 			r.state = infoRefsResponseStateScanRefs
 			r.curr = &InfoRefsResponseChunk{
 				Capabilities: caps,
@@ -212,6 +407,10 @@ transition:
 				r.err = SyntaxError("cannot split into two: " + string(p))
 				return false
 			}
+			if err := r.format.check(ss[0]); err != nil {
+				r.err = err
+				return false
+			}
 			r.curr = &InfoRefsResponseChunk{
 				ObjectID: ss[0],
 				Ref:      strings.TrimSuffix(ss[1], "\n"),
@@ -241,3 +440,15 @@ transition:
 	}
 	panic("impossible state")
 }
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *InfoRefsResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *InfoRefsResponse) Chunks() iter.Seq2[*InfoRefsResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
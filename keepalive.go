@@ -0,0 +1,138 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// KeepalivePkt is the keepalive packet, an empty packet of the sideband main
+// stream. Git's upload-pack and receive-pack send it while they're busy, such
+// as counting objects, so that the connection doesn't time out.
+const KeepalivePkt = "0005\x01"
+
+// isKeepalive returns true if the payload is an empty sideband packet of the
+// main or the progress stream. Git sends the former and ignores both.
+func isKeepalive(bp []byte) bool {
+	return len(bp) == 1 && (bp[0] == 1 || bp[0] == 2)
+}
+
+// KeepaliveWriter writes KeepalivePkt to the underlying writer when nothing is
+// written for an interval, and flushes it. Use it for a sideband stream while
+// the backend is busy before the pack starts.
+//
+// It follows the packet boundaries of the written bytes, so a keepalive never
+// splits a packet. After a raw "PACK" header, there's no keepalive.
+type KeepaliveWriter struct {
+	w        io.Writer
+	flush    func() error
+	interval time.Duration
+
+	m      sync.Mutex
+	framer packetFramer
+	last   time.Time
+	err    error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewKeepaliveWriter returns a new KeepaliveWriter that writes to w. If w has a
+// Flush method, it's called after every keepalive. If interval is zero or
+// negative, the keepalives are disabled as with uploadpack.keepAlive=0, and
+// the bytes are written through.
+func NewKeepaliveWriter(w io.Writer, interval time.Duration) *KeepaliveWriter {
+	kw := &KeepaliveWriter{
+		w:        w,
+		flush:    flushFunc(w),
+		interval: interval,
+		last:     time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(kw.done)
+		return kw
+	}
+	go kw.run()
+	return kw
+}
+
+func (w *KeepaliveWriter) run() {
+	defer close(w.done)
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-t.C:
+			w.m.Lock()
+			if w.err == nil && w.atBoundary() && now.Sub(w.last) >= w.interval {
+				if _, err := io.WriteString(w.w, KeepalivePkt); err != nil {
+					w.err = err
+				} else {
+					w.err = w.flush()
+				}
+				w.last = now
+			}
+			w.m.Unlock()
+		}
+	}
+}
+
+func (w *KeepaliveWriter) atBoundary() bool {
+	return !w.framer.raw && w.framer.remaining == 0 && len(w.framer.hdr) == 0
+}
+
+// Write writes p to the underlying writer. An error of a keepalive is returned
+// by the next Write.
+func (w *KeepaliveWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.w.Write(p)
+	for q := p[:n]; len(q) != 0; {
+		i, _, ferr := w.framer.next(q)
+		if ferr != nil {
+			// Not pkt-lines. Stop the keepalives.
+			w.framer.raw = true
+			break
+		}
+		q = q[i:]
+	}
+	w.last = time.Now()
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Close stops the keepalives. It doesn't close the underlying writer.
+func (w *KeepaliveWriter) Close() error {
+	w.m.Lock()
+	select {
+	case <-w.stop:
+	default:
+		close(w.stop)
+	}
+	w.m.Unlock()
+	<-w.done
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepaliveWriter(t *testing.T) {
+	pkt := string(SideBandReportPacket("counting\n").EncodeToPktLine())
+	for _, tc := range []struct {
+		interval   time.Duration
+		keepalives bool
+	}{
+		{time.Millisecond, true},
+		{0, false},
+		{-time.Second, false},
+	} {
+		var buf lockedBuffer
+		w := NewKeepaliveWriter(&buf, tc.interval)
+		if _, err := w.Write([]byte(pkt)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got := buf.String()
+		if got := len(got) > len(pkt); got != tc.keepalives {
+			t.Errorf("interval %v: got keepalives %v, want %v", tc.interval, got, tc.keepalives)
+		}
+		if got[:len(pkt)] != pkt {
+			t.Errorf("interval %v: got %q", tc.interval, got)
+		}
+	}
+}
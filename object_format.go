@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ObjectFormat is the hash algorithm of the object IDs of a repository, as in
+// the "object-format" capability.
+type ObjectFormat string
+
+// Object formats.
+const (
+	ObjectFormatSHA1   ObjectFormat = "sha1"
+	ObjectFormatSHA256 ObjectFormat = "sha256"
+)
+
+// ObjectFormatFromCapabilities returns the object format in the capabilities.
+// Without the "object-format" capability, it's SHA-1.
+func ObjectFormatFromCapabilities(caps []string) ObjectFormat {
+	for _, c := range caps {
+		if strings.HasPrefix(c, "object-format=") {
+			return ObjectFormat(strings.TrimPrefix(c, "object-format="))
+		}
+	}
+	return ObjectFormatSHA1
+}
+
+// HashAlgo returns the registered hash algorithm of the format, or nil if
+// unknown.
+func (f ObjectFormat) HashAlgo() *HashAlgo {
+	return LookupHashAlgo(f)
+}
+
+// HexSize returns the length of a hexadecimal object ID, or 0 if the format is
+// unknown.
+func (f ObjectFormat) HexSize() int {
+	if a := f.HashAlgo(); a != nil {
+		return a.HexSize
+	}
+	return 0
+}
+
+// ZeroObjectID returns the all-zero object ID.
+func (f ObjectFormat) ZeroObjectID() string {
+	return strings.Repeat("0", f.HexSize())
+}
+
+// ValidObjectID returns true if s is a lowercase hexadecimal object ID of the
+// format.
+func (f ObjectFormat) ValidObjectID(s string) bool {
+	a := f.HashAlgo()
+	return a != nil && a.ValidObjectID(s)
+}
+
+// check returns a SyntaxError if oid is not valid. An empty format accepts
+// anything.
+func (f ObjectFormat) check(oid string) error {
+	if f == "" || f.ValidObjectID(oid) {
+		return nil
+	}
+	return SyntaxError(fmt.Sprintf("invalid %s object ID: %q", f, oid))
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestObjectFormat(t *testing.T) {
+	sha256OID := strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		caps     []string
+		want     ObjectFormat
+		hexSize  int
+		valid    string
+		invalids []string
+	}{
+		{nil, ObjectFormatSHA1, 40, oidA, []string{sha256OID, strings.ToUpper(strings.Repeat("a", 40)), strings.Repeat("g", 40), ""}},
+		{[]string{"ofs-delta", "object-format=sha256"}, ObjectFormatSHA256, 64, sha256OID, []string{oidA}},
+	} {
+		f := ObjectFormatFromCapabilities(tc.caps)
+		if f != tc.want || f.HexSize() != tc.hexSize || len(f.ZeroObjectID()) != tc.hexSize {
+			t.Errorf("%q: got %s (%d, %q)", tc.caps, f, f.HexSize(), f.ZeroObjectID())
+		}
+		if !f.ValidObjectID(tc.valid) || !f.ValidObjectID(f.ZeroObjectID()) {
+			t.Errorf("%s: %q is not valid", f, tc.valid)
+		}
+		for _, oid := range tc.invalids {
+			if f.ValidObjectID(oid) {
+				t.Errorf("%s: %q is valid", f, oid)
+			}
+		}
+	}
+
+	unknown := ObjectFormatFromCapabilities([]string{"object-format=md5"})
+	if unknown.HexSize() != 0 || unknown.ValidObjectID(oidA) {
+		t.Errorf("%s: got hex size %d", unknown, unknown.HexSize())
+	}
+}
+
+func TestSetObjectFormat(t *testing.T) {
+	sha256OID := strings.Repeat("a", 64)
+	parsers := map[string]func(f ObjectFormat, in string) error{
+		"info/refs": func(f ObjectFormat, in string) error {
+			r := NewInfoRefsResponse(strings.NewReader(in))
+			r.SetObjectFormat(f)
+			for r.Scan() {
+			}
+			return r.Err()
+		},
+		"upload-pack request": func(f ObjectFormat, in string) error {
+			r := NewProtocolV1UploadPackRequest(strings.NewReader(in))
+			r.SetObjectFormat(f)
+			for r.Scan() {
+			}
+			return r.Err()
+		},
+		"upload-pack response": func(f ObjectFormat, in string) error {
+			r := NewProtocolV1UploadPackResponse(strings.NewReader(in))
+			r.SetObjectFormat(f)
+			for r.Scan() {
+			}
+			return r.Err()
+		},
+		"receive-pack request": func(f ObjectFormat, in string) error {
+			r := NewProtocolV1ReceivePackRequest(strings.NewReader(in))
+			r.SetObjectFormat(f)
+			for r.Scan() {
+			}
+			return r.Err()
+		},
+	}
+	for _, tc := range []struct {
+		parser string
+		input  func(oid string) string
+	}{
+		{"info/refs", func(oid string) string { return pktLines(oid+" HEAD\x00ofs-delta\n", "0000") }},
+		{"upload-pack request", func(oid string) string { return pktLines("want "+oid+"\n", "0000", "done\n") }},
+		{"upload-pack response", func(oid string) string { return pktLines("ACK "+oid+"\n", "\x01PACK", "0000") }},
+		{"receive-pack request", func(oid string) string {
+			return pktLines(oid+" "+oid+" refs/heads/main\x00report-status\n", "0000")
+		}},
+	} {
+		scan := parsers[tc.parser]
+		if err := scan(ObjectFormatSHA256, tc.input(sha256OID)); err != nil {
+			t.Errorf("%s: %v", tc.parser, err)
+		}
+		if err := scan(ObjectFormatSHA256, tc.input(oidA)); err == nil {
+			t.Errorf("%s: SHA-1 object ID accepted in SHA-256", tc.parser)
+		}
+		if err := scan(ObjectFormatSHA1, tc.input(sha256OID)); err == nil {
+			t.Errorf("%s: SHA-256 object ID accepted in SHA-1", tc.parser)
+		}
+		// By default, object IDs are not checked.
+		if err := scan("", tc.input(sha256OID)); err != nil {
+			t.Errorf("%s: %v", tc.parser, err)
+		}
+	}
+}
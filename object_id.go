@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultShortObjectIDSize is the length of an abbreviated object ID by
+// default, same as Git's core.abbrev minimum.
+const DefaultShortObjectIDSize = 7
+
+// ObjectID is a lowercase hexadecimal object ID. The chunks keep object IDs as
+// strings, such as ShallowObjectID. ParseObjectID converts them with the
+// validation, and the zero value "" is no object.
+type ObjectID string
+
+// ParseObjectID validates s as an object ID of the format. If the format is
+// empty, it's inferred from the length of s.
+func ParseObjectID(s string, f ObjectFormat) (ObjectID, error) {
+	var a *HashAlgo
+	if f == "" {
+		a = HashAlgoByHexSize(len(s))
+	} else {
+		a = f.HashAlgo()
+		if a == nil {
+			return "", SyntaxError(fmt.Sprintf("unknown object format: %s", f))
+		}
+	}
+	if a == nil || !a.ValidObjectID(s) {
+		return "", SyntaxError(fmt.Sprintf("invalid object ID: %q", s))
+	}
+	return ObjectID(s), nil
+}
+
+// String returns the object ID as is.
+func (id ObjectID) String() string {
+	return string(id)
+}
+
+// Format returns the object format inferred from the length, or "" if unknown.
+func (id ObjectID) Format() ObjectFormat {
+	if a := HashAlgoByHexSize(len(id)); a != nil {
+		return a.Name
+	}
+	return ""
+}
+
+// IsZero returns true for the all-zero object ID, which means a missing object
+// such as the old value of a created ref. The empty ObjectID is not zero.
+func (id ObjectID) IsZero() bool {
+	return id != "" && strings.Trim(string(id), "0") == ""
+}
+
+// Short returns the first n hexadecimal digits. If n is not positive,
+// DefaultShortObjectIDSize is used. Unlike Git, it doesn't extend the prefix
+// to make it unique in a repository.
+func (id ObjectID) Short(n int) string {
+	if n <= 0 {
+		n = DefaultShortObjectIDSize
+	}
+	if len(id) > n {
+		return string(id[:n])
+	}
+	return string(id)
+}
+
+// HasPrefix returns true if the abbreviated object ID prefix matches the
+// object ID. prefix can be in uppercase.
+func (id ObjectID) HasPrefix(prefix string) bool {
+	return strings.HasPrefix(string(id), strings.ToLower(prefix))
+}
+
+// Compare returns -1, 0, or +1 in the same order as the binary object IDs.
+func (id ObjectID) Compare(other ObjectID) int {
+	return strings.Compare(string(id), string(other))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (id ObjectID) MarshalText() ([]byte, error) {
+	return []byte(id), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. The text must be a valid
+// object ID of a registered format or empty.
+func (id *ObjectID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*id = ""
+		return nil
+	}
+	v, err := ParseObjectID(string(text), "")
+	if err != nil {
+		return err
+	}
+	*id = v
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseObjectID(t *testing.T) {
+	sha256OID := strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		s       string
+		f       ObjectFormat
+		want    ObjectFormat
+		wantErr bool
+	}{
+		{oidA, "", ObjectFormatSHA1, false},
+		{oidA, ObjectFormatSHA1, ObjectFormatSHA1, false},
+		{sha256OID, "", ObjectFormatSHA256, false},
+		{sha256OID, ObjectFormatSHA256, ObjectFormatSHA256, false},
+		{oidA, ObjectFormatSHA256, "", true},
+		{sha256OID, ObjectFormatSHA1, "", true},
+		{oidA, "md5", "", true},
+		{"", "", "", true},
+		{"1234567", "", "", true},
+		{strings.ToUpper(strings.Repeat("a", 40)), "", "", true},
+		{strings.Repeat("g", 40), "", "", true},
+	} {
+		id, err := ParseObjectID(tc.s, tc.f)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q, %q: got %v, want error %v", tc.s, tc.f, err, tc.wantErr)
+			continue
+		}
+		if err == nil && (id.String() != tc.s || id.Format() != tc.want) {
+			t.Errorf("%q, %q: got %q of %q", tc.s, tc.f, id, id.Format())
+		}
+	}
+}
+
+func TestObjectID(t *testing.T) {
+	id := ObjectID("0123456789abcdef0123456789abcdef01234567")
+	if got := id.Short(0); got != "0123456" {
+		t.Errorf("got %q", got)
+	}
+	if got := id.Short(12); got != "0123456789ab" {
+		t.Errorf("got %q", got)
+	}
+	if got := ObjectID("abc").Short(0); got != "abc" {
+		t.Errorf("got %q", got)
+	}
+	if !id.HasPrefix("0123456789AB") || id.HasPrefix("1") {
+		t.Error("unexpected HasPrefix")
+	}
+	for _, tc := range []struct {
+		id   ObjectID
+		want bool
+	}{
+		{ObjectID(ObjectFormatSHA1.ZeroObjectID()), true},
+		{ObjectID(ObjectFormatSHA256.ZeroObjectID()), true},
+		{"", false},
+		{id, false},
+	} {
+		if got := tc.id.IsZero(); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.id, got, tc.want)
+		}
+	}
+	if id.Compare(ObjectID(oidA)) != -1 || ObjectID(oidB).Compare(ObjectID(oidA)) != 1 || id.Compare(id) != 0 {
+		t.Error("unexpected Compare")
+	}
+	if got := ObjectID("abc").Format(); got != "" {
+		t.Errorf("got %q, want unknown", got)
+	}
+}
+
+func TestObjectIDText(t *testing.T) {
+	type ref struct {
+		Old ObjectID `json:"old"`
+		New ObjectID `json:"new"`
+	}
+	b, err := json.Marshal(ref{New: ObjectID(oidA)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"old":"","new":"` + oidA + `"}`; string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+	var got ref
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Old != "" || got.New != ObjectID(oidA) {
+		t.Errorf("got %+v", got)
+	}
+	for _, s := range []string{`{"new":"xyz"}`, `{"new":"` + strings.ToUpper(oidB[:39]) + `A"}`} {
+		if err := json.Unmarshal([]byte(s), &got); err == nil {
+			t.Errorf("%s: got %+v, want an error", s, got)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+)
+
+// ObjectInfoRequest is the arguments of a protocol v2 object-info command.
+type ObjectInfoRequest struct {
+	// Size is true if the client asks the object sizes.
+	Size bool
+	// ObjectIDs are the objects asked.
+	ObjectIDs []string
+}
+
+// ParseObjectInfoArguments parses the arguments of an object-info command
+// (ProtocolV2RequestChunk.Argument).
+func ParseObjectInfoArguments(args []string) (*ObjectInfoRequest, error) {
+	req := &ObjectInfoRequest{}
+	for _, arg := range args {
+		arg = strings.TrimSuffix(arg, "\n")
+		switch {
+		case arg == "size":
+			req.Size = true
+		case strings.HasPrefix(arg, "oid "):
+			req.ObjectIDs = append(req.ObjectIDs, strings.TrimPrefix(arg, "oid "))
+		default:
+			return nil, ErrorPacket(fmt.Sprintf("object-info: unexpected line: '%s'", arg))
+		}
+	}
+	return req, nil
+}
+
+// Arguments returns the argument lines of the request.
+func (r *ObjectInfoRequest) Arguments() []string {
+	var ret []string
+	if r.Size {
+		ret = append(ret, "size")
+	}
+	for _, oid := range r.ObjectIDs {
+		ret = append(ret, "oid "+oid)
+	}
+	return ret
+}
+
+// Chunks returns the whole request with the capabilities, such as
+// "object-format=sha256", from the command line to the flush.
+func (r *ObjectInfoRequest) Chunks(capabilities []string) []*ProtocolV2RequestChunk {
+	ret := []*ProtocolV2RequestChunk{{Command: "object-info"}}
+	for _, c := range capabilities {
+		ret = append(ret, &ProtocolV2RequestChunk{Capability: c})
+	}
+	ret = append(ret, &ProtocolV2RequestChunk{EndCapability: true})
+	for _, arg := range r.Arguments() {
+		ret = append(ret, &ProtocolV2RequestChunk{Argument: []byte(arg + "\n")})
+	}
+	return append(ret, &ProtocolV2RequestChunk{EndArgument: true})
+}
+
+// EncodeObjectInfoResponse returns the response of an object-info command.
+// sizeOf returns the size of an object, or false if the object doesn't exist.
+//
+// The response starts with the attribute line ("size") if any attribute is
+// asked, then has one "<oid> <size>" line per object, and ends with a flush. As
+// Git does, a missing object has an empty size, and the lines don't end with a
+// newline.
+func EncodeObjectInfoResponse(req *ObjectInfoRequest, sizeOf func(objectID string) (uint64, bool)) []*ProtocolV2ResponseChunk {
+	var ret []*ProtocolV2ResponseChunk
+	if req.Size {
+		ret = append(ret, &ProtocolV2ResponseChunk{Response: []byte("size")})
+	}
+	for _, oid := range req.ObjectIDs {
+		line := oid
+		if req.Size {
+			if sz, ok := sizeOf(oid); ok {
+				line += fmt.Sprintf(" %d", sz)
+			} else {
+				line += " "
+			}
+		}
+		ret = append(ret, &ProtocolV2ResponseChunk{Response: []byte(line)})
+	}
+	return append(ret, &ProtocolV2ResponseChunk{EndResponse: true})
+}
+
+type objectInfoResponseState int
+
+const (
+	objectInfoResponseStateBegin objectInfoResponseState = iota
+	objectInfoResponseStateScanObjects
+	objectInfoResponseStateEnd
+)
+
+func (s objectInfoResponseState) String() string {
+	switch s {
+	case objectInfoResponseStateBegin:
+		return "Begin"
+	case objectInfoResponseStateScanObjects:
+		return "ScanObjects"
+	case objectInfoResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
+// ObjectInfoResponseChunk is a chunk of a protocol v2 object-info response.
+type ObjectInfoResponseChunk struct {
+	// Attributes is the first line of a response, the attributes of the
+	// object lines, such as "size".
+	Attributes []string
+	ObjectID   string
+	// Size is the size of the object. HasSize is true if the line has the
+	// size attribute.
+	Size    uint64
+	HasSize bool
+	// Missing is true if the size is empty, which means the object doesn't
+	// exist.
+	Missing     bool
+	EndResponse bool
+}
+
+// EncodeToPktLine serializes the chunk. As Git does, the line doesn't end with
+// a newline.
+func (c *ObjectInfoResponseChunk) EncodeToPktLine() []byte {
+	if c.Attributes != nil {
+		return BytesPacket([]byte(strings.Join(c.Attributes, " "))).EncodeToPktLine()
+	}
+	if c.ObjectID != "" {
+		line := c.ObjectID
+		if c.Missing {
+			line += " "
+		} else if c.HasSize {
+			line += " " + strconv.FormatUint(c.Size, 10)
+		}
+		return BytesPacket([]byte(line)).EncodeToPktLine()
+	}
+	if c.EndResponse {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// ObjectInfoResponse provides an interface for reading a protocol v2
+// object-info response.
+//
+// The input can have multiple responses back to back, as in a stateful
+// connection. Each response ends with an EndResponse chunk, after which
+// ResponseComplete returns true and Scan continues to the next response.
+type ObjectInfoResponse struct {
+	scanner *PacketScanner
+	state   objectInfoResponseState
+	err     error
+	curr    *ObjectInfoResponseChunk
+	attrs   []string
+	format  ObjectFormat
+}
+
+// NewObjectInfoResponse returns a new ObjectInfoResponse to read from rd.
+func NewObjectInfoResponse(rd io.Reader) *ObjectInfoResponse {
+	return &ObjectInfoResponse{scanner: NewPacketScanner(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ObjectInfoResponse.
+func (r *ObjectInfoResponse) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent chunk generated by a call to Scan.
+func (r *ObjectInfoResponse) Chunk() *ObjectInfoResponseChunk {
+	return r.curr
+}
+
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ObjectInfoResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *ObjectInfoResponse) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ObjectInfoResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ObjectInfoResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *ObjectInfoResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
+// ResponseComplete returns true if the most recent chunk ended a response. More
+// responses may follow.
+func (r *ObjectInfoResponse) ResponseComplete() bool {
+	return r.state == objectInfoResponseStateBegin && r.curr != nil && r.curr.EndResponse
+}
+
+// Scan advances the scanner to the next packet. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *ObjectInfoResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ObjectInfoResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *ObjectInfoResponse) scan() bool {
+	if r.err != nil || r.state == objectInfoResponseStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != objectInfoResponseStateBegin {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+
+	switch p := r.scanner.Packet().(type) {
+	case FlushPacket:
+		r.state = objectInfoResponseStateBegin
+		r.attrs = nil
+		r.curr = &ObjectInfoResponseChunk{
+			EndResponse: true,
+		}
+		return true
+	case BytesPacket:
+		line := strings.TrimSuffix(string(p), "\n")
+		if r.state == objectInfoResponseStateBegin {
+			r.state = objectInfoResponseStateScanObjects
+			// Without any attribute, the attribute line is omitted.
+			if oid, _, _ := strings.Cut(line, " "); !isHexObjectID(oid) {
+				r.attrs = strings.Fields(line)
+				r.curr = &ObjectInfoResponseChunk{
+					Attributes: r.attrs,
+				}
+				return true
+			}
+		}
+		c, err := r.parseLine(line)
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.curr = c
+		return true
+	default:
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+		return false
+	}
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ObjectInfoResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ObjectInfoResponse) Chunks() iter.Seq2[*ObjectInfoResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+func (r *ObjectInfoResponse) parseLine(line string) (*ObjectInfoResponseChunk, error) {
+	ss := strings.Split(line, " ")
+	if len(ss) != 1+len(r.attrs) {
+		return nil, SyntaxError(fmt.Sprintf("cannot parse the object-info line: %q", line))
+	}
+	if err := r.format.check(ss[0]); err != nil {
+		return nil, err
+	}
+	c := &ObjectInfoResponseChunk{ObjectID: ss[0]}
+	for i, attr := range r.attrs {
+		if attr != "size" {
+			continue
+		}
+		if ss[i+1] == "" {
+			c.Missing = true
+			continue
+		}
+		sz, err := strconv.ParseUint(ss[i+1], 10, 64)
+		if err != nil {
+			return nil, SyntaxError(fmt.Sprintf("cannot parse the object size: %q", line))
+		}
+		c.Size = sz
+		c.HasSize = true
+	}
+	return c, nil
+}
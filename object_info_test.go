@@ -0,0 +1,123 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	oidA = "1111111111111111111111111111111111111111"
+	oidB = "2222222222222222222222222222222222222222"
+)
+
+func TestParseObjectInfoArguments(t *testing.T) {
+	args := []string{"size\n", "oid " + oidA + "\n", "oid " + oidB + "\n"}
+	req, err := ParseObjectInfoArguments(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ObjectInfoRequest{Size: true, ObjectIDs: []string{oidA, oidB}}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+	if got := req.Arguments(); !reflect.DeepEqual(got, []string{"size", "oid " + oidA, "oid " + oidB}) {
+		t.Errorf("got arguments %q", got)
+	}
+
+	var b bytes.Buffer
+	for _, c := range req.Chunks([]string{"object-format=sha1"}) {
+		b.Write(c.EncodeToPktLine())
+	}
+	wantReq := pktLines("command=object-info\n", "object-format=sha1\n") + DelimPkt + pktLines("size\n", "oid "+oidA+"\n", "oid "+oidB+"\n", "0000")
+	if b.String() != wantReq {
+		t.Errorf("got %q, want %q", b.String(), wantReq)
+	}
+
+	if _, err := ParseObjectInfoArguments([]string{"size\n", "type\n"}); err == nil {
+		t.Error("got no error for an unknown argument")
+	} else if _, ok := err.(ErrorPacket); !ok {
+		t.Errorf("got %T, want an ErrorPacket", err)
+	}
+}
+
+func TestObjectInfoResponse(t *testing.T) {
+	req := &ObjectInfoRequest{Size: true, ObjectIDs: []string{oidA, oidB}}
+	var b bytes.Buffer
+	for _, c := range EncodeObjectInfoResponse(req, func(oid string) (uint64, bool) {
+		return 42, oid == oidA
+	}) {
+		b.Write(c.EncodeToPktLine())
+	}
+	if want := pktLines("size", oidA+" 42", oidB+" ", "0000"); b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	r := NewObjectInfoResponse(bytes.NewReader(b.Bytes()))
+	var got []*ObjectInfoResponseChunk
+	var out bytes.Buffer
+	for r.Scan() {
+		got = append(got, r.Chunk())
+		out.Write(r.Chunk().EncodeToPktLine())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []*ObjectInfoResponseChunk{
+		{Attributes: []string{"size"}},
+		{ObjectID: oidA, Size: 42, HasSize: true},
+		{ObjectID: oidB, Missing: true},
+		{EndResponse: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if out.String() != b.String() {
+		t.Errorf("got %q, want %q", out.String(), b.String())
+	}
+}
+
+func TestObjectInfoResponseNoAttributes(t *testing.T) {
+	r := NewObjectInfoResponse(strings.NewReader(pktLines(oidA, "0000")))
+	if !r.Scan() {
+		t.Fatal(r.Err())
+	}
+	if want := (&ObjectInfoResponseChunk{ObjectID: oidA}); !reflect.DeepEqual(r.Chunk(), want) {
+		t.Errorf("got %+v, want %+v", r.Chunk(), want)
+	}
+}
+
+func TestObjectInfoResponseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+	}{
+		{"no flush", pktLines("size", oidA+" 42")},
+		{"bad size", pktLines("size", oidA+" big", "0000")},
+		{"missing size", pktLines("size", oidA, "0000")},
+		{"extra field", pktLines("size", oidA+" 1 2", "0000")},
+		{"delim", pktLines("size") + DelimPkt},
+	} {
+		r := NewObjectInfoResponse(strings.NewReader(tc.in))
+		for r.Scan() {
+		}
+		if r.Err() == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
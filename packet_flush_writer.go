@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"strconv"
+)
+
+// PacketFlushWriter is a WriteFlushCloser that follows the packet boundaries in
+// the written bytes and flushes the underlying transport at the end of every
+// flush, delim, and response-end packet.
+//
+// Buffering transports such as HTTP/2 streams hold the written bytes until the
+// frame is full. Without a flush, a peer waiting for the end of a section (e.g.
+// the acknowledgments of a protocol v2 fetch) waits for data that is already
+// written. Bytes after a raw "PACK" header are passed through and flushed only
+// by an explicit Flush.
+type PacketFlushWriter struct {
+	w     io.Writer
+	flush func() error
+
+	// FlushEveryPacket makes the writer flush after every packet, for
+	// streams where every packet matters to the peer, such as progress
+	// messages.
+	FlushEveryPacket bool
+
+	framer packetFramer
+}
+
+// NewPacketFlushWriter returns a new PacketFlushWriter that writes to w and
+// calls flush at the packet boundaries. If flush is nil and w has a Flush
+// method, that's used.
+func NewPacketFlushWriter(w io.Writer, flush func() error) *PacketFlushWriter {
+	if flush == nil {
+		flush = flushFunc(w)
+	}
+	return &PacketFlushWriter{w: w, flush: flush}
+}
+
+// flushFunc returns the Flush method of w, or a no-op if w has none.
+func flushFunc(w io.Writer) func() error {
+	if f, ok := w.(interface{ Flush() error }); ok {
+		return f.Flush
+	}
+	if f, ok := w.(interface{ Flush() }); ok {
+		return func() error { f.Flush(); return nil }
+	}
+	return func() error { return nil }
+}
+
+// Write writes p to the underlying writer, flushing it at the packet
+// boundaries within p.
+func (w *PacketFlushWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		i, size, err := w.framer.next(p)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(p[:i])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if size != 0 && !w.framer.raw && (w.framer.special || w.FlushEveryPacket) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+		p = p[i:]
+	}
+	return written, nil
+}
+
+// Flush flushes the underlying transport.
+func (w *PacketFlushWriter) Flush() error {
+	return w.flush()
+}
+
+// Close flushes the underlying transport. If the underlying writer is an
+// io.Closer, it's closed.
+func (w *PacketFlushWriter) Close() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// packetFramer follows the packet boundaries in a written byte stream. After a
+// raw "PACK" header, every write is treated as a packet.
+type packetFramer struct {
+	hdr       []byte
+	remaining int
+	size      int
+	// special is true if the last packet was a flush, delim, or
+	// response-end packet.
+	special bool
+	raw     bool
+}
+
+// next consumes p up to the end of the current packet. It returns the number
+// of bytes consumed, and the wire size of the packet if it ended, or zero.
+func (f *packetFramer) next(p []byte) (int, int, error) {
+	if f.raw {
+		f.special = false
+		return len(p), len(p), nil
+	}
+	i := 0
+	for i < len(p) {
+		if f.remaining > 0 {
+			n := len(p) - i
+			if n > f.remaining {
+				n = f.remaining
+			}
+			f.remaining -= n
+			i += n
+			if f.remaining == 0 {
+				return i, f.size, nil
+			}
+			continue
+		}
+		n := PacketLengthHeaderSize - len(f.hdr)
+		if n > len(p)-i {
+			n = len(p) - i
+		}
+		f.hdr = append(f.hdr, p[i:i+n]...)
+		i += n
+		if len(f.hdr) < PacketLengthHeaderSize {
+			continue
+		}
+		hdr := string(f.hdr)
+		f.hdr = f.hdr[:0]
+		f.special = false
+		if hdr == "PACK" {
+			f.raw = true
+			return i, PacketLengthHeaderSize, nil
+		}
+		sz, err := strconv.ParseUint(hdr, 16, 16)
+		if err != nil {
+			return i, 0, SyntaxError("cannot parse the packet length: " + hdr)
+		}
+		if sz < PacketLengthHeaderSize {
+			// flush, delim, or response-end packet.
+			f.special = true
+			return i, PacketLengthHeaderSize, nil
+		}
+		f.size = int(sz)
+		f.remaining = int(sz) - PacketLengthHeaderSize
+		if f.remaining == 0 {
+			return i, f.size, nil
+		}
+	}
+	return i, 0, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// flushRecorder records the number of bytes written at every flush.
+type flushRecorder struct {
+	bytes.Buffer
+	flushes []int
+	closed  bool
+}
+
+func (r *flushRecorder) Flush() error {
+	r.flushes = append(r.flushes, r.Len())
+	return nil
+}
+
+func (r *flushRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestPacketFlushWriter(t *testing.T) {
+	in := "0008abcd" + FlushPkt + "0006ab" + DelimPkt + "0004" + ResponseEndPkt + "PACKraw0000"
+	for _, tc := range []struct {
+		name       string
+		everyPkt   bool
+		wantFlush  []int
+		writeSizes int
+	}{
+		{"one write", false, []int{12, 22, 30}, len(in)},
+		{"byte by byte", false, []int{12, 22, 30}, 1},
+		{"every packet", true, []int{8, 12, 18, 22, 26, 30}, 5},
+	} {
+		rec := &flushRecorder{}
+		w := NewPacketFlushWriter(rec, nil)
+		w.FlushEveryPacket = tc.everyPkt
+		for i := 0; i < len(in); i += tc.writeSizes {
+			if _, err := w.Write([]byte(in[i:min(i+tc.writeSizes, len(in))])); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+		if rec.String() != in {
+			t.Errorf("%s: got %q, want %q", tc.name, rec.String(), in)
+		}
+		if !reflect.DeepEqual(rec.flushes, tc.wantFlush) {
+			t.Errorf("%s: got flushes at %v, want %v", tc.name, rec.flushes, tc.wantFlush)
+		}
+		if err := w.Close(); err != nil || !rec.closed {
+			t.Errorf("%s: Close: %v, closed %v", tc.name, err, rec.closed)
+		}
+	}
+}
+
+func TestPacketFlushWriterSyntaxError(t *testing.T) {
+	rec := &flushRecorder{}
+	w := NewPacketFlushWriter(rec, nil)
+	n, err := w.Write([]byte("0008abcdzzzz"))
+	if _, ok := err.(SyntaxError); !ok {
+		t.Errorf("got %v, want a SyntaxError", err)
+	}
+	if n != 8 {
+		t.Errorf("got %d bytes written, want 8", n)
+	}
+}
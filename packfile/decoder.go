@@ -0,0 +1,371 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package packfile
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/google/gitprotocolio"
+)
+
+// defaultCacheSize is the size of the delta base cache by default.
+const defaultCacheSize = 16 << 20
+
+// Object is a materialized object of a pack.
+type Object struct {
+	ObjectID string
+	// Type is the type of the object, not a delta type.
+	Type ObjectType
+	Data []byte
+	// Offset is the position of the object in the pack.
+	Offset int64
+}
+
+// Decoder resolves the deltas of a pack and materializes the objects.
+//
+// It reads the pack from an io.ReaderAt, such as an *os.File: the objects are
+// read in order, and a delta base that isn't in the cache is read again from
+// its offset. So the memory is bounded by CacheSize and the largest delta
+// chain, except for the ref-deltas whose bases come later in the pack, which
+// are held until their bases are found.
+type Decoder struct {
+	// CacheSize is the maximum total size of the delta bases kept in memory.
+	// If zero, 16MiB is used.
+	CacheSize int64
+	// ExternalBase returns the object of a ref-delta base not in the pack, as
+	// in a thin pack. If nil, such a delta is an error.
+	ExternalBase func(objectID string) (ObjectType, []byte, error)
+
+	ra   io.ReaderAt
+	algo *gitprotocolio.HashAlgo
+
+	offsets map[string]int64
+	cache   *baseCache
+	// pending is the ref-deltas waiting for their bases by the base object
+	// ID.
+	pending map[string][]*pendingDelta
+}
+
+type pendingDelta struct {
+	offset int64
+	delta  []byte
+}
+
+// NewDecoder returns a new Decoder to read the pack from ra. algo is the hash
+// algorithm of the object IDs. If nil, SHA-1 is used.
+func NewDecoder(ra io.ReaderAt, algo *gitprotocolio.HashAlgo) *Decoder {
+	if algo == nil {
+		algo = gitprotocolio.HashAlgoSHA1
+	}
+	return &Decoder{ra: ra, algo: algo}
+}
+
+// Decode reads the pack and calls fn for each object. The objects are passed
+// in the pack order, except that a ref-delta whose base comes later is passed
+// after the base. fn must not keep the Data after it returns. If fn returns an
+// error, Decode stops and returns it.
+func (d *Decoder) Decode(fn func(*Object) error) error {
+	size := d.CacheSize
+	if size == 0 {
+		size = defaultCacheSize
+	}
+	d.offsets = map[string]int64{}
+	d.cache = newBaseCache(size)
+	d.pending = map[string][]*pendingDelta{}
+
+	s := NewScanner(io.NewSectionReader(d.ra, 0, math.MaxInt64), d.algo)
+	s.keepData = true
+	for s.Scan() {
+		o := s.Object()
+		data := s.data.Bytes()
+		var obj *Object
+		switch o.Type {
+		case ObjectOfsDelta:
+			typ, base, err := d.resolve(o.BaseOffset)
+			if err != nil {
+				return err
+			}
+			patched, err := applyDelta(base, data)
+			if err != nil {
+				return fmt.Errorf("object at offset %d: %v", o.Offset, err)
+			}
+			obj = &Object{Type: typ, Data: patched, Offset: o.Offset}
+		case ObjectRefDelta:
+			off, ok := d.offsets[o.BaseObjectID]
+			if !ok {
+				d.pending[o.BaseObjectID] = append(d.pending[o.BaseObjectID], &pendingDelta{
+					offset: o.Offset,
+					delta:  append([]byte(nil), data...),
+				})
+				continue
+			}
+			typ, base, err := d.resolve(off)
+			if err != nil {
+				return err
+			}
+			patched, err := applyDelta(base, data)
+			if err != nil {
+				return fmt.Errorf("object at offset %d: %v", o.Offset, err)
+			}
+			obj = &Object{Type: typ, Data: patched, Offset: o.Offset}
+		default:
+			obj = &Object{Type: o.Type, Data: data, Offset: o.Offset}
+		}
+		if err := d.emit(obj, fn); err != nil {
+			return err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return d.resolveExternal(fn)
+}
+
+// emit computes the object ID, passes the object to fn, and then resolves the
+// ref-deltas waiting for it.
+func (d *Decoder) emit(obj *Object, fn func(*Object) error) error {
+	obj.ObjectID = d.objectID(obj.Type, obj.Data)
+	d.offsets[obj.ObjectID] = obj.Offset
+	d.cache.put(obj.Offset, obj.Type, obj.Data)
+	if err := fn(obj); err != nil {
+		return err
+	}
+	return d.resolvePending(obj.ObjectID, obj.Type, obj.Data, fn)
+}
+
+func (d *Decoder) resolvePending(oid string, typ ObjectType, base []byte, fn func(*Object) error) error {
+	deltas := d.pending[oid]
+	delete(d.pending, oid)
+	for _, p := range deltas {
+		patched, err := applyDelta(base, p.delta)
+		if err != nil {
+			return fmt.Errorf("object at offset %d: %v", p.offset, err)
+		}
+		if err := d.emit(&Object{Type: typ, Data: patched, Offset: p.offset}, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveExternal resolves the ref-deltas whose bases aren't in the pack.
+func (d *Decoder) resolveExternal(fn func(*Object) error) error {
+	for len(d.pending) != 0 {
+		var oid string
+		for oid = range d.pending {
+			break
+		}
+		if d.ExternalBase == nil {
+			return SyntaxError("delta base not in the pack: " + oid)
+		}
+		typ, base, err := d.ExternalBase(oid)
+		if err != nil {
+			return err
+		}
+		if err := d.resolvePending(oid, typ, base, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolve returns the object at the offset, from the cache or by reading it
+// and its bases again.
+func (d *Decoder) resolve(offset int64) (ObjectType, []byte, error) {
+	if typ, data, ok := d.cache.get(offset); ok {
+		return typ, data, nil
+	}
+	s := &Scanner{
+		r:        &hashReader{br: bufio.NewReader(io.NewSectionReader(d.ra, offset, math.MaxInt64)), n: offset},
+		algo:     d.algo,
+		keepData: true,
+	}
+	o, err := s.readObject()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	typ, data := o.Type, s.data.Bytes()
+	if o.Type.IsDelta() {
+		var base []byte
+		if typ, base, err = d.resolveBase(o); err != nil {
+			return 0, nil, err
+		}
+		if data, err = applyDelta(base, data); err != nil {
+			return 0, nil, fmt.Errorf("object at offset %d: %v", offset, err)
+		}
+	} else {
+		data = append([]byte(nil), data...)
+	}
+	d.cache.put(offset, typ, data)
+	return typ, data, nil
+}
+
+// resolveBase returns the base of a delta read again by resolve.
+func (d *Decoder) resolveBase(o *ObjectHeader) (ObjectType, []byte, error) {
+	if o.Type == ObjectOfsDelta {
+		return d.resolve(o.BaseOffset)
+	}
+	if off, ok := d.offsets[o.BaseObjectID]; ok {
+		return d.resolve(off)
+	}
+	if d.ExternalBase == nil {
+		return 0, nil, SyntaxError("delta base not in the pack: " + o.BaseObjectID)
+	}
+	return d.ExternalBase(o.BaseObjectID)
+}
+
+// objectID returns the object ID, the hash of "<type> <size>\0<data>".
+func (d *Decoder) objectID(typ ObjectType, data []byte) string {
+	h := d.algo.New()
+	h.Write([]byte(typ.String() + " " + strconv.Itoa(len(data)) + "\x00"))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// applyDelta applies a delta to the base. A delta is the base size and the
+// result size in varints, followed by the copy and insert instructions.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if srcSize != uint64(len(base)) {
+		return nil, SyntaxError(fmt.Sprintf("delta base size %d, want %d", len(base), srcSize))
+	}
+	dstSize, delta, err := deltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	// A copy instruction produces 0xffffff bytes at most.
+	if dstSize > uint64(len(delta))*0xffffff {
+		return nil, SyntaxError(fmt.Sprintf("implausible delta result size %d", dstSize))
+	}
+	out := make([]byte, 0, dstSize)
+	for len(delta) != 0 {
+		op := delta[0]
+		delta = delta[1:]
+		switch {
+		case op&0x80 != 0:
+			var off, sz uint64
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if len(delta) == 0 {
+					return nil, SyntaxError("truncated delta copy instruction")
+				}
+				if i < 4 {
+					off |= uint64(delta[0]) << (8 * i)
+				} else {
+					sz |= uint64(delta[0]) << (8 * (i - 4))
+				}
+				delta = delta[1:]
+			}
+			if sz == 0 {
+				sz = 0x10000
+			}
+			if off+sz > uint64(len(base)) {
+				return nil, SyntaxError("delta copy out of the base")
+			}
+			out = append(out, base[off:off+sz]...)
+		case op != 0:
+			if int(op) > len(delta) {
+				return nil, SyntaxError("truncated delta insert instruction")
+			}
+			out = append(out, delta[:op]...)
+			delta = delta[op:]
+		default:
+			return nil, SyntaxError("invalid delta instruction 0")
+		}
+		if uint64(len(out)) > dstSize {
+			return nil, SyntaxError("delta result larger than the header says")
+		}
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, SyntaxError(fmt.Sprintf("delta result size %d, want %d", len(out), dstSize))
+	}
+	return out, nil
+}
+
+func deltaSize(delta []byte) (uint64, []byte, error) {
+	var sz uint64
+	for shift := uint(0); ; shift += 7 {
+		if len(delta) == 0 || shift > 63 {
+			return 0, nil, SyntaxError("invalid delta size")
+		}
+		c := delta[0]
+		delta = delta[1:]
+		sz |= uint64(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return sz, delta, nil
+		}
+	}
+}
+
+// baseCache is an LRU cache of the delta bases by the offset, bounded by the
+// total data size.
+type baseCache struct {
+	max     int64
+	size    int64
+	lru     *list.List
+	entries map[int64]*list.Element
+}
+
+type baseCacheEntry struct {
+	offset int64
+	typ    ObjectType
+	data   []byte
+}
+
+func newBaseCache(max int64) *baseCache {
+	return &baseCache{max: max, lru: list.New(), entries: map[int64]*list.Element{}}
+}
+
+func (c *baseCache) get(offset int64) (ObjectType, []byte, bool) {
+	e, ok := c.entries[offset]
+	if !ok {
+		return 0, nil, false
+	}
+	c.lru.MoveToFront(e)
+	ent := e.Value.(*baseCacheEntry)
+	return ent.typ, ent.data, true
+}
+
+// put adds a copy of the data if it fits, evicting the least recently used
+// entries.
+func (c *baseCache) put(offset int64, typ ObjectType, data []byte) {
+	if _, ok := c.entries[offset]; ok || int64(len(data)) > c.max {
+		return
+	}
+	for c.size+int64(len(data)) > c.max {
+		e := c.lru.Back()
+		ent := e.Value.(*baseCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, ent.offset)
+		c.size -= int64(len(ent.data))
+	}
+	ent := &baseCacheEntry{offset: offset, typ: typ, data: append([]byte(nil), data...)}
+	c.entries[offset] = c.lru.PushFront(ent)
+	c.size += int64(len(data))
+}
@@ -0,0 +1,369 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package packfile reads packs. Scanner inspects a pack stream without
+// resolving the deltas: the header, the type and the size of each object, the
+// delta bases, and the trailing checksum. Decoder resolves the deltas and
+// materializes the objects.
+//
+// A pack is:
+//
+//	"PACK"       4 bytes
+//	version      4-byte big-endian, 2 or 3
+//	object count 4-byte big-endian
+//	objects      an object header followed by the zlib-compressed data
+//	checksum     the hash of all the bytes above
+//
+// See gitformat-pack(5).
+package packfile
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/google/gitprotocolio"
+)
+
+// SyntaxError is an error returned when the parser cannot parse the input.
+type SyntaxError string
+
+func (s SyntaxError) Error() string { return string(s) }
+
+// ObjectType is the type of an object in a pack.
+type ObjectType int
+
+// The object types. 5 is reserved.
+const (
+	ObjectCommit   ObjectType = 1
+	ObjectTree     ObjectType = 2
+	ObjectBlob     ObjectType = 3
+	ObjectTag      ObjectType = 4
+	ObjectOfsDelta ObjectType = 6
+	ObjectRefDelta ObjectType = 7
+)
+
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectCommit:
+		return "commit"
+	case ObjectTree:
+		return "tree"
+	case ObjectBlob:
+		return "blob"
+	case ObjectTag:
+		return "tag"
+	case ObjectOfsDelta:
+		return "ofs-delta"
+	case ObjectRefDelta:
+		return "ref-delta"
+	}
+	return fmt.Sprintf("ObjectType(%d)", int(t))
+}
+
+// IsDelta returns true for the delta types.
+func (t ObjectType) IsDelta() bool {
+	return t == ObjectOfsDelta || t == ObjectRefDelta
+}
+
+// Header is the header of a pack.
+type Header struct {
+	Version    uint32
+	NumObjects uint32
+}
+
+// headerSize is the size of the pack header.
+const headerSize = 12
+
+// ReadHeader reads the pack header.
+func ReadHeader(r io.Reader) (*Header, error) {
+	var bs [headerSize]byte
+	if _, err := io.ReadFull(r, bs[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return parseHeader(bs[:])
+}
+
+func parseHeader(bs []byte) (*Header, error) {
+	if !bytes.Equal(bs[:4], []byte("PACK")) {
+		return nil, SyntaxError(fmt.Sprintf("not a pack: %q", bs[:4]))
+	}
+	h := &Header{
+		Version:    binary.BigEndian.Uint32(bs[4:8]),
+		NumObjects: binary.BigEndian.Uint32(bs[8:12]),
+	}
+	if h.Version != 2 && h.Version != 3 {
+		return nil, SyntaxError(fmt.Sprintf("unsupported pack version: %d", h.Version))
+	}
+	return h, nil
+}
+
+// ObjectHeader is the header of an object in a pack.
+type ObjectHeader struct {
+	// Offset is the position of the object in the pack.
+	Offset int64
+	Type   ObjectType
+	// Size is the size of the inflated data. For a delta, it's the size of
+	// the delta, not of the object.
+	Size int64
+	// BaseOffset is the position of the base of an ofs-delta.
+	BaseOffset int64
+	// BaseObjectID is the base of a ref-delta.
+	BaseObjectID string
+	// CompressedSize is the size of the object in the pack, including the
+	// header.
+	CompressedSize int64
+}
+
+// Scanner reads the object headers of a pack stream. The usage is same as
+// bufio.Scanner. The object data is inflated to find the end of each object
+// and to check its size, and then discarded. After the last object, the
+// trailing checksum is verified.
+type Scanner struct {
+	r      *hashReader
+	algo   *gitprotocolio.HashAlgo
+	zr     io.ReadCloser
+	header *Header
+	curr   *ObjectHeader
+	read   uint32
+	sum    []byte
+	err    error
+	done   bool
+
+	// keepData makes inflate keep the object data in data for Decoder.
+	keepData bool
+	data     bytes.Buffer
+}
+
+// NewScanner returns a new Scanner to read from rd. algo is the hash algorithm
+// of the object IDs and the checksum. If nil, SHA-1 is used.
+func NewScanner(rd io.Reader, algo *gitprotocolio.HashAlgo) *Scanner {
+	if algo == nil {
+		algo = gitprotocolio.HashAlgoSHA1
+	}
+	return &Scanner{
+		r:    &hashReader{br: bufio.NewReader(rd), h: algo.New()},
+		algo: algo,
+	}
+}
+
+// Err returns the first non-EOF error that was encountered by the Scanner. A
+// truncated pack is io.ErrUnexpectedEOF, and a checksum mismatch is
+// *gitprotocolio.PackChecksumError.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Header returns the pack header. It's nil until the first Scan reads it.
+func (s *Scanner) Header() *Header {
+	return s.header
+}
+
+// Object returns the most recent object header generated by a call to Scan.
+func (s *Scanner) Object() *ObjectHeader {
+	return s.curr
+}
+
+// Checksum returns the trailing checksum in hex after the scan reaches the
+// end of the pack.
+func (s *Scanner) Checksum() string {
+	return hex.EncodeToString(s.sum)
+}
+
+// Scan advances the scanner to the next object. It returns false when the scan
+// stops, either by reaching the end of the pack or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning.
+func (s *Scanner) Scan() bool {
+	if s.err != nil || s.done {
+		return false
+	}
+	if s.header == nil {
+		var bs [headerSize]byte
+		if _, err := io.ReadFull(s.r, bs[:]); err != nil {
+			s.setErr(err)
+			return false
+		}
+		h, err := parseHeader(bs[:])
+		if err != nil {
+			s.err = err
+			return false
+		}
+		s.header = h
+	}
+	if s.read == s.header.NumObjects {
+		s.done = true
+		s.curr = nil
+		s.err = s.verify()
+		return false
+	}
+	o, err := s.readObject()
+	if err != nil {
+		s.setErr(err)
+		return false
+	}
+	s.read++
+	s.curr = o
+	return true
+}
+
+func (s *Scanner) setErr(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	s.err = err
+}
+
+func (s *Scanner) readObject() (*ObjectHeader, error) {
+	o := &ObjectHeader{Offset: s.r.n}
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	o.Type = ObjectType((c >> 4) & 7)
+	o.Size = int64(c & 0x0f)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if shift > 57 {
+			return nil, SyntaxError(fmt.Sprintf("object size too large at offset %d", o.Offset))
+		}
+		if c, err = s.r.ReadByte(); err != nil {
+			return nil, err
+		}
+		o.Size |= int64(c&0x7f) << shift
+	}
+
+	switch o.Type {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+	case ObjectOfsDelta:
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		off := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if off >= 1<<56 {
+				return nil, SyntaxError(fmt.Sprintf("delta base offset too large at offset %d", o.Offset))
+			}
+			if c, err = s.r.ReadByte(); err != nil {
+				return nil, err
+			}
+			off = ((off + 1) << 7) | int64(c&0x7f)
+		}
+		if off <= 0 || off > o.Offset {
+			return nil, SyntaxError(fmt.Sprintf("invalid delta base offset %d at offset %d", off, o.Offset))
+		}
+		o.BaseOffset = o.Offset - off
+	case ObjectRefDelta:
+		bs := make([]byte, s.algo.HexSize/2)
+		if _, err := io.ReadFull(s.r, bs); err != nil {
+			return nil, err
+		}
+		o.BaseObjectID = hex.EncodeToString(bs)
+	default:
+		return nil, SyntaxError(fmt.Sprintf("invalid object type %d at offset %d", o.Type, o.Offset))
+	}
+
+	if err := s.inflate(o); err != nil {
+		return nil, err
+	}
+	o.CompressedSize = s.r.n - o.Offset
+	return o, nil
+}
+
+// inflate reads the compressed data of the object. The hashReader is an
+// io.ByteReader, so zlib doesn't read beyond the end of the data.
+func (s *Scanner) inflate(o *ObjectHeader) error {
+	var err error
+	if s.zr == nil {
+		s.zr, err = zlib.NewReader(s.r)
+	} else {
+		err = s.zr.(zlib.Resetter).Reset(s.r, nil)
+	}
+	if err != nil {
+		return err
+	}
+	var w io.Writer = io.Discard
+	if s.keepData {
+		s.data.Reset()
+		w = &s.data
+	}
+	// Stop at one byte past the size, so that a small object that inflates
+	// to a huge one doesn't fill the memory.
+	n, err := io.Copy(w, io.LimitReader(s.zr, o.Size+1))
+	if err != nil {
+		return err
+	}
+	if n > o.Size {
+		return SyntaxError(fmt.Sprintf("object at offset %d has more bytes than the header says, %d", o.Offset, o.Size))
+	}
+	if n != o.Size {
+		return SyntaxError(fmt.Sprintf("object at offset %d has %d bytes, the header says %d", o.Offset, n, o.Size))
+	}
+	return nil
+}
+
+// verify reads the trailing checksum and compares it with the hash of the
+// pack.
+func (s *Scanner) verify() error {
+	got := s.r.h.Sum(nil)
+	s.sum = make([]byte, len(got))
+	if _, err := io.ReadFull(s.r.br, s.sum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !bytes.Equal(got, s.sum) {
+		return &gitprotocolio.PackChecksumError{Want: hex.EncodeToString(s.sum), Got: hex.EncodeToString(got)}
+	}
+	return nil
+}
+
+// hashReader hashes and counts the bytes read. h can be nil to only count.
+type hashReader struct {
+	br *bufio.Reader
+	h  hash.Hash
+	n  int64
+	b  [1]byte
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.br.Read(p)
+	if r.h != nil {
+		r.h.Write(p[:n])
+	}
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *hashReader) ReadByte() (byte, error) {
+	c, err := r.br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if r.h != nil {
+		r.b[0] = c
+		r.h.Write(r.b[:])
+	}
+	r.n++
+	return c, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package packfile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// writePack writes a pack of one blob whose header says size and whose
+// compressed data inflates to data.
+func writePack(t *testing.T, size int64, data []byte) []byte {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+	var pack bytes.Buffer
+	w := NewWriter(&pack, 1, nil)
+	if err := w.WriteCompressed(&ObjectHeader{Type: ObjectBlob, Size: size}, compressed.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return pack.Bytes()
+}
+
+func TestDecoderObjectSize(t *testing.T) {
+	data := []byte("hello\n")
+	var got []byte
+	err := NewDecoder(bytes.NewReader(writePack(t, int64(len(data)), data)), nil).Decode(func(o *Object) error {
+		got = append([]byte(nil), o.Data...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+
+	for _, tc := range []struct {
+		name string
+		size int64
+		data []byte
+	}{
+		{"short", 10, data},
+		{"long", 1, data},
+		// A small object that inflates to 16MiB.
+		{"bomb", 1, make([]byte, 16<<20)},
+	} {
+		err := NewDecoder(bytes.NewReader(writePack(t, tc.size, tc.data)), nil).Decode(func(*Object) error { return nil })
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("%s: got %v, want a SyntaxError", tc.name, err)
+		}
+	}
+}
+
+// delta encodes a delta of the instructions.
+func delta(baseSize, resultSize int, ops ...[]byte) []byte {
+	var bs []byte
+	for _, sz := range []int{baseSize, resultSize} {
+		for ; sz >= 0x80; sz >>= 7 {
+			bs = append(bs, byte(sz)|0x80)
+		}
+		bs = append(bs, byte(sz))
+	}
+	for _, op := range ops {
+		bs = append(bs, op...)
+	}
+	return bs
+}
+
+// copyOp copies n bytes of the base from off.
+func copyOp(off, n byte) []byte { return []byte{0x91, off, n} }
+
+// insertOp inserts s.
+func insertOp(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+
+func blobID(data string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("blob %d\x00%s", len(data), data)))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDecoderDeltas(t *testing.T) {
+	var pack bytes.Buffer
+	w := NewWriter(&pack, 5, nil)
+	base := &ObjectHeader{Type: ObjectBlob}
+	objects := []struct {
+		h    *ObjectHeader
+		data []byte
+	}{
+		{base, []byte("hello world\n")},
+		{&ObjectHeader{Type: ObjectOfsDelta}, delta(12, 12, copyOp(0, 6), insertOp("there\n"))},
+		// The base comes later in the pack.
+		{&ObjectHeader{Type: ObjectRefDelta, BaseObjectID: blobID("later\n")}, delta(6, 7, copyOp(0, 5), insertOp("!\n"))},
+		{&ObjectHeader{Type: ObjectBlob}, []byte("later\n")},
+		// The base is a delta.
+		{&ObjectHeader{Type: ObjectRefDelta, BaseObjectID: blobID("hello there\n")}, delta(12, 7, copyOp(0, 5), insertOp("?\n"))},
+	}
+	for _, o := range objects {
+		if o.h.Type == ObjectOfsDelta {
+			o.h.BaseOffset = base.Offset
+		}
+		if err := w.WriteObject(o.h, o.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type object struct {
+		ID     string
+		Type   ObjectType
+		Data   string
+		Offset int64
+	}
+	var want []object
+	for _, i := range []struct {
+		index int
+		data  string
+	}{{0, "hello world\n"}, {1, "hello there\n"}, {3, "later\n"}, {2, "later!\n"}, {4, "hello?\n"}} {
+		want = append(want, object{blobID(i.data), ObjectBlob, i.data, objects[i.index].h.Offset})
+	}
+	// With a one-byte cache, the bases are read again from the pack.
+	for _, cacheSize := range []int64{0, 1} {
+		d := NewDecoder(bytes.NewReader(pack.Bytes()), nil)
+		d.CacheSize = cacheSize
+		var got []object
+		err := d.Decode(func(o *Object) error {
+			got = append(got, object{o.ObjectID, o.Type, string(o.Data), o.Offset})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("cache size %d: %v", cacheSize, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("cache size %d: got %+v, want %+v", cacheSize, got, want)
+		}
+	}
+}
+
+func TestDecoderThinPack(t *testing.T) {
+	var pack bytes.Buffer
+	w := NewWriter(&pack, 1, nil)
+	if err := w.WriteObject(&ObjectHeader{Type: ObjectRefDelta, BaseObjectID: blobID("base\n")}, delta(5, 6, copyOp(0, 4), insertOp("!\n"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(bytes.NewReader(pack.Bytes()), nil)
+	if err := d.Decode(func(*Object) error { return nil }); err == nil {
+		t.Error("got no error without ExternalBase")
+	}
+	d.ExternalBase = func(oid string) (ObjectType, []byte, error) {
+		if oid != blobID("base\n") {
+			return 0, nil, fmt.Errorf("unexpected base %s", oid)
+		}
+		return ObjectBlob, []byte("base\n"), nil
+	}
+	var got []string
+	if err := d.Decode(func(o *Object) error {
+		got = append(got, string(o.Data))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"base!\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello world\n")
+	for _, tc := range []struct {
+		name  string
+		delta []byte
+		want  string
+	}{
+		{"copy and insert", delta(12, 8, copyOp(6, 5), insertOp("!\n"), insertOp("?")), "world!\n?"},
+		{"wrong base size", delta(11, 5, copyOp(0, 5)), ""},
+		{"copy out of the base", delta(12, 5, copyOp(10, 5)), ""},
+		{"truncated insert", delta(12, 5, []byte{5, 'a'}), ""},
+		{"instruction 0", delta(12, 1, []byte{0}), ""},
+		{"wrong result size", delta(12, 6, copyOp(0, 5)), ""},
+		{"implausible result size", delta(12, 1<<30, copyOp(0, 5)), ""},
+	} {
+		got, err := applyDelta(base, tc.delta)
+		if tc.want == "" {
+			if _, ok := err.(SyntaxError); !ok {
+				t.Errorf("%s: got %q, %v, want a SyntaxError", tc.name, got, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package packfile
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/google/gitprotocolio"
+)
+
+// Writer writes a pack stream. The header has the number of objects, so it
+// must be known beforehand. The stream can be sent as the packfile section of
+// an upload-pack response, for example through a SideBandMuxer.
+type Writer struct {
+	w          *hashWriter
+	algo       *gitprotocolio.HashAlgo
+	zw         *zlib.Writer
+	numObjects uint32
+	written    uint32
+	sum        []byte
+	err        error
+}
+
+// NewWriter returns a new Writer of a version 2 pack with numObjects objects.
+// algo is the hash algorithm of the object IDs and the checksum. If nil, SHA-1
+// is used.
+func NewWriter(w io.Writer, numObjects uint32, algo *gitprotocolio.HashAlgo) *Writer {
+	if algo == nil {
+		algo = gitprotocolio.HashAlgoSHA1
+	}
+	return &Writer{
+		w:          &hashWriter{w: w, h: algo.New()},
+		algo:       algo,
+		numObjects: numObjects,
+	}
+}
+
+// Offset returns the position in the pack of the next object, to be used as
+// the BaseOffset of an ofs-delta.
+func (w *Writer) Offset() int64 {
+	if w.w.n == 0 {
+		return headerSize
+	}
+	return w.w.n
+}
+
+// WriteObject compresses and writes an object. h.Type is the object type, and
+// h.BaseOffset or h.BaseObjectID is the base of a delta. For a delta, data is
+// the delta. h.Offset, h.Size, and h.CompressedSize are set to the written
+// values.
+func (w *Writer) WriteObject(h *ObjectHeader, data []byte) error {
+	h.Size = int64(len(data))
+	return w.write(h, func() error {
+		if w.zw == nil {
+			w.zw = zlib.NewWriter(w.w)
+		} else {
+			w.zw.Reset(w.w)
+		}
+		if _, err := w.zw.Write(data); err != nil {
+			return err
+		}
+		return w.zw.Close()
+	})
+}
+
+// WriteCompressed writes an object whose data is already zlib-compressed, such
+// as an object copied from another pack. h.Size must be the size of the
+// inflated data. h.Offset and h.CompressedSize are set to the written values.
+func (w *Writer) WriteCompressed(h *ObjectHeader, compressed []byte) error {
+	return w.write(h, func() error {
+		_, err := w.w.Write(compressed)
+		return err
+	})
+}
+
+func (w *Writer) write(h *ObjectHeader, writeData func() error) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.written == w.numObjects {
+		return errors.New("packfile: too many objects")
+	}
+	hdr, err := w.objectHeader(h)
+	if err != nil {
+		return err
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	h.Offset = w.w.n
+	if _, err := w.w.Write(hdr); err != nil {
+		w.err = err
+		return err
+	}
+	if err := writeData(); err != nil {
+		w.err = err
+		return err
+	}
+	h.CompressedSize = w.w.n - h.Offset
+	w.written++
+	return nil
+}
+
+// objectHeader encodes the object header, which is followed by the base for a
+// delta.
+func (w *Writer) objectHeader(h *ObjectHeader) ([]byte, error) {
+	if h.Size < 0 {
+		return nil, fmt.Errorf("packfile: invalid object size %d", h.Size)
+	}
+	sz := uint64(h.Size)
+	c := byte(h.Type)<<4 | byte(sz&0x0f)
+	sz >>= 4
+	var bs []byte
+	for sz != 0 {
+		bs = append(bs, c|0x80)
+		c = byte(sz & 0x7f)
+		sz >>= 7
+	}
+	bs = append(bs, c)
+
+	switch h.Type {
+	case ObjectCommit, ObjectTree, ObjectBlob, ObjectTag:
+	case ObjectOfsDelta:
+		off := w.Offset() - h.BaseOffset
+		if h.BaseOffset < headerSize || off <= 0 {
+			return nil, fmt.Errorf("packfile: invalid delta base offset %d", h.BaseOffset)
+		}
+		// The offset is big-endian, and each continued byte is one less.
+		var buf [10]byte
+		i := len(buf) - 1
+		buf[i] = byte(off & 0x7f)
+		for off >>= 7; off != 0; off >>= 7 {
+			off--
+			i--
+			buf[i] = 0x80 | byte(off&0x7f)
+		}
+		bs = append(bs, buf[i:]...)
+	case ObjectRefDelta:
+		id, err := hex.DecodeString(h.BaseObjectID)
+		if err != nil || len(id) != w.algo.HexSize/2 {
+			return nil, fmt.Errorf("packfile: invalid delta base %q", h.BaseObjectID)
+		}
+		bs = append(bs, id...)
+	default:
+		return nil, fmt.Errorf("packfile: invalid object type %d", h.Type)
+	}
+	return bs, nil
+}
+
+func (w *Writer) writeHeader() error {
+	if w.w.n != 0 {
+		return nil
+	}
+	var bs [headerSize]byte
+	copy(bs[:4], "PACK")
+	binary.BigEndian.PutUint32(bs[4:8], 2)
+	binary.BigEndian.PutUint32(bs[8:12], w.numObjects)
+	if _, err := w.w.Write(bs[:]); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// Close writes the trailing checksum. It's an error if fewer objects than
+// numObjects are written. It doesn't close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.sum != nil {
+		return nil
+	}
+	if w.written != w.numObjects {
+		return fmt.Errorf("packfile: %d objects written, the header says %d", w.written, w.numObjects)
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	sum := w.w.h.Sum(nil)
+	if _, err := w.w.w.Write(sum); err != nil {
+		w.err = err
+		return err
+	}
+	w.sum = sum
+	return nil
+}
+
+// Checksum returns the trailing checksum in hex after Close.
+func (w *Writer) Checksum() string {
+	return hex.EncodeToString(w.sum)
+}
+
+// hashWriter hashes and counts the bytes written.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func (w *hashWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+)
+
+// OffloadedObject is an object served from a pre-generated pack on a CDN, the
+// same as an uploadpack.blobPackfileUri entry of Git.
+type OffloadedObject struct {
+	// ObjectID is the object offloaded.
+	ObjectID string
+	// PackHash is the hash of the pack that has the object.
+	PackHash string
+	// URI is where the client downloads the pack from.
+	URI string
+}
+
+// PackfileURIsOffload is the decision of PackfileURIOffloader.
+type PackfileURIsOffload struct {
+	// Excluded is the set of object IDs the pack must not contain since the
+	// client downloads them.
+	Excluded map[string]bool
+	// Section is the packfile-uris section of the fetch response, with the
+	// trailing delimiter. It's empty if nothing is offloaded.
+	Section []*ProtocolV2ResponseChunk
+}
+
+// PackfileURIOffloader decides which objects are offloaded to pre-generated
+// packs in a protocol v2 fetch.
+type PackfileURIOffloader struct {
+	Objects []OffloadedObject
+}
+
+// ParsePackfileURIsArgument returns the protocols (URI schemes) of a
+// "packfile-uris <protocol>,<protocol>..." fetch argument, or nil if the
+// argument is not packfile-uris.
+func ParsePackfileURIsArgument(arg string) []string {
+	arg = strings.TrimSuffix(arg, "\n")
+	if !strings.HasPrefix(arg, "packfile-uris ") {
+		return nil
+	}
+	var ret []string
+	for _, p := range strings.Split(strings.TrimPrefix(arg, "packfile-uris "), ",") {
+		if p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// PackfileURIsArgument returns the "packfile-uris" fetch argument of the
+// protocols, such as "packfile-uris https". It's "" if protocols is empty.
+func PackfileURIsArgument(protocols []string) string {
+	if len(protocols) == 0 {
+		return ""
+	}
+	return "packfile-uris " + strings.Join(protocols, ",")
+}
+
+// Offload selects the objects whose URI scheme the client supports and that
+// the pack would contain (inPack returns true). If protocols is empty, the
+// client didn't ask for packfile-uris and nothing is offloaded.
+func (o *PackfileURIOffloader) Offload(protocols []string, inPack func(objectID string) bool) *PackfileURIsOffload {
+	ret := &PackfileURIsOffload{Excluded: map[string]bool{}}
+	supported := map[string]bool{}
+	for _, p := range protocols {
+		supported[p] = true
+	}
+	sent := map[string]bool{}
+	var lines []string
+	for _, obj := range o.Objects {
+		scheme := obj.URI
+		if i := strings.Index(scheme, "://"); i >= 0 {
+			scheme = scheme[:i]
+		}
+		if !supported[scheme] || !inPack(obj.ObjectID) {
+			continue
+		}
+		ret.Excluded[obj.ObjectID] = true
+		line := obj.PackHash + " " + obj.URI + "\n"
+		if !sent[line] {
+			sent[line] = true
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return ret
+	}
+	ret.Section = append(ret.Section, &ProtocolV2ResponseChunk{Response: []byte("packfile-uris\n")})
+	for _, line := range lines {
+		ret.Section = append(ret.Section, &ProtocolV2ResponseChunk{Response: []byte(line)})
+	}
+	ret.Section = append(ret.Section, &ProtocolV2ResponseChunk{Delimiter: true})
+	return ret
+}
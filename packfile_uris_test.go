@@ -0,0 +1,73 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePackfileURIsArgument(t *testing.T) {
+	for _, tc := range []struct {
+		arg  string
+		want []string
+	}{
+		{"packfile-uris https\n", []string{"https"}},
+		{"packfile-uris https,,http", []string{"https", "http"}},
+		{"packfile-uris ", nil},
+		{"packfile-uris", nil},
+		{"thin-pack", nil},
+	} {
+		if got := ParsePackfileURIsArgument(tc.arg); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.arg, got, tc.want)
+		}
+	}
+	if got := PackfileURIsArgument([]string{"https", "http"}); got != "packfile-uris https,http" {
+		t.Errorf("got %q", got)
+	}
+	if got := PackfileURIsArgument(nil); got != "" {
+		t.Errorf("got %q for no protocols", got)
+	}
+}
+
+func TestPackfileURIOffloader(t *testing.T) {
+	o := &PackfileURIOffloader{Objects: []OffloadedObject{
+		{ObjectID: "b1", PackHash: "p1", URI: "https://cdn/p1.pack"},
+		{ObjectID: "b2", PackHash: "p1", URI: "https://cdn/p1.pack"},
+		{ObjectID: "b3", PackHash: "p2", URI: "http://cdn/p2.pack"},
+		{ObjectID: "b4", PackHash: "p3", URI: "https://cdn/p3.pack"},
+	}}
+	inPack := func(oid string) bool { return oid != "b4" }
+
+	got := o.Offload([]string{"https"}, inPack)
+	if want := map[string]bool{"b1": true, "b2": true}; !reflect.DeepEqual(got.Excluded, want) {
+		t.Errorf("got excluded %v, want %v", got.Excluded, want)
+	}
+	want := []*ProtocolV2ResponseChunk{
+		{Response: []byte("packfile-uris\n")},
+		{Response: []byte("p1 https://cdn/p1.pack\n")},
+		{Delimiter: true},
+	}
+	if !reflect.DeepEqual(got.Section, want) {
+		t.Errorf("got section %+v, want %+v", got.Section, want)
+	}
+
+	for _, protocols := range [][]string{nil, {"ftp"}} {
+		got := o.Offload(protocols, inPack)
+		if len(got.Excluded) != 0 || got.Section != nil {
+			t.Errorf("%q: got %+v, want nothing offloaded", protocols, got)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package packfileuri downloads the packs advertised in the packfile-uris
+// section of a protocol v2 fetch response.
+//
+// A download is resumed with an HTTP range request after an interruption, and
+// the pack is verified against the advertised pack hash, which is the checksum
+// at the end of the pack.
+package packfileuri
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gitprotocolio"
+)
+
+// SyntaxError is an error returned when the parser cannot parse the input.
+type SyntaxError string
+
+func (s SyntaxError) Error() string { return string(s) }
+
+// Pack is a pack advertised in the packfile-uris section.
+type Pack struct {
+	Hash string
+	URI  string
+}
+
+// ParseLine parses a "<pack-hash> <uri>" line of the packfile-uris section.
+func ParseLine(line []byte) (*Pack, error) {
+	ss := strings.SplitN(strings.TrimSuffix(string(line), "\n"), " ", 2)
+	if len(ss) != 2 || ss[1] == "" {
+		return nil, SyntaxError(fmt.Sprintf("cannot parse a packfile-uris line: %q", line))
+	}
+	if _, err := hex.DecodeString(ss[0]); err != nil || (len(ss[0]) != 40 && len(ss[0]) != 64) {
+		return nil, SyntaxError("invalid pack hash: " + ss[0])
+	}
+	return &Pack{Hash: ss[0], URI: ss[1]}, nil
+}
+
+// ChecksumError is returned when the downloaded pack doesn't match the
+// advertised pack hash.
+type ChecksumError struct {
+	Want string
+	Got  string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("pack checksum mismatch: want %s, got %s", e.Want, e.Got)
+}
+
+// Downloader downloads packs with retries.
+type Downloader struct {
+	// Client is the HTTP client. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// MaxAttempts is the number of attempts per pack. If zero, 5 is used.
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubled for every retry.
+	// If zero, one second is used.
+	Backoff time.Duration
+}
+
+// DownloadToFile downloads the pack to the file at path and verifies it. If the
+// file already has a part of the pack, the download resumes from its end. If
+// the server doesn't support range requests, the download starts over.
+//
+// A pack that fails the verification is removed so that the next attempt
+// doesn't resume from a corrupted file.
+func (d *Downloader) DownloadToFile(ctx context.Context, p *Pack, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	attempts := d.MaxAttempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := d.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for i := 0; ; i++ {
+		complete, err := d.fetch(ctx, p.URI, f)
+		if err == nil && complete {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if i+1 >= attempts {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("cannot download %s: %v", p.URI, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+
+	if err := Verify(f, p.Hash); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// fetch downloads the rest of the pack into f. It returns true if the
+// response body was read to the end.
+func (d *Downloader) fetch(ctx context.Context, uri string, f *os.File) (bool, error) {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server sends the whole pack.
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The file already has the whole pack.
+		return true, nil
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Verify checks that the pack read from r ends with the checksum of the
+// preceding bytes, and the checksum is the pack hash. The hash algorithm is
+// chosen by the length of the pack hash among the registered
+// ones.
+func Verify(r io.ReadSeeker, packHash string) error {
+	a := gitprotocolio.HashAlgoByHexSize(len(packHash))
+	if a == nil {
+		return SyntaxError("invalid pack hash: " + packHash)
+	}
+	h := a.New()
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if size < int64(h.Size())+12 {
+		return SyntaxError("pack too short")
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, []byte("PACK")) {
+		return SyntaxError("not a pack")
+	}
+	h.Write(header)
+	if _, err := io.CopyN(h, r, size-int64(h.Size())-4); err != nil {
+		return err
+	}
+	trailer := make([]byte, h.Size())
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if !bytes.Equal(h.Sum(nil), trailer) {
+		return &ChecksumError{Want: hex.EncodeToString(trailer), Got: got}
+	}
+	if got != packHash {
+		return &ChecksumError{Want: packHash, Got: got}
+	}
+	return nil
+}
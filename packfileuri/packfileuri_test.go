@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package packfileuri
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testPack returns a pack of no object and its hash.
+func testPack() ([]byte, string) {
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+	sum := sha1.Sum(pack)
+	return append(pack, sum[:]...), hex.EncodeToString(sum[:])
+}
+
+func TestParseLine(t *testing.T) {
+	_, hash := testPack()
+	p, err := ParseLine([]byte(hash + " https://cdn/p.pack\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Hash != hash || p.URI != "https://cdn/p.pack" {
+		t.Errorf("got %+v", p)
+	}
+	for _, line := range []string{
+		hash + "\n",
+		hash + " \n",
+		"abc https://cdn/p.pack\n",
+		hash[:39] + "z https://cdn/p.pack\n",
+	} {
+		if _, err := ParseLine([]byte(line)); err == nil {
+			t.Errorf("%q: got no error", line)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pack, hash := testPack()
+	if err := Verify(bytes.NewReader(pack), hash); err != nil {
+		t.Errorf("got %v", err)
+	}
+	corrupted := append([]byte(nil), pack...)
+	corrupted[8] = 1
+	otherHash := hex.EncodeToString(make([]byte, 20))
+	for _, tc := range []struct {
+		name string
+		pack []byte
+		hash string
+	}{
+		{"corrupted", corrupted, hash},
+		{"other hash", pack, otherHash},
+		{"not a pack", append([]byte("KCAP"), pack[4:]...), hash},
+		{"too short", pack[:20], hash},
+		{"bad hash size", pack, hash[:30]},
+	} {
+		if err := Verify(bytes.NewReader(tc.pack), tc.hash); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
+
+func TestDownloadToFile(t *testing.T) {
+	pack, hash := testPack()
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Send a half and cut the connection.
+			w.Header().Set("Content-Length", "32")
+			w.Write(pack[:16])
+			return
+		}
+		if r.Header.Get("Range") != "bytes=16-" {
+			t.Errorf("got range %q, want a resumed download", r.Header.Get("Range"))
+		}
+		http.ServeContent(w, r, "p.pack", time.Time{}, bytes.NewReader(pack))
+	}))
+	defer s.Close()
+
+	d := &Downloader{Client: s.Client(), Backoff: time.Millisecond}
+	path := filepath.Join(t.TempDir(), "p.pack")
+	if err := d.DownloadToFile(context.Background(), &Pack{Hash: hash, URI: s.URL}, path); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, pack) {
+		t.Errorf("got %q, want %q", got, pack)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests, want 2", requests)
+	}
+}
+
+func TestDownloadToFileErrors(t *testing.T) {
+	pack, _ := testPack()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(pack)
+	}))
+	defer s.Close()
+	d := &Downloader{Client: s.Client(), MaxAttempts: 2, Backoff: time.Millisecond}
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "mismatch.pack")
+	otherHash := hex.EncodeToString(make([]byte, 20))
+	err := d.DownloadToFile(context.Background(), &Pack{Hash: otherHash, URI: s.URL}, path)
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Errorf("got %v, want a ChecksumError", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the corrupted pack is left: %v", err)
+	}
+
+	if err := d.DownloadToFile(context.Background(), &Pack{Hash: otherHash, URI: s.URL + "/missing"}, filepath.Join(dir, "missing.pack")); err == nil {
+		t.Error("got no error for 404")
+	}
+}
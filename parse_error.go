@@ -0,0 +1,74 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import "fmt"
+
+// ParseError is a SyntaxError of a PacketScanner or a parser with where in the
+// input it happened. Use errors.As to get it from Err, or the SyntaxError it
+// wraps.
+type ParseError struct {
+	// Parser is the type of the parser, such as
+	// "ProtocolV1UploadPackRequest". It's empty for an error of the
+	// PacketScanner itself, such as an invalid packet length.
+	Parser string
+	// State is the state of the parser when the error happened, such as
+	// "ScanWants".
+	State string
+	// Offset is the position of the offending packet in the input.
+	Offset int64
+	// PacketIndex is the index of the offending packet, counted from 0. Pack
+	// file data after a raw "PACK" header is not counted.
+	PacketIndex int64
+	// Packet is the offending packet as it appeared on the wire, including
+	// the length prefix. It's nil if the input ended early.
+	Packet []byte
+	// Err is the SyntaxError.
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	where := fmt.Sprintf("packet %d at offset %d", e.PacketIndex, e.Offset)
+	if e.Parser != "" {
+		where = fmt.Sprintf("%s in state %s, %s", e.Parser, e.State, where)
+	}
+	return fmt.Sprintf("%v (%s)", e.Err, where)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// parseError attaches the position of the current packet to a SyntaxError.
+// Other errors, such as a RemoteError from the other side, are returned as
+// is. An error of the scanner itself gets the parser and the state.
+func (s *PacketScanner) parseError(err error, parser, state string) error {
+	switch e := err.(type) {
+	case SyntaxError:
+		return &ParseError{
+			Parser:      parser,
+			State:       state,
+			Offset:      s.rawOffset,
+			PacketIndex: s.rawIndex,
+			Packet:      append([]byte(nil), s.raw...),
+			Err:         e,
+		}
+	case *ParseError:
+		if e.Parser == "" {
+			e.Parser, e.State = parser, state
+		}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseError(t *testing.T) {
+	v1 := func(in string) error {
+		r := NewProtocolV1UploadPackRequest(strings.NewReader(in))
+		for r.Scan() {
+		}
+		return r.Err()
+	}
+	v2 := func(in string) error {
+		r := NewProtocolV2Request(strings.NewReader(in))
+		for r.Scan() {
+		}
+		return r.Err()
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want ParseError
+	}{
+		{
+			name: "bad want",
+			err:  v1(pktLines("want "+oidA+"\n", "wont "+oidB+"\n")),
+			want: ParseError{Parser: "ProtocolV1UploadPackRequest", State: "ScanWants", Offset: 50, PacketIndex: 1, Packet: []byte(pktLines("wont " + oidB + "\n"))},
+		},
+		{
+			name: "invalid packet length",
+			err:  v2(pktLines("command=ls-refs\n") + "zzzz"),
+			want: ParseError{Parser: "ProtocolV2Request", State: "ScanCapabilities", Offset: 20, PacketIndex: 1, Packet: []byte("zzzz")},
+		},
+		{
+			name: "early EOF",
+			err:  v2(pktLines("command=ls-refs\n")),
+			want: ParseError{Parser: "ProtocolV2Request", State: "ScanCapabilities", Offset: 20, PacketIndex: 1},
+		},
+	} {
+		var pe *ParseError
+		if !errors.As(tc.err, &pe) {
+			t.Errorf("%s: got %#v, want a ParseError", tc.name, tc.err)
+			continue
+		}
+		if pe.Parser != tc.want.Parser || pe.State != tc.want.State || pe.Offset != tc.want.Offset || pe.PacketIndex != tc.want.PacketIndex || string(pe.Packet) != string(tc.want.Packet) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, pe, &tc.want)
+		}
+		var se SyntaxError
+		if !errors.As(tc.err, &se) {
+			t.Errorf("%s: got %#v, want a SyntaxError", tc.name, tc.err)
+		}
+	}
+}
+
+func TestParseErrorRemoteError(t *testing.T) {
+	r := NewProtocolV1UploadPackRequest(strings.NewReader(pktLines("ERR access denied\n")))
+	for r.Scan() {
+	}
+	var re *RemoteError
+	var pe *ParseError
+	if !errors.As(r.Err(), &re) || errors.As(r.Err(), &pe) {
+		t.Errorf("got %#v, want a RemoteError as is", r.Err())
+	}
+}
+
+func TestParseErrorMessage(t *testing.T) {
+	for _, tc := range []struct {
+		e    *ParseError
+		want string
+	}{
+		{
+			&ParseError{Parser: "ProtocolV2Request", State: "ScanArguments", Offset: 20, PacketIndex: 2, Err: SyntaxError("oops")},
+			"oops (ProtocolV2Request in state ScanArguments, packet 2 at offset 20)",
+		},
+		{
+			&ParseError{Offset: 4, PacketIndex: 1, Err: SyntaxError("invalid packet length")},
+			"invalid packet length (packet 1 at offset 4)",
+		},
+	} {
+		if got := tc.e.Error(); got != tc.want {
+			t.Errorf("got %q, want %q", got, tc.want)
+		}
+	}
+}
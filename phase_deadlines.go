@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Session phases.
+const (
+	// PhaseDiscovery is the ref advertisement or ls-refs.
+	PhaseDiscovery = "discovery"
+	// PhaseNegotiation is the want/have exchange.
+	PhaseNegotiation = "negotiation"
+	// PhasePackTransfer is the pack stream.
+	PhasePackTransfer = "pack"
+)
+
+// PhaseTimeouts is the time budget of each phase of a session. A zero timeout
+// means no limit.
+//
+// A healthy pack transfer can take far longer than the negotiation, so one
+// blanket timeout is either too short for large clones or too long to catch a
+// stalled negotiation.
+type PhaseTimeouts struct {
+	Discovery    time.Duration
+	Negotiation  time.Duration
+	PackTransfer time.Duration
+}
+
+func (t PhaseTimeouts) timeout(phase string) time.Duration {
+	switch phase {
+	case PhaseDiscovery:
+		return t.Discovery
+	case PhaseNegotiation:
+		return t.Negotiation
+	case PhasePackTransfer:
+		return t.PackTransfer
+	}
+	return 0
+}
+
+// PhaseDeadlineError is the cause of the cancellation when a phase runs out of
+// its time budget.
+type PhaseDeadlineError struct {
+	Phase   string
+	Timeout time.Duration
+}
+
+func (e *PhaseDeadlineError) Error() string {
+	return fmt.Sprintf("%s phase exceeded its deadline (%v)", e.Phase, e.Timeout)
+}
+
+// DeadlineSetter is implemented by connections with deadlines such as
+// net.Conn.
+type DeadlineSetter interface {
+	SetDeadline(t time.Time) error
+}
+
+// PhaseDeadlines enforces PhaseTimeouts. Starting a phase replaces the
+// deadline of the previous phase. When a phase runs out of time, the context
+// is canceled with a PhaseDeadlineError as the cause, and the connection's
+// deadline, if given, makes blocked reads and writes fail.
+type PhaseDeadlines struct {
+	timeouts PhaseTimeouts
+	conn     DeadlineSetter
+	cancel   context.CancelCauseFunc
+
+	m     sync.Mutex
+	timer *time.Timer
+	phase string
+}
+
+// NewPhaseDeadlines returns a new PhaseDeadlines and a context canceled when a
+// phase runs out of time. conn can be nil.
+func NewPhaseDeadlines(ctx context.Context, timeouts PhaseTimeouts, conn DeadlineSetter) (*PhaseDeadlines, context.Context) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	return &PhaseDeadlines{timeouts: timeouts, conn: conn, cancel: cancel}, ctx
+}
+
+// Start starts the phase and its deadline.
+func (p *PhaseDeadlines) Start(phase string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.phase = phase
+	timeout := p.timeouts.timeout(phase)
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+		err := &PhaseDeadlineError{Phase: phase, Timeout: timeout}
+		p.timer = time.AfterFunc(timeout, func() { p.cancel(err) })
+	}
+	if p.conn != nil {
+		return p.conn.SetDeadline(deadline)
+	}
+	return nil
+}
+
+// Phase returns the current phase.
+func (p *PhaseDeadlines) Phase() string {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.phase
+}
+
+// Stop stops the deadlines and releases the context.
+func (p *PhaseDeadlines) Stop() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if p.conn != nil {
+		p.conn.SetDeadline(time.Time{})
+	}
+	p.cancel(context.Canceled)
+}
@@ -0,0 +1,79 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type deadlineRecorder struct {
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetDeadline(t time.Time) error {
+	r.deadlines = append(r.deadlines, t)
+	return nil
+}
+
+func TestPhaseDeadlines(t *testing.T) {
+	conn := &deadlineRecorder{}
+	p, ctx := NewPhaseDeadlines(context.Background(), PhaseTimeouts{
+		Negotiation:  20 * time.Millisecond,
+		PackTransfer: time.Hour,
+	}, conn)
+	defer p.Stop()
+
+	if err := p.Start(PhaseDiscovery); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Start(PhaseNegotiation); err != nil {
+		t.Fatal(err)
+	}
+	if p.Phase() != PhaseNegotiation {
+		t.Errorf("got phase %q, want %q", p.Phase(), PhaseNegotiation)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("the negotiation deadline didn't cancel the context")
+	}
+	var pde *PhaseDeadlineError
+	if !errors.As(context.Cause(ctx), &pde) || pde.Phase != PhaseNegotiation || pde.Timeout != 20*time.Millisecond {
+		t.Errorf("got cause %v", context.Cause(ctx))
+	}
+	if len(conn.deadlines) != 2 || !conn.deadlines[0].IsZero() || conn.deadlines[1].IsZero() {
+		t.Errorf("got deadlines %v, want none for discovery and one for negotiation", conn.deadlines)
+	}
+}
+
+func TestPhaseDeadlinesNextPhase(t *testing.T) {
+	p, ctx := NewPhaseDeadlines(context.Background(), PhaseTimeouts{Negotiation: 20 * time.Millisecond}, nil)
+	p.Start(PhaseNegotiation)
+	// The pack transfer has no limit, so the negotiation deadline is
+	// replaced.
+	p.Start(PhasePackTransfer)
+	select {
+	case <-ctx.Done():
+		t.Fatalf("canceled by %v", context.Cause(ctx))
+	case <-time.After(100 * time.Millisecond):
+	}
+	p.Stop()
+	if context.Cause(ctx) != context.Canceled {
+		t.Errorf("got cause %v after Stop, want %v", context.Cause(ctx), context.Canceled)
+	}
+}
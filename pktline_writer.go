@@ -0,0 +1,109 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bufio"
+	"io"
+)
+
+const hexDigits = "0123456789abcdef"
+
+// PktLineWriter writes packets to a buffered writer. Unlike EncodeToPktLine,
+// WriteBytes and WriteString don't allocate a slice per packet.
+//
+// The buffered packets are written to the underlying writer at every flush,
+// delim, and response-end packet, where the peer may wait for the end of a
+// section or a response.
+type PktLineWriter struct {
+	w   *bufio.Writer
+	hdr [PacketLengthHeaderSize]byte
+}
+
+// NewPktLineWriter returns a new PktLineWriter that writes to w.
+func NewPktLineWriter(w io.Writer) *PktLineWriter {
+	return &PktLineWriter{w: bufio.NewWriterSize(w, MaxPacketSize)}
+}
+
+// WritePacket writes the packet. Flush, delim, response-end, and BytesPacket
+// packets are written in the same way as Flush, Delim, ResponseEnd, and
+// WriteBytes.
+func (w *PktLineWriter) WritePacket(p Packet) error {
+	switch p := p.(type) {
+	case FlushPacket:
+		return w.Flush()
+	case DelimPacket:
+		return w.Delim()
+	case ResponseEndPacket:
+		return w.ResponseEnd()
+	case BytesPacket:
+		return w.WriteBytes(p)
+	}
+	_, err := w.w.Write(p.EncodeToPktLine())
+	return err
+}
+
+// WriteBytes writes a packet with the content.
+func (w *PktLineWriter) WriteBytes(p []byte) error {
+	if err := w.writeHeader(len(p)); err != nil {
+		return err
+	}
+	_, err := w.w.Write(p)
+	return err
+}
+
+// WriteString writes a packet with the content.
+func (w *PktLineWriter) WriteString(s string) error {
+	if err := w.writeHeader(len(s)); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString(s)
+	return err
+}
+
+func (w *PktLineWriter) writeHeader(payloadSize int) error {
+	if payloadSize > MaxPacketPayloadSize {
+		panic("content too large")
+	}
+	sz := payloadSize + PacketLengthHeaderSize
+	for i := PacketLengthHeaderSize - 1; i >= 0; i-- {
+		w.hdr[i] = hexDigits[sz&0xf]
+		sz >>= 4
+	}
+	_, err := w.w.Write(w.hdr[:])
+	return err
+}
+
+// Flush writes a flush packet and the buffered packets.
+func (w *PktLineWriter) Flush() error {
+	return w.writeSpecial(FlushPkt)
+}
+
+// Delim writes a delim packet and the buffered packets.
+func (w *PktLineWriter) Delim() error {
+	return w.writeSpecial(DelimPkt)
+}
+
+// ResponseEnd writes a response-end packet and the buffered packets.
+func (w *PktLineWriter) ResponseEnd() error {
+	return w.writeSpecial(ResponseEndPkt)
+}
+
+func (w *PktLineWriter) writeSpecial(pkt string) error {
+	if _, err := w.w.WriteString(pkt); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPktLineWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewPktLineWriter(&b)
+	w.WriteString("command=ls-refs\n")
+	w.WriteBytes([]byte("agent=git/2.40\n"))
+	if b.Len() != 0 {
+		t.Errorf("got %q before a special packet", b.String())
+	}
+	if err := w.Delim(); err != nil {
+		t.Fatal(err)
+	}
+	want := pktLines("command=ls-refs\n", "agent=git/2.40\n") + DelimPkt
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	for _, p := range []Packet{BytesPacket("peel\n"), SideBandMainPacket("PACK"), BytesPacket(""), FlushPacket{}} {
+		if err := w.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+		want += string(p.EncodeToPktLine())
+	}
+	if err := w.ResponseEnd(); err != nil {
+		t.Fatal(err)
+	}
+	want += ResponseEndPkt
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestPktLineWriterLargePacket(t *testing.T) {
+	var b bytes.Buffer
+	w := NewPktLineWriter(&b)
+	max := strings.Repeat("x", MaxPacketPayloadSize)
+	w.WriteString(max)
+	w.Flush()
+	if want := string(BytesPacket(max).EncodeToPktLine()) + FlushPkt; b.String() != want {
+		t.Errorf("got %q..., want %q...", b.String()[:8], want[:8])
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("got no panic for a too large packet")
+		}
+	}()
+	w.WriteString(max + "x")
+}
+
+func TestPktLineWriterError(t *testing.T) {
+	w := NewPktLineWriter(failingWriter{})
+	if err := w.WriteString("abcd"); err != nil {
+		t.Errorf("got %v for a buffered packet", err)
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("got no error from the writer")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// ProgressEvent is a message of the report stream (0x02), such as
+// "Counting objects:  45% (9/20)" or "Enumerating objects: 20, done.".
+type ProgressEvent struct {
+	// Phase is the title of the progress, such as "Counting objects". It's
+	// empty if the message is not a progress, such as "Total 3 (delta 0),
+	// reused 0 (delta 0)".
+	Phase string
+	// Current is the count so far.
+	Current uint64
+	// Total is the count at the end, or zero if it's unknown.
+	Total uint64
+	// Done is true if the phase has ended.
+	Done bool
+	// Line is the message without the line terminator.
+	Line string
+}
+
+// ParseProgress parses a message of the report stream in the format of Git's
+// progress.c. The throughput, such as "1.00 KiB | 1.00 MiB/s", is ignored.
+func ParseProgress(line string) *ProgressEvent {
+	e := &ProgressEvent{Line: line}
+	i := strings.LastIndex(line, ": ")
+	if i <= 0 {
+		return e
+	}
+	phase, rest := line[:i], strings.TrimLeft(line[i+2:], " ")
+	done := strings.HasSuffix(rest, ", done.")
+	rest = strings.TrimSuffix(rest, ", done.")
+	if j := strings.Index(rest, ", "); j >= 0 {
+		rest = rest[:j]
+	}
+	var current, total uint64
+	var err error
+	if pct, counts, ok := strings.Cut(rest, "% ("); ok {
+		// "45% (9/20)"
+		c, t, ok := strings.Cut(strings.TrimSuffix(counts, ")"), "/")
+		if !ok || !strings.HasSuffix(counts, ")") {
+			return e
+		}
+		if _, err := strconv.ParseUint(pct, 10, 64); err != nil {
+			return e
+		}
+		if current, err = strconv.ParseUint(c, 10, 64); err != nil {
+			return e
+		}
+		if total, err = strconv.ParseUint(t, 10, 64); err != nil {
+			return e
+		}
+	} else if current, err = strconv.ParseUint(rest, 10, 64); err != nil {
+		return e
+	}
+	e.Phase, e.Current, e.Total, e.Done = phase, current, total, done
+	return e
+}
+
+// ProgressParser parses the report stream into ProgressEvents. It's an
+// io.Writer, so it can be the progress writer of PackReader or
+// SideBandReader. A message ends with "\r" while the phase goes on, and with
+// "\n" at the end. It can be split across writes.
+type ProgressParser struct {
+	f   func(*ProgressEvent)
+	buf []byte
+}
+
+// NewProgressParser returns a new ProgressParser that calls f for every
+// message.
+func NewProgressParser(f func(*ProgressEvent)) *ProgressParser {
+	return &ProgressParser{f: f}
+}
+
+// Write parses the messages in b. The last message is kept until its line
+// terminator is written.
+func (p *ProgressParser) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	start := 0
+	for {
+		i := bytes.IndexAny(p.buf[start:], "\r\n")
+		if i < 0 {
+			break
+		}
+		// Git pads a message with spaces to clear a longer previous one.
+		line := strings.TrimRight(string(p.buf[start:start+i]), " ")
+		start += i + 1
+		if line != "" {
+			p.f(ParseProgress(line))
+		}
+	}
+	p.buf = p.buf[:copy(p.buf, p.buf[start:])]
+	return len(b), nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"io"
+)
+
+// ProtocolDiscovery is the result of the ref discovery, the first response of
+// the server.
+type ProtocolDiscovery struct {
+	// ProtocolVersion is the protocol version the server speaks: 0, 1, or
+	// 2.
+	ProtocolVersion uint64
+	// Capabilities are the capabilities of the server. For protocol v2,
+	// these are the capability lines such as "fetch=shallow".
+	Capabilities []string
+	// Refs are the advertised refs for protocol v0 and v1. For an empty
+	// repository, this can contain the "capabilities^{}" pseudo ref.
+	Refs []*InfoRefsResponseChunk
+}
+
+// ReadProtocolDiscovery reads a ref advertisement (with or without the smart
+// HTTP service header) and returns the protocol version the server chose. A
+// server that doesn't understand the version request answers with a v0
+// advertisement, which is returned as is.
+func ReadProtocolDiscovery(rd io.Reader) (*ProtocolDiscovery, error) {
+	d := &ProtocolDiscovery{}
+	r := NewInfoRefsResponse(rd)
+	for r.Scan() {
+		c := r.Chunk()
+		switch {
+		case c.ProtocolVersion != 0:
+			d.ProtocolVersion = c.ProtocolVersion
+		case c.ObjectID != "":
+			if len(c.Capabilities) != 0 {
+				d.Capabilities = c.Capabilities
+			}
+			d.Refs = append(d.Refs, c)
+		case len(c.Capabilities) == 1:
+			d.Capabilities = append(d.Capabilities, c.Capabilities[0])
+		case c.EndOfRequest:
+			return d, nil
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return nil, SyntaxError("early EOF")
+}
+
+// DiscoveryOpener opens the ref discovery stream of a transport, requesting
+// the protocol version. For example, an HTTP transport sends
+// "Git-Protocol: version=2" when version is 2, and nothing when it's 0.
+type DiscoveryOpener func(ctx context.Context, version int) (io.ReadCloser, error)
+
+// DiscoverWithFallback requests protocol v2 and falls back to v0 like Git.
+//
+// A server that ignores the version request answers with a v0 advertisement on
+// the same stream, so the stream is used as is. Only if the v2 attempt fails
+// (e.g. the server rejects the request with an error), the stream is closed
+// and reopened without the version request.
+//
+// The returned stream is the one the advertisement was read from. Stateful
+// transports continue the exchange on it.
+func DiscoverWithFallback(ctx context.Context, open DiscoveryOpener) (*ProtocolDiscovery, io.ReadCloser, error) {
+	rc, err := open(ctx, 2)
+	if err == nil {
+		d, err := ReadProtocolDiscovery(rc)
+		if err == nil {
+			return d, rc, nil
+		}
+		rc.Close()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	rc, err = open(ctx, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	d, err := ReadProtocolDiscovery(rc)
+	if err != nil {
+		rc.Close()
+		return nil, nil, err
+	}
+	return d, rc, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	fallbackOID   = "1111111111111111111111111111111111111111"
+	v2Discovery   = "000eversion 2\n" + "0013agent=git/2.40\n" + "000cls-refs\n" + "0000"
+	httpDiscovery = "001e# service=git-upload-pack\n" + "0000"
+)
+
+var v0Discovery = pktLines(fallbackOID+" HEAD\x00multi_ack ofs-delta\n", fallbackOID+" refs/heads/main\n", "0000")
+
+func TestReadProtocolDiscovery(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		in       string
+		version  uint64
+		caps     []string
+		refNames []string
+	}{
+		{"v2", v2Discovery, 2, []string{"agent=git/2.40", "ls-refs"}, nil},
+		{"v0", v0Discovery, 0, []string{"multi_ack", "ofs-delta"}, []string{"HEAD", "refs/heads/main"}},
+		{"v0 over HTTP", httpDiscovery + v0Discovery, 0, []string{"multi_ack", "ofs-delta"}, []string{"HEAD", "refs/heads/main"}},
+	} {
+		d, err := ReadProtocolDiscovery(strings.NewReader(tc.in))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var names []string
+		for _, r := range d.Refs {
+			names = append(names, r.Ref)
+		}
+		if d.ProtocolVersion != tc.version || !reflect.DeepEqual(d.Capabilities, tc.caps) || !reflect.DeepEqual(names, tc.refNames) {
+			t.Errorf("%s: got version %d, capabilities %q, refs %q", tc.name, d.ProtocolVersion, d.Capabilities, names)
+		}
+	}
+}
+
+func TestReadProtocolDiscoveryErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"no flush", strings.TrimSuffix(v2Discovery, "0000")},
+		{"error", pktLines("ERR access denied\n")},
+		{"bad length", "zzzz"},
+	} {
+		if _, err := ReadProtocolDiscovery(strings.NewReader(tc.in)); err == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
+
+func TestDiscoverWithFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		responses map[int]string
+		versions  []int
+		want      uint64
+		wantErr   bool
+	}{
+		{"v2", map[int]string{2: v2Discovery}, []int{2}, 2, false},
+		{"v2 ignored", map[int]string{2: v0Discovery}, []int{2}, 0, false},
+		{"v2 rejected", map[int]string{2: pktLines("ERR unknown version\n"), 0: v0Discovery}, []int{2, 0}, 0, false},
+		{"v2 fails to open", map[int]string{0: v0Discovery}, []int{2, 0}, 0, false},
+		{"both fail", map[int]string{2: "", 0: ""}, []int{2, 0}, 0, true},
+	} {
+		var versions []int
+		open := func(ctx context.Context, version int) (io.ReadCloser, error) {
+			versions = append(versions, version)
+			s, ok := tc.responses[version]
+			if !ok {
+				return nil, errors.New("connection refused")
+			}
+			return io.NopCloser(strings.NewReader(s)), nil
+		}
+		d, rc, err := DiscoverWithFallback(context.Background(), open)
+		if !reflect.DeepEqual(versions, tc.versions) {
+			t.Errorf("%s: requested versions %v, want %v", tc.name, versions, tc.versions)
+		}
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: got no error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		rc.Close()
+		if d.ProtocolVersion != tc.want {
+			t.Errorf("%s: got version %d, want %d", tc.name, d.ProtocolVersion, tc.want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// PushCertificate is the push certificate of a signed push.
+type PushCertificate struct {
+	Pusher      string
+	Pushee      string
+	Nonce       string
+	PushOptions []string
+	Commands    []*ProtocolV1ReceivePackRequestChunk
+	// Payload is the signed bytes as received, from the "certificate
+	// version" line to the line before the signature.
+	Payload []byte
+	// Signature is the armored signature.
+	Signature []byte
+}
+
+// EncodePayload returns the certificate to sign, built from the fields: the
+// header lines, an empty line, and the commands. For a parsed certificate, it's
+// the same as Payload unless the client wrote it in an unusual way.
+func (c *PushCertificate) EncodePayload() []byte {
+	var b bytes.Buffer
+	b.WriteString("certificate version 0.1\n")
+	b.WriteString("pusher " + c.Pusher + "\n")
+	if c.Pushee != "" {
+		b.WriteString("pushee " + c.Pushee + "\n")
+	}
+	if c.Nonce != "" {
+		b.WriteString("nonce " + c.Nonce + "\n")
+	}
+	for _, o := range c.PushOptions {
+		b.WriteString("push-option " + o + "\n")
+	}
+	b.WriteString("\n")
+	for _, cmd := range c.Commands {
+		fmt.Fprintf(&b, "%s %s %s\n", cmd.OldObjectID, cmd.NewObjectID, cmd.RefName)
+	}
+	return b.Bytes()
+}
+
+// Chunks returns the chunks of the certificate in a receive-pack request, from
+// the StartOfPushCert chunk with the capabilities to the EndOfPushCert chunk.
+// The commands are only in the certificate, and an EndOfCommands chunk follows
+// them. The signature is sent a line per packet.
+func (c *PushCertificate) Chunks(capabilities []string) []*ProtocolV1ReceivePackRequestChunk {
+	ret := []*ProtocolV1ReceivePackRequestChunk{
+		{StartOfPushCert: true, Capabilities: capabilities},
+		{PushCertHeader: true},
+		{Pusher: c.Pusher},
+	}
+	if c.Pushee != "" {
+		ret = append(ret, &ProtocolV1ReceivePackRequestChunk{Pushee: c.Pushee})
+	}
+	if c.Nonce != "" {
+		ret = append(ret, &ProtocolV1ReceivePackRequestChunk{Nonce: c.Nonce})
+	}
+	for _, o := range c.PushOptions {
+		ret = append(ret, &ProtocolV1ReceivePackRequestChunk{CertPushOption: o})
+	}
+	ret = append(ret, &ProtocolV1ReceivePackRequestChunk{EndOfCertPushOptions: true})
+	for _, cmd := range c.Commands {
+		ret = append(ret, &ProtocolV1ReceivePackRequestChunk{
+			OldObjectID: cmd.OldObjectID,
+			NewObjectID: cmd.NewObjectID,
+			RefName:     cmd.RefName,
+			InPushCert:  true,
+		})
+	}
+	for _, line := range bytes.SplitAfter(c.Signature, []byte("\n")) {
+		if len(line) != 0 {
+			ret = append(ret, &ProtocolV1ReceivePackRequestChunk{GPGSignaturePart: line})
+		}
+	}
+	return append(ret, &ProtocolV1ReceivePackRequestChunk{EndOfPushCert: true})
+}
+
+// Signature formats.
+const (
+	SignatureFormatOpenPGP = "openpgp"
+	SignatureFormatSSH     = "ssh"
+	SignatureFormatX509    = "x509"
+)
+
+// SignatureFormat returns the format of the signature, or "" if unknown.
+func (c *PushCertificate) SignatureFormat() string {
+	switch {
+	case bytes.HasPrefix(c.Signature, []byte("-----BEGIN PGP SIGNATURE-----")):
+		return SignatureFormatOpenPGP
+	case bytes.HasPrefix(c.Signature, []byte("-----BEGIN SSH SIGNATURE-----")):
+		return SignatureFormatSSH
+	case bytes.HasPrefix(c.Signature, []byte("-----BEGIN SIGNED MESSAGE-----")):
+		return SignatureFormatX509
+	}
+	return ""
+}
+
+// Push certificate signature statuses. The values are the same as
+// GIT_PUSH_CERT_STATUS of git-receive-pack.
+const (
+	PushCertStatusGood            = "G"
+	PushCertStatusBad             = "B"
+	PushCertStatusUnknownValidity = "U"
+	PushCertStatusExpired         = "X"
+	PushCertStatusExpiredKey      = "Y"
+	PushCertStatusRevokedKey      = "R"
+	PushCertStatusCannotCheck     = "E"
+	PushCertStatusNoSignature     = "N"
+)
+
+// PushCertVerification is the result of verifying a push certificate.
+type PushCertVerification struct {
+	// Status is one of PushCertStatus*.
+	Status string
+	// Signer is the identity of the signer, e.g. the UID of the GPG key.
+	Signer string
+	// Key is the fingerprint of the signing key.
+	Key string
+
+	NonceStatus PushCertNonceStatus
+	NonceSlop   time.Duration
+}
+
+// Accepted returns true if the signature is good and the nonce is valid or
+// not used.
+func (v *PushCertVerification) Accepted() bool {
+	if v.Status != PushCertStatusGood {
+		return false
+	}
+	return v.NonceStatus == "" || v.NonceStatus == PushCertNonceOK
+}
+
+// RejectedRefStatuses returns "ng" statuses of the commands if the certificate
+// is not accepted, and nil otherwise. A server can report them instead of
+// updating the refs.
+func (v *PushCertVerification) RejectedRefStatuses(cert *PushCertificate) []*RefStatus {
+	if v.Accepted() {
+		return nil
+	}
+	reason := "invalid push certificate signature"
+	if v.Status == PushCertStatusGood {
+		reason = "invalid push certificate nonce"
+	}
+	var ret []*RefStatus
+	for _, c := range cert.Commands {
+		ret = append(ret, &RefStatus{RefName: c.RefName, Reason: reason})
+	}
+	return ret
+}
+
+// PushCertVerifier verifies the signature of a push certificate. An
+// implementation can use GPG, ssh-keygen -Y verify, etc. depending on the
+// signature format.
+type PushCertVerifier interface {
+	// VerifyPushCert returns the signature status, the signer, and the key.
+	// The nonce fields are filled by VerifyPushCertificate. An error means
+	// the verification couldn't be done.
+	VerifyPushCert(ctx context.Context, cert *PushCertificate) (*PushCertVerification, error)
+}
+
+// PushCertVerifierFunc is a function that implements PushCertVerifier.
+type PushCertVerifierFunc func(ctx context.Context, cert *PushCertificate) (*PushCertVerification, error)
+
+// VerifyPushCert calls f.
+func (f PushCertVerifierFunc) VerifyPushCert(ctx context.Context, cert *PushCertificate) (*PushCertVerification, error) {
+	return f(ctx, cert)
+}
+
+// VerifyPushCertificate verifies the certificate with the verifier and checks
+// its nonce against the advertised nonce with n. If n is nil, the nonce is not
+// checked.
+func VerifyPushCertificate(ctx context.Context, cert *PushCertificate, verifier PushCertVerifier, n *PushCertNonce, advertisedNonce string) (*PushCertVerification, error) {
+	var v *PushCertVerification
+	if len(cert.Signature) == 0 {
+		v = &PushCertVerification{Status: PushCertStatusNoSignature}
+	} else {
+		var err error
+		if v, err = verifier.VerifyPushCert(ctx, cert); err != nil {
+			return nil, err
+		}
+	}
+	if n != nil {
+		v.NonceStatus, v.NonceSlop = n.Check(advertisedNonce, cert.Nonce)
+	}
+	return v, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PushCertNonceStatus is the result of checking the nonce of a push
+// certificate. The values are the same as GIT_PUSH_CERT_NONCE_STATUS of
+// git-receive-pack.
+type PushCertNonceStatus string
+
+// Push certificate nonce statuses.
+const (
+	// PushCertNonceUnsolicited means the server didn't advertise a nonce,
+	// whether or not the client sent one.
+	PushCertNonceUnsolicited PushCertNonceStatus = "UNSOLICITED"
+	// PushCertNonceMissing means the client didn't send the nonce.
+	PushCertNonceMissing PushCertNonceStatus = "MISSING"
+	// PushCertNonceBad means the nonce was not issued by the server.
+	PushCertNonceBad PushCertNonceStatus = "BAD"
+	// PushCertNonceOK means the nonce is valid.
+	PushCertNonceOK PushCertNonceStatus = "OK"
+	// PushCertNonceSlop means the nonce was issued by the server but out of
+	// the slop window.
+	PushCertNonceSlop PushCertNonceStatus = "SLOP"
+)
+
+// PushCertNonce generates and checks push certificate nonces in the same way
+// as git-receive-pack, so that a nonce issued by one can be checked by the
+// other. A nonce is "<timestamp>-<HMAC hex>", where the HMAC uses the hash
+// algorithm of the repository.
+type PushCertNonce struct {
+	// Seed is the secret key. It corresponds to receive.certNonceSeed.
+	Seed string
+	// Path identifies the repository. It's the repository path in
+	// git-receive-pack.
+	Path string
+	// SlopLimit is how far the timestamp of a nonce issued by the server can
+	// be from the advertised nonce. It corresponds to
+	// receive.certNonceSlop.
+	SlopLimit time.Duration
+	// StatelessRPC is true for a stateless transport such as HTTP, where the
+	// nonce is advertised by a different request than the push.
+	StatelessRPC bool
+	// HashAlgo is the hash algorithm of the repository. If nil, SHA-1 is
+	// used.
+	HashAlgo *HashAlgo
+}
+
+// Generate returns the nonce for the time.
+func (n *PushCertNonce) Generate(t time.Time) string {
+	return n.generate(t.Unix())
+}
+
+func (n *PushCertNonce) generate(stamp int64) string {
+	// git-receive-pack uses "path:timestamp" as the key and the seed as the
+	// message.
+	algo := n.HashAlgo
+	if algo == nil {
+		algo = HashAlgoSHA1
+	}
+	mac := hmac.New(algo.New, []byte(fmt.Sprintf("%s:%d", n.Path, stamp)))
+	mac.Write([]byte(n.Seed))
+	return fmt.Sprintf("%d-%s", stamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Check checks the nonce received in a push certificate against the nonce
+// advertised. advertised is "" if the server didn't advertise a nonce. It
+// returns the status and the difference of the timestamps, which is
+// GIT_PUSH_CERT_NONCE_SLOP in git-receive-pack.
+func (n *PushCertNonce) Check(advertised, received string) (PushCertNonceStatus, time.Duration) {
+	if advertised == "" {
+		return PushCertNonceUnsolicited, 0
+	}
+	if received == "" {
+		return PushCertNonceMissing, 0
+	}
+	if received == advertised {
+		return PushCertNonceOK, 0
+	}
+	if !n.StatelessRPC {
+		// The same connection advertised the nonce, so it must match.
+		return PushCertNonceBad, 0
+	}
+	stamp, ok := nonceStamp(received)
+	if !ok || !hmac.Equal([]byte(n.generate(stamp)), []byte(received)) {
+		return PushCertNonceBad, 0
+	}
+	ostamp, ok := nonceStamp(advertised)
+	if !ok {
+		return PushCertNonceBad, 0
+	}
+	slop := time.Duration(ostamp-stamp) * time.Second
+	abs := slop
+	if abs < 0 {
+		abs = -abs
+	}
+	if n.SlopLimit > 0 && abs <= n.SlopLimit {
+		return PushCertNonceOK, slop
+	}
+	return PushCertNonceSlop, slop
+}
+
+func nonceStamp(nonce string) (int64, bool) {
+	// As check_nonce of git-receive-pack, a stamp starts with 1-9.
+	if nonce == "" || nonce[0] < '1' || '9' < nonce[0] {
+		return 0, false
+	}
+	i := strings.IndexByte(nonce, '-')
+	if i <= 0 {
+		return 0, false
+	}
+	stamp, err := strconv.ParseInt(nonce[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return stamp, true
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushCertNonceGenerate(t *testing.T) {
+	n := &PushCertNonce{Seed: "seed", Path: "/repo", HashAlgo: HashAlgoSHA256}
+	mac := hmac.New(sha256.New, []byte("/repo:1500000000"))
+	mac.Write([]byte("seed"))
+	want := "1500000000-" + hex.EncodeToString(mac.Sum(nil))
+	if got := n.Generate(time.Unix(1500000000, 0)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	sha1Nonce := (&PushCertNonce{Seed: "seed", Path: "/repo"}).Generate(time.Unix(1500000000, 0))
+	if len(sha1Nonce) != len("1500000000-")+40 {
+		t.Errorf("unexpected SHA-1 nonce: %s", sha1Nonce)
+	}
+}
+
+func TestPushCertNonceCheck(t *testing.T) {
+	n := &PushCertNonce{Seed: "seed", Path: "/repo", SlopLimit: time.Minute, StatelessRPC: true}
+	now := time.Unix(1500000000, 0)
+	advertised := n.Generate(now)
+	forged := strings.Replace(n.Generate(now.Add(-time.Second)), "1499999999", "1499999998", 1)
+	for _, tc := range []struct {
+		name       string
+		n          *PushCertNonce
+		advertised string
+		received   string
+		want       PushCertNonceStatus
+	}{
+		{"missing", n, advertised, "", PushCertNonceMissing},
+		{"unsolicited", n, "", advertised, PushCertNonceUnsolicited},
+		{"unsolicited without a nonce", n, "", "", PushCertNonceUnsolicited},
+		{"same", n, advertised, advertised, PushCertNonceOK},
+		{"in slop", n, advertised, n.Generate(now.Add(-time.Second)), PushCertNonceOK},
+		{"out of slop", n, advertised, n.Generate(now.Add(-time.Hour)), PushCertNonceSlop},
+		{"forged", n, advertised, forged, PushCertNonceBad},
+		{"no stamp", n, advertised, "-" + advertised, PushCertNonceBad},
+		// Signed, but git rejects a stamp starting with 0.
+		{"zero stamp", n, advertised, n.generate(0), PushCertNonceBad},
+		{"other algorithm", &PushCertNonce{Seed: "seed", Path: "/repo", SlopLimit: time.Minute, StatelessRPC: true, HashAlgo: HashAlgoSHA256}, advertised, n.Generate(now.Add(-time.Second)), PushCertNonceBad},
+		{"stateful", &PushCertNonce{Seed: "seed", Path: "/repo", SlopLimit: time.Minute}, advertised, n.Generate(now.Add(-time.Second)), PushCertNonceBad},
+	} {
+		if got, _ := tc.n.Check(tc.advertised, tc.received); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
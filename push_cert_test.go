@@ -0,0 +1,165 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSignature = "-----BEGIN PGP SIGNATURE-----\nabc\n-----END PGP SIGNATURE-----\n"
+
+func TestPushCertificateRoundTrip(t *testing.T) {
+	cert := &PushCertificate{
+		Pusher:      "A U Thor <author@example.com> 1500000000 +0000",
+		Pushee:      "https://example.com/repo",
+		Nonce:       "1500000000-abc",
+		PushOptions: []string{"ci.skip"},
+		Commands: []*ProtocolV1ReceivePackRequestChunk{
+			{OldObjectID: oidA, NewObjectID: oidB, RefName: "refs/heads/main"},
+		},
+		Signature: []byte(testSignature),
+	}
+	var b bytes.Buffer
+	e := NewProtocolV1ReceivePackRequestEncoder(&b)
+	chunks := append(cert.Chunks([]string{"report-status"}), &ProtocolV1ReceivePackRequestChunk{EndOfCommands: true})
+	for _, c := range chunks {
+		if err := e.WriteChunk(c); err != nil {
+			t.Fatalf("WriteChunk(%#v): %v", c, err)
+		}
+	}
+
+	r := NewProtocolV1ReceivePackRequest(&b)
+	var caps []string
+	for r.Scan() {
+		if c := r.Chunk(); c.StartOfPushCert {
+			caps = c.Capabilities
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"report-status"}; !reflect.DeepEqual(caps, want) {
+		t.Errorf("capabilities: got %q, want %q", caps, want)
+	}
+	got := r.PushCertificate()
+	if got == nil {
+		t.Fatal("no push certificate")
+	}
+	if got.Pusher != cert.Pusher || got.Pushee != cert.Pushee || got.Nonce != cert.Nonce || !reflect.DeepEqual(got.PushOptions, cert.PushOptions) {
+		t.Errorf("got %+v, want %+v", got, cert)
+	}
+	if len(got.Commands) != 1 || got.Commands[0].RefName != "refs/heads/main" || !got.Commands[0].InPushCert {
+		t.Errorf("commands: got %+v", got.Commands)
+	}
+	if !bytes.Equal(got.Payload, cert.EncodePayload()) {
+		t.Errorf("payload: got %q, want %q", got.Payload, cert.EncodePayload())
+	}
+	if string(got.Signature) != testSignature || got.SignatureFormat() != SignatureFormatOpenPGP {
+		t.Errorf("signature: got %q (%q)", got.Signature, got.SignatureFormat())
+	}
+}
+
+func TestPushCertificateErrors(t *testing.T) {
+	command := oidA + " " + oidB + " refs/heads/main\n"
+	for _, tc := range []struct {
+		name  string
+		lines []string
+	}{
+		{"version", []string{"push-cert\x00\n", "certificate version 0.2\n"}},
+		{"no pusher", []string{"push-cert\x00\n", "certificate version 0.1\n", "pushee x\n"}},
+		{"unknown header", []string{"push-cert\x00\n", "certificate version 0.1\n", "pusher p\n", "foo bar\n"}},
+		{"pushee after nonce", []string{"push-cert\x00\n", "certificate version 0.1\n", "pusher p\n", "nonce n\n", "pushee x\n"}},
+		{"flush in header", []string{"push-cert\x00\n", "certificate version 0.1\n", "0000"}},
+		{"bad command", []string{"push-cert\x00\n", "certificate version 0.1\n", "pusher p\n", "\n", "x y\n"}},
+		{"bad object ID", []string{"push-cert\x00\n", "certificate version 0.1\n", "pusher p\n", "\n", "x y refs/heads/main\n"}},
+		{"no signature", []string{"push-cert\x00\n", "certificate version 0.1\n", "pusher p\n", "\n", command, "push-cert-end\n"}},
+		{"early EOF", []string{"push-cert\x00\n", "certificate version 0.1\n", "pusher p\n", "\n", command}},
+	} {
+		r := NewProtocolV1ReceivePackRequest(strings.NewReader(pktLines(tc.lines...)))
+		for r.Scan() {
+		}
+		if r.Err() == nil || r.PushCertificate() != nil {
+			t.Errorf("%s: got %v, %v, want an error", tc.name, r.Err(), r.PushCertificate())
+		}
+	}
+}
+
+func TestPushCertificateSignatureFormat(t *testing.T) {
+	for _, tc := range []struct {
+		sig  string
+		want string
+	}{
+		{testSignature, SignatureFormatOpenPGP},
+		{"-----BEGIN SSH SIGNATURE-----\n", SignatureFormatSSH},
+		{"-----BEGIN SIGNED MESSAGE-----\n", SignatureFormatX509},
+		{"signature\n", ""},
+	} {
+		if got := (&PushCertificate{Signature: []byte(tc.sig)}).SignatureFormat(); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.sig, got, tc.want)
+		}
+	}
+}
+
+func TestVerifyPushCertificate(t *testing.T) {
+	good := PushCertVerifierFunc(func(context.Context, *PushCertificate) (*PushCertVerification, error) {
+		return &PushCertVerification{Status: PushCertStatusGood, Signer: "A U Thor"}, nil
+	})
+	n := &PushCertNonce{Seed: "seed", Path: "/repo"}
+	nonce := n.Generate(time.Unix(1500000000, 0))
+	cert := &PushCertificate{
+		Nonce:     nonce,
+		Commands:  []*ProtocolV1ReceivePackRequestChunk{{RefName: "refs/heads/main"}},
+		Signature: []byte(testSignature),
+	}
+	for _, tc := range []struct {
+		name       string
+		cert       *PushCertificate
+		n          *PushCertNonce
+		advertised string
+		want       string
+	}{
+		{"good", cert, n, nonce, ""},
+		{"nonce not checked", cert, nil, "", ""},
+		{"bad nonce", cert, n, n.Generate(time.Unix(1400000000, 0)), "invalid push certificate nonce"},
+		{"no signature", &PushCertificate{Commands: cert.Commands}, nil, "", "invalid push certificate signature"},
+	} {
+		v, err := VerifyPushCertificate(context.Background(), tc.cert, good, tc.n, tc.advertised)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var got string
+		if ss := v.RejectedRefStatuses(tc.cert); len(ss) != 0 {
+			got = ss[0].Reason
+		}
+		if got != tc.want || v.Accepted() != (tc.want == "") {
+			t.Errorf("%s: got %q (accepted %v), want %q", tc.name, got, v.Accepted(), tc.want)
+		}
+	}
+
+	errVerify := errors.New("no gpg")
+	failing := PushCertVerifierFunc(func(context.Context, *PushCertificate) (*PushCertVerification, error) {
+		return nil, errVerify
+	})
+	if _, err := VerifyPushCertificate(context.Background(), cert, failing, nil, ""); err != errVerify {
+		t.Errorf("got %v, want %v", err, errVerify)
+	}
+}
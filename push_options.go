@@ -0,0 +1,49 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PushOptionsChunks returns the push-options section of a receive-pack request:
+// an option per chunk and the EndOfPushOptions chunk. It's an error if an option
+// has a newline, as Git rejects.
+func PushOptionsChunks(options []string) ([]*ProtocolV1ReceivePackRequestChunk, error) {
+	var ret []*ProtocolV1ReceivePackRequestChunk
+	for _, o := range options {
+		if o == "" || strings.ContainsAny(o, "\n\x00") {
+			return nil, SyntaxError(fmt.Sprintf("invalid push option: %q", o))
+		}
+		ret = append(ret, &ProtocolV1ReceivePackRequestChunk{PushOption: o})
+	}
+	return append(ret, &ProtocolV1ReceivePackRequestChunk{EndOfPushOptions: true}), nil
+}
+
+// PushOptionsEnv returns the environment variables that git-receive-pack sets
+// for the pre-receive and post-receive hooks: GIT_PUSH_OPTION_COUNT and
+// GIT_PUSH_OPTION_0, GIT_PUSH_OPTION_1, and so on. It returns nil if the client
+// didn't negotiate push-options (options is nil).
+func PushOptionsEnv(options []string) []string {
+	if options == nil {
+		return nil
+	}
+	ret := []string{fmt.Sprintf("GIT_PUSH_OPTION_COUNT=%d", len(options))}
+	for i, o := range options {
+		ret = append(ret, fmt.Sprintf("GIT_PUSH_OPTION_%d=%s", i, o))
+	}
+	return ret
+}
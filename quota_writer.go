@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"strings"
+)
+
+// QuotaFunc is called before a chunk of pack data is sent. sent is the number
+// of pack bytes sent so far in the session, and n is the size of the chunk. A
+// non-nil error aborts the transfer. Its message is sent to the client.
+type QuotaFunc func(sent, n int64) error
+
+// QuotaWriter streams pack data to the client, consulting a QuotaFunc for
+// every chunk. When the quota is exhausted, it sends the error message on the
+// sideband error channel so that the client shows it, instead of just dropping
+// the connection.
+type QuotaWriter struct {
+	w           io.Writer
+	payloadSize int
+	quota       QuotaFunc
+	sent        int64
+	err         error
+}
+
+// NewQuotaWriter returns a new QuotaWriter. payloadSize is the sideband payload
+// size: MaxSideBandPayloadSize for side-band-64k and protocol v2, 999 for
+// side-band. If payloadSize is zero, the pack is sent without the sideband and
+// an exhausted quota just stops the stream.
+func NewQuotaWriter(w io.Writer, payloadSize int, quota QuotaFunc) *QuotaWriter {
+	return &QuotaWriter{w: w, payloadSize: payloadSize, quota: quota}
+}
+
+// Write sends the pack data p. After the quota is exhausted, it keeps
+// returning the quota error.
+func (w *QuotaWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) != 0 {
+		sz := len(p)
+		if w.payloadSize > 0 && sz > w.payloadSize {
+			sz = w.payloadSize
+		}
+		if err := w.quota(w.sent, int64(sz)); err != nil {
+			w.err = err
+			if w.payloadSize > 0 {
+				msg := err.Error()
+				if !strings.HasSuffix(msg, "\n") {
+					msg += "\n"
+				}
+				w.w.Write(SideBandErrorPacket(msg).EncodeToPktLine())
+			}
+			return written, err
+		}
+		var err error
+		if w.payloadSize > 0 {
+			_, err = w.w.Write(SideBandMainPacket(p[:sz]).EncodeToPktLine())
+		} else {
+			_, err = w.w.Write(p[:sz])
+		}
+		if err != nil {
+			w.err = err
+			return written, err
+		}
+		w.sent += int64(sz)
+		written += sz
+		p = p[sz:]
+	}
+	return written, nil
+}
+
+// Sent returns the number of pack bytes sent.
+func (w *QuotaWriter) Sent() int64 {
+	return w.sent
+}
+
+// Err returns the error that stopped the stream, if any.
+func (w *QuotaWriter) Err() error {
+	return w.err
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestQuotaWriter(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	quota := func(sent, n int64) error {
+		if sent+n > 6 {
+			return errQuota
+		}
+		return nil
+	}
+	for _, tc := range []struct {
+		name        string
+		payloadSize int
+		want        string
+		wantSent    int64
+		wantWritten int
+	}{
+		{"sideband", 3, pktLines("\x01abc", "\x01def", "\x03quota exceeded\n"), 6, 6},
+		{"no sideband", 0, "", 0, 0},
+	} {
+		var b bytes.Buffer
+		w := NewQuotaWriter(&b, tc.payloadSize, quota)
+		n, err := w.Write([]byte("abcdefgh"))
+		if err != errQuota || n != tc.wantWritten {
+			t.Errorf("%s: got %d, %v, want %d, %v", tc.name, n, err, tc.wantWritten, errQuota)
+		}
+		if b.String() != tc.want || w.Sent() != tc.wantSent {
+			t.Errorf("%s: got %q (%d sent), want %q", tc.name, b.String(), w.Sent(), tc.want)
+		}
+		if _, err := w.Write([]byte("i")); err != errQuota || w.Err() != errQuota {
+			t.Errorf("%s: got %v after the quota is exhausted", tc.name, err)
+		}
+	}
+}
+
+func TestQuotaWriterWithinQuota(t *testing.T) {
+	var sizes []int64
+	var b bytes.Buffer
+	w := NewQuotaWriter(&b, 0, func(sent, n int64) error {
+		sizes = append(sizes, sent, n)
+		return nil
+	})
+	for _, s := range []string{"PACK", "data"} {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.String() != "PACKdata" || w.Sent() != 8 || w.Err() != nil {
+		t.Errorf("got %q, %d sent, %v", b.String(), w.Sent(), w.Err())
+	}
+	if len(sizes) != 4 || sizes[2] != 4 || sizes[3] != 4 {
+		t.Errorf("got quota calls %v, want [0 4 4 4]", sizes)
+	}
+}
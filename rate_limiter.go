@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by TokenBucket when a packet would have to wait
+// longer than MaxWait.
+var ErrRateLimited = ErrorPacket("rate limit exceeded")
+
+// RateLimiter throttles the packets read by a PacketScanner or written by a
+// RateLimitedWriter.
+//
+// The limiter is consulted per packet, not per Read or Write, so a packet is
+// never split by the throttling.
+type RateLimiter interface {
+	// WaitPacket is called after a packet of the wire size (including the
+	// length prefix) is read or written. It blocks to keep the rate, or
+	// returns an error to abort the stream. Pack file data after a raw
+	// "PACK" header is reported per chunk.
+	WaitPacket(size int) error
+}
+
+// TokenBucket is a RateLimiter that limits bytes and packets per second with
+// token buckets. It's safe for concurrent use, so one TokenBucket can limit all
+// the streams of a client.
+type TokenBucket struct {
+	// MaxWait is the longest a packet may wait. If a packet would wait
+	// longer, WaitPacket returns ErrRateLimited. If zero, it waits as long
+	// as needed.
+	MaxWait time.Duration
+
+	m       sync.Mutex
+	bytes   bucket
+	packets bucket
+}
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take removes n tokens and returns how long the caller needs to wait until
+// the bucket is not in debt.
+func (b *bucket) take(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// NewTokenBucket returns a new TokenBucket. A zero rate means no limit.
+func NewTokenBucket(bytesPerSecond float64, burstBytes int, packetsPerSecond float64, burstPackets int) *TokenBucket {
+	now := time.Now()
+	return &TokenBucket{
+		bytes:   bucket{rate: bytesPerSecond, burst: float64(burstBytes), tokens: float64(burstBytes), last: now},
+		packets: bucket{rate: packetsPerSecond, burst: float64(burstPackets), tokens: float64(burstPackets), last: now},
+	}
+}
+
+// WaitPacket implements RateLimiter.
+func (t *TokenBucket) WaitPacket(size int) error {
+	t.m.Lock()
+	now := time.Now()
+	bytes, packets := t.bytes, t.packets
+	wait := t.bytes.take(now, float64(size))
+	if w := t.packets.take(now, 1); w > wait {
+		wait = w
+	}
+	if t.MaxWait > 0 && wait > t.MaxWait {
+		// Don't charge a packet that is rejected.
+		t.bytes, t.packets = bytes, packets
+		t.m.Unlock()
+		return ErrRateLimited
+	}
+	t.m.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	return nil
+}
+
+// RateLimitedWriter is a writer that consults a RateLimiter for every packet
+// written through it.
+type RateLimitedWriter struct {
+	w       io.Writer
+	limiter RateLimiter
+	framer  packetFramer
+}
+
+// NewRateLimitedWriter returns a new RateLimitedWriter that writes to w.
+func NewRateLimitedWriter(w io.Writer, limiter RateLimiter) *RateLimitedWriter {
+	return &RateLimitedWriter{w: w, limiter: limiter}
+}
+
+// Write writes p, waiting for the limiter after every packet that ends in p.
+func (w *RateLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		i, size, err := w.framer.next(p)
+		if err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(p[:i])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if size != 0 {
+			if err := w.limiter.WaitPacket(size); err != nil {
+				return written, err
+			}
+		}
+		p = p[i:]
+	}
+	return written, nil
+}
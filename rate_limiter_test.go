@@ -0,0 +1,114 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingLimiter records the packet sizes and fails after limit packets.
+type recordingLimiter struct {
+	sizes []int
+	limit int
+}
+
+func (l *recordingLimiter) WaitPacket(size int) error {
+	l.sizes = append(l.sizes, size)
+	if l.limit != 0 && len(l.sizes) >= l.limit {
+		return errors.New("limited")
+	}
+	return nil
+}
+
+func TestTokenBucket(t *testing.T) {
+	tb := NewTokenBucket(1000, 100, 0, 0)
+	tb.MaxWait = time.Second
+	start := time.Now()
+	for _, size := range []int{100, 50} {
+		if err := tb.WaitPacket(size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The burst covers the first packet, and the second waits 50ms.
+	if d := time.Since(start); d < 40*time.Millisecond || d > 900*time.Millisecond {
+		t.Errorf("waited %v, want about 50ms", d)
+	}
+	if err := tb.WaitPacket(5000); err != ErrRateLimited {
+		t.Errorf("got %v, want %v", err, ErrRateLimited)
+	}
+	// The rejected packet isn't charged.
+	start = time.Now()
+	if err := tb.WaitPacket(1); err != nil || time.Since(start) > 900*time.Millisecond {
+		t.Errorf("got %v after %v", err, time.Since(start))
+	}
+
+	tb = NewTokenBucket(0, 0, 10, 1)
+	tb.MaxWait = time.Millisecond
+	if err := tb.WaitPacket(MaxPacketSize); err != nil {
+		t.Errorf("the first packet: %v", err)
+	}
+	if err := tb.WaitPacket(4); err != ErrRateLimited {
+		t.Errorf("the second packet: got %v, want %v", err, ErrRateLimited)
+	}
+}
+
+func TestRateLimitedWriter(t *testing.T) {
+	in := pktLines("abc\n", "0000") + "PACKxyz"
+	l := &recordingLimiter{}
+	var b bytes.Buffer
+	w := NewRateLimitedWriter(&b, l)
+	for i := 0; i < len(in); i += 3 {
+		if _, err := w.Write([]byte(in[i:min(i+3, len(in))])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.String() != in {
+		t.Errorf("got %q, want %q", b.String(), in)
+	}
+	// The pack data is reported per write.
+	if want := []int{8, 4, 4, 2, 1}; !reflect.DeepEqual(l.sizes, want) {
+		t.Errorf("got sizes %v, want %v", l.sizes, want)
+	}
+
+	w = NewRateLimitedWriter(&b, &recordingLimiter{limit: 1})
+	if n, err := w.Write([]byte(in)); err == nil || n != 8 {
+		t.Errorf("got %d, %v, want the limiter error after the first packet", n, err)
+	}
+	w = NewRateLimitedWriter(&b, &recordingLimiter{})
+	if _, err := w.Write([]byte("zzzz")); err == nil {
+		t.Error("got no error for a bad packet length")
+	}
+}
+
+func TestPacketScannerRateLimiter(t *testing.T) {
+	l := &recordingLimiter{limit: 2}
+	s := NewPacketScanner(strings.NewReader(pktLines("abc\n", "0000", "de\n")))
+	s.SetRateLimiter(l)
+	n := 0
+	for s.Scan() {
+		n++
+	}
+	if n != 1 || s.Err() == nil {
+		t.Errorf("got %d packets and %v, want the limiter error at the second packet", n, s.Err())
+	}
+	if want := []int{8, 4}; !reflect.DeepEqual(l.sizes, want) {
+		t.Errorf("got sizes %v, want %v", l.sizes, want)
+	}
+}
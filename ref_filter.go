@@ -0,0 +1,195 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import "strings"
+
+// RefFilter decides how a ref is advertised. It returns the name to advertise
+// the ref as, which is the ref itself to keep it as is, and false to hide it.
+// The ref never has the peeled suffix "^{}".
+//
+// Use InfoRefs and LsRefs to apply it to the advertisements in a Relay.
+type RefFilter func(ref string) (string, bool)
+
+// InfoRefs returns a RelayInterceptor that applies the filter to a v0/v1 ref
+// advertisement (InfoRefsResponse). Use a new one for every advertisement, as
+// it keeps state across the chunks.
+//
+// If the first ref, which carries the capabilities, is hidden, the
+// capabilities move to the next advertised ref, or to a "capabilities^{}"
+// line if every ref is hidden. The peeled line "<ref>^{}" of an annotated tag
+// follows its ref: it's hidden or renamed with it. The "symref=<ref>:<target>"
+// capabilities are renamed too, and dropped if either side is hidden.
+func (f RefFilter) InfoRefs() RelayInterceptor[*InfoRefsResponseChunk] {
+	var caps []string
+	// The last ref that is not a peeled line and what the filter returned.
+	var last, lastName string
+	var lastOK bool
+	return func(c *InfoRefsResponseChunk) ([]*InfoRefsResponseChunk, error) {
+		if c.ObjectID == "" {
+			if c.EndOfRequest && caps != nil {
+				empty := &InfoRefsResponseChunk{
+					Capabilities: caps,
+					ObjectID:     ObjectFormatFromCapabilities(caps).ZeroObjectID(),
+					Ref:          "capabilities^{}",
+				}
+				caps = nil
+				return []*InfoRefsResponseChunk{empty, c}, nil
+			}
+			return []*InfoRefsResponseChunk{c}, nil
+		}
+		if c.Capabilities != nil {
+			caps = f.symrefCapabilities(c.Capabilities)
+		}
+		ref := c.RefName()
+		if ref == "" {
+			// "capabilities^{}". It's written at the end if no ref takes
+			// the capabilities.
+			return nil, nil
+		}
+		name, ok := lastName, lastOK
+		if !c.IsPeeled() {
+			name, ok = f(ref)
+			last, lastName, lastOK = ref, name, ok
+		} else if ref != last {
+			name, ok = f(ref)
+		}
+		if !ok {
+			return nil, nil
+		}
+		if c.IsPeeled() {
+			name += "^{}"
+		}
+		ret := &InfoRefsResponseChunk{
+			Capabilities: caps,
+			ObjectID:     c.ObjectID,
+			Ref:          name,
+		}
+		caps = nil
+		return []*InfoRefsResponseChunk{ret}, nil
+	}
+}
+
+// symrefCapabilities applies the filter to the "symref=<ref>:<target>"
+// capabilities. The other capabilities are returned as they are.
+func (f RefFilter) symrefCapabilities(caps []string) []string {
+	ret := make([]string, 0, len(caps))
+	for _, c := range caps {
+		ss := strings.SplitN(strings.TrimPrefix(c, "symref="), ":", 2)
+		if !strings.HasPrefix(c, "symref=") || len(ss) != 2 {
+			ret = append(ret, c)
+			continue
+		}
+		ref, ok := f(ss[0])
+		if !ok {
+			continue
+		}
+		target := f.symrefTarget(ss[1])
+		if target == "" {
+			continue
+		}
+		ret = append(ret, "symref="+ref+":"+target)
+	}
+	return ret
+}
+
+// LsRefs returns a RelayInterceptor that applies the filter to a protocol v2
+// ls-refs response (LsRefsResponse).
+//
+// The peeled object ID is an attribute of the ref line, so it goes with the
+// ref. A symref-target is renamed, and dropped if the target is hidden, so
+// that the name of a hidden ref doesn't leak; the symbolic ref itself is
+// still advertised.
+func (f RefFilter) LsRefs() RelayInterceptor[*LsRefsResponseChunk] {
+	return func(c *LsRefsResponseChunk) ([]*LsRefsResponseChunk, error) {
+		if c.Ref == "" {
+			return []*LsRefsResponseChunk{c}, nil
+		}
+		name, ok := f(c.Ref)
+		if !ok {
+			return nil, nil
+		}
+		ret := *c
+		ret.Ref = name
+		if c.SymrefTarget != "" {
+			ret.SymrefTarget = f.symrefTarget(c.SymrefTarget)
+		}
+		return []*LsRefsResponseChunk{&ret}, nil
+	}
+}
+
+// symrefTarget returns the name to advertise the target of a symbolic ref as,
+// or "" if the target is hidden.
+func (f RefFilter) symrefTarget(target string) string {
+	if name, ok := f(target); ok {
+		return name
+	}
+	return ""
+}
+
+// keepRefs returns a RefFilter that keeps the refs for which keep returns true
+// as they are and hides the others.
+func keepRefs(keep func(ref string) bool) RefFilter {
+	return func(ref string) (string, bool) {
+		return ref, keep(ref)
+	}
+}
+
+// filterInfoRefsResponse applies the filter to a whole v0/v1 ref
+// advertisement, as InfoRefs does.
+func (f RefFilter) filterInfoRefsResponse(chunks []*InfoRefsResponseChunk) []*InfoRefsResponseChunk {
+	intercept := f.InfoRefs()
+	var ret []*InfoRefsResponseChunk
+	for _, c := range chunks {
+		// The interceptor never fails.
+		cs, _ := intercept(c)
+		ret = append(ret, cs...)
+	}
+	return ret
+}
+
+// filterLsRefsResponse applies the filter to the lines of an ls-refs response,
+// as LsRefs does. The other attributes of a line are kept as they are.
+func (f RefFilter) filterLsRefsResponse(chunks []*ProtocolV2ResponseChunk) []*ProtocolV2ResponseChunk {
+	var ret []*ProtocolV2ResponseChunk
+	for _, c := range chunks {
+		// "<oid> <ref> [attributes...]" or "unborn <ref> ..."
+		line := strings.TrimSuffix(string(c.Response), "\n")
+		fields := strings.Split(line, " ")
+		if len(fields) < 2 {
+			ret = append(ret, c)
+			continue
+		}
+		name, ok := f(fields[1])
+		if !ok {
+			continue
+		}
+		out := []string{fields[0], name}
+		for _, attr := range fields[2:] {
+			if target, ok := strings.CutPrefix(attr, "symref-target:"); ok {
+				if target = f.symrefTarget(target); target == "" {
+					continue
+				}
+				attr = "symref-target:" + target
+			}
+			out = append(out, attr)
+		}
+		if l := strings.Join(out, " "); l != line {
+			c = &ProtocolV2ResponseChunk{Response: []byte(l + "\n")}
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
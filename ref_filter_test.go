@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testRefFilter hides refs/hidden/ and renames refs/heads/ to refs/mirror/.
+func testRefFilter(ref string) (string, bool) {
+	if strings.HasPrefix(ref, "refs/hidden/") {
+		return "", false
+	}
+	if name, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+		return "refs/mirror/" + name, true
+	}
+	return ref, true
+}
+
+func TestRefFilterInfoRefs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []*InfoRefsResponseChunk
+		want []*InfoRefsResponseChunk
+	}{
+		{
+			"rename and hide",
+			[]*InfoRefsResponseChunk{
+				{ObjectID: "1111", Ref: "HEAD", Capabilities: []string{"symref=HEAD:refs/heads/main", "ofs-delta"}},
+				{ObjectID: "1111", Ref: "refs/heads/main"},
+				{ObjectID: "2222", Ref: "refs/hidden/x"},
+				{ObjectID: "3333", Ref: "refs/tags/v1"},
+				{ObjectID: "4444", Ref: "refs/tags/v1^{}"},
+				{EndOfRequest: true},
+			},
+			[]*InfoRefsResponseChunk{
+				{ObjectID: "1111", Ref: "HEAD", Capabilities: []string{"symref=HEAD:refs/mirror/main", "ofs-delta"}},
+				{ObjectID: "1111", Ref: "refs/mirror/main"},
+				{ObjectID: "3333", Ref: "refs/tags/v1"},
+				{ObjectID: "4444", Ref: "refs/tags/v1^{}"},
+				{EndOfRequest: true},
+			},
+		},
+		{
+			"hidden first ref and symref target",
+			[]*InfoRefsResponseChunk{
+				{ObjectID: "2222", Ref: "refs/hidden/x", Capabilities: []string{"symref=HEAD:refs/hidden/x"}},
+				{ObjectID: "3333", Ref: "refs/tags/v1"},
+				{EndOfRequest: true},
+			},
+			[]*InfoRefsResponseChunk{
+				{ObjectID: "3333", Ref: "refs/tags/v1", Capabilities: []string{}},
+				{EndOfRequest: true},
+			},
+		},
+		{
+			"every ref hidden",
+			[]*InfoRefsResponseChunk{
+				{ObjectID: "2222", Ref: "refs/hidden/x", Capabilities: []string{"ofs-delta"}},
+				{ObjectID: "3333", Ref: "refs/hidden/x^{}"},
+				{EndOfRequest: true},
+			},
+			[]*InfoRefsResponseChunk{
+				{ObjectID: ZeroObjectIDSHA1, Ref: "capabilities^{}", Capabilities: []string{"ofs-delta"}},
+				{EndOfRequest: true},
+			},
+		},
+	} {
+		if got := RefFilter(testRefFilter).filterInfoRefsResponse(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRefFilterLsRefs(t *testing.T) {
+	intercept := RefFilter(testRefFilter).LsRefs()
+	var got []*LsRefsResponseChunk
+	for _, c := range []*LsRefsResponseChunk{
+		{ObjectID: "1111", Ref: "HEAD", SymrefTarget: "refs/heads/main"},
+		{ObjectID: "2222", Ref: "refs/symref", SymrefTarget: "refs/hidden/x"},
+		{ObjectID: "2222", Ref: "refs/hidden/x"},
+		{ObjectID: "3333", Ref: "refs/tags/v1", Peeled: "4444"},
+		{EndResponse: true},
+	} {
+		cs, err := intercept(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, cs...)
+	}
+	want := []*LsRefsResponseChunk{
+		{ObjectID: "1111", Ref: "HEAD", SymrefTarget: "refs/mirror/main"},
+		{ObjectID: "2222", Ref: "refs/symref"},
+		{ObjectID: "3333", Ref: "refs/tags/v1", Peeled: "4444"},
+		{EndResponse: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// The raw ls-refs lines are filtered the same way.
+	var raw []*ProtocolV2ResponseChunk
+	for _, c := range []*LsRefsResponseChunk{
+		{ObjectID: "1111", Ref: "HEAD", SymrefTarget: "refs/heads/main"},
+		{ObjectID: "2222", Ref: "refs/symref", SymrefTarget: "refs/hidden/x"},
+		{ObjectID: "2222", Ref: "refs/hidden/x"},
+		{ObjectID: "3333", Ref: "refs/tags/v1", Peeled: "4444"},
+		{EndResponse: true},
+	} {
+		raw = append(raw, &ProtocolV2ResponseChunk{Response: c.EncodeToPktLine()[PacketLengthHeaderSize:], EndResponse: c.EndResponse})
+	}
+	var gotLines []string
+	for _, c := range RefFilter(testRefFilter).filterLsRefsResponse(raw) {
+		gotLines = append(gotLines, string(c.EncodeToPktLine()))
+	}
+	var wantLines []string
+	for _, c := range want {
+		wantLines = append(wantLines, string(c.EncodeToPktLine()))
+	}
+	if !reflect.DeepEqual(gotLines, wantLines) {
+		t.Errorf("got %q, want %q", gotLines, wantLines)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import "strings"
+
+// maxRefPrefixes is the number of ref-prefix arguments from which Git ignores
+// them all (TOO_MANY_PREFIXES in ls-refs.c).
+const maxRefPrefixes = 65536
+
+// RefPrefixMatcher matches ref names against the ref-prefix arguments of a
+// protocol v2 ls-refs request.
+//
+// A prefix is a plain string prefix, not a path prefix. "refs/heads" matches
+// "refs/heads/main" and also "refs/headsup", while "refs/heads/" doesn't match
+// a ref named "refs/heads". Having no prefix, or too many prefixes, matches
+// every ref. This is what Git does.
+type RefPrefixMatcher struct {
+	prefixes []string
+}
+
+// NewRefPrefixMatcher returns a new RefPrefixMatcher for the prefixes.
+func NewRefPrefixMatcher(prefixes []string) *RefPrefixMatcher {
+	if len(prefixes) >= maxRefPrefixes {
+		prefixes = nil
+	}
+	for _, p := range prefixes {
+		if p == "" {
+			// An empty prefix matches everything.
+			prefixes = nil
+			break
+		}
+	}
+	return &RefPrefixMatcher{prefixes: prefixes}
+}
+
+// NewRefPrefixMatcherFromArguments returns a new RefPrefixMatcher for the
+// "ref-prefix" lines in the arguments of an ls-refs request.
+func NewRefPrefixMatcherFromArguments(args []string) *RefPrefixMatcher {
+	var prefixes []string
+	for _, arg := range args {
+		arg = strings.TrimSuffix(arg, "\n")
+		if strings.HasPrefix(arg, "ref-prefix ") {
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+	return NewRefPrefixMatcher(prefixes)
+}
+
+// MatchesAll returns true if the matcher matches every ref.
+func (m *RefPrefixMatcher) MatchesAll() bool {
+	return len(m.prefixes) == 0
+}
+
+// Match returns true if the ref matches any prefix. A peeled ref suffix "^{}"
+// is ignored, so a peeled tag follows its tag.
+func (m *RefPrefixMatcher) Match(ref string) bool {
+	if len(m.prefixes) == 0 {
+		return true
+	}
+	ref = strings.TrimSuffix(ref, "^{}")
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(ref, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterInfoRefsResponse removes the refs that don't match from a protocol
+// v0/v1 ref advertisement, keeping the capabilities as
+// RefVisibility.FilterInfoRefsResponse does.
+func (m *RefPrefixMatcher) FilterInfoRefsResponse(chunks []*InfoRefsResponseChunk) []*InfoRefsResponseChunk {
+	if m.MatchesAll() {
+		return chunks
+	}
+	return keepRefs(m.Match).filterInfoRefsResponse(chunks)
+}
+
+// FilterLsRefsResponse removes the refs that don't match from a protocol v2
+// ls-refs response, dropping the symref-target attributes as
+// RefVisibility.FilterLsRefsResponse does.
+func (m *RefPrefixMatcher) FilterLsRefsResponse(chunks []*ProtocolV2ResponseChunk) []*ProtocolV2ResponseChunk {
+	if m.MatchesAll() {
+		return chunks
+	}
+	return keepRefs(m.Match).filterLsRefsResponse(chunks)
+}
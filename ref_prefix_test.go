@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRefPrefixMatcher(t *testing.T) {
+	m := NewRefPrefixMatcherFromArguments([]string{"peel\n", "ref-prefix refs/heads\n", "ref-prefix refs/tags/v1\n"})
+	for ref, want := range map[string]bool{
+		"refs/heads/main":  true,
+		"refs/headsup":     true,
+		"refs/tags/v1.0":   true,
+		"refs/tags/v1^{}":  true,
+		"refs/tags/v2":     false,
+		"HEAD":             false,
+		"refs/remotes/foo": false,
+	} {
+		if got := m.Match(ref); got != want {
+			t.Errorf("%s: got %v, want %v", ref, got, want)
+		}
+	}
+	if m.MatchesAll() {
+		t.Error("MatchesAll is true with prefixes")
+	}
+
+	many := func(n int) []string {
+		var ret []string
+		for i := 0; i < n; i++ {
+			ret = append(ret, fmt.Sprintf("refs/heads/%d", i))
+		}
+		return ret
+	}
+	for _, tc := range []struct {
+		name     string
+		prefixes []string
+		all      bool
+	}{
+		{"none", nil, true},
+		{"empty prefix", []string{"refs/heads/", ""}, true},
+		{"below the limit", many(maxRefPrefixes - 1), false},
+		{"at the limit", many(maxRefPrefixes), true},
+	} {
+		if got := NewRefPrefixMatcher(tc.prefixes).MatchesAll(); got != tc.all {
+			t.Errorf("%s: got MatchesAll %v, want %v", tc.name, got, tc.all)
+		}
+	}
+}
+
+func TestRefPrefixMatcherFilter(t *testing.T) {
+	m := NewRefPrefixMatcher([]string{"refs/tags/"})
+	caps := []string{"ofs-delta"}
+	got := m.FilterInfoRefsResponse([]*InfoRefsResponseChunk{
+		{ObjectID: "1111", Ref: "refs/heads/main", Capabilities: caps},
+		{ObjectID: "2222", Ref: "refs/tags/v1"},
+		{EndOfRequest: true},
+	})
+	want := []*InfoRefsResponseChunk{
+		{ObjectID: "2222", Ref: "refs/tags/v1", Capabilities: caps},
+		{EndOfRequest: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// No ref is left, so the capabilities go to "capabilities^{}".
+	got = NewRefPrefixMatcher([]string{"refs/notes/"}).FilterInfoRefsResponse([]*InfoRefsResponseChunk{
+		{ObjectID: "1111", Ref: "refs/heads/main", Capabilities: caps},
+		{EndOfRequest: true},
+	})
+	if len(got) != 2 || got[0].Ref != "capabilities^{}" || !reflect.DeepEqual(got[0].Capabilities, caps) {
+		t.Errorf("unexpected chunks: %+v", got)
+	}
+
+	lsRefs := m.FilterLsRefsResponse([]*ProtocolV2ResponseChunk{
+		{Response: []byte("1111 refs/heads/main\n")},
+		{Response: []byte("2222 refs/tags/v1 peeled:3333\n")},
+		{EndResponse: true},
+	})
+	if len(lsRefs) != 2 || string(lsRefs[0].Response) != "2222 refs/tags/v1 peeled:3333\n" {
+		t.Errorf("unexpected ls-refs: %+v", lsRefs)
+	}
+}
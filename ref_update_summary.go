@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RefUpdate is a ref update command of a push and its result.
+type RefUpdate struct {
+	RefName     string
+	OldObjectID string
+	NewObjectID string
+	// Status is the result. It's nil until the backend reports it.
+	Status *RefStatus
+}
+
+// Kind returns "create", "delete", or "update".
+func (u *RefUpdate) Kind() string {
+	switch {
+	case isZeroObjectID(u.OldObjectID):
+		return "create"
+	case isZeroObjectID(u.NewObjectID):
+		return "delete"
+	}
+	return "update"
+}
+
+func isZeroObjectID(oid string) bool {
+	return ObjectID(oid).IsZero()
+}
+
+// RefUpdateSummary collects the ref update commands of a push and the results
+// of the backend, and renders both the report-status response and a log line
+// from them so that the two are consistent.
+type RefUpdateSummary struct {
+	// Atomic is true for an atomic push. If one update fails, the others are
+	// reported as failed.
+	Atomic bool
+
+	unpack  *UnpackStatus
+	updates []*RefUpdate
+	byRef   map[string]*RefUpdate
+}
+
+// NewRefUpdateSummary returns an empty RefUpdateSummary.
+func NewRefUpdateSummary() *RefUpdateSummary {
+	return &RefUpdateSummary{byRef: map[string]*RefUpdate{}}
+}
+
+// AddCommand adds a ref update command. Chunks other than commands are
+// ignored, so all the request chunks can be passed.
+func (s *RefUpdateSummary) AddCommand(c *ProtocolV1ReceivePackRequestChunk) {
+	if c.RefName == "" {
+		return
+	}
+	u := &RefUpdate{RefName: c.RefName, OldObjectID: c.OldObjectID, NewObjectID: c.NewObjectID}
+	s.updates = append(s.updates, u)
+	s.byRef[c.RefName] = u
+}
+
+// SetUnpackError sets the result of unpacking the pack. A nil err means
+// success.
+func (s *RefUpdateSummary) SetUnpackError(err error) {
+	if err == nil {
+		s.unpack = &UnpackStatus{Ok: true}
+		return
+	}
+	s.unpack = &UnpackStatus{Reason: err.Error()}
+}
+
+// SetResult sets the result of a ref update. A nil err means success. The
+// error message is the reason reported to the client.
+func (s *RefUpdateSummary) SetResult(refName string, err error) {
+	st := &RefStatus{RefName: refName, Ok: true}
+	if err != nil {
+		st = &RefStatus{RefName: refName, Reason: err.Error()}
+	}
+	s.SetRefStatus(st)
+}
+
+// SetRefStatus sets the result of a ref update with the report-status-v2
+// options.
+func (s *RefUpdateSummary) SetRefStatus(st *RefStatus) {
+	u, ok := s.byRef[st.RefName]
+	if !ok {
+		u = &RefUpdate{RefName: st.RefName}
+		s.updates = append(s.updates, u)
+		s.byRef[st.RefName] = u
+	}
+	u.Status = st
+}
+
+// Updates returns the ref updates with the final statuses: the updates are
+// failed with "unpacker error" if unpacking failed, "atomic push failed" if
+// another update of an atomic push failed, and "not processed" if the backend
+// didn't report them.
+func (s *RefUpdateSummary) Updates() []*RefUpdate {
+	unpackOk := s.unpack == nil || s.unpack.Ok
+	atomicFailed := false
+	if s.Atomic {
+		for _, u := range s.updates {
+			if u.Status == nil || !u.Status.Ok {
+				atomicFailed = true
+			}
+		}
+	}
+	var ret []*RefUpdate
+	for _, u := range s.updates {
+		st := u.Status
+		switch {
+		case !unpackOk:
+			st = &RefStatus{RefName: u.RefName, Reason: "unpacker error"}
+		case st == nil:
+			st = &RefStatus{RefName: u.RefName, Reason: "not processed"}
+		case atomicFailed && st.Ok:
+			st = &RefStatus{RefName: u.RefName, Reason: "atomic push failed"}
+		}
+		ret = append(ret, &RefUpdate{RefName: u.RefName, OldObjectID: u.OldObjectID, NewObjectID: u.NewObjectID, Status: st})
+	}
+	return ret
+}
+
+// ReportStatus returns the report-status response. The options are sent only
+// if reportStatusV2 is true.
+func (s *RefUpdateSummary) ReportStatus(reportStatusV2 bool) []*ProtocolV1ReceivePackResponseChunk {
+	unpack := s.unpack
+	if unpack == nil {
+		unpack = &UnpackStatus{Ok: true}
+	}
+	ret := []*ProtocolV1ReceivePackResponseChunk{unpack.Chunk()}
+	for _, u := range s.Updates() {
+		cs := u.Status.Chunks()
+		if !reportStatusV2 {
+			cs = cs[:1]
+		}
+		ret = append(ret, cs...)
+	}
+	return append(ret, &ProtocolV1ReceivePackResponseChunk{EndOfResponse: true})
+}
+
+// LogLine returns a one-line human-readable summary such as
+// "push: 1 ok, 1 failed; update refs/heads/main 1234567..89abcde ok; create
+// refs/heads/topic 0000000..89abcde ng (hook declined)".
+func (s *RefUpdateSummary) LogLine() string {
+	updates := s.Updates()
+	okCount := 0
+	var parts []string
+	for _, u := range updates {
+		part := fmt.Sprintf("%s %s %s..%s", u.Kind(), u.RefName, shortObjectID(u.OldObjectID), shortObjectID(u.NewObjectID))
+		if u.Status.Ok {
+			okCount++
+			part += " ok"
+			if u.Status.RewrittenRefName != "" {
+				part += " -> " + u.Status.RewrittenRefName
+			}
+		} else {
+			part += fmt.Sprintf(" ng (%s)", u.Status.Reason)
+		}
+		parts = append(parts, part)
+	}
+	head := fmt.Sprintf("push: %d ok, %d failed", okCount, len(updates)-okCount)
+	if s.unpack != nil && !s.unpack.Ok {
+		head += fmt.Sprintf(", unpack failed (%s)", s.unpack.Reason)
+	}
+	return strings.Join(append([]string{head}, parts...), "; ")
+}
+
+func shortObjectID(oid string) string {
+	return ObjectID(oid).Short(0)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"testing"
+)
+
+const zeroOID = "0000000000000000000000000000000000000000"
+
+func encodeReceivePackResponse(cs []*ProtocolV1ReceivePackResponseChunk) string {
+	var s string
+	for _, c := range cs {
+		s += string(c.EncodeToPktLine())
+	}
+	return s
+}
+
+func TestRefUpdateSummary(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		atomic     bool
+		unpackErr  error
+		results    map[string]error
+		wantLog    string
+		wantReport []string
+	}{
+		{
+			name:       "ok",
+			results:    map[string]error{"refs/heads/main": nil, "refs/heads/topic": nil},
+			wantLog:    "push: 2 ok, 0 failed; update refs/heads/main 1111111..2222222 ok; create refs/heads/topic 0000000..2222222 ok",
+			wantReport: []string{"unpack ok\n", "ok refs/heads/main\n", "ok refs/heads/topic\n", "0000"},
+		},
+		{
+			name:       "one failed",
+			results:    map[string]error{"refs/heads/main": nil, "refs/heads/topic": errors.New("hook declined")},
+			wantLog:    "push: 1 ok, 1 failed; update refs/heads/main 1111111..2222222 ok; create refs/heads/topic 0000000..2222222 ng (hook declined)",
+			wantReport: []string{"unpack ok\n", "ok refs/heads/main\n", "ng refs/heads/topic hook declined\n", "0000"},
+		},
+		{
+			name:       "atomic",
+			atomic:     true,
+			results:    map[string]error{"refs/heads/main": nil, "refs/heads/topic": errors.New("hook declined")},
+			wantLog:    "push: 0 ok, 2 failed; update refs/heads/main 1111111..2222222 ng (atomic push failed); create refs/heads/topic 0000000..2222222 ng (hook declined)",
+			wantReport: []string{"unpack ok\n", "ng refs/heads/main atomic push failed\n", "ng refs/heads/topic hook declined\n", "0000"},
+		},
+		{
+			name:       "not processed",
+			results:    map[string]error{"refs/heads/main": nil},
+			wantLog:    "push: 1 ok, 1 failed; update refs/heads/main 1111111..2222222 ok; create refs/heads/topic 0000000..2222222 ng (not processed)",
+			wantReport: []string{"unpack ok\n", "ok refs/heads/main\n", "ng refs/heads/topic not processed\n", "0000"},
+		},
+		{
+			name:       "unpack failed",
+			unpackErr:  errors.New("index-pack failed"),
+			results:    map[string]error{"refs/heads/main": nil},
+			wantLog:    "push: 0 ok, 2 failed, unpack failed (index-pack failed); update refs/heads/main 1111111..2222222 ng (unpacker error); create refs/heads/topic 0000000..2222222 ng (unpacker error)",
+			wantReport: []string{"unpack index-pack failed\n", "ng refs/heads/main unpacker error\n", "ng refs/heads/topic unpacker error\n", "0000"},
+		},
+	} {
+		s := NewRefUpdateSummary()
+		s.Atomic = tc.atomic
+		for _, c := range []*ProtocolV1ReceivePackRequestChunk{
+			{OldObjectID: oidA, NewObjectID: oidB, RefName: "refs/heads/main", Capabilities: []string{"report-status"}},
+			{OldObjectID: zeroOID, NewObjectID: oidB, RefName: "refs/heads/topic"},
+			{EndOfCommands: true},
+		} {
+			s.AddCommand(c)
+		}
+		s.SetUnpackError(tc.unpackErr)
+		for ref, err := range tc.results {
+			s.SetResult(ref, err)
+		}
+		if got := s.LogLine(); got != tc.wantLog {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.wantLog)
+		}
+		if got, want := encodeReceivePackResponse(s.ReportStatus(false)), pktLines(tc.wantReport...); got != want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, want)
+		}
+	}
+}
+
+func TestRefUpdateSummaryReportStatusV2(t *testing.T) {
+	s := NewRefUpdateSummary()
+	s.AddCommand(&ProtocolV1ReceivePackRequestChunk{OldObjectID: oidA, NewObjectID: oidB, RefName: "refs/for/main"})
+	s.SetRefStatus(&RefStatus{RefName: "refs/for/main", Ok: true, RewrittenRefName: "refs/changes/01/1/1"})
+	// A status of a ref without a command is still reported.
+	s.SetResult("refs/heads/other", errors.New("unexpected"))
+
+	want := pktLines("unpack ok\n", "ok refs/for/main\n", "option refname refs/changes/01/1/1\n", "ng refs/heads/other unexpected\n", "0000")
+	if got := encodeReceivePackResponse(s.ReportStatus(true)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	want = pktLines("unpack ok\n", "ok refs/for/main\n", "ng refs/heads/other unexpected\n", "0000")
+	if got := encodeReceivePackResponse(s.ReportStatus(false)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := s.LogLine(), "push: 1 ok, 1 failed; update refs/for/main 1111111..2222222 ok -> refs/changes/01/1/1; update refs/heads/other .. ng (unexpected)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRefUpdateKind(t *testing.T) {
+	for _, tc := range []struct {
+		u    *RefUpdate
+		want string
+	}{
+		{&RefUpdate{OldObjectID: zeroOID, NewObjectID: oidA}, "create"},
+		{&RefUpdate{OldObjectID: oidA, NewObjectID: zeroOID}, "delete"},
+		{&RefUpdate{OldObjectID: oidA, NewObjectID: oidB}, "update"},
+	} {
+		if got := tc.u.Kind(); got != tc.want {
+			t.Errorf("%s..%s: got %s, want %s", tc.u.OldObjectID, tc.u.NewObjectID, got, tc.want)
+		}
+	}
+}
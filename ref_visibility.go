@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+)
+
+// RefVisibility is a ref hiding configuration with the semantics of Git's
+// transfer.hideRefs.
+//
+// Each rule is a ref prefix. A rule matches a ref if the ref is the prefix or
+// starts with the prefix followed by "/". A rule starting with "!" makes the
+// matched refs visible again. A rule starting with "^" is matched against the
+// ref name before the namespace is stripped. The last matching rule wins, and
+// a ref that matches no rule is visible.
+type RefVisibility struct {
+	// Transfer is the rules for all services (transfer.hideRefs).
+	Transfer []string
+	// UploadPack is the rules only for git-upload-pack
+	// (uploadpack.hideRefs). They come after Transfer.
+	UploadPack []string
+	// ReceivePack is the rules only for git-receive-pack
+	// (receive.hideRefs). They come after Transfer.
+	ReceivePack []string
+	// Namespace is the Git namespace of the repository (GIT_NAMESPACE).
+	// The advertised ref names don't have the namespace prefix.
+	Namespace string
+	// AllowTipInWant allows wanting the tip of a hidden ref
+	// (uploadpack.allowTipSHA1InWant).
+	AllowTipInWant bool
+}
+
+func (v *RefVisibility) rules(service string) []string {
+	switch strings.TrimPrefix(service, "git-") {
+	case "upload-pack":
+		return append(v.Transfer[:len(v.Transfer):len(v.Transfer)], v.UploadPack...)
+	case "receive-pack":
+		return append(v.Transfer[:len(v.Transfer):len(v.Transfer)], v.ReceivePack...)
+	}
+	return v.Transfer
+}
+
+func (v *RefVisibility) fullName(ref string) string {
+	if v.Namespace == "" {
+		return ref
+	}
+	ns := "refs/namespaces/" + strings.Join(strings.Split(strings.Trim(v.Namespace, "/"), "/"), "/refs/namespaces/") + "/"
+	return ns + ref
+}
+
+// IsHidden returns true if the ref is hidden for the service, such as
+// "git-upload-pack" or "receive-pack". The ref is the advertised name, without
+// the namespace prefix. A peeled ref suffix "^{}" is ignored.
+func (v *RefVisibility) IsHidden(service, ref string) bool {
+	ref = strings.TrimSuffix(ref, "^{}")
+	full := v.fullName(ref)
+	rules := v.rules(service)
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		neg := strings.HasPrefix(rule, "!")
+		rule = strings.TrimPrefix(rule, "!")
+		name := ref
+		if strings.HasPrefix(rule, "^") {
+			rule = rule[1:]
+			name = full
+		}
+		rule = strings.TrimSuffix(rule, "/")
+		if name == rule || strings.HasPrefix(name, rule+"/") {
+			return !neg
+		}
+	}
+	return false
+}
+
+// FilterInfoRefsResponse removes the hidden refs from a protocol v0/v1 ref
+// advertisement. If the first ref is hidden, the capabilities move to the next
+// visible ref, or to a "capabilities^{}" line if no ref is visible. A
+// "symref=" capability is dropped if either side is hidden. This is what
+// RefFilter.InfoRefs does. Protocol v2 capability advertisements are returned
+// as is.
+func (v *RefVisibility) FilterInfoRefsResponse(service string, chunks []*InfoRefsResponseChunk) []*InfoRefsResponseChunk {
+	return keepRefs(func(ref string) bool {
+		return !v.IsHidden(service, ref)
+	}).filterInfoRefsResponse(chunks)
+}
+
+// FilterLsRefsResponse removes the hidden refs from a protocol v2 ls-refs
+// response. A symref-target attribute that names a hidden ref is dropped, as
+// RefFilter.LsRefs does.
+func (v *RefVisibility) FilterLsRefsResponse(chunks []*ProtocolV2ResponseChunk) []*ProtocolV2ResponseChunk {
+	return keepRefs(func(ref string) bool {
+		return !v.IsHidden("git-upload-pack", ref)
+	}).filterLsRefsResponse(chunks)
+}
+
+// CheckWants verifies that the wants of an upload-pack request are the tips of
+// visible refs. refs maps the ref names, as advertised, to their object IDs.
+// wantRefs are the ref names of protocol v2 want-ref lines.
+func (v *RefVisibility) CheckWants(refs map[string]string, wants, wantRefs []string) error {
+	visible := map[string]bool{}
+	for ref, oid := range refs {
+		if v.AllowTipInWant || !v.IsHidden("git-upload-pack", ref) {
+			visible[oid] = true
+		}
+	}
+	for _, w := range wants {
+		if !visible[w] {
+			return ErrorPacket("upload-pack: not our ref " + w)
+		}
+	}
+	for _, ref := range wantRefs {
+		if _, ok := refs[ref]; !ok || v.IsHidden("git-upload-pack", ref) {
+			return ErrorPacket("unknown ref " + ref)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRefVisibilityIsHidden(t *testing.T) {
+	v := &RefVisibility{
+		Transfer:    []string{"refs/hidden/", "!refs/hidden/public", "^refs/namespaces/a/refs/namespaces/b/refs/secret"},
+		UploadPack:  []string{"refs/pull"},
+		ReceivePack: []string{"!refs/pull/ok"},
+		Namespace:   "a/b",
+	}
+	for _, tc := range []struct {
+		service string
+		ref     string
+		want    bool
+	}{
+		{"git-upload-pack", "refs/heads/main", false},
+		{"git-upload-pack", "refs/hidden/x", true},
+		{"git-upload-pack", "refs/hidden", true},
+		{"git-upload-pack", "refs/hiddenx", false},
+		{"git-upload-pack", "refs/hidden/public", false},
+		{"git-upload-pack", "refs/hidden/public/x^{}", false},
+		{"git-upload-pack", "refs/secret/x", true},
+		{"git-upload-pack", "refs/pull/1/head", true},
+		{"upload-pack", "refs/pull/1/head", true},
+		{"git-receive-pack", "refs/pull/1/head", false},
+		{"git-receive-pack", "refs/hidden/x^{}", true},
+	} {
+		if got := v.IsHidden(tc.service, tc.ref); got != tc.want {
+			t.Errorf("%s %s: got %v, want %v", tc.service, tc.ref, got, tc.want)
+		}
+	}
+}
+
+func TestRefVisibilityFilter(t *testing.T) {
+	v := &RefVisibility{Transfer: []string{"refs/heads/"}}
+	caps := []string{"ofs-delta"}
+	got := v.FilterInfoRefsResponse("git-upload-pack", []*InfoRefsResponseChunk{
+		{ObjectID: "1111", Ref: "refs/heads/main", Capabilities: caps},
+		{ObjectID: "2222", Ref: "refs/tags/v1"},
+		{EndOfRequest: true},
+	})
+	want := []*InfoRefsResponseChunk{
+		{ObjectID: "2222", Ref: "refs/tags/v1", Capabilities: caps},
+		{EndOfRequest: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	lsRefs := v.FilterLsRefsResponse([]*ProtocolV2ResponseChunk{
+		{Response: []byte("1111 refs/heads/main\n")},
+		{Response: []byte("unborn HEAD symref-target:refs/heads/main\n")},
+		{EndResponse: true},
+	})
+	// HEAD is advertised, but not the name of the hidden target.
+	if len(lsRefs) != 2 || string(lsRefs[0].Response) != "unborn HEAD\n" {
+		t.Errorf("unexpected ls-refs: %+v", lsRefs)
+	}
+
+	got = v.FilterInfoRefsResponse("git-upload-pack", []*InfoRefsResponseChunk{
+		{ObjectID: "1111", Ref: "HEAD", Capabilities: []string{"symref=HEAD:refs/heads/main", "ofs-delta"}},
+		{ObjectID: "1111", Ref: "refs/heads/main"},
+		{EndOfRequest: true},
+	})
+	want = []*InfoRefsResponseChunk{
+		{ObjectID: "1111", Ref: "HEAD", Capabilities: caps},
+		{EndOfRequest: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestRefVisibilityCheckWants(t *testing.T) {
+	refs := map[string]string{
+		"refs/heads/main":   "1111",
+		"refs/hidden/draft": "2222",
+	}
+	for _, tc := range []struct {
+		name     string
+		allowTip bool
+		wants    []string
+		wantRefs []string
+		wantErr  bool
+	}{
+		{"visible tip", false, []string{"1111"}, nil, false},
+		{"hidden tip", false, []string{"2222"}, nil, true},
+		{"hidden tip allowed", true, []string{"2222"}, nil, false},
+		{"unknown object", true, []string{"3333"}, nil, true},
+		{"visible want-ref", false, nil, []string{"refs/heads/main"}, false},
+		{"hidden want-ref", true, nil, []string{"refs/hidden/draft"}, true},
+		{"unknown want-ref", false, nil, []string{"refs/heads/nope"}, true},
+	} {
+		v := &RefVisibility{Transfer: []string{"refs/hidden"}, AllowTipInWant: tc.allowTip}
+		err := v.CheckWants(refs, tc.wants, tc.wantRefs)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if _, ok := err.(ErrorPacket); err != nil && !ok {
+			t.Errorf("%s: got %T, want an ErrorPacket", tc.name, err)
+		}
+	}
+}
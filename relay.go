@@ -0,0 +1,82 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import "io"
+
+// RelaySource is a parser that reads chunk by chunk, such as
+// ProtocolV1UploadPackResponse.
+type RelaySource[T any] interface {
+	Scan() bool
+	Chunk() T
+	Err() error
+}
+
+// RelaySink writes chunks, such as ProtocolV1UploadPackResponseEncoder.
+type RelaySink[T any] interface {
+	WriteChunk(T) error
+}
+
+// RelayInterceptor is called by Relay for every chunk. It returns the chunks to
+// write in place of the chunk: the chunk itself to pass it through, none to
+// drop it, or more to insert some. An error stops the relay.
+type RelayInterceptor[T any] func(T) ([]T, error)
+
+// Relay reads chunks from src until Scan returns false, and writes them to
+// dst. The interceptors are applied to every chunk in order, each to the
+// output of the previous one. It returns the first error of src, dst, or an
+// interceptor.
+//
+// A chunk may point to the buffer of the parser, which the next Scan
+// overwrites. An interceptor that keeps a chunk, for example for an audit log,
+// must copy it.
+func Relay[T any](dst RelaySink[T], src RelaySource[T], interceptors ...RelayInterceptor[T]) error {
+	for src.Scan() {
+		chunks := []T{src.Chunk()}
+		for _, f := range interceptors {
+			var next []T
+			for _, c := range chunks {
+				out, err := f(c)
+				if err != nil {
+					return err
+				}
+				next = append(next, out...)
+			}
+			chunks = next
+		}
+		for _, c := range chunks {
+			if err := dst.WriteChunk(c); err != nil {
+				return err
+			}
+		}
+	}
+	return src.Err()
+}
+
+// NewRelaySink returns a RelaySink that writes the chunks as they are, without
+// checking the order. Use it for the parsers without an encoder, such as
+// ProtocolV2Response.
+func NewRelaySink[T Packet](w io.Writer) RelaySink[T] {
+	return packetSink[T]{w}
+}
+
+type packetSink[T Packet] struct {
+	w io.Writer
+}
+
+func (e packetSink[T]) WriteChunk(c T) error {
+	_, err := e.w.Write(c.EncodeToPktLine())
+	return err
+}
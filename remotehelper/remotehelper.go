@@ -0,0 +1,375 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remotehelper implements the Git remote helper protocol.
+//
+// A remote helper is a program named git-remote-<transport> that Git runs for
+// URLs like <transport>://... It reads commands from the standard input and
+// writes the responses to the standard output. See gitremote-helpers(7).
+package remotehelper
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SyntaxError is an error returned when the parser cannot parse the input.
+type SyntaxError string
+
+func (s SyntaxError) Error() string { return string(s) }
+
+// Command is a command sent by Git to a remote helper.
+type Command struct {
+	// Name is the command name, such as "capabilities", "list", "option",
+	// "fetch", "push", and "connect".
+	Name string
+	// Args are the space-separated arguments after the command name. For
+	// option, the value can contain spaces and it's not split.
+	Args []string
+	// EndOfBatch is true for the blank line that terminates a batch of
+	// fetch or push commands, or all the commands if there's no batch.
+	EndOfBatch bool
+}
+
+// CommandScanner provides an interface for reading remote helper commands.
+// The usage is same as bufio.Scanner.
+type CommandScanner struct {
+	rd   *bufio.Reader
+	err  error
+	curr *Command
+}
+
+// NewCommandScanner returns a new CommandScanner to read from rd.
+func NewCommandScanner(rd io.Reader) *CommandScanner {
+	return &CommandScanner{rd: bufio.NewReader(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// CommandScanner.
+func (s *CommandScanner) Err() error {
+	return s.err
+}
+
+// Command returns the most recent command generated by a call to Scan.
+func (s *CommandScanner) Command() *Command {
+	return s.curr
+}
+
+// Reader returns the reader of the rest of the input. This is used after
+// connect, when the input becomes the raw protocol stream.
+func (s *CommandScanner) Reader() io.Reader {
+	return s.rd
+}
+
+// Scan advances the scanner to the next command. It returns false when the
+// scan stops, either by reaching the end of the input or an error. After Scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (s *CommandScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	line, err := s.rd.ReadString('\n')
+	if err != nil {
+		if err != io.EOF {
+			s.err = err
+		} else if line != "" {
+			s.err = SyntaxError("incomplete line: " + line)
+		}
+		return false
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if line == "" {
+		s.curr = &Command{EndOfBatch: true}
+		return true
+	}
+	if strings.HasPrefix(line, "option ") {
+		ss := strings.SplitN(line, " ", 3)
+		if len(ss) != 3 {
+			s.err = SyntaxError("cannot split option: " + line)
+			return false
+		}
+		s.curr = &Command{Name: ss[0], Args: ss[1:]}
+		return true
+	}
+	ss := strings.Split(line, " ")
+	s.curr = &Command{Name: ss[0], Args: ss[1:]}
+	return true
+}
+
+// Ref is a ref returned by the list command.
+type Ref struct {
+	Name string
+	// ObjectID is the object the ref points to. If empty, the value is
+	// unknown ("?").
+	ObjectID string
+	// SymRefTarget is the target if the ref is a symbolic ref.
+	SymRefTarget string
+	// Attributes are the optional attributes such as "unchanged".
+	Attributes []string
+}
+
+func (r *Ref) String() string {
+	v := r.ObjectID
+	if r.SymRefTarget != "" {
+		v = "@" + r.SymRefTarget
+	} else if v == "" {
+		v = "?"
+	}
+	return strings.Join(append([]string{v, r.Name}, r.Attributes...), " ")
+}
+
+// FetchCommand is a fetch command.
+type FetchCommand struct {
+	ObjectID string
+	Name     string
+}
+
+// PushCommand is a push command.
+type PushCommand struct {
+	// Src is the local ref. Empty if the remote ref is deleted.
+	Src   string
+	Dst   string
+	Force bool
+}
+
+// ErrUnsupportedOption is returned by Helper.Option for unknown options.
+var ErrUnsupportedOption = SyntaxError("unsupported option")
+
+// Helper is a remote helper. The capabilities are advertised based on the
+// non-nil functions.
+type Helper struct {
+	// Capabilities are the extra capabilities to advertise, such as
+	// "refspec refs/heads/*:refs/remotes/origin/*".
+	Capabilities []string
+
+	// List returns the refs of the remote.
+	List func(forPush bool) ([]*Ref, error)
+	// Option sets an option. It returns ErrUnsupportedOption for unknown
+	// options.
+	Option func(name, value string) error
+	// Fetch fetches the objects into the local repository.
+	Fetch func(cmds []*FetchCommand) error
+	// Push pushes the refs. It returns the per-command errors in the same
+	// order as cmds, or an error that fails the entire push.
+	Push func(cmds []*PushCommand) ([]error, error)
+	// Connect connects to a Git service ("git-upload-pack" or
+	// "git-receive-pack"). The helper relays the protocol stream between
+	// Git and the returned connection.
+	Connect func(service string) (io.ReadWriteCloser, error)
+}
+
+// Serve runs the remote helper protocol over in and out. It returns when Git
+// closes the input or sends a blank line outside a batch.
+func (h *Helper) Serve(in io.Reader, out io.Writer) error {
+	s := NewCommandScanner(in)
+	for s.Scan() {
+		cmd := s.Command()
+		var err error
+		switch cmd.Name {
+		case "":
+			// The blank line at the end of the commands.
+			return nil
+		case "capabilities":
+			err = h.capabilities(out)
+		case "list":
+			err = h.list(out, len(cmd.Args) > 0 && cmd.Args[0] == "for-push")
+		case "option":
+			if len(cmd.Args) != 2 {
+				return SyntaxError("option needs a name and a value")
+			}
+			err = h.option(out, cmd.Args[0], cmd.Args[1])
+		case "fetch":
+			err = h.fetch(s, out, cmd)
+		case "push":
+			err = h.push(s, out, cmd)
+		case "connect":
+			if len(cmd.Args) != 1 {
+				return SyntaxError("connect needs a service name")
+			}
+			return h.connect(s, out, cmd.Args[0])
+		default:
+			return SyntaxError("unknown command: " + cmd.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func (h *Helper) capabilities(out io.Writer) error {
+	var caps []string
+	if h.Option != nil {
+		caps = append(caps, "option")
+	}
+	if h.Fetch != nil {
+		caps = append(caps, "fetch")
+	}
+	if h.Push != nil {
+		caps = append(caps, "push")
+	}
+	if h.Connect != nil {
+		caps = append(caps, "connect")
+	}
+	caps = append(caps, h.Capabilities...)
+	return writeLines(out, caps)
+}
+
+func (h *Helper) list(out io.Writer, forPush bool) error {
+	if h.List == nil {
+		return SyntaxError("list is not supported")
+	}
+	refs, err := h.List(forPush)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, r := range refs {
+		lines = append(lines, r.String())
+	}
+	return writeLines(out, lines)
+}
+
+func (h *Helper) option(out io.Writer, name, value string) error {
+	if h.Option == nil {
+		_, err := io.WriteString(out, "unsupported\n")
+		return err
+	}
+	err := h.Option(name, value)
+	if err == ErrUnsupportedOption {
+		_, err = io.WriteString(out, "unsupported\n")
+		return err
+	}
+	if err != nil {
+		_, err = fmt.Fprintf(out, "error %s\n", err)
+		return err
+	}
+	_, err = io.WriteString(out, "ok\n")
+	return err
+}
+
+func (h *Helper) fetch(s *CommandScanner, out io.Writer, first *Command) error {
+	if h.Fetch == nil {
+		return SyntaxError("fetch is not supported")
+	}
+	var cmds []*FetchCommand
+	for cmd := first; !cmd.EndOfBatch; cmd = s.Command() {
+		if cmd.Name != "fetch" || len(cmd.Args) != 2 {
+			return SyntaxError(fmt.Sprintf("unexpected command in a fetch batch: %#v", cmd))
+		}
+		cmds = append(cmds, &FetchCommand{ObjectID: cmd.Args[0], Name: cmd.Args[1]})
+		if !s.Scan() {
+			return scanErr(s)
+		}
+	}
+	if err := h.Fetch(cmds); err != nil {
+		return err
+	}
+	return writeLines(out, nil)
+}
+
+func (h *Helper) push(s *CommandScanner, out io.Writer, first *Command) error {
+	if h.Push == nil {
+		return SyntaxError("push is not supported")
+	}
+	var cmds []*PushCommand
+	for cmd := first; !cmd.EndOfBatch; cmd = s.Command() {
+		if cmd.Name != "push" || len(cmd.Args) != 1 {
+			return SyntaxError(fmt.Sprintf("unexpected command in a push batch: %#v", cmd))
+		}
+		refspec := cmd.Args[0]
+		c := &PushCommand{}
+		if strings.HasPrefix(refspec, "+") {
+			c.Force = true
+			refspec = refspec[1:]
+		}
+		ss := strings.SplitN(refspec, ":", 2)
+		if len(ss) != 2 {
+			return SyntaxError("cannot split refspec: " + cmd.Args[0])
+		}
+		c.Src, c.Dst = ss[0], ss[1]
+		cmds = append(cmds, c)
+		if !s.Scan() {
+			return scanErr(s)
+		}
+	}
+	errs, err := h.Push(cmds)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for i, c := range cmds {
+		if i < len(errs) && errs[i] != nil {
+			lines = append(lines, fmt.Sprintf("error %s %s", c.Dst, errs[i]))
+		} else {
+			lines = append(lines, "ok "+c.Dst)
+		}
+	}
+	return writeLines(out, lines)
+}
+
+func (h *Helper) connect(s *CommandScanner, out io.Writer, service string) error {
+	if h.Connect == nil {
+		return SyntaxError("connect is not supported")
+	}
+	conn, err := h.Connect(service)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := writeLines(out, nil); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, s.Reader())
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+			err = cw.CloseWrite()
+		}
+		errCh <- err
+	}()
+	if _, err := io.Copy(out, conn); err != nil {
+		return err
+	}
+	// The service has closed the connection. Git might still hold the input
+	// open, so don't wait for the copy of the input.
+	select {
+	case err := <-errCh:
+		return err
+	default:
+		return nil
+	}
+}
+
+func writeLines(out io.Writer, lines []string) error {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(out, b.String())
+	return err
+}
+
+func scanErr(s *CommandScanner) error {
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return SyntaxError("early EOF")
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotehelper
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandScanner(t *testing.T) {
+	s := NewCommandScanner(strings.NewReader("capabilities\noption depth 1 2\nfetch abc refs/heads/main\n\n"))
+	var got []*Command
+	for s.Scan() {
+		got = append(got, s.Command())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []*Command{
+		{Name: "capabilities", Args: []string{}},
+		{Name: "option", Args: []string{"depth", "1 2"}},
+		{Name: "fetch", Args: []string{"abc", "refs/heads/main"}},
+		{EndOfBatch: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, input := range []string{"list", "option depth\n"} {
+		s := NewCommandScanner(strings.NewReader(input))
+		for s.Scan() {
+		}
+		if s.Err() == nil {
+			t.Errorf("%q: want an error", input)
+		}
+	}
+}
+
+func TestHelperServe(t *testing.T) {
+	var options []string
+	var fetched []*FetchCommand
+	h := &Helper{
+		List: func(forPush bool) ([]*Ref, error) {
+			return []*Ref{
+				{Name: "HEAD", SymRefTarget: "refs/heads/main"},
+				{Name: "refs/heads/main", ObjectID: "abc"},
+				{Name: "refs/heads/unknown"},
+			}, nil
+		},
+		Option: func(name, value string) error {
+			if name != "depth" {
+				return ErrUnsupportedOption
+			}
+			options = append(options, name+"="+value)
+			return nil
+		},
+		Fetch: func(cmds []*FetchCommand) error {
+			fetched = cmds
+			return nil
+		},
+		Push: func(cmds []*PushCommand) ([]error, error) {
+			return []error{nil, errors.New("rejected")}, nil
+		},
+	}
+	in := "capabilities\nlist\noption depth 1\noption verbosity 2\n" +
+		"fetch abc refs/heads/main\n\n" +
+		"push +refs/heads/a:refs/heads/a\npush :refs/heads/b\n\n\n"
+	var out strings.Builder
+	if err := h.Serve(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "option\nfetch\npush\n\n" +
+		"@refs/heads/main HEAD\nabc refs/heads/main\n? refs/heads/unknown\n\n" +
+		"ok\nunsupported\n" +
+		"\n" +
+		"ok refs/heads/a\nerror refs/heads/b rejected\n\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+	if !reflect.DeepEqual(options, []string{"depth=1"}) {
+		t.Errorf("unexpected options: %q", options)
+	}
+	if len(fetched) != 1 || fetched[0].ObjectID != "abc" || fetched[0].Name != "refs/heads/main" {
+		t.Errorf("unexpected fetch: %+v", fetched)
+	}
+}
+
+func TestHelperServeErrors(t *testing.T) {
+	h := &Helper{
+		Fetch: func([]*FetchCommand) error { return nil },
+		Push:  func([]*PushCommand) ([]error, error) { return nil, nil },
+	}
+	for _, in := range []string{
+		"option\n",
+		"unknown\n",
+		"connect\n",
+		"connect git-upload-pack\n",
+		"fetch abc\n\n",
+		"fetch abc refs/heads/main\npush a:b\n\n",
+		"push refs/heads/a\n\n",
+		"push a:b\n",
+	} {
+		var out strings.Builder
+		if err := h.Serve(strings.NewReader(in), &out); err == nil {
+			t.Errorf("%q: want an error", in)
+		}
+	}
+}
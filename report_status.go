@@ -0,0 +1,164 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import "sort"
+
+// UnpackStatus is the result of unpacking the pack of a push, reported by the
+// "unpack" line of a report-status response.
+type UnpackStatus struct {
+	Ok bool
+	// Reason is the error message if not Ok.
+	Reason string
+}
+
+// ParseUnpackStatus parses the status of an "unpack" line, which is "ok" or an
+// error message.
+func ParseUnpackStatus(s string) *UnpackStatus {
+	if s == "ok" {
+		return &UnpackStatus{Ok: true}
+	}
+	return &UnpackStatus{Reason: s}
+}
+
+// Chunk returns the response chunk of the status.
+func (s *UnpackStatus) Chunk() *ProtocolV1ReceivePackResponseChunk {
+	if s.Ok {
+		return &ProtocolV1ReceivePackResponseChunk{UnpackStatus: "ok"}
+	}
+	return &ProtocolV1ReceivePackResponseChunk{UnpackStatus: s.Reason}
+}
+
+// Unpack returns the unpack status if the chunk is an "unpack" line, and nil
+// otherwise.
+func (c *ProtocolV1ReceivePackResponseChunk) Unpack() *UnpackStatus {
+	if c.UnpackStatus == "" {
+		return nil
+	}
+	return ParseUnpackStatus(c.UnpackStatus)
+}
+
+// RefStatus is the result of a ref update of a push, reported by an "ok" or
+// "ng" line of a report-status response.
+type RefStatus struct {
+	RefName string
+	Ok      bool
+	// Reason is the error message if not Ok.
+	Reason string
+
+	// The report-status-v2 options. They're reported when the server
+	// updated a ref different from the one pushed, e.g. by proc-receive.
+	//
+	// RewrittenRefName is the ref actually updated.
+	RewrittenRefName string
+	OldObjectID      string
+	NewObjectID      string
+	ForcedUpdate     bool
+	// Options are the options unknown to this package.
+	Options map[string]string
+}
+
+// RefStatus returns the ref update status if the chunk is an "ok" or "ng"
+// line, and nil otherwise. The status doesn't have the options. Use
+// ParseRefStatuses to get them.
+func (c *ProtocolV1ReceivePackResponseChunk) RefStatus() *RefStatus {
+	if c.RefUpdateStatus == "" {
+		return nil
+	}
+	return &RefStatus{
+		RefName: c.RefName,
+		Ok:      c.RefUpdateStatus == "ok",
+		Reason:  c.RefUpdateFailMessage,
+	}
+}
+
+func (s *RefStatus) setOption(key, value string) {
+	switch key {
+	case "refname":
+		s.RewrittenRefName = value
+	case "old-oid":
+		s.OldObjectID = value
+	case "new-oid":
+		s.NewObjectID = value
+	case "forced-update":
+		s.ForcedUpdate = true
+	default:
+		if s.Options == nil {
+			s.Options = map[string]string{}
+		}
+		s.Options[key] = value
+	}
+}
+
+// ParseRefStatuses returns the ref update statuses in the response chunks with
+// the options attached to them.
+func ParseRefStatuses(chunks []*ProtocolV1ReceivePackResponseChunk) ([]*RefStatus, error) {
+	var ret []*RefStatus
+	for _, c := range chunks {
+		if s := c.RefStatus(); s != nil {
+			ret = append(ret, s)
+			continue
+		}
+		if c.RefUpdateOptionKey == "" {
+			continue
+		}
+		if len(ret) == 0 || !ret[len(ret)-1].Ok {
+			return nil, SyntaxError("option without an ok status: " + c.RefUpdateOptionKey)
+		}
+		ret[len(ret)-1].setOption(c.RefUpdateOptionKey, c.RefUpdateOptionValue)
+	}
+	return ret, nil
+}
+
+// Chunks returns the response chunks of the status, the "ok" or "ng" line
+// followed by the options.
+func (s *RefStatus) Chunks() []*ProtocolV1ReceivePackResponseChunk {
+	if !s.Ok {
+		return []*ProtocolV1ReceivePackResponseChunk{{
+			RefUpdateStatus:      "ng",
+			RefName:              s.RefName,
+			RefUpdateFailMessage: s.Reason,
+		}}
+	}
+	ret := []*ProtocolV1ReceivePackResponseChunk{{RefUpdateStatus: "ok", RefName: s.RefName}}
+	opt := func(k, v string) {
+		ret = append(ret, &ProtocolV1ReceivePackResponseChunk{RefUpdateOptionKey: k, RefUpdateOptionValue: v})
+	}
+	if s.RewrittenRefName != "" {
+		opt("refname", s.RewrittenRefName)
+	}
+	if s.OldObjectID != "" {
+		opt("old-oid", s.OldObjectID)
+	}
+	if s.NewObjectID != "" {
+		opt("new-oid", s.NewObjectID)
+	}
+	if s.ForcedUpdate {
+		opt("forced-update", "")
+	}
+	for _, k := range sortedStringKeys(s.Options) {
+		opt(k, s.Options[k])
+	}
+	return ret
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnpackStatus(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want *UnpackStatus
+	}{
+		{"unpack ok\n", &UnpackStatus{Ok: true}},
+		{"unpack index-pack abnormal exit\n", &UnpackStatus{Reason: "index-pack abnormal exit"}},
+	} {
+		r := NewProtocolV1ReceivePackResponse(strings.NewReader(pktLines(tc.line, "0000")))
+		if !r.Scan() {
+			t.Fatalf("%q: %v", tc.line, r.Err())
+		}
+		got := r.Chunk().Unpack()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.line, got, tc.want)
+		}
+		if enc := string(got.Chunk().EncodeToPktLine()); enc != pktLines(tc.line) {
+			t.Errorf("%q: got %q after a round trip", tc.line, enc)
+		}
+	}
+	if s := (&ProtocolV1ReceivePackResponseChunk{EndOfResponse: true}).Unpack(); s != nil {
+		t.Errorf("got %+v for a flush", s)
+	}
+}
+
+func TestParseRefStatuses(t *testing.T) {
+	in := pktLines(
+		"unpack ok\n",
+		"ok refs/for/main\n",
+		"option refname refs/changes/1/1\n",
+		"option old-oid 1111\n",
+		"option new-oid 2222\n",
+		"option forced-update\n",
+		"option x-extra y\n",
+		"ng refs/heads/locked locked by admin\n",
+		"0000",
+	)
+	r := NewProtocolV1ReceivePackResponse(strings.NewReader(in))
+	var chunks []*ProtocolV1ReceivePackResponseChunk
+	for r.Scan() {
+		chunks = append(chunks, r.Chunk())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseRefStatuses(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*RefStatus{
+		{
+			RefName:          "refs/for/main",
+			Ok:               true,
+			RewrittenRefName: "refs/changes/1/1",
+			OldObjectID:      "1111",
+			NewObjectID:      "2222",
+			ForcedUpdate:     true,
+			Options:          map[string]string{"x-extra": "y"},
+		},
+		{RefName: "refs/heads/locked", Reason: "locked by admin"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	var out strings.Builder
+	out.Write(ParseUnpackStatus("ok").Chunk().EncodeToPktLine())
+	for _, s := range got {
+		for _, c := range s.Chunks() {
+			out.Write(c.EncodeToPktLine())
+		}
+	}
+	out.WriteString(FlushPkt)
+	if out.String() != in {
+		t.Errorf("got %q, want %q", out.String(), in)
+	}
+}
+
+func TestParseRefStatusesErrors(t *testing.T) {
+	for _, chunks := range [][]*ProtocolV1ReceivePackResponseChunk{
+		{{RefUpdateOptionKey: "refname", RefUpdateOptionValue: "refs/heads/x"}},
+		{{RefUpdateStatus: "ng", RefName: "refs/heads/x", RefUpdateFailMessage: "no"}, {RefUpdateOptionKey: "forced-update"}},
+	} {
+		if _, err := ParseRefStatuses(chunks); err == nil {
+			t.Errorf("%+v: got no error", chunks)
+		}
+	}
+	r := NewProtocolV1ReceivePackResponse(strings.NewReader(pktLines("unpack ok\n", "ok refs/heads/x\n", "option \n", "0000")))
+	for r.Scan() {
+	}
+	if r.Err() == nil {
+		t.Error("got no error for an empty option")
+	}
+}
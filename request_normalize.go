@@ -0,0 +1,154 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"sort"
+	"strings"
+)
+
+// DuplicateObjectIDs is the object IDs that appeared more than once in a
+// request.
+type DuplicateObjectIDs struct {
+	Wants []string
+	Haves []string
+}
+
+// Empty returns true if there's no duplicate.
+func (d *DuplicateObjectIDs) Empty() bool {
+	return len(d.Wants) == 0 && len(d.Haves) == 0
+}
+
+// SortedUniqueObjectIDs returns the sorted object IDs without duplicates, and
+// the sorted object IDs that appeared more than once.
+func SortedUniqueObjectIDs(ids []string) (unique, duplicates []string) {
+	return sortedUnique(ids)
+}
+
+func sortedUnique(ss []string) (unique, duplicates []string) {
+	seen := map[string]int{}
+	for _, s := range ss {
+		seen[s]++
+	}
+	for s, n := range seen {
+		unique = append(unique, s)
+		if n > 1 {
+			duplicates = append(duplicates, s)
+		}
+	}
+	sort.Strings(unique)
+	sort.Strings(duplicates)
+	return unique, duplicates
+}
+
+// NormalizeProtocolV1UploadPackRequest returns the request with sorted and
+// deduplicated wants, shallows, and haves, and the duplicates found. The
+// capabilities on the first want line are sorted too.
+//
+// All haves are merged into one round, so the result is meant for
+// fingerprinting and cache keys, not for replaying the negotiation.
+func NormalizeProtocolV1UploadPackRequest(chunks []*ProtocolV1UploadPackRequestChunk) ([]*ProtocolV1UploadPackRequestChunk, *DuplicateObjectIDs) {
+	var caps, wants, shallows, haves []string
+	var others []*ProtocolV1UploadPackRequestChunk
+	done := false
+	for _, c := range chunks {
+		switch {
+		case c.WantObjectID != "":
+			caps = append(caps, c.Capabilities...)
+			wants = append(wants, c.WantObjectID)
+		case c.ShallowObjectID != "":
+			shallows = append(shallows, c.ShallowObjectID)
+		case c.HaveObjectID != "":
+			haves = append(haves, c.HaveObjectID)
+		case c.NoMoreNegotiation:
+			done = true
+		case c.EndOneRound:
+		default:
+			others = append(others, c)
+		}
+	}
+	caps, _ = sortedUnique(caps)
+	wants, dupWants := SortedUniqueObjectIDs(wants)
+	shallows, _ = sortedUnique(shallows)
+	haves, dupHaves := SortedUniqueObjectIDs(haves)
+
+	var ret []*ProtocolV1UploadPackRequestChunk
+	for i, w := range wants {
+		c := &ProtocolV1UploadPackRequestChunk{WantObjectID: w}
+		if i == 0 {
+			c.Capabilities = caps
+		}
+		ret = append(ret, c)
+	}
+	for _, s := range shallows {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{ShallowObjectID: s})
+	}
+	ret = append(ret, others...)
+	ret = append(ret, &ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+	for _, h := range haves {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{HaveObjectID: h})
+	}
+	if len(haves) != 0 {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+	}
+	if done {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true})
+	}
+	return ret, &DuplicateObjectIDs{Wants: dupWants, Haves: dupHaves}
+}
+
+// NormalizeProtocolV2FetchArguments returns the arguments of a protocol v2
+// fetch request with sorted and deduplicated want, want-ref, shallow, and have
+// lines, and the duplicates found. The other arguments keep their order and
+// come first. done is moved to the end.
+func NormalizeProtocolV2FetchArguments(args []string) ([]string, *DuplicateObjectIDs) {
+	var others, wants, wantRefs, shallows, haves []string
+	done := false
+	for _, arg := range args {
+		arg = strings.TrimSuffix(arg, "\n")
+		switch {
+		case arg == "done":
+			done = true
+		case strings.HasPrefix(arg, "want "):
+			wants = append(wants, strings.TrimPrefix(arg, "want "))
+		case strings.HasPrefix(arg, "want-ref "):
+			wantRefs = append(wantRefs, arg)
+		case strings.HasPrefix(arg, "shallow "):
+			shallows = append(shallows, arg)
+		case strings.HasPrefix(arg, "have "):
+			haves = append(haves, strings.TrimPrefix(arg, "have "))
+		default:
+			others = append(others, arg)
+		}
+	}
+	wants, dupWants := SortedUniqueObjectIDs(wants)
+	wantRefs, _ = sortedUnique(wantRefs)
+	shallows, _ = sortedUnique(shallows)
+	haves, dupHaves := SortedUniqueObjectIDs(haves)
+
+	ret := others
+	for _, w := range wants {
+		ret = append(ret, "want "+w)
+	}
+	ret = append(ret, wantRefs...)
+	ret = append(ret, shallows...)
+	for _, h := range haves {
+		ret = append(ret, "have "+h)
+	}
+	if done {
+		ret = append(ret, "done")
+	}
+	return ret, &DuplicateObjectIDs{Wants: dupWants, Haves: dupHaves}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortedUniqueObjectIDs(t *testing.T) {
+	unique, dups := SortedUniqueObjectIDs([]string{"c", "a", "b", "a", "c", "a"})
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(unique, want) {
+		t.Errorf("unique: got %q, want %q", unique, want)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(dups, want) {
+		t.Errorf("duplicates: got %q, want %q", dups, want)
+	}
+	if unique, dups := SortedUniqueObjectIDs(nil); unique != nil || dups != nil {
+		t.Errorf("got %q and %q for no IDs", unique, dups)
+	}
+}
+
+func TestNormalizeProtocolV1UploadPackRequest(t *testing.T) {
+	chunks := []*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: "w2", Capabilities: []string{"ofs-delta", "agent=git/2"}},
+		{WantObjectID: "w1"},
+		{WantObjectID: "w2"},
+		{ShallowObjectID: "s1"},
+		{DeepenDepth: 1},
+		{EndOneRound: true},
+		{HaveObjectID: "h2"},
+		{HaveObjectID: "h1"},
+		{EndOneRound: true},
+		{HaveObjectID: "h1"},
+		{NoMoreNegotiation: true},
+	}
+	got, dups := NormalizeProtocolV1UploadPackRequest(chunks)
+	want := []*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: "w1", Capabilities: []string{"agent=git/2", "ofs-delta"}},
+		{WantObjectID: "w2"},
+		{ShallowObjectID: "s1"},
+		{DeepenDepth: 1},
+		{EndOneRound: true},
+		{HaveObjectID: "h1"},
+		{HaveObjectID: "h2"},
+		{EndOneRound: true},
+		{NoMoreNegotiation: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	wantDups := &DuplicateObjectIDs{Wants: []string{"w2"}, Haves: []string{"h1"}}
+	if !reflect.DeepEqual(dups, wantDups) || dups.Empty() {
+		t.Errorf("got %+v, want %+v", dups, wantDups)
+	}
+}
+
+func TestNormalizeProtocolV1UploadPackRequestNoHaves(t *testing.T) {
+	got, dups := NormalizeProtocolV1UploadPackRequest([]*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: "w1"},
+		{EndOneRound: true},
+	})
+	want := []*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: "w1"},
+		{EndOneRound: true},
+	}
+	if !reflect.DeepEqual(got, want) || !dups.Empty() {
+		t.Errorf("got %+v and %+v, want %+v", got, dups, want)
+	}
+}
+
+func TestNormalizeProtocolV2FetchArguments(t *testing.T) {
+	got, dups := NormalizeProtocolV2FetchArguments([]string{
+		"thin-pack\n",
+		"done\n",
+		"have h2\n",
+		"want w2\n",
+		"want-ref refs/heads/b\n",
+		"want w1\n",
+		"want-ref refs/heads/a\n",
+		"have h1\n",
+		"shallow s1\n",
+		"ofs-delta\n",
+		"have h2\n",
+	})
+	want := []string{
+		"thin-pack",
+		"ofs-delta",
+		"want w1",
+		"want w2",
+		"want-ref refs/heads/a",
+		"want-ref refs/heads/b",
+		"shallow s1",
+		"have h1",
+		"have h2",
+		"done",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	wantDups := &DuplicateObjectIDs{Haves: []string{"h2"}}
+	if !reflect.DeepEqual(dups, wantDups) {
+		t.Errorf("got %+v, want %+v", dups, wantDups)
+	}
+}
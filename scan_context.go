@@ -0,0 +1,83 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader makes the reads of a PacketScanner return when the context of
+// the current ScanContext is done. Without a context, it reads directly.
+type contextReader struct {
+	r   io.Reader
+	ctx context.Context
+	buf []byte
+}
+
+type contextReadResult struct {
+	n   int
+	err error
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if cr.ctx == nil || cr.ctx.Done() == nil {
+		return cr.r.Read(p)
+	}
+	if cr.ctx.Err() != nil {
+		return 0, context.Cause(cr.ctx)
+	}
+	if cap(cr.buf) < len(p) {
+		cr.buf = make([]byte, len(p))
+	}
+	buf := cr.buf[:len(p)]
+	ch := make(chan contextReadResult, 1)
+	go func() {
+		n, err := cr.r.Read(buf)
+		ch <- contextReadResult{n, err}
+	}()
+	select {
+	case res := <-ch:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-cr.ctx.Done():
+		// The abandoned read still owns buf. The scanner stops with the
+		// error, so the bytes it may read are never used.
+		cr.buf = nil
+		return 0, context.Cause(cr.ctx)
+	}
+}
+
+// ScanContext is Scan with the reads bound to ctx. When ctx is done, the scan
+// stops and Err returns the cause of ctx, such as context.DeadlineExceeded or a
+// PhaseDeadlineError. The scanner can't be used after that.
+//
+// A read blocked in the underlying reader keeps running in the background
+// until the reader returns. Close the reader, or use a DeadlineSetter such as
+// net.Conn with PhaseDeadlines, to release it.
+func (s *PacketScanner) ScanContext(ctx context.Context) bool {
+	return s.scanContext(ctx, s.Scan)
+}
+
+// scanContext runs scan, the Scan of the scanner or of a parser reading from
+// it, with the reads bound to ctx.
+func (s *PacketScanner) scanContext(ctx context.Context, scan func() bool) bool {
+	if s.err == nil && ctx.Err() != nil {
+		s.err = context.Cause(ctx)
+	}
+	s.reader.ctx = ctx
+	defer func() { s.reader.ctx = nil }()
+	return scan()
+}
@@ -0,0 +1,378 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlowCounter is the amount of data in a flow.
+type FlowCounter struct {
+	// Bytes is the number of bytes on the wire, including the packet
+	// headers.
+	Bytes int64
+	// Packets is the number of packets. The pack file data of
+	// git-receive-pack requests is not counted as packets.
+	Packets int64
+}
+
+func (f FlowCounter) String() string {
+	return fmt.Sprintf("%dB/%dpkt", f.Bytes, f.Packets)
+}
+
+// SessionStats accumulates the flow statistics of a session: bytes and
+// packets per direction, per sideband band, and per section, and the
+// durations of phases. It's safe for concurrent use.
+//
+// Packets are fed by AddPacket, or by wrapping the underlying reader or writer
+// of a scanner or an encoder with Reader or Writer. Sections and phases are
+// named by the caller.
+type SessionStats struct {
+	m           sync.Mutex
+	directions  [3]FlowCounter
+	bands       [4]FlowCounter
+	sideBand    [3]bool
+	sections    map[string]*FlowCounter
+	sectionList []string
+	section     string
+	phases      map[string]time.Duration
+	phaseList   []string
+	phase       string
+	phaseStart  time.Time
+}
+
+// NewSessionStats returns a new SessionStats.
+func NewSessionStats() *SessionStats {
+	return &SessionStats{
+		sections: map[string]*FlowCounter{},
+		phases:   map[string]time.Duration{},
+	}
+}
+
+// SetSideBand sets whether the packets in the direction are sideband encoded.
+// Packets in a sideband-encoded flow are counted per band.
+func (s *SessionStats) SetSideBand(d Direction, enabled bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.sideBand[directionIndex(d)] = enabled
+}
+
+// directionIndex returns the index of the direction in the counters. An
+// unknown direction goes to the slot 0, which is not reported.
+func directionIndex(d Direction) int {
+	if d == ClientToServer || d == ServerToClient {
+		return int(d)
+	}
+	return 0
+}
+
+// StartSection attributes the subsequent packets to the named section, such
+// as "wants" or "packfile".
+func (s *SessionStats) StartSection(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.section = name
+	if _, ok := s.sections[name]; !ok {
+		s.sections[name] = &FlowCounter{}
+		s.sectionList = append(s.sectionList, name)
+	}
+}
+
+// StartPhase ends the current phase if any and starts the named phase, such
+// as "discovery", "negotiation", or "pack".
+func (s *SessionStats) StartPhase(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.endPhase()
+	s.phase = name
+	s.phaseStart = time.Now()
+	if _, ok := s.phases[name]; !ok {
+		s.phaseList = append(s.phaseList, name)
+	}
+}
+
+// EndPhase ends the current phase.
+func (s *SessionStats) EndPhase() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.endPhase()
+}
+
+func (s *SessionStats) endPhase() {
+	if s.phase == "" {
+		return
+	}
+	s.phases[s.phase] += time.Since(s.phaseStart)
+	s.phase = ""
+}
+
+// AddPacket counts a packet.
+func (s *SessionStats) AddPacket(d Direction, p Packet) {
+	band := 0
+	switch p := p.(type) {
+	case SideBandMainPacket:
+		band = 1
+	case SideBandReportPacket:
+		band = 2
+	case SideBandErrorPacket:
+		band = 3
+	case BytesPacket:
+		s.m.Lock()
+		if s.sideBand[directionIndex(d)] && len(p) > 0 && p[0] <= 3 {
+			band = int(p[0])
+		}
+		s.m.Unlock()
+	}
+	isPacket := true
+	if _, ok := p.(PackFilePacket); ok {
+		isPacket = false
+	}
+	s.add(d, band, int64(packetWireSize(p)), isPacket)
+}
+
+func (s *SessionStats) add(d Direction, band int, bytes int64, isPacket bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var pkts int64
+	if isPacket {
+		pkts = 1
+	}
+	counters := []*FlowCounter{&s.directions[directionIndex(d)]}
+	if band != 0 {
+		counters = append(counters, &s.bands[band])
+	}
+	if s.section != "" {
+		counters = append(counters, s.sections[s.section])
+	}
+	for _, c := range counters {
+		c.Bytes += bytes
+		c.Packets += pkts
+	}
+}
+
+// Direction returns the counter of the direction. It's zero for an unknown
+// direction.
+func (s *SessionStats) Direction(d Direction) FlowCounter {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if directionIndex(d) == 0 {
+		return FlowCounter{}
+	}
+	return s.directions[d]
+}
+
+// Band returns the counter of the sideband band (1, 2, or 3). It's zero for
+// another band.
+func (s *SessionStats) Band(band int) FlowCounter {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if band < 1 || band > 3 {
+		return FlowCounter{}
+	}
+	return s.bands[band]
+}
+
+// Section returns the counter of the section.
+func (s *SessionStats) Section(name string) FlowCounter {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if c, ok := s.sections[name]; ok {
+		return *c
+	}
+	return FlowCounter{}
+}
+
+// Phase returns the total duration of the phase. The current phase is counted
+// until now.
+func (s *SessionStats) Phase(name string) time.Duration {
+	s.m.Lock()
+	defer s.m.Unlock()
+	d := s.phases[name]
+	if s.phase == name {
+		d += time.Since(s.phaseStart)
+	}
+	return d
+}
+
+// Phases returns the total duration of every phase. The current phase is
+// counted until now.
+func (s *SessionStats) Phases() map[string]time.Duration {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ret := map[string]time.Duration{}
+	for name, d := range s.phases {
+		ret[name] = d
+	}
+	if s.phase != "" {
+		ret[s.phase] += time.Since(s.phaseStart)
+	}
+	return ret
+}
+
+// String returns a one-line summary suitable for logging.
+func (s *SessionStats) String() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	ss := []string{
+		"c2s=" + s.directions[ClientToServer].String(),
+		"s2c=" + s.directions[ServerToClient].String(),
+	}
+	for band := 1; band <= 3; band++ {
+		if s.bands[band] != (FlowCounter{}) {
+			ss = append(ss, fmt.Sprintf("band%d=%s", band, s.bands[band]))
+		}
+	}
+	for _, name := range s.sectionList {
+		ss = append(ss, fmt.Sprintf("section:%s=%s", name, s.sections[name]))
+	}
+	for _, name := range s.phaseList {
+		d := s.phases[name]
+		if s.phase == name {
+			d += time.Since(s.phaseStart)
+		}
+		ss = append(ss, fmt.Sprintf("phase:%s=%s", name, d.Round(time.Millisecond)))
+	}
+	return strings.Join(ss, " ")
+}
+
+// Reader returns a reader that reads from r and counts the packets in the
+// direction.
+func (s *SessionStats) Reader(d Direction, r io.Reader) io.Reader {
+	return &statsReader{r: r, m: &packetMeter{s: s, d: d}}
+}
+
+// Writer returns a writer that writes to w and counts the packets in the
+// direction.
+func (s *SessionStats) Writer(d Direction, w io.Writer) io.Writer {
+	return &statsWriter{w: w, m: &packetMeter{s: s, d: d}}
+}
+
+type statsReader struct {
+	r io.Reader
+	m *packetMeter
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.m.feed(p[:n])
+	return n, err
+}
+
+type statsWriter struct {
+	w io.Writer
+	m *packetMeter
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.m.feed(p[:n])
+	return n, err
+}
+
+// packetMeter tokenizes a packet line stream incrementally and reports the
+// packets to a SessionStats.
+type packetMeter struct {
+	s *SessionStats
+	d Direction
+
+	hdr       []byte
+	remaining int
+	needBand  bool
+	raw       bool
+}
+
+func (m *packetMeter) feed(p []byte) {
+	for len(p) > 0 {
+		if m.raw {
+			m.s.add(m.d, 0, int64(len(p)), false)
+			return
+		}
+		if m.needBand {
+			m.needBand = false
+			band := 0
+			if p[0] <= 3 {
+				band = int(p[0])
+			}
+			m.s.add(m.d, band, int64(m.remaining+4), true)
+		}
+		if m.remaining > 0 {
+			n := m.remaining
+			if len(p) < n {
+				n = len(p)
+			}
+			m.remaining -= n
+			p = p[n:]
+			continue
+		}
+		n := 4 - len(m.hdr)
+		if len(p) < n {
+			n = len(p)
+		}
+		m.hdr = append(m.hdr, p[:n]...)
+		p = p[n:]
+		if len(m.hdr) < 4 {
+			return
+		}
+		m.startPacket()
+	}
+}
+
+func (m *packetMeter) startPacket() {
+	hdr := string(m.hdr)
+	m.hdr = m.hdr[:0]
+	sz, err := strconv.ParseUint(hdr, 16, 16)
+	if err != nil || (sz > 2 && sz < 4) {
+		// "PACK" or garbage. Count the rest as raw bytes.
+		m.raw = true
+		m.s.add(m.d, 0, 4, false)
+		return
+	}
+	if sz < 4 {
+		m.s.add(m.d, 0, 4, true)
+		return
+	}
+	m.remaining = int(sz) - 4
+	m.s.m.Lock()
+	sideBand := m.s.sideBand[directionIndex(m.d)]
+	m.s.m.Unlock()
+	if sideBand && m.remaining > 0 {
+		m.needBand = true
+		return
+	}
+	m.s.add(m.d, 0, int64(sz), true)
+}
+
+func packetWireSize(p Packet) int {
+	switch p := p.(type) {
+	case FlushPacket, DelimPacket, ResponseEndPacket, PackFileIndicatorPacket:
+		return 4
+	case BytesPacket:
+		return len(p) + 4
+	case SideBandMainPacket:
+		return len(p) + 5
+	case SideBandReportPacket:
+		return len(p) + 5
+	case SideBandErrorPacket:
+		return len(p) + 5
+	case PackFilePacket:
+		return len(p)
+	}
+	return len(p.EncodeToPktLine())
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSessionStats(t *testing.T) {
+	s := NewSessionStats()
+	s.SetSideBand(ServerToClient, true)
+	s.StartPhase("negotiation")
+	s.StartSection("wants")
+	s.AddPacket(ClientToServer, BytesPacket("want 1111\n"))
+	s.AddPacket(ClientToServer, FlushPacket{})
+	s.StartSection("packfile")
+	s.StartPhase("pack")
+	s.AddPacket(ServerToClient, BytesPacket("\x01PACK"))
+	s.AddPacket(ServerToClient, SideBandReportPacket("counting\n"))
+	s.EndPhase()
+
+	for _, tc := range []struct {
+		name string
+		got  FlowCounter
+		want FlowCounter
+	}{
+		{"c2s", s.Direction(ClientToServer), FlowCounter{Bytes: 18, Packets: 2}},
+		{"s2c", s.Direction(ServerToClient), FlowCounter{Bytes: 23, Packets: 2}},
+		{"band 1", s.Band(1), FlowCounter{Bytes: 9, Packets: 1}},
+		{"band 2", s.Band(2), FlowCounter{Bytes: 14, Packets: 1}},
+		{"wants", s.Section("wants"), FlowCounter{Bytes: 18, Packets: 2}},
+		{"packfile", s.Section("packfile"), FlowCounter{Bytes: 23, Packets: 2}},
+		{"unknown section", s.Section("unknown"), FlowCounter{}},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+	if len(s.Phases()) != 2 {
+		t.Errorf("unexpected phases: %v", s.Phases())
+	}
+	if str := s.String(); !strings.HasPrefix(str, "c2s=18B/2pkt s2c=23B/2pkt band1=9B/1pkt band2=14B/1pkt section:wants=") {
+		t.Errorf("unexpected summary: %s", str)
+	}
+}
+
+func TestSessionStatsUnknownDirection(t *testing.T) {
+	s := NewSessionStats()
+	for _, d := range []Direction{0, -1, 3, 100} {
+		s.SetSideBand(d, true)
+		s.AddPacket(d, BytesPacket("\x01data"))
+		s.Writer(d, io.Discard).Write(BytesPacket("\x01data").EncodeToPktLine())
+		if got := s.Direction(d); got != (FlowCounter{}) {
+			t.Errorf("direction %d: got %v", d, got)
+		}
+	}
+	for _, band := range []int{-1, 0, 4} {
+		if got := s.Band(band); got != (FlowCounter{}) {
+			t.Errorf("band %d: got %v", band, got)
+		}
+	}
+	if got := s.Direction(ClientToServer); got != (FlowCounter{}) {
+		t.Errorf("c2s: got %v", got)
+	}
+}
+
+func TestSessionStatsWriter(t *testing.T) {
+	s := NewSessionStats()
+	s.SetSideBand(ServerToClient, true)
+	stream := string(BytesPacket("\x02hello\n").EncodeToPktLine()) + FlushPkt + "PACKdata"
+	w := s.Writer(ServerToClient, io.Discard)
+	// Split the stream in the middle of the packets.
+	for _, part := range []string{stream[:3], stream[3:12], stream[12:]} {
+		if _, err := w.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := s.Direction(ServerToClient), (FlowCounter{Bytes: int64(len(stream)), Packets: 2}); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := s.Band(2), (FlowCounter{Bytes: 11, Packets: 1}); got != want {
+		t.Errorf("band 2: got %v, want %v", got, want)
+	}
+
+	s = NewSessionStats()
+	if _, err := io.Copy(io.Discard, s.Reader(ClientToServer, bytes.NewReader([]byte(stream)))); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Direction(ClientToServer); got.Bytes != int64(len(stream)) {
+		t.Errorf("reader: got %v", got)
+	}
+}
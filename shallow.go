@@ -0,0 +1,169 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadShallowFile reads the shallow commits in the format of .git/shallow, one
+// object ID per line.
+func ReadShallowFile(r io.Reader) ([]string, error) {
+	var ret []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		oid := s.Text()
+		if !isHexObjectID(oid) {
+			return nil, fmt.Errorf("bad shallow line: %q", oid)
+		}
+		ret = append(ret, oid)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func isHexObjectID(s string) bool {
+	_, err := ParseObjectID(s, "")
+	return err == nil
+}
+
+// WriteShallowFile writes the shallow commits in the format of .git/shallow.
+// The commits are sorted and deduplicated. If there is no shallow commit, git
+// removes the file instead of writing an empty one.
+func WriteShallowFile(w io.Writer, shallows []string) error {
+	bw := bufio.NewWriter(w)
+	for _, oid := range sortedKeys(shallowSet(shallows)) {
+		if _, err := fmt.Fprintf(bw, "%s\n", oid); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func shallowSet(shallows []string) map[string]bool {
+	m := map[string]bool{}
+	for _, oid := range shallows {
+		m[oid] = true
+	}
+	return m
+}
+
+// ApplyShallowUpdates returns the shallow commits after a protocol v0/v1 fetch
+// with the shallow and unshallow lines of the response applied. Chunks other
+// than them are ignored, so all the response chunks can be passed.
+func ApplyShallowUpdates(shallows []string, chunks []*ProtocolV1UploadPackResponseChunk) []string {
+	m := shallowSet(shallows)
+	for _, c := range chunks {
+		switch {
+		case c.ShallowObjectID != "":
+			m[c.ShallowObjectID] = true
+		case c.UnshallowObjectID != "":
+			delete(m, c.UnshallowObjectID)
+		}
+	}
+	return sortedKeys(m)
+}
+
+// ApplyProtocolV2ShallowInfo returns the shallow commits after a protocol v2
+// fetch with the shallow-info section of the response applied. Chunks other
+// than the shallow and unshallow lines are ignored, so all the response chunks
+// can be passed.
+func ApplyProtocolV2ShallowInfo(shallows []string, chunks []*ProtocolV2ResponseChunk) []string {
+	m := shallowSet(shallows)
+	for _, c := range chunks {
+		line := strings.TrimSuffix(string(c.Response), "\n")
+		switch {
+		case strings.HasPrefix(line, "shallow "):
+			m[strings.TrimPrefix(line, "shallow ")] = true
+		case strings.HasPrefix(line, "unshallow "):
+			delete(m, strings.TrimPrefix(line, "unshallow "))
+		}
+	}
+	return sortedKeys(m)
+}
+
+// ShallowRequestChunks returns the shallow lines of a protocol v0/v1 request
+// that tell the server the shallow commits of the client.
+func ShallowRequestChunks(shallows []string) []*ProtocolV1UploadPackRequestChunk {
+	var ret []*ProtocolV1UploadPackRequestChunk
+	for _, oid := range sortedKeys(shallowSet(shallows)) {
+		ret = append(ret, &ProtocolV1UploadPackRequestChunk{ShallowObjectID: oid})
+	}
+	return ret
+}
+
+// ShallowArguments returns the shallow arguments of a protocol v2 fetch that
+// tell the server the shallow commits of the client.
+func ShallowArguments(shallows []string) []string {
+	var ret []string
+	for _, oid := range sortedKeys(shallowSet(shallows)) {
+		ret = append(ret, "shallow "+oid)
+	}
+	return ret
+}
+
+// DeepenNotResolver resolves the ref of a deepen-not line to a commit, in the
+// same way as git rev-parse does with a ref name. It returns "" if the ref
+// doesn't exist or is ambiguous.
+type DeepenNotResolver func(ref string) (string, error)
+
+// ResolveDeepenNot returns the commits of the deepen-not lines of a protocol
+// v0/v1 request. Chunks other than deepen-not lines are ignored, so all the
+// request chunks can be passed.
+//
+// If a ref cannot be resolved, it returns the ErrorPacket git-upload-pack
+// sends. An error from the resolver is returned as is.
+func ResolveDeepenNot(chunks []*ProtocolV1UploadPackRequestChunk, resolve DeepenNotResolver) ([]string, error) {
+	var refs []string
+	for _, c := range chunks {
+		if c.DeepenNotRef != "" {
+			refs = append(refs, c.DeepenNotRef)
+		}
+	}
+	return resolveDeepenNot(refs, resolve)
+}
+
+// ResolveProtocolV2DeepenNot returns the commits of the deepen-not arguments of
+// a protocol v2 fetch request in the same way as ResolveDeepenNot.
+func ResolveProtocolV2DeepenNot(args []string, resolve DeepenNotResolver) ([]string, error) {
+	var refs []string
+	for _, arg := range args {
+		arg = strings.TrimSuffix(arg, "\n")
+		if strings.HasPrefix(arg, "deepen-not ") {
+			refs = append(refs, strings.TrimPrefix(arg, "deepen-not "))
+		}
+	}
+	return resolveDeepenNot(refs, resolve)
+}
+
+func resolveDeepenNot(refs []string, resolve DeepenNotResolver) ([]string, error) {
+	var ret []string
+	for _, ref := range refs {
+		oid, err := resolve(ref)
+		if err != nil {
+			return nil, err
+		}
+		if oid == "" {
+			return nil, ErrorPacket("git upload-pack: ambiguous deepen-not: " + ref)
+		}
+		ret = append(ret, oid)
+	}
+	return ret, nil
+}
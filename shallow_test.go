@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShallowFileRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteShallowFile(&b, []string{oidB, oidA, oidB}); err != nil {
+		t.Fatal(err)
+	}
+	if want := oidA + "\n" + oidB + "\n"; b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	got, err := ReadShallowFile(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{oidA, oidB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadShallowFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		file string
+	}{
+		{"short", "1234567\n"},
+		{"not hex", strings.Repeat("x", 40) + "\n"},
+		{"upper case", strings.Repeat("A", 40) + "\n"},
+		{"trailing space", oidA + " \n"},
+		{"empty line", oidA + "\n\n"},
+	} {
+		if got, err := ReadShallowFile(strings.NewReader(tc.file)); err == nil {
+			t.Errorf("%s: got %q, want an error", tc.name, got)
+		}
+	}
+}
+
+func TestApplyShallowUpdates(t *testing.T) {
+	got := ApplyShallowUpdates([]string{oidA}, []*ProtocolV1UploadPackResponseChunk{
+		{ShallowObjectID: oidB},
+		{UnshallowObjectID: oidA},
+		{EndOfShallows: true},
+	})
+	if want := []string{oidB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyProtocolV2ShallowInfo(t *testing.T) {
+	got := ApplyProtocolV2ShallowInfo([]string{oidA}, []*ProtocolV2ResponseChunk{
+		{Response: []byte("shallow-info\n")},
+		{Response: []byte("shallow " + oidB + "\n")},
+		{Response: []byte("unshallow " + oidA + "\n")},
+		{Delimiter: true},
+	})
+	if want := []string{oidB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestShallowRequest(t *testing.T) {
+	shallows := []string{oidB, oidA, oidA}
+	var got []string
+	for _, c := range ShallowRequestChunks(shallows) {
+		got = append(got, string(c.EncodeToPktLine()))
+	}
+	if want := []string{pktLines("shallow " + oidA + "\n"), pktLines("shallow " + oidB + "\n")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := ShallowArguments(shallows), []string{"shallow " + oidA, "shallow " + oidB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestResolveDeepenNot(t *testing.T) {
+	errBackend := errors.New("ref backend")
+	resolve := func(ref string) (string, error) {
+		switch ref {
+		case "refs/heads/main":
+			return oidA, nil
+		case "v1":
+			return oidB, nil
+		case "broken":
+			return "", errBackend
+		}
+		return "", nil
+	}
+	got, err := ResolveDeepenNot([]*ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: oidA},
+		{DeepenNotRef: "refs/heads/main"},
+		{DeepenNotRef: "v1"},
+	}, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{oidA, oidB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got, err = ResolveProtocolV2DeepenNot([]string{"want " + oidA + "\n", "deepen-not v1\n"}, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{oidB}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, err = ResolveDeepenNot([]*ProtocolV1UploadPackRequestChunk{{DeepenNotRef: "unknown"}}, resolve)
+	if want := ErrorPacket("git upload-pack: ambiguous deepen-not: unknown"); err != want {
+		t.Errorf("got %v, want %v", err, want)
+	}
+	if _, err := ResolveProtocolV2DeepenNot([]string{"deepen-not broken\n"}, resolve); err != errBackend {
+		t.Errorf("got %v, want %v", err, errBackend)
+	}
+}
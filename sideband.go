@@ -16,6 +16,7 @@ package gitprotocolio
 
 import (
 	"fmt"
+	"io"
 )
 
 // BytePayloadPacket is the interface of Packets that the payload is []byte.
@@ -30,10 +31,10 @@ type SideBandMainPacket []byte
 // EncodeToPktLine serializes the packet.
 func (p SideBandMainPacket) EncodeToPktLine() []byte {
 	sz := len(p)
-	if sz > 0xFFFF-5 {
+	if sz > MaxSideBandPayloadSize {
 		panic("content too large")
 	}
-	return append([]byte(fmt.Sprintf("%04x%c", sz+5, 1)), p...)
+	return append([]byte(fmt.Sprintf("%04x%c", sz+PacketLengthHeaderSize+1, 1)), p...)
 }
 
 // Bytes returns the payload.
@@ -47,10 +48,10 @@ type SideBandReportPacket []byte
 // EncodeToPktLine serializes the packet.
 func (p SideBandReportPacket) EncodeToPktLine() []byte {
 	sz := len(p)
-	if sz > 0xFFFF-5 {
+	if sz > MaxSideBandPayloadSize {
 		panic("content too large")
 	}
-	return append([]byte(fmt.Sprintf("%04x%c", sz+5, 2)), p...)
+	return append([]byte(fmt.Sprintf("%04x%c", sz+PacketLengthHeaderSize+1, 2)), p...)
 }
 
 // Bytes returns the payload.
@@ -64,10 +65,10 @@ type SideBandErrorPacket []byte
 // EncodeToPktLine serializes the packet.
 func (p SideBandErrorPacket) EncodeToPktLine() []byte {
 	sz := len(p)
-	if sz > 0xFFFF-5 {
+	if sz > MaxSideBandPayloadSize {
 		panic("content too large")
 	}
-	return append([]byte(fmt.Sprintf("%04x%c", sz+5, 3)), p...)
+	return append([]byte(fmt.Sprintf("%04x%c", sz+PacketLengthHeaderSize+1, 3)), p...)
 }
 
 // Bytes returns the payload.
@@ -78,6 +79,9 @@ func (p SideBandErrorPacket) Bytes() []byte {
 // ParseSideBandPacket parses the BytesPacket as a sideband packet. Returns nil
 // if the packet is not a sideband packet.
 func ParseSideBandPacket(bp BytesPacket) BytePayloadPacket {
+	if len(bp) == 0 {
+		return nil
+	}
 	switch bp[0] {
 	case 1:
 		return SideBandMainPacket(bp[1:])
@@ -88,3 +92,61 @@ func ParseSideBandPacket(bp BytesPacket) BytePayloadPacket {
 	}
 	return nil
 }
+
+// SideBandReader reads the main stream (0x01) of sideband packets that end with
+// a flush packet. The report stream (0x02) is written to the progress writer,
+// and the error stream (0x03) stops reading with a RemoteError.
+type SideBandReader struct {
+	scanner  *PacketScanner
+	progress io.Writer
+	buf      []byte
+	err      error
+}
+
+// NewSideBandReader returns a new SideBandReader to read from rd. If progress is
+// nil, the report stream is discarded.
+func NewSideBandReader(rd io.Reader, progress io.Writer) *SideBandReader {
+	if progress == nil {
+		progress = io.Discard
+	}
+	return &SideBandReader{scanner: NewPacketScanner(rd), progress: progress}
+}
+
+// Read reads the main stream. It returns io.EOF at the flush packet.
+func (r *SideBandReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *SideBandReader) next() error {
+	if !r.scanner.Scan() {
+		if err := r.scanner.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	switch p := r.scanner.Packet().(type) {
+	case FlushPacket:
+		return io.EOF
+	case BytesPacket:
+		switch sp := ParseSideBandPacket(p).(type) {
+		case SideBandMainPacket:
+			// The scanner reuses the buffer.
+			r.buf = append(r.buf[:0], sp...)
+			return nil
+		case SideBandReportPacket:
+			_, err := r.progress.Write(sp)
+			return err
+		case SideBandErrorPacket:
+			return newRemoteError(sp)
+		}
+	}
+	return SyntaxError(fmt.Sprintf("unexpected packet: %#v", r.scanner.Packet()))
+}
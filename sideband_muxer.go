@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"strings"
+	"sync"
+)
+
+// SideBandMuxer writes the pack data, the progress messages, and the error
+// messages to the sideband streams, splitting them into packets of the
+// payload size. It's safe to call the methods concurrently, e.g. from the
+// goroutines that copy the stdout and the stderr of git-pack-objects.
+type SideBandMuxer struct {
+	w           io.Writer
+	payloadSize int
+	mu          sync.Mutex
+}
+
+// NewSideBandMuxer returns a new SideBandMuxer that writes to w. payloadSize is
+// the sideband payload size: MaxSideBandPayloadSize (65515) for side-band-64k
+// and protocol v2, 999 for side-band. If it's zero or larger than
+// MaxSideBandPayloadSize, MaxSideBandPayloadSize is used, so that a packet
+// never exceeds the 65520 bytes Git accepts.
+func NewSideBandMuxer(w io.Writer, payloadSize int) *SideBandMuxer {
+	if payloadSize <= 0 || payloadSize > MaxSideBandPayloadSize {
+		payloadSize = MaxSideBandPayloadSize
+	}
+	return &SideBandMuxer{w: w, payloadSize: payloadSize}
+}
+
+// Write writes p to the main stream, so the muxer can be the destination of an
+// io.Copy of the pack data.
+func (m *SideBandMuxer) Write(p []byte) (int, error) {
+	if err := m.WritePack(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// WritePack writes the pack data to the main stream (0x01).
+func (m *SideBandMuxer) WritePack(p []byte) error {
+	return m.write(p, func(b []byte) Packet { return SideBandMainPacket(b) })
+}
+
+// WriteProgress writes a progress message to the report stream (0x02). The
+// message is sent as is, so it should end with "\n" or "\r".
+func (m *SideBandMuxer) WriteProgress(msg string) error {
+	return m.write([]byte(msg), func(b []byte) Packet { return SideBandReportPacket(b) })
+}
+
+// WriteError writes an error message to the error stream (0x03). A newline is
+// added if the message doesn't end with one. The client aborts the transfer
+// after this, so nothing should be written after it.
+func (m *SideBandMuxer) WriteError(msg string) error {
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	return m.write([]byte(msg), func(b []byte) Packet { return SideBandErrorPacket(b) })
+}
+
+func (m *SideBandMuxer) write(p []byte, packet func([]byte) Packet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(p) != 0 {
+		sz := len(p)
+		if sz > m.payloadSize {
+			sz = m.payloadSize
+		}
+		if _, err := m.w.Write(packet(p[:sz]).EncodeToPktLine()); err != nil {
+			return err
+		}
+		p = p[sz:]
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSideBandMuxer(t *testing.T) {
+	var b bytes.Buffer
+	m := NewSideBandMuxer(&b, 4)
+	if _, err := io.Copy(m, strings.NewReader("PACKabcdef")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.WriteProgress("Total 3\n"); err != nil {
+		t.Fatal(err)
+	}
+	want := pktLines("\x01PACK", "\x01abcd", "\x01ef", "\x02Tota", "\x02l 3\n")
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+
+	// The output is read back by SideBandReader.
+	b.WriteString(FlushPkt)
+	var progress bytes.Buffer
+	got, err := io.ReadAll(NewSideBandReader(&b, &progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "PACKabcdef" || progress.String() != "Total 3\n" {
+		t.Errorf("got %q, progress %q", got, progress.String())
+	}
+}
+
+func TestSideBandMuxerError(t *testing.T) {
+	var b bytes.Buffer
+	m := NewSideBandMuxer(&b, 0)
+	m.WritePack([]byte("PACK"))
+	m.WriteError("object not found")
+	if want := pktLines("\x01PACK", "\x03object not found\n"); b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+	_, err := io.ReadAll(NewSideBandReader(&b, nil))
+	var re *RemoteError
+	if !errors.As(err, &re) {
+		t.Errorf("got %v, want a RemoteError", err)
+	}
+
+	if err := NewSideBandMuxer(failingWriter{}, 0).WritePack([]byte("PACK")); err == nil {
+		t.Error("got no error from the writer")
+	}
+	if n, err := NewSideBandMuxer(failingWriter{}, 0).Write([]byte("PACK")); n != 0 || err == nil {
+		t.Errorf("got %d, %v, want an error", n, err)
+	}
+}
+
+func TestSideBandMuxerPayloadSize(t *testing.T) {
+	for _, tc := range []struct {
+		size int
+		want int
+	}{
+		{0, 65515},
+		{-1, 65515},
+		{MaxSideBandPayloadSize + 1, 65515},
+		{999, 999},
+	} {
+		var b bytes.Buffer
+		NewSideBandMuxer(&b, tc.size).WritePack(make([]byte, MaxSideBandPayloadSize+1))
+		s := NewPacketScanner(&b)
+		if !s.Scan() {
+			t.Fatal(s.Err())
+		}
+		if got := len(s.Packet().(BytesPacket)) - 1; got != tc.want {
+			t.Errorf("size %d: got %d, want %d", tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestSideBandMuxerLargeWrite(t *testing.T) {
+	var b bytes.Buffer
+	data := bytes.Repeat([]byte("x"), 200*1024)
+	if _, err := NewSideBandMuxer(&b, 0).Write(data); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	for rest := b.Bytes(); len(rest) != 0; {
+		sz, err := strconv.ParseUint(string(rest[:PacketLengthHeaderSize]), 16, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sz > 65520 {
+			t.Fatalf("got a %d-byte packet, want at most 65520", sz)
+		}
+		got = append(got, rest[PacketLengthHeaderSize+1:sz]...)
+		rest = rest[sz:]
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes of pack data, want %d", len(got), len(data))
+	}
+}
+
+func TestSideBandMuxerConcurrent(t *testing.T) {
+	var b bytes.Buffer
+	m := NewSideBandMuxer(&b, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			m.WritePack([]byte("0123456789"))
+		}()
+		go func() {
+			defer wg.Done()
+			m.WriteProgress("progress\n")
+		}()
+	}
+	wg.Wait()
+	b.WriteString(FlushPkt)
+	var progress bytes.Buffer
+	got, err := io.ReadAll(NewSideBandReader(&b, &progress))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("0123456789", 10); string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := strings.Repeat("progress\n", 10); progress.String() != want {
+		t.Errorf("got %q, want %q", progress.String(), want)
+	}
+}
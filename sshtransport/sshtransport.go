@@ -0,0 +1,197 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sshtransport runs git-upload-pack and git-receive-pack over SSH.
+//
+// Git runs "git-upload-pack '<path>'" on the remote host, with the path quoted
+// for the remote shell, and requests protocol v2 with the GIT_PROTOCOL
+// environment variable. The service's standard input and output carry the
+// pkt-line streams, and the connection is stateful like git://.
+package sshtransport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gitprotocolio"
+)
+
+// maxStderrSize is the size of the standard error kept for an error message.
+const maxStderrSize = 4096
+
+// Session is a remote command session. *ssh.Session of
+// golang.org/x/crypto/ssh implements it.
+type Session interface {
+	Setenv(name, value string) error
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.Reader, error)
+	StderrPipe() (io.Reader, error)
+	Start(cmd string) error
+	Wait() error
+	Close() error
+}
+
+// Command returns the remote command line of the service, such as
+// "git-upload-pack '/project.git'".
+func Command(service, path string) string {
+	return service + " " + quote(path)
+}
+
+// quote quotes s for a POSIX shell in the same way as Git's sq_quote. "!" is
+// escaped too for the shells with the history expansion.
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		switch r {
+		case '\'', '!':
+			b.WriteString(`'\`)
+			b.WriteRune(r)
+			b.WriteByte('\'')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// Conn is a running service. Read reads its standard output and Write writes
+// to its standard input.
+type Conn struct {
+	session Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+
+	mu     sync.Mutex
+	stderr []byte
+	done   chan struct{}
+}
+
+// Start runs the service ("git-upload-pack" or "git-receive-pack") for the
+// repository path on the session. If version is not 0, GIT_PROTOCOL requests
+// the protocol version. SSH servers often reject the variable, and then the
+// service speaks v0; gitprotocolio.DiscoverWithFallback handles both on the
+// same Conn.
+func Start(s Session, service, path string, version int) (*Conn, error) {
+	if version != 0 {
+		// If rejected, the service falls back to v0.
+		s.Setenv("GIT_PROTOCOL", "version="+strconv.Itoa(version))
+	}
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := s.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Start(Command(service, path)); err != nil {
+		return nil, err
+	}
+	c := &Conn{session: s, stdin: stdin, stdout: stdout, done: make(chan struct{})}
+	go c.readStderr(stderr)
+	return c, nil
+}
+
+// readStderr keeps the head of the standard error for the error message. The
+// rest is discarded so that the remote command doesn't block.
+func (c *Conn) readStderr(r io.Reader) {
+	defer close(c.done)
+	buf := make([]byte, 512)
+	for {
+		n, err := r.Read(buf)
+		c.mu.Lock()
+		if room := maxStderrSize - len(c.stderr); room > 0 {
+			if n > room {
+				n = room
+			}
+			c.stderr = append(c.stderr, buf[:n]...)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read reads the standard output of the service.
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+// Write writes to the standard input of the service.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite closes the standard input of the service. git-receive-pack
+// finishes reading the pack at the EOF.
+func (c *Conn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+// Stderr returns the head of the standard error of the service so far.
+func (c *Conn) Stderr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return string(c.stderr)
+}
+
+// Wait closes the standard input, waits for the service to exit, and closes
+// the session. If the service fails, the error has its standard error.
+func (c *Conn) Wait() error {
+	c.stdin.Close()
+	// Read the standard error to the end before Wait closes it.
+	<-c.done
+	err := c.session.Wait()
+	c.session.Close()
+	if err != nil {
+		if msg := strings.TrimSpace(c.Stderr()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+	}
+	return err
+}
+
+// Close closes the session without waiting for the service.
+func (c *Conn) Close() error {
+	c.stdin.Close()
+	return c.session.Close()
+}
+
+// Opener returns a gitprotocolio.DiscoveryOpener that starts the service on a
+// new session, for gitprotocolio.DiscoverWithFallback.
+func Opener(newSession func(ctx context.Context) (Session, error), service, path string) gitprotocolio.DiscoveryOpener {
+	return func(ctx context.Context, version int) (io.ReadCloser, error) {
+		s, err := newSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c, err := Start(s, service, path, version)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
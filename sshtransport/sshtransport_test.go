@@ -0,0 +1,152 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sshtransport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// stdin is the standard input of a fakeSession.
+type stdin struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *stdin) Close() error {
+	w.closed = true
+	return nil
+}
+
+// fakeSession runs a command that writes the canned output.
+type fakeSession struct {
+	env     map[string]string
+	cmd     string
+	stdin   stdin
+	stdout  string
+	stderr  string
+	waitErr error
+	closed  bool
+}
+
+func (s *fakeSession) Setenv(name, value string) error {
+	if s.env == nil {
+		s.env = map[string]string{}
+	}
+	s.env[name] = value
+	return nil
+}
+
+func (s *fakeSession) StdinPipe() (io.WriteCloser, error) { return &s.stdin, nil }
+func (s *fakeSession) StdoutPipe() (io.Reader, error)     { return strings.NewReader(s.stdout), nil }
+func (s *fakeSession) StderrPipe() (io.Reader, error)     { return strings.NewReader(s.stderr), nil }
+
+func (s *fakeSession) Start(cmd string) error {
+	s.cmd = cmd
+	return nil
+}
+
+func (s *fakeSession) Wait() error { return s.waitErr }
+
+func (s *fakeSession) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestCommand(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/project.git", `git-upload-pack '/project.git'`},
+		{"~user/it's.git", `git-upload-pack '~user/it'\''s.git'`},
+		{"/a b!", `git-upload-pack '/a b'\!''`},
+	} {
+		if got := Command("git-upload-pack", tc.path); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	for _, version := range []int{0, 2} {
+		s := &fakeSession{stdout: "advertisement"}
+		c, err := Start(s, "git-upload-pack", "/repo.git", version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.cmd != "git-upload-pack '/repo.git'" {
+			t.Errorf("version %d: got command %s", version, s.cmd)
+		}
+		if v, ok := s.env["GIT_PROTOCOL"]; ok != (version == 2) || (ok && v != "version=2") {
+			t.Errorf("version %d: got GIT_PROTOCOL %q", version, v)
+		}
+		if _, err := c.Write([]byte("request")); err != nil {
+			t.Fatal(err)
+		}
+		bs, err := io.ReadAll(c)
+		if err != nil || string(bs) != "advertisement" {
+			t.Errorf("version %d: got %q, %v", version, bs, err)
+		}
+		if err := c.Wait(); err != nil {
+			t.Error(err)
+		}
+		if s.stdin.String() != "request" || !s.stdin.closed || !s.closed {
+			t.Errorf("version %d: got stdin %q, closed %v, session closed %v", version, s.stdin.String(), s.stdin.closed, s.closed)
+		}
+	}
+}
+
+func TestConnWaitError(t *testing.T) {
+	errExit := errors.New("exit status 128")
+	s := &fakeSession{stderr: "fatal: '/repo.git' does not appear to be a git repository\n" + strings.Repeat("x", 2*maxStderrSize), waitErr: errExit}
+	c, err := Start(s, "git-upload-pack", "/repo.git", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Wait()
+	if err == nil || !strings.HasPrefix(err.Error(), "exit status 128: fatal: '/repo.git' does not appear to be a git repository") {
+		t.Errorf("got %v", err)
+	}
+	if got := len(c.Stderr()); got != maxStderrSize {
+		t.Errorf("got %d bytes of the standard error, want %d", got, maxStderrSize)
+	}
+}
+
+func TestOpener(t *testing.T) {
+	var sessions []*fakeSession
+	open := Opener(func(ctx context.Context) (Session, error) {
+		s := &fakeSession{}
+		sessions = append(sessions, s)
+		return s, nil
+	}, "git-receive-pack", "/repo.git")
+	rc, err := open(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	if len(sessions) != 1 || sessions[0].cmd != "git-receive-pack '/repo.git'" || sessions[0].env["GIT_PROTOCOL"] != "version=2" || !sessions[0].closed {
+		t.Errorf("got sessions %+v", sessions)
+	}
+
+	errDial := errors.New("dial")
+	open = Opener(func(ctx context.Context) (Session, error) { return nil, errDial }, "git-upload-pack", "/repo.git")
+	if _, err := open(context.Background(), 0); err != errDial {
+		t.Errorf("got %v, want %v", err, errDial)
+	}
+}
@@ -0,0 +1,2799 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package end2end
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gitprotocolio"
+	"github.com/google/gitprotocolio/capture"
+	"github.com/google/gitprotocolio/client"
+	"github.com/google/gitprotocolio/gittest"
+	"github.com/google/gitprotocolio/httpclient"
+	"github.com/google/gitprotocolio/httpserver"
+	"github.com/google/gitprotocolio/packfile"
+	"github.com/google/gitprotocolio/sshtransport"
+)
+
+// The tests in this file drive git-upload-pack and git-receive-pack directly
+// with the requests built from this package's chunks, and parse the responses
+// with this package's parsers. The other tests cover the opposite direction,
+// git clients against the proxy built from this package.
+
+// runService runs "git <service> --stateless-rpc" on the remote repository with
+// the request as the input.
+func runService(service, gitProtocol string, request []byte, arg ...string) ([]byte, error) {
+	args := append([]string{service, "--stateless-rpc"}, arg...)
+	cmd := exec.Command(gitBinary, append(args, string(remoteGitRepo))...)
+	cmd.Env = os.Environ()
+	if gitProtocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+gitProtocol)
+	}
+	cmd.Stdin = bytes.NewReader(request)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	bs, err := cmd.Output()
+	if err != nil {
+		return nil, &commandError{err, cmd.Args, strings.TrimRight(stderr.String(), "\n")}
+	}
+	return bs, nil
+}
+
+func encodeChunks(chunks ...gitprotocolio.Packet) []byte {
+	var buf bytes.Buffer
+	for _, c := range chunks {
+		buf.Write(c.EncodeToPktLine())
+	}
+	return buf.Bytes()
+}
+
+// advertisedRefs parses the ref advertisement of the service.
+func advertisedRefs(t *testing.T, service string) map[string]string {
+	bs, err := runService(service, "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]string{}
+	r := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+	for r.Scan() {
+		if c := r.Chunk(); c.Ref != "" {
+			refs[c.Ref] = c.ObjectID
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("cannot parse the %s advertisement: %v", service, err)
+	}
+	return refs
+}
+
+func pushInitialCommit(t *testing.T) string {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=init"); err != nil {
+		t.Fatal(err)
+	}
+	oid, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(oid)
+}
+
+func TestConformance_clone(t *testing.T) {
+	want := pushInitialCommit(t)
+
+	for name, args := range protocolParams() {
+		r := createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(args, "clone", httpProxyURL, "cloned")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := gitRepo(string(r)+"/cloned").run("rev-parse", "HEAD"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if strings.TrimSpace(got) != want {
+			t.Errorf("%s: want %s, got %s", name, want, got)
+		}
+	}
+}
+
+func TestConformance_uploadPackV0(t *testing.T) {
+	want := pushInitialCommit(t)
+	if got := advertisedRefs(t, "upload-pack")["refs/heads/master"]; got != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	req := encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: []string{"side-band-64k", "ofs-delta"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+	)
+	bs, err := runService("upload-pack", "", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	nak, pack := false, false
+	for r.Scan() {
+		c := r.Chunk()
+		nak = nak || c.Nak
+		pack = pack || len(c.PackStream) != 0
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !nak || !pack {
+		t.Errorf("want a NAK and a pack, got NAK %v, pack %v", nak, pack)
+	}
+}
+
+func TestConformance_uploadPackPackReader(t *testing.T) {
+	want := pushInitialCommit(t)
+
+	for _, caps := range [][]string{{"side-band-64k"}, {"ofs-delta"}} {
+		req := encodeChunks(
+			&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: caps},
+			&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+			&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+		)
+		bs, err := runService("upload-pack", "", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+		v := gitprotocolio.NewPackVerifier(false)
+		if _, err := io.Copy(v, r.PackReader(nil)); err != nil {
+			t.Fatalf("%v: %v", caps, err)
+		}
+		if err := v.Verify(); err != nil {
+			t.Errorf("%v: %v", caps, err)
+		}
+		if !r.ResponseComplete() {
+			t.Errorf("%v: the response isn't read to the end", caps)
+		}
+	}
+}
+
+func TestConformance_uploadPackV2(t *testing.T) {
+	want := pushInitialCommit(t)
+
+	lsRefs := encodeChunks(
+		&gitprotocolio.ProtocolV2RequestChunk{Command: "ls-refs"},
+		&gitprotocolio.ProtocolV2RequestChunk{EndCapability: true},
+		&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("ref-prefix refs/heads/\n")},
+		&gitprotocolio.ProtocolV2RequestChunk{EndArgument: true},
+	)
+	bs, err := runService("upload-pack", "version=2", lsRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	r := gitprotocolio.NewProtocolV2Response(bytes.NewReader(bs))
+	for r.Scan() {
+		if c := r.Chunk(); len(c.Response) != 0 {
+			lines = append(lines, strings.TrimSuffix(string(c.Response), "\n"))
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 1 || lines[0] != want+" refs/heads/master" {
+		t.Errorf("unexpected ls-refs response: %q", lines)
+	}
+
+	fetch := encodeChunks(
+		&gitprotocolio.ProtocolV2RequestChunk{Command: "fetch"},
+		&gitprotocolio.ProtocolV2RequestChunk{EndCapability: true},
+		&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("want " + want + "\n")},
+		&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("done\n")},
+		&gitprotocolio.ProtocolV2RequestChunk{EndArgument: true},
+	)
+	bs, err = runService("upload-pack", "version=2", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pack := false
+	fr := gitprotocolio.NewProtocolV2FetchResponse(bytes.NewReader(bs))
+	for fr.Scan() {
+		pack = pack || len(fr.Chunk().PackStream) != 0
+	}
+	if err := fr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !pack {
+		t.Error("no packfile section in the fetch response")
+	}
+}
+
+// emptyPack returns a pack without objects, sent when the new refs point to
+// existing commits.
+func emptyPack() []byte {
+	pack := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+	sum := sha1.Sum(pack)
+	return append(pack, sum[:]...)
+}
+
+func TestConformance_receivePack(t *testing.T) {
+	oid := pushInitialCommit(t)
+	refs := advertisedRefs(t, "receive-pack")
+	if refs["refs/heads/master"] != oid {
+		t.Fatalf("want %s, got %s", oid, refs["refs/heads/master"])
+	}
+
+	req := encodeChunks(
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			OldObjectID:  gitprotocolio.ObjectFormatSHA1.ZeroObjectID(),
+			NewObjectID:  oid,
+			RefName:      "refs/heads/copy",
+			Capabilities: []string{"report-status"},
+		},
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true},
+	)
+	bs, err := runService("receive-pack", "", append(req, emptyPack()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	r := gitprotocolio.NewProtocolV1ReceivePackResponse(bytes.NewReader(bs))
+	for r.Scan() {
+		c := *r.Chunk()
+		chunks = append(chunks, &c)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) == 0 {
+		t.Fatal("empty report-status")
+	}
+	if st := chunks[0].Unpack(); st == nil || !st.Ok {
+		t.Errorf("unpack failed: %+v", st)
+	}
+	sts, err := gitprotocolio.ParseRefStatuses(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 1 || sts[0].RefName != "refs/heads/copy" || !sts[0].Ok {
+		t.Errorf("unexpected ref statuses: %+v", sts)
+	}
+	if got := advertisedRefs(t, "receive-pack")["refs/heads/copy"]; got != oid {
+		t.Errorf("want %s, got %s", oid, got)
+	}
+}
+
+func TestConformance_receivePackSideBand(t *testing.T) {
+	oid := pushInitialCommit(t)
+
+	req := encodeChunks(
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			OldObjectID:  gitprotocolio.ObjectFormatSHA1.ZeroObjectID(),
+			NewObjectID:  oid,
+			RefName:      "refs/heads/copy",
+			Capabilities: []string{"report-status", "side-band-64k"},
+		},
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true},
+	)
+	bs, err := runService("receive-pack", "", append(req, emptyPack()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	r := gitprotocolio.NewProtocolV1ReceivePackResponseFromSideBand(bytes.NewReader(bs), nil)
+	for r.Scan() {
+		c := *r.Chunk()
+		chunks = append(chunks, &c)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	sts, err := gitprotocolio.ParseRefStatuses(chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 1 || sts[0].RefName != "refs/heads/copy" || !sts[0].Ok {
+		t.Errorf("unexpected ref statuses: %+v", sts)
+	}
+}
+
+func TestConformance_uploadPackMultiAckDetailed(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=first"); err != nil {
+		t.Fatal(err)
+	}
+	have, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	have, want = strings.TrimSpace(have), strings.TrimSpace(want)
+
+	for _, done := range []bool{false, true} {
+		chunks := []gitprotocolio.Packet{
+			&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: []string{"multi_ack_detailed", "side-band-64k"}},
+			&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+			&gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: have},
+		}
+		// In the stateless-RPC mode, the last round ends with done instead
+		// of a flush.
+		if done {
+			chunks = append(chunks, &gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true})
+		} else {
+			chunks = append(chunks, &gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+		}
+		bs, err := runService("upload-pack", "", encodeChunks(chunks...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var acks []string
+		pack := false
+		resp := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+		for resp.Scan() {
+			c := resp.Chunk()
+			switch {
+			case c.AckObjectID != "":
+				acks = append(acks, strings.TrimSpace(c.AckObjectID+" "+c.AckDetail))
+			case c.Nak:
+				acks = append(acks, "NAK")
+			case len(c.PackStream) != 0:
+				pack = true
+			}
+		}
+		if err := resp.Err(); err != nil {
+			t.Fatalf("done %v: %v", done, err)
+		}
+		if len(acks) == 0 || acks[0] != have+" common" || pack != done {
+			t.Errorf("done %v: unexpected response: acks %q, pack %v", done, acks, pack)
+		}
+	}
+}
+
+func TestConformance_uploadPackStatelessRPC(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=first"); err != nil {
+		t.Fatal(err)
+	}
+	have, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	have, want = strings.TrimSpace(have), strings.TrimSpace(want)
+
+	// Without multi_ack, the server exits after the first ACK.
+	bs, err := runService("upload-pack", "", encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: []string{"side-band-64k"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: have},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	for resp.Scan() {
+	}
+	if resp.Err() == nil {
+		t.Error("got no error without the stateless-RPC mode")
+	}
+
+	var acks []string
+	resp = gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	resp.SetStatelessRPC(true)
+	for resp.Scan() {
+		if c := resp.Chunk(); c.AckObjectID != "" {
+			acks = append(acks, c.AckObjectID)
+		}
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.ResponseComplete() {
+		t.Error("the response is not complete")
+	}
+	if len(acks) != 1 || acks[0] != have {
+		t.Errorf("unexpected acks: %q", acks)
+	}
+}
+
+func TestConformance_uploadPackNoDone(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("commit", "--allow-empty", "--message=first"); err != nil {
+		t.Fatal(err)
+	}
+	have, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=second"); err != nil {
+		t.Fatal(err)
+	}
+	want, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	have, want = strings.TrimSpace(have), strings.TrimSpace(want)
+
+	// With no-done, the server sends the pack once it's ready, without
+	// waiting for done.
+	bs, err := runService("upload-pack", "", encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: []string{"multi_ack_detailed", "no-done", "side-band-64k"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: have},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	resp.SetStatelessRPC(true)
+	n := gitprotocolio.NewFetchNegotiator([]string{"multi_ack_detailed", "no-done"}, true)
+	for resp.Scan() {
+		c := resp.Chunk()
+		if len(c.PackStream) != 0 {
+			break
+		}
+		n.Observe(c)
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !n.Ready() {
+		t.Error("the server is not ready")
+	}
+	v := gitprotocolio.NewPackVerifier(false)
+	if _, err := io.Copy(v, resp.PackReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Verify(); err != nil {
+		t.Error(err)
+	}
+	if !resp.ResponseComplete() {
+		t.Error("the response is not complete")
+	}
+}
+
+func TestConformance_progressParser(t *testing.T) {
+	want := pushInitialCommit(t)
+	bs, err := runService("upload-pack", "", encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: []string{"side-band-64k"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phases := map[string]*gitprotocolio.ProgressEvent{}
+	progress := gitprotocolio.NewProgressParser(func(e *gitprotocolio.ProgressEvent) {
+		if e.Phase == "" {
+			return
+		}
+		if e.Total != 0 && e.Current > e.Total {
+			t.Errorf("%q: current %d exceeds total %d", e.Line, e.Current, e.Total)
+		}
+		phases[e.Phase] = e
+	})
+	resp := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	if _, err := io.Copy(io.Discard, resp.PackReader(progress)); err != nil {
+		t.Fatal(err)
+	}
+	e, ok := phases["Enumerating objects"]
+	if !ok {
+		t.Fatalf("no enumerating progress: %+v", phases)
+	}
+	if !e.Done || e.Current == 0 {
+		t.Errorf("unexpected last event: %+v", e)
+	}
+
+	for _, tc := range []struct {
+		line string
+		want gitprotocolio.ProgressEvent
+	}{
+		{"Counting objects:  45% (9/20)", gitprotocolio.ProgressEvent{Phase: "Counting objects", Current: 9, Total: 20}},
+		{"Receiving objects: 100% (20/20), 1.00 KiB | 1.00 MiB/s, done.", gitprotocolio.ProgressEvent{Phase: "Receiving objects", Current: 20, Total: 20, Done: true}},
+		{"Total 3 (delta 0), reused 0 (delta 0), pack-reused 0", gitprotocolio.ProgressEvent{}},
+	} {
+		tc.want.Line = tc.line
+		if got := gitprotocolio.ParseProgress(tc.line); *got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.line, got, tc.want)
+		}
+	}
+}
+
+func TestConformance_clientFetch(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	var oids []string
+	for i := 0; i < 3; i++ {
+		if _, err := r.run("commit", "--allow-empty", fmt.Sprintf("--message=%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		oid, err := r.run("rev-parse", "master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		oids = append(oids, strings.TrimSpace(oid))
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	want := oids[len(oids)-1]
+	parents := func(oid string) ([]string, error) {
+		out, err := r.run("rev-parse", oid+"^@")
+		return strings.Fields(out), err
+	}
+
+	for _, disableV2 := range []bool{true, false} {
+		for _, haves := range [][]string{nil, oids[:1]} {
+			opts := &client.FetchOptions{
+				Refs:              []string{"refs/heads/master"},
+				DisableProtocolV2: disableV2,
+			}
+			if haves != nil {
+				var tips []*gitprotocolio.NegotiationTip
+				for _, oid := range haves {
+					tips = append(tips, &gitprotocolio.NegotiationTip{ObjectID: oid})
+				}
+				opts.Haves = gitprotocolio.NewHaveWalker([]string{want}, tips, nil, parents).Next
+			}
+			res, err := client.Fetch(context.Background(), &httpclient.Client{URL: httpServerURL}, opts)
+			if err != nil {
+				t.Fatalf("v2 disabled %v, haves %v: %v", disableV2, haves, err)
+			}
+			if got := res.Refs["refs/heads/master"]; got != want {
+				t.Errorf("v2 disabled %v: want %s, got %s", disableV2, want, got)
+			}
+			v := gitprotocolio.NewPackVerifier(false)
+			if _, err := io.Copy(v, res.Pack); err != nil {
+				t.Fatal(err)
+			}
+			res.Pack.Close()
+			if err := v.Verify(); err != nil {
+				t.Errorf("v2 disabled %v, haves %v: %v", disableV2, haves, err)
+			}
+		}
+	}
+}
+
+func TestConformance_clientPush(t *testing.T) {
+	base := pushInitialCommit(t)
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("fetch", httpServerURL, "master"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("reset", "--hard", "FETCH_HEAD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--allow-empty", "--message=next"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := r.run("rev-parse", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := strings.TrimSpace(out)
+	cmd := exec.Command(gitBinary, "pack-objects", "--stdout", "--revs")
+	cmd.Dir = string(r)
+	cmd.Stdin = strings.NewReader(next + "\n^" + base + "\n")
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zero := gitprotocolio.ObjectFormatSHA1.ZeroObjectID()
+	var progress bytes.Buffer
+	res, err := client.Push(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.PushOptions{
+		Updates: []*gitprotocolio.RefUpdate{
+			{RefName: "refs/heads/master", OldObjectID: base, NewObjectID: next},
+			{RefName: "refs/heads/copy", OldObjectID: zero, NewObjectID: base},
+			{RefName: "refs/heads/stale", OldObjectID: base, NewObjectID: next},
+		},
+		Pack:     bytes.NewReader(pack),
+		Progress: &progress,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Unpack.Ok {
+		t.Fatalf("unpack failed: %s", res.Unpack.Reason)
+	}
+	for _, u := range res.Updates {
+		wantOk := u.RefName != "refs/heads/stale"
+		if u.Status == nil || u.Status.Ok != wantOk {
+			t.Errorf("%s: unexpected status %+v", u.RefName, u.Status)
+		}
+	}
+	refs := advertisedRefs(t, "receive-pack")
+	if refs["refs/heads/master"] != next || refs["refs/heads/copy"] != base {
+		t.Errorf("unexpected refs: %v", refs)
+	}
+
+	res, err = client.Push(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.PushOptions{
+		Updates: []*gitprotocolio.RefUpdate{
+			{RefName: "refs/heads/copy", OldObjectID: base, NewObjectID: zero},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := res.Updates[0]; u.Status == nil || !u.Status.Ok {
+		t.Errorf("%s: unexpected status %+v", u.RefName, u.Status)
+	}
+	if _, ok := advertisedRefs(t, "receive-pack")["refs/heads/copy"]; ok {
+		t.Error("refs/heads/copy isn't deleted")
+	}
+}
+
+func TestConformance_httpClientGzip(t *testing.T) {
+	oid := pushInitialCommit(t)
+	chunks := []gitprotocolio.Packet{
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: oid, Capabilities: []string{"side-band-64k"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+	}
+	// Unknown haves make the request larger than the gzip threshold.
+	for i := 0; i < 64; i++ {
+		h := sha1.Sum([]byte(fmt.Sprint(i)))
+		chunks = append(chunks, &gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: fmt.Sprintf("%x", h)})
+	}
+	chunks = append(chunks, &gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true})
+
+	c := &httpclient.Client{URL: httpServerURL}
+	rc, err := c.Request(context.Background(), "git-upload-pack", 0, bytes.NewReader(encodeChunks(chunks...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var nak, pack bool
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(rc)
+	for r.Scan() {
+		nak = nak || r.Chunk().Nak
+		pack = pack || len(r.Chunk().PackStream) != 0
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !nak || !pack {
+		t.Errorf("want NAK and a pack, got NAK %v, pack %v", nak, pack)
+	}
+
+	c.URL = httpServerURL + "/nonexistent"
+	if _, err := c.Discover(context.Background(), "git-upload-pack", 0); err == nil {
+		t.Error("want an error for a nonexistent repository")
+	}
+}
+
+// cgitBackend is an httpserver backend that runs git-upload-pack and
+// git-receive-pack.
+type cgitBackend struct{}
+
+func (cgitBackend) AdvertiseRefs(ctx context.Context, service string) ([]string, gitprotocolio.RefIterator, error) {
+	bs, err := runService(strings.TrimPrefix(service, "git-"), "", nil, "--advertise-refs")
+	if err != nil {
+		return nil, nil, err
+	}
+	var caps []string
+	var refs []*gitprotocolio.AdvertisedRef
+	r := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+	for r.Scan() {
+		c := r.Chunk()
+		if c.Capabilities != nil {
+			caps = c.Capabilities
+		}
+		switch {
+		case c.Ref == "" || c.Ref == "capabilities^{}":
+		case c.IsPeeled():
+			refs[len(refs)-1].Peeled = c.ObjectID
+		default:
+			refs = append(refs, &gitprotocolio.AdvertisedRef{Name: c.Ref, ObjectID: c.ObjectID})
+		}
+	}
+	return caps, gitprotocolio.RefSlice(refs), r.Err()
+}
+
+func (cgitBackend) UploadPack(ctx context.Context, req []*gitprotocolio.ProtocolV1UploadPackRequestChunk, send func(*gitprotocolio.ProtocolV1UploadPackResponseChunk) error) error {
+	var buf bytes.Buffer
+	for _, c := range req {
+		buf.Write(c.EncodeToPktLine())
+	}
+	bs, err := runService("upload-pack", "", buf.Bytes())
+	if err != nil {
+		return err
+	}
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	for r.Scan() {
+		if err := send(r.Chunk()); err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+func (cgitBackend) ReceivePack(ctx context.Context, req []*gitprotocolio.ProtocolV1ReceivePackRequestChunk, pack io.Reader) ([]*gitprotocolio.ProtocolV1ReceivePackResponseChunk, error) {
+	var buf bytes.Buffer
+	for _, c := range req {
+		if len(c.Capabilities) != 0 {
+			// The handler adds the sideband.
+			cc := *c
+			cc.Capabilities = nil
+			for _, s := range c.Capabilities {
+				if s != "side-band-64k" {
+					cc.Capabilities = append(cc.Capabilities, s)
+				}
+			}
+			c = &cc
+		}
+		buf.Write(c.EncodeToPktLine())
+	}
+	if _, err := io.Copy(&buf, pack); err != nil {
+		return nil, err
+	}
+	bs, err := runService("receive-pack", "", buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var chunks []*gitprotocolio.ProtocolV1ReceivePackResponseChunk
+	r := gitprotocolio.NewProtocolV1ReceivePackResponse(bytes.NewReader(bs))
+	for r.Scan() {
+		c := *r.Chunk()
+		chunks = append(chunks, &c)
+	}
+	return chunks, r.Err()
+}
+
+func TestConformance_httpServer(t *testing.T) {
+	base := pushInitialCommit(t)
+	mux := http.NewServeMux()
+	mux.Handle("/repo/info/refs", &httpserver.InfoRefsHandler{Backend: cgitBackend{}})
+	mux.Handle("/repo/git-upload-pack", &httpserver.UploadPackHandler{Backend: cgitBackend{}})
+	mux.Handle("/repo/git-receive-pack", &httpserver.ReceivePackHandler{Backend: cgitBackend{}})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	u := s.URL + "/repo"
+
+	for name, args := range protocolParams() {
+		branch := strings.ReplaceAll(name, " ", "-")
+		r := createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(args, "fetch", u, "master")...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if out, err := r.run("rev-parse", "FETCH_HEAD"); err != nil || strings.TrimSpace(out) != base {
+			t.Errorf("%s: want %s, got %s (%v)", name, base, out, err)
+		}
+		if _, err := r.run("reset", "--hard", "FETCH_HEAD"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("commit", "--allow-empty", "--message="+name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run(append(args, "push", u, "master:"+branch)...); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		next, err := r.run("rev-parse", "master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := advertisedRefs(t, "receive-pack")["refs/heads/"+branch]; got != strings.TrimSpace(next) {
+			t.Errorf("%s: want %s, got %s", name, next, got)
+		}
+	}
+}
+
+// serveDaemon accepts git:// connections and runs the requested service on the
+// remote repository. It sends the parsed requests to reqs.
+func serveDaemon(l net.Listener, reqs chan<- *gitprotocolio.DaemonRequest) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			req, err := gitprotocolio.ReadDaemonRequest(conn)
+			if err != nil {
+				conn.Write(gitprotocolio.ErrorPacket(err.Error()).EncodeToPktLine())
+				return
+			}
+			reqs <- req
+			cmd := exec.Command(gitBinary, strings.TrimPrefix(req.Service, "git-"), string(remoteGitRepo))
+			cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+strings.Join(req.ExtraParameters, ":"))
+			cmd.Stdin = conn
+			cmd.Stdout = conn
+			cmd.Run()
+		}()
+	}
+}
+
+func TestConformance_daemon(t *testing.T) {
+	oid := pushInitialCommit(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	reqs := make(chan *gitprotocolio.DaemonRequest, 10)
+	go serveDaemon(l, reqs)
+	addr := l.Addr().String()
+
+	r := createLocalGitRepo()
+	defer r.close()
+	for _, version := range []int{0, 2} {
+		out, err := r.run("-c", fmt.Sprintf("protocol.version=%d", version), "ls-remote", "git://"+addr+"/repo", "refs/heads/master")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(out, oid) {
+			t.Errorf("version %d: want %s, got %q", version, oid, out)
+		}
+		req := <-reqs
+		if req.Service != "git-upload-pack" || req.Path != "/repo" || req.Host != addr || req.ProtocolVersion() != version {
+			t.Errorf("version %d: unexpected request %+v", version, req)
+		}
+		if got, err := gitprotocolio.ParseDaemonRequest(req.EncodeToPktLine()[gitprotocolio.PacketLengthHeaderSize:]); err != nil || !reflect.DeepEqual(got, req) {
+			t.Errorf("version %d: round trip: got %+v, %v", version, got, err)
+		}
+	}
+
+	d, rc, err := gitprotocolio.DiscoverWithFallback(context.Background(), client.DaemonOpener(addr, "git-upload-pack", "/repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	<-reqs
+	if d.ProtocolVersion != 2 {
+		t.Errorf("want protocol v2, got %d", d.ProtocolVersion)
+	}
+}
+
+// execSession is an sshtransport.Session that runs the command locally with a
+// shell, as sshd does.
+type execSession struct {
+	cmd *exec.Cmd
+}
+
+func newExecSession() *execSession {
+	cmd := exec.Command("sh", "-c")
+	cmd.Env = os.Environ()
+	return &execSession{cmd: cmd}
+}
+
+func (s *execSession) Setenv(name, value string) error {
+	s.cmd.Env = append(s.cmd.Env, name+"="+value)
+	return nil
+}
+
+func (s *execSession) StdinPipe() (io.WriteCloser, error) { return s.cmd.StdinPipe() }
+func (s *execSession) StdoutPipe() (io.Reader, error)     { return s.cmd.StdoutPipe() }
+func (s *execSession) StderrPipe() (io.Reader, error)     { return s.cmd.StderrPipe() }
+func (s *execSession) Wait() error                        { return s.cmd.Wait() }
+func (s *execSession) Close() error                       { return nil }
+
+func (s *execSession) Start(cmd string) error {
+	s.cmd.Args = append(s.cmd.Args, cmd)
+	return s.cmd.Start()
+}
+
+func TestConformance_sshTransport(t *testing.T) {
+	oid := pushInitialCommit(t)
+	if got, want := sshtransport.Command("git-upload-pack", "/a b/it's!"), `git-upload-pack '/a b/it'\''s'\!''`; got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+
+	newSession := func(ctx context.Context) (sshtransport.Session, error) {
+		return newExecSession(), nil
+	}
+	d, rc, err := gitprotocolio.DiscoverWithFallback(context.Background(), sshtransport.Opener(newSession, "git-upload-pack", string(remoteGitRepo)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ProtocolVersion != 2 {
+		t.Errorf("want protocol v2, got %d", d.ProtocolVersion)
+	}
+	c := rc.(*sshtransport.Conn)
+	if _, err := c.Write(encodeChunks(
+		&gitprotocolio.ProtocolV2RequestChunk{Command: "ls-refs"},
+		&gitprotocolio.ProtocolV2RequestChunk{EndCapability: true},
+		&gitprotocolio.ProtocolV2RequestChunk{EndArgument: true},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	r := gitprotocolio.NewProtocolV2Response(c)
+	var refs []string
+	for r.Scan() && !r.ResponseComplete() {
+		if c := r.Chunk(); len(c.Response) != 0 {
+			refs = append(refs, strings.TrimSpace(string(c.Response)))
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := oid + " refs/heads/master"; !reflect.DeepEqual(refs, []string{oid + " HEAD", want}) {
+		t.Errorf("unexpected refs: %v", refs)
+	}
+	if err := c.Wait(); err != nil {
+		t.Error(err)
+	}
+
+	c, err = sshtransport.Start(newExecSession(), "git-upload-pack", string(remoteGitRepo)+"-nonexistent", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, c)
+	if err := c.Wait(); err == nil || !strings.Contains(err.Error(), "does not appear to be a git repository") {
+		t.Errorf("want an error with the stderr, got %v", err)
+	}
+}
+
+func TestConformance_packfileScanner(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	content := strings.Repeat("line of a file to be deltified\n", 200)
+	for i := 0; i < 3; i++ {
+		content += fmt.Sprintf("change %d\n", i)
+		if err := os.WriteFile(string(r)+"/file", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("add", "file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("commit", fmt.Sprintf("--message=%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ofsDelta := range []bool{true, false} {
+		args := []string{"pack-objects", "--stdout", "--revs"}
+		if !ofsDelta {
+			args = append(args, "--no-reuse-delta")
+		} else {
+			args = append(args, "--delta-base-offset")
+		}
+		cmd := exec.Command(gitBinary, args...)
+		cmd.Dir = string(r)
+		cmd.Stdin = strings.NewReader("master\n")
+		pack, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// index-pack + verify-pack print "<oid> <type> <size> <size in
+		// pack> <offset> [<depth> <base>]" per object.
+		packPath := string(r) + "/test.pack"
+		if err := os.WriteFile(packPath, pack, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("index-pack", packPath); err != nil {
+			t.Fatal(err)
+		}
+		out, err := r.run("verify-pack", "-v", packPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{}
+		for _, line := range strings.Split(out, "\n") {
+			fs := strings.Fields(line)
+			if len(fs) >= 5 && len(fs[0]) == 40 {
+				want[fs[4]] = fs[3]
+			}
+		}
+
+		s := packfile.NewScanner(bytes.NewReader(pack), nil)
+		got := map[string]string{}
+		deltas := 0
+		for s.Scan() {
+			o := s.Object()
+			got[fmt.Sprint(o.Offset)] = fmt.Sprint(o.CompressedSize)
+			if o.Type.IsDelta() {
+				deltas++
+			}
+			if (o.Type == packfile.ObjectOfsDelta) != (o.BaseOffset != 0) || (o.Type == packfile.ObjectRefDelta) != (o.BaseObjectID != "") {
+				t.Errorf("unexpected delta base: %+v", o)
+			}
+		}
+		if err := s.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ofs-delta %v: want offsets and sizes %v, got %v", ofsDelta, want, got)
+		}
+		if deltas == 0 {
+			t.Errorf("ofs-delta %v: no delta in the pack", ofsDelta)
+		}
+		if int(s.Header().NumObjects) != len(got) || s.Checksum() != fmt.Sprintf("%x", pack[len(pack)-20:]) {
+			t.Errorf("ofs-delta %v: unexpected header %+v or checksum %s", ofsDelta, s.Header(), s.Checksum())
+		}
+
+		pack[len(pack)-1] ^= 1
+		s = packfile.NewScanner(bytes.NewReader(pack), nil)
+		for s.Scan() {
+		}
+		var pce *gitprotocolio.PackChecksumError
+		if !errors.As(s.Err(), &pce) {
+			t.Errorf("want a checksum error, got %v", s.Err())
+		}
+	}
+}
+
+func TestConformance_packfileDecoder(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	content := strings.Repeat("line of a file to be deltified\n", 200)
+	for i := 0; i < 4; i++ {
+		content += fmt.Sprintf("change %d\n", i)
+		if err := os.WriteFile(string(r)+"/file", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("add", "file"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.run("commit", fmt.Sprintf("--message=%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	externalBase := func(oid string) (packfile.ObjectType, []byte, error) {
+		typ, err := r.run("cat-file", "-t", oid)
+		if err != nil {
+			return 0, nil, err
+		}
+		if strings.TrimSpace(typ) != "blob" {
+			return 0, nil, fmt.Errorf("unexpected base type %s", typ)
+		}
+		data, err := r.run("cat-file", "blob", oid)
+		return packfile.ObjectBlob, []byte(data), err
+	}
+
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		revs      string
+		cacheSize int64
+	}{
+		{"ofs-delta", []string{"--delta-base-offset"}, "master\n", 0},
+		{"ref-delta", []string{"--no-reuse-delta"}, "master\n", 0},
+		{"no cache", []string{"--delta-base-offset"}, "master\n", 1},
+		{"thin", []string{"--thin"}, "master\n^master~1\n", 0},
+	} {
+		cmd := exec.Command(gitBinary, append([]string{"pack-objects", "--stdout", "--revs"}, tc.args...)...)
+		cmd.Dir = string(r)
+		cmd.Stdin = strings.NewReader(tc.revs)
+		pack, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{}
+		cmd = exec.Command(gitBinary, "rev-list", "--objects", "--no-object-names", "--stdin")
+		cmd.Dir = string(r)
+		cmd.Stdin = strings.NewReader(tc.revs)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, oid := range strings.Fields(string(out)) {
+			typ, err := r.run("cat-file", "-t", oid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[oid] = strings.TrimSpace(typ)
+		}
+
+		d := packfile.NewDecoder(bytes.NewReader(pack), nil)
+		d.CacheSize = tc.cacheSize
+		if tc.name == "thin" {
+			d.ExternalBase = externalBase
+		}
+		got := map[string]string{}
+		if err := d.Decode(func(o *packfile.Object) error {
+			got[o.ObjectID] = o.Type.String()
+			return nil
+		}); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: want objects %v, got %v", tc.name, want, got)
+		}
+
+		if tc.name == "thin" {
+			err := packfile.NewDecoder(bytes.NewReader(pack), nil).Decode(func(*packfile.Object) error { return nil })
+			var se packfile.SyntaxError
+			if !errors.As(err, &se) {
+				t.Errorf("thin: want a missing base error, got %v", err)
+			}
+		}
+	}
+}
+
+func TestConformance_packfileWriter(t *testing.T) {
+	r := createLocalGitRepo()
+	defer r.close()
+	base := strings.Repeat("line of a blob\n", 100)
+	var pack bytes.Buffer
+	w := packfile.NewWriter(&pack, 3, nil)
+	blob := &packfile.ObjectHeader{Type: packfile.ObjectBlob}
+	if err := w.WriteObject(blob, []byte(base)); err != nil {
+		t.Fatal(err)
+	}
+	baseID := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("blob %d\x00%s", len(base), base))))
+	// A delta that copies the whole base and appends "x\n".
+	delta := []byte{byte(len(base)&0x7f | 0x80), byte(len(base) >> 7), byte((len(base)+2)&0x7f | 0x80), byte((len(base) + 2) >> 7), 0x80 | 0x01 | 0x10 | 0x20, 0, byte(len(base)), byte(len(base) >> 8), 2, 'x', '\n'}
+	if err := w.WriteObject(&packfile.ObjectHeader{Type: packfile.ObjectOfsDelta, BaseOffset: blob.Offset}, delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteObject(&packfile.ObjectHeader{Type: packfile.ObjectRefDelta, BaseObjectID: baseID}, delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteObject(&packfile.ObjectHeader{Type: packfile.ObjectBlob}, nil); err == nil {
+		t.Error("want an error for too many objects")
+	}
+
+	cmd := exec.Command(gitBinary, "index-pack", "--stdin")
+	cmd.Dir = string(r)
+	cmd.Stdin = bytes.NewReader(pack.Bytes())
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("index-pack: %v: %s", err, out)
+	}
+	if got, err := r.run("cat-file", "blob", baseID); err != nil || got != base {
+		t.Errorf("unexpected base: %v", err)
+	}
+	id := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("blob %d\x00%sx\n", len(base)+2, base))))
+	if got, err := r.run("cat-file", "blob", id); err != nil || got != base+"x\n" {
+		t.Errorf("unexpected delta result: %v", err)
+	}
+	if w.Checksum() != fmt.Sprintf("%x", pack.Bytes()[pack.Len()-20:]) {
+		t.Errorf("unexpected checksum %s", w.Checksum())
+	}
+
+	if err := packfile.NewWriter(io.Discard, 2, nil).Close(); err == nil {
+		t.Error("want an error for too few objects")
+	}
+}
+
+func TestConformance_v2CapabilityAdvertisement(t *testing.T) {
+	pushInitialCommit(t)
+	bs, err := runService("upload-pack", "version=2", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := gitprotocolio.ReadProtocolV2CapabilityAdvertisement(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.HasCommand("ls-refs") || !a.Features("fetch").Has("shallow") || a.Agent() == "" || a.ObjectFormat() != gitprotocolio.ObjectFormatSHA1 {
+		t.Errorf("unexpected capabilities: %v", a.Capabilities)
+	}
+	if got := a.EncodeToPktLine(); !bytes.Equal(got, bs) {
+		t.Errorf("want the re-encoded advertisement %q, got %q", bs, got)
+	}
+
+	bs, err = runService("upload-pack", "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitprotocolio.ReadProtocolV2CapabilityAdvertisement(bytes.NewReader(bs)); err == nil {
+		t.Error("want an error for a v0 advertisement")
+	}
+}
+
+func TestConformance_lsRefs(t *testing.T) {
+	oid := pushInitialCommit(t)
+	if _, err := remoteGitRepo.run("-c", "user.name=tagger", "-c", "user.email=tagger@example.com", "tag", "-a", "-m", "v1", "v1", oid); err != nil {
+		t.Fatal(err)
+	}
+	tagOID, err := remoteGitRepo.run("rev-parse", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagOID = strings.TrimSpace(tagOID)
+
+	req := &gitprotocolio.LsRefsRequest{Peel: true, Symrefs: true, Unborn: true, RefPrefixes: []string{"HEAD", "refs/tags/"}}
+	var body bytes.Buffer
+	for _, c := range req.Chunks(nil) {
+		body.Write(c.EncodeToPktLine())
+	}
+	var args []string
+	r := gitprotocolio.NewProtocolV2Request(bytes.NewReader(body.Bytes()))
+	for r.Scan() {
+		if c := r.Chunk(); len(c.Argument) != 0 {
+			args = append(args, string(c.Argument))
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if parsed, err := gitprotocolio.ParseLsRefsArguments(args); err != nil || !reflect.DeepEqual(parsed, req) {
+		t.Errorf("want the parsed request %+v, got %+v (%v)", req, parsed, err)
+	}
+
+	bs, err := runService("upload-pack", "version=2", body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []gitprotocolio.LsRefsResponseChunk
+	var encoded []byte
+	resp := gitprotocolio.NewLsRefsResponse(bytes.NewReader(bs))
+	resp.SetObjectFormat(gitprotocolio.ObjectFormatSHA1)
+	for resp.Scan() {
+		got = append(got, *resp.Chunk())
+		encoded = append(encoded, resp.Chunk().EncodeToPktLine()...)
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []gitprotocolio.LsRefsResponseChunk{
+		{ObjectID: oid, Ref: "HEAD", SymrefTarget: "refs/heads/master"},
+		{ObjectID: tagOID, Ref: "refs/tags/v1", Peeled: oid},
+		{EndResponse: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if !bytes.Equal(encoded, bs) {
+		t.Errorf("want the re-encoded response %q, got %q", bs, encoded)
+	}
+
+	if _, err := gitprotocolio.ParseLsRefsArguments([]string{"bogus\n"}); err == nil {
+		t.Error("want an error for an unknown argument")
+	}
+}
+
+func TestConformance_objectInfo(t *testing.T) {
+	oid := pushInitialCommit(t)
+	if _, err := remoteGitRepo.run("config", "transfer.advertiseObjectInfo", "true"); err != nil {
+		t.Fatal(err)
+	}
+	size, err := remoteGitRepo.run("cat-file", "-s", oid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := strings.Repeat("1", 40)
+	req := &gitprotocolio.ObjectInfoRequest{Size: true, ObjectIDs: []string{oid, missing}}
+	var body bytes.Buffer
+	for _, c := range req.Chunks(nil) {
+		body.Write(c.EncodeToPktLine())
+	}
+	bs, err := runService("upload-pack", "version=2", body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []gitprotocolio.ObjectInfoResponseChunk
+	var encoded []byte
+	resp := gitprotocolio.NewObjectInfoResponse(bytes.NewReader(bs))
+	resp.SetObjectFormat(gitprotocolio.ObjectFormatSHA1)
+	for resp.Scan() {
+		got = append(got, *resp.Chunk())
+		encoded = append(encoded, resp.Chunk().EncodeToPktLine()...)
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var n uint64
+	fmt.Sscan(size, &n)
+	want := []gitprotocolio.ObjectInfoResponseChunk{
+		{Attributes: []string{"size"}},
+		{ObjectID: oid, Size: n, HasSize: true},
+		{ObjectID: missing, Missing: true},
+		{EndResponse: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if !bytes.Equal(encoded, bs) {
+		t.Errorf("want the re-encoded response %q, got %q", bs, encoded)
+	}
+
+	// The server side encoder writes the same response.
+	var args []string
+	r := gitprotocolio.NewProtocolV2Request(bytes.NewReader(body.Bytes()))
+	for r.Scan() {
+		if c := r.Chunk(); len(c.Argument) != 0 {
+			args = append(args, string(c.Argument))
+		}
+	}
+	parsed, err := gitprotocolio.ParseObjectInfoArguments(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks []gitprotocolio.Packet
+	for _, c := range gitprotocolio.EncodeObjectInfoResponse(parsed, func(id string) (uint64, bool) { return n, id == oid }) {
+		chunks = append(chunks, c)
+	}
+	if got := encodeChunks(chunks...); !bytes.Equal(got, bs) {
+		t.Errorf("want the encoded response %q, got %q", bs, got)
+	}
+}
+
+func TestConformance_clientFetchPackfileURIs(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if err := os.WriteFile(string(r)+"/large", []byte(strings.Repeat("offloaded\n", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("add", "large"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--message=large"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := r.run("rev-parse", "master:large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob = strings.TrimSpace(blob)
+	packHash := strings.Repeat("1", 40)
+	uri := "https://cdn.example.com/large.pack"
+	if _, err := remoteGitRepo.run("config", "uploadpack.blobPackfileUri", fmt.Sprintf("%s %s %s", blob, packHash, uri)); err != nil {
+		t.Fatal(err)
+	}
+	// Git's upload-pack sends packfile-uris only with sideband-all.
+	if _, err := remoteGitRepo.run("config", "uploadpack.allowSidebandAll", "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, protocols := range [][]string{nil, {"https"}} {
+		var progress bytes.Buffer
+		res, err := client.Fetch(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.FetchOptions{
+			Refs:                 []string{"refs/heads/master"},
+			PackfileURIProtocols: protocols,
+			Progress:             &progress,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := packfile.NewScanner(res.Pack, nil)
+		blobs := 0
+		for s.Scan() {
+			if s.Object().Type == packfile.ObjectBlob {
+				blobs++
+			}
+		}
+		res.Pack.Close()
+		if err := s.Err(); err != nil {
+			t.Fatal(err)
+		}
+
+		var want []*client.PackfileURI
+		wantBlobs := 1
+		if protocols != nil {
+			want = []*client.PackfileURI{{Hash: packHash, URI: uri}}
+			wantBlobs = 0
+		}
+		if !reflect.DeepEqual(res.PackfileURIs, want) || blobs != wantBlobs {
+			t.Errorf("protocols %v: want %v and %d blobs, got %v and %d blobs", protocols, want, wantBlobs, res.PackfileURIs, blobs)
+		}
+		if !strings.Contains(progress.String(), "Enumerating objects") {
+			t.Errorf("protocols %v: no progress message: %q", protocols, progress.String())
+		}
+	}
+}
+
+func TestConformance_filterSpec(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	if err := os.WriteFile(string(r)+"/small", []byte("small\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(string(r)+"/large", []byte(strings.Repeat("large\n", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("add", "small", "large"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("commit", "--message=files"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.run("push", httpServerURL, "master:master"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		spec      string
+		canonical string
+		blobs     int
+	}{
+		{"blob:none", "blob:none", 0},
+		{"blob:limit=1k", "blob:limit=1024", 1},
+		{"combine:blob:limit=1k+object:type=blob", "combine:blob:limit=1024+object:type=blob", 1},
+		{"combine:blob:none+sparse:oid=master%7e1:.sparse", "combine:blob:none+sparse:oid=master%7e1:.sparse", -1},
+		{"tree:0", "tree:0", 0},
+	} {
+		f, err := gitprotocolio.ParseFilterSpec(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.String() != tc.canonical {
+			t.Errorf("%s: want %s, got %s", tc.spec, tc.canonical, f.String())
+		}
+		if _, err := gitprotocolio.ParseFilterSpec(f.String()); err != nil {
+			t.Errorf("%s: cannot parse the encoded spec: %v", tc.spec, err)
+		}
+		if tc.blobs < 0 {
+			continue
+		}
+		for _, disableV2 := range []bool{true, false} {
+			res, err := client.Fetch(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.FetchOptions{
+				Refs:              []string{"refs/heads/master"},
+				Filter:            f,
+				DisableProtocolV2: disableV2,
+			})
+			if err != nil {
+				t.Fatalf("%s, v2 disabled %v: %v", tc.spec, disableV2, err)
+			}
+			s := packfile.NewScanner(res.Pack, nil)
+			blobs := 0
+			for s.Scan() {
+				if s.Object().Type == packfile.ObjectBlob {
+					blobs++
+				}
+			}
+			res.Pack.Close()
+			if err := s.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if blobs != tc.blobs {
+				t.Errorf("%s, v2 disabled %v: want %d blobs, got %d", tc.spec, disableV2, tc.blobs, blobs)
+			}
+		}
+	}
+
+	for _, spec := range []string{"blob:limit=x", "tree:", "object:type=foo", "combine:", "combine:blob:none+tree:1 ", "sparse:path=x", "unknown"} {
+		if _, err := gitprotocolio.ParseFilterSpec(spec); err == nil {
+			t.Errorf("%q: want an error", spec)
+		}
+	}
+}
+
+func TestConformance_wantValidator(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	commit := func(args ...string) string {
+		out, err := r.run(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(out)
+	}
+	commit("commit", "--allow-empty", "--message=first")
+	reachable := commit("rev-parse", "master")
+	commit("commit", "--allow-empty", "--message=second")
+	tip := commit("rev-parse", "master")
+	hidden := commit("commit-tree", "-p", reachable, "-m", "hidden", reachable+"^{tree}")
+	dangling := commit("commit-tree", "-p", reachable, "-m", "dangling", reachable+"^{tree}")
+	for _, refspec := range []string{"master:master", hidden + ":refs/heads/hidden", dangling + ":refs/heads/dangling", ":refs/heads/dangling"} {
+		if _, err := r.run("push", httpServerURL, refspec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := remoteGitRepo.run("config", "uploadpack.hideRefs", "refs/heads/hidden"); err != nil {
+		t.Fatal(err)
+	}
+	isReachable := func(oid string, tips []string) (bool, error) {
+		out, err := remoteGitRepo.run(append([]string{"rev-list", oid, "--not"}, tips...)...)
+		if err != nil {
+			return false, err
+		}
+		return out == "", nil
+	}
+
+	for _, config := range []string{"", "uploadpack.allowTipSHA1InWant", "uploadpack.allowReachableSHA1InWant"} {
+		if config != "" {
+			if _, err := remoteGitRepo.run("config", config, "true"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		bs, err := runService("upload-pack", "", nil, "--advertise-refs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var caps gitprotocolio.Capabilities
+		var tips []string
+		adv := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+		for adv.Scan() {
+			c := adv.Chunk()
+			if c.Capabilities != nil {
+				caps = c.Capabilities
+			}
+			if c.Ref != "" {
+				tips = append(tips, c.ObjectID)
+			}
+		}
+		if err := adv.Err(); err != nil {
+			t.Fatal(err)
+		}
+		v := gitprotocolio.NewWantValidator(caps, tips)
+		v.SetHiddenTips([]string{hidden})
+		v.SetReachability(isReachable)
+		v.SetStatelessRPC(true)
+
+		for _, want := range []string{tip, hidden, reachable, dangling} {
+			req := encodeChunks(
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: want, Capabilities: []string{"side-band-64k"}},
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+				&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+			)
+			_, gitErr := runService("upload-pack", "", req)
+
+			p := gitprotocolio.NewProtocolV1UploadPackRequest(bytes.NewReader(req))
+			p.SetPolicy(&gitprotocolio.UploadPackPolicy{Wants: v})
+			for p.Scan() {
+			}
+			var ep gitprotocolio.ErrorPacket
+			if err := p.Err(); err != nil && !errors.As(err, &ep) {
+				t.Fatal(err)
+			}
+			if (gitErr == nil) != (p.Err() == nil) {
+				t.Errorf("%q, want %s: git error %v, validator error %v", config, want, gitErr, p.Err())
+			}
+		}
+	}
+}
+
+func TestConformance_refInWant(t *testing.T) {
+	master := pushInitialCommit(t)
+	if _, err := remoteGitRepo.run("config", "uploadpack.allowRefInWant", "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := &gitprotocolio.FetchRequest{
+		WantRefs: []string{"refs/heads/master"},
+		OfsDelta: true,
+		Done:     true,
+	}
+	parsed, err := gitprotocolio.ParseFetchArguments(req.Arguments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, req) {
+		t.Errorf("want %+v, got %+v", req, parsed)
+	}
+	var chunks []gitprotocolio.Packet
+	for _, c := range req.Chunks(nil) {
+		chunks = append(chunks, c)
+	}
+	bs, err := runService("upload-pack", "version=2", encodeChunks(chunks...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := gitprotocolio.NewProtocolV2FetchResponse(bytes.NewReader(bs))
+	wanted := map[string]string{}
+	for resp.Scan() {
+		if c := resp.Chunk(); c.WantedRefName != "" {
+			wanted[c.WantedRefName] = c.WantedRefObjectID
+		}
+	}
+	if err := resp.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"refs/heads/master": master}
+	if !reflect.DeepEqual(wanted, want) {
+		t.Errorf("wanted-refs: want %v, got %v", want, wanted)
+	}
+
+	res, err := client.Fetch(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.FetchOptions{
+		Refs:         []string{"refs/heads/master"},
+		UseRefInWant: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := packfile.NewScanner(res.Pack, nil)
+	for s.Scan() {
+	}
+	res.Pack.Close()
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Refs, want) {
+		t.Errorf("client: want %v, got %v", want, res.Refs)
+	}
+
+	if _, err := gitprotocolio.ParseFetchArguments([]string{"want-ref"}); err == nil {
+		t.Error("want an error for a want-ref line without a ref")
+	}
+}
+
+func TestConformance_deepen(t *testing.T) {
+	refreshRemote()
+	r := createLocalGitRepo()
+	defer r.close()
+	var commits []string
+	for _, msg := range []string{"first", "second", "third"} {
+		if _, err := r.run("commit", "--allow-empty", "--message="+msg); err != nil {
+			t.Fatal(err)
+		}
+		oid, err := r.run("rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, strings.TrimSpace(oid))
+	}
+	if _, err := r.run("push", httpServerURL, "master:master", commits[0]+":refs/heads/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, disableV2 := range []bool{true, false} {
+		res, err := client.Fetch(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.FetchOptions{
+			Refs:              []string{"refs/heads/master"},
+			DeepenNot:         []string{"refs/heads/old"},
+			DisableProtocolV2: disableV2,
+		})
+		if err != nil {
+			t.Fatalf("v2 disabled %v: %v", disableV2, err)
+		}
+		res.Pack.Close()
+		if want := []string{commits[1]}; !reflect.DeepEqual(res.Shallows, want) {
+			t.Errorf("v2 disabled %v: want shallows %v, got %v", disableV2, want, res.Shallows)
+		}
+	}
+
+	req := encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: commits[2], Capabilities: []string{"shallow", "deepen-since", "deepen-not"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenSince: 1},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenNotRef: "refs/heads/old"},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenNotRef: "refs/heads/other"},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{FilterSpec: "blob:none"},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+	)
+	p := gitprotocolio.NewProtocolV1UploadPackRequest(bytes.NewReader(req))
+	var deepenNot []string
+	for p.Scan() {
+		if c := p.Chunk(); c.DeepenNotRef != "" {
+			deepenNot = append(deepenNot, c.DeepenNotRef)
+		}
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"refs/heads/old", "refs/heads/other"}; !reflect.DeepEqual(deepenNot, want) {
+		t.Errorf("want deepen-not %v, got %v", want, deepenNot)
+	}
+}
+
+func TestConformance_clientSignedPush(t *testing.T) {
+	base := pushInitialCommit(t)
+	statusFile := string(remoteGitRepo) + "/cert-status"
+	hook := "#!/bin/sh\necho \"$GIT_PUSH_CERT_STATUS $GIT_PUSH_CERT_NONCE_STATUS\" > " + statusFile + "\n"
+	if err := os.WriteFile(string(remoteGitRepo)+"/hooks/pre-receive", []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the server verify the signature with the local key.
+	gpgProgram := string(remoteGitRepo) + "/gpg"
+	if err := os.WriteFile(gpgProgram, []byte("#!/bin/sh\nexec gpg --homedir "+gnuPGHome+" \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteGitRepo.run("config", "gpg.program", gpgProgram); err != nil {
+		t.Fatal(err)
+	}
+	// The server has all the objects, but expects a pack for a non-delete.
+	cmd := exec.Command(gitBinary, "pack-objects", "--stdout")
+	cmd.Dir = string(remoteGitRepo)
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed []byte
+	zero := gitprotocolio.ObjectFormatSHA1.ZeroObjectID()
+	res, err := client.Push(context.Background(), &httpclient.Client{URL: httpServerURL}, &client.PushOptions{
+		Updates: []*gitprotocolio.RefUpdate{
+			{RefName: "refs/heads/signed", OldObjectID: zero, NewObjectID: base},
+		},
+		Pack:   bytes.NewReader(pack),
+		Pusher: fmt.Sprintf("local root <local-root@example.com> %d +0000", time.Now().Unix()),
+		Pushee: httpServerURL,
+		SignPushCert: func(payload []byte) ([]byte, error) {
+			signed = payload
+			cmd := exec.Command("gpg", "--homedir", gnuPGHome, "--batch", "--detach-sign", "--armor")
+			cmd.Stdin = bytes.NewReader(payload)
+			return cmd.Output()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := res.Updates[0]; u.Status == nil || !u.Status.Ok {
+		t.Fatalf("unexpected status %+v", u.Status)
+	}
+	bs, err := os.ReadFile(statusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(bs)); got != "G OK" {
+		t.Errorf("want the certificate status G OK, got %q", got)
+	}
+
+	// The parser reads back the same certificate.
+	cert := &gitprotocolio.PushCertificate{
+		Pusher:   "local root <local-root@example.com> 1700000000 +0000",
+		Nonce:    "1700000000-0123456789abcdef",
+		Commands: []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{{OldObjectID: zero, NewObjectID: base, RefName: "refs/heads/signed", InPushCert: true}},
+	}
+	cert.Signature = []byte("-----BEGIN PGP SIGNATURE-----\n\nAAAA\n-----END PGP SIGNATURE-----\n")
+	var req bytes.Buffer
+	for _, c := range cert.Chunks([]string{"report-status"}) {
+		req.Write(c.EncodeToPktLine())
+	}
+	req.Write((&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true}).EncodeToPktLine())
+	p := gitprotocolio.NewProtocolV1ReceivePackRequest(&req)
+	for p.Scan() {
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got := p.PushCertificate()
+	if got == nil || !bytes.Equal(got.Payload, cert.EncodePayload()) || !bytes.Equal(got.Signature, cert.Signature) {
+		t.Errorf("want %+v, got %+v", cert, got)
+	}
+	if len(signed) == 0 || !bytes.HasPrefix(signed, []byte("certificate version 0.1\npusher local root")) {
+		t.Errorf("unexpected signed payload %q", signed)
+	}
+}
+
+func TestConformance_pushOptions(t *testing.T) {
+	base := pushInitialCommit(t)
+	envFile := string(remoteGitRepo) + "/push-option-env"
+	hook := "#!/bin/sh\nenv | grep ^GIT_PUSH_OPTION_ | sort > " + envFile + "\n"
+	if err := os.WriteFile(string(remoteGitRepo)+"/hooks/pre-receive", []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	options := []string{"ci.skip", "reviewer=a@example.com"}
+	optionChunks, err := gitprotocolio.PushOptionsChunks(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := []gitprotocolio.Packet{
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+			OldObjectID:  base,
+			NewObjectID:  gitprotocolio.ObjectFormatSHA1.ZeroObjectID(),
+			RefName:      "refs/heads/master",
+			Capabilities: []string{"report-status", "delete-refs", "push-options"},
+		},
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true},
+	}
+	for _, c := range optionChunks {
+		chunks = append(chunks, c)
+	}
+	req := encodeChunks(chunks...)
+
+	p := gitprotocolio.NewProtocolV1ReceivePackRequest(bytes.NewReader(req))
+	for p.Scan() {
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.PushOptions(), options) {
+		t.Errorf("want %v, got %v", options, p.PushOptions())
+	}
+
+	if _, err := runService("receive-pack", "", req); err != nil {
+		t.Fatal(err)
+	}
+	bs, err := os.ReadFile(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	want := gitprotocolio.PushOptionsEnv(options)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	if _, err := gitprotocolio.PushOptionsChunks([]string{"a\nb"}); err == nil {
+		t.Error("want an error for a push option with a newline")
+	}
+}
+
+func TestConformance_streamEncoders(t *testing.T) {
+	master := pushInitialCommit(t)
+
+	// Re-encoding Git's output chunk by chunk gives the same bytes.
+	for _, gitProtocol := range []string{"", "version=2"} {
+		bs, err := runService("upload-pack", gitProtocol, nil, "--advertise-refs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		e := gitprotocolio.NewInfoRefsResponseEncoder(&out)
+		r := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+		for r.Scan() {
+			if err := e.WriteChunk(r.Chunk()); err != nil {
+				t.Fatalf("%q: %v", gitProtocol, err)
+			}
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), bs) {
+			t.Errorf("%q: want %q, got %q", gitProtocol, bs, out.Bytes())
+		}
+	}
+
+	var req bytes.Buffer
+	re := gitprotocolio.NewProtocolV1UploadPackRequestEncoder(&req)
+	for _, c := range []*gitprotocolio.ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: master, Capabilities: []string{"side-band-64k", "shallow"}},
+		{DeepenDepth: 1},
+		{EndOneRound: true},
+		{NoMoreNegotiation: true},
+	} {
+		if err := re.WriteChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := runService("upload-pack", "", req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Git omits the newline of a shallow line, so compare the chunks.
+	var out bytes.Buffer
+	var chunks []*gitprotocolio.ProtocolV1UploadPackResponseChunk
+	e := gitprotocolio.NewProtocolV1UploadPackResponseEncoder(&out)
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	for r.Scan() {
+		chunks = append(chunks, r.Chunk())
+		if err := e.WriteChunk(r.Chunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	r = gitprotocolio.NewProtocolV1UploadPackResponse(&out)
+	for i := 0; r.Scan(); i++ {
+		if i >= len(chunks) || !reflect.DeepEqual(r.Chunk(), chunks[i]) {
+			t.Errorf("upload-pack response: unexpected chunk %d: %#v", i, r.Chunk())
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	req.Reset()
+	v2e := gitprotocolio.NewProtocolV2RequestEncoder(&req)
+	for _, c := range (&gitprotocolio.FetchRequest{Wants: []string{master}, Deepen: 1, Done: true}).Chunks(nil) {
+		if err := v2e.WriteChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err = runService("upload-pack", "version=2", req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	var fetchChunks []*gitprotocolio.ProtocolV2FetchResponseChunk
+	fe := gitprotocolio.NewProtocolV2FetchResponseEncoder(&out)
+	fr := gitprotocolio.NewProtocolV2FetchResponse(bytes.NewReader(bs))
+	for fr.Scan() {
+		fetchChunks = append(fetchChunks, fr.Chunk())
+		if err := fe.WriteChunk(fr.Chunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	fr = gitprotocolio.NewProtocolV2FetchResponse(&out)
+	for i := 0; fr.Scan(); i++ {
+		if i >= len(fetchChunks) || !reflect.DeepEqual(fr.Chunk(), fetchChunks[i]) {
+			t.Errorf("fetch response: unexpected chunk %d: %#v", i, fr.Chunk())
+		}
+	}
+	if err := fr.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server has all the objects, but expects a pack for a non-delete.
+	cmd := exec.Command(gitBinary, "pack-objects", "--stdout")
+	cmd.Dir = string(remoteGitRepo)
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Reset()
+	rpe := gitprotocolio.NewProtocolV1ReceivePackRequestEncoder(&req)
+	for _, c := range []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+		{OldObjectID: gitprotocolio.ObjectFormatSHA1.ZeroObjectID(), NewObjectID: master, RefName: "refs/heads/copy", Capabilities: []string{"report-status"}},
+		{EndOfCommands: true},
+		{PackStream: pack},
+	} {
+		if err := rpe.WriteChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err = runService("receive-pack", "", req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	rse := gitprotocolio.NewProtocolV1ReceivePackResponseEncoder(&out)
+	rsr := gitprotocolio.NewProtocolV1ReceivePackResponse(bytes.NewReader(bs))
+	for rsr.Scan() {
+		if err := rse.WriteChunk(rsr.Chunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rsr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), bs) {
+		t.Errorf("receive-pack response: want %q, got %q", bs, out.Bytes())
+	}
+
+	// Out-of-order chunks are rejected without being written.
+	out.Reset()
+	e = gitprotocolio.NewProtocolV1UploadPackResponseEncoder(&out)
+	if err := e.WriteChunk(&gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteChunk(&gitprotocolio.ProtocolV1UploadPackResponseChunk{ShallowObjectID: master}); err == nil {
+		t.Error("want an error for a shallow after a NAK")
+	}
+	if out.String() != "0008NAK\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	re = gitprotocolio.NewProtocolV1UploadPackRequestEncoder(io.Discard)
+	if err := re.WriteChunk(&gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: master}); err == nil {
+		t.Error("want an error for a have before the wants")
+	}
+	fe = gitprotocolio.NewProtocolV2FetchResponseEncoder(io.Discard)
+	for i, c := range []*gitprotocolio.ProtocolV2FetchResponseChunk{
+		{SectionHeader: gitprotocolio.FetchSectionShallowInfo},
+		{ShallowObjectID: master},
+		{EndOfSection: true},
+		{SectionHeader: gitprotocolio.FetchSectionAcknowledgments},
+	} {
+		if err := fe.WriteChunk(c); (err != nil) != (i == 3) {
+			t.Errorf("fetch response chunk %d: unexpected error %v", i, err)
+		}
+	}
+	rse = gitprotocolio.NewProtocolV1ReceivePackResponseEncoder(io.Discard)
+	for i, c := range []*gitprotocolio.ProtocolV1ReceivePackResponseChunk{
+		{UnpackStatus: "ok"},
+		{RefUpdateStatus: "ng", RefName: "refs/heads/a", RefUpdateFailMessage: "fail"},
+		{RefUpdateOptionKey: "old-oid", RefUpdateOptionValue: master},
+	} {
+		if err := rse.WriteChunk(c); (err != nil) != (i == 2) {
+			t.Errorf("receive-pack response chunk %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestConformance_iterators(t *testing.T) {
+	pushInitialCommit(t)
+
+	bs, err := runService("upload-pack", "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for c, err := range gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs)).Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Ref != "" {
+			refs = append(refs, c.Ref)
+		}
+	}
+	if len(refs) == 0 {
+		t.Error("no refs")
+	}
+
+	n := 0
+	for p, err := range gitprotocolio.NewPacketScanner(bytes.NewReader(bs)).Packets() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p.(gitprotocolio.FlushPacket); ok {
+			break
+		}
+		n++
+	}
+	if n != len(refs) {
+		t.Errorf("want %d ref packets, got %d", len(refs), n)
+	}
+
+	// A broken response yields the error at the end.
+	broken := append(bytes.TrimSuffix(bs, []byte("0000")), "zzzz"...)
+	var last error
+	for _, err := range gitprotocolio.NewInfoRefsResponse(bytes.NewReader(broken)).Chunks() {
+		last = err
+	}
+	if last == nil {
+		t.Error("want an error for a broken response")
+	}
+}
+
+func TestConformance_scanContext(t *testing.T) {
+	master := pushInitialCommit(t)
+
+	// A client that sends the first want and stalls.
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go pw.Write(encodeChunks(&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: master}))
+
+	r := gitprotocolio.NewProtocolV1UploadPackRequest(pr)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if !r.ScanContext(ctx) || r.Chunk().WantObjectID != master {
+		t.Fatalf("cannot read the want: %v", r.Err())
+	}
+	start := time.Now()
+	if r.ScanContext(ctx) {
+		t.Fatalf("unexpected chunk %#v", r.Chunk())
+	}
+	if !errors.Is(r.Err(), context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded, got %v", r.Err())
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("the scan took %v after the deadline", d)
+	}
+
+	// The cause of the cancellation is the error, so a phase deadline is
+	// distinguishable from a disconnect.
+	pd, ctx := gitprotocolio.NewPhaseDeadlines(context.Background(), gitprotocolio.PhaseTimeouts{Negotiation: 50 * time.Millisecond}, nil)
+	defer pd.Stop()
+	if err := pd.Start(gitprotocolio.PhaseNegotiation); err != nil {
+		t.Fatal(err)
+	}
+	stalled, _ := io.Pipe()
+	s := gitprotocolio.NewPacketScanner(stalled)
+	if s.ScanContext(ctx) {
+		t.Fatal("unexpected packet")
+	}
+	var pde *gitprotocolio.PhaseDeadlineError
+	if !errors.As(s.Err(), &pde) || pde.Phase != gitprotocolio.PhaseNegotiation {
+		t.Errorf("want a PhaseDeadlineError, got %v", s.Err())
+	}
+
+	// Without a deadline, the scan is the same as Scan.
+	bs, err := runService("upload-pack", "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ir := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+	n := 0
+	for ir.ScanContext(context.Background()) {
+		n++
+	}
+	if err := ir.Err(); err != nil || n == 0 {
+		t.Errorf("want chunks without an error, got %d chunks, %v", n, err)
+	}
+}
+
+func TestConformance_parseError(t *testing.T) {
+	master := pushInitialCommit(t)
+
+	want := encodeChunks(&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: master, Capabilities: []string{"ofs-delta"}})
+	bogus := gitprotocolio.BytesPacket("bogus\n").EncodeToPktLine()
+	r := gitprotocolio.NewProtocolV1UploadPackRequest(bytes.NewReader(append(append([]byte{}, want...), bogus...)))
+	for r.Scan() {
+	}
+	var pe *gitprotocolio.ParseError
+	if !errors.As(r.Err(), &pe) {
+		t.Fatalf("want a ParseError, got %#v", r.Err())
+	}
+	if pe.Parser != "ProtocolV1UploadPackRequest" || pe.State != "ScanWants" || pe.Offset != int64(len(want)) || pe.PacketIndex != 1 || !bytes.Equal(pe.Packet, bogus) {
+		t.Errorf("unexpected ParseError %#v", pe)
+	}
+	var se gitprotocolio.SyntaxError
+	if !errors.As(r.Err(), &se) {
+		t.Errorf("want a SyntaxError, got %#v", r.Err())
+	}
+
+	// An early EOF has no packet.
+	r = gitprotocolio.NewProtocolV1UploadPackRequest(bytes.NewReader(want))
+	for r.Scan() {
+	}
+	if !errors.As(r.Err(), &pe) || pe.Packet != nil || pe.PacketIndex != 1 || pe.Err != gitprotocolio.SyntaxError("early EOF") {
+		t.Errorf("unexpected error %#v", r.Err())
+	}
+
+	// A broken length prefix is an error of the PacketScanner, with the
+	// parser state it was read in.
+	ir := gitprotocolio.NewInfoRefsResponse(strings.NewReader("zzzz"))
+	for ir.Scan() {
+	}
+	if !errors.As(ir.Err(), &pe) || pe.Parser != "InfoRefsResponse" || pe.State != "ScanServiceHeader" || string(pe.Packet) != "zzzz" || pe.Offset != 0 {
+		t.Errorf("unexpected error %#v", ir.Err())
+	}
+
+	// An error from the other side is not a ParseError.
+	ir = gitprotocolio.NewInfoRefsResponse(bytes.NewReader(gitprotocolio.ErrorPacket("denied").EncodeToPktLine()))
+	for ir.Scan() {
+	}
+	if errors.As(ir.Err(), &pe) {
+		t.Errorf("want a RemoteError, got %#v", ir.Err())
+	}
+}
+
+func TestConformance_remoteError(t *testing.T) {
+	pushInitialCommit(t)
+
+	missing := strings.Repeat("1", 40)
+	// runService drops the output of a failed command.
+	cmd := exec.Command(gitBinary, "upload-pack", "--stateless-rpc", string(remoteGitRepo))
+	cmd.Stdin = bytes.NewReader(encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: missing, Capabilities: []string{"side-band-64k"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+	))
+	bs, err := cmd.Output()
+	if err == nil {
+		t.Fatal("want upload-pack to fail")
+	}
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	for r.Scan() {
+	}
+	var re *gitprotocolio.RemoteError
+	if !errors.As(r.Err(), &re) || re.Message != "upload-pack: not our ref "+missing {
+		t.Fatalf("want a RemoteError, got %#v", r.Err())
+	}
+	// A proxy can relay it as is.
+	var ep gitprotocolio.ErrorPacket
+	if !errors.As(r.Err(), &ep) || !bytes.Equal(ep.EncodeToPktLine(), bs) {
+		t.Errorf("want the ErrorPacket %q, got %q", bs, ep.EncodeToPktLine())
+	}
+
+	// The sideband error stream is a RemoteError too.
+	var buf bytes.Buffer
+	buf.Write(gitprotocolio.SideBandMainPacket("data").EncodeToPktLine())
+	buf.Write(gitprotocolio.SideBandErrorPacket("pack-objects died\n").EncodeToPktLine())
+	if _, err := io.ReadAll(gitprotocolio.NewSideBandReader(&buf, nil)); !errors.As(err, &re) || re.Message != "pack-objects died" {
+		t.Errorf("want a RemoteError, got %#v", err)
+	}
+}
+
+type flushCounter struct {
+	bytes.Buffer
+	flushes int
+}
+
+func (f *flushCounter) Flush() { f.flushes++ }
+
+func TestConformance_keepalive(t *testing.T) {
+	master := pushInitialCommit(t)
+	bs, err := runService("upload-pack", "", encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: master, Capabilities: []string{"side-band-64k", "no-progress"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nak := []byte("0008NAK\n")
+	if !bytes.HasPrefix(bs, nak) {
+		t.Fatalf("unexpected response %q", bs)
+	}
+	want, err := io.ReadAll(gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs)).PackReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keepalives while the server counts objects, as Git's upload-pack
+	// sends them.
+	withKeepalives := append(append(append([]byte{}, nak...), gitprotocolio.KeepalivePkt+gitprotocolio.KeepalivePkt+"0005\x02"...), bs[len(nak):]...)
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(withKeepalives))
+	keepalives := 0
+	var out bytes.Buffer
+	e := gitprotocolio.NewProtocolV1UploadPackResponseEncoder(&out)
+	for r.Scan() {
+		if r.Chunk().Keepalive {
+			keepalives++
+		}
+		if err := e.WriteChunk(r.Chunk()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if keepalives != 3 {
+		t.Errorf("want 3 keepalives, got %d", keepalives)
+	}
+	got, err := io.ReadAll(gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(withKeepalives)).PackReader(nil))
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("cannot read the pack with keepalives: %v", err)
+	}
+
+	// With sideband-all, a keepalive can come before any section.
+	v2 := encodeChunks(
+		gitprotocolio.BytesPacket(gitprotocolio.KeepalivePkt[4:]),
+		gitprotocolio.BytesPacket("\x01packfile\n"),
+		gitprotocolio.BytesPacket(gitprotocolio.KeepalivePkt[4:]),
+		gitprotocolio.BytesPacket("\x01PACK"),
+		gitprotocolio.FlushPacket{},
+	)
+	fr := gitprotocolio.NewProtocolV2FetchResponse(bytes.NewReader(v2))
+	fr.SetSideBandAll(true)
+	var chunks []*gitprotocolio.ProtocolV2FetchResponseChunk
+	for c, err := range fr.Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, c)
+	}
+	if len(chunks) != 5 || !chunks[0].Keepalive || !chunks[2].Keepalive {
+		t.Errorf("unexpected chunks %v", chunks)
+	}
+
+	// KeepaliveWriter doesn't split a packet, and stops after a raw pack.
+	var fc flushCounter
+	kw := gitprotocolio.NewKeepaliveWriter(&fc, 10*time.Millisecond)
+	kw.Write(nak[:3])
+	time.Sleep(50 * time.Millisecond)
+	kw.Write(nak[3:])
+	time.Sleep(50 * time.Millisecond)
+	kw.Write([]byte("PACK"))
+	time.Sleep(50 * time.Millisecond)
+	kw.Close()
+	s := fc.String()
+	if !strings.HasPrefix(s, string(nak)+gitprotocolio.KeepalivePkt) || !strings.HasSuffix(s, gitprotocolio.KeepalivePkt+"PACK") {
+		t.Errorf("unexpected output %q", s)
+	}
+	n := strings.Count(s, gitprotocolio.KeepalivePkt)
+	if fc.flushes != n {
+		t.Errorf("want %d flushes, got %d", n, fc.flushes)
+	}
+}
+
+func TestConformance_relay(t *testing.T) {
+	master := pushInitialCommit(t)
+	if _, err := remoteGitRepo.run("update-ref", "refs/heads/secret", master); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := runService("upload-pack", "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	var audit []string
+	err = gitprotocolio.Relay(
+		gitprotocolio.NewInfoRefsResponseEncoder(&out),
+		gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs)),
+		func(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+			if c.Ref == "refs/heads/secret" {
+				return nil, nil
+			}
+			return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+		},
+		func(c *gitprotocolio.InfoRefsResponseChunk) ([]*gitprotocolio.InfoRefsResponseChunk, error) {
+			if c.Ref != "" {
+				audit = append(audit, c.Ref)
+			}
+			return []*gitprotocolio.InfoRefsResponseChunk{c}, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range audit {
+		if ref == "refs/heads/secret" {
+			t.Errorf("the filtered ref reached the next interceptor")
+		}
+	}
+	var refs []string
+	for c, err := range gitprotocolio.NewInfoRefsResponse(&out).Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Ref != "" {
+			refs = append(refs, c.Ref)
+		}
+	}
+	if !reflect.DeepEqual(refs, audit) {
+		t.Errorf("want refs %v, got %v", audit, refs)
+	}
+
+	// The encoder rejects the chunks an interceptor inserts out of order.
+	err = gitprotocolio.Relay(
+		gitprotocolio.NewProtocolV1UploadPackResponseEncoder(io.Discard),
+		gitprotocolio.NewProtocolV1UploadPackResponse(strings.NewReader("0008NAK\n0000")),
+		func(c *gitprotocolio.ProtocolV1UploadPackResponseChunk) ([]*gitprotocolio.ProtocolV1UploadPackResponseChunk, error) {
+			if c.Nak {
+				return []*gitprotocolio.ProtocolV1UploadPackResponseChunk{c, {ShallowObjectID: master}}, nil
+			}
+			return []*gitprotocolio.ProtocolV1UploadPackResponseChunk{c}, nil
+		},
+	)
+	if err == nil {
+		t.Error("want an error for a shallow after a NAK")
+	}
+}
+
+func TestConformance_refFilter(t *testing.T) {
+	master := pushInitialCommit(t)
+	if _, err := remoteGitRepo.run("update-ref", "refs/heads/secret", master); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteGitRepo.run("-c", "user.name=tagger", "-c", "user.email=tagger@example.com", "tag", "-a", "-m", "v1", "v1", master); err != nil {
+		t.Fatal(err)
+	}
+	tagOID, err := remoteGitRepo.run("rev-parse", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagOID = strings.TrimSpace(tagOID)
+	rename := map[string]string{
+		"HEAD":              "HEAD",
+		"refs/heads/master": "refs/heads/main",
+		"refs/tags/v1":      "refs/tags/release-v1",
+	}
+	filter := gitprotocolio.RefFilter(func(ref string) (string, bool) {
+		name, ok := rename[ref]
+		return name, ok
+	})
+
+	bs, err := runService("upload-pack", "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayInfoRefs := func(f gitprotocolio.RefFilter) []*gitprotocolio.InfoRefsResponseChunk {
+		var out bytes.Buffer
+		if err := gitprotocolio.Relay(gitprotocolio.NewInfoRefsResponseEncoder(&out), gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs)), f.InfoRefs()); err != nil {
+			t.Fatal(err)
+		}
+		var ret []*gitprotocolio.InfoRefsResponseChunk
+		for c, err := range gitprotocolio.NewInfoRefsResponse(&out).Chunks() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			ret = append(ret, c)
+		}
+		return ret
+	}
+	chunks := relayInfoRefs(filter)
+	var refs []string
+	for _, c := range chunks {
+		if c.Ref != "" {
+			refs = append(refs, c.ObjectID+" "+c.Ref)
+		}
+	}
+	wantRefs := []string{
+		master + " HEAD",
+		master + " refs/heads/main",
+		tagOID + " refs/tags/release-v1",
+		master + " refs/tags/release-v1^{}",
+	}
+	if !reflect.DeepEqual(refs, wantRefs) {
+		t.Errorf("want refs %q, got %q", wantRefs, refs)
+	}
+	if got := gitprotocolio.SymrefsFromCapabilities(chunks[0].Capabilities)["HEAD"]; got != "refs/heads/main" {
+		t.Errorf("want the renamed symref target, got %q", got)
+	}
+
+	// Hiding HEAD moves the capabilities to the next ref and drops the
+	// symref.
+	delete(rename, "HEAD")
+	chunks = relayInfoRefs(filter)
+	if chunks[0].Ref != "refs/heads/main" || chunks[0].Capabilities == nil {
+		t.Errorf("want the capabilities on refs/heads/main, got %+v", chunks[0])
+	}
+	if symrefs := gitprotocolio.SymrefsFromCapabilities(chunks[0].Capabilities); len(symrefs) != 0 {
+		t.Errorf("want no symref, got %v", symrefs)
+	}
+
+	// Hiding every ref leaves the capabilities alone.
+	chunks = relayInfoRefs(func(string) (string, bool) { return "", false })
+	if len(chunks) != 2 || chunks[0].Ref != "capabilities^{}" || chunks[0].Capabilities == nil || !chunks[1].EndOfRequest {
+		t.Errorf("want only the capabilities, got %+v", chunks)
+	}
+
+	rename["HEAD"] = "HEAD"
+	req := &gitprotocolio.LsRefsRequest{Peel: true, Symrefs: true}
+	var body bytes.Buffer
+	for _, c := range req.Chunks(nil) {
+		body.Write(c.EncodeToPktLine())
+	}
+	bs, err = runService("upload-pack", "version=2", body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := gitprotocolio.Relay(gitprotocolio.NewRelaySink[*gitprotocolio.LsRefsResponseChunk](&out), gitprotocolio.NewLsRefsResponse(bytes.NewReader(bs)), filter.LsRefs()); err != nil {
+		t.Fatal(err)
+	}
+	var got []gitprotocolio.LsRefsResponseChunk
+	for c, err := range gitprotocolio.NewLsRefsResponse(&out).Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, *c)
+	}
+	want := []gitprotocolio.LsRefsResponseChunk{
+		{ObjectID: master, Ref: "HEAD", SymrefTarget: "refs/heads/main"},
+		{ObjectID: master, Ref: "refs/heads/main"},
+		{ObjectID: tagOID, Ref: "refs/tags/release-v1", Peeled: master},
+		{EndResponse: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestConformance_trace(t *testing.T) {
+	master := pushInitialCommit(t)
+
+	bs, err := runService("upload-pack", "", nil, "--advertise-refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var traced []byte
+	var refs []string
+	r := gitprotocolio.NewInfoRefsResponse(bytes.NewReader(bs))
+	r.SetTrace(func(d gitprotocolio.Direction, raw []byte, chunk gitprotocolio.Packet) {
+		if d != gitprotocolio.ServerToClient {
+			t.Errorf("want %v, got %v", gitprotocolio.ServerToClient, d)
+		}
+		if c := chunk.(*gitprotocolio.InfoRefsResponseChunk); c.Ref != "" {
+			refs = append(refs, c.Ref)
+		}
+		traced = append(traced, raw...)
+	})
+	var out bytes.Buffer
+	var encoded []byte
+	e := gitprotocolio.NewInfoRefsResponseEncoder(&out)
+	e.SetTrace(func(d gitprotocolio.Direction, raw []byte, chunk gitprotocolio.Packet) {
+		if !bytes.Equal(raw, chunk.EncodeToPktLine()) {
+			t.Errorf("want the encoded chunk %q, got %q", chunk.EncodeToPktLine(), raw)
+		}
+		encoded = append(encoded, raw...)
+	})
+	if err := gitprotocolio.Relay(e, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(traced, bs) {
+		t.Errorf("want the traced bytes %q, got %q", bs, traced)
+	}
+	if !bytes.Equal(encoded, out.Bytes()) {
+		t.Errorf("want the traced bytes %q, got %q", out.Bytes(), encoded)
+	}
+	if want := []string{"HEAD", "refs/heads/master"}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("want refs %v, got %v", want, refs)
+	}
+
+	req := encodeChunks(
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: master, Capabilities: []string{"side-band-64k"}},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true},
+		&gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true},
+	)
+	var dirs []gitprotocolio.Direction
+	traced = nil
+	rr := gitprotocolio.NewProtocolV1UploadPackRequest(bytes.NewReader(req))
+	rr.SetTrace(func(d gitprotocolio.Direction, raw []byte, chunk gitprotocolio.Packet) {
+		dirs = append(dirs, d)
+		traced = append(traced, raw...)
+	})
+	for _, err := range rr.Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dirs) != 3 || dirs[0] != gitprotocolio.ClientToServer {
+		t.Errorf("want 3 client-to-server chunks, got %v", dirs)
+	}
+	if !bytes.Equal(traced, req) {
+		t.Errorf("want the traced bytes %q, got %q", req, traced)
+	}
+}
+
+func TestConformance_captureReplay(t *testing.T) {
+	want := pushInitialCommit(t)
+
+	var file bytes.Buffer
+	cw, err := capture.NewWriter(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req bytes.Buffer
+	e := gitprotocolio.NewProtocolV1UploadPackRequestEncoder(&req)
+	e.SetTrace(cw.Trace)
+	for _, c := range []*gitprotocolio.ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: want, Capabilities: []string{"side-band-64k", "ofs-delta"}},
+		{EndOneRound: true},
+		{NoMoreNegotiation: true},
+	} {
+		if err := e.WriteChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := runService("upload-pack", "", req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gitprotocolio.NewProtocolV1UploadPackResponse(bytes.NewReader(bs))
+	r.SetTrace(cw.Trace)
+	var chunks int
+	for _, err := range r.Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks++
+	}
+	// An empty record has nothing to replay.
+	if err := cw.WriteRecord(&capture.Record{Direction: gitprotocolio.ServerToClient}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every chunk is a record.
+	cr, err := capture.NewReader(bytes.NewReader(file.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records int
+	for cr.Scan() {
+		if len(cr.Record().Data) != 0 {
+			records++
+		}
+	}
+	if err := cr.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if records != 3+chunks {
+		t.Errorf("want %d records, got %d", 3+chunks, records)
+	}
+
+	replay := func(d gitprotocolio.Direction) io.Reader {
+		cr, err := capture.NewReader(bytes.NewReader(file.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return capture.Replay(cr, d)
+	}
+	var replayed []byte
+	rr := gitprotocolio.NewProtocolV1UploadPackRequest(replay(gitprotocolio.ClientToServer))
+	for c, err := range rr.Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayed = append(replayed, c.EncodeToPktLine()...)
+	}
+	if !bytes.Equal(replayed, req.Bytes()) {
+		t.Errorf("want the replayed request %q, got %q", req.Bytes(), replayed)
+	}
+	got, err := io.ReadAll(replay(gitprotocolio.ServerToClient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bs) {
+		t.Error("the replayed response differs from the captured one")
+	}
+	resp := gitprotocolio.NewProtocolV1UploadPackResponse(replay(gitprotocolio.ServerToClient))
+	var replayedChunks int
+	for _, err := range resp.Chunks() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		replayedChunks++
+	}
+	if replayedChunks != chunks {
+		t.Errorf("want %d chunks, got %d", chunks, replayedChunks)
+	}
+}
+
+func TestConformance_gittestServer(t *testing.T) {
+	treeID := fmt.Sprintf("%x", sha1.Sum([]byte("tree 0\x00")))
+	commit := fmt.Sprintf("tree %s\nauthor A <a@example.com> 1500000000 +0000\ncommitter A <a@example.com> 1500000000 +0000\n\ninit\n", treeID)
+	commitID := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("commit %d\x00%s", len(commit), commit))))
+	var pack bytes.Buffer
+	w := packfile.NewWriter(&pack, 2, nil)
+	if err := w.WriteObject(&packfile.ObjectHeader{Type: packfile.ObjectTree}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteObject(&packfile.ObjectHeader{Type: packfile.ObjectCommit}, []byte(commit)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := gittest.NewServer()
+	s.SetRef("refs/heads/master", commitID)
+	s.SetPack(commitID, pack.Bytes())
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for name, args := range protocolParams() {
+		r := createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(args, "clone", ts.URL+"/repo.git", "cloned")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if got, err := gitRepo(string(r)+"/cloned").run("rev-parse", "HEAD"); err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if strings.TrimSpace(got) != commitID {
+			t.Errorf("%s: want %s, got %s", name, commitID, got)
+		}
+	}
+
+	r := createLocalGitRepo()
+	defer r.close()
+	if _, err := r.run("clone", ts.URL+"/repo.git", "cloned"); err != nil {
+		t.Fatal(err)
+	}
+	cloned := gitRepo(string(r) + "/cloned")
+	if _, err := cloned.run("-c", "user.name=pusher", "-c", "user.email=pusher@example.com", "commit", "--allow-empty", "--message=topic"); err != nil {
+		t.Fatal(err)
+	}
+	topic, err := cloned.run("rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic = strings.TrimSpace(topic)
+	if _, err := cloned.run("push", "--push-option=reviewer=a", "origin", "HEAD:refs/heads/topic"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Refs()["refs/heads/topic"]; got != topic {
+		t.Errorf("want refs/heads/topic %s, got %s", topic, got)
+	}
+	if pushes := s.Pushes(); len(pushes) != 1 || len(pushes[0].Updates) != 1 || !pushes[0].Updates[0].Status.Ok || len(pushes[0].Pack) == 0 || !reflect.DeepEqual(pushes[0].Options, []string{"reviewer=a"}) {
+		t.Errorf("unexpected pushes %+v", pushes)
+	}
+	// An atomic push with a stale old object ID is rejected as a whole.
+	zero := gitprotocolio.HashAlgoSHA1.ZeroObjectID()
+	res, err := client.Push(context.Background(), s, &client.PushOptions{
+		Updates: []*gitprotocolio.RefUpdate{
+			{RefName: "refs/heads/topic", OldObjectID: commitID, NewObjectID: zero},
+			{RefName: "refs/heads/other", OldObjectID: zero, NewObjectID: commitID},
+		},
+		Atomic: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range res.Updates {
+		if u.Status == nil || u.Status.Ok {
+			t.Errorf("want %s rejected, got %+v", u.RefName, u.Status)
+		}
+	}
+	if refs := s.Refs(); refs["refs/heads/topic"] != topic || refs["refs/heads/other"] != "" {
+		t.Errorf("want the refs unchanged, got %v", refs)
+	}
+
+	// The server is a client.Transport without HTTP.
+	for _, disableV2 := range []bool{false, true} {
+		res, err := client.Fetch(context.Background(), s, &client.FetchOptions{Refs: []string{"refs/heads/master"}, DisableProtocolV2: disableV2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(res.Pack)
+		res.Pack.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, pack.Bytes()) {
+			t.Errorf("protocol v%d: the fetched pack differs from the canned one", res.ProtocolVersion)
+		}
+	}
+	s.SetRef("refs/heads/nopack", strings.Repeat("1", 40))
+	if _, err := client.Fetch(context.Background(), s, &client.FetchOptions{Refs: []string{"refs/heads/nopack"}}); err == nil {
+		t.Error("want an error for a ref without a pack")
+	}
+}
+
+// TestConformance_gittestServerLargePack clones a pack that doesn't fit in one
+// sideband packet, so that git checks the packet size of every protocol.
+func TestConformance_gittestServerLargePack(t *testing.T) {
+	blob := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(blob)
+	blobID := sha1.Sum(append([]byte(fmt.Sprintf("blob %d\x00", len(blob))), blob...))
+	tree := append([]byte("100644 large\x00"), blobID[:]...)
+	treeID := fmt.Sprintf("%x", sha1.Sum(append([]byte(fmt.Sprintf("tree %d\x00", len(tree))), tree...)))
+	commit := fmt.Sprintf("tree %s\nauthor A <a@example.com> 1500000000 +0000\ncommitter A <a@example.com> 1500000000 +0000\n\nlarge\n", treeID)
+	commitID := fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("commit %d\x00%s", len(commit), commit))))
+	var pack bytes.Buffer
+	w := packfile.NewWriter(&pack, 3, nil)
+	for _, o := range []struct {
+		typ  packfile.ObjectType
+		data []byte
+	}{
+		{packfile.ObjectBlob, blob},
+		{packfile.ObjectTree, tree},
+		{packfile.ObjectCommit, []byte(commit)},
+	} {
+		if err := w.WriteObject(&packfile.ObjectHeader{Type: o.typ}, o.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pack.Len() <= 64*1024 {
+		t.Fatalf("want a pack larger than 64 KiB, got %d bytes", pack.Len())
+	}
+
+	s := gittest.NewServer()
+	s.SetRef("refs/heads/master", commitID)
+	s.SetPack(commitID, pack.Bytes())
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for name, args := range protocolParams() {
+		r := createLocalGitRepo()
+		defer r.close()
+		if _, err := r.run(append(args, "clone", ts.URL+"/repo.git", "cloned")...); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got, err := os.ReadFile(string(r) + "/cloned/large")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if !bytes.Equal(got, blob) {
+			t.Errorf("%s: the cloned file differs from the canned blob", name)
+		}
+	}
+}
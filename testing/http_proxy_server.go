@@ -72,19 +72,13 @@ func (s *httpProxyServer) infoRefsHandler(w http.ResponseWriter, r *http.Request
 
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", r.URL.Query().Get("service")))
 	infoRefsResp := gitprotocolio.NewInfoRefsResponse(resp.Body)
-	for infoRefsResp.Scan() {
-		if err := writePacket(w, infoRefsResp.Chunk()); err != nil {
-			writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
-			return
-		}
-	}
-
-	if err := infoRefsResp.Err(); err != nil {
-		if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+	if err := gitprotocolio.Relay(gitprotocolio.NewInfoRefsResponseEncoder(w), infoRefsResp); err != nil {
+		var ep gitprotocolio.ErrorPacket
+		if errors.As(err, &ep) {
 			writePacket(w, ep)
 		} else {
 			writePacket(w, gitprotocolio.ErrorPacket("internal error"))
-			log.Printf("Parsing error: %#v, parser: %#v", err, infoRefsResp)
+			log.Printf("Relay error: %#v, parser: %#v", err, infoRefsResp)
 		}
 		return
 	}
@@ -118,19 +112,13 @@ func uploadPackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Requ
 		defer pw.Close()
 		v1Req := gitprotocolio.NewProtocolV1UploadPackRequest(r.Body)
 
-		for v1Req.Scan() {
-			if err := writePacket(pw, v1Req.Chunk()); err != nil {
-				writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
-				return
-			}
-		}
-
-		if err := v1Req.Err(); err != nil {
-			if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+		if err := gitprotocolio.Relay(gitprotocolio.NewProtocolV1UploadPackRequestEncoder(pw), v1Req); err != nil {
+			var ep gitprotocolio.ErrorPacket
+			if errors.As(err, &ep) {
 				writePacket(pw, ep)
 			} else {
 				writePacket(pw, gitprotocolio.ErrorPacket("internal error"))
-				log.Printf("Parsing error: %#v, parser: %#v", err, v1Req)
+				log.Printf("Relay error: %#v, parser: %#v", err, v1Req)
 			}
 			return
 		}
@@ -156,19 +144,14 @@ func uploadPackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Requ
 
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
 	v1Resp := gitprotocolio.NewProtocolV1UploadPackResponse(resp.Body)
-	for v1Resp.Scan() {
-		if err := writePacket(w, v1Resp.Chunk()); err != nil {
-			writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
-			return
-		}
-	}
-
-	if err := v1Resp.Err(); err != nil {
-		if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+	v1Resp.SetStatelessRPC(true)
+	if err := gitprotocolio.Relay(gitprotocolio.NewProtocolV1UploadPackResponseEncoder(w), v1Resp); err != nil {
+		var ep gitprotocolio.ErrorPacket
+		if errors.As(err, &ep) {
 			writePacket(w, ep)
 		} else {
 			writePacket(w, gitprotocolio.ErrorPacket("internal error"))
-			log.Printf("Parsing error: %#v, parser: %#v", err, v1Resp)
+			log.Printf("Relay error: %#v, parser: %#v", err, v1Resp)
 		}
 		return
 	}
@@ -202,19 +185,13 @@ func receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Req
 		defer pw.Close()
 		v1Req := gitprotocolio.NewProtocolV1ReceivePackRequest(r.Body)
 
-		for v1Req.Scan() {
-			if err := writePacket(pw, v1Req.Chunk()); err != nil {
-				writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
-				return
-			}
-		}
-
-		if err := v1Req.Err(); err != nil {
-			if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+		if err := gitprotocolio.Relay(gitprotocolio.NewProtocolV1ReceivePackRequestEncoder(pw), v1Req); err != nil {
+			var ep gitprotocolio.ErrorPacket
+			if errors.As(err, &ep) {
 				writePacket(pw, ep)
 			} else {
 				writePacket(pw, gitprotocolio.ErrorPacket("internal error"))
-				log.Printf("Parsing error: %#v, parser: %#v", err, v1Req)
+				log.Printf("Relay error: %#v, parser: %#v", err, v1Req)
 			}
 			return
 		}
@@ -266,17 +243,11 @@ func receivePackV1Handler(delegateURL string, w http.ResponseWriter, r *http.Req
 			pktWt.closeWithError(err)
 		}
 	}()
-	ch, chunkWt := gitprotocolio.NewChunkedWriter(0xFFFF - 5)
+	ch, chunkWt := gitprotocolio.NewChunkedWriter(gitprotocolio.MaxSideBandPayloadSize)
 	go func() {
 		defer chunkWt.Close()
 		v1Resp := gitprotocolio.NewProtocolV1ReceivePackResponse(mainRd)
-		for v1Resp.Scan() {
-			if err := writePacket(chunkWt, v1Resp.Chunk()); err != nil {
-				pktWt.closeWithError(err)
-				return
-			}
-		}
-		if err := v1Resp.Err(); err != nil {
+		if err := gitprotocolio.Relay(gitprotocolio.NewProtocolV1ReceivePackResponseEncoder(chunkWt), v1Resp); err != nil {
 			log.Println(err)
 			pktWt.closeWithError(err)
 		}
@@ -296,19 +267,13 @@ func serveProtocolV2(delegateURL string, w http.ResponseWriter, r *http.Request)
 		defer pw.Close()
 		v2Req := gitprotocolio.NewProtocolV2Request(r.Body)
 
-		for v2Req.Scan() {
-			if err := writePacket(pw, v2Req.Chunk()); err != nil {
-				writePacket(pw, gitprotocolio.ErrorPacket("cannot write a packet"))
-				return
-			}
-		}
-
-		if err := v2Req.Err(); err != nil {
-			if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+		if err := gitprotocolio.Relay(gitprotocolio.NewProtocolV2RequestEncoder(pw), v2Req); err != nil {
+			var ep gitprotocolio.ErrorPacket
+			if errors.As(err, &ep) {
 				writePacket(pw, ep)
 			} else {
 				writePacket(pw, gitprotocolio.ErrorPacket("internal error"))
-				log.Printf("Parsing error: %#v, parser: %#v", err, v2Req)
+				log.Printf("Relay error: %#v, parser: %#v", err, v2Req)
 			}
 			return
 		}
@@ -335,19 +300,13 @@ func serveProtocolV2(delegateURL string, w http.ResponseWriter, r *http.Request)
 
 	w.Header().Add("Content-Type", "application/x-git-upload-pack-result")
 	v2Resp := gitprotocolio.NewProtocolV2Response(resp.Body)
-	for v2Resp.Scan() {
-		if err := writePacket(w, v2Resp.Chunk()); err != nil {
-			writePacket(w, gitprotocolio.ErrorPacket("cannot write a packet"))
-			return
-		}
-	}
-
-	if err := v2Resp.Err(); err != nil {
-		if ep, ok := err.(gitprotocolio.ErrorPacket); ok {
+	if err := gitprotocolio.Relay(gitprotocolio.NewRelaySink[*gitprotocolio.ProtocolV2ResponseChunk](w), v2Resp); err != nil {
+		var ep gitprotocolio.ErrorPacket
+		if errors.As(err, &ep) {
 			writePacket(w, ep)
 		} else {
 			writePacket(w, gitprotocolio.ErrorPacket("internal error"))
-			log.Printf("Parsing error: %#v, parser: %#v", err, v2Resp)
+			log.Printf("Relay error: %#v, parser: %#v", err, v2Resp)
 		}
 	}
 }
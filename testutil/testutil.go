@@ -0,0 +1,394 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides helpers for property-testing code that handles
+// the Git protocol: round-trip checks of the encoders and the parsers, and
+// generators of random but valid chunk streams.
+//
+// For a fuzz test of a middleware, seed the corpus with AddSeeds and check the
+// output of the middleware with CheckRoundTrip:
+//
+//	func FuzzFilter(f *testing.F) {
+//		testutil.AddSeeds(f, 1, 100, testutil.RandomInfoRefsResponse)
+//		f.Fuzz(func(t *testing.T, input []byte) {
+//			out := filter(input)
+//			if err := testutil.CheckRoundTrip(out, gitprotocolio.NewInfoRefsResponse); err != nil {
+//				t.Error(err)
+//			}
+//		})
+//	}
+package testutil
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+// ChunkScanner is the interface implemented by the protocol parsers that
+// produce chunks of type C.
+type ChunkScanner[C gitprotocolio.Packet] interface {
+	Scan() bool
+	Err() error
+	Chunk() C
+}
+
+// Encode concatenates the encoded chunks.
+func Encode[C gitprotocolio.Packet](chunks []C) []byte {
+	var buf bytes.Buffer
+	for _, c := range chunks {
+		buf.Write(c.EncodeToPktLine())
+	}
+	return buf.Bytes()
+}
+
+// RoundTrip parses the input with the parser created by newScanner and
+// returns the re-encoded chunks.
+func RoundTrip[C gitprotocolio.Packet, S ChunkScanner[C]](input []byte, newScanner func(io.Reader) S) ([]byte, error) {
+	var buf bytes.Buffer
+	sc := newScanner(bytes.NewReader(input))
+	for sc.Scan() {
+		// Encode right away. Some parsers reuse the buffer of a chunk.
+		buf.Write(sc.Chunk().EncodeToPktLine())
+	}
+	if err := sc.Err(); err != nil {
+		return buf.Bytes(), err
+	}
+	return buf.Bytes(), nil
+}
+
+// CheckStable checks that the chunks survive encode → parse → encode without
+// a change.
+func CheckStable[C gitprotocolio.Packet, S ChunkScanner[C]](chunks []C, newScanner func(io.Reader) S) error {
+	want := Encode(chunks)
+	got, err := RoundTrip(want, newScanner)
+	if err != nil {
+		return fmt.Errorf("cannot parse %q: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("round trip mismatch:\n got: %q\nwant: %q", got, want)
+	}
+	return nil
+}
+
+// AssertStable is CheckStable that reports the error to t.
+func AssertStable[C gitprotocolio.Packet, S ChunkScanner[C]](t testing.TB, chunks []C, newScanner func(io.Reader) S) {
+	t.Helper()
+	if err := CheckStable(chunks, newScanner); err != nil {
+		t.Error(err)
+	}
+}
+
+// CheckRoundTrip checks that arbitrary input, such as the input of a fuzz
+// test, survives parse → encode → parse → encode without a change after the
+// first encoding. The input itself may be non-canonical, such as a length
+// prefix in uppercase hexadecimal digits. If the parser rejects the input,
+// there's nothing to check and it returns nil.
+func CheckRoundTrip[C gitprotocolio.Packet, S ChunkScanner[C]](input []byte, newScanner func(io.Reader) S) error {
+	once, err := RoundTrip(input, newScanner)
+	if err != nil {
+		return nil
+	}
+	twice, err := RoundTrip(once, newScanner)
+	if err != nil {
+		return fmt.Errorf("cannot parse the re-encoded %q: %v", once, err)
+	}
+	if !bytes.Equal(twice, once) {
+		return fmt.Errorf("round trip mismatch:\n got: %q\nwant: %q", twice, once)
+	}
+	return nil
+}
+
+// AddSeeds adds n encoded chunk streams generated by gen, such as
+// RandomProtocolV2Request, to the seed corpus of f. The streams are the same
+// for the same seed.
+func AddSeeds[C gitprotocolio.Packet](f *testing.F, seed int64, n int, gen func(*rand.Rand) []C) {
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < n; i++ {
+		f.Add(Encode(gen(r)))
+	}
+}
+
+// RoundTripPackets parses the input with a PacketScanner and returns the
+// re-encoded packets.
+func RoundTripPackets(input []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	sc := gitprotocolio.NewPacketScanner(bytes.NewReader(input))
+	for sc.Scan() {
+		buf.Write(sc.Packet().EncodeToPktLine())
+	}
+	return buf.Bytes(), sc.Err()
+}
+
+// CheckPacketsStable checks that the packets survive encode → parse → encode
+// without a change.
+func CheckPacketsStable(packets []gitprotocolio.Packet) error {
+	want := Encode(packets)
+	got, err := RoundTripPackets(want)
+	if err != nil {
+		return fmt.Errorf("cannot parse %q: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("round trip mismatch:\n got: %q\nwant: %q", got, want)
+	}
+	return nil
+}
+
+var capabilities = []string{
+	"multi_ack",
+	"multi_ack_detailed",
+	"no-done",
+	"thin-pack",
+	"side-band",
+	"side-band-64k",
+	"ofs-delta",
+	"shallow",
+	"no-progress",
+	"include-tag",
+	"allow-tip-sha1-in-want",
+	"filter",
+	"agent=git/2.40.0",
+	"object-format=sha1",
+}
+
+func randomCapabilities(r *rand.Rand, min int) []string {
+	var ret []string
+	for _, i := range r.Perm(len(capabilities))[:min+r.Intn(len(capabilities)+1-min)] {
+		ret = append(ret, capabilities[i])
+	}
+	return ret
+}
+
+// RandomObjectID returns a random SHA-1 object ID.
+func RandomObjectID(r *rand.Rand) string {
+	bs := make([]byte, 20)
+	r.Read(bs)
+	return fmt.Sprintf("%x", bs)
+}
+
+// RandomRefName returns a random ref name.
+func RandomRefName(r *rand.Rand) string {
+	prefixes := []string{"refs/heads/", "refs/tags/", "refs/changes/"}
+	return fmt.Sprintf("%s%s%d", prefixes[r.Intn(len(prefixes))], []string{"main", "topic", "v"}[r.Intn(3)], r.Intn(1000))
+}
+
+// RandomPackets returns up to n random packets. It doesn't return pack file
+// packets.
+func RandomPackets(r *rand.Rand, n int) []gitprotocolio.Packet {
+	var ret []gitprotocolio.Packet
+	for i := 0; i < n; i++ {
+		switch r.Intn(4) {
+		case 0:
+			ret = append(ret, gitprotocolio.FlushPacket{})
+		case 1:
+			ret = append(ret, gitprotocolio.DelimPacket{})
+		default:
+			bs := make([]byte, 1+r.Intn(100))
+			r.Read(bs)
+			if bytes.HasPrefix(bs, []byte("PACK")) || bytes.HasPrefix(bs, []byte("ERR ")) {
+				bs[0] = 'x'
+			}
+			ret = append(ret, gitprotocolio.BytesPacket(bs))
+		}
+	}
+	return ret
+}
+
+// RandomInfoRefsResponse returns a random protocol v0 smart HTTP ref
+// advertisement.
+func RandomInfoRefsResponse(r *rand.Rand) []*gitprotocolio.InfoRefsResponseChunk {
+	ret := []*gitprotocolio.InfoRefsResponseChunk{
+		{ServiceHeader: "git-upload-pack"},
+		{ServiceHeaderFlush: true},
+		{Capabilities: randomCapabilities(r, 1), ObjectID: RandomObjectID(r), Ref: "HEAD"},
+	}
+	for i := r.Intn(10); i > 0; i-- {
+		ret = append(ret, &gitprotocolio.InfoRefsResponseChunk{ObjectID: RandomObjectID(r), Ref: RandomRefName(r)})
+	}
+	return append(ret, &gitprotocolio.InfoRefsResponseChunk{EndOfRequest: true})
+}
+
+// RandomProtocolV1UploadPackRequest returns a random protocol v1
+// git-upload-pack request.
+func RandomProtocolV1UploadPackRequest(r *rand.Rand) []*gitprotocolio.ProtocolV1UploadPackRequestChunk {
+	ret := []*gitprotocolio.ProtocolV1UploadPackRequestChunk{
+		{WantObjectID: RandomObjectID(r), Capabilities: randomCapabilities(r, 0)},
+	}
+	for i := r.Intn(5); i > 0; i-- {
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{WantObjectID: RandomObjectID(r)})
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{ShallowObjectID: RandomObjectID(r)})
+	}
+	switch r.Intn(4) {
+	case 1:
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenDepth: 1 + r.Intn(100)})
+	case 2:
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenSince: uint64(1 + r.Int63n(1<<32))})
+	case 3:
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{DeepenNotRef: RandomRefName(r)})
+	}
+	if r.Intn(2) == 0 {
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{FilterSpec: "blob:none"})
+	}
+	ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+	for rounds := r.Intn(3); rounds > 0; rounds-- {
+		for i := 1 + r.Intn(5); i > 0; i-- {
+			ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{HaveObjectID: RandomObjectID(r)})
+		}
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+	}
+	return append(ret, &gitprotocolio.ProtocolV1UploadPackRequestChunk{NoMoreNegotiation: true})
+}
+
+// RandomProtocolV2Request returns a random protocol v2 request with one or
+// more commands.
+func RandomProtocolV2Request(r *rand.Rand) []*gitprotocolio.ProtocolV2RequestChunk {
+	var ret []*gitprotocolio.ProtocolV2RequestChunk
+	for cmds := 1 + r.Intn(3); cmds > 0; cmds-- {
+		if r.Intn(2) == 0 {
+			ret = append(ret,
+				&gitprotocolio.ProtocolV2RequestChunk{Command: "ls-refs"},
+				&gitprotocolio.ProtocolV2RequestChunk{Capability: "agent=git/2.40.0"},
+				&gitprotocolio.ProtocolV2RequestChunk{EndCapability: true},
+				&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("peel\n")},
+				&gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("ref-prefix refs/heads/\n")},
+				&gitprotocolio.ProtocolV2RequestChunk{EndArgument: true},
+			)
+			continue
+		}
+		ret = append(ret,
+			&gitprotocolio.ProtocolV2RequestChunk{Command: "fetch"},
+			&gitprotocolio.ProtocolV2RequestChunk{Capability: "object-format=sha1"},
+			&gitprotocolio.ProtocolV2RequestChunk{EndCapability: true},
+		)
+		for i := 1 + r.Intn(5); i > 0; i-- {
+			ret = append(ret, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("want " + RandomObjectID(r) + "\n")})
+		}
+		for i := r.Intn(5); i > 0; i-- {
+			ret = append(ret, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("have " + RandomObjectID(r) + "\n")})
+		}
+		if r.Intn(2) == 0 {
+			ret = append(ret, &gitprotocolio.ProtocolV2RequestChunk{Argument: []byte("done\n")})
+		}
+		ret = append(ret, &gitprotocolio.ProtocolV2RequestChunk{EndArgument: true})
+	}
+	return append(ret, &gitprotocolio.ProtocolV2RequestChunk{EndRequest: true})
+}
+
+// RandomProtocolV2Response returns a random protocol v2 response.
+func RandomProtocolV2Response(r *rand.Rand) []*gitprotocolio.ProtocolV2ResponseChunk {
+	var ret []*gitprotocolio.ProtocolV2ResponseChunk
+	for sections := 1 + r.Intn(3); sections > 0; sections-- {
+		if len(ret) != 0 {
+			ret = append(ret, &gitprotocolio.ProtocolV2ResponseChunk{Delimiter: true})
+		}
+		for i := 1 + r.Intn(5); i > 0; i-- {
+			ret = append(ret, &gitprotocolio.ProtocolV2ResponseChunk{Response: []byte(RandomObjectID(r) + " " + RandomRefName(r) + "\n")})
+		}
+	}
+	return append(ret, &gitprotocolio.ProtocolV2ResponseChunk{EndResponse: true})
+}
+
+// RandomProtocolV1ReceivePackResponse returns a random report-status
+// response.
+func RandomProtocolV1ReceivePackResponse(r *rand.Rand) []*gitprotocolio.ProtocolV1ReceivePackResponseChunk {
+	ret := []*gitprotocolio.ProtocolV1ReceivePackResponseChunk{{UnpackStatus: "ok"}}
+	for i := 1 + r.Intn(5); i > 0; i-- {
+		if r.Intn(3) == 0 {
+			ret = append(ret, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{RefUpdateStatus: "ng", RefName: RandomRefName(r), RefUpdateFailMessage: "non-fast-forward"})
+		} else {
+			ret = append(ret, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{RefUpdateStatus: "ok", RefName: RandomRefName(r)})
+		}
+	}
+	return append(ret, &gitprotocolio.ProtocolV1ReceivePackResponseChunk{EndOfResponse: true})
+}
+
+// RandomProtocolV1ReceivePackRequest returns a random git-receive-pack
+// request with the commands, the push options, and random pack data.
+func RandomProtocolV1ReceivePackRequest(r *rand.Rand) []*gitprotocolio.ProtocolV1ReceivePackRequestChunk {
+	caps := []string{"report-status", "side-band-64k"}
+	pushOptions := r.Intn(2) == 0
+	if pushOptions {
+		caps = append(caps, "push-options")
+	}
+	ret := []*gitprotocolio.ProtocolV1ReceivePackRequestChunk{
+		{Capabilities: caps, OldObjectID: RandomObjectID(r), NewObjectID: RandomObjectID(r), RefName: RandomRefName(r)},
+	}
+	for i := r.Intn(5); i > 0; i-- {
+		ret = append(ret, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{OldObjectID: RandomObjectID(r), NewObjectID: RandomObjectID(r), RefName: RandomRefName(r)})
+	}
+	ret = append(ret, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfCommands: true})
+	if pushOptions {
+		for i := r.Intn(3); i > 0; i-- {
+			ret = append(ret, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{PushOption: fmt.Sprintf("option%d", r.Intn(1000))})
+		}
+		ret = append(ret, &gitprotocolio.ProtocolV1ReceivePackRequestChunk{EndOfPushOptions: true})
+	}
+	pack := make([]byte, 1+r.Intn(100))
+	r.Read(pack)
+	return append(ret,
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{PackStream: []byte("PACK")},
+		&gitprotocolio.ProtocolV1ReceivePackRequestChunk{PackStream: pack},
+	)
+}
+
+// RandomProtocolV1UploadPackResponse returns a random git-upload-pack
+// response with the sideband.
+func RandomProtocolV1UploadPackResponse(r *rand.Rand) []*gitprotocolio.ProtocolV1UploadPackResponseChunk {
+	var ret []*gitprotocolio.ProtocolV1UploadPackResponseChunk
+	if r.Intn(2) == 0 {
+		for i := 1 + r.Intn(3); i > 0; i-- {
+			ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{ShallowObjectID: RandomObjectID(r)})
+		}
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{EndOfShallows: true})
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{AckObjectID: RandomObjectID(r), AckDetail: "common"})
+	}
+	ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{Nak: true})
+	for i := 1 + r.Intn(5); i > 0; i-- {
+		switch r.Intn(4) {
+		case 0:
+			ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{PackStream: []byte("\x02Counting objects\n")})
+		case 1:
+			ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{Keepalive: true})
+		default:
+			bs := make([]byte, 1+r.Intn(100))
+			r.Read(bs)
+			ret = append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{PackStream: append([]byte{1}, bs...)})
+		}
+	}
+	return append(ret, &gitprotocolio.ProtocolV1UploadPackResponseChunk{EndOfRequest: true})
+}
+
+// RandomLsRefsResponse returns a random protocol v2 ls-refs response with the
+// symref-target and peeled attributes.
+func RandomLsRefsResponse(r *rand.Rand) []*gitprotocolio.LsRefsResponseChunk {
+	ret := []*gitprotocolio.LsRefsResponseChunk{
+		{ObjectID: RandomObjectID(r), Ref: "HEAD", SymrefTarget: "refs/heads/main"},
+	}
+	for i := r.Intn(10); i > 0; i-- {
+		c := &gitprotocolio.LsRefsResponseChunk{ObjectID: RandomObjectID(r), Ref: RandomRefName(r)}
+		if r.Intn(3) == 0 {
+			c.Peeled = RandomObjectID(r)
+		}
+		ret = append(ret, c)
+	}
+	return append(ret, &gitprotocolio.LsRefsResponseChunk{EndResponse: true})
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/google/gitprotocolio"
+)
+
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if err := CheckPacketsStable(RandomPackets(r, 20)); err != nil {
+			t.Error(err)
+		}
+		AssertStable(t, RandomInfoRefsResponse(r), gitprotocolio.NewInfoRefsResponse)
+		AssertStable(t, RandomProtocolV1UploadPackRequest(r), gitprotocolio.NewProtocolV1UploadPackRequest)
+		AssertStable(t, RandomProtocolV2Request(r), gitprotocolio.NewProtocolV2Request)
+		AssertStable(t, RandomProtocolV2Response(r), gitprotocolio.NewProtocolV2Response)
+		AssertStable(t, RandomProtocolV1ReceivePackResponse(r), gitprotocolio.NewProtocolV1ReceivePackResponse)
+		AssertStable(t, RandomProtocolV1ReceivePackRequest(r), gitprotocolio.NewProtocolV1ReceivePackRequest)
+		AssertStable(t, RandomProtocolV1UploadPackResponse(r), gitprotocolio.NewProtocolV1UploadPackResponse)
+		AssertStable(t, RandomLsRefsResponse(r), gitprotocolio.NewLsRefsResponse)
+	}
+}
+
+func FuzzLsRefsResponse(f *testing.F) {
+	AddSeeds(f, 1, 20, RandomLsRefsResponse)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		if err := CheckRoundTrip(input, gitprotocolio.NewLsRefsResponse); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -19,7 +19,39 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"iter"
 	"strconv"
+	"strings"
+)
+
+const (
+	// FlushPkt is the encoded flush packet.
+	FlushPkt = "0000"
+	// DelimPkt is the encoded delim packet used in protocol v2.
+	DelimPkt = "0001"
+	// ResponseEndPkt is the encoded response-end packet used in protocol
+	// v2 stateless connections.
+	ResponseEndPkt = "0002"
+
+	// PacketLengthHeaderSize is the size of the hexadecimal length prefix of
+	// a packet.
+	PacketLengthHeaderSize = 4
+	// MaxPacketSize is the maximum size of a packet including the length
+	// prefix. It's LARGE_PACKET_MAX of Git, which rejects longer packets
+	// even though the length prefix can express up to 0xFFFF.
+	MaxPacketSize = 65520
+	// MaxPacketPayloadSize is the maximum size of a packet payload
+	// (LARGE_PACKET_DATA_MAX of Git).
+	MaxPacketPayloadSize = MaxPacketSize - PacketLengthHeaderSize
+	// MaxSideBandPayloadSize is the maximum size of a sideband packet
+	// payload, excluding the band byte.
+	MaxSideBandPayloadSize = MaxPacketPayloadSize - 1
+
+	// ZeroObjectIDSHA1 is the all-zero SHA-1 object ID. It denotes a
+	// missing object, such as the old value of a ref being created.
+	ZeroObjectIDSHA1 = "0000000000000000000000000000000000000000"
+	// ZeroObjectIDSHA256 is the all-zero SHA-256 object ID.
+	ZeroObjectIDSHA256 = "0000000000000000000000000000000000000000000000000000000000000000"
 )
 
 // SyntaxError is an error returned when the parser cannot parse the input.
@@ -37,7 +69,7 @@ type FlushPacket struct{}
 
 // EncodeToPktLine serializes the packet.
 func (FlushPacket) EncodeToPktLine() []byte {
-	return []byte("0000")
+	return []byte(FlushPkt)
 }
 
 // DelimPacket is the delim packet ("0001").
@@ -45,7 +77,16 @@ type DelimPacket struct{}
 
 // EncodeToPktLine serializes the packet.
 func (DelimPacket) EncodeToPktLine() []byte {
-	return []byte("0001")
+	return []byte(DelimPkt)
+}
+
+// ResponseEndPacket is the response-end packet ("0002") of protocol v2
+// stateless connections.
+type ResponseEndPacket struct{}
+
+// EncodeToPktLine serializes the packet.
+func (ResponseEndPacket) EncodeToPktLine() []byte {
+	return []byte(ResponseEndPkt)
 }
 
 // BytesPacket is a packet with a content.
@@ -54,13 +95,20 @@ type BytesPacket []byte
 // EncodeToPktLine serializes the packet.
 func (b BytesPacket) EncodeToPktLine() []byte {
 	sz := len(b)
-	if sz > 0xFFFF-4 {
+	if sz > MaxPacketPayloadSize {
 		panic("content too large")
 	}
-	return append([]byte(fmt.Sprintf("%04x", sz+4)), b...)
+	return append([]byte(fmt.Sprintf("%04x", sz+PacketLengthHeaderSize)), b...)
+}
+
+// Bytes returns the payload.
+func (b BytesPacket) Bytes() []byte {
+	return b
 }
 
-// ErrorPacket is a packet that indicates an error.
+// ErrorPacket is a packet that indicates an error. A server writes it to stop
+// the response with a message for the client. An "ERR" packet read from the
+// other side is a RemoteError.
 type ErrorPacket string
 
 func (e ErrorPacket) Error() string { return "error: " + string(e) }
@@ -69,10 +117,26 @@ func (e ErrorPacket) Error() string { return "error: " + string(e) }
 func (e ErrorPacket) EncodeToPktLine() []byte {
 	bs := []byte("ERR " + e)
 	sz := len(bs)
-	if sz > 0xFFFF {
+	if sz > MaxPacketPayloadSize {
 		panic("content too large")
 	}
-	return append([]byte(fmt.Sprintf("%04X", sz+4)), bs...)
+	return append([]byte(fmt.Sprintf("%04x", sz+PacketLengthHeaderSize)), bs...)
+}
+
+// RemoteError is an error that the other side sent with an "ERR" packet or on
+// the sideband error stream. Unwrap returns it as an ErrorPacket, so that a
+// proxy can relay it with errors.As.
+type RemoteError struct {
+	// Message is the message without the trailing newline.
+	Message string
+}
+
+func (e *RemoteError) Error() string { return "remote error: " + e.Message }
+
+func (e *RemoteError) Unwrap() error { return ErrorPacket(e.Message) }
+
+func newRemoteError(msg []byte) *RemoteError {
+	return &RemoteError{Message: strings.TrimSuffix(string(msg), "\n")}
 }
 
 // PackFileIndicatorPacket is the indicator of the beginning of the pack file
@@ -92,18 +156,107 @@ func (p PackFilePacket) EncodeToPktLine() []byte {
 	return []byte(p)
 }
 
+// Bytes returns the payload.
+func (p PackFilePacket) Bytes() []byte {
+	return p
+}
+
+// CopyPacket returns a copy of the packet that doesn't share the payload with
+// p. Use it to keep a packet returned by PacketScanner after the next Scan.
+// The packets without a []byte payload are returned as is.
+func CopyPacket(p Packet) Packet {
+	switch p := p.(type) {
+	case BytesPacket:
+		return BytesPacket(append([]byte{}, p...))
+	case PackFilePacket:
+		return PackFilePacket(append([]byte{}, p...))
+	case SideBandMainPacket:
+		return SideBandMainPacket(append([]byte{}, p...))
+	case SideBandReportPacket:
+		return SideBandReportPacket(append([]byte{}, p...))
+	case SideBandErrorPacket:
+		return SideBandErrorPacket(append([]byte{}, p...))
+	}
+	return p
+}
+
 // PacketScanner provides an interface for reading packet line data. The usage
 // is same as bufio.Scanner.
+//
+// The scanner doesn't copy the payloads. Like bufio.Scanner.Bytes, the payload
+// of a BytesPacket or a PackFilePacket is a slice of the internal buffer that
+// the next Scan overwrites, so relaying a large pack doesn't allocate per
+// packet. Use CopyPacket to keep a packet.
 type PacketScanner struct {
 	err          error
 	curr         Packet
 	packFileMode bool
 	scanner      *bufio.Scanner
+	reader       *contextReader
+
+	wireSize       int
+	totalWireBytes int64
+	packets        int64
+
+	// raw is the current packet as it appeared on the wire, and rawOffset
+	// and rawIndex are its position, for ParseError. badHeader is the length
+	// prefix the split function rejected.
+	raw       []byte
+	rawOffset int64
+	rawIndex  int64
+	badHeader []byte
+
+	opts    PacketScannerOptions
+	limiter RateLimiter
+	recover func(*ScanDiagnostic)
+	tee     io.Writer
+
+	// traceBuf is the bytes consumed since the previous chunk of the
+	// parser, for trace.
+	trace    TraceFunc
+	traceDir Direction
+	traceBuf []byte
+}
+
+// PacketScannerOptions tunes how strictly a PacketScanner reads the input.
+// The zero value is the behavior of NewPacketScanner.
+type PacketScannerOptions struct {
+	// MaxPacketSize is the maximum size of a packet including the length
+	// prefix. A larger packet is an error, so a server can bound the
+	// memory per packet. If zero, MaxPacketSize is used.
+	MaxPacketSize int
+	// AllowEmptyPackets makes "0004", a packet without a payload, an empty
+	// BytesPacket. Git never sends it, so it's an error by default.
+	AllowEmptyPackets bool
+	// RejectUppercaseHex makes an uppercase hexadecimal digit in a length
+	// prefix an error. Git writes lowercase ones but accepts both.
+	RejectUppercaseHex bool
+}
+
+// ScanDiagnostic describes malformed input skipped by a PacketScanner in the
+// recovery mode.
+type ScanDiagnostic struct {
+	// Offset is the position of the skipped bytes in the input.
+	Offset int64
+	// Skipped is the skipped bytes.
+	Skipped []byte
+	// Reason is why the bytes were skipped.
+	Reason string
 }
 
 // NewPacketScanner returns a new PacketScanner to read from r.
 func NewPacketScanner(r io.Reader) *PacketScanner {
-	s := &PacketScanner{scanner: bufio.NewScanner(r)}
+	return NewPacketScannerWithOptions(r, PacketScannerOptions{})
+}
+
+// NewPacketScannerWithOptions returns a new PacketScanner to read from r with
+// the options.
+func NewPacketScannerWithOptions(r io.Reader, opts PacketScannerOptions) *PacketScanner {
+	if opts.MaxPacketSize <= 0 || opts.MaxPacketSize > MaxPacketSize {
+		opts.MaxPacketSize = MaxPacketSize
+	}
+	cr := &contextReader{r: r}
+	s := &PacketScanner{scanner: bufio.NewScanner(cr), reader: cr, opts: opts}
 	s.scanner.Split(s.packetSplitFunc)
 	return s
 }
@@ -114,56 +267,178 @@ func (s *PacketScanner) Err() error {
 	return s.err
 }
 
-// Packet returns the most recent packet generated by a call to Scan.
+// Packet returns the most recent packet generated by a call to Scan. Its
+// payload is valid until the next Scan.
 func (s *PacketScanner) Packet() Packet {
 	return s.curr
 }
 
+// Bytes returns the payload of the most recent packet, or nil for a packet
+// without a payload such as a flush packet. It's valid until the next Scan.
+func (s *PacketScanner) Bytes() []byte {
+	if p, ok := s.curr.(BytePayloadPacket); ok {
+		return p.Bytes()
+	}
+	return nil
+}
+
+// WireSize returns the number of bytes the most recent packet occupied on the
+// wire, including the length prefix. For pack file data, this is the size of
+// the chunk.
+func (s *PacketScanner) WireSize() int {
+	return s.wireSize
+}
+
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the length prefixes and the packets that resulted in an error
+// such as RemoteError.
+func (s *PacketScanner) TotalWireBytes() int64 {
+	return s.totalWireBytes
+}
+
+// PacketCount returns the number of packets scanned so far. Pack file chunks
+// are not counted.
+func (s *PacketScanner) PacketCount() int64 {
+	return s.packets
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. A nil
+// limiter removes the limit.
+func (s *PacketScanner) SetRateLimiter(l RateLimiter) {
+	s.limiter = l
+}
+
+// SetTee makes the scanner write the bytes it consumes to w, exactly as they
+// appeared in the input, including the bytes skipped in the recovery mode.
+// Unlike io.TeeReader, the bytes read ahead but not yet scanned are not
+// written, so w sees the input up to the current packet. An error writing to w
+// stops the scan. For the output side, use io.MultiWriter.
+func (s *PacketScanner) SetTee(w io.Writer) {
+	s.tee = w
+}
+
+func (s *PacketScanner) writeTee(bs []byte) error {
+	if s.trace != nil {
+		s.traceBuf = append(s.traceBuf, bs...)
+	}
+	if s.tee == nil || len(bs) == 0 {
+		return nil
+	}
+	_, err := s.tee.Write(bs)
+	return err
+}
+
+// SetRecovery enables the recovery mode. After a malformed packet, the scanner
+// skips to the next plausible packet length header instead of failing, and
+// calls f with the skipped bytes. This is for forensic analysis of corrupted
+// captures. The packets after a resynchronization may be wrong, so don't use
+// this to serve requests. A nil f disables the recovery mode.
+func (s *PacketScanner) SetRecovery(f func(*ScanDiagnostic)) {
+	s.recover = f
+}
+
+func (s *PacketScanner) diagnose(skipped []byte, reason string) error {
+	if err := s.writeTee(skipped); err != nil {
+		return err
+	}
+	s.recover(&ScanDiagnostic{
+		Offset:  s.totalWireBytes,
+		Skipped: append([]byte(nil), skipped...),
+		Reason:  reason,
+	})
+	s.totalWireBytes += int64(len(skipped))
+	return nil
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (s *PacketScanner) Scan() bool {
-	if s.err != nil {
-		return false
-	}
-	if !s.scanner.Scan() {
-		s.err = s.scanner.Err()
-		return false
-	}
+	for {
+		if s.err != nil {
+			return false
+		}
+		if !s.scanner.Scan() {
+			s.raw, s.rawOffset, s.rawIndex = s.badHeader, s.totalWireBytes, s.packets
+			s.err = s.parseError(s.scanner.Err(), "", "")
+			return false
+		}
 
-	bs := s.scanner.Bytes()
-	if s.packFileMode {
-		if len(bs) == 0 {
-			// EOF
+		bs := s.scanner.Bytes()
+		s.raw, s.rawOffset, s.rawIndex = bs, s.totalWireBytes, s.packets
+		if err := s.writeTee(bs); err != nil {
+			s.err = err
 			return false
 		}
-		s.curr = PackFilePacket(bs)
-		return true
-	}
-	if bytes.Equal(bs, []byte("0000")) {
-		s.curr = FlushPacket{}
-		return true
-	}
-	if bytes.Equal(bs, []byte("0001")) {
-		s.curr = DelimPacket{}
-		return true
-	}
-	if bytes.Equal(bs, []byte("PACK")) {
-		s.packFileMode = true
-		s.curr = PackFileIndicatorPacket{}
+		s.wireSize = len(bs)
+		s.totalWireBytes += int64(len(bs))
+		if !s.packFileMode {
+			s.packets++
+		}
+		if s.limiter != nil && len(bs) != 0 {
+			if err := s.limiter.WaitPacket(len(bs)); err != nil {
+				s.err = err
+				return false
+			}
+		}
+		if s.packFileMode {
+			if len(bs) == 0 {
+				// EOF
+				return false
+			}
+			s.curr = PackFilePacket(bs)
+			return true
+		}
+		if bytes.Equal(bs, []byte(FlushPkt)) {
+			s.curr = FlushPacket{}
+			return true
+		}
+		if bytes.Equal(bs, []byte(DelimPkt)) {
+			s.curr = DelimPacket{}
+			return true
+		}
+		if bytes.Equal(bs, []byte(ResponseEndPkt)) {
+			s.curr = ResponseEndPacket{}
+			return true
+		}
+		if bytes.Equal(bs, []byte("PACK")) {
+			s.packFileMode = true
+			s.curr = PackFileIndicatorPacket{}
+			return true
+		}
+		if s.opts.AllowEmptyPackets && bytes.Equal(bs, []byte("0004")) {
+			s.curr = BytesPacket([]byte{})
+			return true
+		}
+		if len(bs) == 4 {
+			if s.recover != nil {
+				s.packets--
+				s.recover(&ScanDiagnostic{
+					Offset:  s.totalWireBytes - int64(len(bs)),
+					Skipped: append([]byte(nil), bs...),
+					Reason:  "unknown special packet",
+				})
+				// Skip the packet.
+				continue
+			}
+			s.err = s.parseError(SyntaxError("unknown special packet: "+string(bs)), "", "")
+			return false
+		}
+		if bytes.HasPrefix(bs[4:], []byte("ERR ")) {
+			s.err = newRemoteError(bs[8:])
+			return false
+		}
+		s.curr = BytesPacket(bs[4:])
 		return true
 	}
-	if len(bs) == 4 {
-		s.err = SyntaxError("unknown special packet: " + string(bs))
-		return false
-	}
-	if bytes.Equal(bs[4:8], []byte("ERR ")) {
-		s.err = ErrorPacket(string(bs[8:]))
-		return false
-	}
-	s.curr = BytesPacket(bs[4:])
-	return true
+}
+
+// Packets returns an iterator over the remaining packets. It calls Scan until
+// it returns false, and yields the error of Err at the end if any. A packet's
+// payload is valid until the next iteration.
+func (s *PacketScanner) Packets() iter.Seq2[Packet, error] {
+	return scanSeq(s.Scan, s.Packet, s.Err)
 }
 
 func (s *PacketScanner) packetSplitFunc(data []byte, atEOF bool) (int, []byte, error) {
@@ -178,14 +453,85 @@ func (s *PacketScanner) packetSplitFunc(data []byte, atEOF bool) (int, []byte, e
 	}
 	sz, err := strconv.ParseUint(string(data[:4]), 16, 32)
 	if err != nil {
+		err = SyntaxError(fmt.Sprintf("invalid packet length: %q", data[:4]))
+	} else if s.opts.RejectUppercaseHex && bytes.ContainsAny(data[:4], "ABCDEF") {
+		err = SyntaxError(fmt.Sprintf("uppercase packet length: %q", data[:4]))
+	}
+	if err != nil {
+		if s.recover != nil {
+			return s.resync(data, atEOF, "invalid packet length")
+		}
+		s.badHeader = append([]byte(nil), data[:4]...)
 		return 0, nil, err
 	}
-	if sz == 0 || sz == 1 {
+	if sz < PacketLengthHeaderSize {
 		// Special packet.
 		return 4, data[:4], nil
 	}
+	if int(sz) > s.opts.MaxPacketSize {
+		if s.recover != nil {
+			return s.resync(data, atEOF, "packet too large")
+		}
+		s.badHeader = append([]byte(nil), data[:4]...)
+		return 0, nil, SyntaxError(fmt.Sprintf("packet too large: %d bytes, the limit is %d", sz, s.opts.MaxPacketSize))
+	}
 	if len(data) < int(sz) {
+		if atEOF && s.recover != nil {
+			return s.resync(data, atEOF, "truncated packet")
+		}
 		return 0, nil, nil
 	}
 	return int(sz), data[:int(sz)], nil
 }
+
+// resync skips data up to the next plausible packet length header. A header
+// is plausible if its packet ends within the buffered data, so that random
+// hexadecimal characters in the garbage are less likely to be taken.
+func (s *PacketScanner) resync(data []byte, atEOF bool, reason string) (int, []byte, error) {
+	for i := 1; i+PacketLengthHeaderSize <= len(data); i++ {
+		if plausiblePacketHeader(data[i:]) {
+			if err := s.diagnose(data[:i], reason); err != nil {
+				return 0, nil, err
+			}
+			return i, nil, nil
+		}
+	}
+	if !atEOF && len(data) < MaxPacketSize {
+		// Read more.
+		return 0, nil, nil
+	}
+	if err := s.diagnose(data, reason); err != nil {
+		return 0, nil, err
+	}
+	return len(data), nil, nil
+}
+
+func plausiblePacketHeader(data []byte) bool {
+	hdr := data[:PacketLengthHeaderSize]
+	if bytes.Equal(hdr, []byte("PACK")) {
+		return true
+	}
+	for _, c := range hdr {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	sz, _ := strconv.ParseUint(string(hdr), 16, 32)
+	return sz <= 2 || sz > PacketLengthHeaderSize && int(sz) <= len(data)
+}
+
+// scanSeq adapts the Scan/Err pattern of the scanners to an iterator. The
+// error, if any, is yielded with the zero value after the last element.
+func scanSeq[T any](scan func() bool, get func() T, errFn func() error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for scan() {
+			if !yield(get(), nil) {
+				return
+			}
+		}
+		if err := errFn(); err != nil {
+			var zero T
+			yield(zero, err)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPacketConstants(t *testing.T) {
+	if got := string(FlushPacket{}.EncodeToPktLine()); got != FlushPkt {
+		t.Errorf("flush: got %q, want %q", got, FlushPkt)
+	}
+	if got := string(DelimPacket{}.EncodeToPktLine()); got != DelimPkt {
+		t.Errorf("delim: got %q, want %q", got, DelimPkt)
+	}
+	if got := string(BytesPacket(bytes.Repeat([]byte("a"), MaxPacketPayloadSize)).EncodeToPktLine()[:PacketLengthHeaderSize]); got != "fff0" {
+		t.Errorf("largest packet: got length %q, want %q", got, "fff0")
+	}
+	if got := string(SideBandMainPacket(bytes.Repeat([]byte("a"), MaxSideBandPayloadSize)).EncodeToPktLine()[:PacketLengthHeaderSize]); got != "fff0" {
+		t.Errorf("largest sideband packet: got length %q, want %q", got, "fff0")
+	}
+	if len(ZeroObjectIDSHA1) != 40 || strings.Trim(ZeroObjectIDSHA1, "0") != "" {
+		t.Errorf("bad ZeroObjectIDSHA1 %q", ZeroObjectIDSHA1)
+	}
+	if len(ZeroObjectIDSHA256) != 64 || strings.Trim(ZeroObjectIDSHA256, "0") != "" {
+		t.Errorf("bad ZeroObjectIDSHA256 %q", ZeroObjectIDSHA256)
+	}
+}
+
+func TestPacketTooLarge(t *testing.T) {
+	for name, f := range map[string]func(){
+		"bytes":    func() { BytesPacket(make([]byte, MaxPacketPayloadSize+1)).EncodeToPktLine() },
+		"sideband": func() { SideBandMainPacket(make([]byte, MaxSideBandPayloadSize+1)).EncodeToPktLine() },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: got no panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestPacketScannerMaxPacketSize(t *testing.T) {
+	in := BytesPacket(bytes.Repeat([]byte("a"), MaxPacketPayloadSize)).EncodeToPktLine()
+	s := NewPacketScanner(bytes.NewReader(append(in, FlushPkt...)))
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if got := len(s.Packet().(BytesPacket)); got != MaxPacketPayloadSize {
+		t.Errorf("got %d bytes, want %d", got, MaxPacketPayloadSize)
+	}
+	if !s.Scan() {
+		t.Fatal(s.Err())
+	}
+	if _, ok := s.Packet().(FlushPacket); !ok {
+		t.Errorf("got %#v, want a flush", s.Packet())
+	}
+}
+
+func TestPacketScannerWireBytes(t *testing.T) {
+	s := NewPacketScanner(strings.NewReader(pktLines("abc\n", "0000", "ERR oops\n", "more\n")))
+	var sizes []int
+	for s.Scan() {
+		sizes = append(sizes, s.WireSize())
+	}
+	if _, ok := s.Err().(*RemoteError); !ok {
+		t.Fatalf("got %v, want a RemoteError", s.Err())
+	}
+	if want := []int{8, 4}; len(sizes) != 2 || sizes[0] != want[0] || sizes[1] != want[1] {
+		t.Errorf("got sizes %v, want %v", sizes, want)
+	}
+	if got, want := s.TotalWireBytes(), int64(8+4+13); got != want {
+		t.Errorf("got %d total bytes, want %d", got, want)
+	}
+	if got := s.PacketCount(); got != 3 {
+		t.Errorf("got %d packets, want 3", got)
+	}
+}
+
+func TestParserTotalWireBytes(t *testing.T) {
+	in := pktLines("want 1111111111111111111111111111111111111111 ofs-delta\n", "0000", "done\n")
+	r := NewProtocolV1UploadPackRequest(strings.NewReader(in))
+	for r.Scan() {
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.TotalWireBytes(); got != int64(len(in)) {
+		t.Errorf("got %d, want %d", got, len(in))
+	}
+}
+
+func TestPacketScannerRecovery(t *testing.T) {
+	in := pktLines("abcd") + "zz!!garbage" + pktLines("xyz") + "0003" + pktLines("0000") + "0009ab"
+	var diags []*ScanDiagnostic
+	s := NewPacketScanner(strings.NewReader(in))
+	s.SetRecovery(func(d *ScanDiagnostic) { diags = append(diags, d) })
+	var got []string
+	for s.Scan() {
+		got = append(got, string(s.Packet().EncodeToPktLine()))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{pktLines("abcd"), pktLines("xyz"), FlushPkt}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	want := []*ScanDiagnostic{
+		{Offset: 8, Skipped: []byte("zz!!garbage"), Reason: "invalid packet length"},
+		{Offset: 26, Skipped: []byte("0003"), Reason: "unknown special packet"},
+		{Offset: 34, Skipped: []byte("0009ab"), Reason: "truncated packet"},
+	}
+	if !reflect.DeepEqual(diags, want) {
+		for _, d := range diags {
+			t.Logf("%+v", d)
+		}
+		t.Errorf("got %d diagnostics, want %d", len(diags), len(want))
+	}
+	if s.TotalWireBytes() != int64(len(in)) {
+		t.Errorf("got %d total bytes, want %d", s.TotalWireBytes(), len(in))
+	}
+
+	// Without the recovery mode, the garbage is an error.
+	s = NewPacketScanner(strings.NewReader(in))
+	for s.Scan() {
+	}
+	if s.Err() == nil {
+		t.Error("got no error without the recovery mode")
+	}
+
+	// A long run of skipped packets is skipped in one Scan.
+	in = strings.Repeat("0003", 100000) + pktLines("abcd")
+	n := 0
+	s = NewPacketScanner(strings.NewReader(in))
+	s.SetRecovery(func(*ScanDiagnostic) { n++ })
+	if !s.Scan() || string(s.Packet().EncodeToPktLine()) != pktLines("abcd") || n != 100000 {
+		t.Errorf("got %v after %d diagnostics", s.Packet(), n)
+	}
+}
+
+func TestPacketScannerTee(t *testing.T) {
+	in := pktLines("abcd", "0000", "efg\n")
+	var tee bytes.Buffer
+	s := NewPacketScanner(strings.NewReader(in))
+	s.SetTee(&tee)
+	n := 0
+	for s.Scan() {
+		// The tee has the input up to the end of the current packet, and not
+		// the bytes read ahead.
+		n += len(s.Packet().EncodeToPktLine())
+		if tee.String() != in[:n] {
+			t.Errorf("got %q, want %q", tee.String(), in[:n])
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if tee.String() != in {
+		t.Errorf("got %q, want %q", tee.String(), in)
+	}
+
+	// The skipped bytes are written too in the recovery mode.
+	in = pktLines("abcd") + "zz!!garbage" + pktLines("xyz")
+	tee.Reset()
+	s = NewPacketScanner(strings.NewReader(in))
+	s.SetTee(&tee)
+	s.SetRecovery(func(*ScanDiagnostic) {})
+	for s.Scan() {
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if tee.String() != in {
+		t.Errorf("recovery: got %q, want %q", tee.String(), in)
+	}
+}
+
+func TestPacketScannerTeeError(t *testing.T) {
+	s := NewPacketScanner(strings.NewReader(pktLines("abcd", "0000")))
+	s.SetTee(failingWriter{})
+	if s.Scan() {
+		t.Errorf("got %#v, want no packet", s.Packet())
+	}
+	if err := s.Err(); err == nil || !strings.Contains(err.Error(), "broken pipe") {
+		t.Errorf("got %v, want the tee error", err)
+	}
+}
+
+func TestParserTee(t *testing.T) {
+	in := pktLines("command=ls-refs\n") + DelimPkt + pktLines("peel\n", "0000")
+	var tee bytes.Buffer
+	r := NewProtocolV2Request(strings.NewReader(in))
+	r.SetTee(&tee)
+	for r.Scan() {
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if tee.String() != in {
+		t.Errorf("got %q, want %q", tee.String(), in)
+	}
+}
+
+func TestPacketScannerResponseEnd(t *testing.T) {
+	in := pktLines("abcd") + ResponseEndPkt + pktLines("efgh") + ResponseEndPkt
+	s := NewPacketScanner(strings.NewReader(in))
+	var got []Packet
+	for s.Scan() {
+		got = append(got, s.Packet())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Packet{BytesPacket("abcd"), ResponseEndPacket{}, BytesPacket("efgh"), ResponseEndPacket{}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got := string(ResponseEndPacket{}.EncodeToPktLine()); got != ResponseEndPkt {
+		t.Errorf("got %q, want %q", got, ResponseEndPkt)
+	}
+
+	// 0003 is still invalid.
+	s = NewPacketScanner(strings.NewReader("0003"))
+	if s.Scan() || s.Err() == nil {
+		t.Errorf("got %#v, %v, want an error", s.Packet(), s.Err())
+	}
+}
+
+func TestPacketScannerOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    PacketScannerOptions
+		in      string
+		want    []Packet
+		wantErr bool
+	}{
+		{"default", PacketScannerOptions{}, "000Aabcdef" + FlushPkt, []Packet{BytesPacket("abcdef"), FlushPacket{}}, false},
+		{"empty packet", PacketScannerOptions{}, "0004", nil, true},
+		{"allow empty packet", PacketScannerOptions{AllowEmptyPackets: true}, "0004" + FlushPkt, []Packet{BytesPacket{}, FlushPacket{}}, false},
+		{"uppercase", PacketScannerOptions{RejectUppercaseHex: true}, "000Aabcdef", nil, true},
+		{"lowercase", PacketScannerOptions{RejectUppercaseHex: true}, "000aabcdef", []Packet{BytesPacket("abcdef")}, false},
+		{"within the limit", PacketScannerOptions{MaxPacketSize: 8}, "0008abcd", []Packet{BytesPacket("abcd")}, false},
+		{"over the limit", PacketScannerOptions{MaxPacketSize: 8}, "0009abcde", nil, true},
+		{"over the default limit", PacketScannerOptions{}, "fff1" + strings.Repeat("a", 0xfff1-4), nil, true},
+		{"over the maximum", PacketScannerOptions{MaxPacketSize: 0xFFFF}, "fff1" + strings.Repeat("a", 0xfff1-4), nil, true},
+	} {
+		s := NewPacketScannerWithOptions(strings.NewReader(tc.in), tc.opts)
+		var got []Packet
+		for s.Scan() {
+			p := s.Packet()
+			if bp, ok := p.(BytesPacket); ok {
+				p = BytesPacket(append([]byte{}, bp...))
+			}
+			got = append(got, p)
+		}
+		if (s.Err() != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %v", tc.name, s.Err(), tc.wantErr)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPacketScannerOptionsRecovery(t *testing.T) {
+	in := "0009abcde" + pktLines("xyz")
+	s := NewPacketScannerWithOptions(strings.NewReader(in), PacketScannerOptions{MaxPacketSize: 8})
+	var reasons []string
+	s.SetRecovery(func(d *ScanDiagnostic) { reasons = append(reasons, d.Reason) })
+	var got []string
+	for s.Scan() {
+		got = append(got, string(s.Packet().(BytesPacket)))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"xyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(reasons) == 0 || reasons[0] != "packet too large" {
+		t.Errorf("got %q, want packet too large", reasons)
+	}
+}
+
+func TestCopyPacket(t *testing.T) {
+	for _, p := range []Packet{
+		BytesPacket("abcd"),
+		PackFilePacket("PACK"),
+		SideBandMainPacket("main"),
+		SideBandReportPacket("report"),
+		SideBandErrorPacket("error"),
+	} {
+		c := CopyPacket(p)
+		if !reflect.DeepEqual(c, p) {
+			t.Errorf("got %#v, want %#v", c, p)
+		}
+		// Overwrite the original payload.
+		b := reflect.ValueOf(p).Bytes()
+		b[0] = 'x'
+		if reflect.DeepEqual(c, p) {
+			t.Errorf("%T: the copy shares the payload", p)
+		}
+	}
+	for _, p := range []Packet{FlushPacket{}, DelimPacket{}, ResponseEndPacket{}, ErrorPacket("oops")} {
+		if c := CopyPacket(p); c != p {
+			t.Errorf("got %#v, want %#v", c, p)
+		}
+	}
+}
+
+func TestPacketScannerCopyPacket(t *testing.T) {
+	var lines []string
+	for i := 0; i < 1000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+	s := NewPacketScanner(strings.NewReader(pktLines(lines...)))
+	var got []Packet
+	for s.Scan() {
+		got = append(got, CopyPacket(s.Packet()))
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range got {
+		if string(p.(BytesPacket)) != lines[i] {
+			t.Fatalf("packet %d: got %q, want %q", i, p, lines[i])
+		}
+	}
+}
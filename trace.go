@@ -0,0 +1,43 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+// TraceFunc is called by a parser for every chunk it reads, and by an encoder
+// for every chunk it writes. d is the direction of the data, such as
+// ServerToClient for a response. raw is the bytes of the chunk on the wire,
+// including the length prefixes; for a parser, it's every byte consumed since
+// the previous chunk. raw and the chunk are valid only during the call.
+//
+// Set it with the SetTrace method of a parser or an encoder, such as
+// ProtocolV1UploadPackResponse.SetTrace.
+type TraceFunc func(d Direction, raw []byte, chunk Packet)
+
+func (s *PacketScanner) setTrace(d Direction, f TraceFunc) {
+	s.trace, s.traceDir, s.traceBuf = f, d, nil
+}
+
+// traceChunk calls the trace function with the bytes consumed since the
+// previous chunk.
+func (s *PacketScanner) traceChunk(c Packet) {
+	if s.trace == nil {
+		return
+	}
+	s.trace(s.traceDir, s.traceBuf, c)
+	s.traceBuf = s.traceBuf[:0]
+}
+
+func (w *chunkWriter) setTrace(d Direction, f TraceFunc) {
+	w.trace, w.traceDir = f, d
+}
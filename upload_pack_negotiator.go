@@ -0,0 +1,266 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+)
+
+// AckMode is the acknowledgement mode negotiated by the capabilities of a
+// protocol v1 git-upload-pack request.
+type AckMode int
+
+const (
+	// AckModeSingle is the default mode. Only the first common commit is
+	// acknowledged.
+	AckModeSingle AckMode = iota
+	// AckModeMultiAck is the multi_ack mode.
+	AckModeMultiAck
+	// AckModeMultiAckDetailed is the multi_ack_detailed mode.
+	AckModeMultiAckDetailed
+)
+
+// AckModeFromCapabilities returns the AckMode selected by the client
+// capabilities.
+func AckModeFromCapabilities(caps []string) AckMode {
+	mode := AckModeSingle
+	for _, c := range caps {
+		switch c {
+		case "multi_ack_detailed":
+			return AckModeMultiAckDetailed
+		case "multi_ack":
+			mode = AckModeMultiAck
+		}
+	}
+	return mode
+}
+
+// UploadPackNegotiator computes the ACK/NAK lines of a protocol v1
+// git-upload-pack response from the have lines of the request, in the same way
+// as git-upload-pack.
+//
+// Feed the request chunks after the flush that ends the wants and shallows one
+// by one, and write the returned chunks to the response.
+type UploadPackNegotiator struct {
+	// AckMode is the negotiated acknowledgement mode.
+	AckMode AckMode
+	// NoDone is true if the client sent the no-done capability.
+	NoDone bool
+	// StatelessRPC is true if the request is a smart HTTP request. The
+	// negotiation ends at the first flush.
+	StatelessRPC bool
+	// HasObject reports whether the server has the commit.
+	HasObject func(objectID string) bool
+	// OKToGiveUp reports whether all wants are reachable from the common
+	// commits found so far. If nil, the server never gives up early.
+	OKToGiveUp func(commonObjectIDs []string) bool
+	// MaxRounds is the maximum number of negotiation rounds. A round ends
+	// with a flush. If zero, there's no limit.
+	MaxRounds int
+	// PreviousRounds is the number of rounds before this request. In the
+	// stateless-RPC mode, every round is a separate request handled by a
+	// new negotiator. Servers that track the requests of a client can set
+	// this to enforce MaxRounds across the requests.
+	PreviousRounds int
+
+	commons   []string
+	seen      map[string]bool
+	lastHex   string
+	gotCommon bool
+	gotOther  bool
+	sentReady bool
+	done      bool
+	sendPack  bool
+	rounds    int
+}
+
+// MissingDoneError is returned when a fetch request ends without done while
+// the server cannot send the pack without it.
+type MissingDoneError struct {
+	Reason string
+}
+
+func (e *MissingDoneError) Error() string {
+	return "missing done: " + e.Reason
+}
+
+// ErrTooManyNegotiationRounds is returned by UploadPackNegotiator when the
+// client exceeds MaxRounds. It can be written to the response as is.
+var ErrTooManyNegotiationRounds = ErrorPacket("too many negotiation rounds")
+
+// Done returns true if the negotiation of this request has ended.
+func (n *UploadPackNegotiator) Done() bool {
+	return n.done
+}
+
+// SendPack returns true if the negotiation has ended and the pack should be
+// sent. In the stateless-RPC mode, a request without done ends the
+// negotiation without a pack.
+func (n *UploadPackNegotiator) SendPack() bool {
+	return n.sendPack
+}
+
+// Rounds returns the number of rounds including PreviousRounds.
+func (n *UploadPackNegotiator) Rounds() int {
+	return n.PreviousRounds + n.rounds
+}
+
+// CommonObjectIDs returns the common commits found so far.
+func (n *UploadPackNegotiator) CommonObjectIDs() []string {
+	return n.commons
+}
+
+// Feed processes a request chunk and returns the response chunks to send.
+// Chunks other than have lines, flushes, and done are ignored.
+//
+// If the client exceeds MaxRounds, it returns ErrTooManyNegotiationRounds and
+// the negotiation ends without a pack.
+func (n *UploadPackNegotiator) Feed(c *ProtocolV1UploadPackRequestChunk) ([]*ProtocolV1UploadPackResponseChunk, error) {
+	if n.done {
+		return nil, nil
+	}
+	switch {
+	case c.HaveObjectID != "":
+		return n.have(c.HaveObjectID), nil
+	case c.EndOneRound:
+		n.rounds++
+		if n.MaxRounds != 0 && n.Rounds() > n.MaxRounds {
+			n.done = true
+			return nil, ErrTooManyNegotiationRounds
+		}
+		return n.endRound(), nil
+	case c.NoMoreNegotiation:
+		return n.finish(), nil
+	}
+	return nil, nil
+}
+
+// Finish checks that the request has properly ended. Call it when the request
+// reaches the end of the input. It returns a *MissingDoneError if the client
+// stopped without sending done where it's required.
+//
+// Over a stateful connection, the negotiation ends only with done, or with a
+// flush after "ACK <oid> ready" if no-done is negotiated. In the stateless-RPC
+// mode, the request can also end with a flush.
+func (n *UploadPackNegotiator) Finish() error {
+	if n.done {
+		return nil
+	}
+	if n.StatelessRPC {
+		return &MissingDoneError{Reason: "the request ended in the middle of a round"}
+	}
+	if n.NoDone && n.sentReady {
+		return &MissingDoneError{Reason: "the request ended after ready without a flush"}
+	}
+	return &MissingDoneError{Reason: "the request ended without done"}
+}
+
+// CheckProtocolV2FetchDone checks the arguments of a protocol v2 fetch
+// request. With wait-for-done, the client promises to send done when it wants
+// the pack, so a request without done is a MissingDoneError. Otherwise, a
+// request without done is valid: the server sends the acknowledgments, or the
+// pack if there's nothing to negotiate. Like git-upload-pack, the order of the
+// arguments doesn't matter.
+func CheckProtocolV2FetchDone(args []string) error {
+	done, waitForDone := false, false
+	for _, arg := range args {
+		switch strings.TrimSuffix(arg, "\n") {
+		case "done":
+			done = true
+		case "wait-for-done":
+			waitForDone = true
+		}
+	}
+	if waitForDone && !done {
+		return &MissingDoneError{Reason: "the request has wait-for-done but no done"}
+	}
+	return nil
+}
+
+func (n *UploadPackNegotiator) have(oid string) []*ProtocolV1UploadPackResponseChunk {
+	if !n.HasObject(oid) {
+		n.gotOther = true
+		if n.AckMode != AckModeSingle && n.okToGiveUp() {
+			if n.AckMode == AckModeMultiAckDetailed {
+				n.sentReady = true
+				return []*ProtocolV1UploadPackResponseChunk{{AckObjectID: oid, AckDetail: "ready"}}
+			}
+			return []*ProtocolV1UploadPackResponseChunk{{AckObjectID: oid, AckDetail: "continue"}}
+		}
+		return nil
+	}
+
+	n.gotCommon = true
+	n.lastHex = oid
+	if !n.seen[oid] {
+		if n.seen == nil {
+			n.seen = map[string]bool{}
+		}
+		n.seen[oid] = true
+		n.commons = append(n.commons, oid)
+	}
+	switch n.AckMode {
+	case AckModeMultiAckDetailed:
+		return []*ProtocolV1UploadPackResponseChunk{{AckObjectID: oid, AckDetail: "common"}}
+	case AckModeMultiAck:
+		return []*ProtocolV1UploadPackResponseChunk{{AckObjectID: oid, AckDetail: "continue"}}
+	}
+	if len(n.commons) == 1 && n.commons[0] == oid {
+		return []*ProtocolV1UploadPackResponseChunk{{AckObjectID: oid}}
+	}
+	return nil
+}
+
+func (n *UploadPackNegotiator) endRound() []*ProtocolV1UploadPackResponseChunk {
+	var chunks []*ProtocolV1UploadPackResponseChunk
+	if n.AckMode == AckModeMultiAckDetailed && n.gotCommon && !n.gotOther && n.okToGiveUp() {
+		n.sentReady = true
+		chunks = append(chunks, &ProtocolV1UploadPackResponseChunk{AckObjectID: n.lastHex, AckDetail: "ready"})
+	}
+	if len(n.commons) == 0 || n.AckMode != AckModeSingle {
+		chunks = append(chunks, &ProtocolV1UploadPackResponseChunk{Nak: true})
+	}
+	if n.NoDone && n.sentReady {
+		n.done = true
+		n.sendPack = true
+		chunks = append(chunks, &ProtocolV1UploadPackResponseChunk{AckObjectID: n.lastHex})
+		return chunks
+	}
+	if n.StatelessRPC {
+		n.done = true
+	}
+	n.gotCommon = false
+	n.gotOther = false
+	return chunks
+}
+
+func (n *UploadPackNegotiator) finish() []*ProtocolV1UploadPackResponseChunk {
+	n.done = true
+	n.sendPack = true
+	if len(n.commons) == 0 {
+		return []*ProtocolV1UploadPackResponseChunk{{Nak: true}}
+	}
+	if n.AckMode != AckModeSingle {
+		return []*ProtocolV1UploadPackResponseChunk{{AckObjectID: n.lastHex}}
+	}
+	return nil
+}
+
+func (n *UploadPackNegotiator) okToGiveUp() bool {
+	if n.OKToGiveUp == nil {
+		return false
+	}
+	return n.OKToGiveUp(n.commons)
+}
@@ -0,0 +1,189 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// negotiate feeds the request to the negotiator and returns the response
+// lines. A have is "h<oid>", a flush is "0000", and done is "done".
+func negotiate(t *testing.T, n *UploadPackNegotiator, request ...string) []string {
+	var lines []string
+	for _, r := range request {
+		c := &ProtocolV1UploadPackRequestChunk{}
+		switch {
+		case r == "0000":
+			c.EndOneRound = true
+		case r == "done":
+			c.NoMoreNegotiation = true
+		default:
+			c.HaveObjectID = strings.TrimPrefix(r, "h")
+		}
+		resp, err := n.Feed(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rc := range resp {
+			switch {
+			case rc.Nak:
+				lines = append(lines, "NAK")
+			default:
+				lines = append(lines, strings.TrimSpace("ACK "+rc.AckObjectID+" "+rc.AckDetail))
+			}
+		}
+	}
+	return lines
+}
+
+func TestUploadPackNegotiator(t *testing.T) {
+	common := map[string]bool{"c1": true, "c2": true}
+	for _, tc := range []struct {
+		name      string
+		caps      []string
+		stateless bool
+		giveUp    bool
+		request   []string
+		want      []string
+		sendPack  bool
+	}{
+		{
+			name:     "single",
+			request:  []string{"hx", "hc1", "hc2", "0000", "done"},
+			want:     []string{"ACK c1"},
+			sendPack: true,
+		},
+		{
+			name:     "nothing common",
+			request:  []string{"hx", "0000", "done"},
+			want:     []string{"NAK", "NAK"},
+			sendPack: true,
+		},
+		{
+			name:     "multi_ack",
+			caps:     []string{"multi_ack"},
+			request:  []string{"hc1", "hx", "0000", "done"},
+			want:     []string{"ACK c1 continue", "NAK", "ACK c1"},
+			sendPack: true,
+		},
+		{
+			name:     "multi_ack_detailed ready",
+			caps:     []string{"multi_ack_detailed"},
+			giveUp:   true,
+			request:  []string{"hc1", "0000", "done"},
+			want:     []string{"ACK c1 common", "ACK c1 ready", "NAK", "ACK c1"},
+			sendPack: true,
+		},
+		{
+			name:     "no-done",
+			caps:     []string{"multi_ack_detailed", "no-done"},
+			giveUp:   true,
+			request:  []string{"hc1", "0000"},
+			want:     []string{"ACK c1 common", "ACK c1 ready", "NAK", "ACK c1"},
+			sendPack: true,
+		},
+		{
+			name:      "stateless round",
+			caps:      []string{"multi_ack_detailed"},
+			stateless: true,
+			request:   []string{"hc1", "hx", "0000"},
+			want:      []string{"ACK c1 common", "NAK"},
+		},
+	} {
+		n := &UploadPackNegotiator{
+			AckMode:      AckModeFromCapabilities(tc.caps),
+			NoDone:       reflect.DeepEqual(tc.caps, []string{"multi_ack_detailed", "no-done"}),
+			StatelessRPC: tc.stateless,
+			HasObject:    func(oid string) bool { return common[oid] },
+			OKToGiveUp:   func([]string) bool { return tc.giveUp },
+		}
+		if got := negotiate(t, n, tc.request...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if !n.Done() || n.SendPack() != tc.sendPack {
+			t.Errorf("%s: done %v, send pack %v", tc.name, n.Done(), n.SendPack())
+		}
+		if err := n.Finish(); err != nil {
+			t.Errorf("%s: Finish: %v", tc.name, err)
+		}
+	}
+}
+
+func TestUploadPackNegotiatorMaxRounds(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		previous int
+		flushes  int
+		wantErr  bool
+	}{
+		{"within the limit", 0, 3, false},
+		{"over the limit", 0, 4, true},
+		{"over the limit with previous rounds", 2, 2, true},
+	} {
+		n := &UploadPackNegotiator{
+			HasObject:      func(string) bool { return false },
+			MaxRounds:      3,
+			PreviousRounds: tc.previous,
+		}
+		var err error
+		for i := 0; i < tc.flushes && err == nil; i++ {
+			_, err = n.Feed(&ProtocolV1UploadPackRequestChunk{EndOneRound: true})
+		}
+		if tc.wantErr {
+			if err != ErrTooManyNegotiationRounds || !n.Done() || n.SendPack() {
+				t.Errorf("%s: got %v, done %v, send pack %v", tc.name, err, n.Done(), n.SendPack())
+			}
+			continue
+		}
+		if err != nil || n.Rounds() != tc.previous+tc.flushes {
+			t.Errorf("%s: got %v, rounds %d", tc.name, err, n.Rounds())
+		}
+	}
+}
+
+func TestUploadPackNegotiatorFinish(t *testing.T) {
+	n := &UploadPackNegotiator{HasObject: func(string) bool { return false }}
+	negotiate(t, n, "hx", "0000")
+	var md *MissingDoneError
+	if err := n.Finish(); !errors.As(err, &md) {
+		t.Errorf("got %v, want a MissingDoneError", err)
+	}
+}
+
+func TestCheckProtocolV2FetchDone(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{"wants only", []string{"want a\n"}, false},
+		{"wants and done", []string{"want a\n", "done\n"}, false},
+		{"haves without done", []string{"want a\n", "have b\n"}, false},
+		{"haves and done", []string{"want a\n", "have b\n", "done\n"}, false},
+		{"have after done", []string{"want a\n", "done\n", "have b\n"}, false},
+		{"wait-for-done and done", []string{"want a\n", "wait-for-done\n", "have b\n", "done\n"}, false},
+		{"wait-for-done without done", []string{"want a\n", "wait-for-done\n", "have b\n"}, true},
+		{"wait-for-done without haves", []string{"want a\n", "wait-for-done\n"}, true},
+	} {
+		err := CheckProtocolV2FetchDone(tc.args)
+		var md *MissingDoneError
+		if (err != nil) != tc.wantErr || (err != nil && !errors.As(err, &md)) {
+			t.Errorf("%s: got %v, want a MissingDoneError %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
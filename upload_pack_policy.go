@@ -0,0 +1,186 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// UploadPackPolicy restricts what a git-upload-pack request can ask for. The
+// zero value allows everything. Set it to the request parsers with SetPolicy,
+// and they stop with an ErrorPacket that can be written to the response as is.
+type UploadPackPolicy struct {
+	// MaxDepth is the maximum depth of a deepen line. If zero, there's no
+	// limit.
+	MaxDepth int
+	// AllowedFilters is the filter types allowed, such as "blob:none",
+	// "blob:limit", "tree", "sparse:oid", "object:type", and "combine", the
+	// same as uploadpackfilter.<filter>.allow of Git. The sub-filters of a
+	// combined filter are checked too. If nil, all filters are allowed. If
+	// empty but not nil, no filter is allowed.
+	AllowedFilters []string
+	// DenyWantRef rejects the want-ref lines of a protocol v2 fetch.
+	DenyWantRef bool
+	// DenyPackfileURIs rejects the packfile-uris line of a protocol v2
+	// fetch.
+	DenyPackfileURIs bool
+	// RequiredCapabilities is the capabilities the client must send, such as
+	// "side-band-64k" or "object-format". A capability with a value such as
+	// "agent=git/2.30.0" matches its name.
+	RequiredCapabilities []string
+	// Wants checks the object IDs of the want lines. If nil, any object can
+	// be wanted.
+	Wants *WantValidator
+	// Visibility checks the want and want-ref lines against Refs with
+	// RefVisibility.CheckWants, so that a hidden ref cannot be fetched. If
+	// nil, they aren't checked.
+	Visibility *RefVisibility
+	// Refs maps the names of all the refs, hidden ones included, to their
+	// object IDs for Visibility.
+	Refs map[string]string
+}
+
+// CheckCapabilities checks the capabilities a client sent.
+func (p *UploadPackPolicy) CheckCapabilities(caps []string) error {
+	for _, req := range p.RequiredCapabilities {
+		found := false
+		for _, c := range caps {
+			if c == req || strings.HasPrefix(c, req+"=") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrorPacket("git upload-pack: missing required capability " + req)
+		}
+	}
+	return nil
+}
+
+// CheckDepth checks the depth of a deepen line.
+func (p *UploadPackPolicy) CheckDepth(depth int) error {
+	if p.MaxDepth != 0 && depth > p.MaxDepth {
+		return ErrorPacket(fmt.Sprintf("git upload-pack: deepen %d exceeds the maximum depth %d", depth, p.MaxDepth))
+	}
+	return nil
+}
+
+// CheckFilter checks a filter spec such as "blob:limit=1m" with the message of
+// git-upload-pack.
+func (p *UploadPackPolicy) CheckFilter(spec string) error {
+	if p.AllowedFilters == nil {
+		return nil
+	}
+	name := filterTypeName(spec)
+	if !p.filterAllowed(name) {
+		return ErrorPacket(fmt.Sprintf("git upload-pack: filter '%s' not supported", name))
+	}
+	if name == "combine" {
+		for _, sub := range strings.Split(strings.TrimPrefix(spec, "combine:"), "+") {
+			if err := p.CheckFilter(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *UploadPackPolicy) filterAllowed(name string) bool {
+	for _, f := range p.AllowedFilters {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filterTypeName returns the type of a filter spec in the same way as Git's
+// list_object_filter_config_name.
+func filterTypeName(spec string) string {
+	switch {
+	case spec == "blob:none":
+		return "blob:none"
+	case strings.HasPrefix(spec, "blob:limit="):
+		return "blob:limit"
+	case strings.HasPrefix(spec, "tree:"):
+		return "tree"
+	case strings.HasPrefix(spec, "sparse:oid="):
+		return "sparse:oid"
+	case strings.HasPrefix(spec, "object:type="):
+		return "object:type"
+	case strings.HasPrefix(spec, "combine:"):
+		return "combine"
+	}
+	return spec
+}
+
+// checkWant checks the object ID of a want line with Wants and Visibility.
+func (p *UploadPackPolicy) checkWant(oid string) error {
+	if p.Wants != nil {
+		if err := p.Wants.CheckWant(oid); err != nil {
+			return err
+		}
+	}
+	if p.Visibility != nil {
+		return p.Visibility.CheckWants(p.Refs, []string{oid}, nil)
+	}
+	return nil
+}
+
+// CheckProtocolV1UploadPackRequestChunk checks a chunk of a protocol v0/v1
+// request. The required capabilities are checked on the first want line, and
+// the object IDs of the want lines with Wants and Visibility.
+func (p *UploadPackPolicy) CheckProtocolV1UploadPackRequestChunk(c *ProtocolV1UploadPackRequestChunk) error {
+	if c.Capabilities != nil {
+		if err := p.CheckCapabilities(c.Capabilities); err != nil {
+			return err
+		}
+	}
+	switch {
+	case c.WantObjectID != "":
+		return p.checkWant(c.WantObjectID)
+	case c.DeepenDepth != 0:
+		return p.CheckDepth(c.DeepenDepth)
+	case c.FilterSpec != "":
+		return p.CheckFilter(c.FilterSpec)
+	}
+	return nil
+}
+
+// CheckProtocolV2FetchArgument checks an argument of a protocol v2 fetch
+// request.
+func (p *UploadPackPolicy) CheckProtocolV2FetchArgument(arg string) error {
+	arg = strings.TrimSuffix(arg, "\n")
+	switch {
+	case strings.HasPrefix(arg, "deepen "):
+		depth, err := strconv.Atoi(strings.TrimPrefix(arg, "deepen "))
+		if err != nil {
+			return SyntaxError("cannot parse depth")
+		}
+		return p.CheckDepth(depth)
+	case strings.HasPrefix(arg, "filter "):
+		return p.CheckFilter(strings.TrimPrefix(arg, "filter "))
+	case strings.HasPrefix(arg, "want "):
+		return p.checkWant(strings.TrimPrefix(arg, "want "))
+	case strings.HasPrefix(arg, "want-ref ") && p.DenyWantRef,
+		strings.HasPrefix(arg, "packfile-uris ") && p.DenyPackfileURIs:
+		return ErrorPacket(fmt.Sprintf("unexpected line: '%s'", arg))
+	case strings.HasPrefix(arg, "want-ref ") && p.Visibility != nil:
+		return p.Visibility.CheckWants(p.Refs, nil, []string{strings.TrimPrefix(arg, "want-ref ")})
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUploadPackPolicyCheckFilter(t *testing.T) {
+	for _, tc := range []struct {
+		allowed []string
+		spec    string
+		want    error
+	}{
+		{nil, "blob:none", nil},
+		{[]string{}, "blob:none", ErrorPacket("git upload-pack: filter 'blob:none' not supported")},
+		{[]string{"blob:limit"}, "blob:limit=1m", nil},
+		{[]string{"blob:limit"}, "tree:0", ErrorPacket("git upload-pack: filter 'tree' not supported")},
+		{[]string{"combine", "blob:none", "tree"}, "combine:blob:none+tree:1", nil},
+		{[]string{"combine", "blob:none"}, "combine:blob:none+tree:1", ErrorPacket("git upload-pack: filter 'tree' not supported")},
+		{[]string{"blob:none", "tree"}, "combine:blob:none+tree:1", ErrorPacket("git upload-pack: filter 'combine' not supported")},
+	} {
+		p := &UploadPackPolicy{AllowedFilters: tc.allowed}
+		if got := p.CheckFilter(tc.spec); got != tc.want {
+			t.Errorf("%q, %s: got %v, want %v", tc.allowed, tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestUploadPackPolicyCheck(t *testing.T) {
+	p := &UploadPackPolicy{
+		MaxDepth:             10,
+		RequiredCapabilities: []string{"side-band-64k", "agent"},
+	}
+	for _, tc := range []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{"depth", p.CheckDepth(10), false},
+		{"too deep", p.CheckDepth(11), true},
+		{"capabilities", p.CheckCapabilities([]string{"agent=git/2.40", "side-band-64k"}), false},
+		{"missing capability", p.CheckCapabilities([]string{"side-band-64k"}), true},
+		{"capability prefix", p.CheckCapabilities([]string{"agentx", "side-band-64k"}), true},
+		{"v2 depth", p.CheckProtocolV2FetchArgument("deepen 10\n"), false},
+		{"v2 too deep", p.CheckProtocolV2FetchArgument("deepen 11\n"), true},
+		{"v2 bad depth", p.CheckProtocolV2FetchArgument("deepen x\n"), true},
+		{"v2 want-ref", p.CheckProtocolV2FetchArgument("want-ref refs/heads/main\n"), false},
+		{"v2 denied want-ref", (&UploadPackPolicy{DenyWantRef: true}).CheckProtocolV2FetchArgument("want-ref refs/heads/main\n"), true},
+		{"v2 denied packfile-uris", (&UploadPackPolicy{DenyPackfileURIs: true}).CheckProtocolV2FetchArgument("packfile-uris https\n"), true},
+	} {
+		if (tc.err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %v", tc.name, tc.err, tc.wantErr)
+		}
+	}
+}
+
+func TestUploadPackPolicyVisibility(t *testing.T) {
+	p := &UploadPackPolicy{
+		Visibility: &RefVisibility{Transfer: []string{"refs/hidden"}},
+		Refs:       map[string]string{"refs/heads/main": oidA, "refs/hidden/x": oidB},
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"v1 visible", p.CheckProtocolV1UploadPackRequestChunk(&ProtocolV1UploadPackRequestChunk{WantObjectID: oidA}), nil},
+		{"v1 hidden", p.CheckProtocolV1UploadPackRequestChunk(&ProtocolV1UploadPackRequestChunk{WantObjectID: oidB}), ErrorPacket("upload-pack: not our ref " + oidB)},
+		{"v2 visible", p.CheckProtocolV2FetchArgument("want " + oidA + "\n"), nil},
+		{"v2 hidden", p.CheckProtocolV2FetchArgument("want " + oidB + "\n"), ErrorPacket("upload-pack: not our ref " + oidB)},
+		{"v2 want-ref", p.CheckProtocolV2FetchArgument("want-ref refs/heads/main\n"), nil},
+		{"v2 hidden want-ref", p.CheckProtocolV2FetchArgument("want-ref refs/hidden/x\n"), ErrorPacket("unknown ref refs/hidden/x")},
+	} {
+		if tc.err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.err, tc.want)
+		}
+	}
+}
+
+func TestUploadPackPolicyParsers(t *testing.T) {
+	p := &UploadPackPolicy{
+		MaxDepth:             1,
+		AllowedFilters:       []string{"blob:none"},
+		RequiredCapabilities: []string{"side-band-64k"},
+		Wants:                NewWantValidator(nil, []string{oidA}),
+	}
+	v1 := func(lines ...string) error {
+		r := NewProtocolV1UploadPackRequest(strings.NewReader(pktLines(lines...)))
+		r.SetPolicy(p)
+		for r.Scan() {
+		}
+		return r.Err()
+	}
+	v2 := func(args ...string) error {
+		in := pktLines("command=fetch\n", "agent=git/2.40\n", "side-band-64k\n") + DelimPkt + pktLines(append(args, "0000")...)
+		r := NewProtocolV2Request(strings.NewReader(in))
+		r.SetPolicy(p)
+		for r.Scan() {
+		}
+		return r.Err()
+	}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"v1", v1("want "+oidA+" side-band-64k\n", "deepen 1\n", "filter blob:none\n", "0000", "done\n"), nil},
+		{"v1 missing capability", v1("want "+oidA+" ofs-delta\n", "0000", "done\n"), ErrorPacket("git upload-pack: missing required capability side-band-64k")},
+		{"v1 not our ref", v1("want "+oidB+" side-band-64k\n", "0000", "done\n"), ErrorPacket("upload-pack: not our ref " + oidB)},
+		{"v1 too deep", v1("want "+oidA+" side-band-64k\n", "deepen 2\n", "0000", "done\n"), ErrorPacket("git upload-pack: deepen 2 exceeds the maximum depth 1")},
+		{"v1 filter", v1("want "+oidA+" side-band-64k\n", "filter tree:0\n", "0000", "done\n"), ErrorPacket("git upload-pack: filter 'tree' not supported")},
+		{"v2", v2("want "+oidA+"\n", "deepen 1\n", "filter blob:none\n", "done\n"), nil},
+		{"v2 not our ref", v2("want "+oidB+"\n", "done\n"), ErrorPacket("upload-pack: not our ref " + oidB)},
+		{"v2 filter", v2("want "+oidA+"\n", "filter tree:0\n", "done\n"), ErrorPacket("git upload-pack: filter 'tree' not supported")},
+	} {
+		if tc.err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, tc.err, tc.want)
+		}
+	}
+}
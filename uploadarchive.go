@@ -0,0 +1,399 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+)
+
+type uploadArchiveRequestState int
+
+const (
+	uploadArchiveRequestStateScanArguments uploadArchiveRequestState = iota
+	uploadArchiveRequestStateEnd
+)
+
+func (s uploadArchiveRequestState) String() string {
+	switch s {
+	case uploadArchiveRequestStateScanArguments:
+		return "ScanArguments"
+	case uploadArchiveRequestStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
+// UploadArchiveRequestChunk is a chunk of a git-upload-archive request.
+type UploadArchiveRequestChunk struct {
+	Argument     string
+	EndOfRequest bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *UploadArchiveRequestChunk) EncodeToPktLine() []byte {
+	if c.Argument != "" {
+		return BytesPacket([]byte(fmt.Sprintf("argument %s\n", c.Argument))).EncodeToPktLine()
+	}
+	if c.EndOfRequest {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// UploadArchiveRequest provides an interface for reading a git-upload-archive
+// request.
+type UploadArchiveRequest struct {
+	scanner *PacketScanner
+	state   uploadArchiveRequestState
+	err     error
+	curr    *UploadArchiveRequestChunk
+}
+
+// NewUploadArchiveRequest returns a new UploadArchiveRequest to read from rd.
+func NewUploadArchiveRequest(rd io.Reader) *UploadArchiveRequest {
+	return &UploadArchiveRequest{scanner: NewPacketScanner(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// UploadArchiveRequest.
+func (r *UploadArchiveRequest) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent chunk generated by a call to Scan.
+func (r *UploadArchiveRequest) Chunk() *UploadArchiveRequestChunk {
+	return r.curr
+}
+
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *UploadArchiveRequest) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *UploadArchiveRequest) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *UploadArchiveRequest) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ClientToServer as
+// the direction. See TraceFunc.
+func (r *UploadArchiveRequest) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ClientToServer, f)
+}
+
+// Scan advances the scanner to the next packet. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *UploadArchiveRequest) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "UploadArchiveRequest", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *UploadArchiveRequest) scan() bool {
+	if r.err != nil || r.state == uploadArchiveRequestStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+
+	switch p := r.scanner.Packet().(type) {
+	case FlushPacket:
+		r.state = uploadArchiveRequestStateEnd
+		r.curr = &UploadArchiveRequestChunk{
+			EndOfRequest: true,
+		}
+		return true
+	case BytesPacket:
+		if !bytes.HasPrefix(p, []byte("argument ")) {
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+			return false
+		}
+		r.curr = &UploadArchiveRequestChunk{
+			Argument: strings.TrimSuffix(strings.TrimPrefix(string(p), "argument "), "\n"),
+		}
+		return true
+	default:
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+		return false
+	}
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *UploadArchiveRequest) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *UploadArchiveRequest) Chunks() iter.Seq2[*UploadArchiveRequestChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+type uploadArchiveResponseState int
+
+const (
+	uploadArchiveResponseStateBegin uploadArchiveResponseState = iota
+	uploadArchiveResponseStateScanStatusFlush
+	uploadArchiveResponseStateScanArchive
+	uploadArchiveResponseStateEnd
+)
+
+func (s uploadArchiveResponseState) String() string {
+	switch s {
+	case uploadArchiveResponseStateBegin:
+		return "Begin"
+	case uploadArchiveResponseStateScanStatusFlush:
+		return "ScanStatusFlush"
+	case uploadArchiveResponseStateScanArchive:
+		return "ScanArchive"
+	case uploadArchiveResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
+// UploadArchiveResponseChunk is a chunk of a git-upload-archive response.
+//
+// After the status, the archive is sent with the sideband encoding. The main
+// stream is in ArchiveStream, the progress messages are in ProgressMessage,
+// and the error messages are in ErrorMessage.
+type UploadArchiveResponseChunk struct {
+	Ack             bool
+	NackReason      string
+	EndOfStatus     bool
+	ArchiveStream   []byte
+	ProgressMessage []byte
+	ErrorMessage    []byte
+	// Keepalive is an empty sideband packet that the server sends while
+	// it's busy.
+	Keepalive     bool
+	EndOfResponse bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *UploadArchiveResponseChunk) EncodeToPktLine() []byte {
+	if c.Ack {
+		return BytesPacket([]byte("ACK\n")).EncodeToPktLine()
+	}
+	if c.NackReason != "" {
+		return BytesPacket([]byte(fmt.Sprintf("NACK %s\n", c.NackReason))).EncodeToPktLine()
+	}
+	if c.EndOfStatus {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	if len(c.ArchiveStream) != 0 {
+		return SideBandMainPacket(c.ArchiveStream).EncodeToPktLine()
+	}
+	if len(c.ProgressMessage) != 0 {
+		return SideBandReportPacket(c.ProgressMessage).EncodeToPktLine()
+	}
+	if len(c.ErrorMessage) != 0 {
+		return SideBandErrorPacket(c.ErrorMessage).EncodeToPktLine()
+	}
+	if c.Keepalive {
+		return []byte(KeepalivePkt)
+	}
+	if c.EndOfResponse {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// UploadArchiveResponse provides an interface for reading a git-upload-archive
+// response.
+type UploadArchiveResponse struct {
+	scanner *PacketScanner
+	state   uploadArchiveResponseState
+	err     error
+	curr    *UploadArchiveResponseChunk
+}
+
+// NewUploadArchiveResponse returns a new UploadArchiveResponse to read from rd.
+func NewUploadArchiveResponse(rd io.Reader) *UploadArchiveResponse {
+	return &UploadArchiveResponse{scanner: NewPacketScanner(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// UploadArchiveResponse.
+func (r *UploadArchiveResponse) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent chunk generated by a call to Scan.
+func (r *UploadArchiveResponse) Chunk() *UploadArchiveResponseChunk {
+	return r.curr
+}
+
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *UploadArchiveResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *UploadArchiveResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *UploadArchiveResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *UploadArchiveResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
+// Scan advances the scanner to the next packet. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *UploadArchiveResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "UploadArchiveResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *UploadArchiveResponse) scan() bool {
+	if r.err != nil || r.state == uploadArchiveResponseStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	pkt := r.scanner.Packet()
+
+	switch r.state {
+	case uploadArchiveResponseStateBegin:
+		bp, ok := pkt.(BytesPacket)
+		if !ok {
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+			return false
+		}
+		s := strings.TrimSuffix(string(bp), "\n")
+		if s == "ACK" {
+			r.state = uploadArchiveResponseStateScanStatusFlush
+			r.curr = &UploadArchiveResponseChunk{
+				Ack: true,
+			}
+			return true
+		}
+		if strings.HasPrefix(s, "NACK ") {
+			// The server closes the connection after NACK.
+			r.state = uploadArchiveResponseStateEnd
+			r.curr = &UploadArchiveResponseChunk{
+				NackReason: strings.TrimPrefix(s, "NACK "),
+			}
+			return true
+		}
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+		return false
+	case uploadArchiveResponseStateScanStatusFlush:
+		if _, ok := pkt.(FlushPacket); !ok {
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+			return false
+		}
+		r.state = uploadArchiveResponseStateScanArchive
+		r.curr = &UploadArchiveResponseChunk{
+			EndOfStatus: true,
+		}
+		return true
+	case uploadArchiveResponseStateScanArchive:
+		switch p := pkt.(type) {
+		case FlushPacket:
+			r.state = uploadArchiveResponseStateEnd
+			r.curr = &UploadArchiveResponseChunk{
+				EndOfResponse: true,
+			}
+			return true
+		case BytesPacket:
+			if isKeepalive(p) {
+				r.curr = &UploadArchiveResponseChunk{
+					Keepalive: true,
+				}
+				return true
+			}
+			switch sp := ParseSideBandPacket(p).(type) {
+			case SideBandMainPacket:
+				r.curr = &UploadArchiveResponseChunk{
+					ArchiveStream: sp,
+				}
+			case SideBandReportPacket:
+				r.curr = &UploadArchiveResponseChunk{
+					ProgressMessage: sp,
+				}
+			case SideBandErrorPacket:
+				r.curr = &UploadArchiveResponseChunk{
+					ErrorMessage: sp,
+				}
+			default:
+				r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+				return false
+			}
+			return true
+		default:
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+			return false
+		}
+	}
+	panic("impossible state")
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *UploadArchiveResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *UploadArchiveResponse) Chunks() iter.Seq2[*UploadArchiveResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
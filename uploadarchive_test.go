@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// pktLines encodes the lines as pkt-lines. "0000" is a flush packet.
+func pktLines(lines ...string) string {
+	var b bytes.Buffer
+	for _, l := range lines {
+		if l == "0000" {
+			b.Write(FlushPacket{}.EncodeToPktLine())
+			continue
+		}
+		b.Write(BytesPacket(l).EncodeToPktLine())
+	}
+	return b.String()
+}
+
+func TestUploadArchiveRequest(t *testing.T) {
+	in := pktLines("argument --format=tar\n", "argument HEAD\n", "0000")
+	r := NewUploadArchiveRequest(strings.NewReader(in))
+	var got []*UploadArchiveRequestChunk
+	var out bytes.Buffer
+	for r.Scan() {
+		got = append(got, r.Chunk())
+		out.Write(r.Chunk().EncodeToPktLine())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []*UploadArchiveRequestChunk{
+		{Argument: "--format=tar"},
+		{Argument: "HEAD"},
+		{EndOfRequest: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if out.String() != in {
+		t.Errorf("got %q, want %q", out.String(), in)
+	}
+}
+
+func TestUploadArchiveRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"no flush", pktLines("argument HEAD\n")},
+		{"not an argument", pktLines("want HEAD\n", "0000")},
+		{"delim", "0001"},
+		{"bad length", "00zz"},
+	} {
+		r := NewUploadArchiveRequest(strings.NewReader(tc.in))
+		for r.Scan() {
+		}
+		if r.Err() == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
+
+func TestUploadArchiveResponse(t *testing.T) {
+	in := pktLines("ACK\n", "0000", "\x01tar", "\x02Counting\n", "\x01", "\x03oops\n", "0000")
+	r := NewUploadArchiveResponse(strings.NewReader(in))
+	var got []*UploadArchiveResponseChunk
+	var out bytes.Buffer
+	for r.Scan() {
+		got = append(got, r.Chunk())
+		out.Write(r.Chunk().EncodeToPktLine())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want := []*UploadArchiveResponseChunk{
+		{Ack: true},
+		{EndOfStatus: true},
+		{ArchiveStream: []byte("tar")},
+		{ProgressMessage: []byte("Counting\n")},
+		{Keepalive: true},
+		{ErrorMessage: []byte("oops\n")},
+		{EndOfResponse: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if out.String() != in {
+		t.Errorf("got %q, want %q", out.String(), in)
+	}
+}
+
+func TestUploadArchiveResponseNack(t *testing.T) {
+	r := NewUploadArchiveResponse(strings.NewReader(pktLines("NACK unknown format\n")))
+	if !r.Scan() {
+		t.Fatal(r.Err())
+	}
+	if got := r.Chunk().NackReason; got != "unknown format" {
+		t.Errorf("got %q, want %q", got, "unknown format")
+	}
+	if r.Scan() || r.Err() != nil {
+		t.Errorf("got more chunks after NACK, err %v", r.Err())
+	}
+}
+
+func TestUploadArchiveResponseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"flush first", pktLines("0000")},
+		{"bad status", pktLines("OK\n")},
+		{"no status flush", pktLines("ACK\n", "\x01tar")},
+		{"bad band", pktLines("ACK\n", "0000", "\x04tar")},
+		{"delim in archive", pktLines("ACK\n", "0000") + "0001"},
+		{"no end", pktLines("ACK\n", "0000", "\x01tar")},
+	} {
+		r := NewUploadArchiveResponse(strings.NewReader(tc.in))
+		for r.Scan() {
+		}
+		if r.Err() == nil {
+			t.Errorf("%s: got no error", tc.name)
+		}
+	}
+}
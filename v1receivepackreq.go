@@ -16,8 +16,10 @@ package gitprotocolio
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
 )
 
@@ -43,6 +45,40 @@ const (
 	protocolV1ReceivePackRequestStateScanPackFile
 )
 
+func (s protocolV1ReceivePackRequestState) String() string {
+	switch s {
+	case protocolV1ReceivePackRequestStateBegin:
+		return "Begin"
+	case protocolV1ReceivePackRequestStateScanCommandAndCapabilities:
+		return "ScanCommandAndCapabilities"
+	case protocolV1ReceivePackRequestStateScanCommand:
+		return "ScanCommand"
+	case protocolV1ReceivePackRequestStateScanCert:
+		return "ScanCert"
+	case protocolV1ReceivePackRequestStateScanCertVersion:
+		return "ScanCertVersion"
+	case protocolV1ReceivePackRequestStateScanCertPusher:
+		return "ScanCertPusher"
+	case protocolV1ReceivePackRequestStateScanCertPushee:
+		return "ScanCertPushee"
+	case protocolV1ReceivePackRequestStateScanCertNonce:
+		return "ScanCertNonce"
+	case protocolV1ReceivePackRequestStateScanOptionalCertPushOptions:
+		return "ScanOptionalCertPushOptions"
+	case protocolV1ReceivePackRequestStateScanCertCommand:
+		return "ScanCertCommand"
+	case protocolV1ReceivePackRequestStateScanCertGPGLine:
+		return "ScanCertGPGLine"
+	case protocolV1ReceivePackRequestStateScanOptionalPushOptions:
+		return "ScanOptionalPushOptions"
+	case protocolV1ReceivePackRequestStateScanPushOptions:
+		return "ScanPushOptions"
+	case protocolV1ReceivePackRequestStateScanPackFile:
+		return "ScanPackFile"
+	}
+	return "unknown"
+}
+
 // ProtocolV1ReceivePackRequestChunk is a chunk of a protocol v1
 // git-receive-pack request.
 type ProtocolV1ReceivePackRequestChunk struct {
@@ -54,7 +90,10 @@ type ProtocolV1ReceivePackRequestChunk struct {
 	RefName       string
 	EndOfCommands bool
 
-	StartOfPushCert      bool
+	// StartOfPushCert is the "push-cert" line, which has the capabilities.
+	// A push certificate follows, and the commands are in it.
+	StartOfPushCert bool
+	// PushCertHeader is the "certificate version 0.1" line.
 	PushCertHeader       bool
 	Pusher               string
 	Pushee               string
@@ -63,6 +102,8 @@ type ProtocolV1ReceivePackRequestChunk struct {
 	EndOfCertPushOptions bool
 	GPGSignaturePart     []byte
 	EndOfPushCert        bool
+	// InPushCert is true for a command in a push certificate.
+	InPushCert bool
 
 	PushOption       string
 	EndOfPushOptions bool
@@ -75,6 +116,36 @@ func (c *ProtocolV1ReceivePackRequestChunk) EncodeToPktLine() []byte {
 	if c.ClientShallow != "" {
 		return BytesPacket([]byte(fmt.Sprintf("shallow %s\n", c.ClientShallow))).EncodeToPktLine()
 	}
+	if c.StartOfPushCert {
+		return BytesPacket([]byte(fmt.Sprintf("push-cert\x00%s", strings.Join(c.Capabilities, " ")))).EncodeToPktLine()
+	}
+	if c.PushCertHeader {
+		return BytesPacket([]byte("certificate version 0.1\n")).EncodeToPktLine()
+	}
+	if c.Pusher != "" {
+		return BytesPacket([]byte(fmt.Sprintf("pusher %s\n", c.Pusher))).EncodeToPktLine()
+	}
+	if c.Pushee != "" {
+		return BytesPacket([]byte(fmt.Sprintf("pushee %s\n", c.Pushee))).EncodeToPktLine()
+	}
+	if c.Nonce != "" {
+		return BytesPacket([]byte(fmt.Sprintf("nonce %s\n", c.Nonce))).EncodeToPktLine()
+	}
+	if c.CertPushOption != "" {
+		return BytesPacket([]byte(fmt.Sprintf("push-option %s\n", c.CertPushOption))).EncodeToPktLine()
+	}
+	if c.EndOfCertPushOptions {
+		return BytesPacket([]byte("\n")).EncodeToPktLine()
+	}
+	if c.InPushCert {
+		return BytesPacket([]byte(fmt.Sprintf("%s %s %s\n", c.OldObjectID, c.NewObjectID, c.RefName))).EncodeToPktLine()
+	}
+	if len(c.GPGSignaturePart) != 0 {
+		return BytesPacket(c.GPGSignaturePart).EncodeToPktLine()
+	}
+	if c.EndOfPushCert {
+		return BytesPacket([]byte("push-cert-end\n")).EncodeToPktLine()
+	}
 	if len(c.Capabilities) != 0 {
 		return BytesPacket([]byte(fmt.Sprintf("%s %s %s\x00%s\n", c.OldObjectID, c.NewObjectID, c.RefName, strings.Join(c.Capabilities, " ")))).EncodeToPktLine()
 	}
@@ -97,6 +168,143 @@ func (c *ProtocolV1ReceivePackRequestChunk) EncodeToPktLine() []byte {
 	panic("impossible chunk")
 }
 
+// kind returns the name of the chunk type for the errors, or "" for an
+// impossible chunk.
+func (c *ProtocolV1ReceivePackRequestChunk) kind() string {
+	switch {
+	case c.ClientShallow != "":
+		return "shallow"
+	case c.StartOfPushCert:
+		return "push-cert"
+	case c.PushCertHeader:
+		return "the certificate version"
+	case c.Pusher != "":
+		return "pusher"
+	case c.Pushee != "":
+		return "pushee"
+	case c.Nonce != "":
+		return "nonce"
+	case c.CertPushOption != "":
+		return "a push option in push-cert"
+	case c.EndOfCertPushOptions:
+		return "the end of the push-cert header"
+	case c.InPushCert:
+		return "a command in push-cert"
+	case len(c.GPGSignaturePart) != 0:
+		return "a signature line"
+	case c.EndOfPushCert:
+		return "push-cert-end"
+	case len(c.Capabilities) != 0:
+		return "a command with capabilities"
+	case c.OldObjectID != "" && c.NewObjectID != "" && c.RefName != "":
+		return "a command"
+	case c.EndOfCommands:
+		return "the end of commands"
+	case c.PushOption != "":
+		return "a push option"
+	case c.EndOfPushOptions:
+		return "the end of push options"
+	case len(c.PackStream) != 0:
+		return "pack data"
+	}
+	return ""
+}
+
+// ProtocolV1ReceivePackRequestEncoder writes a protocol v1 git-receive-pack
+// request chunk by chunk, in the order ProtocolV1ReceivePackRequest reads.
+type ProtocolV1ReceivePackRequestEncoder struct {
+	w     chunkWriter
+	state protocolV1ReceivePackRequestState
+}
+
+// NewProtocolV1ReceivePackRequestEncoder returns a new
+// ProtocolV1ReceivePackRequestEncoder that writes to w.
+func NewProtocolV1ReceivePackRequestEncoder(w io.Writer) *ProtocolV1ReceivePackRequestEncoder {
+	return &ProtocolV1ReceivePackRequestEncoder{w: chunkWriter{w: w}}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ClientToServer
+// as the direction. See TraceFunc.
+func (e *ProtocolV1ReceivePackRequestEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ClientToServer, f)
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one, such as a push option before the end
+// of commands. The first command has the capabilities unless a push
+// certificate has them.
+func (e *ProtocolV1ReceivePackRequestEncoder) WriteChunk(c *ProtocolV1ReceivePackRequestChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	var ok bool
+	var next protocolV1ReceivePackRequestState
+	kind := c.kind()
+	switch kind {
+	case "shallow":
+		ok = e.state == protocolV1ReceivePackRequestStateBegin
+		next = protocolV1ReceivePackRequestStateBegin
+	case "push-cert":
+		ok = e.state == protocolV1ReceivePackRequestStateBegin
+		next = protocolV1ReceivePackRequestStateScanCertVersion
+	case "the certificate version":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertVersion
+		next = protocolV1ReceivePackRequestStateScanCertPusher
+	case "pusher":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertPusher
+		next = protocolV1ReceivePackRequestStateScanCertPushee
+	case "pushee":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertPushee
+		next = protocolV1ReceivePackRequestStateScanCertNonce
+	case "nonce":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertPushee || e.state == protocolV1ReceivePackRequestStateScanCertNonce
+		next = protocolV1ReceivePackRequestStateScanOptionalCertPushOptions
+	case "a push option in push-cert", "the end of the push-cert header":
+		ok = e.state >= protocolV1ReceivePackRequestStateScanCertPushee && e.state <= protocolV1ReceivePackRequestStateScanOptionalCertPushOptions
+		next = protocolV1ReceivePackRequestStateScanOptionalCertPushOptions
+		if c.EndOfCertPushOptions {
+			next = protocolV1ReceivePackRequestStateScanCertCommand
+		}
+	case "a command in push-cert":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertCommand
+		next = protocolV1ReceivePackRequestStateScanCertCommand
+	case "a signature line":
+		// The parser finds the signature by its armor header.
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertGPGLine ||
+			e.state == protocolV1ReceivePackRequestStateScanCertCommand && bytes.HasPrefix(c.GPGSignaturePart, []byte("-----BEGIN "))
+		next = protocolV1ReceivePackRequestStateScanCertGPGLine
+	case "push-cert-end":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCertGPGLine
+		next = protocolV1ReceivePackRequestStateScanCommand
+	case "a command with capabilities":
+		ok = e.state == protocolV1ReceivePackRequestStateBegin
+		next = protocolV1ReceivePackRequestStateScanCommand
+	case "a command", "the end of commands":
+		ok = e.state == protocolV1ReceivePackRequestStateScanCommand
+		next = protocolV1ReceivePackRequestStateScanCommand
+		if c.EndOfCommands {
+			next = protocolV1ReceivePackRequestStateScanOptionalPushOptions
+		}
+	case "a push option", "the end of push options":
+		ok = e.state == protocolV1ReceivePackRequestStateScanOptionalPushOptions || e.state == protocolV1ReceivePackRequestStateScanPushOptions
+		next = protocolV1ReceivePackRequestStateScanPushOptions
+		if c.EndOfPushOptions {
+			next = protocolV1ReceivePackRequestStateScanPackFile
+		}
+	case "pack data":
+		ok = e.state == protocolV1ReceivePackRequestStateScanOptionalPushOptions || e.state == protocolV1ReceivePackRequestStateScanPackFile
+		next = protocolV1ReceivePackRequestStateScanPackFile
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	if err := e.w.write(kind, c, c.EncodeToPktLine()); err != nil {
+		return err
+	}
+	e.state = next
+	return nil
+}
+
 // ProtocolV1ReceivePackRequest provides an interface for reading a protocol v1
 // git-receive-pack request.
 type ProtocolV1ReceivePackRequest struct {
@@ -104,6 +312,11 @@ type ProtocolV1ReceivePackRequest struct {
 	state   protocolV1ReceivePackRequestState
 	err     error
 	curr    *ProtocolV1ReceivePackRequestChunk
+	// cert is the push certificate being scanned.
+	cert        *PushCertificate
+	pushCert    *PushCertificate
+	pushOptions []string
+	format      ObjectFormat
 }
 
 // NewProtocolV1ReceivePackRequest returns a new ProtocolV1ReceivePackRequest to
@@ -123,11 +336,67 @@ func (r *ProtocolV1ReceivePackRequest) Chunk() *ProtocolV1ReceivePackRequestChun
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV1ReceivePackRequest) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// PushCertificate returns the push certificate after its EndOfPushCert chunk is
+// scanned, and nil otherwise.
+func (r *ProtocolV1ReceivePackRequest) PushCertificate() *PushCertificate {
+	return r.pushCert
+}
+
+// PushOptions returns the push options in the push-options section. It's nil
+// until the section is scanned, and an empty slice if the section has no
+// option. PushOptionsEnv converts them for the hooks.
+func (r *ProtocolV1ReceivePackRequest) PushOptions() []string {
+	if r.state != protocolV1ReceivePackRequestStateScanPackFile {
+		return nil
+	}
+	return r.pushOptions
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *ProtocolV1ReceivePackRequest) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV1ReceivePackRequest) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV1ReceivePackRequest) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ClientToServer as
+// the direction. See TraceFunc.
+func (r *ProtocolV1ReceivePackRequest) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ClientToServer, f)
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1ReceivePackRequest) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV1ReceivePackRequest", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *ProtocolV1ReceivePackRequest) scan() bool {
 	if r.err != nil {
 		return false
 	}
@@ -149,12 +418,17 @@ transition:
 			return false
 		}
 		if bytes.HasPrefix(bp, []byte("shallow ")) {
+			oid := strings.TrimPrefix(strings.TrimSuffix(string(bp), "\n"), "shallow ")
+			if err := r.format.check(oid); err != nil {
+				r.err = err
+				return false
+			}
 			r.curr = &ProtocolV1ReceivePackRequestChunk{
-				ClientShallow: strings.TrimPrefix(strings.TrimSuffix(string(bp), "\n"), "shallow "),
+				ClientShallow: oid,
 			}
 			return true
 		}
-		if bytes.HasPrefix(bp, []byte("push-cert ")) {
+		if bytes.HasPrefix(bp, []byte("push-cert\x00")) {
 			r.state = protocolV1ReceivePackRequestStateScanCert
 			goto transition
 		}
@@ -181,6 +455,9 @@ transition:
 			r.err = SyntaxError("cannot split into three: " + string(zss[0]))
 			return false
 		}
+		if !r.checkCommand(ss) {
+			return false
+		}
 		r.state = protocolV1ReceivePackRequestStateScanCommand
 		r.curr = &ProtocolV1ReceivePackRequestChunk{
 			Capabilities: caps,
@@ -203,6 +480,9 @@ transition:
 				r.err = SyntaxError("cannot split into three: " + string(p))
 				return false
 			}
+			if !r.checkCommand(ss) {
+				return false
+			}
 			r.curr = &ProtocolV1ReceivePackRequestChunk{
 				OldObjectID: ss[0],
 				NewObjectID: ss[1],
@@ -214,39 +494,159 @@ transition:
 			return false
 		}
 	case protocolV1ReceivePackRequestStateScanCert:
+		bp := pkt.(BytesPacket)
+		caps := []string{}
+		if capStr := strings.TrimPrefix(strings.TrimSuffix(string(bp[len("push-cert\x00"):]), "\n"), " "); capStr != "" {
+			caps = strings.Split(capStr, " ")
+		}
+		r.state = protocolV1ReceivePackRequestStateScanCertVersion
+		r.cert = &PushCertificate{}
+		r.curr = &ProtocolV1ReceivePackRequestChunk{
+			StartOfPushCert: true,
+			Capabilities:    caps,
+		}
+		return true
 	case protocolV1ReceivePackRequestStateScanCertVersion:
+		bp, line, ok := r.certLine(pkt)
+		if !ok {
+			return false
+		}
+		if line != "certificate version 0.1" {
+			r.err = SyntaxError("unsupported push-cert version: " + line)
+			return false
+		}
+		r.cert.Payload = append(r.cert.Payload, bp...)
+		r.state = protocolV1ReceivePackRequestStateScanCertPusher
+		r.curr = &ProtocolV1ReceivePackRequestChunk{
+			PushCertHeader: true,
+		}
+		return true
 	case protocolV1ReceivePackRequestStateScanCertPusher:
-	case protocolV1ReceivePackRequestStateScanCertPushee:
-	case protocolV1ReceivePackRequestStateScanCertNonce:
-	case protocolV1ReceivePackRequestStateScanOptionalCertPushOptions:
+		bp, line, ok := r.certLine(pkt)
+		if !ok {
+			return false
+		}
+		if !strings.HasPrefix(line, "pusher ") {
+			r.err = SyntaxError("pusher expected: " + line)
+			return false
+		}
+		r.cert.Payload = append(r.cert.Payload, bp...)
+		r.cert.Pusher = strings.TrimPrefix(line, "pusher ")
+		r.state = protocolV1ReceivePackRequestStateScanCertPushee
+		r.curr = &ProtocolV1ReceivePackRequestChunk{
+			Pusher: r.cert.Pusher,
+		}
+		return true
+	case protocolV1ReceivePackRequestStateScanCertPushee, protocolV1ReceivePackRequestStateScanCertNonce, protocolV1ReceivePackRequestStateScanOptionalCertPushOptions:
+		bp, line, ok := r.certLine(pkt)
+		if !ok {
+			return false
+		}
+		// pushee and nonce are optional, and followed by push-options and
+		// an empty line.
+		r.cert.Payload = append(r.cert.Payload, bp...)
+		switch {
+		case r.state == protocolV1ReceivePackRequestStateScanCertPushee && strings.HasPrefix(line, "pushee "):
+			r.cert.Pushee = strings.TrimPrefix(line, "pushee ")
+			r.state = protocolV1ReceivePackRequestStateScanCertNonce
+			r.curr = &ProtocolV1ReceivePackRequestChunk{
+				Pushee: r.cert.Pushee,
+			}
+		case r.state != protocolV1ReceivePackRequestStateScanOptionalCertPushOptions && strings.HasPrefix(line, "nonce "):
+			r.cert.Nonce = strings.TrimPrefix(line, "nonce ")
+			r.state = protocolV1ReceivePackRequestStateScanOptionalCertPushOptions
+			r.curr = &ProtocolV1ReceivePackRequestChunk{
+				Nonce: r.cert.Nonce,
+			}
+		case strings.HasPrefix(line, "push-option "):
+			opt := strings.TrimPrefix(line, "push-option ")
+			r.cert.PushOptions = append(r.cert.PushOptions, opt)
+			r.state = protocolV1ReceivePackRequestStateScanOptionalCertPushOptions
+			r.curr = &ProtocolV1ReceivePackRequestChunk{
+				CertPushOption: opt,
+			}
+		case line == "":
+			r.state = protocolV1ReceivePackRequestStateScanCertCommand
+			r.curr = &ProtocolV1ReceivePackRequestChunk{
+				EndOfCertPushOptions: true,
+			}
+		default:
+			r.err = SyntaxError("unexpected push-cert header: " + line)
+			return false
+		}
+		return true
 	case protocolV1ReceivePackRequestStateScanCertCommand:
-	case protocolV1ReceivePackRequestStateScanCertGPGLine:
-	case protocolV1ReceivePackRequestStateScanOptionalPushOptions:
-		if _, ok := pkt.(PackFileIndicatorPacket); ok {
-			r.state = protocolV1ReceivePackRequestStateScanPackFile
+		bp, line, ok := r.certLine(pkt)
+		if !ok {
+			return false
+		}
+		if strings.HasPrefix(line, "-----BEGIN ") {
+			r.state = protocolV1ReceivePackRequestStateScanCertGPGLine
 			goto transition
 		}
-		bp, ok := pkt.(BytesPacket)
+		ss := strings.SplitN(line, " ", 3)
+		if len(ss) != 3 {
+			r.err = SyntaxError("cannot split into three: " + line)
+			return false
+		}
+		if !r.checkCommand(ss) {
+			return false
+		}
+		r.cert.Payload = append(r.cert.Payload, bp...)
+		r.curr = &ProtocolV1ReceivePackRequestChunk{
+			OldObjectID: ss[0],
+			NewObjectID: ss[1],
+			RefName:     ss[2],
+			InPushCert:  true,
+		}
+		r.cert.Commands = append(r.cert.Commands, r.curr)
+		return true
+	case protocolV1ReceivePackRequestStateScanCertGPGLine:
+		bp, line, ok := r.certLine(pkt)
 		if !ok {
-			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
 			return false
 		}
-		r.state = protocolV1ReceivePackRequestStateScanPushOptions
+		if line == "push-cert-end" {
+			if r.cert.Signature == nil {
+				r.err = SyntaxError("push-cert without a signature")
+				return false
+			}
+			r.pushCert = r.cert
+			r.state = protocolV1ReceivePackRequestStateScanCommand
+			r.curr = &ProtocolV1ReceivePackRequestChunk{
+				EndOfPushCert: true,
+			}
+			return true
+		}
+		r.cert.Signature = append(r.cert.Signature, bp...)
 		r.curr = &ProtocolV1ReceivePackRequestChunk{
-			PushOption: strings.TrimSuffix(string(bp), "\n"),
+			GPGSignaturePart: bp,
 		}
 		return true
+	case protocolV1ReceivePackRequestStateScanOptionalPushOptions:
+		if _, ok := pkt.(PackFileIndicatorPacket); ok {
+			r.state = protocolV1ReceivePackRequestStateScanPackFile
+			goto transition
+		}
+		r.state = protocolV1ReceivePackRequestStateScanPushOptions
+		goto transition
 	case protocolV1ReceivePackRequestStateScanPushOptions:
 		switch p := pkt.(type) {
 		case FlushPacket:
+			// A client that negotiated push-options can send no option.
 			r.state = protocolV1ReceivePackRequestStateScanPackFile
+			if r.pushOptions == nil {
+				r.pushOptions = []string{}
+			}
 			r.curr = &ProtocolV1ReceivePackRequestChunk{
 				EndOfPushOptions: true,
 			}
 			return true
 		case BytesPacket:
+			opt := strings.TrimSuffix(string(p), "\n")
+			r.pushOptions = append(r.pushOptions, opt)
 			r.curr = &ProtocolV1ReceivePackRequestChunk{
-				PushOption: strings.TrimSuffix(string(p), "\n"),
+				PushOption: opt,
 			}
 			return true
 		default:
@@ -261,3 +661,34 @@ transition:
 	}
 	panic("impossible state")
 }
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV1ReceivePackRequest) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV1ReceivePackRequest) Chunks() iter.Seq2[*ProtocolV1ReceivePackRequestChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+func (r *ProtocolV1ReceivePackRequest) certLine(pkt Packet) (BytesPacket, string, bool) {
+	bp, ok := pkt.(BytesPacket)
+	if !ok {
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet in push-cert: %#v", pkt))
+		return nil, "", false
+	}
+	return bp, strings.TrimSuffix(string(bp), "\n"), true
+}
+
+func (r *ProtocolV1ReceivePackRequest) checkCommand(ss []string) bool {
+	for _, oid := range ss[:2] {
+		if err := r.format.check(oid); err != nil {
+			r.err = err
+			return false
+		}
+	}
+	return true
+}
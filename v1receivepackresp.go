@@ -15,8 +15,10 @@
 package gitprotocolio
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
 )
 
@@ -28,13 +30,31 @@ const (
 	protocolV1ReceivePackResponseStateEnd
 )
 
+func (s protocolV1ReceivePackResponseState) String() string {
+	switch s {
+	case protocolV1ReceivePackResponseStateBegin:
+		return "Begin"
+	case protocolV1ReceivePackResponseStateScanResult:
+		return "ScanResult"
+	case protocolV1ReceivePackResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
 // ProtocolV1ReceivePackResponseChunk is a chunk of a protocol v1
 // git-receive-pack response.
 type ProtocolV1ReceivePackResponseChunk struct {
+	// UnpackStatus is "ok" or the error message. See Unpack for the typed
+	// status.
 	UnpackStatus         string
 	RefUpdateStatus      string
 	RefName              string
 	RefUpdateFailMessage string
+	// RefUpdateOptionKey and RefUpdateOptionValue are a report-status-v2
+	// option line that follows an "ok" line, such as "option old-oid <oid>".
+	RefUpdateOptionKey   string
+	RefUpdateOptionValue string
 	EndOfResponse        bool
 }
 
@@ -49,12 +69,89 @@ func (c *ProtocolV1ReceivePackResponseChunk) EncodeToPktLine() []byte {
 		}
 		return BytesPacket([]byte(fmt.Sprintf("%s %s %s\n", c.RefUpdateStatus, c.RefName, c.RefUpdateFailMessage))).EncodeToPktLine()
 	}
+	if c.RefUpdateOptionKey != "" {
+		if c.RefUpdateOptionValue == "" {
+			return BytesPacket([]byte(fmt.Sprintf("option %s\n", c.RefUpdateOptionKey))).EncodeToPktLine()
+		}
+		return BytesPacket([]byte(fmt.Sprintf("option %s %s\n", c.RefUpdateOptionKey, c.RefUpdateOptionValue))).EncodeToPktLine()
+	}
 	if c.EndOfResponse {
 		return FlushPacket{}.EncodeToPktLine()
 	}
 	panic("impossible chunk")
 }
 
+// kind returns the name of the chunk type for the errors, or "" for an
+// impossible chunk.
+func (c *ProtocolV1ReceivePackResponseChunk) kind() string {
+	switch {
+	case c.UnpackStatus != "":
+		return "unpack"
+	case c.RefUpdateStatus == "ok" && c.RefUpdateFailMessage == "":
+		return "ok"
+	case c.RefUpdateStatus == "ng" && c.RefUpdateFailMessage != "":
+		return "ng"
+	case c.RefUpdateStatus != "":
+		return ""
+	case c.RefUpdateOptionKey != "":
+		return "an option"
+	case c.EndOfResponse:
+		return "the end of the response"
+	}
+	return ""
+}
+
+// ProtocolV1ReceivePackResponseEncoder writes a protocol v1 git-receive-pack
+// response chunk by chunk, in the order ProtocolV1ReceivePackResponse reads.
+type ProtocolV1ReceivePackResponseEncoder struct {
+	w     chunkWriter
+	state protocolV1ReceivePackResponseState
+}
+
+// NewProtocolV1ReceivePackResponseEncoder returns a new
+// ProtocolV1ReceivePackResponseEncoder that writes to w. With side-band-64k,
+// w is the main stream of a sideband writer.
+func NewProtocolV1ReceivePackResponseEncoder(w io.Writer) *ProtocolV1ReceivePackResponseEncoder {
+	return &ProtocolV1ReceivePackResponseEncoder{w: chunkWriter{w: w}}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ServerToClient
+// as the direction. See TraceFunc.
+func (e *ProtocolV1ReceivePackResponseEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ServerToClient, f)
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one. The unpack status comes first, and the
+// report-status-v2 options follow an "ok" line. A "ng" line needs the reason.
+func (e *ProtocolV1ReceivePackResponseEncoder) WriteChunk(c *ProtocolV1ReceivePackResponseChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	var ok bool
+	next := protocolV1ReceivePackResponseStateScanResult
+	kind := c.kind()
+	switch kind {
+	case "unpack":
+		ok = e.state == protocolV1ReceivePackResponseStateBegin
+	case "ok", "ng":
+		ok = e.state == protocolV1ReceivePackResponseStateScanResult
+	case "an option":
+		ok = e.state == protocolV1ReceivePackResponseStateScanResult && (e.w.last == "ok" || e.w.last == "an option")
+	case "the end of the response":
+		ok = e.state == protocolV1ReceivePackResponseStateScanResult
+		next = protocolV1ReceivePackResponseStateEnd
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	if err := e.w.write(kind, c, c.EncodeToPktLine()); err != nil {
+		return err
+	}
+	e.state = next
+	return nil
+}
+
 // ProtocolV1ReceivePackResponse provides an interface for reading a protocol v1
 // git-receive-pack response.
 type ProtocolV1ReceivePackResponse struct {
@@ -70,6 +167,14 @@ func NewProtocolV1ReceivePackResponse(rd io.Reader) *ProtocolV1ReceivePackRespon
 	return &ProtocolV1ReceivePackResponse{scanner: NewPacketScanner(rd)}
 }
 
+// NewProtocolV1ReceivePackResponseFromSideBand returns a new
+// ProtocolV1ReceivePackResponse to read a response sent in the main stream of
+// the sideband, as when side-band-64k is negotiated. The progress messages are
+// written to progress.
+func NewProtocolV1ReceivePackResponseFromSideBand(rd io.Reader, progress io.Writer) *ProtocolV1ReceivePackResponse {
+	return NewProtocolV1ReceivePackResponse(NewSideBandReader(rd, progress))
+}
+
 // Err returns the first non-EOF error that was encountered by the
 // ProtocolV1ReceivePackResponse.
 func (r *ProtocolV1ReceivePackResponse) Err() error {
@@ -81,11 +186,44 @@ func (r *ProtocolV1ReceivePackResponse) Chunk() *ProtocolV1ReceivePackResponseCh
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV1ReceivePackResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV1ReceivePackResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV1ReceivePackResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *ProtocolV1ReceivePackResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1ReceivePackResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV1ReceivePackResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *ProtocolV1ReceivePackResponse) scan() bool {
 	if r.err != nil || r.state == protocolV1ReceivePackResponseStateEnd {
 		return false
 	}
@@ -145,6 +283,20 @@ func (r *ProtocolV1ReceivePackResponse) Scan() bool {
 				}
 				return true
 			}
+			if strings.HasPrefix(s, "option ") {
+				ss := strings.SplitN(s, " ", 3)
+				if ss[1] == "" {
+					r.err = SyntaxError("empty option: " + s)
+					return false
+				}
+				r.curr = &ProtocolV1ReceivePackResponseChunk{
+					RefUpdateOptionKey: ss[1],
+				}
+				if len(ss) == 3 {
+					r.curr.RefUpdateOptionValue = ss[2]
+				}
+				return true
+			}
 			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
 			return false
 		default:
@@ -154,3 +306,15 @@ func (r *ProtocolV1ReceivePackResponse) Scan() bool {
 	}
 	panic("impossible state")
 }
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV1ReceivePackResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV1ReceivePackResponse) Chunks() iter.Seq2[*ProtocolV1ReceivePackResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
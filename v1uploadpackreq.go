@@ -15,8 +15,10 @@
 package gitprotocolio
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"iter"
 	"strconv"
 	"strings"
 )
@@ -35,6 +37,30 @@ const (
 	protocolV1UploadPackRequestStateEnd
 )
 
+func (s protocolV1UploadPackRequestState) String() string {
+	switch s {
+	case protocolV1UploadPackRequestStateBegin:
+		return "Begin"
+	case protocolV1UploadPackRequestStateScanWants:
+		return "ScanWants"
+	case protocolV1UploadPackRequestStateScanShallows:
+		return "ScanShallows"
+	case protocolV1UploadPackRequestStateScanDepth:
+		return "ScanDepth"
+	case protocolV1UploadPackRequestStateScanFilter:
+		return "ScanFilter"
+	case protocolV1UploadPackRequestStateBeginNegotiationOrDoneOrEnd:
+		return "BeginNegotiationOrDoneOrEnd"
+	case protocolV1UploadPackRequestStateNegotiation:
+		return "Negotiation"
+	case protocolV1UploadPackRequestStateScanHaves:
+		return "ScanHaves"
+	case protocolV1UploadPackRequestStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
 // ProtocolV1UploadPackRequestChunk is a chunk of a protocol v1 git-upload-pack
 // request.
 type ProtocolV1UploadPackRequestChunk struct {
@@ -43,8 +69,13 @@ type ProtocolV1UploadPackRequestChunk struct {
 	ShallowObjectID string
 	DeepenDepth     int
 	// Not documented, but seconds from UNIX epoch.
-	DeepenSince       uint64
-	DeepenNotRef      string
+	DeepenSince uint64
+	// DeepenNotRef is a ref whose history is excluded. A request can have
+	// multiple deepen-not lines, and a deepen-since line with them. A
+	// deepen-relative request is the "deepen-relative" capability with a
+	// deepen line.
+	DeepenNotRef string
+	// FilterSpec is a filter spec such as "blob:none". See Filter.
 	FilterSpec        string
 	HaveObjectID      string
 	EndOneRound       bool
@@ -86,6 +117,99 @@ func (c *ProtocolV1UploadPackRequestChunk) EncodeToPktLine() []byte {
 	panic("impossible chunk")
 }
 
+// kind returns the name of the chunk type for the errors, or "" for an
+// impossible chunk.
+func (c *ProtocolV1UploadPackRequestChunk) kind() string {
+	switch {
+	case len(c.Capabilities) > 0 && c.WantObjectID != "":
+		return "want with capabilities"
+	case c.WantObjectID != "":
+		return "want"
+	case c.ShallowObjectID != "":
+		return "shallow"
+	case c.DeepenDepth != 0:
+		return "deepen"
+	case c.DeepenSince != 0:
+		return "deepen-since"
+	case c.DeepenNotRef != "":
+		return "deepen-not"
+	case c.FilterSpec != "":
+		return "filter"
+	case c.HaveObjectID != "":
+		return "have"
+	case c.EndOneRound:
+		return "flush"
+	case c.NoMoreNegotiation:
+		return "done"
+	}
+	return ""
+}
+
+// ProtocolV1UploadPackRequestEncoder writes a protocol v1 git-upload-pack
+// request chunk by chunk, in the order ProtocolV1UploadPackRequest reads.
+type ProtocolV1UploadPackRequestEncoder struct {
+	w     chunkWriter
+	state protocolV1UploadPackRequestState
+}
+
+// NewProtocolV1UploadPackRequestEncoder returns a new
+// ProtocolV1UploadPackRequestEncoder that writes to w.
+func NewProtocolV1UploadPackRequestEncoder(w io.Writer) *ProtocolV1UploadPackRequestEncoder {
+	return &ProtocolV1UploadPackRequestEncoder{w: chunkWriter{w: w}}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ClientToServer
+// as the direction. See TraceFunc.
+func (e *ProtocolV1UploadPackRequestEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ClientToServer, f)
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one, such as a want after a have. Only the
+// first want can have the capabilities.
+func (e *ProtocolV1UploadPackRequestEncoder) WriteChunk(c *ProtocolV1UploadPackRequestChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	var ok bool
+	var next protocolV1UploadPackRequestState
+	kind := c.kind()
+	switch kind {
+	case "want with capabilities":
+		ok = e.state == protocolV1UploadPackRequestStateBegin
+		next = protocolV1UploadPackRequestStateScanWants
+	case "want":
+		ok = e.state <= protocolV1UploadPackRequestStateScanWants
+		next = protocolV1UploadPackRequestStateScanWants
+	case "shallow":
+		ok = e.state == protocolV1UploadPackRequestStateScanWants || e.state == protocolV1UploadPackRequestStateScanShallows
+		next = protocolV1UploadPackRequestStateScanShallows
+	case "deepen", "deepen-since", "deepen-not":
+		ok = e.state >= protocolV1UploadPackRequestStateScanWants && e.state <= protocolV1UploadPackRequestStateScanDepth
+		next = protocolV1UploadPackRequestStateScanDepth
+	case "filter":
+		ok = e.state >= protocolV1UploadPackRequestStateScanWants && e.state <= protocolV1UploadPackRequestStateScanFilter
+		next = protocolV1UploadPackRequestStateNegotiation
+	case "have":
+		ok = e.state == protocolV1UploadPackRequestStateBeginNegotiationOrDoneOrEnd || e.state == protocolV1UploadPackRequestStateNegotiation
+		next = protocolV1UploadPackRequestStateNegotiation
+	case "flush":
+		ok = e.state != protocolV1UploadPackRequestStateBegin && e.state != protocolV1UploadPackRequestStateEnd
+		next = protocolV1UploadPackRequestStateBeginNegotiationOrDoneOrEnd
+	case "done":
+		ok = e.state == protocolV1UploadPackRequestStateBeginNegotiationOrDoneOrEnd || e.state == protocolV1UploadPackRequestStateNegotiation
+		next = protocolV1UploadPackRequestStateEnd
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	if err := e.w.write(kind, c, c.EncodeToPktLine()); err != nil {
+		return err
+	}
+	e.state = next
+	return nil
+}
+
 // ProtocolV1UploadPackRequest provides an interface for reading a protocol v1
 // git-upload-pack request.
 type ProtocolV1UploadPackRequest struct {
@@ -93,6 +217,8 @@ type ProtocolV1UploadPackRequest struct {
 	state   protocolV1UploadPackRequestState
 	err     error
 	curr    *ProtocolV1UploadPackRequestChunk
+	format  ObjectFormat
+	policy  *UploadPackPolicy
 }
 
 // NewProtocolV1UploadPackRequest returns a new ProtocolV1UploadPackRequest to
@@ -112,11 +238,75 @@ func (r *ProtocolV1UploadPackRequest) Chunk() *ProtocolV1UploadPackRequestChunk
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV1UploadPackRequest) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *ProtocolV1UploadPackRequest) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetPolicy makes the parser stop with an ErrorPacket when the request
+// violates the policy.
+func (r *ProtocolV1UploadPackRequest) SetPolicy(p *UploadPackPolicy) {
+	r.policy = p
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV1UploadPackRequest) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV1UploadPackRequest) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ClientToServer as
+// the direction. See TraceFunc.
+func (r *ProtocolV1UploadPackRequest) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ClientToServer, f)
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1UploadPackRequest) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV1UploadPackRequest", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	if r.policy != nil {
+		if err := r.policy.CheckProtocolV1UploadPackRequestChunk(r.curr); err != nil {
+			r.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV1UploadPackRequest) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV1UploadPackRequest) Chunks() iter.Seq2[*ProtocolV1UploadPackRequestChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+func (r *ProtocolV1UploadPackRequest) scan() bool {
 	if r.err != nil || r.state == protocolV1UploadPackRequestStateEnd {
 		return false
 	}
@@ -135,20 +325,23 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
 			return false
 		}
-		ss := strings.SplitN(string(bp), " ", 3)
+		ss := strings.SplitN(strings.TrimSuffix(string(bp), "\n"), " ", 3)
 		if len(ss) < 2 {
 			r.err = SyntaxError("cannot split wants: " + string(bp))
 			return false
 		}
 		caps := []string{}
-		if len(ss) == 3 {
-			if capStr := strings.TrimSuffix(ss[2], "\n"); capStr != "" {
-				// This is to avoid strings.Split("", " ") => []string{""}.
-				caps = strings.Split(capStr, " ")
-			}
+		if len(ss) == 3 && ss[2] != "" {
+			// This is to avoid strings.Split("", " ") => []string{""}.
+			caps = strings.Split(ss[2], " ")
 		}
 		if ss[0] != "want" {
 			r.err = SyntaxError("the first packet is not want: " + string(bp))
+			return false
+		}
+		if err := r.format.check(ss[1]); err != nil {
+			r.err = err
+			return false
 		}
 		r.state = protocolV1UploadPackRequestStateScanWants
 		r.curr = &ProtocolV1UploadPackRequestChunk{
@@ -194,6 +387,10 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 	switch r.state {
 	case protocolV1UploadPackRequestStateScanWants:
 		if ss[0] == "want" {
+			if err := r.format.check(ss[1]); err != nil {
+				r.err = err
+				return false
+			}
 			r.curr = &ProtocolV1UploadPackRequestChunk{
 				WantObjectID: ss[1],
 			}
@@ -202,6 +399,10 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 		fallthrough
 	case protocolV1UploadPackRequestStateScanShallows:
 		if ss[0] == "shallow" {
+			if err := r.format.check(ss[1]); err != nil {
+				r.err = err
+				return false
+			}
 			r.state = protocolV1UploadPackRequestStateScanShallows
 			r.curr = &ProtocolV1UploadPackRequestChunk{
 				ShallowObjectID: ss[1],
@@ -216,7 +417,11 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 				r.err = SyntaxError("cannot parse depth")
 				return false
 			}
-			r.state = protocolV1UploadPackRequestStateScanFilter
+			if depth <= 0 {
+				r.err = SyntaxError("invalid deepen: " + ss[1])
+				return false
+			}
+			r.state = protocolV1UploadPackRequestStateScanDepth
 			r.curr = &ProtocolV1UploadPackRequestChunk{
 				DeepenDepth: int(depth),
 			}
@@ -225,17 +430,17 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 		if ss[0] == "deepen-since" {
 			since, err := strconv.ParseUint(ss[1], 10, 64)
 			if err != nil {
-				r.err = SyntaxError("cannot parse depth")
+				r.err = SyntaxError("cannot parse deepen-since")
 				return false
 			}
-			r.state = protocolV1UploadPackRequestStateScanFilter
+			r.state = protocolV1UploadPackRequestStateScanDepth
 			r.curr = &ProtocolV1UploadPackRequestChunk{
 				DeepenSince: since,
 			}
 			return true
 		}
 		if ss[0] == "deepen-not" {
-			r.state = protocolV1UploadPackRequestStateScanFilter
+			r.state = protocolV1UploadPackRequestStateScanDepth
 			r.curr = &ProtocolV1UploadPackRequestChunk{
 				DeepenNotRef: ss[1],
 			}
@@ -247,6 +452,10 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
 			return false
 		}
+		if _, err := ParseFilterSpec(ss[1]); err != nil {
+			r.err = err
+			return false
+		}
 		r.state = protocolV1UploadPackRequestStateNegotiation
 		r.curr = &ProtocolV1UploadPackRequestChunk{
 			FilterSpec: ss[1],
@@ -257,6 +466,10 @@ func (r *ProtocolV1UploadPackRequest) Scan() bool {
 			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
 			return false
 		}
+		if err := r.format.check(ss[1]); err != nil {
+			r.err = err
+			return false
+		}
 		r.state = protocolV1UploadPackRequestStateNegotiation
 		r.curr = &ProtocolV1UploadPackRequestChunk{
 			HaveObjectID: ss[1],
@@ -16,8 +16,10 @@ package gitprotocolio
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
 )
 
@@ -29,10 +31,36 @@ const (
 	protocolV1UploadPackResponseStateScanUnshallows
 	protocolV1UploadPackResponseStateBeginAcknowledgements
 	protocolV1UploadPackResponseStateScanAcknowledgements
+	protocolV1UploadPackResponseStateEndOfRound
 	protocolV1UploadPackResponseStateScanPacks
+	protocolV1UploadPackResponseStateScanRawPack
 	protocolV1UploadPackResponseStateEnd
 )
 
+func (s protocolV1UploadPackResponseState) String() string {
+	switch s {
+	case protocolV1UploadPackResponseStateBegin:
+		return "Begin"
+	case protocolV1UploadPackResponseStateScanShallows:
+		return "ScanShallows"
+	case protocolV1UploadPackResponseStateScanUnshallows:
+		return "ScanUnshallows"
+	case protocolV1UploadPackResponseStateBeginAcknowledgements:
+		return "BeginAcknowledgements"
+	case protocolV1UploadPackResponseStateScanAcknowledgements:
+		return "ScanAcknowledgements"
+	case protocolV1UploadPackResponseStateEndOfRound:
+		return "EndOfRound"
+	case protocolV1UploadPackResponseStateScanPacks:
+		return "ScanPacks"
+	case protocolV1UploadPackResponseStateScanRawPack:
+		return "ScanRawPack"
+	case protocolV1UploadPackResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
 // ProtocolV1UploadPackResponseChunk is a chunk of a protocol v1 git-upload-pack
 // response.
 type ProtocolV1UploadPackResponseChunk struct {
@@ -42,8 +70,16 @@ type ProtocolV1UploadPackResponseChunk struct {
 	AckObjectID       string
 	AckDetail         string
 	Nak               bool
-	PackStream        []byte
-	EndOfRequest      bool
+	// PackStream is a packet of the pack data. With side-band or
+	// side-band-64k, it's a sideband packet.
+	PackStream []byte
+	// PackFile is a part of the pack data sent without the sideband, as is
+	// and not in pkt-lines. The response ends at the end of the input.
+	PackFile []byte
+	// Keepalive is an empty sideband packet that the server sends while
+	// it's busy. It has no data.
+	Keepalive    bool
+	EndOfRequest bool
 }
 
 // EncodeToPktLine serializes the chunk.
@@ -69,19 +105,139 @@ func (c *ProtocolV1UploadPackResponseChunk) EncodeToPktLine() []byte {
 	if len(c.PackStream) != 0 {
 		return BytesPacket(c.PackStream).EncodeToPktLine()
 	}
+	if len(c.PackFile) != 0 {
+		return c.PackFile
+	}
+	if c.Keepalive {
+		return []byte(KeepalivePkt)
+	}
 	if c.EndOfRequest {
 		return FlushPacket{}.EncodeToPktLine()
 	}
 	panic("impossible chunk")
 }
 
+// kind returns the name of the chunk type for the errors, or "" for an
+// impossible chunk.
+func (c *ProtocolV1UploadPackResponseChunk) kind() string {
+	switch {
+	case c.ShallowObjectID != "":
+		return "shallow"
+	case c.UnshallowObjectID != "":
+		return "unshallow"
+	case c.EndOfShallows:
+		return "the end of shallows"
+	case c.AckObjectID != "":
+		return "ACK"
+	case c.Nak:
+		return "NAK"
+	case len(c.PackStream) != 0:
+		return "a pack stream packet"
+	case len(c.PackFile) != 0:
+		return "pack file data"
+	case c.Keepalive:
+		return "a keepalive"
+	case c.EndOfRequest:
+		return "the end of the response"
+	}
+	return ""
+}
+
+// ProtocolV1UploadPackResponseEncoder writes a protocol v1 git-upload-pack
+// response chunk by chunk, in the order ProtocolV1UploadPackResponse reads. A
+// chunk after the end of a response starts the next response.
+type ProtocolV1UploadPackResponseEncoder struct {
+	w     chunkWriter
+	state protocolV1UploadPackResponseState
+}
+
+// NewProtocolV1UploadPackResponseEncoder returns a new
+// ProtocolV1UploadPackResponseEncoder that writes to w.
+func NewProtocolV1UploadPackResponseEncoder(w io.Writer) *ProtocolV1UploadPackResponseEncoder {
+	return &ProtocolV1UploadPackResponseEncoder{w: chunkWriter{w: w}}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ServerToClient
+// as the direction. See TraceFunc.
+func (e *ProtocolV1UploadPackResponseEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ServerToClient, f)
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one, such as a shallow line after a NAK.
+func (e *ProtocolV1UploadPackResponseEncoder) WriteChunk(c *ProtocolV1UploadPackResponseChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	state := e.state
+	if state == protocolV1UploadPackResponseStateEnd {
+		state = protocolV1UploadPackResponseStateBegin
+	}
+	var ok bool
+	var next protocolV1UploadPackResponseState
+	kind := c.kind()
+	switch kind {
+	case "shallow":
+		ok = state <= protocolV1UploadPackResponseStateScanShallows
+		next = protocolV1UploadPackResponseStateScanShallows
+	case "unshallow":
+		ok = state <= protocolV1UploadPackResponseStateScanUnshallows
+		next = protocolV1UploadPackResponseStateScanUnshallows
+	case "the end of shallows":
+		ok = state <= protocolV1UploadPackResponseStateScanUnshallows
+		next = protocolV1UploadPackResponseStateBeginAcknowledgements
+	case "ACK", "NAK":
+		ok = state <= protocolV1UploadPackResponseStateEndOfRound
+		next = protocolV1UploadPackResponseStateScanAcknowledgements
+		if c.Nak {
+			next = protocolV1UploadPackResponseStateEndOfRound
+		}
+	case "a pack stream packet", "a keepalive":
+		ok = state != protocolV1UploadPackResponseStateBegin && state != protocolV1UploadPackResponseStateScanRawPack
+		next = protocolV1UploadPackResponseStateScanPacks
+	case "pack file data":
+		ok = state != protocolV1UploadPackResponseStateBegin && state != protocolV1UploadPackResponseStateScanPacks
+		next = protocolV1UploadPackResponseStateScanRawPack
+	case "the end of the response":
+		// The flush is the end of shallows until the shallows end, and
+		// a raw pack ends at the end of the stream.
+		ok = state >= protocolV1UploadPackResponseStateBeginAcknowledgements && state != protocolV1UploadPackResponseStateScanRawPack
+		next = protocolV1UploadPackResponseStateEnd
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	if err := e.w.write(kind, c, c.EncodeToPktLine()); err != nil {
+		return err
+	}
+	e.state = next
+	return nil
+}
+
 // ProtocolV1UploadPackResponse provides an interface for reading a protocol v1
 // git-upload-pack response.
+//
+// With multi_ack and multi_ack_detailed, the ACK lines and the NAKs of all the
+// negotiation rounds are parsed as they come. A response to a stateless-RPC
+// request without done can end after a NAK.
+//
+// Without multi_ack, a stateless-RPC response to a request without done ends
+// after the first ACK, as the server exits instead of waiting for more haves.
+// Use SetStatelessRPC to parse the responses of smart HTTP. With no-done, the
+// pack follows "ACK <oid> ready", a NAK, and a final ACK in the response to a
+// request without done.
+//
+// The input can have multiple responses back to back. Scan returns false at
+// the end of each response, and ResponseComplete reports it. Call NextResponse
+// to read the next one.
 type ProtocolV1UploadPackResponse struct {
-	scanner *PacketScanner
-	state   protocolV1UploadPackResponseState
-	err     error
-	curr    *ProtocolV1UploadPackResponseChunk
+	scanner   *PacketScanner
+	state     protocolV1UploadPackResponseState
+	err       error
+	curr      *ProtocolV1UploadPackResponseChunk
+	responses int
+	format    ObjectFormat
+	stateless bool
 }
 
 // NewProtocolV1UploadPackResponse returns a new ProtocolV1UploadPackResponse to
@@ -101,17 +257,95 @@ func (r *ProtocolV1UploadPackResponse) Chunk() *ProtocolV1UploadPackResponseChun
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV1UploadPackResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *ProtocolV1UploadPackResponse) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV1UploadPackResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV1UploadPackResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *ProtocolV1UploadPackResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
+// SetStatelessRPC sets whether the response is of the stateless-RPC mode used
+// by smart HTTP, where every request gets its own response. In this mode, the
+// response can end after any acknowledgement, and ResponseComplete returns
+// true when it does.
+func (r *ProtocolV1UploadPackResponse) SetStatelessRPC(b bool) {
+	r.stateless = b
+}
+
+// ResponseComplete returns true if the current response has been read to the
+// end. More responses may follow.
+func (r *ProtocolV1UploadPackResponse) ResponseComplete() bool {
+	return r.state == protocolV1UploadPackResponseStateEnd
+}
+
+// NextResponse starts reading the next response after the current one is
+// complete. It returns false if the current response is not complete or an
+// error occurred. An EOF before the next response is not an error.
+func (r *ProtocolV1UploadPackResponse) NextResponse() bool {
+	if r.err != nil || r.state != protocolV1UploadPackResponseStateEnd {
+		return false
+	}
+	r.state = protocolV1UploadPackResponseStateBegin
+	r.curr = nil
+	r.responses++
+	return true
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV1UploadPackResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV1UploadPackResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *ProtocolV1UploadPackResponse) scan() bool {
 	if r.err != nil || r.state == protocolV1UploadPackResponseStateEnd {
 		return false
 	}
 	if !r.scanner.Scan() {
 		r.err = r.scanner.Err()
-		if r.err == nil && r.state != protocolV1UploadPackResponseStateBeginAcknowledgements {
+		if r.err == nil && r.state == protocolV1UploadPackResponseStateBegin && r.responses != 0 {
+			return false
+		}
+		if r.err == nil && r.state == protocolV1UploadPackResponseStateScanRawPack {
+			r.state = protocolV1UploadPackResponseStateEnd
+			return false
+		}
+		if r.err == nil && r.stateless && r.state >= protocolV1UploadPackResponseStateBeginAcknowledgements && r.state <= protocolV1UploadPackResponseStateEndOfRound {
+			r.state = protocolV1UploadPackResponseStateEnd
+			return false
+		}
+		if r.err == nil && r.state != protocolV1UploadPackResponseStateBeginAcknowledgements && r.state != protocolV1UploadPackResponseStateEndOfRound {
 			r.err = SyntaxError("early EOF")
 		}
 		return false
@@ -127,6 +361,10 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 					r.err = SyntaxError("cannot split shallow: " + string(bp))
 					return false
 				}
+				if err := r.format.check(ss[1]); err != nil {
+					r.err = err
+					return false
+				}
 				r.state = protocolV1UploadPackResponseStateScanShallows
 				r.curr = &ProtocolV1UploadPackResponseChunk{
 					ShallowObjectID: ss[1],
@@ -143,6 +381,10 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 					r.err = SyntaxError("cannot split unshallow: " + string(bp))
 					return false
 				}
+				if err := r.format.check(ss[1]); err != nil {
+					r.err = err
+					return false
+				}
 				r.state = protocolV1UploadPackResponseStateScanUnshallows
 				r.curr = &ProtocolV1UploadPackResponseChunk{
 					UnshallowObjectID: ss[1],
@@ -158,7 +400,7 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 			return true
 		}
 		fallthrough
-	case protocolV1UploadPackResponseStateBeginAcknowledgements, protocolV1UploadPackResponseStateScanAcknowledgements:
+	case protocolV1UploadPackResponseStateBeginAcknowledgements, protocolV1UploadPackResponseStateScanAcknowledgements, protocolV1UploadPackResponseStateEndOfRound:
 		if bp, ok := pkt.(BytesPacket); ok {
 			if bytes.HasPrefix(bp, []byte("ACK ")) {
 				ss := strings.SplitN(strings.TrimSuffix(string(bp), "\n"), " ", 3)
@@ -166,6 +408,10 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 					r.err = SyntaxError("cannot split ACK: " + string(bp))
 					return false
 				}
+				if err := r.format.check(ss[1]); err != nil {
+					r.err = err
+					return false
+				}
 				detail := ""
 				if len(ss) == 3 {
 					detail = ss[2]
@@ -178,7 +424,9 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 				return true
 			}
 			if bytes.Equal(bp, []byte("NAK\n")) {
-				r.state = protocolV1UploadPackResponseStateScanPacks
+				// With multi_ack and multi_ack_detailed, a NAK ends a
+				// negotiation round, and more ACKs can follow.
+				r.state = protocolV1UploadPackResponseStateEndOfRound
 				r.curr = &ProtocolV1UploadPackResponseChunk{
 					Nak: true,
 				}
@@ -190,8 +438,14 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 			return false
 		}
 		fallthrough
-	case protocolV1UploadPackResponseStateScanPacks:
+	case protocolV1UploadPackResponseStateScanPacks, protocolV1UploadPackResponseStateScanRawPack:
 		switch p := pkt.(type) {
+		case PackFileIndicatorPacket, PackFilePacket:
+			r.state = protocolV1UploadPackResponseStateScanRawPack
+			r.curr = &ProtocolV1UploadPackResponseChunk{
+				PackFile: p.EncodeToPktLine(),
+			}
+			return true
 		case FlushPacket:
 			r.state = protocolV1UploadPackResponseStateEnd
 			r.curr = &ProtocolV1UploadPackResponseChunk{
@@ -200,6 +454,12 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 			return true
 		case BytesPacket:
 			r.state = protocolV1UploadPackResponseStateScanPacks
+			if isKeepalive(p) {
+				r.curr = &ProtocolV1UploadPackResponseChunk{
+					Keepalive: true,
+				}
+				return true
+			}
 			r.curr = &ProtocolV1UploadPackResponseChunk{
 				PackStream: p,
 			}
@@ -211,3 +471,90 @@ func (r *ProtocolV1UploadPackResponse) Scan() bool {
 	}
 	panic("impossible state")
 }
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV1UploadPackResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV1UploadPackResponse) Chunks() iter.Seq2[*ProtocolV1UploadPackResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+// PackReader returns a reader of the pack data in the rest of the response. It
+// reads the response with Scan, skipping the chunks before the pack. If the
+// current chunk is a part of the pack, its data is read first, so it can be
+// called when Scan returns the first pack chunk.
+//
+// The sideband packets are demultiplexed. The report stream is written to
+// progress unless it's nil, and the error stream makes Read return a
+// RemoteError. The reader returns io.EOF at the end of the response.
+func (r *ProtocolV1UploadPackResponse) PackReader(progress io.Writer) io.Reader {
+	return &uploadPackReader{r: r, progress: progress}
+}
+
+type uploadPackReader struct {
+	r        *ProtocolV1UploadPackResponse
+	progress io.Writer
+	started  bool
+	buf      []byte
+	err      error
+}
+
+func (pr *uploadPackReader) Read(p []byte) (int, error) {
+	for len(pr.buf) == 0 {
+		if pr.err != nil {
+			return 0, pr.err
+		}
+		pr.err = pr.next()
+	}
+	n := copy(p, pr.buf)
+	pr.buf = pr.buf[n:]
+	return n, nil
+}
+
+func (pr *uploadPackReader) next() error {
+	if !pr.started {
+		pr.started = true
+		if c := pr.r.Chunk(); c != nil && (len(c.PackStream) != 0 || len(c.PackFile) != 0) {
+			return pr.take(c)
+		}
+	}
+	for pr.r.Scan() {
+		c := pr.r.Chunk()
+		if c.EndOfRequest {
+			return io.EOF
+		}
+		if len(c.PackStream) != 0 || len(c.PackFile) != 0 {
+			return pr.take(c)
+		}
+	}
+	if err := pr.r.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (pr *uploadPackReader) take(c *ProtocolV1UploadPackResponseChunk) error {
+	if len(c.PackFile) != 0 {
+		pr.buf = c.PackFile
+		return nil
+	}
+	switch sp := ParseSideBandPacket(BytesPacket(c.PackStream)).(type) {
+	case SideBandMainPacket:
+		pr.buf = sp
+		return nil
+	case SideBandReportPacket:
+		if pr.progress != nil {
+			_, err := pr.progress.Write(sp)
+			return err
+		}
+		return nil
+	case SideBandErrorPacket:
+		return newRemoteError(sp)
+	}
+	return SyntaxError(fmt.Sprintf("not a sideband packet: %q", c.PackStream))
+}
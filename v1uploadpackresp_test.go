@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProtocolV1UploadPackResponseBackToBack(t *testing.T) {
+	var b bytes.Buffer
+	for i := 0; i < 2; i++ {
+		for _, c := range []*ProtocolV1UploadPackResponseChunk{
+			{Nak: true},
+			{PackStream: []byte("\x01PACK")},
+			{EndOfRequest: true},
+		} {
+			b.Write(c.EncodeToPktLine())
+		}
+	}
+
+	r := NewProtocolV1UploadPackResponse(&b)
+	for i := 0; i < 2; i++ {
+		if i != 0 && !r.NextResponse() {
+			t.Fatalf("response %d: NextResponse returned false: %v", i, r.Err())
+		}
+		n := 0
+		for r.Scan() {
+			n++
+		}
+		if r.Err() != nil || !r.ResponseComplete() || n != 3 {
+			t.Errorf("response %d: got %d chunks, complete %v, err %v", i, n, r.ResponseComplete(), r.Err())
+		}
+	}
+	// An EOF between responses is not an error.
+	if !r.NextResponse() {
+		t.Fatal(r.Err())
+	}
+	if r.Scan() || r.Err() != nil {
+		t.Errorf("got a chunk or %v at the end of the input", r.Err())
+	}
+}
+
+func TestProtocolV1UploadPackResponseNextResponseErrors(t *testing.T) {
+	r := NewProtocolV1UploadPackResponse(strings.NewReader(pktLines("NAK\n", "\x01PACK")))
+	r.Scan()
+	if r.NextResponse() {
+		t.Error("NextResponse returned true in the middle of a response")
+	}
+	for r.Scan() {
+	}
+	if r.Err() == nil {
+		t.Error("got no error for a response cut in the middle")
+	}
+	if r.NextResponse() {
+		t.Error("NextResponse returned true after an error")
+	}
+}
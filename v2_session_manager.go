@@ -0,0 +1,345 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"iter"
+	"sort"
+	"sync"
+)
+
+// V2SessionState is the state of a V2Session.
+type V2SessionState int
+
+const (
+	// V2SessionStateSending means the request is being sent.
+	V2SessionStateSending V2SessionState = iota
+	// V2SessionStateReceiving means the response is being read.
+	V2SessionStateReceiving
+	// V2SessionStateDone means the response was read to the end and the
+	// connection went back to the pool.
+	V2SessionStateDone
+	// V2SessionStateFailed means the exchange failed or was abandoned, and
+	// the connection was closed.
+	V2SessionStateFailed
+)
+
+func (s V2SessionState) String() string {
+	switch s {
+	case V2SessionStateSending:
+		return "sending"
+	case V2SessionStateReceiving:
+		return "receiving"
+	case V2SessionStateDone:
+		return "done"
+	case V2SessionStateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// ErrV2SessionManagerClosed is returned by V2SessionManager after Close.
+var ErrV2SessionManagerClosed = errors.New("gitprotocolio: session manager closed")
+
+// V2SessionInfo is a snapshot of an active V2Session.
+type V2SessionInfo struct {
+	ID      uint64
+	Command string
+	State   V2SessionState
+}
+
+// V2SessionManager runs protocol v2 command exchanges over a pool of stateful
+// upstream connections, such as ssh or git:// connections. A proxy can fan many
+// client requests into a few upstream connections. It's safe for concurrent
+// use.
+//
+// An upstream connection starts with the capability advertisement, and then
+// runs one command after another. A connection is reused only after the
+// response of the previous command was read to the end.
+type V2SessionManager struct {
+	dial     func(context.Context) (io.ReadWriteCloser, error)
+	slots    chan struct{}
+	m        sync.Mutex
+	idle     []*v2UpstreamConn
+	caps     []string
+	active   map[uint64]*V2Session
+	nextID   uint64
+	isClosed bool
+}
+
+type v2UpstreamConn struct {
+	rwc  io.ReadWriteCloser
+	resp *ProtocolV2Response
+}
+
+// NewV2SessionManager returns a new V2SessionManager that opens upstream
+// connections with dial, up to maxConns at the same time.
+func NewV2SessionManager(dial func(context.Context) (io.ReadWriteCloser, error), maxConns int) *V2SessionManager {
+	if maxConns <= 0 {
+		maxConns = 1
+	}
+	return &V2SessionManager{
+		dial:   dial,
+		slots:  make(chan struct{}, maxConns),
+		active: map[uint64]*V2Session{},
+	}
+}
+
+// Capabilities returns the capabilities advertised by the upstream. It opens a
+// connection if none has been opened yet.
+func (m *V2SessionManager) Capabilities(ctx context.Context) ([]string, error) {
+	m.m.Lock()
+	caps := m.caps
+	m.m.Unlock()
+	if caps != nil {
+		return caps, nil
+	}
+	c, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.release(c)
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.caps, nil
+}
+
+func (m *V2SessionManager) acquire(ctx context.Context) (*v2UpstreamConn, error) {
+	select {
+	case m.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	m.m.Lock()
+	if m.isClosed {
+		m.m.Unlock()
+		<-m.slots
+		return nil, ErrV2SessionManagerClosed
+	}
+	if n := len(m.idle); n != 0 {
+		c := m.idle[n-1]
+		m.idle = m.idle[:n-1]
+		m.m.Unlock()
+		return c, nil
+	}
+	m.m.Unlock()
+
+	rwc, err := m.dial(ctx)
+	if err != nil {
+		<-m.slots
+		return nil, err
+	}
+	d, err := ReadProtocolDiscovery(rwc)
+	if err == nil && d.ProtocolVersion != 2 {
+		err = SyntaxError("upstream doesn't speak protocol v2")
+	}
+	if err != nil {
+		rwc.Close()
+		<-m.slots
+		return nil, err
+	}
+	m.m.Lock()
+	if m.caps == nil {
+		m.caps = d.Capabilities
+	}
+	m.m.Unlock()
+	return &v2UpstreamConn{rwc: rwc, resp: NewProtocolV2Response(rwc)}, nil
+}
+
+func (m *V2SessionManager) release(c *v2UpstreamConn) {
+	m.m.Lock()
+	if m.isClosed {
+		m.m.Unlock()
+		c.rwc.Close()
+	} else {
+		m.idle = append(m.idle, c)
+		m.m.Unlock()
+	}
+	<-m.slots
+}
+
+func (m *V2SessionManager) discard(c *v2UpstreamConn) {
+	c.rwc.Close()
+	<-m.slots
+}
+
+// Start sends a command request to an upstream connection and returns the
+// session to read the response from. The request must be a whole command,
+// from Command to EndArgument. It blocks while all the connections are in use.
+func (m *V2SessionManager) Start(ctx context.Context, request []*ProtocolV2RequestChunk) (*V2Session, error) {
+	if len(request) == 0 || request[0].Command == "" || !request[len(request)-1].EndArgument {
+		return nil, SyntaxError("not a complete command request")
+	}
+	var buf bytes.Buffer
+	for _, c := range request {
+		buf.Write(c.EncodeToPktLine())
+	}
+
+	c, err := m.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.m.Lock()
+	m.nextID++
+	s := &V2Session{
+		m:       m,
+		conn:    c,
+		id:      m.nextID,
+		command: request[0].Command,
+		state:   V2SessionStateSending,
+	}
+	m.active[s.id] = s
+	m.m.Unlock()
+
+	if _, err := c.rwc.Write(buf.Bytes()); err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	m.m.Lock()
+	s.state = V2SessionStateReceiving
+	m.m.Unlock()
+	return s, nil
+}
+
+// Sessions returns the active sessions sorted by the ID.
+func (m *V2SessionManager) Sessions() []V2SessionInfo {
+	m.m.Lock()
+	defer m.m.Unlock()
+	var ret []V2SessionInfo
+	for _, s := range m.active {
+		ret = append(ret, V2SessionInfo{ID: s.id, Command: s.command, State: s.state})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// Close closes the idle connections. The connections used by the active
+// sessions are closed when the sessions end.
+func (m *V2SessionManager) Close() error {
+	m.m.Lock()
+	m.isClosed = true
+	idle := m.idle
+	m.idle = nil
+	m.m.Unlock()
+	var err error
+	for _, c := range idle {
+		if cerr := c.rwc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// V2Session is one command exchange over an upstream connection. The usage of
+// Scan, Chunk, and Err is same as ProtocolV2Response, except that the scan
+// stops at the end of this command's response.
+type V2Session struct {
+	m       *V2SessionManager
+	conn    *v2UpstreamConn
+	id      uint64
+	command string
+	state   V2SessionState
+	err     error
+	curr    *ProtocolV2ResponseChunk
+}
+
+// ID returns the ID of the session, unique within the manager.
+func (s *V2Session) ID() uint64 {
+	return s.id
+}
+
+// State returns the state of the session.
+func (s *V2Session) State() V2SessionState {
+	s.m.m.Lock()
+	defer s.m.m.Unlock()
+	return s.state
+}
+
+// Err returns the first non-EOF error that was encountered by the session.
+func (s *V2Session) Err() error {
+	return s.err
+}
+
+// Chunk returns the most recent response chunk generated by a call to Scan.
+func (s *V2Session) Chunk() *ProtocolV2ResponseChunk {
+	return s.curr
+}
+
+// Scan advances the session to the next response chunk. It returns false when
+// the response ends or an error occurs. At the end of the response, the
+// connection goes back to the pool.
+func (s *V2Session) Scan() bool {
+	return s.ScanContext(context.Background())
+}
+
+// ScanContext is Scan with the reads bound to ctx. If ctx is done in the middle
+// of the response, the session fails and the connection is closed.
+func (s *V2Session) ScanContext(ctx context.Context) bool {
+	if s.conn == nil {
+		return false
+	}
+	resp := s.conn.resp
+	if !resp.ScanContext(ctx) {
+		err := resp.Err()
+		if err == nil {
+			err = SyntaxError("early EOF")
+		}
+		s.finish(err)
+		return false
+	}
+	s.curr = resp.Chunk()
+	if s.curr.EndResponse {
+		s.finish(nil)
+	}
+	return true
+}
+
+// Chunks returns an iterator over the remaining response chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (s *V2Session) Chunks() iter.Seq2[*ProtocolV2ResponseChunk, error] {
+	return scanSeq(s.Scan, s.Chunk, s.Err)
+}
+
+// Close abandons the session. If the response wasn't read to the end, the
+// connection is closed since it's out of sync.
+func (s *V2Session) Close() error {
+	if s.conn != nil {
+		s.finish(errors.New("gitprotocolio: session abandoned"))
+	}
+	return nil
+}
+
+func (s *V2Session) finish(err error) {
+	c := s.conn
+	s.conn = nil
+	s.m.m.Lock()
+	delete(s.m.active, s.id)
+	if err != nil {
+		s.state = V2SessionStateFailed
+	} else {
+		s.state = V2SessionStateDone
+	}
+	s.m.m.Unlock()
+	if err != nil {
+		s.err = err
+		s.m.discard(c)
+		return
+	}
+	s.m.release(c)
+}
@@ -0,0 +1,177 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeV2Upstream returns a dial function of a protocol v2 server that responds
+// to every command with "ok <command>" and "<argument>" lines. If version is
+// not 2, it sends a v0 advertisement instead.
+func fakeV2Upstream(version int, dials *int32) func(context.Context) (io.ReadWriteCloser, error) {
+	return func(context.Context) (io.ReadWriteCloser, error) {
+		atomic.AddInt32(dials, 1)
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			if version != 2 {
+				io.WriteString(server, v0Discovery)
+				return
+			}
+			if _, err := io.WriteString(server, v2Discovery); err != nil {
+				return
+			}
+			req := NewProtocolV2Request(server)
+			var resp []string
+			for req.Scan() {
+				c := req.Chunk()
+				switch {
+				case c.Command != "":
+					resp = []string{"ok " + c.Command + "\n"}
+				case len(c.Argument) != 0:
+					resp = append(resp, string(c.Argument))
+				case c.EndArgument:
+					if _, err := io.WriteString(server, pktLines(append(resp, "0000")...)); err != nil {
+						return
+					}
+				}
+			}
+		}()
+		return client, nil
+	}
+}
+
+func v2Command(command string, args ...string) []*ProtocolV2RequestChunk {
+	chunks := []*ProtocolV2RequestChunk{{Command: command}, {EndCapability: true}}
+	for _, a := range args {
+		chunks = append(chunks, &ProtocolV2RequestChunk{Argument: []byte(a + "\n")})
+	}
+	return append(chunks, &ProtocolV2RequestChunk{EndArgument: true})
+}
+
+func readSession(t *testing.T, s *V2Session) []string {
+	var lines []string
+	for s.Scan() {
+		if c := s.Chunk(); !c.EndResponse {
+			lines = append(lines, string(c.Response))
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestV2SessionManager(t *testing.T) {
+	var dials int32
+	m := NewV2SessionManager(fakeV2Upstream(2, &dials), 2)
+	defer m.Close()
+	ctx := context.Background()
+
+	caps, err := m.Capabilities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"agent=git/2.40", "ls-refs"}; !reflect.DeepEqual(caps, want) {
+		t.Errorf("got capabilities %q, want %q", caps, want)
+	}
+	for _, cmd := range []string{"ls-refs", "fetch"} {
+		s, err := m.Start(ctx, v2Command(cmd, "symrefs"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Sessions(); len(got) != 1 || got[0].Command != cmd || got[0].State != V2SessionStateReceiving {
+			t.Errorf("%s: got sessions %+v", cmd, got)
+		}
+		if got, want := readSession(t, s), []string{"ok " + cmd + "\n", "symrefs\n"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", cmd, got, want)
+		}
+		if s.State() != V2SessionStateDone || len(m.Sessions()) != 0 {
+			t.Errorf("%s: got state %v and sessions %+v", cmd, s.State(), m.Sessions())
+		}
+	}
+	if dials != 1 {
+		t.Errorf("got %d dials, want the connection reused", dials)
+	}
+}
+
+func TestV2SessionManagerAbandon(t *testing.T) {
+	var dials int32
+	m := NewV2SessionManager(fakeV2Upstream(2, &dials), 1)
+	defer m.Close()
+	ctx := context.Background()
+
+	s, err := m.Start(ctx, v2Command("ls-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The only connection is in use.
+	tctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.Start(tctx, v2Command("ls-refs")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	s.Close()
+	if s.State() != V2SessionStateFailed || s.Scan() {
+		t.Errorf("got state %v after Close", s.State())
+	}
+	// The abandoned connection is out of sync, so a new one is opened.
+	s, err = m.Start(ctx, v2Command("ls-refs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readSession(t, s)
+	if dials != 2 {
+		t.Errorf("got %d dials, want 2", dials)
+	}
+}
+
+func TestV2SessionManagerErrors(t *testing.T) {
+	ctx := context.Background()
+	var dials int32
+	m := NewV2SessionManager(fakeV2Upstream(2, &dials), 1)
+	for _, req := range [][]*ProtocolV2RequestChunk{
+		nil,
+		{{EndArgument: true}},
+		v2Command("ls-refs")[:2],
+	} {
+		if _, err := m.Start(ctx, req); err == nil {
+			t.Errorf("%+v: got no error", req)
+		}
+	}
+	m.Close()
+	if _, err := m.Start(ctx, v2Command("ls-refs")); err != ErrV2SessionManagerClosed {
+		t.Errorf("got %v, want %v", err, ErrV2SessionManagerClosed)
+	}
+
+	m = NewV2SessionManager(fakeV2Upstream(0, &dials), 1)
+	if _, err := m.Capabilities(ctx); err == nil {
+		t.Error("got no error from a v0 upstream")
+	}
+	m = NewV2SessionManager(func(context.Context) (io.ReadWriteCloser, error) {
+		return nil, errors.New("connection refused")
+	}, 1)
+	if _, err := m.Start(ctx, v2Command("ls-refs")); err == nil {
+		t.Error("got no error from a failed dial")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Bundle list modes.
+const (
+	// BundleModeAll means that the client needs all the bundles.
+	BundleModeAll = "all"
+	// BundleModeAny means that any one of the bundles is enough, such as
+	// mirrors of the same bundle.
+	BundleModeAny = "any"
+)
+
+// BundleHeuristicCreationToken is the heuristic that the client downloads the
+// bundles in the decreasing order of the creationToken, and stops at the
+// bundles it fetched before.
+const BundleHeuristicCreationToken = "creationToken"
+
+// BundleList is the response of a protocol v2 bundle-uri command, which has no
+// argument: a bundle list in the git-config key=value form, one pair per line.
+//
+//	bundle.version=1
+//	bundle.mode=all
+//	bundle.heuristic=creationToken
+//	bundle.daily.uri=https://cdn.example.com/daily.bundle
+//	bundle.daily.creationToken=1700000000
+//
+// A server without bundles sends only the flush, which is an empty BundleList.
+// See gitprotocol-v2(5).
+type BundleList struct {
+	// Version is the bundle list version. Only 1 is defined.
+	Version int
+	// Mode is BundleModeAll or BundleModeAny.
+	Mode string
+	// Heuristic is BundleHeuristicCreationToken or "" for none.
+	Heuristic string
+	// Bundles are the bundles in the order of the first lines of their IDs.
+	Bundles []*BundleListEntry
+}
+
+// BundleListEntry is a bundle in a BundleList.
+type BundleListEntry struct {
+	// ID is the name between "bundle." and the key, such as "daily".
+	ID  string
+	URI string
+	// CreationToken orders the bundles for the creationToken heuristic. It's
+	// 0 if not set.
+	CreationToken uint64
+	// Filter is the object filter of the bundle, such as "blob:none", for
+	// a partial clone.
+	Filter string
+}
+
+// ReadBundleURIResponse reads a bundle-uri response up to the flush.
+func ReadBundleURIResponse(rd io.Reader) (*BundleList, error) {
+	var lines []string
+	r := NewProtocolV2Response(rd)
+	for r.Scan() {
+		c := r.Chunk()
+		if c.EndResponse {
+			return ParseBundleList(lines)
+		}
+		if c.Delimiter {
+			return nil, SyntaxError("unexpected delimiter in a bundle-uri response")
+		}
+		lines = append(lines, strings.TrimSuffix(string(c.Response), "\n"))
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return nil, SyntaxError("early EOF")
+}
+
+// ParseBundleList parses the key=value lines of a bundle list. Unknown keys are
+// ignored as Git does, so that new keys can be added.
+func ParseBundleList(lines []string) (*BundleList, error) {
+	l := &BundleList{}
+	if len(lines) == 0 {
+		return l, nil
+	}
+	byID := map[string]*BundleListEntry{}
+	for _, line := range lines {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || value == "" {
+			return nil, SyntaxError(fmt.Sprintf("cannot parse the bundle list line: %q", line))
+		}
+		rest, ok := strings.CutPrefix(key, "bundle.")
+		if !ok {
+			continue
+		}
+		dot := strings.LastIndexByte(rest, '.')
+		if dot < 0 {
+			switch rest {
+			case "version":
+				v, err := strconv.Atoi(value)
+				if err != nil {
+					return nil, SyntaxError(fmt.Sprintf("cannot parse the bundle list version: %q", value))
+				}
+				l.Version = v
+			case "mode":
+				if value != BundleModeAll && value != BundleModeAny {
+					return nil, SyntaxError(fmt.Sprintf("unknown bundle list mode: %q", value))
+				}
+				l.Mode = value
+			case "heuristic":
+				l.Heuristic = value
+			}
+			continue
+		}
+		id, subkey := rest[:dot], rest[dot+1:]
+		if id == "" {
+			return nil, SyntaxError(fmt.Sprintf("empty bundle ID: %q", line))
+		}
+		e := byID[id]
+		if e == nil {
+			e = &BundleListEntry{ID: id}
+			byID[id] = e
+			l.Bundles = append(l.Bundles, e)
+		}
+		switch subkey {
+		case "uri":
+			e.URI = value
+		case "creationToken":
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, SyntaxError(fmt.Sprintf("cannot parse the creationToken: %q", line))
+			}
+			e.CreationToken = v
+		case "filter":
+			e.Filter = value
+		}
+	}
+	if l.Version != 1 {
+		return nil, SyntaxError(fmt.Sprintf("unsupported bundle list version: %d", l.Version))
+	}
+	if l.Mode == "" {
+		return nil, SyntaxError("no bundle list mode")
+	}
+	for _, e := range l.Bundles {
+		if e.URI == "" {
+			return nil, SyntaxError("no URI for the bundle " + e.ID)
+		}
+	}
+	return l, nil
+}
+
+// Lines returns the key=value lines of the bundle list. An empty BundleList has
+// no line.
+func (l *BundleList) Lines() []string {
+	if l.Version == 0 && len(l.Bundles) == 0 {
+		return nil
+	}
+	ret := []string{
+		fmt.Sprintf("bundle.version=%d", l.Version),
+		"bundle.mode=" + l.Mode,
+	}
+	if l.Heuristic != "" {
+		ret = append(ret, "bundle.heuristic="+l.Heuristic)
+	}
+	for _, e := range l.Bundles {
+		ret = append(ret, fmt.Sprintf("bundle.%s.uri=%s", e.ID, e.URI))
+		if e.CreationToken != 0 {
+			ret = append(ret, fmt.Sprintf("bundle.%s.creationToken=%d", e.ID, e.CreationToken))
+		}
+		if e.Filter != "" {
+			ret = append(ret, fmt.Sprintf("bundle.%s.filter=%s", e.ID, e.Filter))
+		}
+	}
+	return ret
+}
+
+// EncodeToPktLine serializes the bundle list as a bundle-uri response, ending
+// with a flush. As Git does, the lines don't end with a newline.
+func (l *BundleList) EncodeToPktLine() []byte {
+	var b bytes.Buffer
+	for _, line := range l.Lines() {
+		b.Write((&ProtocolV2ResponseChunk{Response: []byte(line)}).EncodeToPktLine())
+	}
+	b.Write((&ProtocolV2ResponseChunk{EndResponse: true}).EncodeToPktLine())
+	return b.Bytes()
+}
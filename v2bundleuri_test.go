@@ -0,0 +1,135 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBundleListRoundTrip(t *testing.T) {
+	l := &BundleList{
+		Version:   1,
+		Mode:      BundleModeAll,
+		Heuristic: BundleHeuristicCreationToken,
+		Bundles: []*BundleListEntry{
+			{ID: "daily", URI: "https://cdn.example.com/daily.bundle", CreationToken: 1700000000},
+			{ID: "base.v2", URI: "https://cdn.example.com/base.bundle?a=b", Filter: "blob:none"},
+		},
+	}
+	want := pktLines(
+		"bundle.version=1",
+		"bundle.mode=all",
+		"bundle.heuristic=creationToken",
+		"bundle.daily.uri=https://cdn.example.com/daily.bundle",
+		"bundle.daily.creationToken=1700000000",
+		"bundle.base.v2.uri=https://cdn.example.com/base.bundle?a=b",
+		"bundle.base.v2.filter=blob:none",
+		"0000",
+	)
+	if got := string(l.EncodeToPktLine()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	got, err := ReadBundleURIResponse(bytes.NewReader(l.EncodeToPktLine()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, l) {
+		t.Errorf("got %+v, want %+v", got, l)
+	}
+}
+
+func TestReadBundleURIResponseEmpty(t *testing.T) {
+	got, err := ReadBundleURIResponse(strings.NewReader(FlushPkt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, &BundleList{}) || got.Lines() != nil {
+		t.Errorf("got %+v, want an empty list", got)
+	}
+	if got := string(got.EncodeToPktLine()); got != FlushPkt {
+		t.Errorf("got %q, want a flush", got)
+	}
+}
+
+func TestParseBundleList(t *testing.T) {
+	// Unknown keys and other sections are ignored, and the lines of a bundle
+	// can be interleaved.
+	got, err := ParseBundleList([]string{
+		"bundle.version=1",
+		"bundle.mode=any",
+		"bundle.a.uri=https://a.example.com/x.bundle",
+		"bundle.b.uri=https://b.example.com/x.bundle",
+		"bundle.a.creationToken=2",
+		"bundle.a.unknown=x",
+		"bundle.unknown=x",
+		"other.key=x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &BundleList{
+		Version: 1,
+		Mode:    BundleModeAny,
+		Bundles: []*BundleListEntry{
+			{ID: "a", URI: "https://a.example.com/x.bundle", CreationToken: 2},
+			{ID: "b", URI: "https://b.example.com/x.bundle"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseBundleListErrors(t *testing.T) {
+	header := []string{"bundle.version=1", "bundle.mode=all"}
+	for _, tc := range []struct {
+		name  string
+		lines []string
+	}{
+		{"no equal sign", append(header, "bundle.a.uri")},
+		{"empty value", append(header, "bundle.a.uri=")},
+		{"bad version", []string{"bundle.version=x", "bundle.mode=all"}},
+		{"unsupported version", []string{"bundle.version=2", "bundle.mode=all"}},
+		{"no version", []string{"bundle.mode=all"}},
+		{"unknown mode", []string{"bundle.version=1", "bundle.mode=some"}},
+		{"no mode", []string{"bundle.version=1"}},
+		{"empty ID", append(header, "bundle..uri=https://example.com")},
+		{"bad creationToken", append(header, "bundle.a.uri=https://example.com", "bundle.a.creationToken=-1")},
+		{"no URI", append(header, "bundle.a.creationToken=1")},
+	} {
+		if got, err := ParseBundleList(tc.lines); err == nil {
+			t.Errorf("%s: got %+v, want an error", tc.name, got)
+		}
+	}
+}
+
+func TestReadBundleURIResponseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+	}{
+		{"early EOF", pktLines("bundle.version=1")},
+		{"delimiter", pktLines("bundle.version=1") + DelimPkt + FlushPkt},
+		{"bad list", pktLines("bundle.version=1", "0000")},
+		{"bad packet", "zzzz"},
+	} {
+		if got, err := ReadBundleURIResponse(strings.NewReader(tc.in)); err == nil {
+			t.Errorf("%s: got %+v, want an error", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ProtocolV2CapabilityAdvertisement is the first response of a protocol v2
+// server: "version 2", a capability per line, and a flush.
+//
+//	version 2
+//	agent=git/2.45.0
+//	ls-refs=unborn
+//	fetch=shallow wait-for-done
+//	server-option
+//	object-format=sha1
+//	0000
+//
+// A capability can have a value after "=". For a command, such as fetch, the
+// value is the space-separated features of the command.
+type ProtocolV2CapabilityAdvertisement struct {
+	Capabilities Capabilities
+}
+
+// ReadProtocolV2CapabilityAdvertisement reads a capability advertisement
+// (with or without the smart HTTP service header) up to the flush. It's an
+// error if the server doesn't speak protocol v2.
+func ReadProtocolV2CapabilityAdvertisement(rd io.Reader) (*ProtocolV2CapabilityAdvertisement, error) {
+	a := &ProtocolV2CapabilityAdvertisement{}
+	r := NewInfoRefsResponse(rd)
+	if !r.Scan() {
+		if err := r.Err(); err != nil {
+			return nil, err
+		}
+		return nil, SyntaxError("early EOF")
+	}
+	if v := r.Chunk().ProtocolVersion; v != 2 {
+		return nil, SyntaxError(fmt.Sprintf("not a protocol v2 advertisement: version %d", v))
+	}
+	for r.Scan() {
+		c := r.Chunk()
+		if c.EndOfRequest {
+			return a, nil
+		}
+		if err := checkV2Capability(c.Capabilities[0]); err != nil {
+			return nil, err
+		}
+		a.Capabilities = append(a.Capabilities, c.Capabilities[0])
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	return nil, SyntaxError("early EOF")
+}
+
+// checkV2Capability checks the syntax of a capability line. A key is
+// alphanumeric with "-" and "_", and a value is not empty.
+func checkV2Capability(s string) error {
+	key, value, hasValue := strings.Cut(s, "=")
+	if key == "" || hasValue && value == "" {
+		return SyntaxError(fmt.Sprintf("invalid capability: %q", s))
+	}
+	for _, c := range key {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return SyntaxError(fmt.Sprintf("invalid capability: %q", s))
+		}
+	}
+	return nil
+}
+
+// EncodeToPktLine serializes the advertisement, from the version line to the
+// flush. A smart HTTP server writes the service header before it.
+func (a *ProtocolV2CapabilityAdvertisement) EncodeToPktLine() []byte {
+	var b bytes.Buffer
+	b.Write((&InfoRefsResponseChunk{ProtocolVersion: 2}).EncodeToPktLine())
+	for _, c := range a.Capabilities {
+		b.Write((&InfoRefsResponseChunk{Capabilities: []string{c}}).EncodeToPktLine())
+	}
+	b.Write(FlushPacket{}.EncodeToPktLine())
+	return b.Bytes()
+}
+
+// HasCommand returns true if the command, such as "fetch", is advertised.
+func (a *ProtocolV2CapabilityAdvertisement) HasCommand(command string) bool {
+	return a.Capabilities.Has(command)
+}
+
+// Features returns the features of the command, such as "shallow" and
+// "wait-for-done" of "fetch=shallow wait-for-done".
+func (a *ProtocolV2CapabilityAdvertisement) Features(command string) Capabilities {
+	v, _ := a.Capabilities.Value(command)
+	return ParseCapabilities(v)
+}
+
+// Agent returns the value of the agent capability, or "" if none.
+func (a *ProtocolV2CapabilityAdvertisement) Agent() string {
+	return a.Capabilities.Agent()
+}
+
+// ObjectFormat returns the object format. Without the object-format
+// capability, it's SHA-1.
+func (a *ProtocolV2CapabilityAdvertisement) ObjectFormat() ObjectFormat {
+	return a.Capabilities.ObjectFormat()
+}
+
+// SessionID returns the value of the session-id capability, or "" if none.
+func (a *ProtocolV2CapabilityAdvertisement) SessionID() string {
+	v, _ := a.Capabilities.Value("session-id")
+	return v
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FetchRequest is the arguments of a protocol v2 fetch command.
+type FetchRequest struct {
+	Wants []string
+	// WantRefs are the refs the client wants by name, with the ref-in-want
+	// feature. The server resolves them and returns the object IDs in the
+	// wanted-refs section.
+	WantRefs []string
+	Haves    []string
+	// Done ends the negotiation.
+	Done bool
+
+	ThinPack   bool
+	NoProgress bool
+	IncludeTag bool
+	OfsDelta   bool
+
+	// Shallows are the shallow commits of the client.
+	Shallows       []string
+	Deepen         int
+	DeepenRelative bool
+	// DeepenSince is seconds from UNIX epoch.
+	DeepenSince uint64
+	DeepenNot   []string
+	Filter      *FilterSpec
+
+	SideBandAll bool
+	// PackfileURIs are the URI schemes of the packfile-uris argument.
+	PackfileURIs []string
+	WaitForDone  bool
+}
+
+// ParseFetchArguments parses the arguments of a fetch command
+// (ProtocolV2RequestChunk.Argument).
+func ParseFetchArguments(args []string) (*FetchRequest, error) {
+	req := &FetchRequest{}
+	for _, arg := range args {
+		arg = strings.TrimSuffix(arg, "\n")
+		name, value, _ := strings.Cut(arg, " ")
+		var err error
+		switch name {
+		case "want", "want-ref", "have", "shallow", "deepen", "deepen-since", "deepen-not", "filter", "packfile-uris":
+			if value == "" {
+				return nil, ErrorPacket(fmt.Sprintf("unexpected line: '%s'", arg))
+			}
+		}
+		switch name {
+		case "want":
+			req.Wants = append(req.Wants, value)
+		case "want-ref":
+			req.WantRefs = append(req.WantRefs, value)
+		case "have":
+			req.Haves = append(req.Haves, value)
+		case "shallow":
+			req.Shallows = append(req.Shallows, value)
+		case "deepen":
+			req.Deepen, err = strconv.Atoi(value)
+			if err == nil && req.Deepen <= 0 {
+				err = fmt.Errorf("invalid depth %d", req.Deepen)
+			}
+		case "deepen-since":
+			req.DeepenSince, err = strconv.ParseUint(value, 10, 64)
+		case "deepen-not":
+			req.DeepenNot = append(req.DeepenNot, value)
+		case "filter":
+			req.Filter, err = ParseFilterSpec(value)
+		case "packfile-uris":
+			req.PackfileURIs = ParsePackfileURIsArgument(arg)
+		default:
+			if value != "" {
+				return nil, ErrorPacket(fmt.Sprintf("unexpected line: '%s'", arg))
+			}
+			switch name {
+			case "done":
+				req.Done = true
+			case "thin-pack":
+				req.ThinPack = true
+			case "no-progress":
+				req.NoProgress = true
+			case "include-tag":
+				req.IncludeTag = true
+			case "ofs-delta":
+				req.OfsDelta = true
+			case "deepen-relative":
+				req.DeepenRelative = true
+			case "sideband-all":
+				req.SideBandAll = true
+			case "wait-for-done":
+				req.WaitForDone = true
+			default:
+				return nil, ErrorPacket(fmt.Sprintf("unexpected line: '%s'", arg))
+			}
+		}
+		if err != nil {
+			return nil, SyntaxError(fmt.Sprintf("cannot parse the fetch argument %q: %v", arg, err))
+		}
+	}
+	return req, nil
+}
+
+// Arguments returns the argument lines of the request, in the order Git sends
+// them.
+func (r *FetchRequest) Arguments() []string {
+	var ret []string
+	flag := func(b bool, s string) {
+		if b {
+			ret = append(ret, s)
+		}
+	}
+	flag(r.ThinPack, "thin-pack")
+	flag(r.NoProgress, "no-progress")
+	flag(r.IncludeTag, "include-tag")
+	flag(r.OfsDelta, "ofs-delta")
+	flag(r.SideBandAll, "sideband-all")
+	for _, w := range r.Wants {
+		ret = append(ret, "want "+w)
+	}
+	for _, w := range r.WantRefs {
+		ret = append(ret, "want-ref "+w)
+	}
+	ret = append(ret, ShallowArguments(r.Shallows)...)
+	if r.Deepen != 0 {
+		ret = append(ret, fmt.Sprintf("deepen %d", r.Deepen))
+	}
+	flag(r.DeepenRelative, "deepen-relative")
+	if r.DeepenSince != 0 {
+		ret = append(ret, fmt.Sprintf("deepen-since %d", r.DeepenSince))
+	}
+	for _, ref := range r.DeepenNot {
+		ret = append(ret, "deepen-not "+ref)
+	}
+	if r.Filter != nil {
+		ret = append(ret, "filter "+r.Filter.String())
+	}
+	if arg := PackfileURIsArgument(r.PackfileURIs); arg != "" {
+		ret = append(ret, arg)
+	}
+	flag(r.WaitForDone, "wait-for-done")
+	for _, h := range r.Haves {
+		ret = append(ret, "have "+h)
+	}
+	flag(r.Done, "done")
+	return ret
+}
+
+// Chunks returns the whole request with the capabilities, such as
+// "object-format=sha256", from the command line to the flush.
+func (r *FetchRequest) Chunks(capabilities []string) []*ProtocolV2RequestChunk {
+	ret := []*ProtocolV2RequestChunk{{Command: "fetch"}}
+	for _, c := range capabilities {
+		ret = append(ret, &ProtocolV2RequestChunk{Capability: c})
+	}
+	ret = append(ret, &ProtocolV2RequestChunk{EndCapability: true})
+	for _, arg := range r.Arguments() {
+		ret = append(ret, &ProtocolV2RequestChunk{Argument: []byte(arg + "\n")})
+	}
+	return append(ret, &ProtocolV2RequestChunk{EndArgument: true})
+}
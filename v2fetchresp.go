@@ -0,0 +1,500 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+)
+
+type protocolV2FetchResponseState int
+
+const (
+	protocolV2FetchResponseStateBegin protocolV2FetchResponseState = iota
+	protocolV2FetchResponseStateScanSection
+	protocolV2FetchResponseStateBeginSection
+	protocolV2FetchResponseStateEnd
+)
+
+func (s protocolV2FetchResponseState) String() string {
+	switch s {
+	case protocolV2FetchResponseStateBegin:
+		return "Begin"
+	case protocolV2FetchResponseStateScanSection:
+		return "ScanSection"
+	case protocolV2FetchResponseStateBeginSection:
+		return "BeginSection"
+	case protocolV2FetchResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
+// Sections of a protocol v2 fetch response.
+const (
+	FetchSectionAcknowledgments = "acknowledgments"
+	FetchSectionShallowInfo     = "shallow-info"
+	FetchSectionWantedRefs      = "wanted-refs"
+	FetchSectionPackfileURIs    = "packfile-uris"
+	FetchSectionPackfile        = "packfile"
+)
+
+// ProtocolV2FetchResponseChunk is a chunk of a protocol v2 fetch response.
+type ProtocolV2FetchResponseChunk struct {
+	// SectionHeader is the name of the section that starts, such as
+	// "acknowledgments".
+	SectionHeader     string
+	Nak               bool
+	AckObjectID       string
+	Ready             bool
+	ShallowObjectID   string
+	UnshallowObjectID string
+	WantedRefObjectID string
+	WantedRefName     string
+	PackfileURIHash   string
+	PackfileURI       string
+	// PackStream is a side-band packet of the packfile section, including
+	// the band byte.
+	PackStream []byte
+	// SideBandMessage is a progress (0x02) or error (0x03) packet outside
+	// the packfile section with sideband-all, including the band byte.
+	SideBandMessage []byte
+	// Keepalive is an empty sideband packet that the server sends while
+	// it's busy, in the packfile section or anywhere with sideband-all.
+	Keepalive bool
+	// EndOfSection is the delimiter between sections.
+	EndOfSection bool
+	EndResponse  bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *ProtocolV2FetchResponseChunk) EncodeToPktLine() []byte {
+	if c.SectionHeader != "" {
+		return BytesPacket([]byte(c.SectionHeader + "\n")).EncodeToPktLine()
+	}
+	if c.Nak {
+		return BytesPacket([]byte("NAK\n")).EncodeToPktLine()
+	}
+	if c.AckObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("ACK %s\n", c.AckObjectID))).EncodeToPktLine()
+	}
+	if c.Ready {
+		return BytesPacket([]byte("ready\n")).EncodeToPktLine()
+	}
+	if c.ShallowObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("shallow %s\n", c.ShallowObjectID))).EncodeToPktLine()
+	}
+	if c.UnshallowObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("unshallow %s\n", c.UnshallowObjectID))).EncodeToPktLine()
+	}
+	if c.WantedRefObjectID != "" {
+		return BytesPacket([]byte(fmt.Sprintf("%s %s\n", c.WantedRefObjectID, c.WantedRefName))).EncodeToPktLine()
+	}
+	if c.PackfileURIHash != "" {
+		return BytesPacket([]byte(fmt.Sprintf("%s %s\n", c.PackfileURIHash, c.PackfileURI))).EncodeToPktLine()
+	}
+	if len(c.PackStream) != 0 {
+		return BytesPacket(c.PackStream).EncodeToPktLine()
+	}
+	if len(c.SideBandMessage) != 0 {
+		return BytesPacket(c.SideBandMessage).EncodeToPktLine()
+	}
+	if c.Keepalive {
+		return []byte(KeepalivePkt)
+	}
+	if c.EndOfSection {
+		return DelimPacket{}.EncodeToPktLine()
+	}
+	if c.EndResponse {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// fetchSections is the sections of a fetch response in the order they appear.
+var fetchSections = []string{
+	FetchSectionAcknowledgments,
+	FetchSectionShallowInfo,
+	FetchSectionWantedRefs,
+	FetchSectionPackfileURIs,
+	FetchSectionPackfile,
+}
+
+// lineSection returns the section of a line chunk, such as
+// FetchSectionShallowInfo for a shallow line, or "" for the other chunks.
+func (c *ProtocolV2FetchResponseChunk) lineSection() string {
+	switch {
+	case c.Nak, c.AckObjectID != "", c.Ready:
+		return FetchSectionAcknowledgments
+	case c.ShallowObjectID != "", c.UnshallowObjectID != "":
+		return FetchSectionShallowInfo
+	case c.WantedRefObjectID != "":
+		return FetchSectionWantedRefs
+	case c.PackfileURIHash != "":
+		return FetchSectionPackfileURIs
+	case len(c.PackStream) != 0:
+		return FetchSectionPackfile
+	}
+	return ""
+}
+
+// ProtocolV2FetchResponseEncoder writes protocol v2 fetch responses chunk by
+// chunk, in the order ProtocolV2FetchResponse reads. The sections must be in the
+// order of gitprotocol-v2(5): acknowledgments, shallow-info, wanted-refs,
+// packfile-uris, and packfile.
+type ProtocolV2FetchResponseEncoder struct {
+	w       chunkWriter
+	state   protocolV2FetchResponseState
+	section int
+	// sideBandAll is true if every packet has a band byte.
+	sideBandAll bool
+}
+
+// NewProtocolV2FetchResponseEncoder returns a new
+// ProtocolV2FetchResponseEncoder that writes to w.
+func NewProtocolV2FetchResponseEncoder(w io.Writer) *ProtocolV2FetchResponseEncoder {
+	return &ProtocolV2FetchResponseEncoder{w: chunkWriter{w: w}, section: -1}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ServerToClient
+// as the direction. See TraceFunc.
+func (e *ProtocolV2FetchResponseEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ServerToClient, f)
+}
+
+// SetSideBandAll makes the encoder send the lines outside the packfile section
+// in band 1, as when the client sent sideband-all. SideBandMessage chunks are
+// allowed only with it.
+func (e *ProtocolV2FetchResponseEncoder) SetSideBandAll(b bool) {
+	e.sideBandAll = b
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one, such as a shallow line in the
+// acknowledgments section or a section after packfile.
+func (e *ProtocolV2FetchResponseEncoder) WriteChunk(c *ProtocolV2FetchResponseChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	var kind string
+	var ok bool
+	next := e.state
+	nextSection := e.section
+	section := c.lineSection()
+	switch {
+	case c.SectionHeader != "":
+		kind = "the " + c.SectionHeader + " section"
+		i := -1
+		for j, name := range fetchSections {
+			if name == c.SectionHeader {
+				i = j
+			}
+		}
+		if i < 0 {
+			kind = ""
+		}
+		ok = i > e.section && (e.state == protocolV2FetchResponseStateBegin || e.state == protocolV2FetchResponseStateBeginSection)
+		next, nextSection = protocolV2FetchResponseStateScanSection, i
+	case section != "":
+		kind = "a line of " + section
+		ok = e.state == protocolV2FetchResponseStateScanSection && fetchSections[e.section] == section
+	case len(c.SideBandMessage) != 0:
+		kind = "a sideband message"
+		ok = e.sideBandAll && (c.SideBandMessage[0] == 2 || c.SideBandMessage[0] == 3)
+	case c.Keepalive:
+		kind = "a keepalive"
+		ok = e.sideBandAll || e.state == protocolV2FetchResponseStateScanSection && fetchSections[e.section] == FetchSectionPackfile
+	case c.EndOfSection:
+		kind = "a delimiter"
+		ok = e.state == protocolV2FetchResponseStateScanSection && fetchSections[e.section] != FetchSectionPackfile
+		next = protocolV2FetchResponseStateBeginSection
+	case c.EndResponse:
+		kind = "the end of the response"
+		ok = e.state == protocolV2FetchResponseStateScanSection
+		next, nextSection = protocolV2FetchResponseStateBegin, -1
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	bs := c.EncodeToPktLine()
+	if e.sideBandAll && (c.SectionHeader != "" || section != "" && section != FetchSectionPackfile) {
+		bs = BytesPacket(append([]byte{1}, bs[4:]...)).EncodeToPktLine()
+	}
+	if err := e.w.write(kind, c, bs); err != nil {
+		return err
+	}
+	e.state, e.section = next, nextSection
+	return nil
+}
+
+// ProtocolV2FetchResponse provides an interface for reading a protocol v2 fetch
+// response section by section. Use ProtocolV2Response for the responses of the
+// other commands.
+//
+// The input can have multiple responses back to back, as in a stateful
+// connection. Each response ends with an EndResponse chunk, after which
+// ResponseComplete returns true and Scan continues to the next response.
+type ProtocolV2FetchResponse struct {
+	scanner *PacketScanner
+	state   protocolV2FetchResponseState
+	err     error
+	curr    *ProtocolV2FetchResponseChunk
+	section string
+	format  ObjectFormat
+	// sideBandAll is true if every packet has a band byte.
+	sideBandAll bool
+}
+
+// NewProtocolV2FetchResponse returns a new ProtocolV2FetchResponse to read from
+// rd.
+func NewProtocolV2FetchResponse(rd io.Reader) *ProtocolV2FetchResponse {
+	return &ProtocolV2FetchResponse{scanner: NewPacketScanner(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// ProtocolV2FetchResponse.
+func (r *ProtocolV2FetchResponse) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent chunk generated by a call to Scan.
+//
+// The underlying arrays of PackStream and SideBandMessage may point to data
+// that will be overwritten by a subsequent call to Scan. It does no
+// allocation.
+func (r *ProtocolV2FetchResponse) Chunk() *ProtocolV2FetchResponseChunk {
+	return r.curr
+}
+
+// Section returns the name of the current section, or "" between responses.
+func (r *ProtocolV2FetchResponse) Section() string {
+	return r.section
+}
+
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV2FetchResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *ProtocolV2FetchResponse) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetSideBandAll makes the parser expect the framing that the client requests
+// with the "sideband-all" argument: every packet except the flushes and the
+// delimiters has a band byte, and the progress and error messages can come in
+// any section. The lines are returned without the band byte, and the messages
+// outside the packfile section as SideBandMessage chunks.
+func (r *ProtocolV2FetchResponse) SetSideBandAll(b bool) {
+	r.sideBandAll = b
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV2FetchResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV2FetchResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *ProtocolV2FetchResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
+// ResponseComplete returns true if the most recent chunk ended a response. More
+// responses may follow.
+func (r *ProtocolV2FetchResponse) ResponseComplete() bool {
+	return r.state == protocolV2FetchResponseStateBegin && r.curr != nil && r.curr.EndResponse
+}
+
+// Scan advances the scanner to the next packet. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *ProtocolV2FetchResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV2FetchResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *ProtocolV2FetchResponse) scan() bool {
+	if r.err != nil || r.state == protocolV2FetchResponseStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != protocolV2FetchResponseStateBegin {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+	pkt := r.scanner.Packet()
+	if bp, ok := pkt.(BytesPacket); ok && r.sideBandAll && r.section != FetchSectionPackfile {
+		switch {
+		case len(bp) == 0:
+			r.err = SyntaxError("empty sideband packet")
+			return false
+		case isKeepalive(bp):
+			r.curr = &ProtocolV2FetchResponseChunk{
+				Keepalive: true,
+			}
+			return true
+		case bp[0] == 1:
+			pkt = bp[1:]
+		case bp[0] == 2 || bp[0] == 3:
+			r.curr = &ProtocolV2FetchResponseChunk{
+				SideBandMessage: bp,
+			}
+			return true
+		default:
+			r.err = SyntaxError(fmt.Sprintf("unknown sideband band: %d", bp[0]))
+			return false
+		}
+	}
+
+	switch r.state {
+	case protocolV2FetchResponseStateBegin, protocolV2FetchResponseStateBeginSection:
+		bp, ok := pkt.(BytesPacket)
+		if !ok {
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", pkt))
+			return false
+		}
+		name := strings.TrimSuffix(string(bp), "\n")
+		switch name {
+		case FetchSectionAcknowledgments, FetchSectionShallowInfo, FetchSectionWantedRefs, FetchSectionPackfileURIs, FetchSectionPackfile:
+		default:
+			r.err = SyntaxError("unknown section: " + name)
+			return false
+		}
+		r.state = protocolV2FetchResponseStateScanSection
+		r.section = name
+		r.curr = &ProtocolV2FetchResponseChunk{
+			SectionHeader: name,
+		}
+		return true
+	case protocolV2FetchResponseStateScanSection:
+		switch p := pkt.(type) {
+		case FlushPacket:
+			r.state = protocolV2FetchResponseStateBegin
+			r.section = ""
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndResponse: true,
+			}
+			return true
+		case DelimPacket:
+			if r.section == FetchSectionPackfile {
+				r.err = SyntaxError("packfile is not the last section")
+				return false
+			}
+			r.state = protocolV2FetchResponseStateBeginSection
+			r.curr = &ProtocolV2FetchResponseChunk{
+				EndOfSection: true,
+			}
+			return true
+		case BytesPacket:
+			if r.section == FetchSectionPackfile {
+				if isKeepalive(p) {
+					r.curr = &ProtocolV2FetchResponseChunk{
+						Keepalive: true,
+					}
+					return true
+				}
+				r.curr = &ProtocolV2FetchResponseChunk{
+					PackStream: p,
+				}
+				return true
+			}
+			c, err := r.parseLine(strings.TrimSuffix(string(p), "\n"))
+			if err != nil {
+				r.err = err
+				return false
+			}
+			r.curr = c
+			return true
+		default:
+			r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+			return false
+		}
+	}
+	panic("impossible state")
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV2FetchResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV2FetchResponse) Chunks() iter.Seq2[*ProtocolV2FetchResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+func (r *ProtocolV2FetchResponse) parseLine(line string) (*ProtocolV2FetchResponseChunk, error) {
+	ss := strings.SplitN(line, " ", 2)
+	switch r.section {
+	case FetchSectionAcknowledgments:
+		switch {
+		case line == "NAK":
+			return &ProtocolV2FetchResponseChunk{Nak: true}, nil
+		case line == "ready":
+			return &ProtocolV2FetchResponseChunk{Ready: true}, nil
+		case len(ss) == 2 && ss[0] == "ACK":
+			if err := r.format.check(ss[1]); err != nil {
+				return nil, err
+			}
+			return &ProtocolV2FetchResponseChunk{AckObjectID: ss[1]}, nil
+		}
+	case FetchSectionShallowInfo:
+		if len(ss) == 2 && (ss[0] == "shallow" || ss[0] == "unshallow") {
+			if err := r.format.check(ss[1]); err != nil {
+				return nil, err
+			}
+			if ss[0] == "shallow" {
+				return &ProtocolV2FetchResponseChunk{ShallowObjectID: ss[1]}, nil
+			}
+			return &ProtocolV2FetchResponseChunk{UnshallowObjectID: ss[1]}, nil
+		}
+	case FetchSectionWantedRefs:
+		if len(ss) == 2 {
+			if err := r.format.check(ss[0]); err != nil {
+				return nil, err
+			}
+			return &ProtocolV2FetchResponseChunk{WantedRefObjectID: ss[0], WantedRefName: ss[1]}, nil
+		}
+	case FetchSectionPackfileURIs:
+		if len(ss) == 2 {
+			return &ProtocolV2FetchResponseChunk{PackfileURIHash: ss[0], PackfileURI: ss[1]}, nil
+		}
+	}
+	return nil, SyntaxError(fmt.Sprintf("unexpected line in %s: %q", r.section, line))
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strings"
+)
+
+// LsRefsRequest is the arguments of a protocol v2 ls-refs command.
+type LsRefsRequest struct {
+	// Peel asks the peeled object IDs of the annotated tags.
+	Peel bool
+	// Symrefs asks the targets of the symbolic refs.
+	Symrefs bool
+	// Unborn asks the symbolic refs pointing to a branch not created yet,
+	// such as HEAD of an empty repository. The server must advertise
+	// "ls-refs=unborn".
+	Unborn bool
+	// RefPrefixes limits the refs to the ones with any of the prefixes. See
+	// RefPrefixMatcher.
+	RefPrefixes []string
+}
+
+// ParseLsRefsArguments parses the arguments of an ls-refs command
+// (ProtocolV2RequestChunk.Argument).
+func ParseLsRefsArguments(args []string) (*LsRefsRequest, error) {
+	req := &LsRefsRequest{}
+	for _, arg := range args {
+		arg = strings.TrimSuffix(arg, "\n")
+		switch {
+		case arg == "peel":
+			req.Peel = true
+		case arg == "symrefs":
+			req.Symrefs = true
+		case arg == "unborn":
+			req.Unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			req.RefPrefixes = append(req.RefPrefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		default:
+			return nil, ErrorPacket(fmt.Sprintf("ls-refs: unexpected line: '%s'", arg))
+		}
+	}
+	return req, nil
+}
+
+// Arguments returns the argument lines of the request.
+func (r *LsRefsRequest) Arguments() []string {
+	var ret []string
+	if r.Symrefs {
+		ret = append(ret, "symrefs")
+	}
+	if r.Peel {
+		ret = append(ret, "peel")
+	}
+	if r.Unborn {
+		ret = append(ret, "unborn")
+	}
+	for _, p := range r.RefPrefixes {
+		ret = append(ret, "ref-prefix "+p)
+	}
+	return ret
+}
+
+// Chunks returns the whole request with the capabilities, such as
+// "object-format=sha256", from the command line to the flush.
+func (r *LsRefsRequest) Chunks(capabilities []string) []*ProtocolV2RequestChunk {
+	ret := []*ProtocolV2RequestChunk{{Command: "ls-refs"}}
+	for _, c := range capabilities {
+		ret = append(ret, &ProtocolV2RequestChunk{Capability: c})
+	}
+	ret = append(ret, &ProtocolV2RequestChunk{EndCapability: true})
+	for _, arg := range r.Arguments() {
+		ret = append(ret, &ProtocolV2RequestChunk{Argument: []byte(arg + "\n")})
+	}
+	return append(ret, &ProtocolV2RequestChunk{EndArgument: true})
+}
+
+type lsRefsResponseState int
+
+const (
+	lsRefsResponseStateBegin lsRefsResponseState = iota
+	lsRefsResponseStateScanRefs
+	lsRefsResponseStateEnd
+)
+
+func (s lsRefsResponseState) String() string {
+	switch s {
+	case lsRefsResponseStateBegin:
+		return "Begin"
+	case lsRefsResponseStateScanRefs:
+		return "ScanRefs"
+	case lsRefsResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
+// LsRefsResponseChunk is a chunk of a protocol v2 ls-refs response, a ref line
+// such as "<oid> refs/tags/v1 peeled:<oid>".
+type LsRefsResponseChunk struct {
+	// ObjectID is "" for an unborn ref.
+	ObjectID string
+	// Unborn is true for an unborn symbolic ref such as HEAD of an empty
+	// repository.
+	Unborn       bool
+	Ref          string
+	SymrefTarget string
+	Peeled       string
+	EndResponse  bool
+}
+
+// EncodeToPktLine serializes the chunk.
+func (c *LsRefsResponseChunk) EncodeToPktLine() []byte {
+	if c.Ref != "" && (c.ObjectID != "" || c.Unborn) {
+		var sb strings.Builder
+		if c.Unborn {
+			sb.WriteString("unborn")
+		} else {
+			sb.WriteString(c.ObjectID)
+		}
+		sb.WriteString(" " + c.Ref)
+		if c.SymrefTarget != "" {
+			sb.WriteString(" symref-target:" + c.SymrefTarget)
+		}
+		if c.Peeled != "" {
+			sb.WriteString(" peeled:" + c.Peeled)
+		}
+		sb.WriteByte('\n')
+		return BytesPacket([]byte(sb.String())).EncodeToPktLine()
+	}
+	if c.EndResponse {
+		return FlushPacket{}.EncodeToPktLine()
+	}
+	panic("impossible chunk")
+}
+
+// LsRefsResponse provides an interface for reading a protocol v2 ls-refs
+// response.
+//
+// The input can have multiple responses back to back, as in a stateful
+// connection. Each response ends with an EndResponse chunk, after which
+// ResponseComplete returns true and Scan continues to the next response.
+type LsRefsResponse struct {
+	scanner *PacketScanner
+	state   lsRefsResponseState
+	err     error
+	curr    *LsRefsResponseChunk
+	format  ObjectFormat
+}
+
+// NewLsRefsResponse returns a new LsRefsResponse to read from rd.
+func NewLsRefsResponse(rd io.Reader) *LsRefsResponse {
+	return &LsRefsResponse{scanner: NewPacketScanner(rd)}
+}
+
+// Err returns the first non-EOF error that was encountered by the
+// LsRefsResponse.
+func (r *LsRefsResponse) Err() error {
+	return r.err
+}
+
+// Chunk returns the most recent chunk generated by a call to Scan.
+func (r *LsRefsResponse) Chunk() *LsRefsResponseChunk {
+	return r.curr
+}
+
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *LsRefsResponse) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetObjectFormat makes the parser reject object IDs not of the format, such as
+// a SHA-1 object ID in a SHA-256 session. By default, object IDs are not
+// checked.
+func (r *LsRefsResponse) SetObjectFormat(f ObjectFormat) {
+	r.format = f
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *LsRefsResponse) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *LsRefsResponse) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *LsRefsResponse) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
+// ResponseComplete returns true if the most recent chunk ended a response. More
+// responses may follow.
+func (r *LsRefsResponse) ResponseComplete() bool {
+	return r.state == lsRefsResponseStateBegin && r.curr != nil && r.curr.EndResponse
+}
+
+// Scan advances the scanner to the next packet. It returns false when the scan
+// stops, either by reaching the end of the input or an error. After scan
+// returns false, the Err method will return any error that occurred during
+// scanning, except that if it was io.EOF, Err will return nil.
+func (r *LsRefsResponse) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "LsRefsResponse", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *LsRefsResponse) scan() bool {
+	if r.err != nil || r.state == lsRefsResponseStateEnd {
+		return false
+	}
+	if !r.scanner.Scan() {
+		r.err = r.scanner.Err()
+		if r.err == nil && r.state != lsRefsResponseStateBegin {
+			r.err = SyntaxError("early EOF")
+		}
+		return false
+	}
+
+	switch p := r.scanner.Packet().(type) {
+	case FlushPacket:
+		r.state = lsRefsResponseStateBegin
+		r.curr = &LsRefsResponseChunk{
+			EndResponse: true,
+		}
+		return true
+	case BytesPacket:
+		c, err := r.parseLine(strings.TrimSuffix(string(p), "\n"))
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.state = lsRefsResponseStateScanRefs
+		r.curr = c
+		return true
+	default:
+		r.err = SyntaxError(fmt.Sprintf("unexpected packet: %#v", p))
+		return false
+	}
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *LsRefsResponse) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *LsRefsResponse) Chunks() iter.Seq2[*LsRefsResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+func (r *LsRefsResponse) parseLine(line string) (*LsRefsResponseChunk, error) {
+	ss := strings.Split(line, " ")
+	if len(ss) < 2 || ss[0] == "" || ss[1] == "" {
+		return nil, SyntaxError(fmt.Sprintf("cannot parse the ls-refs line: %q", line))
+	}
+	c := &LsRefsResponseChunk{Ref: ss[1]}
+	if ss[0] == "unborn" {
+		c.Unborn = true
+	} else {
+		if err := r.format.check(ss[0]); err != nil {
+			return nil, err
+		}
+		c.ObjectID = ss[0]
+	}
+	// Unknown attributes are ignored as Git does.
+	for _, attr := range ss[2:] {
+		switch {
+		case strings.HasPrefix(attr, "symref-target:"):
+			c.SymrefTarget = strings.TrimPrefix(attr, "symref-target:")
+		case strings.HasPrefix(attr, "peeled:"):
+			c.Peeled = strings.TrimPrefix(attr, "peeled:")
+			if err := r.format.check(c.Peeled); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
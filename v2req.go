@@ -16,8 +16,10 @@ package gitprotocolio
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"iter"
 	"strings"
 )
 
@@ -30,6 +32,20 @@ const (
 	protocolV2RequestStateEnd
 )
 
+func (s protocolV2RequestState) String() string {
+	switch s {
+	case protocolV2RequestStateBegin:
+		return "Begin"
+	case protocolV2RequestStateScanCapabilities:
+		return "ScanCapabilities"
+	case protocolV2RequestStateScanArguments:
+		return "ScanArguments"
+	case protocolV2RequestStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
 // ProtocolV2RequestChunk is a chunk of a protocol v2 request.
 type ProtocolV2RequestChunk struct {
 	Command       string
@@ -60,12 +76,95 @@ func (c *ProtocolV2RequestChunk) EncodeToPktLine() []byte {
 	panic("impossible chunk")
 }
 
+// kind returns the name of the chunk type for the errors, or "" for an
+// impossible chunk.
+func (c *ProtocolV2RequestChunk) kind() string {
+	switch {
+	case c.Command != "":
+		return "a command"
+	case c.Capability != "":
+		return "a capability"
+	case c.EndCapability:
+		return "the end of capabilities"
+	case len(c.Argument) != 0:
+		return "an argument"
+	case c.EndArgument:
+		return "the end of arguments"
+	case c.EndRequest:
+		return "the end of the request"
+	}
+	return ""
+}
+
+// ProtocolV2RequestEncoder writes protocol v2 requests chunk by chunk, in the
+// order ProtocolV2Request reads. Multiple commands can be written back to back,
+// as in a stateful connection.
+type ProtocolV2RequestEncoder struct {
+	w     chunkWriter
+	state protocolV2RequestState
+}
+
+// NewProtocolV2RequestEncoder returns a new ProtocolV2RequestEncoder that
+// writes to w.
+func NewProtocolV2RequestEncoder(w io.Writer) *ProtocolV2RequestEncoder {
+	return &ProtocolV2RequestEncoder{w: chunkWriter{w: w}}
+}
+
+// SetTrace makes the encoder call f for every chunk it writes, with ClientToServer
+// as the direction. See TraceFunc.
+func (e *ProtocolV2RequestEncoder) SetTrace(f TraceFunc) {
+	e.w.setTrace(ClientToServer, f)
+}
+
+// WriteChunk writes the chunk. It returns an error without writing if the
+// chunk cannot follow the previous one, such as an argument before the end of
+// capabilities.
+func (e *ProtocolV2RequestEncoder) WriteChunk(c *ProtocolV2RequestChunk) error {
+	if e.w.err != nil {
+		return e.w.err
+	}
+	var ok bool
+	var next protocolV2RequestState
+	kind := c.kind()
+	switch kind {
+	case "a command":
+		ok = e.state == protocolV2RequestStateBegin
+		next = protocolV2RequestStateScanCapabilities
+	case "a capability", "the end of capabilities":
+		ok = e.state == protocolV2RequestStateScanCapabilities
+		next = protocolV2RequestStateScanCapabilities
+		if c.EndCapability {
+			next = protocolV2RequestStateScanArguments
+		}
+	case "an argument", "the end of arguments":
+		ok = e.state == protocolV2RequestStateScanArguments
+		next = protocolV2RequestStateScanArguments
+		if c.EndArgument {
+			next = protocolV2RequestStateBegin
+		}
+	case "the end of the request":
+		ok = e.state == protocolV2RequestStateBegin
+		next = protocolV2RequestStateEnd
+	}
+	if !ok {
+		return e.w.orderError(kind)
+	}
+	if err := e.w.write(kind, c, c.EncodeToPktLine()); err != nil {
+		return err
+	}
+	e.state = next
+	return nil
+}
+
 // ProtocolV2Request provides an interface for reading a protocol v2 request.
 type ProtocolV2Request struct {
 	scanner *PacketScanner
 	state   protocolV2RequestState
 	err     error
 	curr    *ProtocolV2RequestChunk
+	policy  *UploadPackPolicy
+	command string
+	caps    []string
 }
 
 // NewProtocolV2Request returns a new ProtocolV2Request to read from rd.
@@ -87,11 +186,84 @@ func (r *ProtocolV2Request) Chunk() *ProtocolV2RequestChunk {
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV2Request) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetPolicy makes the parser stop with an ErrorPacket when a request violates
+// the policy. The required capabilities are checked for every command, and
+// the arguments only for the fetch command.
+func (r *ProtocolV2Request) SetPolicy(p *UploadPackPolicy) {
+	r.policy = p
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV2Request) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV2Request) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ClientToServer as
+// the direction. See TraceFunc.
+func (r *ProtocolV2Request) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ClientToServer, f)
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV2Request) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV2Request", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	if r.policy != nil {
+		if err := r.checkPolicy(r.curr); err != nil {
+			r.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV2Request) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV2Request) Chunks() iter.Seq2[*ProtocolV2RequestChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
+
+func (r *ProtocolV2Request) checkPolicy(c *ProtocolV2RequestChunk) error {
+	switch {
+	case c.Command != "":
+		r.command = c.Command
+		r.caps = nil
+	case c.Capability != "":
+		r.caps = append(r.caps, c.Capability)
+	case c.EndCapability:
+		return r.policy.CheckCapabilities(r.caps)
+	case len(c.Argument) != 0 && r.command == "fetch":
+		return r.policy.CheckProtocolV2FetchArgument(string(c.Argument))
+	}
+	return nil
+}
+
+func (r *ProtocolV2Request) scan() bool {
 	if r.err != nil || r.state == protocolV2RequestStateEnd {
 		return false
 	}
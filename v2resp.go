@@ -15,8 +15,10 @@
 package gitprotocolio
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"iter"
 )
 
 type protocolV2ResponseState int
@@ -27,6 +29,18 @@ const (
 	protocolV2ResponseStateEnd
 )
 
+func (s protocolV2ResponseState) String() string {
+	switch s {
+	case protocolV2ResponseStateBegin:
+		return "Begin"
+	case protocolV2ResponseStateScanResponse:
+		return "ScanResponse"
+	case protocolV2ResponseStateEnd:
+		return "End"
+	}
+	return "unknown"
+}
+
 // ProtocolV2ResponseChunk is a chunk of a protocol v2 response.
 type ProtocolV2ResponseChunk struct {
 	Response    []byte
@@ -49,6 +63,10 @@ func (c *ProtocolV2ResponseChunk) EncodeToPktLine() []byte {
 }
 
 // ProtocolV2Response provides an interface for reading a protocol v2 response.
+//
+// The input can have multiple responses back to back, as in a stateful
+// connection. Each response ends with an EndResponse chunk, after which
+// ResponseComplete returns true and Scan continues to the next response.
 type ProtocolV2Response struct {
 	scanner *PacketScanner
 	state   protocolV2ResponseState
@@ -75,11 +93,50 @@ func (r *ProtocolV2Response) Chunk() *ProtocolV2ResponseChunk {
 	return r.curr
 }
 
+// TotalWireBytes returns the number of bytes consumed from the input so far,
+// including the packet length prefixes.
+func (r *ProtocolV2Response) TotalWireBytes() int64 {
+	return r.scanner.TotalWireBytes()
+}
+
+// SetRateLimiter sets the limiter consulted after every packet read. See
+// PacketScanner.SetRateLimiter.
+func (r *ProtocolV2Response) SetRateLimiter(l RateLimiter) {
+	r.scanner.SetRateLimiter(l)
+}
+
+// SetTee makes the parser write the bytes it consumes to w. See
+// PacketScanner.SetTee.
+func (r *ProtocolV2Response) SetTee(w io.Writer) {
+	r.scanner.SetTee(w)
+}
+
+// SetTrace makes the parser call f for every chunk it reads, with ServerToClient as
+// the direction. See TraceFunc.
+func (r *ProtocolV2Response) SetTrace(f TraceFunc) {
+	r.scanner.setTrace(ServerToClient, f)
+}
+
+// ResponseComplete returns true if the most recent chunk ended a response. More
+// responses may follow.
+func (r *ProtocolV2Response) ResponseComplete() bool {
+	return r.state == protocolV2ResponseStateBegin && r.curr != nil && r.curr.EndResponse
+}
+
 // Scan advances the scanner to the next packet. It returns false when the scan
 // stops, either by reaching the end of the input or an error. After scan
 // returns false, the Err method will return any error that occurred during
 // scanning, except that if it was io.EOF, Err will return nil.
 func (r *ProtocolV2Response) Scan() bool {
+	if !r.scan() {
+		r.err = r.scanner.parseError(r.err, "ProtocolV2Response", r.state.String())
+		return false
+	}
+	r.scanner.traceChunk(r.curr)
+	return true
+}
+
+func (r *ProtocolV2Response) scan() bool {
 	if r.err != nil || r.state == protocolV2ResponseStateEnd {
 		return false
 	}
@@ -115,3 +172,15 @@ func (r *ProtocolV2Response) Scan() bool {
 		return false
 	}
 }
+
+// ScanContext is Scan with the reads bound to ctx. See
+// PacketScanner.ScanContext.
+func (r *ProtocolV2Response) ScanContext(ctx context.Context) bool {
+	return r.scanner.scanContext(ctx, r.Scan)
+}
+
+// Chunks returns an iterator over the remaining chunks. It calls Scan
+// until it returns false, and yields the error of Err at the end if any.
+func (r *ProtocolV2Response) Chunks() iter.Seq2[*ProtocolV2ResponseChunk, error] {
+	return scanSeq(r.Scan, r.Chunk, r.Err)
+}
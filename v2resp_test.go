@@ -0,0 +1,42 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestProtocolV2ResponseBackToBack(t *testing.T) {
+	r := NewProtocolV2Response(strings.NewReader(pktLines("a\n", "0000", "b\n", "c\n", "0000")))
+	var complete []bool
+	for r.Scan() {
+		complete = append(complete, r.ResponseComplete())
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[false true false false true]"; fmt.Sprint(complete) != want {
+		t.Errorf("got %s, want %s", fmt.Sprint(complete), want)
+	}
+
+	r = NewProtocolV2Response(strings.NewReader(pktLines("a\n", "0000", "b\n")))
+	for r.Scan() {
+	}
+	if r.Err() == nil {
+		t.Error("got no error for the second response cut in the middle")
+	}
+}
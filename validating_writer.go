@@ -0,0 +1,89 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+)
+
+// ChunkScanner is the interface implemented by the protocol parsers such as
+// ProtocolV1UploadPackResponse.
+type ChunkScanner interface {
+	Scan() bool
+	Err() error
+	TotalWireBytes() int64
+}
+
+// ValidatingWriter is a WriteFlushCloser that parses the written bytes with a
+// protocol parser and discards them. It's a dry-run replacement of the real
+// output for testing that a handler produces a structurally valid stream.
+type ValidatingWriter struct {
+	pw      *io.PipeWriter
+	done    chan struct{}
+	err     error
+	chunks  int
+	written int64
+}
+
+// NewValidatingWriter returns a new ValidatingWriter that validates the input
+// with the parser created by newScanner, such as
+// NewProtocolV1UploadPackResponse.
+func NewValidatingWriter[S ChunkScanner](newScanner func(io.Reader) S) *ValidatingWriter {
+	pr, pw := io.Pipe()
+	w := &ValidatingWriter{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(w.done)
+		sc := newScanner(pr)
+		for sc.Scan() {
+			w.chunks++
+		}
+		if w.err = sc.Err(); w.err != nil {
+			pr.CloseWithError(w.err)
+			return
+		}
+		// The parser reached the end. Anything after that is not a part
+		// of the stream.
+		n, _ := io.Copy(io.Discard, pr)
+		if consumed := sc.TotalWireBytes(); n != 0 || consumed != w.written {
+			w.err = SyntaxError("trailing data after the end of the stream")
+		}
+	}()
+	return w
+}
+
+// Write parses p. It returns an error if the stream is already invalid.
+func (w *ValidatingWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush does nothing.
+func (w *ValidatingWriter) Flush() error {
+	return nil
+}
+
+// Close ends the stream and returns the validation error if any.
+func (w *ValidatingWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+	return w.err
+}
+
+// Chunks returns the number of chunks parsed. It's valid after Close.
+func (w *ValidatingWriter) Chunks() int {
+	<-w.done
+	return w.chunks
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+import (
+	"io"
+	"testing"
+)
+
+func TestValidatingWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		in         string
+		wantErr    bool
+		wantChunks int
+	}{
+		{"valid", pktLines("argument HEAD\n", "0000"), false, 2},
+		{"early EOF", pktLines("argument HEAD\n"), true, 1},
+		{"bad packet", pktLines("want HEAD\n", "0000"), true, 0},
+		{"trailing data", pktLines("argument HEAD\n", "0000", "argument x\n"), true, 2},
+	} {
+		w := NewValidatingWriter(NewUploadArchiveRequest)
+		// Write the stream in small pieces to split packets across writes.
+		for i := 0; i < len(tc.in); i += 3 {
+			if _, err := io.WriteString(w, tc.in[i:min(i+3, len(tc.in))]); err != nil {
+				break
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Errorf("%s: Flush: %v", tc.name, err)
+		}
+		if err := w.Close(); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if got := w.Chunks(); got != tc.wantChunks {
+			t.Errorf("%s: got %d chunks, want %d", tc.name, got, tc.wantChunks)
+		}
+	}
+}
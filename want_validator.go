@@ -0,0 +1,106 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gitprotocolio
+
+// WantValidator checks the object IDs of want lines against a ref
+// advertisement in the same way as git-upload-pack. An advertised object can
+// always be wanted. Another object can be wanted only if the advertisement has
+// allow-tip-sha1-in-want and the object is the tip of a ref not advertised,
+// such as a hidden ref, or if it has allow-reachable-sha1-in-want and the
+// object is reachable from a ref.
+//
+// Set it to UploadPackPolicy.Wants to check the requests as they're parsed.
+// Protocol v2 has no such capabilities; use the capabilities that a protocol
+// v0 advertisement would have for the same repository.
+type WantValidator struct {
+	allowTip       bool
+	allowReachable bool
+	stateless      bool
+	tips           []string
+	isTip          map[string]bool
+	hiddenTips     []string
+	isHiddenTip    map[string]bool
+	reachable      func(oid string, tips []string) (bool, error)
+}
+
+// NewWantValidator returns a new WantValidator for an advertisement with the
+// capabilities and the object IDs of the advertised refs, including the peeled
+// ones.
+func NewWantValidator(caps Capabilities, tips []string) *WantValidator {
+	return &WantValidator{
+		allowTip:       caps.Has("allow-tip-sha1-in-want"),
+		allowReachable: caps.Has("allow-reachable-sha1-in-want"),
+		tips:           tips,
+		isTip:          objectIDSet(tips),
+	}
+}
+
+// SetHiddenTips sets the object IDs of the refs not advertised, such as hidden
+// refs. They can be wanted with allow-tip-sha1-in-want or
+// allow-reachable-sha1-in-want.
+func (v *WantValidator) SetHiddenTips(tips []string) {
+	v.hiddenTips, v.isHiddenTip = tips, objectIDSet(tips)
+}
+
+// SetReachability sets the function that returns true if an object is
+// reachable from one of the tips. It's called for an object that is not a tip,
+// with the advertised tips, and the hidden ones too with
+// allow-tip-sha1-in-want or allow-reachable-sha1-in-want. If it's not set,
+// only the tips can be wanted.
+func (v *WantValidator) SetReachability(f func(oid string, tips []string) (bool, error)) {
+	v.reachable = f
+}
+
+// SetStatelessRPC sets whether the request is of the stateless-RPC mode used by
+// smart HTTP. A client may want the tip of a ref advertised by an earlier
+// request, so git-upload-pack allows the objects reachable from the tips even
+// without allow-reachable-sha1-in-want.
+func (v *WantValidator) SetStatelessRPC(b bool) {
+	v.stateless = b
+}
+
+// CheckWant returns an ErrorPacket with the message of git-upload-pack if the
+// object cannot be wanted, or the error of the function of SetReachability.
+func (v *WantValidator) CheckWant(oid string) error {
+	if v.isTip[oid] {
+		return nil
+	}
+	allowHidden := v.allowTip || v.allowReachable
+	if allowHidden && v.isHiddenTip[oid] {
+		return nil
+	}
+	if (v.allowReachable || v.stateless) && v.reachable != nil {
+		tips := v.tips
+		if allowHidden {
+			tips = append(tips[:len(tips):len(tips)], v.hiddenTips...)
+		}
+		ok, err := v.reachable(oid, tips)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+	return ErrorPacket("upload-pack: not our ref " + oid)
+}
+
+func objectIDSet(oids []string) map[string]bool {
+	m := make(map[string]bool, len(oids))
+	for _, oid := range oids {
+		m[oid] = true
+	}
+	return m
+}